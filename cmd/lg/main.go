@@ -1,23 +1,32 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
+	"time"
 
-	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/pkg/client"
 	"github.com/nelhage/go.cli/config"
 )
 
 var (
-	server      = flag.String("server", "http://localhost:8910", "The livegrep server to connect to")
-	unixSocket  = flag.String("unix_socket", "", "unix socket path to connect() to as a proxy")
-	showVersion = flag.Bool("show_version", false, "Show versions of matched packages")
+	server       = flag.String("server", "http://localhost:8910", "The livegrep server to connect to")
+	unixSocket   = flag.String("unix_socket", "", "unix socket path to connect() to as a proxy")
+	backend      = flag.String("backend", "", "Search the codesearch backend at this HOST:PORT directly, rather than through -server")
+	index        = flag.String("index", "", "The backend of -server to search, if not its default")
+	showVersion  = flag.Bool("show_version", false, "Show versions of matched packages")
+	format       = flag.String("format", "lg", "Output format: lg, grep (like grep -n) or vimgrep (like rg --vimgrep)")
+	jsonOut      = flag.Bool("json", false, "Print each match as a line of JSON, rather than in -format")
+	fixedStrings = flag.Bool("fixed_strings", false, "Search for the query as a literal string, rather than a regex")
+	filter       = flag.String("filter", "", "Added to every query, such as \"-file:_test\\.go$ repo:^org/\"")
+	maxMatches   = flag.Int("max_matches", 0, "The most matches to return; 0 for the server's default")
+	timeout      = flag.Duration("timeout", 30*time.Second, "How long to wait for the search")
 )
 
 func main() {
@@ -27,29 +36,70 @@ func main() {
 	}
 	if err := config.LoadConfig(flag.CommandLine, "lgrc"); err != nil {
 		fmt.Fprintf(os.Stderr, "Loading config: %s\n", err)
-		os.Exit(1)
+		os.Exit(2)
 	}
 	flag.Parse()
 
 	if len(flag.Args()) == 0 {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(2)
+	}
+	printReply, ok := printers[*format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown -format %q (want lg, grep or vimgrep)\n", *format)
+		os.Exit(2)
+	}
+	if *jsonOut {
+		printReply = printJSON
 	}
 
-	var uri *url.URL
-	var err error
+	c, err := newClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(2)
+	}
+	defer c.Close()
 
-	if strings.Contains(*server, ":") {
-		if uri, err = url.Parse(*server); err != nil {
-			fmt.Fprintf(os.Stderr, "Parsing server %s: %s\n", *server, err.Error())
-			os.Exit(1)
-		}
-	} else {
-		uri = &url.URL{Scheme: "http", Host: *server}
+	query := strings.Join(flag.Args(), " ")
+	if *filter != "" {
+		query += " " + *filter
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	reply, err := c.Search(ctx, &client.Query{
+		Query:      query,
+		Regex:      !*fixedStrings,
+		MaxMatches: *maxMatches,
+		Backend:    *index,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(2)
 	}
 
-	uri.Path = "/api/v1/search/"
-	uri.RawQuery = url.Values{"q": []string{strings.Join(flag.Args(), " ")}}.Encode()
+	out := bufio.NewWriter(os.Stdout)
+	printReply(out, reply)
+	if err := out.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(2)
+	}
+	if reply.Truncated() {
+		fmt.Fprintf(os.Stderr, "Search stopped early (%s); there may be more matches\n", reply.ExitReason)
+	}
+	// Exit as grep does: 1 if nothing matched.
+	if len(reply.Results) == 0 && len(reply.FileResults) == 0 {
+		os.Exit(1)
+	}
+}
+
+func newClient() (client.Client, error) {
+	if *backend != "" {
+		return client.NewGRPC(*backend, nil)
+	}
 
 	var transport http.RoundTripper
 	if *unixSocket == "" {
@@ -64,42 +114,7 @@ func main() {
 			DisableKeepAlives: true,
 		}
 	}
-	client := http.Client{Transport: transport}
-
-	resp, err := client.Get(uri.String())
-
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Requesting %s: %s\n", uri.String(), err.Error())
-		os.Exit(1)
-	}
-
-	if resp.StatusCode != 200 {
-		var reply api.ReplyError
-		if e := json.NewDecoder(resp.Body).Decode(&reply); e != nil {
-			fmt.Fprintf(os.Stderr,
-				"Error reading reply (status=%d): %s\n", resp.StatusCode, e.Error())
-		} else {
-			fmt.Fprintf(os.Stderr, "Error: %s: %s\n", reply.Err.Code, reply.Err.Message)
-		}
-		os.Exit(1)
-	}
-
-	var reply api.ReplySearch
-
-	if e := json.NewDecoder(resp.Body).Decode(&reply); e != nil {
-		fmt.Fprintf(os.Stderr,
-			"Error reading reply (status=%d): %s\n", resp.StatusCode, e.Error())
-		os.Exit(1)
-	}
-
-	for _, r := range reply.Results {
-		if r.Tree != "" {
-			fmt.Printf("%s:", r.Tree)
-		}
-		if *showVersion && r.Version != "" {
-			fmt.Printf("%s:", r.Version)
-		}
-		fmt.Printf("%s:%d: ", r.Path, r.LineNumber)
-		fmt.Printf("%s\n", r.Line)
-	}
+	return client.NewHTTP(*server, &client.Options{
+		HTTPClient: &http.Client{Transport: transport},
+	})
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/livegrep/livegrep/pkg/client"
+	"github.com/livegrep/livegrep/server/api"
+)
+
+// A printer writes the results of a search to w.
+type printer func(w io.Writer, reply *client.Reply)
+
+var printers = map[string]printer{
+	"lg":      printLG,
+	"grep":    printGrep,
+	"vimgrep": printVimgrep,
+}
+
+// printLG prints matches as tree:path:line: text.
+func printLG(w io.Writer, reply *client.Reply) {
+	for _, r := range reply.Results {
+		if r.Tree != "" {
+			fmt.Fprintf(w, "%s:", r.Tree)
+		}
+		if *showVersion && r.Version != "" {
+			fmt.Fprintf(w, "%s:", r.Version)
+		}
+		fmt.Fprintf(w, "%s:%d: ", r.Path, r.LineNumber)
+		fmt.Fprintf(w, "%s\n", r.Line)
+	}
+	printFiles(w, reply)
+}
+
+// printGrep prints matches as grep -n does, as tree/path:line:text.
+func printGrep(w io.Writer, reply *client.Reply) {
+	for _, r := range reply.Results {
+		fmt.Fprintf(w, "%s:%d:%s\n", name(r.Tree, r.Path), r.LineNumber, r.Line)
+	}
+	printFiles(w, reply)
+}
+
+// printVimgrep prints matches as rg --vimgrep does, for editors'
+// quickfix lists: tree/path:line:column:text, with the 1-based byte
+// column the match starts at.
+func printVimgrep(w io.Writer, reply *client.Reply) {
+	for _, r := range reply.Results {
+		fmt.Fprintf(w, "%s:%d:%d:%s\n", name(r.Tree, r.Path), r.LineNumber, r.Bounds[0]+1, r.Line)
+	}
+	printFiles(w, reply)
+}
+
+// printFiles prints the files a file: search matched, one per line,
+// after the matching lines, if any.
+func printFiles(w io.Writer, reply *client.Reply) {
+	for _, f := range reply.FileResults {
+		fmt.Fprintln(w, name(f.Tree, f.Path))
+	}
+}
+
+func name(tree, path string) string {
+	if tree == "" {
+		return path
+	}
+	return tree + "/" + path
+}
+
+// printJSON prints a line of JSON for each match, as /api/v2/search's
+// NDJSON stream does: {"match": ...} for each line and {"file": ...}
+// for each file.
+func printJSON(w io.Writer, reply *client.Reply) {
+	enc := json.NewEncoder(w)
+	for _, r := range reply.Results {
+		enc.Encode(&api.StreamLine{Match: &api.Match{
+			Repo:          r.Tree,
+			Version:       r.Version,
+			Path:          r.Path,
+			LineNumber:    r.LineNumber,
+			Bounds:        r.Bounds,
+			Line:          r.Line,
+			ContextBefore: nonNil(r.ContextBefore),
+			ContextAfter:  nonNil(r.ContextAfter),
+		}})
+	}
+	for _, f := range reply.FileResults {
+		enc.Encode(&api.StreamLine{File: &api.FileMatch{
+			Repo:    f.Tree,
+			Version: f.Version,
+			Path:    f.Path,
+			Bounds:  f.Bounds,
+			Spans:   [][2]int{f.Bounds},
+		}})
+	}
+}
+
+func nonNil(ss []string) []string {
+	if ss == nil {
+		return []string{}
+	}
+	return ss
+}
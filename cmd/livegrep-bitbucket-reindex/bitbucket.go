@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// pageLimit is how many repositories to ask for in each page.
+const pageLimit = 100
+
+// A Repository is the part of a Bitbucket Server repository the config
+// is built from.
+type Repository struct {
+	ID      int    `json:"id"`
+	Slug    string `json:"slug"`
+	Project struct {
+		Key string `json:"key"`
+	} `json:"project"`
+	// Set if the repository is a fork, to the one it was forked from
+	Origin   *Repository `json:"origin"`
+	Archived bool        `json:"archived"`
+	Links    struct {
+		Clone []struct {
+			Href string `json:"href"`
+			Name string `json:"name"`
+		} `json:"clone"`
+		Self []struct {
+			Href string `json:"href"`
+		} `json:"self"`
+	} `json:"links"`
+}
+
+// FullName names the repository as PROJECT/slug, or ~USER/slug for a
+// personal repository.
+func (r *Repository) FullName() string {
+	return r.Project.Key + "/" + r.Slug
+}
+
+// CloneURL returns the URL to clone the repository from over scheme,
+// "http" or "ssh".
+func (r *Repository) CloneURL(scheme string) string {
+	for _, l := range r.Links.Clone {
+		if l.Name == scheme {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+// WebURL returns the repository's page, where its files are browsed.
+func (r *Repository) WebURL() string {
+	if len(r.Links.Self) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(r.Links.Self[0].Href, "/browse")
+}
+
+// A client talks to the 1.0 REST API of a Bitbucket Server or Data
+// Center instance.
+type client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newClient(base, token string) *client {
+	return &client{
+		base:  strings.TrimSuffix(base, "/") + "/rest/api/1.0",
+		token: token,
+		http:  http.DefaultClient,
+	}
+}
+
+func (c *client) get(path string, params url.Values, out interface{}) error {
+	req, err := http.NewRequest("GET", c.base+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// list fetches every page of the repositories at path.
+func (c *client) list(path string) ([]*Repository, error) {
+	var out []*Repository
+	params := url.Values{"limit": {strconv.Itoa(pageLimit)}}
+	for start := 0; ; {
+		params.Set("start", strconv.Itoa(start))
+		var page struct {
+			Values        []*Repository `json:"values"`
+			IsLastPage    bool          `json:"isLastPage"`
+			NextPageStart int           `json:"nextPageStart"`
+		}
+		if err := c.get(path, params, &page); err != nil {
+			return nil, err
+		}
+		out = append(out, page.Values...)
+		if page.IsLastPage || page.NextPageStart <= start {
+			return out, nil
+		}
+		start = page.NextPageStart
+	}
+}
+
+// ProjectRepos lists the repositories of the project key, which may be
+// a ~USER for a user's personal repositories.
+func (c *client) ProjectRepos(key string) ([]*Repository, error) {
+	return c.list("/projects/" + url.PathEscape(key) + "/repos")
+}
+
+// Repo loads the repository PROJECT/slug.
+func (c *client) Repo(fullName string) (*Repository, error) {
+	bits := strings.SplitN(fullName, "/", 2)
+	if len(bits) != 2 {
+		return nil, fmt.Errorf("Bad repository: %s", fullName)
+	}
+	var r Repository
+	if err := c.get("/projects/"+url.PathEscape(bits[0])+"/repos/"+url.PathEscape(bits[1]), url.Values{}, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// AllRepos lists every repository the token can see.
+func (c *client) AllRepos() ([]*Repository, error) {
+	return c.list("/repos")
+}
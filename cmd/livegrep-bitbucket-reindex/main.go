@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/reindex"
+	"github.com/livegrep/livegrep/pkg/sentry"
+)
+
+var (
+	flagApiBaseUrl   = flag.String("api-base-url", "https://bitbucket.example.com", "Bitbucket Server base url")
+	flagToken        = flag.String("bitbucket-token", os.Getenv("BITBUCKET_TOKEN"), "Bitbucket personal or HTTP access token")
+	flagUrlPattern   = flag.String("url-pattern", "", "when using the local frontend fileviewer, this string will be used to construt a link to the file source on bitbucket; by default, each repository's page with /browse/{path}?at={version}#L{lno}")
+	flagForks        = flag.Bool("forks", true, "whether to index repositories that are forks, and not original repos")
+	flagArchived     = flag.Bool("archived", false, "whether to index repositories that are archived on bitbucket")
+	flagHTTP         = flag.Bool("http", false, "clone repositories over HTTPS instead of SSH")
+	flagHTTPUsername = flag.String("http-user", os.Getenv("BITBUCKET_USER"), "The username to clone over https as, with the token as the password")
+
+	flagRepos    reindex.StringList
+	flagProjects reindex.StringList
+
+	common = reindex.RegisterFlags(flag.CommandLine, reindex.FlagOptions{Forks: true})
+)
+
+func init() {
+	flag.Var(&flagRepos, "repo", "Specify a repo to index, as PROJECT/slug (may be passed multiple times)")
+	flag.Var(&flagProjects, "project", "Specify a bitbucket project to index, by key, or ~USER for a user's personal repositories (may be passed multiple times)")
+}
+
+func main() {
+	flag.Parse()
+	if err := logging.Init("bitbucket-reindex"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := sentry.Init("bitbucket-reindex"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer sentry.Recover()
+
+	configPath, err := common.ConfigPath()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	opts, err := common.Options()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	opts.URLPattern = *flagUrlPattern
+	ignorelist, allowlist, err := common.RepoLists()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	bitbucket := newClient(*flagApiBaseUrl, *flagToken)
+	repos, err := loadRepos(bitbucket, flagRepos, flagProjects)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	repos = filterRepos(repos, ignorelist, allowlist, !*flagForks, !*flagArchived)
+	toIndex := toRepos(repos)
+	reindex.SortByName(toIndex)
+
+	sentry.SetTag("config", common.Name)
+	cfg := reindex.BuildConfig(toIndex, opts)
+	if err := common.WriteConfig(configPath, cfg); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if common.DryRun {
+		return
+	}
+
+	fr := common.NewFetchReindex()
+	if *flagToken != "" {
+		fr.Env = []string{"BITBUCKET_TOKEN=" + *flagToken}
+	}
+	if _, err := fr.Run(context.Background(), configPath, nil); err != nil {
+		log.Fatalln(err.Error())
+	}
+}
+
+// loadRepos loads the repositories named by repos and those of
+// projects, each once, or, if neither is given, every repository the
+// token can see.
+func loadRepos(bitbucket *client, repos, projects []string) ([]*Repository, error) {
+	var out []*Repository
+	seen := map[int]bool{}
+	add := func(rs []*Repository) {
+		for _, r := range rs {
+			if !seen[r.ID] {
+				seen[r.ID] = true
+				out = append(out, r)
+			}
+		}
+	}
+
+	if len(repos) == 0 && len(projects) == 0 {
+		rs, err := bitbucket.AllRepos()
+		if err != nil {
+			return nil, fmt.Errorf("listing repositories: %s", err.Error())
+		}
+		add(rs)
+		return out, nil
+	}
+	for _, repo := range repos {
+		r, err := bitbucket.Repo(repo)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %s", repo, err.Error())
+		}
+		add([]*Repository{r})
+	}
+	for _, project := range projects {
+		rs, err := bitbucket.ProjectRepos(project)
+		if err != nil {
+			return nil, fmt.Errorf("listing project %s: %s", project, err.Error())
+		}
+		add(rs)
+	}
+	return out, nil
+}
+
+func filterRepos(repos []*Repository,
+	ignorelist, allowlist *indexspec.RepoList,
+	excludeForks, excludeArchived bool) []*Repository {
+	var out []*Repository
+
+	for _, r := range repos {
+		if excludeForks && r.Origin != nil {
+			logging.With("repo", r.FullName()).Infof("Excluding fork %s...", r.FullName())
+			continue
+		}
+		if excludeArchived && r.Archived {
+			logging.With("repo", r.FullName()).Infof("Excluding archived %s...", r.FullName())
+			continue
+		}
+		if !indexspec.Allowed(r.FullName(), ignorelist, allowlist) {
+			continue
+		}
+		out = append(out, r)
+	}
+
+	return out
+}
+
+// toRepos returns how to index repos.
+func toRepos(repos []*Repository) []*reindex.Repo {
+	var passwordEnv string
+	if *flagToken != "" {
+		passwordEnv = "BITBUCKET_TOKEN"
+	}
+	out := make([]*reindex.Repo, len(repos))
+	for i, r := range repos {
+		remote := r.CloneURL("ssh")
+		if *flagHTTP {
+			remote = r.CloneURL("http")
+		}
+		out[i] = &reindex.Repo{
+			Name:        r.FullName(),
+			Remote:      remote,
+			WebURL:      r.WebURL(),
+			URLPattern:  r.WebURL() + "/browse/{path}?at={version}#L{lno}",
+			Username:    *flagHTTPUsername,
+			PasswordEnv: passwordEnv,
+		}
+		if r.Origin != nil {
+			out[i].Parent = r.Origin.FullName()
+		}
+	}
+	return out
+}
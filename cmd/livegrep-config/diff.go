@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+)
+
+func diff(flags *flag.FlagSet, args []string) int {
+	format := flags.String("format", "text", "output format (text or json)")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		return 2
+	}
+
+	oldSpec, err := indexspec.Load(flags.Arg(0))
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+	newSpec, err := indexspec.Load(flags.Arg(1))
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+
+	d, err := indexspec.Diff(oldSpec, newSpec)
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(d)
+	} else {
+		d.WriteText(os.Stdout)
+	}
+
+	// Like diff(1), exit 1 if the configs differ.
+	if !d.Empty() {
+		return 1
+	}
+	return 0
+}
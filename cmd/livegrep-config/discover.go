@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+func discover(flags *flag.FlagSet, args []string) int {
+	dir := flags.String("dir", "repos", "directory of git clones to scan")
+	name := flags.String("name", "", "name of the generated index")
+	out := flags.String("out", "", "write the config here instead of to stdout; the format follows the extension")
+	format := flags.String("format", "json", "format to write to stdout (json or yaml)")
+	urlPattern := flags.String("url-pattern", "", "url_pattern to set on every repository")
+	revision := flags.String("revision", "", "revision to index in every repository, instead of its default branch")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	repos, err := findRepos(*dir)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	if len(repos) == 0 {
+		log.Printf("no git repositories found in %s", *dir)
+		return 1
+	}
+
+	spec := &config.IndexSpec{Name: *name}
+	for _, r := range repos {
+		repo, err := describeRepo(*dir, r, *revision)
+		if err != nil {
+			log.Printf("%s: %s, skipping", r, err.Error())
+			continue
+		}
+		if *urlPattern != "" {
+			repo.Metadata.UrlPattern = *urlPattern
+		}
+		spec.Repositories = append(spec.Repositories, repo)
+	}
+
+	if *out != "" {
+		if err := indexspec.Write(*out, spec); err != nil {
+			log.Println(err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	f, err := indexspec.ParseFormat(*format)
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+	data, err := indexspec.Marshal(spec, f)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	os.Stdout.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		fmt.Println()
+	}
+	return 0
+}
+
+// findRepos returns the git repositories below root, sorted by path.
+// It does not descend into repositories it finds.
+func findRepos(root string) ([]string, error) {
+	var repos []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != root && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if isBareRepo(path) || exists(filepath.Join(path, ".git")) {
+			repos = append(repos, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	sort.Strings(repos)
+	return repos, err
+}
+
+func isBareRepo(path string) bool {
+	return exists(filepath.Join(path, "HEAD")) &&
+		exists(filepath.Join(path, "objects")) &&
+		exists(filepath.Join(path, "refs"))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// describeRepo builds the RepoSpec for the clone at path. The name is
+// the clone's path relative to root, without any ".git" suffix.
+func describeRepo(root, path, revision string) (*config.RepoSpec, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.ToSlash(strings.TrimSuffix(rel, ".git"))
+	if rel == "." {
+		name = filepath.Base(strings.TrimSuffix(path, ".git"))
+	}
+
+	if !isBareRepo(path) {
+		log.Printf("%s: not a bare clone; livegrep-fetch-reindex will replace it with a mirror clone", path)
+	}
+
+	if revision == "" {
+		if revision, err = git(path, "symbolic-ref", "--short", "HEAD"); err != nil {
+			if revision, err = git(path, "rev-parse", "HEAD"); err != nil {
+				return nil, fmt.Errorf("cannot determine the default branch")
+			}
+		}
+	}
+	remote, _ := git(path, "config", "--get", "remote.origin.url")
+
+	return &config.RepoSpec{
+		Name:      name,
+		Path:      path,
+		Revisions: []string{revision},
+		Metadata: &config.Metadata{
+			Remote: remote,
+		},
+	}, nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Stderr = ioutil.Discard
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
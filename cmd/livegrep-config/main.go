@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(flags *flag.FlagSet, args []string) int
+}
+
+var commands = []command{
+	{"validate", "[flags] CONFIG...", "check index configs for mistakes", validate},
+	{"discover", "[flags]", "generate a config from a directory of git clones", discover},
+	{"diff", "[flags] OLD NEW", "report repositories added, removed or changed between two configs", diff},
+	{"render", "[flags] SOURCE", "generate a config from a Jsonnet program or Go template", render},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s COMMAND [flags] ARGS...\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s COMMAND -h' for help with a command.\n", os.Args[0])
+}
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		c := c
+		flags := flag.NewFlagSet(c.name, flag.ExitOnError)
+		flags.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], c.name, c.usage)
+			flags.PrintDefaults()
+		}
+		os.Exit(c.run(flags, os.Args[2:]))
+	}
+	usage()
+	os.Exit(2)
+}
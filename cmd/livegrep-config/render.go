@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+)
+
+// keyValues collects repeated key=value flags.
+type keyValues struct {
+	keys   []string
+	values map[string]string
+}
+
+func (kv *keyValues) String() string {
+	var pairs []string
+	for _, k := range kv.keys {
+		pairs = append(pairs, k+"="+kv.values[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (kv *keyValues) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	if kv.values == nil {
+		kv.values = map[string]string{}
+	}
+	k := s[:i]
+	if _, ok := kv.values[k]; !ok {
+		kv.keys = append(kv.keys, k)
+	}
+	kv.values[k] = s[i+1:]
+	return nil
+}
+
+func render(flags *flag.FlagSet, args []string) int {
+	out := flags.String("o", "", "write the config here instead of to stdout; the format follows the extension")
+	format := flags.String("format", "json", "format to write to stdout (json or yaml)")
+	var vars, varFiles keyValues
+	var libPaths stringList
+	flags.Var(&vars, "var", "make the string `key=value` available as std.extVar(key) in Jsonnet, or {{.Vars.key}} in a template (repeatable)")
+	flags.Var(&varFiles, "var-file", "like -var, but the value is the JSON or YAML document at `key=path`, e.g. a list of repositories (repeatable)")
+	flags.Var(&libPaths, "J", "add `dir` to the Jsonnet library search path (repeatable)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	src := flags.Arg(0)
+
+	docs := map[string]interface{}{}
+	for _, k := range varFiles.keys {
+		v, err := readDocument(varFiles.values[k])
+		if err != nil {
+			log.Printf("-var-file %s: %s", k, err.Error())
+			return 2
+		}
+		docs[k] = v
+	}
+
+	var data []byte
+	var srcFormat indexspec.Format
+	var err error
+	if isJsonnet(src) {
+		data, err = renderJsonnet(src, &vars, docs, libPaths)
+		srcFormat = indexspec.JSON
+	} else {
+		data, err = renderTemplate(src, &vars, docs)
+		srcFormat = indexspec.FormatForPath(strings.TrimSuffix(src, filepath.Ext(src)))
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	if err := indexspec.CheckSchema(data, srcFormat); err != nil {
+		log.Printf("%s: generated config is invalid: %s", src, err.Error())
+		return 1
+	}
+
+	outFormat := indexspec.FormatForPath(*out)
+	if *out == "" {
+		if outFormat, err = indexspec.ParseFormat(*format); err != nil {
+			log.Println(err.Error())
+			return 2
+		}
+	}
+	if outFormat != srcFormat {
+		if outFormat == indexspec.JSON {
+			data, err = indexspec.ToJSON(data)
+		} else {
+			// Keep any comments from the last rendering of the file.
+			previous, _ := ioutil.ReadFile(*out)
+			data, err = indexspec.FromJSON(data, previous)
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return 1
+		}
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+
+	if *out == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	return 0
+}
+
+func isJsonnet(path string) bool {
+	switch filepath.Ext(path) {
+	case ".jsonnet", ".libsonnet":
+		return true
+	}
+	return false
+}
+
+// readDocument decodes the JSON or YAML document at path into plain Go
+// values.
+func readDocument(path string) (interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if indexspec.FormatForPath(path) == indexspec.YAML {
+		if data, err = indexspec.ToJSON(data); err != nil {
+			return nil, err
+		}
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return v, nil
+}
+
+// renderJsonnet evaluates a Jsonnet program. -var values are string
+// external variables and -var-file values are code external variables;
+// std.native("env")(name) reads the environment.
+func renderJsonnet(path string, vars *keyValues, docs map[string]interface{}, libPaths []string) ([]byte, error) {
+	vm := jsonnet.MakeVM()
+	vm.Importer(&jsonnet.FileImporter{JPaths: libPaths})
+	for _, k := range vars.keys {
+		vm.ExtVar(k, vars.values[k])
+	}
+	for k, v := range docs {
+		code, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		vm.ExtCode(k, string(code))
+	}
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "env",
+		Params: ast.Identifiers{"name"},
+		Func: func(args []interface{}) (interface{}, error) {
+			name, ok := args[0].(string)
+			if !ok {
+				return nil, errors.New("env: name must be a string")
+			}
+			return lookupEnv(name)
+		},
+	})
+
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	out, err := vm.EvaluateAnonymousSnippet(path, string(src))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+// renderTemplate executes a Go text/template. The template sees -var
+// values as .Vars and -var-file documents as .Files, for instance
+// {{range .Files.repos}}.
+func renderTemplate(path string, vars *keyValues, docs map[string]interface{}) ([]byte, error) {
+	funcs := template.FuncMap{
+		"env": lookupEnv,
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"quote": strconv.Quote,
+	}
+	tmpl, err := template.New(filepath.Base(path)).
+		Funcs(funcs).
+		Option("missingkey=error").
+		ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, map[string]interface{}{
+		"Vars":  vars.values,
+		"Files": docs,
+	})
+	return buf.Bytes(), err
+}
+
+// lookupEnv returns the value of an environment variable, failing if it
+// is unset so that a typo does not silently render an empty value.
+func lookupEnv(name string) (interface{}, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
+// stringList collects repeated string flags.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// credentialHelper hands git the credentials from the environment of the
+// ls-remote it is run for, so they never touch the command line.
+const credentialHelper = `!f() { test "$1" = get || exit 0; ` +
+	`test -n "$LIVEGREP_USERNAME" && echo "username=$LIVEGREP_USERNAME"; ` +
+	`test -n "$LIVEGREP_PASSWORD" && echo "password=$LIVEGREP_PASSWORD"; }; f`
+
+func validate(flags *flag.FlagSet, args []string) int {
+	network := flags.Bool("network", false, "also check that every repository's remote is reachable")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout for each remote check")
+	workers := flags.Int("num-workers", 8, "number of remotes to check concurrently")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	spec, err := indexspec.LoadStrict(flags.Args()...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	problems := indexspec.Validate(spec)
+	if *network {
+		problems = append(problems, checkRemotes(spec, *timeout, *workers)...)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p.String())
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+		return 1
+	}
+	return 0
+}
+
+// checkRemotes runs `git ls-remote` against the remote of every
+// repository, using the repository's clone credentials.
+func checkRemotes(spec *config.IndexSpec, timeout time.Duration, workers int) []indexspec.Problem {
+	type result struct {
+		i   int
+		err error
+	}
+	jobs := make(chan int)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results <- result{i, lsRemote(spec.Repositories[i], timeout)}
+			}
+		}()
+	}
+	go func() {
+		for i, r := range spec.Repositories {
+			if r.GetMetadata().GetRemote() != "" {
+				jobs <- i
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	errs := make([]error, len(spec.Repositories))
+	for r := range results {
+		errs[r.i] = r.err
+	}
+
+	var problems []indexspec.Problem
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		r := spec.Repositories[i]
+		problems = append(problems, indexspec.Problem{
+			Where:   fmt.Sprintf("repositories[%d] (%s)", i, r.Name),
+			Message: fmt.Sprintf("remote %s is not reachable: %s", r.Metadata.Remote, err.Error()),
+		})
+	}
+	return problems
+}
+
+func lsRemote(r *config.RepoSpec, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", "-c", "credential.helper=",
+		"-c", "credential.helper="+credentialHelper,
+		"ls-remote", "--heads", r.Metadata.Remote)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if c := r.CloneOptions; c != nil {
+		password, err := indexspec.Password(c)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env,
+			"LIVEGREP_USERNAME="+c.Username,
+			"LIVEGREP_PASSWORD="+password)
+	}
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		if len(out) > 0 {
+			return fmt.Errorf("%s", gitError(out))
+		}
+		return err
+	}
+	return nil
+}
+
+// gitError picks the most useful line out of git's error output.
+func gitError(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	for _, l := range lines {
+		if strings.HasPrefix(l, "fatal: ") {
+			return strings.TrimPrefix(l, "fatal: ")
+		}
+	}
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// references maps the name of each repository in the config to its
+// spec, for finding the clones that clone_options.reference names.
+var references map[string]*config.RepoSpec
+
+func setReferences(repos []*config.RepoSpec) {
+	references = make(map[string]*config.RepoSpec, len(repos))
+	for _, r := range repos {
+		references[r.Name] = r
+	}
+}
+
+// reference returns the spec of the repository r borrows objects from,
+// or nil if it doesn't.
+func reference(r *config.RepoSpec) *config.RepoSpec {
+	if r.CloneOptions == nil || r.CloneOptions.Reference == "" {
+		return nil
+	}
+	ref := references[r.CloneOptions.Reference]
+	if ref == r {
+		return nil
+	}
+	return ref
+}
+
+// cloneWaves splits repos into batches to fetch one after another, so
+// that each repository is fetched after the one it borrows objects
+// from, if that is being fetched too. Without references, that's a
+// single batch of all of them.
+func cloneWaves(repos []*config.RepoSpec) [][]*config.RepoSpec {
+	fetching := make(map[*config.RepoSpec]bool, len(repos))
+	for _, r := range repos {
+		fetching[r] = true
+	}
+	depth := make(map[*config.RepoSpec]int, len(repos))
+	var level func(r *config.RepoSpec, seen int) int
+	level = func(r *config.RepoSpec, seen int) int {
+		if d, ok := depth[r]; ok {
+			return d
+		}
+		d := 0
+		// seen bounds a cycle of references, which git would refuse
+		// anyway.
+		if ref := reference(r); ref != nil && fetching[ref] && seen < len(repos) {
+			d = level(ref, seen+1) + 1
+		}
+		depth[r] = d
+		return d
+	}
+	var waves [][]*config.RepoSpec
+	for _, r := range repos {
+		d := level(r, 0)
+		for len(waves) <= d {
+			waves = append(waves, nil)
+		}
+		waves[d] = append(waves[d], r)
+	}
+	return waves
+}
+
+// usableReference returns the clone r can borrow objects from: that of
+// its reference, if it has been cloned in full. git can't borrow from a
+// shallow or a partial clone.
+func usableReference(r *config.RepoSpec) string {
+	ref := reference(r)
+	if ref == nil {
+		return ""
+	}
+	out, err := gitCommand("--git-dir", ref.Path, "rev-parse", "--is-bare-repository").Output()
+	if err != nil || strings.TrimSpace(string(out)) != "true" {
+		return ""
+	}
+	if isShallow(ref.Path) || isPartial(ref.Path) {
+		logging.With("repo", r.Name).Warnf("Not sharing objects with %s, which is cloned shallow or partially", ref.Name)
+		return ""
+	}
+	abs, err := filepath.Abs(ref.Path)
+	if err != nil {
+		return ""
+	}
+	return abs
+}
+
+// keepObjects stops gc in the clone at gitDir from pruning the objects
+// nothing in it refers to any more, such as those of a force-pushed
+// branch, since a clone borrowing from it may still refer to them.
+func keepObjects(gitDir string) error {
+	return gitCommand("--git-dir", gitDir, "config", "gc.pruneExpire", "never").Run()
+}
+
+func alternatesFile(gitDir string) string {
+	return filepath.Join(gitDir, "objects", "info", "alternates")
+}
+
+// alternates returns the object directories the clone at gitDir
+// borrows from.
+func alternates(gitDir string) []string {
+	f, err := os.Open(alternatesFile(gitDir))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var out []string
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(gitDir, "objects", line)
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// brokenAlternates reports whether the clone at gitDir borrows from an
+// object directory that is gone, such as that of a clone that has been
+// removed and so can't be fetched into.
+func brokenAlternates(gitDir string) bool {
+	for _, dir := range alternates(gitDir) {
+		if _, err := os.Stat(dir); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// shareObjects has the existing clone of r, cloned before it had a
+// reference, borrow from the clone at ref: it adds ref's objects to
+// its alternates, then repacks without the objects it finds there.
+func shareObjects(r *config.RepoSpec, ref string) error {
+	logging.With("repo", r.Name).Infof("Sharing objects with %s", ref)
+	if err := keepObjects(ref); err != nil {
+		return err
+	}
+	line := filepath.Join(ref, "objects") + "\n"
+	if err := ioutil.WriteFile(alternatesFile(r.Path), []byte(line), 0644); err != nil {
+		return err
+	}
+	if err := gitCommand("--git-dir", r.Path, "repack", "-a", "-d", "-l", "-q").Run(); err != nil {
+		return fmt.Errorf("repacking: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// filesystem is one a run writes to, and how much of it the run will
+// need.
+type filesystem struct {
+	path  string // a path on it, for messages
+	avail uint64
+	need  uint64
+	what  []string
+}
+
+// checkDiskSpace estimates how much space fetching and indexing cfg
+// will take and fails if any filesystem it writes to doesn't have it,
+// rather than finding out hours in. Fetching is assumed to grow each
+// clone by -disk-margin of its current size, and each new clone to
+// take the size its code host reported (see CloneOptions.size) plus the
+// margin. The new index is assumed to be the size of the previous one
+// plus the margin; the previous index is kept until the new one
+// replaces it, so the new one needs room of its own.
+func checkDiskSpace(cfg *config.IndexSpec) error {
+	fss := map[uint64]*filesystem{}
+
+	type clones struct {
+		count int
+		size  uint64
+	}
+	existing := map[*filesystem]*clones{}
+	fresh := map[*filesystem]*clones{}
+	add := func(m map[*filesystem]*clones, fs *filesystem, size uint64) {
+		if m[fs] == nil {
+			m[fs] = &clones{}
+		}
+		m[fs].count++
+		m[fs].size += size
+	}
+	for _, r := range cfg.Repositories {
+		fs, err := filesystemOf(fss, r.Path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(r.Path); err == nil {
+			add(existing, fs, measureClone(r.Path))
+		} else if r.CloneOptions != nil && r.CloneOptions.Size > 0 {
+			add(fresh, fs, uint64(r.CloneOptions.Size))
+		}
+	}
+	for fs, c := range existing {
+		fs.need += uint64(float64(c.size) * *flagDiskMargin)
+		fs.what = append(fs.what, fmt.Sprintf("growth of %d clones (%s now)", c.count, humanBytes(c.size)))
+	}
+	for fs, c := range fresh {
+		fs.need += uint64(float64(c.size) * (1 + *flagDiskMargin))
+		fs.what = append(fs.what, fmt.Sprintf("%d new clones (%s as reported)", c.count, humanBytes(c.size)))
+	}
+
+	if !*flagNoIndex {
+		if prev := previousIndex(); prev != "" {
+			if st, err := os.Stat(prev); err == nil {
+				out := *flagIndexPath
+				if *flagIndexDir != "" {
+					out = *flagIndexDir
+				}
+				fs, err := filesystemOf(fss, out)
+				if err != nil {
+					return err
+				}
+				fs.need += uint64(float64(st.Size()) * (1 + *flagDiskMargin))
+				fs.what = append(fs.what, fmt.Sprintf("the new index (%s last time)", humanBytes(uint64(st.Size()))))
+			}
+		}
+	}
+
+	var short []string
+	for _, fs := range fss {
+		if fs.need > fs.avail {
+			short = append(short, fmt.Sprintf("%s: need about %s for %s, but only %s is free",
+				fs.path, humanBytes(fs.need), strings.Join(fs.what, " and "), humanBytes(fs.avail)))
+		}
+	}
+	if len(short) > 0 {
+		sort.Strings(short)
+		return fmt.Errorf("not enough disk space (-skip-disk-check to try anyway):\n  %s",
+			strings.Join(short, "\n  "))
+	}
+	return nil
+}
+
+// filesystemOf returns the filesystem p is, or would be created, on.
+func filesystemOf(fss map[uint64]*filesystem, p string) (*filesystem, error) {
+	existing := existingAncestor(p)
+	dev, avail, err := diskFree(existing)
+	if err != nil {
+		return nil, err
+	}
+	if fs, ok := fss[dev]; ok {
+		return fs, nil
+	}
+	fs := &filesystem{path: existing, avail: avail}
+	fss[dev] = fs
+	return fs, nil
+}
+
+func existingAncestor(p string) string {
+	p = filepath.Clean(p)
+	for {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p
+		}
+		p = parent
+	}
+}
+
+// cloneSize returns the bytes taken up by the objects of the clone at
+// dir, which for a mirror clone is nearly all of it, or 0 if there is
+// no clone there. git count-objects only lists the pack and loose
+// object directories, which is far quicker than walking the clone.
+func cloneSize(dir string) uint64 {
+	if _, err := os.Stat(dir); err != nil {
+		return 0
+	}
+	out, err := gitCommand("--git-dir", dir, "count-objects", "-v").Output()
+	if err != nil {
+		return 0
+	}
+	var kib uint64
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(line, ": ")
+		if key == "size" || key == "size-pack" || key == "size-garbage" {
+			n, _ := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+			kib += n
+		}
+	}
+	return kib << 10
+}
+
+// measured holds the sizes checkDiskSpace found the clones at, for
+// timedCheckout to start from rather than measuring them again.
+var measured = struct {
+	sync.Mutex
+	sizes map[string]uint64
+}{sizes: map[string]uint64{}}
+
+func measureClone(dir string) uint64 {
+	size := cloneSize(dir)
+	measured.Lock()
+	measured.sizes[dir] = size
+	measured.Unlock()
+	return size
+}
+
+// sizeBefore returns the size of the clone at dir before fetching it:
+// what checkDiskSpace measured, or its size now if it didn't.
+func sizeBefore(dir string) uint64 {
+	measured.Lock()
+	size, ok := measured.sizes[dir]
+	delete(measured.sizes, dir)
+	measured.Unlock()
+	if ok {
+		return size
+	}
+	return cloneSize(dir)
+}
+
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+)
+
+// With -index-dir, each build is written to its own generation file in
+// the directory, and a "current" symlink points at the newest one.
+// Backends load the symlink; rolling back is a matter of pointing it at
+// an older generation and reloading.
+const (
+	currentLink          = "current"
+	generationPrefix     = "livegrep-"
+	generationSuffix     = ".idx"
+	generationTimeFormat = "20060102T150405Z"
+)
+
+// newGenerationPath returns the path in dir to write an index built at
+// now to. Generation names sort in the order they were built.
+func newGenerationPath(dir string, now time.Time) string {
+	return filepath.Join(dir, generationPrefix+now.UTC().Format(generationTimeFormat)+generationSuffix)
+}
+
+// publishGeneration atomically points dir's current symlink at gen.
+func publishGeneration(dir, gen string) error {
+	tmp := filepath.Join(dir, "."+currentLink+".tmp")
+	os.Remove(tmp)
+	// A relative target keeps the directory valid wherever it is
+	// mounted.
+	if err := os.Symlink(filepath.Base(gen), tmp); err != nil {
+		// Windows only lets administrators, or anyone in Developer
+		// Mode, create symlinks.
+		return fmt.Errorf("creating the %s symlink: %s", currentLink, err.Error())
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, currentLink)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// listGenerations returns the names of the generations in dir, oldest
+// first.
+func listGenerations(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var gens []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Mode().IsRegular() ||
+			!strings.HasPrefix(name, generationPrefix) ||
+			!strings.HasSuffix(name, generationSuffix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, generationPrefix), generationSuffix)
+		if _, err := time.Parse(generationTimeFormat, stamp); err != nil {
+			continue
+		}
+		gens = append(gens, name)
+	}
+	sort.Strings(gens)
+	return gens, nil
+}
+
+// collectGenerations deletes all but the newest keep generations in dir,
+// returning the paths it removed. The generation current points at is
+// never removed, even if it has been rolled back to an old one.
+func collectGenerations(dir string, keep int) ([]string, error) {
+	gens, err := listGenerations(dir)
+	if err != nil {
+		return nil, err
+	}
+	current, _ := os.Readlink(filepath.Join(dir, currentLink))
+
+	var removed []string
+	for i := 0; i < len(gens)-keep; i++ {
+		if gens[i] == filepath.Base(current) {
+			continue
+		}
+		p := filepath.Join(dir, gens[i])
+		if err := os.Remove(p); err != nil {
+			if inUse(err) {
+				// On Windows, a backend that hasn't reloaded yet
+				// still has it open; try again next time.
+				logging.Infof("Keeping old generation %s, which is in use", p)
+				continue
+			}
+			return removed, fmt.Errorf("removing old generation: %s", err.Error())
+		}
+		os.Remove(p + ".sha256")
+		removed = append(removed, p)
+	}
+	return removed, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// repoHistory is what -failure-history remembers about fetching one
+// repository.
+type repoHistory struct {
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+}
+
+// failureHistory tracks fetch failures per repository across runs, so
+// that a repository that has been failing for weeks stands out from one
+// that failed once. A nil *failureHistory records nothing.
+type failureHistory struct {
+	path string
+
+	mu    sync.Mutex
+	repos map[string]*repoHistory
+}
+
+func loadHistory(path string) (*failureHistory, error) {
+	h := &failureHistory{path: path, repos: map[string]*repoHistory{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &h.repos); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return h, nil
+}
+
+// record notes the result of fetching the named repository.
+func (h *failureHistory) record(name string, err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.repos[name]
+	if !ok {
+		r = &repoHistory{}
+		h.repos[name] = r
+	}
+	now := time.Now()
+	if err == nil {
+		r.ConsecutiveFailures = 0
+		r.LastError = ""
+		r.LastSuccess = &now
+	} else {
+		r.ConsecutiveFailures++
+		r.LastError = err.Error()
+		r.LastFailure = &now
+	}
+}
+
+// failing returns the names of the repositories whose last fetch failed,
+// longest-failing first.
+func (h *failureHistory) failing() []string {
+	names := []string{}
+	for name, r := range h.repos {
+		if r.ConsecutiveFailures > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := h.repos[names[i]], h.repos[names[j]]
+		if a.ConsecutiveFailures != b.ConsecutiveFailures {
+			return a.ConsecutiveFailures > b.ConsecutiveFailures
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// finish logs the repositories that are failing and saves the history,
+// forgetting repositories that are no longer configured.
+func (h *failureHistory) finish(repos []*config.RepoSpec) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	configured := map[string]bool{}
+	for _, r := range repos {
+		configured[r.Name] = true
+	}
+	for name := range h.repos {
+		if !configured[name] {
+			delete(h.repos, name)
+		}
+	}
+
+	if failing := h.failing(); len(failing) > 0 {
+		logging.Warnf("%d repositories failed to fetch:", len(failing))
+		for _, name := range failing {
+			r := h.repos[name]
+			since := "never succeeded"
+			if r.LastSuccess != nil {
+				since = "last succeeded " + r.LastSuccess.Format(time.RFC3339)
+			}
+			logging.With("repo", name, "failures", r.ConsecutiveFailures).Warnf("  %s: %d consecutive failures, %s: %s", name, r.ConsecutiveFailures, since, r.LastError)
+		}
+	}
+
+	data, err := json.MarshalIndent(h.repos, "", "  ")
+	if err == nil {
+		tmp := h.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, h.path)
+		}
+	}
+	if err != nil {
+		logging.Errorf("saving failure history: %s", err.Error())
+	}
+}
+
+// ServeHTTP reports the history as JSON, along with the failing
+// repositories in the order finish logs them.
+func (h *failureHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	data, err := json.MarshalIndent(struct {
+		Failing []string                `json:"failing"`
+		Repos   map[string]*repoHistory `json:"repos"`
+	}{h.failing(), h.repos}, "", "  ")
+	h.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// These mirror the header written by src/dump_load.cc, as far as the
+// trees; livegrep-index-verify reads the rest.
+const (
+	indexMagic   = 0xc0d35eac
+	indexVersion = 16
+	// The header's offsets of the number of trees and of their section.
+	nTreesOff = 28
+	refsOff   = 32
+)
+
+// indexTrees returns the trees of the index at path, as "name@version",
+// reading only the index's header and its list of trees.
+func indexTrees(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, refsOff+8)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return nil, fmt.Errorf("%s: reading the header: %s", path, err.Error())
+	}
+	if magic := binary.LittleEndian.Uint32(head); magic != indexMagic {
+		return nil, fmt.Errorf("%s: not a livegrep index", path)
+	}
+	if v := binary.LittleEndian.Uint32(head[4:]); v != indexVersion {
+		return nil, fmt.Errorf("%s: unsupported index version %d", path, v)
+	}
+	n := binary.LittleEndian.Uint32(head[nTreesOff:])
+	r := io.NewSectionReader(f, int64(binary.LittleEndian.Uint64(head[refsOff:])), 1<<62)
+
+	readString := func() (string, error) {
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return "", err
+		}
+		b := make([]byte, size)
+		_, err := io.ReadFull(r, b)
+		return string(b), err
+	}
+	trees := map[string]bool{}
+	for i := uint32(0); i < n; i++ {
+		// Each tree is its name, version and metadata
+		var s [3]string
+		for j := range s {
+			if s[j], err = readString(); err != nil {
+				return nil, fmt.Errorf("%s: reading tree %d: %s", path, i, err.Error())
+			}
+		}
+		trees[s[0]+"@"+s[1]] = true
+	}
+	return trees, nil
+}
+
+// changedRepos returns how many of repos codesearch --reuse_index would
+// have to read again rather than copy from the index with trees: those
+// with a revision whose commit (as recordCommits found it) isn't among
+// them, and those with walk_submodules, which are always walked.
+func changedRepos(repos []*config.RepoSpec, trees map[string]bool) int {
+	changed := 0
+	for _, r := range repos {
+		if r.WalkSubmodules || r.Metadata == nil || len(r.Metadata.Commits) < len(r.Revisions) {
+			changed++
+			continue
+		}
+		for _, commit := range r.Metadata.Commits {
+			if !trees[r.Name+"@"+commit] {
+				changed++
+				break
+			}
+		}
+	}
+	return changed
+}
+
+// reuseIndex returns the previous index for codesearch to copy unchanged
+// repositories from, or "" for a full rebuild: when there is none, or
+// when more than -incremental-threshold of repos have changed since it,
+// as copying most of an index only to reread it is slower than reading
+// it afresh.
+func reuseIndex(repos []*config.RepoSpec) string {
+	prev := previousIndex()
+	if prev == "" {
+		return ""
+	}
+	trees, err := indexTrees(prev)
+	if err != nil {
+		logging.Warnf("Rebuilding from scratch, as the previous index can't be read: %s", err.Error())
+		return ""
+	}
+	changed := changedRepos(repos, trees)
+	if len(repos) > 0 && float64(changed) > *flagIncrLimit*float64(len(repos)) {
+		logging.Infof("%d of %d repositories changed since %s, more than -incremental-threshold; rebuilding from scratch",
+			changed, len(repos), prev)
+		return ""
+	}
+	logging.Infof("%d of %d repositories changed; reusing the rest from %s", changed, len(repos), prev)
+	return prev
+}
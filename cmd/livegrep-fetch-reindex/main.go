@@ -1,20 +1,31 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/livegrep/livegrep/pkg/debugserver"
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/sdnotify"
+	"github.com/livegrep/livegrep/pkg/sentry"
 	"github.com/livegrep/livegrep/src/proto/config"
 	pb "github.com/livegrep/livegrep/src/proto/go_proto"
 	"golang.org/x/sync/errgroup"
@@ -26,43 +37,288 @@ var (
 	flagIndexPath     = flag.String("out", "livegrep.idx", "Path to write the index")
 	flagRevparse      = flag.Bool("revparse", true, "whether to `git rev-parse` the provided revision in generated links")
 	flagSkipMissing   = flag.Bool("skip-missing", false, "skip repositories where the specified revision is missing")
-	flagReloadBackend = flag.String("reload-backend", "", "Backend to send a Reload RPC to")
+	flagReloadBackend = flag.String("reload-backend", "", "Comma-separated backends to send a Reload RPC to after a successful build")
+	flagReloadPidFile = flag.String("reload-pidfile", "", "After a successful build, send -reload-signal to the backend whose pid is in this file")
+	flagReloadSignal  = flag.String("reload-signal", "HUP", "Signal to send with -reload-pidfile; codesearch -reload_signal only reloads on HUP")
+	flagReloadTimeout = flag.Duration("reload-timeout", 10*time.Minute, "How long to wait for each backend to reload")
 	flagNumWorkers    = flag.Int("num-workers", 8, "Number of workers used to update repositories")
 	flagNoIndex       = flag.Bool("no-index", false, "Skip indexing after fetching")
+	flagMaxFileSize   = flag.Int64("max-file-size", 0, "Skip files larger than this many bytes in repositories that do not set max_file_size")
+	flagExcludeGen    = flag.Bool("exclude-generated", false, "Skip generated, vendored and minified files in repositories that do not set generated")
+	flagRedactReport  = flag.String("redaction-report", "", "After each build, list the files that had secrets masked in this `file`")
+	flagPoll          = flag.Duration("poll", 0, "Run forever, checking the config this often and reindexing when it changes")
+	flagIndexDir      = flag.String("index-dir", "", "Write each index to a new timestamped file in `dir` and point its \"current\" symlink at it, instead of writing -out")
+	flagGenerations   = flag.Int("keep-generations", 3, "With -index-dir, the number of index generations to keep")
+	flagOverlapReport = flag.String("overlap-report", "", "After each build, write a report of content shared between repositories to this `file` (JSON if it ends in .json)")
+	flagQueue         = flag.String("queue", "", "Hand repositories to -worker processes to fetch through this Redis `url` (redis://host:port/db) rather than fetching them here")
+	flagWorker        = flag.Bool("worker", false, "Fetch repositories handed out through -queue until killed, instead of indexing")
+	flagQueueTimeout  = flag.Duration("queue-timeout", time.Hour, "How long to wait for workers to fetch every repository")
+	flagUpload        = flag.String("upload", "", "After each build, upload the index to this object storage `prefix` (s3://, gs://, an Azure blob URL or file://) and point its latest object at it")
+	flagUploadBundles = flag.Bool("upload-bundles", false, "With -upload, also upload a git bundle of each repository whose refs changed to the prefix's bundles/")
+	flagDownload      = flag.String("download", "", "Instead of building an index, download the latest one uploaded to this `prefix` (with -poll, whenever it changes)")
+	flagIncremental   = flag.Bool("incremental", false, "Copy repositories whose revisions haven't changed from the previous index instead of rereading them")
+	flagIncrLimit     = flag.Float64("incremental-threshold", 0.5, "With -incremental, rebuild from scratch when more than this fraction of repositories have changed since the previous index")
+	flagDiskMargin    = flag.Float64("disk-margin", 0.1, "Before starting, check there is room for each clone and the index to grow by this fraction of their current sizes")
+	flagSkipDiskCheck = flag.Bool("skip-disk-check", false, "Don't check for free disk space before starting")
+	flagHistory       = flag.String("failure-history", "", "Track each repository's fetch failures across runs in this `file`, and report the ones failing after each run")
+	flagStatusListen  = flag.String("status-listen", "", "Serve the -failure-history as JSON on this `address`")
+	flagMetricsFile   = flag.String("metrics-textfile", "", "After each run, write fetch and index build metrics to this `file` for the node_exporter textfile collector")
+	flagMetricsListen = flag.String("metrics-listen", "", "Serve running fetch and index build metrics for Prometheus on /metrics at this `address`")
+	flagReportOut     = flag.String("report-out", "", "After each run, write a JSON report of how fetching each repository and building the index went to this `file`")
+	flagState         = flag.String("state", "", "Record when each repository was last fetched, and its HEAD commit, in this `file` as each fetch finishes, for -resume")
+	flagResume        = flag.Bool("resume", false, "If the run recorded in -state didn't finish, fetch only the repositories it didn't fetch, then index")
+	flagSymbolsOut    = flag.String("symbols-out", "", "After each build, run ctags over each repository and index the symbol definitions it finds at this `path`, for codesearch -load_tags")
+	flagCtags         = flag.String("ctags", "ctags", "Path to the universal-ctags binary, for -symbols-out")
+	flagFetchOnly     = flag.String("fetch-only", "", "Fetch only these comma-separated repositories, and any not yet cloned, and index the rest as they are on disk; given empty, fetch only those not yet cloned")
 )
 
+// fetchOnly is whether -fetch-only was given, even empty.
+var fetchOnly bool
+
+// history is loaded from -failure-history, if it is set.
+var history *failureHistory
+
+// state is loaded from -state, if it is set.
+var state *runState
+
 // Used to extract the refname from a line like the following:
 // ref: refs/heads/good_main_2     HEAD
 var remoteHeadRefExtractorReg = regexp.MustCompile("ref:\\s*([^\\s]*)\\s*HEAD")
 
 func main() {
 	flag.Parse()
-	log.SetFlags(0)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "fetch-only" {
+			fetchOnly = true
+		}
+	})
+	if err := logging.Init("fetch-reindex"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := sentry.Init("fetch-reindex"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer sentry.Recover()
+	if err := debugserver.Start(); err != nil {
+		log.Fatalln(err.Error())
+	}
 
-	if len(flag.Args()) != 1 {
-		log.Fatal("Expected exactly one argument (the index json configuration)")
+	if *flagReloadPidFile != "" {
+		if err := checkReloadSignal(*flagReloadSignal); err != nil {
+			log.Fatalf("-reload-signal: %s", err.Error())
+		}
 	}
 
-	data, err := ioutil.ReadFile(flag.Arg(0))
-	if err != nil {
-		log.Fatalf(err.Error())
+	if *flagWorker || *flagPoll != 0 {
+		// Running as a daemon, perhaps under systemd.
+		sdnotify.StopOnSignal()
+		sdnotify.StartWatchdog(nil)
+	}
+
+	if *flagMetricsListen != "" {
+		go func() {
+			log.Fatalln(serveMetrics(*flagMetricsListen).Error())
+		}()
+	}
+
+	if *flagWorker {
+		if *flagQueue == "" {
+			log.Fatal("-worker requires -queue")
+		}
+		host, _ := os.Hostname()
+		log.Fatalln(runWorker(*flagQueue, fmt.Sprintf("%s[%d]", host, os.Getpid())).Error())
+	}
+
+	if *flagDownload != "" {
+		if *flagPoll != 0 {
+			sdnotify.Ready("polling " + *flagDownload)
+		}
+		for {
+			if err := download(*flagDownload); err != nil {
+				if *flagPoll == 0 {
+					log.Fatalln(err.Error())
+				}
+				logging.Errorf("download: %s", err.Error())
+			}
+			if *flagPoll == 0 {
+				return
+			}
+			time.Sleep(*flagPoll)
+		}
 	}
 
-	var cfg config.IndexSpec
-	if err = json.Unmarshal(data, &cfg); err != nil {
-		log.Fatalf("reading %s: %s", flag.Arg(0), err.Error())
+	if len(flag.Args()) == 0 {
+		log.Fatal("Expected at least one argument (the index json or yaml configuration)")
+	}
+	if *flagGenerations < 1 {
+		log.Fatal("-keep-generations must be at least 1")
+	}
+	if *flagUploadBundles && *flagUpload == "" {
+		log.Fatal("-upload-bundles requires -upload")
+	}
+	if *flagIncremental && !*flagRevparse {
+		log.Fatal("-incremental requires -revparse")
+	}
+	if *flagIncrLimit < 0 || *flagIncrLimit > 1 {
+		log.Fatal("-incremental-threshold must be between 0 and 1")
+	}
+	if *flagHistory != "" {
+		var err error
+		if history, err = loadHistory(*flagHistory); err != nil {
+			log.Fatalln(err.Error())
+		}
+	}
+	if *flagResume && *flagState == "" {
+		log.Fatal("-resume requires -state")
+	}
+	if *flagState != "" {
+		var err error
+		if state, err = loadState(*flagState); err != nil {
+			log.Fatalln(err.Error())
+		}
+	}
+	if *flagStatusListen != "" {
+		if history == nil {
+			log.Fatal("-status-listen requires -failure-history")
+		}
+		go func() {
+			log.Fatalln(http.ListenAndServe(*flagStatusListen, history).Error())
+		}()
 	}
 
-	if err := checkoutRepos(&cfg.Repositories); err != nil {
+	if *flagPoll != 0 {
+		poll(flag.Args(), *flagPoll)
+	}
+
+	cfg, err := indexspec.Load(flag.Args()...)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := reindex(cfg); err != nil {
 		log.Fatalln(err.Error())
 	}
+}
+
+// poll reindexes whenever the rendered configs at paths change, checking
+// every interval. It never returns. It is ready as soon as it starts,
+// since a backend may already be serving the last index; each reindex
+// after a change is reported to systemd as a reload.
+func poll(paths []string, interval time.Duration) {
+	var last []byte
+	sdnotify.Ready("starting")
+	for ; ; time.Sleep(interval) {
+		data, err := indexspec.RenderFiles(paths...)
+		if err != nil {
+			logging.Errorf("loading config: %s", err.Error())
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		if last != nil {
+			logging.Infof("Config changed, reindexing")
+		}
+		var cfg config.IndexSpec
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			logging.Errorf("loading config: %s", err.Error())
+			continue
+		}
+		sdnotify.Reloading("reindexing " + cfg.Name)
+		err = reindex(&cfg)
+		if err != nil {
+			logging.Errorf("reindex: %s", err.Error())
+			sdnotify.Ready("reindexing failed: " + err.Error())
+			continue
+		}
+		sdnotify.Ready("indexed " + cfg.Name + " at " + time.Now().Format(time.RFC3339))
+		last = data
+	}
+}
+
+func reindex(cfg *config.IndexSpec) (err error) {
+	sentry.SetTag("config", cfg.Name)
+	metrics = newRunMetrics()
+	defer func(repos []*config.RepoSpec) {
+		if err := metrics.write(*flagMetricsFile, repos); err != nil {
+			logging.Warnf("metrics textfile: %s", err.Error())
+		}
+		if werr := metrics.writeReport(*flagReportOut, cfg.Name, repos, err); werr != nil {
+			logging.Warnf("report: %s", werr.Error())
+		}
+		if err == nil {
+			state.finish(repos)
+		}
+	}(cfg.Repositories)
+
+	if !*flagSkipDiskCheck {
+		if err := checkDiskSpace(cfg); err != nil {
+			return err
+		}
+	}
+
+	fetch := cfg.Repositories
+	if fetchOnly {
+		fetch = selectFetch(cfg.Repositories, *flagFetchOnly)
+		logging.Infof("Fetching %d of %d repositories", len(fetch), len(cfg.Repositories))
+	}
+	fetch = state.begin(fetch, *flagResume)
+	setReferences(cfg.Repositories)
+	for _, wave := range cloneWaves(fetch) {
+		if *flagQueue != "" {
+			err = queueCheckout(*flagQueue, wave)
+		} else {
+			err = checkoutRepos(&wave)
+		}
+		if err != nil {
+			break
+		}
+	}
+	history.finish(cfg.Repositories)
+	state.flush()
+	if err != nil {
+		return err
+	}
 
 	if *flagNoIndex {
-		log.Printf("Skipping indexing after fetching repos")
-		return
+		logging.Infof("Skipping indexing after fetching repos")
+		return nil
+	}
+
+	// The repositories as configured, without the trees tag_history
+	// adds for older tags, for -symbols-out.
+	repos := cfg.Repositories
+	var tagged []*config.RepoSpec
+	for _, r := range cfg.Repositories {
+		if err := resolveRevisions(r); err != nil {
+			return err
+		}
+		tags, err := tagHistory(r)
+		if err != nil {
+			return err
+		}
+		revs := r.Revisions
+		for _, t := range tags {
+			revs = append(revs, t.Revisions...)
+		}
+		if err := fetchBlobs(r, revs); err != nil {
+			return err
+		}
+		tagged = append(tagged, tags...)
+	}
+	cfg.Repositories = append(cfg.Repositories, tagged...)
+	now := time.Now()
+	for _, r := range cfg.Repositories {
+		recordCommits(r, now)
 	}
 
-	tmp := *flagIndexPath + ".tmp"
+	indexPath := *flagIndexPath
+	if *flagIndexDir != "" {
+		if err := os.MkdirAll(*flagIndexDir, 0755); err != nil {
+			return err
+		}
+		indexPath = newGenerationPath(*flagIndexDir, time.Now())
+	}
+	tmp := indexPath + ".tmp"
 
 	args := []string{
 		"--debug=ui",
@@ -73,24 +329,199 @@ func main() {
 	if *flagRevparse {
 		args = append(args, "--revparse")
 	}
-	args = append(args, flag.Arg(0))
+	if *flagMaxFileSize != 0 {
+		args = append(args, fmt.Sprintf("--max_file_size=%d", *flagMaxFileSize))
+	}
+	if *flagExcludeGen {
+		args = append(args, "--exclude_generated")
+	}
+	if *flagRedactReport != "" {
+		args = append(args, "--redaction_report", *flagRedactReport)
+	}
+	tooLarge := ""
+	if *flagReportOut != "" {
+		tooLarge = tmp + ".too-large"
+		args = append(args, "--too_large_report", tooLarge)
+		defer os.Remove(tooLarge)
+	}
+	if *flagIncremental {
+		if prev := reuseIndex(cfg.Repositories); prev != "" {
+			args = append(args, "--reuse_index", prev)
+		}
+	}
+
+	// codesearch only reads a single, fully-resolved JSON config. Write
+	// it next to a local config so relative paths resolve the same way.
+	configDir := ""
+	if !indexspec.IsRemote(flag.Arg(0)) {
+		configDir = filepath.Dir(flag.Arg(0))
+	}
+	configPath, cleanup, err := indexspec.JSONFor(configDir, cfg)
+	if err != nil {
+		return err
+	}
+	args = append(args, configPath)
 
 	cmd := exec.Command(findCodesearch(*flagCodesearch), args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatalln(err)
+	start := time.Now()
+	err = cmd.Run()
+	took := time.Since(start)
+	metrics.recordIndex(took, err)
+	promIndex(took, err)
+	cleanup()
+	logger := logging.With("phase", "index", "duration", took, "repos", len(cfg.Repositories))
+	if err != nil {
+		logger.With("error", err).Errorf("index build failed")
+		return fmt.Errorf("codesearch: %s", err.Error())
+	}
+	logger.Infof("built the index")
+	if tooLarge != "" {
+		files, err := readTooLarge(tooLarge)
+		if err != nil {
+			logger.Warnf("reading the skipped files: %s", err.Error())
+		}
+		metrics.recordTooLarge(files)
+	}
+
+	if err := writeChecksum(tmp, indexPath); err != nil {
+		return fmt.Errorf("checksum: %s", err.Error())
+	}
+	if err := replaceFile(tmp, indexPath); err != nil {
+		return fmt.Errorf("rename: %s", err.Error())
+	}
+	metrics.recordIndexPath(indexPath)
+	if st, err := os.Stat(indexPath); err == nil {
+		promIndexBytes.Set(float64(st.Size()))
+	}
+
+	if *flagSymbolsOut != "" {
+		if err := buildSymbols(repos, *flagSymbolsOut); err != nil {
+			return fmt.Errorf("symbols: %s", err.Error())
+		}
+	}
+
+	if *flagOverlapReport != "" {
+		if err := writeOverlapReport(indexPath, *flagOverlapReport); err != nil {
+			logging.Warnf("overlap report: %s", err.Error())
+		}
 	}
 
-	if err := os.Rename(tmp, *flagIndexPath); err != nil {
-		log.Fatalln("rename:", err.Error())
+	if err := install(indexPath); err != nil {
+		return err
+	}
+	if *flagUpload != "" {
+		if err := uploadIndex(indexPath, *flagUpload); err != nil {
+			return fmt.Errorf("upload: %s", err.Error())
+		}
+		if *flagUploadBundles {
+			// The index is out; missing bundles are retried next time.
+			if err := uploadBundles(repos, *flagUpload); err != nil {
+				logging.Warnf("upload bundles: %s", err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// download fetches the latest index uploaded to prefix and installs it,
+// if it is new.
+func download(prefix string) error {
+	if *flagIndexDir != "" {
+		if err := os.MkdirAll(*flagIndexDir, 0755); err != nil {
+			return err
+		}
+	}
+	p, err := downloadIndex(prefix)
+	if err != nil || p == "" {
+		return err
+	}
+	return install(p)
+}
+
+// install makes the index at indexPath the one backends serve: with
+// -index-dir, by publishing it as the current generation, and then by
+// asking the backends to reload.
+func install(indexPath string) error {
+	if *flagIndexDir != "" {
+		if err := publishGeneration(*flagIndexDir, indexPath); err != nil {
+			return fmt.Errorf("updating current symlink: %s", err.Error())
+		}
+		logging.Infof("Published %s", indexPath)
+		removed, err := collectGenerations(*flagIndexDir, *flagGenerations)
+		for _, p := range removed {
+			logging.Infof("Removed old generation %s", p)
+		}
+		if err != nil {
+			logging.Warnf("%s", err.Error())
+		}
 	}
 
 	if *flagReloadBackend != "" {
-		if err := reloadBackend(*flagReloadBackend); err != nil {
-			log.Fatalln("reload:", err.Error())
+		for _, addr := range strings.Split(*flagReloadBackend, ",") {
+			if err := reloadBackend(addr); err != nil {
+				return fmt.Errorf("reload %s: %s", addr, err.Error())
+			}
+			logging.Infof("Reloaded %s", addr)
+		}
+	}
+	if *flagReloadPidFile != "" {
+		if err := signalBackend(*flagReloadPidFile, *flagReloadSignal); err != nil {
+			return fmt.Errorf("reload: %s", err.Error())
 		}
 	}
+	return nil
+}
+
+// previousIndex returns the path of the index the last successful run
+// built, or "" if there isn't one.
+func previousIndex() string {
+	prev := *flagIndexPath
+	if *flagIndexDir != "" {
+		prev = filepath.Join(*flagIndexDir, currentLink)
+	}
+	resolved, err := filepath.EvalSymlinks(prev)
+	if err != nil {
+		return ""
+	}
+	return resolved
+}
+
+// writeChecksum writes the SHA-256 of the index at tmp to dst.sha256, in
+// the format sha256sum uses, for livegrep-index-verify to check.
+func writeChecksum(tmp, dst string) error {
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%x  %s\n", h.Sum(nil), filepath.Base(dst))
+	return ioutil.WriteFile(dst+".sha256", []byte(line), 0644)
+}
+
+// writeOverlapReport runs index-stats, which is installed alongside
+// codesearch, to report on how much content repositories in the index
+// at idx share.
+func writeOverlapReport(idx, dst string) error {
+	args := []string{"-stats_overlap"}
+	if strings.HasSuffix(dst, ".json") {
+		args = append(args, "-stats_json")
+	}
+	args = append(args, idx)
+	tool := "index-stats" + exeSuffix
+	if cs := findCodesearch(*flagCodesearch); filepath.Base(cs) != cs {
+		tool = filepath.Join(filepath.Dir(cs), tool)
+	}
+	out, err := exec.Command(tool, args...).Output()
+	if err != nil {
+		return fmt.Errorf("%s: %s", tool, err.Error())
+	}
+	return ioutil.WriteFile(dst, out, 0644)
 }
 
 func findCodesearch(given string) string {
@@ -98,8 +529,8 @@ func findCodesearch(given string) string {
 		return given
 	}
 	search := []string{
-		path.Join(path.Dir(os.Args[0]), "codesearch"),
-		"bazel-bin/src/tools/codesearch",
+		filepath.Join(filepath.Dir(os.Args[0]), "codesearch"+exeSuffix),
+		filepath.FromSlash("bazel-bin/src/tools/codesearch" + exeSuffix),
 	}
 	for _, try := range search {
 		if st, err := os.Stat(try); err == nil && (st.Mode()&os.ModeDir) == 0 {
@@ -109,6 +540,22 @@ func findCodesearch(given string) string {
 	return "codesearch"
 }
 
+// selectFetch returns the repositories of repos named in only, a
+// comma-separated list, and those that haven't been cloned yet.
+func selectFetch(repos []*config.RepoSpec, only string) []*config.RepoSpec {
+	names := map[string]bool{}
+	for _, name := range strings.Split(only, ",") {
+		names[strings.TrimSpace(name)] = true
+	}
+	var out []*config.RepoSpec
+	for _, r := range repos {
+		if _, err := os.Stat(r.Path); names[r.Name] || err != nil {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
 func checkoutRepos(repos *[]*config.RepoSpec) error {
 	repoc := make(chan *config.RepoSpec)
 	errc := make(chan error, *flagNumWorkers)
@@ -151,7 +598,8 @@ func checkoutWorker(c <-chan *config.RepoSpec,
 			if !ok {
 				return
 			}
-			err := checkoutOne(r)
+			took, grew, err := timedCheckout(r)
+			fetched(r, "", took, grew, err)
 			if err != nil {
 				errc <- err
 			}
@@ -161,9 +609,36 @@ func checkoutWorker(c <-chan *config.RepoSpec,
 	}
 }
 
+// fetched does the bookkeeping for a fetch of r, whether by this
+// process or, with -queue, by worker: it records the result in the
+// failure history, the -state file and the metrics, and logs it.
+func fetched(r *config.RepoSpec, worker string, took time.Duration, grew int64, err error) {
+	history.record(r.Name, err)
+	state.record(r, err)
+	metrics.recordFetch(r.Name, took, grew, err)
+	logger := logging.With("repo", r.Name, "phase", "fetch", "duration", took)
+	if worker != "" {
+		logger = logger.With("worker", worker)
+	}
+	if err != nil {
+		logger.With("reason", failureReason(err), "error", err).Errorf("fetch failed")
+		promFetch(took, grew, failureReason(err))
+	} else {
+		logger.With("bytes", grew).Infof("fetched")
+		promFetch(took, grew, "")
+	}
+}
+
+// credentialHelperScript is run by sh, which Git for Windows also
+// ships, and reads the password from fd 3, or on Windows from the
+// environment (see passSecret).
 const credentialHelperScript = (`#!/bin/sh
 if test "$1" = "get"; then
-  pass=` + "`cat <&3`" + `
+  if test -n "$LIVEGREP_GITHUB_PASSWORD"; then
+    pass="$LIVEGREP_GITHUB_PASSWORD"
+  else
+    pass=` + "`cat <&3`" + `
+  fi
   if test -n "$LIVEGREP_GITHUB_USERNAME"; then
     echo "username=$LIVEGREP_GITHUB_USERNAME"
   fi
@@ -210,31 +685,26 @@ func callGitInternal(program string, args []string, username string, password st
 		defer os.Remove(f.Name())
 
 		os.Chmod(f.Name(), 0700)
-		args = append([]string{"-c", fmt.Sprintf("credential.helper=%s", f.Name())}, args...)
+		// git runs the helper with sh, which would take backslashes
+		// in a Windows path as escapes.
+		args = append([]string{"-c", fmt.Sprintf("credential.helper=%s", filepath.ToSlash(f.Name()))}, args...)
 	}
 
 	for i := 0; i < 3; i++ {
-		cmd := exec.Command("git", args...)
+		cmd := gitCommand(args...)
 		if !returnOutput {
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
 		}
+		if username != "" {
+			cmd.Env = append(os.Environ(), fmt.Sprintf("LIVEGREP_GITHUB_USERNAME=%s", username))
+		}
 		if password != "" {
-			r, w, err := os.Pipe()
+			done, err := passSecret(cmd, password)
 			if err != nil {
 				return nil, err
 			}
-
-			cmd.ExtraFiles = []*os.File{r}
-
-			go func() {
-				defer w.Close()
-				w.WriteString(password)
-			}()
-			defer r.Close()
-		}
-		if username != "" {
-			cmd.Env = append(os.Environ(), fmt.Sprintf("LIVEGREP_GITHUB_USERNAME=%s", username))
+			defer done()
 		}
 		if !returnOutput {
 			err = cmd.Run()
@@ -248,27 +718,47 @@ func callGitInternal(program string, args []string, username string, password st
 	return nil, fmt.Errorf("%s %v: %s", program, args, err.Error())
 }
 
+// timedCheckout fetches r, and returns how long that took and how many
+// bytes its clone grew by.
+func timedCheckout(r *config.RepoSpec) (time.Duration, int64, error) {
+	before := sizeBefore(r.Path)
+	start := time.Now()
+	err := checkoutOne(r)
+	took := time.Since(start)
+	grew := int64(cloneSize(r.Path)) - int64(before)
+	if grew < 0 {
+		grew = 0
+	}
+	return took, grew, err
+}
+
 func checkoutOne(r *config.RepoSpec) error {
-	log.Println("Updating", r.Name)
+	logger := logging.With("repo", r.Name)
+	logger.Infof("Updating")
 
 	remote := r.Metadata.Remote
 	if remote == "" {
-		return fmt.Errorf("git remote not found in repository metadata for %s", r.Name)
+		return &fetchError{"no_remote", fmt.Errorf("git remote not found in repository metadata for %s", r.Name)}
 	}
 
-	out, err := exec.Command("git", "-C", r.Path, "rev-parse", "--is-bare-repository").Output()
+	out, err := gitCommand("-C", r.Path, "rev-parse", "--is-bare-repository").Output()
 	if err != nil {
 		if _, ok := err.(*exec.ExitError); !ok {
 			return err
 		}
 	}
-	var username, password string
-	if r.CloneOptions != nil {
-		username = r.CloneOptions.Username
-		password = os.Getenv(r.CloneOptions.PasswordEnv)
+	username, password, err := credentials(r)
+	if err != nil {
+		return &fetchError{"credentials", err}
 	}
-	if strings.Trim(string(out), " \n") != "true" {
-		if err := os.RemoveAll(r.Path); err != nil {
+	bare := strings.Trim(string(out), " \n") == "true"
+	if bare && brokenAlternates(r.Path) {
+		logger.Warnf("The clone it borrows objects from is gone; cloning again")
+		bare = false
+	}
+	ref := usableReference(r)
+	if !bare {
+		if err := removeAll(r.Path); err != nil {
 			return err
 		}
 		if err := os.MkdirAll(r.Path, 0755); err != nil {
@@ -278,17 +768,39 @@ func checkoutOne(r *config.RepoSpec) error {
 		if r.CloneOptions != nil && r.CloneOptions.Depth != 0 {
 			args = append(args, fmt.Sprintf("--depth=%d", r.CloneOptions.Depth))
 		}
+		if r.CloneOptions != nil && r.CloneOptions.Filter != "" {
+			args = append(args, "--filter="+r.CloneOptions.Filter)
+		}
+		if ref != "" {
+			if err := keepObjects(ref); err != nil {
+				return err
+			}
+			args = append(args, "--reference", ref)
+		}
 		args = append(args, remote, r.Path)
-		return callGit("git", args, username, password)
+		if err := callGit("git", args, username, password); err != nil {
+			return &fetchError{"clone", err}
+		}
+		return nil
 	}
 
-	if err := exec.Command("git", "-C", r.Path, "remote", "set-url", "origin", remote).Run(); err != nil {
+	if err := gitCommand("-C", r.Path, "remote", "set-url", "origin", remote).Run(); err != nil {
 		return err
 	}
+	if ref != "" && len(alternates(r.Path)) == 0 {
+		if err := shareObjects(r, ref); err != nil {
+			logger.Warnf("Sharing objects: %s", err.Error())
+		}
+	}
 
 	args := []string{"--git-dir", r.Path, "fetch", "-p"}
 	if r.CloneOptions != nil && r.CloneOptions.Depth != 0 {
 		args = append(args, fmt.Sprintf("--depth=%d", r.CloneOptions.Depth))
+	} else if isShallow(r.Path) {
+		// Cloned shallow, but no longer meant to be, e.g. because
+		// the repository has shrunk under -max-repo-size-mb.
+		logger.Infof("Fetching the rest of the shallow clone's history")
+		args = append(args, "--unshallow")
 	}
 
 	// We check and update (if needed) the HEAD ref to avoid scenarios where
@@ -321,17 +833,17 @@ func checkoutOne(r *config.RepoSpec) error {
 	})
 
 	if err := g.Wait(); err != nil {
-		return err
+		return &fetchError{"fetch", err}
 	}
 
 	// Early check, if there's no remote HEAD we can't do anything
 	remoteOutClean := strings.TrimSpace(string(remoteOut))
 	if remoteOutClean == "" {
-		log.Printf("%s: Won't update HEAD. Empty `git ls-remote --symref origin HEAD` (empty repo?)\n", r.Name)
+		logger.Warnf("Won't update HEAD. Empty `git ls-remote --symref origin HEAD` (empty repo?)")
 		return nil
 	}
 
-	currHeadOut, err := exec.Command("git", "--git-dir", r.Path, "symbolic-ref", "HEAD").Output()
+	currHeadOut, err := gitCommand("--git-dir", r.Path, "symbolic-ref", "HEAD").Output()
 	if err != nil {
 		return err
 	}
@@ -347,28 +859,83 @@ func checkoutOne(r *config.RepoSpec) error {
 		return nil
 	}
 
-	log.Printf("%s: remote HEAD: %s does not match local HEAD: %s. Attempting to fix...\n", r.Name, remoteHead, currHead)
+	logger.Infof("remote HEAD: %s does not match local HEAD: %s. Attempting to fix...", remoteHead, currHead)
 
 	// update the HEAD ref
-	if err = exec.Command("git", "--git-dir", r.Path, "symbolic-ref", "HEAD", remoteHead).Run(); err != nil {
-		log.Printf("%s: error setting symbolic ref. %v\n", r.Name, err)
-		return err
+	if err = gitCommand("--git-dir", r.Path, "symbolic-ref", "HEAD", remoteHead).Run(); err != nil {
+		logger.Errorf("error setting symbolic ref. %v", err)
+		return &fetchError{"head", err}
 	}
 
-	log.Printf("%s: HEAD update done.\n", r.Name)
+	logger.Infof("HEAD update done.")
 	return nil
 }
 
+// credentials returns the username and password to fetch r with.
+func credentials(r *config.RepoSpec) (string, string, error) {
+	var username string
+	if r.CloneOptions != nil {
+		username = r.CloneOptions.Username
+	}
+	password, err := indexspec.Password(r.CloneOptions)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s", r.Name, err.Error())
+	}
+	return username, password, nil
+}
+
 func reloadBackend(addr string) error {
 	client, err := grpc.Dial(addr, grpc.WithInsecure())
 	if err != nil {
 		return err
 	}
 
+	defer client.Close()
+
 	codesearch := pb.NewCodeSearchClient(client)
 
-	if _, err = codesearch.Reload(context.Background(), &pb.Empty{}, grpc.FailFast(false)); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), *flagReloadTimeout)
+	defer cancel()
+	if _, err = codesearch.Reload(ctx, &pb.Empty{}, grpc.FailFast(false)); err != nil {
 		return err
 	}
 	return nil
 }
+
+// gitCommand returns the command to run git with args.
+func gitCommand(args ...string) *exec.Cmd {
+	return exec.Command("git", append(append([]string{}, gitPlatformArgs...), args...)...)
+}
+
+func signalName(name string) string {
+	return strings.TrimPrefix(strings.ToUpper(name), "SIG")
+}
+
+// checkReloadSignal returns an error unless -reload-signal names a
+// signal codesearch reloads on, so that a mistake is caught before a
+// build rather than stopping the backend after it.
+func checkReloadSignal(name string) error {
+	if signalName(name) != "HUP" {
+		return fmt.Errorf("codesearch -reload_signal only reloads on SIGHUP, not %s", name)
+	}
+	return nil
+}
+
+// signalBackend sends the named signal to the process whose pid is in
+// pidFile, for backends run with codesearch -reload_signal.
+func signalBackend(pidFile, name string) error {
+	name = signalName(name)
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("%s: bad pid: %s", pidFile, err.Error())
+	}
+	if err := sendSignal(pid, name); err != nil {
+		return fmt.Errorf("signalling pid %d: %s", pid, err.Error())
+	}
+	logging.Infof("Sent SIG%s to pid %d", name, pid)
+	return nil
+}
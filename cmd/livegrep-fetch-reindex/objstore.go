@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/objstore"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// Indexes can be built on one machine and served from others by way of
+// object storage. -upload copies each new index, and its checksum, to
+// the given prefix, then points a "latest" object there at it.
+// -download, on the serving hosts, fetches whatever "latest" points at.
+// See pkg/objstore.
+
+// bundlesDir is where in the -upload prefix -upload-bundles puts each
+// repository's bundle.
+const bundlesDir = "bundles"
+
+// uploadIndex uploads the index at idx and its checksum to prefix, and
+// then updates prefix's latest object to name it, so that downloaders
+// never see a half-uploaded index.
+func uploadIndex(idx, prefix string) error {
+	name := filepath.Base(idx)
+	if *flagIndexDir == "" {
+		// A plain -out has the same name every time; give each
+		// upload its own.
+		name = filepath.Base(newGenerationPath("", time.Now()))
+	}
+	sum, err := ioutil.ReadFile(idx + ".sha256")
+	if err != nil {
+		return err
+	}
+	return objstore.Upload(idx, string(sum), prefix, name)
+}
+
+// downloadIndex fetches the index prefix's latest object names, if it
+// isn't the one already downloaded, and verifies its checksum. It
+// returns the path it was written to, or "" if there was nothing new.
+func downloadIndex(prefix string) (string, error) {
+	return objstore.Download(prefix, func(name string) string {
+		if *flagIndexDir != "" {
+			return filepath.Join(*flagIndexDir, name)
+		}
+		return *flagIndexPath
+	})
+}
+
+// uploadBundles uploads a git bundle of every ref of each of repos,
+// whose refs have changed since its last upload, to prefix's bundles/,
+// as <name>.bundle, so that mirrors of the repositories can be cloned
+// from object storage along with the index. What was last uploaded is
+// kept beside the index, in .bundles.json. A repository that can't be
+// bundled is logged and left for the next build.
+func uploadBundles(repos []*config.RepoSpec, prefix string) error {
+	dir := *flagIndexDir
+	if dir == "" {
+		dir = filepath.Dir(*flagIndexPath)
+	}
+	statePath := filepath.Join(dir, ".bundles.json")
+	uploaded := map[string]string{}
+	if data, err := ioutil.ReadFile(statePath); err == nil {
+		json.Unmarshal(data, &uploaded)
+	}
+
+	failed := 0
+	for _, r := range repos {
+		refs, err := gitCommand("--git-dir", r.Path, "show-ref").Output()
+		if err != nil {
+			logging.With("repo", r.Name, "phase", "upload").Warnf("bundle: listing refs: %s", err.Error())
+			failed++
+			continue
+		}
+		fp := fmt.Sprintf("%x", sha256.Sum256(refs))
+		if uploaded[r.Name] == fp {
+			continue
+		}
+		if err := uploadBundle(r, objstore.Join(prefix, bundlesDir+"/"+r.Name+".bundle")); err != nil {
+			logging.With("repo", r.Name, "phase", "upload").Warnf("bundle: %s", err.Error())
+			failed++
+			continue
+		}
+		uploaded[r.Name] = fp
+	}
+
+	data, err := json.MarshalIndent(uploaded, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(statePath, data, 0644); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d repositories could not be bundled", failed, len(repos))
+	}
+	return nil
+}
+
+// uploadBundle bundles r and copies the bundle to url.
+func uploadBundle(r *config.RepoSpec, url string) error {
+	dir, err := ioutil.TempDir("", "livegrep-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "repo.bundle")
+	cmd := gitCommand("--git-dir", r.Path, "bundle", "create", bundle, "--all")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git bundle: %s: %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return objstore.Copy(bundle, url)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// blobBatch is how many blobs to ask for in each fetch, to keep
+// command lines short.
+const blobBatch = 1000
+
+// isShallow reports whether the mirror at gitDir has a shallow history.
+func isShallow(gitDir string) bool {
+	_, err := os.Stat(filepath.Join(gitDir, "shallow"))
+	return err == nil
+}
+
+// isPartial reports whether the mirror at gitDir was cloned with a
+// filter, and so may be missing blobs. Older gits record that as
+// extensions.partialClone, newer ones as remote.origin.promisor.
+func isPartial(gitDir string) bool {
+	out, _ := gitCommand("--git-dir", gitDir, "config", "--get-regexp",
+		`^(extensions\.partialclone|remote\.origin\.promisor)$`).Output()
+	return len(strings.TrimSpace(string(out))) > 0
+}
+
+// fetchBlobs fetches the blobs that a partial clone of r is missing
+// from the trees of revisions. git would fetch them as it needs them,
+// but codesearch reads the clone without git, and would find them
+// missing.
+func fetchBlobs(r *config.RepoSpec, revisions []string) error {
+	if len(revisions) == 0 || !isPartial(r.Path) {
+		return nil
+	}
+	// --missing=print lists missing objects as ?<oid> rather than
+	// fetching them, and --no-walk keeps to the trees being indexed.
+	args := append([]string{"--git-dir", r.Path, "rev-list", "--objects", "--no-walk", "--missing=print"}, revisions...)
+	out, err := gitCommand(args...).Output()
+	if err != nil {
+		return fmt.Errorf("%s: listing missing blobs: %s", r.Name, err.Error())
+	}
+	var missing []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "?") {
+			missing = append(missing, line[1:])
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	logging.With("repo", r.Name).Infof("Fetching %d missing blobs", len(missing))
+
+	username, password, err := credentials(r)
+	if err != nil {
+		return err
+	}
+	for len(missing) > 0 {
+		n := len(missing)
+		if n > blobBatch {
+			n = blobBatch
+		}
+		args := []string{"-c", "fetch.negotiationAlgorithm=noop", "--git-dir", r.Path,
+			"fetch", "--no-tags", "--no-write-fetch-head", "--recurse-submodules=no", "origin"}
+		if err := callGit("git", append(args, missing[:n]...), username, password); err != nil {
+			return err
+		}
+		missing = missing[n:]
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// exeSuffix is appended to the names of the binaries we look for.
+const exeSuffix = ""
+
+// gitPlatformArgs come before the arguments of every git command.
+var gitPlatformArgs []string
+
+// reloadSignals are the signals -reload-signal can send: those that
+// codesearch -reload_signal reloads on. Any other would stop it. See
+// checkReloadSignal.
+var reloadSignals = map[string]syscall.Signal{
+	"HUP": syscall.SIGHUP,
+}
+
+func sendSignal(pid int, name string) error {
+	sig, ok := reloadSignals[name]
+	if !ok {
+		return fmt.Errorf("codesearch doesn't reload on SIG%s", name)
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// diskFree returns an identifier for the filesystem the existing path p
+// is on, and how many bytes are free on it.
+func diskFree(p string) (uint64, uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(p, &st); err != nil {
+		return 0, 0, fmt.Errorf("stat %s: %s", p, err.Error())
+	}
+	var sfs syscall.Statfs_t
+	if err := syscall.Statfs(p, &sfs); err != nil {
+		return 0, 0, fmt.Errorf("statfs %s: %s", p, err.Error())
+	}
+	return uint64(st.Dev), uint64(sfs.Bavail) * uint64(sfs.Bsize), nil
+}
+
+// replaceFile renames src over dst. Files a backend has open can be
+// replaced; it keeps reading the old one until it reloads.
+func replaceFile(src, dst string) error {
+	return os.Rename(src, dst)
+}
+
+// inUse reports whether err, from removing a file, is because another
+// process has it open, which never stops removal here.
+func inUse(err error) bool {
+	return false
+}
+
+func removeAll(p string) error {
+	return os.RemoveAll(p)
+}
+
+// passSecret arranges for the credential helper run by cmd to read
+// secret from fd 3, so it never touches the environment or the
+// filesystem. The returned function must be called once cmd is done.
+func passSecret(cmd *exec.Cmd, secret string) (func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.ExtraFiles = []*os.File{r}
+	go func() {
+		defer w.Close()
+		w.WriteString(secret)
+	}()
+	return func() { r.Close() }, nil
+}
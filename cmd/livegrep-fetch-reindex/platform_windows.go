@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// exeSuffix is appended to the names of the binaries we look for.
+const exeSuffix = ".exe"
+
+// gitPlatformArgs come before the arguments of every git command. Git
+// for Windows otherwise refuses paths longer than MAX_PATH inside
+// repositories.
+var gitPlatformArgs = []string{"-c", "core.longpaths=true"}
+
+// Windows has no signals to send; backends there are reloaded with
+// -reload-backend.
+func sendSignal(pid int, name string) error {
+	return errors.New("-reload-pidfile isn't supported on Windows; use -reload-backend")
+}
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskFree returns an identifier for the volume the existing path p is
+// on, and how many bytes are free on it.
+func diskFree(p string) (uint64, uint64, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	name, err := syscall.UTF16PtrFromString(abs)
+	if err != nil {
+		return 0, 0, err
+	}
+	var avail uint64
+	if r, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&avail)), 0, 0); r == 0 {
+		return 0, 0, fmt.Errorf("GetDiskFreeSpaceEx %s: %s", abs, err.Error())
+	}
+	var dev uint64
+	for _, c := range strings.ToUpper(filepath.VolumeName(abs)) {
+		dev = dev*31 + uint64(c)
+	}
+	return dev, avail, nil
+}
+
+const (
+	errorAccessDenied     = syscall.Errno(5)
+	errorSharingViolation = syscall.Errno(32)
+)
+
+// replaceFile renames src over dst. Windows won't replace a file that a
+// backend has open, as it does the index it is serving until it
+// reloads, so keep trying for a while.
+func replaceFile(src, dst string) error {
+	var err error
+	for i := 0; i < 20; i++ {
+		if err = os.Rename(src, dst); err == nil || !inUse(err) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("%s (is a backend still serving it? -index-dir avoids replacing files in use)", err.Error())
+}
+
+// inUse reports whether err, from removing or replacing a file, is
+// because another process has it open.
+func inUse(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && (errno == errorSharingViolation || errno == errorAccessDenied)
+}
+
+// removeAll removes p and everything under it. Git makes its object
+// files read-only, which Windows won't delete.
+func removeAll(p string) error {
+	filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode()&0200 == 0 {
+			os.Chmod(path, info.Mode()|0200)
+		}
+		return nil
+	})
+	return os.RemoveAll(p)
+}
+
+// passSecret arranges for the credential helper run by cmd to read
+// secret from the environment, since Windows can't pass the child
+// another file descriptor. The environment of a process is only
+// readable by its own user. The returned function must be called once
+// cmd is done.
+func passSecret(cmd *exec.Cmd, secret string) (func(), error) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "LIVEGREP_GITHUB_PASSWORD="+secret)
+	return func() {}, nil
+}
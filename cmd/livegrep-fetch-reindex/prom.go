@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	// Imported as prom, as metrics is the -metrics-textfile run.
+	prom "github.com/livegrep/livegrep/pkg/metrics"
+)
+
+// With -metrics-listen, fetch-reindex serves running totals for
+// Prometheus to scrape from /metrics, which is most useful when it runs
+// as a daemon, with -poll or -worker. -metrics-textfile covers runs from
+// cron.
+var (
+	promRegistry = prom.NewRegistry()
+
+	promFetches = promRegistry.NewCounter("livegrep_repo_fetches_total",
+		"Repository fetches, by result: ok or failed.", "result")
+	promFetchFailures = promRegistry.NewCounter("livegrep_repo_fetch_failures_total",
+		"Failed repository fetches, by the step that failed: no_remote, credentials, clone, fetch, head, timeout or other.", "reason")
+	promFetchSeconds = promRegistry.NewHistogram("livegrep_repo_fetch_seconds",
+		"How long fetching a repository took.", []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600})
+	promFetchBytes = promRegistry.NewCounter("livegrep_repo_fetch_bytes_total",
+		"How much fetching grew clones on disk.")
+	promIndexBuilds = promRegistry.NewCounter("livegrep_index_builds_total",
+		"Index builds, by result: ok or failed.", "result")
+	promIndexSeconds = promRegistry.NewHistogram("livegrep_index_build_seconds",
+		"How long building the index took.", []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200})
+	promIndexBytes = promRegistry.NewGauge("livegrep_index_size_bytes",
+		"The size of the last index built.")
+)
+
+// A fetchError is a failed fetch, with the step that failed as the
+// reason the failure metric gives.
+type fetchError struct {
+	reason string
+	err    error
+}
+
+func (e *fetchError) Error() string { return e.err.Error() }
+
+// failureReason returns the step that err, from a fetch, failed at.
+func failureReason(err error) string {
+	if fe, ok := err.(*fetchError); ok {
+		return fe.reason
+	}
+	return "other"
+}
+
+// promFetch counts a fetch that took took, grew its clone by grew
+// bytes, and failed at reason, if it isn't "".
+func promFetch(took time.Duration, grew int64, reason string) {
+	promFetchSeconds.Observe(took.Seconds())
+	promFetchBytes.Add(float64(grew))
+	if reason != "" {
+		promFetches.Inc("failed")
+		promFetchFailures.Inc(reason)
+	} else {
+		promFetches.Inc("ok")
+	}
+}
+
+// promIndex counts an index build that took took and ended with err.
+func promIndex(took time.Duration, err error) {
+	promIndexSeconds.Observe(took.Seconds())
+	if err != nil {
+		promIndexBuilds.Inc("failed")
+	} else {
+		promIndexBuilds.Inc("ok")
+	}
+}
+
+// serveMetrics serves /metrics on addr until it fails.
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promRegistry)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/sdnotify"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// With -queue, fetching is spread over any number of -worker processes,
+// possibly on other machines: the coordinator pushes a job per
+// repository onto a Redis list, and workers pop them, fetch the
+// repository into its configured path, and push back the result. The
+// repository paths must be on storage the coordinator and every worker
+// share.
+const (
+	queueJobs   = "livegrep:fetch:jobs"
+	queueResult = "livegrep:fetch:results:"
+)
+
+type fetchJob struct {
+	// The list the worker pushes its result onto.
+	Reply string           `json:"reply"`
+	Repo  *config.RepoSpec `json:"repo"`
+	// The repository Repo borrows objects from, if any, which a worker
+	// has no config to look up; it is fetched in an earlier batch.
+	Reference *config.RepoSpec `json:"reference,omitempty"`
+}
+
+type fetchResult struct {
+	Name    string  `json:"name"`
+	Worker  string  `json:"worker"`
+	Error   string  `json:"error,omitempty"`
+	Reason  string  `json:"reason,omitempty"`
+	Seconds float64 `json:"seconds,omitempty"`
+	Bytes   int64   `json:"bytes,omitempty"`
+}
+
+// redisConn is the smallest Redis client that will do: it speaks just
+// enough RESP to push to and block on lists.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialQueue connects to the -queue; tests replace it.
+var dialQueue = dialRedis
+
+func newRedisConn(conn net.Conn) *redisConn {
+	return &redisConn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// dialRedis connects to a redis://[:password@]host[:port][/db] URL.
+func dialRedis(rawurl string) (*redisConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("%s: only redis:// queues are supported", rawurl)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := newRedisConn(conn)
+	if pass, ok := u.User.Password(); ok {
+		if _, err := c.do("AUTH", pass); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := c.do("SELECT", db); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and returns its reply: a string, an int64, a
+// []interface{}, or nil for a nil reply.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+func (c *redisConn) reply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			if out[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// brpop blocks for up to timeout waiting for a value on key, returning
+// "" if none arrived.
+func (c *redisConn) brpop(key string, timeout time.Duration) (string, error) {
+	secs := int(timeout / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	v, err := c.do("BRPOP", key, strconv.Itoa(secs))
+	if err != nil || v == nil {
+		return "", err
+	}
+	kv, ok := v.([]interface{})
+	if !ok || len(kv) != 2 {
+		return "", fmt.Errorf("redis: unexpected BRPOP reply %v", v)
+	}
+	s, _ := kv[1].(string)
+	return s, nil
+}
+
+// queueCheckout hands every repository to the workers listening on the
+// queue, and waits for them all to be fetched. Like checkoutRepos, it is
+// given one of the batches cloneWaves splits the repositories into.
+func queueCheckout(queue string, repos []*config.RepoSpec) error {
+	c, err := dialQueue(queue)
+	if err != nil {
+		return fmt.Errorf("queue: %s", err.Error())
+	}
+	defer c.Close()
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	reply := queueResult + hex.EncodeToString(id)
+	defer c.do("DEL", reply)
+
+	for _, r := range repos {
+		data, err := json.Marshal(&fetchJob{Reply: reply, Repo: r, Reference: reference(r)})
+		if err != nil {
+			return err
+		}
+		if _, err := c.do("LPUSH", queueJobs, string(data)); err != nil {
+			return fmt.Errorf("queue: %s", err.Error())
+		}
+	}
+	logging.Infof("Queued %d repositories for fetching", len(repos))
+
+	pending := map[string]*config.RepoSpec{}
+	for _, r := range repos {
+		pending[r.Name] = r
+	}
+	deadline := time.Now().Add(*flagQueueTimeout)
+	var failed []string
+	for len(pending) > 0 {
+		if time.Now().After(deadline) {
+			// What no worker got to failed as much as what one did.
+			for _, r := range pending {
+				fetched(r, "", 0, 0, &fetchError{"timeout", errors.New("no worker fetched it before -queue-timeout")})
+			}
+			return fmt.Errorf("queue: timed out with %d of %d repositories fetched; are any workers running?",
+				len(repos)-len(pending), len(repos))
+		}
+		data, err := c.brpop(reply, time.Until(deadline))
+		if err != nil {
+			return fmt.Errorf("queue: %s", err.Error())
+		}
+		if data == "" {
+			continue
+		}
+		var res fetchResult
+		if err := json.Unmarshal([]byte(data), &res); err != nil {
+			return fmt.Errorf("queue: bad result: %s", err.Error())
+		}
+		r := pending[res.Name]
+		if r == nil {
+			logging.With("repo", res.Name, "worker", res.Worker).Warnf("skipping a result for a repository that isn't waiting to be fetched")
+			continue
+		}
+		delete(pending, res.Name)
+		var ferr error
+		if res.Error != "" {
+			ferr = &fetchError{res.Reason, errors.New(res.Error)}
+			failed = append(failed, res.Name)
+		}
+		fetched(r, res.Worker, time.Duration(res.Seconds*float64(time.Second)), res.Bytes, ferr)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("fetching %s failed", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// runWorker fetches repositories from the queue until it fails to talk
+// to it.
+func runWorker(queue, name string) error {
+	c, err := dialQueue(queue)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	logging.Infof("Waiting for jobs on %s", queue)
+	sdnotify.Ready("waiting for jobs on " + queue)
+	for {
+		data, err := c.brpop(queueJobs, 30*time.Second)
+		if err != nil {
+			return err
+		}
+		if data == "" {
+			continue
+		}
+		var job fetchJob
+		if err := json.Unmarshal([]byte(data), &job); err != nil || job.Repo == nil {
+			logging.Warnf("skipping bad job: %s", data)
+			continue
+		}
+		refs := []*config.RepoSpec{job.Repo}
+		if job.Reference != nil {
+			refs = append(refs, job.Reference)
+		}
+		setReferences(refs)
+		res := fetchResult{Name: job.Repo.Name, Worker: name}
+		took, grew, err := timedCheckout(job.Repo)
+		if err != nil {
+			res.Error, res.Reason = err.Error(), failureReason(err)
+		}
+		res.Seconds, res.Bytes = took.Seconds(), grew
+		promFetch(took, grew, res.Reason)
+		out, _ := json.Marshal(&res)
+		if _, err := c.do("LPUSH", job.Reply, string(out)); err != nil {
+			return err
+		}
+		// Results nobody collects (the coordinator gave up) shouldn't
+		// pile up forever.
+		c.do("EXPIRE", job.Reply, strconv.Itoa(int((*flagQueueTimeout)/time.Second)))
+	}
+}
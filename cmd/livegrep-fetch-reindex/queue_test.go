@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+func parseReply(raw string, oneByte bool) (interface{}, error) {
+	r := strings.NewReader(raw)
+	c := &redisConn{r: bufio.NewReader(r)}
+	if oneByte {
+		c.r = bufio.NewReader(iotest.OneByteReader(r))
+	}
+	return c.reply()
+}
+
+func TestRedisReply(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{":42\r\n", int64(42)},
+		{"$5\r\nhello\r\n", "hello"},
+		{"$0\r\n\r\n", ""},
+		{"$-1\r\n", nil},
+		{"*-1\r\n", nil},
+		{"*0\r\n", []interface{}{}},
+		{"*2\r\n$4\r\njobs\r\n*2\r\n:1\r\n$-1\r\n", []interface{}{"jobs", []interface{}{int64(1), nil}}},
+		{"$12\r\nline\r\nbreaks\r\n", "line\r\nbreaks"},
+	} {
+		for _, oneByte := range []bool{false, true} {
+			got, err := parseReply(tc.raw, oneByte)
+			if err != nil {
+				t.Errorf("%q: %v", tc.raw, err)
+			} else if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("%q: got %#v, want %#v", tc.raw, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestRedisReplyErrors(t *testing.T) {
+	for _, raw := range []string{
+		"-ERR wrong number of arguments\r\n",
+		"",
+		"\r\n",
+		"$5\r\nhel",
+		"$5\r\nhello",
+		"*2\r\n:1\r\n",
+		":x\r\n",
+		"$x\r\n",
+		"?what\r\n",
+	} {
+		if got, err := parseReply(raw, false); err == nil {
+			t.Errorf("%q: got %#v, want an error", raw, got)
+		}
+	}
+	_, err := parseReply("-ERR wrong number of arguments\r\n", false)
+	if err == nil || err.Error() != "redis: ERR wrong number of arguments" {
+		t.Errorf("error reply: got %v", err)
+	}
+}
+
+// fakeRedis serves the list commands the queue uses over net.Pipe
+// connections.
+type fakeRedis struct {
+	mu    sync.Mutex
+	lists map[string][]string
+}
+
+func (f *fakeRedis) dial(string) (*redisConn, error) {
+	client, server := net.Pipe()
+	go f.serve(newRedisConn(server))
+	return newRedisConn(client), nil
+}
+
+func (f *fakeRedis) serve(c *redisConn) {
+	defer c.Close()
+	for {
+		cmd, err := c.reply()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, a := range cmd.([]interface{}) {
+			args = append(args, a.(string))
+		}
+		var out string
+		switch args[0] {
+		case "LPUSH":
+			f.mu.Lock()
+			f.lists[args[1]] = append([]string{args[2]}, f.lists[args[1]]...)
+			n := len(f.lists[args[1]])
+			f.mu.Unlock()
+			out = fmt.Sprintf(":%d\r\n", n)
+		case "BRPOP":
+			secs, _ := strconv.Atoi(args[2])
+			out = "*-1\r\n"
+			for deadline := time.Now().Add(time.Duration(secs) * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+				f.mu.Lock()
+				l := f.lists[args[1]]
+				if len(l) > 0 {
+					v := l[len(l)-1]
+					f.lists[args[1]] = l[:len(l)-1]
+					f.mu.Unlock()
+					out = fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[1]), args[1], len(v), v)
+					break
+				}
+				f.mu.Unlock()
+			}
+		case "DEL", "EXPIRE":
+			f.mu.Lock()
+			delete(f.lists, args[1])
+			f.mu.Unlock()
+			out = ":1\r\n"
+		default:
+			out = "-ERR unknown command\r\n"
+		}
+		if _, err := c.conn.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+func TestQueueRoundTrip(t *testing.T) {
+	f := &fakeRedis{lists: map[string][]string{}}
+	dialQueue = f.dial
+	defer func() { dialQueue = dialRedis }()
+
+	// A worker that fetches a and fails to fetch b.
+	go func() {
+		w, _ := f.dial("")
+		defer w.Close()
+		for i := 0; i < 2; i++ {
+			data, err := w.brpop(queueJobs, time.Second)
+			if err != nil || data == "" {
+				return
+			}
+			var job fetchJob
+			json.Unmarshal([]byte(data), &job)
+			res := fetchResult{Name: job.Repo.Name, Worker: "w1", Seconds: 1.5, Bytes: 10}
+			if job.Repo.Name == "b" {
+				res.Error, res.Reason = "authentication failed", "clone"
+			}
+			out, _ := json.Marshal(&res)
+			w.do("LPUSH", job.Reply, string(out))
+		}
+	}()
+
+	err := queueCheckout("redis://fake", []*config.RepoSpec{{Name: "a"}, {Name: "b"}})
+	if err == nil || err.Error() != "fetching b failed" {
+		t.Errorf("queueCheckout: got %v, want b to have failed", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, l := range f.lists {
+		if len(l) > 0 {
+			t.Errorf("%s left with %q", key, l)
+		}
+	}
+}
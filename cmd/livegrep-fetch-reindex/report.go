@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	// Imported as lgreindex, as reindex is a run over the config.
+	lgreindex "github.com/livegrep/livegrep/pkg/reindex"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// writeReport replaces the -report-out report at path with one on the
+// run of the config called name, over repos, which ended with runErr.
+// The report is a reindex.Report, so that pkg/reindex can read it back.
+func (m *runMetrics) writeReport(path, name string, repos []*config.RepoSpec, runErr error) error {
+	if m == nil || path == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := &lgreindex.Report{
+		Name:            name,
+		Started:         m.start,
+		DurationSeconds: time.Since(m.start).Seconds(),
+		OK:              runErr == nil,
+		Repositories:    []*lgreindex.RepoReport{},
+	}
+	if runErr != nil {
+		report.Error = runErr.Error()
+	}
+	if m.indexed {
+		report.Index = &lgreindex.IndexReport{
+			Path:            m.indexPath,
+			DurationSeconds: m.index.seconds,
+			OK:              m.index.ok,
+		}
+		if st, err := os.Stat(m.indexPath); m.indexPath != "" && err == nil {
+			report.Index.SizeBytes = st.Size()
+		}
+	}
+	for _, r := range repos {
+		rr := &lgreindex.RepoReport{
+			Name:             r.Name,
+			Fetch:            "skipped",
+			MissingRevisions: m.missing[r.Name],
+			SkippedTooLarge:  m.tooLarge[r.Name],
+		}
+		if f := m.repos[r.Name]; f != nil {
+			rr.Fetch = "ok"
+			if !f.ok {
+				rr.Fetch, rr.Error = "failed", f.err
+			}
+			rr.DurationSeconds, rr.BytesFetched = f.seconds, f.bytes
+		}
+		if md := r.Metadata; md != nil {
+			rr.Commits, rr.CommitTimes = md.Commits, md.CommitTimes
+		}
+		report.Repositories = append(report.Repositories, rr)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readTooLarge reads codesearch's --too_large_report at path: a line of
+// tab-separated repository, path and size for each file it skipped.
+func readTooLarge(path string) (map[string][]lgreindex.SkippedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	files := map[string][]lgreindex.SkippedFile{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s: bad line %q", path, s.Text())
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad size in %q", path, s.Text())
+		}
+		files[fields[0]] = append(files[fields[0]], lgreindex.SkippedFile{Path: fields[1], SizeBytes: size})
+	}
+	return files, s.Err()
+}
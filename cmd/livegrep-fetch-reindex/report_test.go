@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	lgreindex "github.com/livegrep/livegrep/pkg/reindex"
+)
+
+func TestReadTooLarge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "too-large")
+	data := "a\tdist/bundle.js\t2097152\na\tdata/dump.sql\t1048577\nb\tbig.bin\t3145728\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readTooLarge(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]lgreindex.SkippedFile{
+		"a": {{Path: "dist/bundle.js", SizeBytes: 2097152}, {Path: "data/dump.sql", SizeBytes: 1048577}},
+		"b": {{Path: "big.bin", SizeBytes: 3145728}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readTooLarge: got %+v, want %+v", got, want)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("a\tbig.bin\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTooLarge(path); err == nil {
+		t.Error("readTooLarge: want an error for a line without a size")
+	}
+}
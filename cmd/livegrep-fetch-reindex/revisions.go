@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/src/proto/config"
+	"google.golang.org/protobuf/proto"
+)
+
+// refPrefixes are tried, in order, in front of revision patterns that
+// do not name a full ref.
+var refPrefixes = []string{"refs/heads/", "refs/tags/"}
+
+// resolveRevisions expands the revision patterns and aliases of r
+// against the refs of its freshly fetched mirror, replacing r.Revisions
+// with concrete refs.
+//
+// A revision that names an entry in r.RevisionAliases resolves to the
+// latest (by version sort) ref matching the alias' pattern, and the
+// resolution is recorded in r.Metadata.RevisionAliases. Any other
+// revision containing glob characters expands to every matching ref.
+// Plain revisions are passed through untouched.
+func resolveRevisions(r *config.RepoSpec) error {
+	var refs []string
+	var out []string
+	resolved := map[string]string{}
+	for _, rev := range r.Revisions {
+		pattern, isAlias := r.RevisionAliases[rev]
+		if !isAlias {
+			if !strings.ContainsAny(rev, "*?[") {
+				out = append(out, rev)
+				continue
+			}
+			pattern = rev
+		}
+
+		if refs == nil {
+			var err error
+			if refs, err = listRefs(r.Path); err != nil {
+				return fmt.Errorf("%s: listing refs: %s", r.Name, err.Error())
+			}
+		}
+		matches, err := matchRefs(refs, pattern)
+		if err != nil {
+			return fmt.Errorf("%s: revision %q: %s", r.Name, rev, err.Error())
+		}
+
+		if len(matches) == 0 {
+			if isAlias && !*flagSkipMissing {
+				return fmt.Errorf("%s: no ref matches %q for revision alias %q", r.Name, pattern, rev)
+			}
+			logging.With("repo", r.Name).Warnf("no ref matches %q, skipping revision %q", pattern, rev)
+			metrics.recordMissing(r.Name, rev)
+			continue
+		}
+		if isAlias {
+			latest := matches[len(matches)-1]
+			logging.With("repo", r.Name).Infof("resolved %s to %s", rev, latest)
+			resolved[rev] = latest
+			out = append(out, latest)
+		} else {
+			out = append(out, matches...)
+		}
+	}
+
+	r.Revisions = out
+	if len(resolved) > 0 {
+		if r.Metadata == nil {
+			r.Metadata = &config.Metadata{}
+		}
+		r.Metadata.RevisionAliases = resolved
+	}
+	return nil
+}
+
+// recordCommits records in r.Metadata the commit each of r's revisions
+// points at and when it was committed, and now as the time they were
+// indexed, so that the frontend can say how fresh a result is. A
+// revision that doesn't resolve is left for codesearch to complain
+// about.
+func recordCommits(r *config.RepoSpec, now time.Time) {
+	commits := map[string]string{}
+	times := map[string]int64{}
+	for _, rev := range r.Revisions {
+		out, err := gitCommand("--git-dir", r.Path, "rev-parse", "--verify", "--quiet", rev+"^{commit}").Output()
+		if err != nil {
+			logging.With("repo", r.Name).Warnf("can't resolve revision %q", rev)
+			metrics.recordMissing(r.Name, rev)
+			continue
+		}
+		commit := strings.TrimSpace(string(out))
+		commits[rev] = commit
+		out, err = gitCommand("--git-dir", r.Path, "show", "-s", "--format=%ct", commit).Output()
+		if err != nil {
+			continue
+		}
+		if t, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64); err == nil {
+			times[rev] = t
+		}
+	}
+	if r.Metadata == nil {
+		r.Metadata = &config.Metadata{}
+	}
+	r.Metadata.Commits = commits
+	r.Metadata.CommitTimes = times
+	r.Metadata.IndexedAt = now.Unix()
+}
+
+// listRefs returns the refs of the repository at repoPath, oldest version
+// first.
+func listRefs(repoPath string) ([]string, error) {
+	out, err := gitCommand("--git-dir", repoPath, "for-each-ref",
+		"--sort=version:refname", "--format=%(refname)").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// matchRefs returns the refs matching pattern, preserving their order.
+// A pattern starting with "refs/" is matched against full ref names and
+// yields them; any other pattern is matched against branch and tag names
+// and yields the short name.
+func matchRefs(refs []string, pattern string) ([]string, error) {
+	var matches []string
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		name := ""
+		if strings.HasPrefix(pattern, "refs/") {
+			ok, err := path.Match(pattern, ref)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				name = ref
+			}
+		} else {
+			for _, pfx := range refPrefixes {
+				if !strings.HasPrefix(ref, pfx) {
+					continue
+				}
+				ok, err := path.Match(pattern, strings.TrimPrefix(ref, pfx))
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					name = strings.TrimPrefix(ref, pfx)
+					break
+				}
+			}
+		}
+		if name != "" && !seen[name] {
+			seen[name] = true
+			matches = append(matches, name)
+		}
+	}
+	return matches, nil
+}
+
+// tagHistory returns a copy of r for each of the tags its tag_history
+// selects, which codesearch indexes as a tree of its own at that tag.
+// The copies' metadata records the tag.
+func tagHistory(r *config.RepoSpec) ([]*config.RepoSpec, error) {
+	th := r.TagHistory
+	if th == nil || th.Count <= 0 {
+		return nil, nil
+	}
+	pattern := th.Pattern
+	if pattern == "" {
+		pattern = "*"
+	}
+	refs, err := listRefs(r.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: listing refs: %s", r.Name, err.Error())
+	}
+	tags, err := matchRefs(refs, "refs/tags/"+pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: tag_history: %s", r.Name, err.Error())
+	}
+	if len(tags) > int(th.Count) {
+		tags = tags[len(tags)-int(th.Count):]
+	}
+
+	var out []*config.RepoSpec
+	var names []string
+	for i := len(tags) - 1; i >= 0; i-- {
+		// Everything but what says which revisions to index carries
+		// over, so settings added to RepoSpec and Metadata apply to
+		// the tags too.
+		t := proto.Clone(r).(*config.RepoSpec)
+		t.Revisions = []string{tags[i]}
+		t.RevisionAliases = nil
+		t.TagHistory = nil
+		if t.Metadata == nil {
+			t.Metadata = &config.Metadata{}
+		}
+		t.Metadata.Tag = strings.TrimPrefix(tags[i], "refs/tags/")
+		t.Metadata.RevisionAliases = nil
+		names = append(names, t.Metadata.Tag)
+		out = append(out, t)
+	}
+	if len(out) > 0 {
+		logging.With("repo", r.Name).Infof("also indexing tags %s", strings.Join(names, ", "))
+	}
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+func TestTagHistoryKeepsSettings(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", dir},
+		{"-C", dir, "commit", "-q", "--allow-empty", "-m", "one"},
+		{"-C", dir, "tag", "v1.0"},
+		{"-C", dir, "tag", "v1.1"},
+		{"-C", dir, "tag", "v2.0"},
+	} {
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+	}
+
+	r := &config.RepoSpec{
+		Path:            filepath.Join(dir, ".git"),
+		Name:            "org/app",
+		Revisions:       []string{"main"},
+		RevisionAliases: map[string]string{"stable": "refs/tags/v*"},
+		TagHistory:      &config.TagHistory{Pattern: "v*", Count: 2},
+		FileExcludes:    []string{"vendor/"},
+		Redaction:       &config.Redaction{BuiltinRules: true},
+		Metadata: &config.Metadata{
+			UrlPattern:      "https://git.example.com/{name}/blob/{version}/{path}",
+			LinkRevision:    "commit",
+			LabelMap:        map[string]string{"team": "search"},
+			RevisionAliases: map[string]string{"stable": "refs/tags/v2.0"},
+		},
+	}
+	tags, err := tagHistory(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tag := range tags {
+		names = append(names, tag.Metadata.Tag)
+		if tag.Revisions[0] != "refs/tags/"+tag.Metadata.Tag {
+			t.Errorf("%s: revisions %q", tag.Metadata.Tag, tag.Revisions)
+		}
+		if tag.Metadata.LinkRevision != "commit" || tag.Metadata.LabelMap["team"] != "search" ||
+			tag.Metadata.UrlPattern != r.Metadata.UrlPattern {
+			t.Errorf("%s: metadata not kept: %+v", tag.Metadata.Tag, tag.Metadata)
+		}
+		if !reflect.DeepEqual(tag.FileExcludes, r.FileExcludes) || tag.Redaction == nil || !tag.Redaction.BuiltinRules {
+			t.Errorf("%s: settings not kept: %+v", tag.Metadata.Tag, tag)
+		}
+		if tag.TagHistory != nil || tag.RevisionAliases != nil || tag.Metadata.RevisionAliases != nil {
+			t.Errorf("%s: kept what says which revisions to index: %+v", tag.Metadata.Tag, tag)
+		}
+	}
+	if want := []string{"v2.0", "v1.1"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("tags = %q, want %q", names, want)
+	}
+	if r.Metadata.Tag != "" || len(r.Revisions) != 1 || r.TagHistory == nil {
+		t.Errorf("tagHistory changed the repository: %+v", r)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// stateSaveInterval is the most often -state is rewritten while
+// repositories are being fetched, so that a run with thousands of them
+// doesn't spend its time rewriting the file.
+const stateSaveInterval = 5 * time.Second
+
+// repoState is what -state remembers about one repository: when it was
+// last fetched successfully, and the commit its HEAD was at then.
+type repoState struct {
+	Fetched   time.Time `json:"fetched"`
+	Head      string    `json:"head,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// runState is the -state file. Unlike -failure-history, it is saved as
+// each fetch finishes, rather than at the end of the run, so that it
+// survives the run being killed, and -resume can pick up where it left
+// off. A nil *runState records nothing.
+type runState struct {
+	path string
+
+	mu sync.Mutex
+	// When the run being recorded started, and when it finished, if it
+	// got as far as building and installing the index. A -resume run
+	// continues the last run if it didn't finish.
+	Started  time.Time             `json:"started"`
+	Finished *time.Time            `json:"finished,omitempty"`
+	Repos    map[string]*repoState `json:"repos"`
+	saved    time.Time
+	dirty    bool
+}
+
+func loadState(path string) (*runState, error) {
+	s := &runState{path: path, Repos: map[string]*repoState{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if s.Repos == nil {
+		s.Repos = map[string]*repoState{}
+	}
+	return s, nil
+}
+
+// begin starts recording a run over repos, returning the ones to fetch.
+// With resume, if the last run didn't finish, it carries on with it,
+// and returns only the repositories it didn't fetch successfully, or
+// whose clones are missing or no longer at the commit it fetched;
+// otherwise it starts a new run, and returns all of them.
+func (s *runState) begin(repos []*config.RepoSpec, resume bool) []*config.RepoSpec {
+	if s == nil {
+		return repos
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !resume || s.Finished != nil || s.Started.IsZero() {
+		s.Started, s.Finished = time.Now(), nil
+		s.dirty = true
+		s.save()
+		return repos
+	}
+
+	var out []*config.RepoSpec
+	for _, r := range repos {
+		if !s.fresh(r) {
+			out = append(out, r)
+		}
+	}
+	logging.Infof("Resuming the run started at %s: fetching %d of %d repositories",
+		s.Started.Format(time.RFC3339), len(out), len(repos))
+	return out
+}
+
+// fresh reports whether r was fetched successfully during the run being
+// recorded, and its clone is still as that fetch left it. The lock must
+// be held.
+func (s *runState) fresh(r *config.RepoSpec) bool {
+	rs, ok := s.Repos[r.Name]
+	if !ok || rs.LastError != "" || rs.Fetched.Before(s.Started) {
+		return false
+	}
+	return rs.Head == "" || headCommit(r.Path) == rs.Head
+}
+
+// record notes the result of fetching r, saving the state if it hasn't
+// been saved for stateSaveInterval.
+func (s *runState) record(r *config.RepoSpec, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs, ok := s.Repos[r.Name]
+	if !ok {
+		rs = &repoState{}
+		s.Repos[r.Name] = rs
+	}
+	if err != nil {
+		rs.LastError = err.Error()
+	} else {
+		rs.Fetched, rs.Head, rs.LastError = time.Now(), headCommit(r.Path), ""
+	}
+	s.dirty = true
+	if time.Since(s.saved) >= stateSaveInterval {
+		s.save()
+	}
+}
+
+// flush saves anything not yet saved.
+func (s *runState) flush() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.save()
+}
+
+// finish marks the run finished, forgets repositories that are no
+// longer configured, and saves the state.
+func (s *runState) finish(repos []*config.RepoSpec) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	configured := map[string]bool{}
+	for _, r := range repos {
+		configured[r.Name] = true
+	}
+	for name := range s.Repos {
+		if !configured[name] {
+			delete(s.Repos, name)
+		}
+	}
+	now := time.Now()
+	s.Finished = &now
+	s.dirty = true
+	s.save()
+}
+
+// save writes the state, if it has changed, replacing the file so that
+// a run killed while saving leaves the last one. The lock must be held.
+func (s *runState) save() {
+	if !s.dirty {
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		logging.Errorf("saving state: %s", err.Error())
+		return
+	}
+	s.saved, s.dirty = time.Now(), false
+}
+
+// headCommit returns the commit HEAD is at in the clone at gitDir, or ""
+// if it can't be read.
+func headCommit(gitDir string) string {
+	out, err := gitCommand("--git-dir", gitDir, "rev-parse", "--verify", "--quiet", "HEAD^{commit}").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// buildSymbols runs ctags over the first revision of each of repos and
+// indexes the definitions it finds at out, for codesearch -load_tags to
+// rank definitions first and answer sym: queries from. Each repository's
+// tags become a tree of the same name holding a single tags file, the
+// layout codesearch looks tags up in.
+func buildSymbols(repos []*config.RepoSpec, out string) error {
+	dir, err := ioutil.TempDir(filepath.Dir(out), ".livegrep-symbols-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	spec := &config.IndexSpec{Name: "symbols"}
+	start := time.Now()
+	for i, r := range repos {
+		if len(r.Revisions) == 0 {
+			continue
+		}
+		tree := filepath.Join(dir, strconv.Itoa(i))
+		if err := writeTags(r, tree); err != nil {
+			return fmt.Errorf("%s: %s", r.Name, err.Error())
+		}
+		spec.Paths = append(spec.Paths, &config.PathSpec{Name: r.Name, Path: tree})
+	}
+	logging.With("phase", "symbols", "duration", time.Since(start)).Infof("Extracted symbols from %d repositories", len(spec.Paths))
+
+	configPath, cleanup, err := indexspec.JSONFor(dir, spec)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	tmp := out + ".tmp"
+	cmd := exec.Command(findCodesearch(*flagCodesearch), "--dump_index", tmp, "--index_only", configPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("codesearch: %s", err.Error())
+	}
+	return replaceFile(tmp, out)
+}
+
+// writeTags checks r's first revision out into a scratch directory next
+// to tree, runs ctags over it, and writes the tags it finds to
+// tree/tags.
+func writeTags(r *config.RepoSpec, tree string) error {
+	src := tree + ".src"
+	defer os.RemoveAll(src)
+	if err := extractRevision(r.Path, r.Revisions[0], src); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tree, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(tree, "tags"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The format codesearch parses tag lines in: name, path, line
+	// number and kind.
+	cmd := exec.Command(*flagCtags, "--format=2", "-n", "--fields=+K", "-R", "-f", "-")
+	cmd.Dir = src
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("ctags: %s", err.Error())
+	}
+	w := bufio.NewWriter(f)
+	werr := copyTags(w, stdout)
+	if werr == nil {
+		werr = w.Flush()
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ctags: %s", err.Error())
+	}
+	if werr != nil {
+		return werr
+	}
+	return f.Close()
+}
+
+// copyTags copies the tag lines ctags wrote to r to w, leaving out its
+// !_TAG_ header lines and cleaning each path, which codesearch must find
+// the indexed file under exactly.
+func copyTags(w io.Writer, r io.Reader) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "!_TAG_") {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		fields[1] = path.Clean(filepath.ToSlash(fields[1]))
+		if _, err := io.WriteString(w, strings.Join(fields, "\t")+"\n"); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// extractRevision writes the files of rev in the repository at gitDir
+// to dst.
+func extractRevision(gitDir, rev, dst string) error {
+	cmd := gitCommand("--git-dir", gitDir, "archive", "--format=tar", rev)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	xerr := untar(tar.NewReader(stdout), dst)
+	if xerr != nil {
+		io.Copy(ioutil.Discard, stdout)
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("git archive %s: %s", rev, err.Error())
+	}
+	return xerr
+}
+
+// untar writes the regular files in t under dst. Symlinks are left out,
+// as codesearch indexes the files they point to where they are.
+func untar(t *tar.Reader, dst string) error {
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(h.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("bad path in archive: %q", h.Name)
+		}
+		p := filepath.Join(dst, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(p)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, t)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
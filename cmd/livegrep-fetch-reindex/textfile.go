@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lgreindex "github.com/livegrep/livegrep/pkg/reindex"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// -metrics-textfile writes what each run did in the Prometheus text
+// format, for node_exporter's textfile collector to pick up: how long
+// fetching each repository took and how much its clone grew, whether it
+// succeeded and when it last did, and the same for building the index.
+//
+// A run that fails part way still writes the file, and the last success
+// timestamps are carried over from the previous file, so that an alert
+// on their age fires however the runs are failing.
+const (
+	metricFetchSeconds = "livegrep_fetch_duration_seconds"
+	metricFetchBytes   = "livegrep_fetch_bytes"
+	metricFetchOK      = "livegrep_fetch_success"
+	metricFetchLast    = "livegrep_fetch_last_success_timestamp_seconds"
+	metricIndexSeconds = "livegrep_index_build_duration_seconds"
+	metricIndexOK      = "livegrep_index_build_success"
+	metricIndexLast    = "livegrep_index_last_success_timestamp_seconds"
+	metricRunLast      = "livegrep_reindex_last_run_timestamp_seconds"
+)
+
+type fetchMetrics struct {
+	seconds float64
+	bytes   int64
+	ok      bool
+	err     string
+}
+
+// runMetrics collects the metrics of one run. A nil *runMetrics records
+// nothing.
+type runMetrics struct {
+	mu      sync.Mutex
+	start   time.Time
+	repos   map[string]*fetchMetrics
+	indexed bool
+	index   fetchMetrics
+	// For -report-out: the index built, the revisions of each
+	// repository that were skipped because they didn't resolve, and the
+	// files of each that codesearch skipped for their size
+	indexPath string
+	missing   map[string][]string
+	tooLarge  map[string][]lgreindex.SkippedFile
+}
+
+// metrics is the current run's, if -metrics-textfile or -report-out is
+// set.
+var metrics *runMetrics
+
+func newRunMetrics() *runMetrics {
+	if *flagMetricsFile == "" && *flagReportOut == "" {
+		return nil
+	}
+	return &runMetrics{
+		start:   time.Now(),
+		repos:   map[string]*fetchMetrics{},
+		missing: map[string][]string{},
+	}
+}
+
+// recordFetch notes the result of fetching the named repository.
+func (m *runMetrics) recordFetch(name string, took time.Duration, grew int64, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := &fetchMetrics{seconds: took.Seconds(), bytes: grew, ok: err == nil}
+	if err != nil {
+		f.err = err.Error()
+	}
+	m.repos[name] = f
+}
+
+// recordMissing notes that the named repository's revision rev was
+// skipped because it didn't resolve.
+func (m *runMetrics) recordMissing(name, rev string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.missing[name] = append(m.missing[name], rev)
+}
+
+// recordIndexPath notes where the index was written.
+func (m *runMetrics) recordIndexPath(path string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.indexPath = path
+}
+
+// recordTooLarge notes the files codesearch skipped for exceeding the
+// size limit, by repository.
+func (m *runMetrics) recordTooLarge(files map[string][]lgreindex.SkippedFile) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tooLarge = files
+}
+
+// recordIndex notes the result of building the index.
+func (m *runMetrics) recordIndex(took time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.indexed = true
+	m.index = fetchMetrics{seconds: took.Seconds(), ok: err == nil}
+}
+
+// write replaces the textfile at path. Repositories that were not
+// fetched this run, because it stopped early, keep only their last
+// success timestamps; those no longer configured are dropped.
+func (m *runMetrics) write(path string, repos []*config.RepoSpec) error {
+	if m == nil || path == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	last := readLastSuccess(path)
+	now := float64(time.Now().UnixNano()) / 1e9
+
+	names := make([]string, 0, len(repos))
+	for _, r := range repos {
+		names = append(names, r.Name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	header := func(name, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	sample := func(name, repo string, v float64) {
+		fmt.Fprintf(&buf, "%s{repo=\"%s\"} %s\n", name, escapeLabel(repo), formatValue(v))
+	}
+
+	for _, g := range []struct {
+		name, help string
+		value      func(*fetchMetrics) float64
+	}{
+		{metricFetchSeconds, "How long the last fetch of the repository took.",
+			func(f *fetchMetrics) float64 { return f.seconds }},
+		{metricFetchBytes, "How much the repository's clone grew on disk in the last fetch.",
+			func(f *fetchMetrics) float64 { return float64(f.bytes) }},
+		{metricFetchOK, "Whether the last fetch of the repository succeeded.",
+			func(f *fetchMetrics) float64 { return boolValue(f.ok) }},
+	} {
+		header(g.name, g.help)
+		for _, n := range names {
+			if f := m.repos[n]; f != nil {
+				sample(g.name, n, g.value(f))
+			}
+		}
+	}
+	header(metricFetchLast, "When the repository was last fetched successfully.")
+	for _, n := range names {
+		t, ok := last[n]
+		if f := m.repos[n]; f != nil && f.ok {
+			t, ok = now, true
+		}
+		if ok {
+			sample(metricFetchLast, n, t)
+		}
+	}
+
+	if m.indexed {
+		header(metricIndexSeconds, "How long the last index build took.")
+		fmt.Fprintf(&buf, "%s %s\n", metricIndexSeconds, formatValue(m.index.seconds))
+		header(metricIndexOK, "Whether the last index build succeeded.")
+		fmt.Fprintf(&buf, "%s %s\n", metricIndexOK, formatValue(boolValue(m.index.ok)))
+	}
+	t, ok := last[""]
+	if m.indexed && m.index.ok {
+		t, ok = now, true
+	}
+	if ok {
+		header(metricIndexLast, "When an index was last built successfully.")
+		fmt.Fprintf(&buf, "%s %s\n", metricIndexLast, formatValue(t))
+	}
+	header(metricRunLast, "When the last run started.")
+	fmt.Fprintf(&buf, "%s %s\n", metricRunLast, formatValue(float64(m.start.UnixNano())/1e9))
+
+	// The collector may read the file at any time, so it must never see
+	// it half written.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readLastSuccess returns the last success timestamps in the textfile at
+// path, by repository name, with the index's under "".
+func readLastSuccess(path string) map[string]float64 {
+	last := map[string]float64{}
+	f, err := os.Open(path)
+	if err != nil {
+		return last
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	prefix := metricFetchLast + `{repo="`
+	for s.Scan() {
+		line := s.Text()
+		var key, value string
+		switch {
+		case strings.HasPrefix(line, prefix):
+			rest := line[len(prefix):]
+			i := strings.LastIndex(rest, `"} `)
+			if i < 0 {
+				continue
+			}
+			key, value = unescapeLabel(rest[:i]), rest[i+3:]
+		case strings.HasPrefix(line, metricIndexLast+" "):
+			value = line[len(metricIndexLast)+1:]
+		default:
+			continue
+		}
+		if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			last[key] = v
+		}
+	}
+	return last
+}
+
+var (
+	labelEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labelUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n")
+)
+
+func escapeLabel(s string) string   { return labelEscaper.Replace(s) }
+func unescapeLabel(s string) string { return labelUnescaper.Replace(s) }
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pageLimit is how many projects to ask for in each page.
+const pageLimit = 500
+
+// xssiPrefix starts every JSON response from Gerrit, to stop it from
+// being run as a script.
+var xssiPrefix = []byte(")]}'")
+
+// A Project is the part of a Gerrit project the config is built from.
+type Project struct {
+	Name string `json:"-"`
+	// ACTIVE, READ_ONLY or HIDDEN
+	State string `json:"state"`
+	// Set on the last project of a page if there are more
+	More bool `json:"_more_projects"`
+}
+
+// A client talks to the REST API of a Gerrit server, authenticating
+// with an HTTP password if it has one.
+type client struct {
+	base     string
+	user     string
+	password string
+	http     *http.Client
+}
+
+func newClient(base, user, password string) *client {
+	return &client{
+		base:     strings.TrimSuffix(base, "/"),
+		user:     user,
+		password: password,
+		http:     http.DefaultClient,
+	}
+}
+
+func (c *client) get(path string, params url.Values, out interface{}) error {
+	// The /a/ prefix asks for the authenticated API.
+	u := c.base + path
+	if c.password != "" {
+		u = c.base + "/a" + path
+	}
+	req, err := http.NewRequest("GET", u+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.password != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes.TrimPrefix(body, xssiPrefix), out)
+}
+
+// ListProjects lists the code projects whose names start with prefix,
+// or every one if it is "", sorted by name.
+func (c *client) ListProjects(prefix string) ([]*Project, error) {
+	var out []*Project
+	params := url.Values{
+		"type": {"CODE"},
+		"n":    {strconv.Itoa(pageLimit)},
+	}
+	if prefix != "" {
+		params.Set("p", prefix)
+	}
+	for skip := 0; ; skip += pageLimit {
+		params.Set("S", strconv.Itoa(skip))
+		page := map[string]*Project{}
+		if err := c.get("/projects/", params, &page); err != nil {
+			return nil, err
+		}
+		more := false
+		for name, p := range page {
+			p.Name = name
+			more = more || p.More
+			out = append(out, p)
+		}
+		if !more || len(page) == 0 {
+			break
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// GetProject loads the project name.
+func (c *client) GetProject(name string) (*Project, error) {
+	var p Project
+	if err := c.get("/projects/"+url.PathEscape(name), url.Values{}, &p); err != nil {
+		return nil, err
+	}
+	p.Name = name
+	return &p, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/reindex"
+	"github.com/livegrep/livegrep/pkg/sentry"
+)
+
+var (
+	flagGerritUrl  = flag.String("gerrit-url", "https://gerrit.example.com", "Gerrit server url, where its REST API and HTTP clones are served")
+	flagGerritUser = flag.String("gerrit-user", os.Getenv("GERRIT_USER"), "Gerrit username, to authenticate with -gerrit-password as")
+	flagGerritPass = flag.String("gerrit-password", os.Getenv("GERRIT_HTTP_PASSWORD"), "Gerrit HTTP password, from Settings > HTTP Credentials")
+	flagGitilesUrl = flag.String("gitiles-url", "", "Base url of the gitiles serving the projects, for links; by default, ${gerrit-url}/plugins/gitiles")
+	flagUrlPattern = flag.String("url-pattern", "", "when using the local frontend fileviewer, this string will be used to construt a link to the file source; by default, ${gitiles-url}/{name}/+/{version}/{path}#{lno}")
+	flagReadOnly   = flag.Bool("read-only", false, "whether to index projects whose state is READ_ONLY")
+
+	flagProjects reindex.StringList
+	flagPrefixes reindex.StringList
+
+	common = reindex.RegisterFlags(flag.CommandLine, reindex.FlagOptions{})
+)
+
+func init() {
+	flag.Var(&flagProjects, "project", "Specify a gerrit project to index (may be passed multiple times)")
+	flag.Var(&flagPrefixes, "prefix", "Index the gerrit projects whose names start with this prefix (may be passed multiple times)")
+}
+
+func main() {
+	flag.Parse()
+	if err := logging.Init("gerrit-reindex"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := sentry.Init("gerrit-reindex"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer sentry.Recover()
+
+	configPath, err := common.ConfigPath()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	opts, err := common.Options()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	opts.URLPattern = *flagUrlPattern
+	ignorelist, allowlist, err := common.RepoLists()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	gerrit := newClient(*flagGerritUrl, *flagGerritUser, *flagGerritPass)
+	repos, err := loadRepos(gerrit, flagProjects, flagPrefixes)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	repos = filterRepos(repos, ignorelist, allowlist, !*flagReadOnly)
+	toIndex := toRepos(repos)
+	reindex.SortByName(toIndex)
+
+	sentry.SetTag("config", common.Name)
+	cfg := reindex.BuildConfig(toIndex, opts)
+	if err := common.WriteConfig(configPath, cfg); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if common.DryRun {
+		return
+	}
+
+	fr := common.NewFetchReindex()
+	if *flagGerritPass != "" {
+		fr.Env = []string{"GERRIT_HTTP_PASSWORD=" + *flagGerritPass}
+	}
+	if _, err := fr.Run(context.Background(), configPath, nil); err != nil {
+		log.Fatalln(err.Error())
+	}
+}
+
+// loadRepos loads the projects named by projects and those whose
+// names start with one of prefixes, each once, or, if neither is given,
+// every code project the user can see.
+func loadRepos(gerrit *client, projects, prefixes []string) ([]*Project, error) {
+	var out []*Project
+	seen := map[string]bool{}
+	add := func(ps []*Project) {
+		for _, p := range ps {
+			if !seen[p.Name] {
+				seen[p.Name] = true
+				out = append(out, p)
+			}
+		}
+	}
+
+	if len(projects) == 0 && len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	for _, name := range projects {
+		p, err := gerrit.GetProject(name)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %s", name, err.Error())
+		}
+		add([]*Project{p})
+	}
+	for _, prefix := range prefixes {
+		ps, err := gerrit.ListProjects(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("listing projects: %s", err.Error())
+		}
+		add(ps)
+	}
+	return out, nil
+}
+
+// metaProjects hold Gerrit's own configuration rather than code.
+var metaProjects = map[string]bool{
+	"All-Projects": true,
+	"All-Users":    true,
+}
+
+func filterRepos(repos []*Project,
+	ignorelist, allowlist *indexspec.RepoList,
+	excludeReadOnly bool) []*Project {
+	var out []*Project
+
+	for _, r := range repos {
+		if metaProjects[r.Name] {
+			continue
+		}
+		if r.State == "HIDDEN" {
+			logging.With("repo", r.Name).Infof("Excluding hidden %s...", r.Name)
+			continue
+		}
+		if excludeReadOnly && r.State == "READ_ONLY" {
+			logging.With("repo", r.Name).Infof("Excluding read-only %s...", r.Name)
+			continue
+		}
+		if !indexspec.Allowed(r.Name, ignorelist, allowlist) {
+			continue
+		}
+		out = append(out, r)
+	}
+
+	return out
+}
+
+// toRepos returns how to index repos.
+func toRepos(repos []*Project) []*reindex.Repo {
+	gerritUrl := strings.TrimSuffix(*flagGerritUrl, "/")
+	gitilesUrl := strings.TrimSuffix(*flagGitilesUrl, "/")
+	if gitilesUrl == "" {
+		gitilesUrl = gerritUrl + "/plugins/gitiles"
+	}
+
+	out := make([]*reindex.Repo, len(repos))
+	for i, r := range repos {
+		// Gerrit serves authenticated clones under /a/.
+		remote := gerritUrl + "/" + r.Name
+		var passwordEnv string
+		if *flagGerritPass != "" {
+			remote = gerritUrl + "/a/" + r.Name
+			passwordEnv = "GERRIT_HTTP_PASSWORD"
+		}
+		out[i] = &reindex.Repo{
+			Name:        r.Name,
+			Remote:      remote,
+			WebURL:      gitilesUrl + "/" + r.Name,
+			URLPattern:  gitilesUrl + "/{name}/+/{version}/{path}#{lno}",
+			Username:    *flagGerritUser,
+			PasswordEnv: passwordEnv,
+		}
+	}
+	return out
+}
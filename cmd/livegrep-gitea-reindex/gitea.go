@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// pageLimit is how many repositories to ask for in each page; Gitea
+// caps it at its MAX_RESPONSE_ITEMS, 50 by default.
+const pageLimit = 50
+
+// A Repository is the part of a Gitea (or Forgejo) repository the
+// config is built from.
+type Repository struct {
+	ID       int64  `json:"id"`
+	FullName string `json:"full_name"`
+	HTMLURL  string `json:"html_url"`
+	CloneURL string `json:"clone_url"`
+	SSHURL   string `json:"ssh_url"`
+	Fork     bool   `json:"fork"`
+	Archived bool   `json:"archived"`
+	Mirror   bool   `json:"mirror"`
+	Empty    bool   `json:"empty"`
+	// In KiB
+	Size int64 `json:"size"`
+	// Set if the repository is a fork, to the one it was forked from
+	Parent *struct {
+		FullName string `json:"full_name"`
+	} `json:"parent"`
+}
+
+// A client talks to the v1 API of a Gitea instance.
+type client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newClient(base, token string) *client {
+	return &client{
+		base:  strings.TrimSuffix(base, "/"),
+		token: token,
+		http:  http.DefaultClient,
+	}
+}
+
+func (c *client) get(path string, params url.Values, out interface{}) error {
+	req, err := http.NewRequest("GET", c.base+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "token "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// list fetches every page of the repositories at path. search says the
+// endpoint wraps them in {"data": [...]}, as /repos/search does.
+func (c *client) list(path string, params url.Values, search bool) ([]*Repository, error) {
+	var out []*Repository
+	params.Set("limit", strconv.Itoa(pageLimit))
+	for page := 1; ; page++ {
+		params.Set("page", strconv.Itoa(page))
+		var repos []*Repository
+		if search {
+			var res struct {
+				Data []*Repository `json:"data"`
+			}
+			if err := c.get(path, params, &res); err != nil {
+				return nil, err
+			}
+			repos = res.Data
+		} else if err := c.get(path, params, &repos); err != nil {
+			return nil, err
+		}
+		out = append(out, repos...)
+		if len(repos) < pageLimit {
+			return out, nil
+		}
+	}
+}
+
+// OrgRepos lists the repositories of the organization org.
+func (c *client) OrgRepos(org string) ([]*Repository, error) {
+	return c.list("/orgs/"+url.PathEscape(org)+"/repos", url.Values{}, false)
+}
+
+// UserRepos lists the repositories the user owns.
+func (c *client) UserRepos(user string) ([]*Repository, error) {
+	return c.list("/users/"+url.PathEscape(user)+"/repos", url.Values{}, false)
+}
+
+// TopicRepos lists the repositories tagged with topic.
+func (c *client) TopicRepos(topic string) ([]*Repository, error) {
+	return c.list("/repos/search", url.Values{"q": {topic}, "topic": {"true"}}, true)
+}
+
+// Repo loads the repository owner/name.
+func (c *client) Repo(fullName string) (*Repository, error) {
+	bits := strings.SplitN(fullName, "/", 2)
+	if len(bits) != 2 {
+		return nil, fmt.Errorf("Bad repository: %s", fullName)
+	}
+	var r Repository
+	if err := c.get("/repos/"+url.PathEscape(bits[0])+"/"+url.PathEscape(bits[1]), url.Values{}, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// AllRepos lists every repository the token can see.
+func (c *client) AllRepos() ([]*Repository, error) {
+	return c.list("/repos/search", url.Values{}, true)
+}
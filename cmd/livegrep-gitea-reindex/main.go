@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/reindex"
+	"github.com/livegrep/livegrep/pkg/sentry"
+)
+
+var (
+	flagApiBaseUrl   = flag.String("api-base-url", "https://gitea.example.com/api/v1", "Gitea API base url")
+	flagGiteaToken   = flag.String("gitea-token", os.Getenv("GITEA_TOKEN"), "Gitea access token")
+	flagUrlPattern   = flag.String("url-pattern", "", "when using the local frontend fileviewer, this string will be used to construt a link to the file source on gitea; by default, each repository's page with /src/commit/{version}/{path}#L{lno}")
+	flagForks        = flag.Bool("forks", true, "whether to index repositories that are forks, and not original repos")
+	flagArchived     = flag.Bool("archived", false, "whether to index repositories that are archived on gitea")
+	flagMirrors      = flag.Bool("mirrors", true, "whether to index repositories that are pull mirrors of another")
+	flagHTTP         = flag.Bool("http", false, "clone repositories over HTTPS instead of SSH")
+	flagHTTPUsername = flag.String("http-user", "git", "Override the username to use when cloning over https")
+
+	flagRepos  reindex.StringList
+	flagOrgs   reindex.StringList
+	flagUsers  reindex.StringList
+	flagTopics reindex.StringList
+
+	common = reindex.RegisterFlags(flag.CommandLine, reindex.FlagOptions{Forks: true, Sizes: true})
+)
+
+func init() {
+	flag.Var(&flagRepos, "repo", "Specify a repo to index, as owner/name (may be passed multiple times)")
+	flag.Var(&flagOrgs, "org", "Specify a gitea organization to index (may be passed multiple times)")
+	flag.Var(&flagUsers, "user", "Specify a gitea user whose repositories to index (may be passed multiple times)")
+	flag.Var(&flagTopics, "topic", "Only index repositories with this topic; alone, index every repository with it (may be passed multiple times)")
+}
+
+func main() {
+	flag.Parse()
+	if err := logging.Init("gitea-reindex"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := sentry.Init("gitea-reindex"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer sentry.Recover()
+
+	configPath, err := common.ConfigPath()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	opts, err := common.Options()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	opts.URLPattern = *flagUrlPattern
+	ignorelist, allowlist, err := common.RepoLists()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	gitea := newClient(*flagApiBaseUrl, *flagGiteaToken)
+	repos, err := loadRepos(gitea, flagRepos, flagOrgs, flagUsers, flagTopics)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	repos = filterRepos(repos, ignorelist, allowlist, !*flagForks, !*flagArchived, !*flagMirrors)
+	toIndex := toRepos(repos)
+	reindex.SortByName(toIndex)
+
+	sentry.SetTag("config", common.Name)
+	cfg := reindex.BuildConfig(toIndex, opts)
+	if err := common.WriteConfig(configPath, cfg); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if common.DryRun {
+		return
+	}
+
+	fr := common.NewFetchReindex()
+	if *flagGiteaToken != "" {
+		fr.Env = []string{"GITEA_TOKEN=" + *flagGiteaToken}
+	}
+	if _, err := fr.Run(context.Background(), configPath, nil); err != nil {
+		log.Fatalln(err.Error())
+	}
+}
+
+// loadRepos loads the repositories named by repos, those of the
+// organizations orgs and of users, each once. With topics, only those
+// with one of them are kept, or, if nothing else is given, every
+// repository with one of them is loaded. With none of them, it loads
+// every repository the token can see.
+func loadRepos(gitea *client, repos, orgs, users, topics []string) ([]*Repository, error) {
+	var out []*Repository
+	seen := map[int64]bool{}
+	add := func(rs []*Repository) {
+		for _, r := range rs {
+			if !seen[r.ID] {
+				seen[r.ID] = true
+				out = append(out, r)
+			}
+		}
+	}
+
+	var tagged []*Repository
+	for _, topic := range topics {
+		rs, err := gitea.TopicRepos(topic)
+		if err != nil {
+			return nil, fmt.Errorf("listing topic %s: %s", topic, err.Error())
+		}
+		tagged = append(tagged, rs...)
+	}
+
+	if len(repos) == 0 && len(orgs) == 0 && len(users) == 0 {
+		if len(topics) > 0 {
+			add(tagged)
+			return out, nil
+		}
+		rs, err := gitea.AllRepos()
+		if err != nil {
+			return nil, fmt.Errorf("listing repositories: %s", err.Error())
+		}
+		add(rs)
+		return out, nil
+	}
+
+	for _, repo := range repos {
+		r, err := gitea.Repo(repo)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %s", repo, err.Error())
+		}
+		add([]*Repository{r})
+	}
+	for _, org := range orgs {
+		rs, err := gitea.OrgRepos(org)
+		if err != nil {
+			return nil, fmt.Errorf("listing org %s: %s", org, err.Error())
+		}
+		add(rs)
+	}
+	for _, user := range users {
+		rs, err := gitea.UserRepos(user)
+		if err != nil {
+			return nil, fmt.Errorf("listing user %s: %s", user, err.Error())
+		}
+		add(rs)
+	}
+
+	if len(topics) == 0 {
+		return out, nil
+	}
+	hasTopic := map[int64]bool{}
+	for _, r := range tagged {
+		hasTopic[r.ID] = true
+	}
+	var kept []*Repository
+	for _, r := range out {
+		if hasTopic[r.ID] {
+			kept = append(kept, r)
+		}
+	}
+	return kept, nil
+}
+
+func filterRepos(repos []*Repository,
+	ignorelist, allowlist *indexspec.RepoList,
+	excludeForks, excludeArchived, excludeMirrors bool) []*Repository {
+	var out []*Repository
+
+	for _, r := range repos {
+		if r.Empty {
+			logging.With("repo", r.FullName).Infof("Excluding empty %s...", r.FullName)
+			continue
+		}
+		if excludeForks && r.Fork {
+			logging.With("repo", r.FullName).Infof("Excluding fork %s...", r.FullName)
+			continue
+		}
+		if excludeArchived && r.Archived {
+			logging.With("repo", r.FullName).Infof("Excluding archived %s...", r.FullName)
+			continue
+		}
+		if excludeMirrors && r.Mirror {
+			logging.With("repo", r.FullName).Infof("Excluding mirror %s...", r.FullName)
+			continue
+		}
+		if !indexspec.Allowed(r.FullName, ignorelist, allowlist) {
+			continue
+		}
+		out = append(out, r)
+	}
+
+	return out
+}
+
+// toRepos returns how to index repos.
+func toRepos(repos []*Repository) []*reindex.Repo {
+	var passwordEnv string
+	if *flagGiteaToken != "" {
+		passwordEnv = "GITEA_TOKEN"
+	}
+	out := make([]*reindex.Repo, len(repos))
+	for i, r := range repos {
+		remote := r.SSHURL
+		if *flagHTTP {
+			remote = r.CloneURL
+		}
+		out[i] = &reindex.Repo{
+			Name:        r.FullName,
+			Remote:      remote,
+			WebURL:      r.HTMLURL,
+			URLPattern:  strings.TrimSuffix(r.HTMLURL, "/") + "/src/commit/{version}/{path}#L{lno}",
+			Username:    *flagHTTPUsername,
+			PasswordEnv: passwordEnv,
+			Size:        r.Size << 10,
+		}
+		if r.Parent != nil {
+			out[i].Parent = r.Parent.FullName
+		}
+	}
+	return out
+}
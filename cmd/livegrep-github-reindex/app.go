@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/githubapp"
+	"github.com/livegrep/livegrep/pkg/logging"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// tokenFile is where, under -dir, the installation token is kept for
+// fetch-reindex to clone with.
+const tokenFile = ".github-app-token"
+
+// appTokens returns the token source of the -github-app-id app's
+// installation: -github-app-installation-id, or else the one on the
+// owner of the first -org, -user or -repo, or else the app's only one.
+func appTokens(ctx context.Context) (*githubapp.TokenSource, error) {
+	key, err := githubapp.LoadKey(*flagAppKey)
+	if err != nil {
+		return nil, err
+	}
+	app := &githubapp.App{ID: *flagAppID, Key: key, BaseURL: *flagApiBaseUrl}
+	id := *flagAppInstallation
+	if id == 0 {
+		if id, err = app.FindInstallation(ctx, installationOwner()); err != nil {
+			return nil, err
+		}
+	}
+	ts := app.TokenSource(id)
+	// Fail now, rather than on the first API call, if the app can't
+	// act as the installation.
+	if _, _, err := ts.Token(ctx); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func installationOwner() string {
+	switch {
+	case len(flagOrgs) > 0:
+		return flagOrgs[0]
+	case len(flagUsers) > 0:
+		return flagUsers[0]
+	case len(flagRepos) > 0:
+		return strings.SplitN(flagRepos[0], "/", 2)[0]
+	}
+	return ""
+}
+
+// oauthTokens has the API client authenticate with the installation's
+// tokens, which ts replaces as they expire.
+type oauthTokens struct {
+	ts *githubapp.TokenSource
+}
+
+func (o oauthTokens) Token() (*oauth2.Token, error) {
+	token, expires, err := o.ts.Token(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: token, Expiry: expires}, nil
+}
+
+// keepTokenFile writes a token to the token file under dir, and keeps
+// it current every minute, until ctx is done. An index rebuild can
+// clone for longer than one token lasts, and fetch-reindex reads the
+// file afresh for each repository.
+func keepTokenFile(ctx context.Context, ts *githubapp.TokenSource, dir string) error {
+	file := path.Join(dir, tokenFile)
+	if err := ts.WriteFile(ctx, file); err != nil {
+		return err
+	}
+	go func() {
+		tick := time.NewTicker(time.Minute)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if err := ts.WriteFile(ctx, file); err != nil {
+					logging.Errorf("refreshing %s: %s", file, err.Error())
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
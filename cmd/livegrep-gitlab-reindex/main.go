@@ -1,298 +1,176 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
-	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"path"
-	"sort"
-	"strings"
+	"time"
 
 	"github.com/xanzy/go-gitlab"
 
-	"github.com/livegrep/livegrep/src/proto/config"
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/reindex"
+	"github.com/livegrep/livegrep/pkg/reindex/gitlabsource"
+	"github.com/livegrep/livegrep/pkg/sentry"
 )
 
 const BLDeprecatedMessage = "This flag has been deprecated and will be removed in a future release. Please switch to the '-ignorelist' option."
 
 var (
-	flagCodesearch   = flag.String("codesearch", "", "Path to the `codesearch` binary")
-	flagFetchReindex = flag.String("fetch-reindex", "", "Path to the `livegrep-fetch-reindex` binary")
-	flagApiBaseUrl   = flag.String("api-base-url", "https://gitlab.example.com/api/v4", "Gitlab API base url")
-	flagGitlabToken  = flag.String("gitlab-token", os.Getenv("GITLAB_TOKEN"), "Gitlab access token")
-	flagRepoDir      = flag.String("dir", "repos", "Directory to store repos")
-	flagIgnorelist   = flag.String("ignorelist", "", "File containing a list of repositories to ignore when indexing")
-	flagIndexPath    = dynamicDefault{
-		display: "${dir}/livegrep.idx",
-		fn:      func() string { return path.Join(*flagRepoDir, "livegrep.idx") },
-	}
-	flagRevision             = flag.String("revision", "HEAD", "git revision to index")
-	flagUrlPattern           = flag.String("url-pattern", "https://gitlab.com/{name}/-/blob/{version}/{path}#L{lno}", "when using the local frontend fileviewer, this string will be used to construt a link to the file source on gitlab")
-	flagName                 = flag.String("name", "livegrep index", "The name to be stored in the index file")
-	flagNumRepoUpdateWorkers = flag.String("num-repo-update-workers", "8", "Number of workers fetch-reindex will use to update repositories")
-	flagRevparse             = flag.Bool("revparse", true, "whether to `git rev-parse` the provided revision in generated links")
-	flagForks                = flag.Bool("forks", true, "whether to index repositories that are forks, and not original repos")
-	flagArchived             = flag.Bool("archived", false, "whether to index repositories that are archived on gitlab")
-	flagHTTP                 = flag.Bool("http", false, "clone repositories over HTTPS instead of SSH")
-	flagHTTPUsername         = flag.String("http-user", "git", "Override the username to use when cloning over https")
-	flagDepth                = flag.Int("depth", 0, "clone repository with specify --depth=N depth.")
-	flagSkipMissing          = flag.Bool("skip-missing", false, "skip repositories where the specified revision is missing")
-	flagNoIndex              = flag.Bool("no-index", false, "Skip indexing after writing config and fetching")
-
-	// TODO: think about how to implement these or something similar for gitlab,
-	// rather than just listing all of the projects that are accessible
-	// flagRepos = stringList{}
-	flagGroups = stringList{}
-	// flagUsers = stringList{}
+	flagApiBaseUrl    = flag.String("api-base-url", "https://gitlab.example.com/api/v4", "Gitlab API base url")
+	flagGitlabToken   = flag.String("gitlab-token", os.Getenv("GITLAB_TOKEN"), "Gitlab access token")
+	flagUrlPattern    = flag.String("url-pattern", "https://gitlab.com/{name}/-/blob/{version}/{path}#L{lno}", "when using the local frontend fileviewer, this string will be used to construt a link to the file source on gitlab")
+	flagListWorkers   = flag.Int("list-workers", Workers, "Number of groups, users and projects to list from the GitLab API at once")
+	flagForks         = flag.Bool("forks", true, "whether to index repositories that are forks, and not original repos")
+	flagMinVisibility = flag.String("min-visibility", "private", "Only index projects at least this visible: private (all of them), internal or public")
+	flagArchived      = flag.Bool("archived", false, "whether to index repositories that are archived on gitlab")
+	flagHTTP          = flag.Bool("http", false, "clone repositories over HTTPS instead of SSH")
+	flagHTTPUsername  = flag.String("http-user", "git", "Override the username to use when cloning over https")
+	flagListen        = flag.String("listen", "", "Run as a daemon, reindexing from the GitLab webhooks sent to this `address`")
+	flagWebhookSecret = flag.String("webhook-secret", os.Getenv("GITLAB_WEBHOOK_SECRET"), "The secret token GitLab sends with webhooks; required by -listen")
+	flagDebounce      = flag.Duration("debounce", 30*time.Second, "With -listen, how long to collect webhooks before reindexing")
+	flagPrune         = flag.Bool("prune", false, "Remove the clones in -dir of projects that are no longer listed, e.g. because they were deleted or transferred")
+	flagPruneTrash    = flag.String("prune-trash", "", "With -prune, move clones to this `dir` instead of deleting them")
+	flagMetricsListen = flag.String("metrics-listen", "", "With -listen, serve webhook and reindex metrics for Prometheus on /metrics at this `address`")
+	flagSweep         = flag.Duration("sweep", 24*time.Hour, "With -listen, how often to list and fetch every project, as well as at startup; 0 only at startup")
+
+	flagRepos  reindex.StringList
+	flagGroups reindex.StringList
+	flagUsers  reindex.StringList
+
+	flagTopics        reindex.StringList
+	flagExcludeTopics reindex.StringList
+
+	common = reindex.RegisterFlags(flag.CommandLine, reindex.FlagOptions{Forks: true})
 )
 
 func init() {
-	flag.Var(&flagIndexPath, "out", "Path to write the index")
-	// flag.Var(&flagRepos, "repo", "Specify a repo to index (may be passed multiple times)")
+	flag.Var(&flagRepos, "repo", "Specify a gitlab project to index, as group/name (may be passed multiple times)")
 	flag.Var(&flagGroups, "group", "Specify a gitlab group to index (may be passed multiple times)")
-	// flag.Var(&flagUsers, "user", "Specify a github user to index (may be passed multiple times)")
+	flag.Var(&flagUsers, "user", "Specify a gitlab user whose personal projects to index (may be passed multiple times)")
+	flag.Var(&flagTopics, "topic", "Only index projects with this topic; alone, index every project with it (may be passed multiple times)")
+	flag.Var(&flagExcludeTopics, "exclude-topic", "Don't index projects with this topic (may be passed multiple times)")
 }
 
 const Workers = 8
 
 func main() {
 	flag.Parse()
-	log.SetFlags(0)
-
-	var ignorelist map[string]struct{}
-	if *flagIgnorelist != "" {
-		var err error
-		ignorelist, err = loadIgnorelist(*flagIgnorelist)
-		if err != nil {
-			log.Fatalf("loading %s: %s", *flagIgnorelist, err)
-		}
+	if err := logging.Init("gitlab-reindex"); err != nil {
+		log.Fatalln(err.Error())
 	}
-
-	git, err := gitlab.NewClient(*flagGitlabToken, gitlab.WithBaseURL(*flagApiBaseUrl))
-	if err != nil {
-		log.Fatalf("creating gitlab client: %s", err)
+	if err := sentry.Init("gitlab-reindex"); err != nil {
+		log.Fatalln(err.Error())
 	}
+	defer sentry.Recover()
 
-	repos, err := loadRepos(git, flagGroups.strings)
+	configPath, err := common.ConfigPath()
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
-
-	repos = filterRepos(repos, ignorelist, !*flagForks, !*flagArchived)
-
-	sort.Sort(ReposByName(repos))
-
-	config, err := buildConfig(*flagName, *flagRepoDir, repos, *flagRevision)
+	if !gitlabsource.ValidVisibility(gitlab.VisibilityValue(*flagMinVisibility)) {
+		log.Fatalf("-min-visibility: unknown visibility %q (want private, internal or public)", *flagMinVisibility)
+	}
+	opts, err := common.Options()
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
-	configPath := path.Join(*flagRepoDir, "livegrep.json")
-	if err := writeConfig(config, configPath); err != nil {
+	opts.URLPattern = *flagUrlPattern
+	ignorelist, allowlist, err := common.RepoLists()
+	if err != nil {
 		log.Fatalln(err.Error())
 	}
 
-	index := flagIndexPath.Get().(string)
-
-	args := []string{
-		"--out", index,
-		"--codesearch", *flagCodesearch,
-		"--num-workers", *flagNumRepoUpdateWorkers,
-	}
-	if *flagNoIndex {
-		args = append(args, "--no-index")
-	}
-	if *flagRevparse {
-		args = append(args, "--revparse")
-	}
-	if *flagSkipMissing {
-		args = append(args, "--skip-missing")
+	git, err := gitlab.NewClient(*flagGitlabToken, gitlab.WithBaseURL(*flagApiBaseUrl))
+	if err != nil {
+		log.Fatalf("creating gitlab client: %s", err)
 	}
-	args = append(args, configPath)
-
-	if *flagFetchReindex == "" {
-		fr := findBinary("livegrep-fetch-reindex")
-		flagFetchReindex = &fr
+	src := &gitlabsource.Source{
+		Client:        git,
+		Groups:        flagGroups,
+		Users:         flagUsers,
+		Projects:      flagRepos,
+		Topics:        flagTopics,
+		ExcludeTopics: flagExcludeTopics,
+		MinVisibility: gitlab.VisibilityValue(*flagMinVisibility),
+		Workers:       *flagListWorkers,
+		Forks:         *flagForks,
+		Archived:      *flagArchived,
+		HTTP:          *flagHTTP,
+		Username:      *flagHTTPUsername,
 	}
-
-	log.Printf("Running: %s %v\n", *flagFetchReindex, args)
-	cmd := exec.Command(*flagFetchReindex, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
 	if *flagGitlabToken != "" {
-		cmd.Env = append(os.Environ(), fmt.Sprintf("GITLAB_TOKEN=%s", *flagGitlabToken))
-	}
-	if err := cmd.Run(); err != nil {
-		log.Fatalln("livegrep-fetch-reindex: ", err)
+		src.PasswordEnv = "GITLAB_TOKEN"
 	}
-}
 
-func findBinary(name string) string {
-	paths := []string{
-		path.Join(path.Dir(os.Args[0]), name),
-		strings.Replace(os.Args[0], path.Base(os.Args[0]), name, -1),
-	}
-	for _, try := range paths {
-		if st, err := os.Stat(try); err == nil && (st.Mode()&os.ModeDir) == 0 {
-			return try
+	sentry.SetTag("config", common.Name)
+	if *flagListen != "" {
+		if *flagWebhookSecret == "" {
+			log.Fatal("-listen requires -webhook-secret")
 		}
+		if common.DryRun {
+			log.Fatal("-dry-run can't be used with -listen")
+		}
+		d := newDaemon(src, ignorelist, allowlist, opts, configPath)
+		if *flagMetricsListen != "" {
+			go func() {
+				log.Fatalln(serveMetrics(*flagMetricsListen).Error())
+			}()
+		}
+		log.Fatalln(d.run(*flagListen, *flagDebounce, *flagSweep).Error())
 	}
-	return name
-}
 
-type ReposByName []*gitlab.Project
-
-func (r ReposByName) Len() int           { return len(r) }
-func (r ReposByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
-func (r ReposByName) Less(i, j int) bool { return r[i].PathWithNamespace < r[j].PathWithNamespace }
-
-func loadIgnorelist(path string) (map[string]struct{}, error) {
-	data, err := ioutil.ReadFile(path)
+	repos, err := listRepos(src, ignorelist, allowlist)
 	if err != nil {
-		return nil, err
+		log.Fatalln(err.Error())
 	}
-
-	lines := strings.Split(string(data), "\n")
-	out := make(map[string]struct{}, len(lines))
-	for _, l := range lines {
-		out[l] = struct{}{}
+	if err := reindexRepos(src, repos, opts, configPath, nil); err != nil {
+		log.Fatalln(err.Error())
 	}
-	return out, nil
 }
 
-func loadRepos(client *gitlab.Client, groups []string) ([]*gitlab.Project, error) {
-	var projects []*gitlab.Project
-
-	// TODO: parallelise, deduplicate, etc
-	if len(groups) > 0 {
-		for _, group := range groups {
-			opt := &gitlab.ListGroupProjectsOptions{
-				ListOptions: gitlab.ListOptions{
-					PerPage: 100,
-					Page:    1,
-				},
-			}
-			for {
-				ps, resp, err := client.Groups.ListGroupProjects(group, opt)
-				if err != nil {
-					return nil, err
-				}
-				projects = append(projects, ps...)
-				if resp.NextPage == 0 {
-					break
-				}
-				opt.Page = resp.NextPage
-			}
-		}
-		return projects, nil
-	}
-
-	// read everything the user has access to
-	opt := &gitlab.ListProjectsOptions{
-		Archived: gitlab.Bool(*flagArchived),
-		ListOptions: gitlab.ListOptions{
-			PerPage: 100,
-			Page:    1,
-		},
+// listRepos lists the projects to index.
+func listRepos(src *gitlabsource.Source, ignorelist, allowlist *indexspec.RepoList) ([]*gitlab.Project, error) {
+	projects, err := src.List(context.Background())
+	if err != nil {
+		return nil, err
 	}
-	for {
-		ps, resp, err := client.Projects.ListProjects(opt)
-		if err != nil {
-			return nil, err
+	var repos []*gitlab.Project
+	for _, p := range projects {
+		if indexspec.Allowed(p.PathWithNamespace, ignorelist, allowlist) {
+			repos = append(repos, p)
 		}
-		projects = append(projects, ps...)
-		if resp.NextPage == 0 {
-			break
-		}
-		opt.Page = resp.NextPage
 	}
-	return projects, nil
+	return repos, nil
 }
 
-func filterRepos(repos []*gitlab.Project,
-	ignorelist map[string]struct{},
-	excludeForks bool, excludeArchived bool) []*gitlab.Project {
-	var out []*gitlab.Project
-
-	for _, r := range repos {
-		if excludeForks && r.ForkedFromProject != nil {
-			log.Printf("Excluding fork %s, was forked from %s", r.PathWithNamespace, r.ForkedFromProject.PathWithNamespace)
-			continue
-		}
-		if ignorelist != nil {
-			if _, ok := ignorelist[r.PathWithNamespace]; ok {
-				continue
-			}
-		}
-		out = append(out, r)
-	}
-
-	return out
-}
-
-func writeConfig(config []byte, file string) error {
-	dir := path.Dir(file)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+// reindexRepos writes the config for projects, in order of their
+// names, and runs fetch-reindex on it. If fetch isn't nil, only the
+// repositories it names, and any not cloned yet, are fetched, and the
+// rest are indexed as they are on disk.
+func reindexRepos(src *gitlabsource.Source, projects []*gitlab.Project, opts *reindex.Options, configPath string, fetch []string) error {
+	repos := make([]*reindex.Repo, len(projects))
+	for i, p := range projects {
+		repos[i] = src.Repo(p)
+	}
+	reindex.SortByName(repos)
+	cfg := reindex.BuildConfig(repos, opts)
+	if err := common.WriteConfig(configPath, cfg); err != nil || common.DryRun {
 		return err
 	}
-	return ioutil.WriteFile(file, config, 0644)
-}
-
-func buildConfig(name string,
-	dir string,
-	repos []*gitlab.Project,
-	revision string) ([]byte, error) {
-	cfg := config.IndexSpec{
-		Name: name,
-	}
-
-	for _, r := range repos {
-		if *flagSkipMissing {
-			cmd := exec.Command("git",
-				"--git-dir",
-				path.Join(dir, r.PathWithNamespace),
-				"rev-parse",
-				"--verify",
-				revision,
-			)
-			if e := cmd.Run(); e != nil {
-				log.Printf("Skipping missing revision repo=%s rev=%s",
-					r.PathWithNamespace, revision,
-				)
-				continue
-			}
-		}
-		var remote string
-		remote = r.SSHURLToRepo
-		if *flagHTTP {
-			remote = r.HTTPURLToRepo
-		}
 
-		var password_env string
-		if *flagGitlabToken != "" {
-			password_env = "GITLAB_TOKEN"
+	if *flagPrune {
+		if err := pruneClones(common.Dir, projects, *flagPruneTrash); err != nil {
+			return err
 		}
-
-		cfg.Repositories = append(cfg.Repositories, &config.RepoSpec{
-			Path:      path.Join(dir, r.PathWithNamespace),
-			Name:      r.PathWithNamespace,
-			Revisions: []string{revision},
-			Metadata: &config.Metadata{
-				// TODO: what is this used for?
-				Github:     r.WebURL,
-				Remote:     remote,
-				UrlPattern: *flagUrlPattern,
-			},
-			CloneOptions: &config.CloneOptions{
-				Depth:       int32(*flagDepth),
-				Username:    *flagHTTPUsername,
-				PasswordEnv: password_env,
-			},
-		})
 	}
 
-	return json.MarshalIndent(cfg, "", "  ")
+	fr := common.NewFetchReindex()
+	if *flagGitlabToken != "" {
+		fr.Env = []string{"GITLAB_TOKEN=" + *flagGitlabToken}
+	}
+	_, err := fr.Run(context.Background(), configPath, fetch)
+	return err
 }
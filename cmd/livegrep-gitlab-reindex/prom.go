@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/metrics"
+)
+
+// With -listen and -metrics-listen, the daemon serves metrics for
+// Prometheus to scrape from /metrics. The fetches and index builds it
+// runs are fetch-reindex's to report, with -metrics-textfile.
+var (
+	promRegistry = metrics.NewRegistry()
+
+	promWebhooks = promRegistry.NewCounter("livegrep_gitlab_webhooks_total",
+		"Webhooks received that changed something, by event.", "event")
+	promReindexes = promRegistry.NewCounter("livegrep_gitlab_reindexes_total",
+		"Reindexes run by the daemon, by result: ok or failed.", "result")
+	promReindexSeconds = promRegistry.NewHistogram("livegrep_gitlab_reindex_seconds",
+		"How long each reindex, fetching and building the index, took.", []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200})
+)
+
+// promReindex counts a reindex that took took and ended with err.
+func promReindex(took time.Duration, err error) {
+	promReindexSeconds.Observe(took.Seconds())
+	if err != nil {
+		promReindexes.Inc("failed")
+	} else {
+		promReindexes.Inc("ok")
+	}
+}
+
+// serveMetrics serves /metrics on addr until it fails.
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promRegistry)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+)
+
+// pruneClones removes the clones under dir of projects that aren't in
+// repos, because they were deleted, transferred or renamed, or are now
+// left out by -ignorelist or the like, moving them under trash instead
+// if it is set.
+func pruneClones(dir string, repos []*gitlab.Project, trash string) error {
+	// An empty list more likely means the token lost access than that
+	// every project is gone.
+	if len(repos) == 0 {
+		logging.Warnf("Not pruning %s: no projects were listed", dir)
+		return nil
+	}
+	dir = filepath.Clean(dir)
+	keep := map[string]bool{}
+	if trash != "" {
+		// Leave alone what was pruned before, if trash is under dir.
+		keep[filepath.Clean(trash)] = true
+	}
+	for _, r := range repos {
+		keep[filepath.Join(dir, filepath.FromSlash(r.PathWithNamespace))] = true
+	}
+
+	stale, err := findClones(dir, keep)
+	if err != nil {
+		return err
+	}
+	for _, p := range stale {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if trash == "" {
+			logging.With("repo", filepath.ToSlash(rel)).Infof("Pruning %s: no longer listed", filepath.ToSlash(rel))
+			if err := os.RemoveAll(p); err != nil {
+				return fmt.Errorf("pruning %s: %s", rel, err.Error())
+			}
+		} else {
+			dst := filepath.Join(trash, rel)
+			if _, err := os.Stat(dst); err == nil {
+				dst += "." + time.Now().Format("20060102T150405")
+			}
+			logging.With("repo", filepath.ToSlash(rel)).Infof("Pruning %s: no longer listed, moving it to %s", filepath.ToSlash(rel), dst)
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(p, dst); err != nil {
+				return fmt.Errorf("pruning %s: %s", rel, err.Error())
+			}
+		}
+		removeEmptyParents(dir, filepath.Dir(p))
+	}
+	return nil
+}
+
+// findClones returns the git directories under dir that aren't in
+// keep. It doesn't look inside them, or inside the clones it keeps.
+func findClones(dir string, keep map[string]bool) ([]string, error) {
+	var out []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || p == dir {
+			return nil
+		}
+		if keep[p] {
+			return filepath.SkipDir
+		}
+		if isGitDir(p) {
+			out = append(out, p)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return out, err
+}
+
+// isGitDir reports whether p looks like a bare repository, as
+// fetch-reindex clones them.
+func isGitDir(p string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(p, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// removeEmptyParents removes p and its parents, up to but not
+// including dir, while they are empty, such as a deleted group's
+// directory.
+func removeEmptyParents(dir, p string) {
+	for p != dir && len(p) > len(dir) {
+		if os.Remove(p) != nil {
+			return
+		}
+		p = filepath.Dir(p)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/reindex"
+	"github.com/livegrep/livegrep/pkg/reindex/gitlabsource"
+)
+
+// maxHookSize limits the webhook bodies read; push events list at most
+// 20 commits, so are much smaller.
+const maxHookSize = 1 << 20
+
+// retryDelay is how long to wait before trying failed changes again.
+const retryDelay = time.Minute
+
+// A daemon keeps the index up to date from GitLab webhooks. A push
+// re-fetches only the project pushed to, and the system hooks for a
+// project being created, renamed, transferred or deleted update the
+// config, before reindexing. Every project is listed and fetched at
+// startup, and again every -sweep, to catch hooks that were missed.
+type daemon struct {
+	src        *gitlabsource.Source
+	ignorelist *indexspec.RepoList
+	allowlist  *indexspec.RepoList
+	opts       *reindex.Options
+	configPath string
+
+	mu sync.Mutex
+	// Projects to re-fetch, by path, with their ids if the hook gave
+	// them
+	pending map[string]int
+	// Projects deleted or renamed, by their old paths
+	removed map[string]bool
+	sweep   bool
+	wake    chan struct{}
+
+	// The projects in the config, by path; only run uses it.
+	repos map[string]*gitlab.Project
+}
+
+func newDaemon(src *gitlabsource.Source, ignorelist, allowlist *indexspec.RepoList, opts *reindex.Options, configPath string) *daemon {
+	return &daemon{
+		src:        src,
+		ignorelist: ignorelist,
+		allowlist:  allowlist,
+		opts:       opts,
+		configPath: configPath,
+		pending:    map[string]int{},
+		removed:    map[string]bool{},
+		sweep:      true,
+		wake:       make(chan struct{}, 1),
+		repos:      map[string]*gitlab.Project{},
+	}
+}
+
+// hookEvent has the fields of GitLab's project webhooks and system
+// hooks that say which project changed.
+type hookEvent struct {
+	ObjectKind string `json:"object_kind"`
+	EventName  string `json:"event_name"`
+	// Project and system push and repository_update hooks
+	Project struct {
+		ID                int    `json:"id"`
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	// System project_* hooks
+	ProjectID            int    `json:"project_id"`
+	PathWithNamespace    string `json:"path_with_namespace"`
+	OldPathWithNamespace string `json:"old_path_with_namespace"`
+}
+
+// run serves webhooks on listen and reindexes whenever they change
+// something, waiting debounce after the first of a burst for the rest.
+// It only returns if it can't listen.
+func (d *daemon) run(listen string, debounce, sweep time.Duration) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	logging.Infof("Listening for webhooks on %s", l.Addr())
+	go func() {
+		log.Fatalln(http.Serve(l, d).Error())
+	}()
+
+	var sweeps <-chan time.Time
+	if sweep > 0 {
+		sweeps = time.NewTicker(sweep).C
+	}
+	for {
+		if err := d.update(); err != nil {
+			logging.Errorf("reindex: %s", err.Error())
+		}
+		select {
+		case <-d.wake:
+			time.Sleep(debounce)
+		case <-sweeps:
+			d.mu.Lock()
+			d.sweep = true
+			d.mu.Unlock()
+		}
+	}
+}
+
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.Header.Get("X-Gitlab-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(*flagWebhookSecret)) != 1 {
+		http.Error(w, "bad X-Gitlab-Token", http.StatusUnauthorized)
+		return
+	}
+	var ev hookEvent
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxHookSize)).Decode(&ev); err != nil {
+		http.Error(w, "parsing event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !d.handle(&ev) {
+		io.WriteString(w, "ignored\n")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handle queues the changes ev makes, reporting whether it made any.
+func (d *daemon) handle(ev *hookEvent) bool {
+	kind := ev.ObjectKind
+	if kind == "" {
+		kind = ev.EventName
+	}
+	name, id := ev.PathWithNamespace, ev.ProjectID
+	if ev.Project.PathWithNamespace != "" {
+		name, id = ev.Project.PathWithNamespace, ev.Project.ID
+	}
+	if name == "" {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch kind {
+	case "push", "tag_push", "repository_update", "project_create", "project_update":
+		d.refetch(name, id)
+	case "project_rename", "project_transfer":
+		d.removed[ev.OldPathWithNamespace] = true
+		d.refetch(name, id)
+	case "project_destroy":
+		d.removed[name] = true
+	default:
+		return false
+	}
+	logging.Infof("%s hook for %s", kind, name)
+	promWebhooks.Inc(kind)
+	d.poke()
+	return true
+}
+
+// poke wakes run, if it isn't already due to wake.
+func (d *daemon) poke() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *daemon) refetch(path string, id int) {
+	d.pending[path] = id
+	delete(d.removed, path)
+}
+
+// update applies the queued changes and reindexes, if there are any.
+// Changes that fail are queued again.
+func (d *daemon) update() error {
+	d.mu.Lock()
+	pending, removed, sweep := d.pending, d.removed, d.sweep
+	d.pending, d.removed, d.sweep = map[string]int{}, map[string]bool{}, false
+	d.mu.Unlock()
+
+	var fetch []string
+	retry := map[string]int{}
+	if sweep {
+		repos, err := listRepos(d.src, d.ignorelist, d.allowlist)
+		if err != nil {
+			d.requeue(pending, removed, true)
+			return err
+		}
+		d.repos = map[string]*gitlab.Project{}
+		for _, p := range repos {
+			d.repos[p.PathWithNamespace] = p
+		}
+		logging.Infof("Indexing all %d projects", len(repos))
+	} else {
+		if len(pending) == 0 && len(removed) == 0 {
+			return nil
+		}
+		for name := range removed {
+			delete(d.repos, name)
+		}
+		fetch = []string{}
+		// Whether a project was dropped from the config, because it
+		// no longer exists or is no longer to be indexed, such as one
+		// given an -exclude-topic
+		dropped := false
+		for name, id := range pending {
+			p, ok, err := d.project(name, id)
+			if err != nil {
+				logging.Errorf("loading project %s: %s", name, err.Error())
+				retry[name] = id
+				continue
+			}
+			if p == nil || p.PathWithNamespace != name {
+				dropped = dropped || d.repos[name] != nil
+				delete(d.repos, name)
+			}
+			if p == nil || !ok {
+				if p != nil {
+					dropped = dropped || d.repos[p.PathWithNamespace] != nil
+					delete(d.repos, p.PathWithNamespace)
+				}
+				continue
+			}
+			d.repos[p.PathWithNamespace] = p
+			fetch = append(fetch, p.PathWithNamespace)
+		}
+		if len(fetch) == 0 && len(removed) == 0 && !dropped {
+			d.requeue(retry, nil, false)
+			return nil
+		}
+		sort.Strings(fetch)
+		logging.Infof("Fetching %v", fetch)
+	}
+
+	repos := make([]*gitlab.Project, 0, len(d.repos))
+	for _, p := range d.repos {
+		repos = append(repos, p)
+	}
+	start := time.Now()
+	err := reindexRepos(d.src, repos, d.opts, d.configPath, fetch)
+	promReindex(time.Since(start), err)
+	if err != nil {
+		// The config was written, so removals are done with, but the
+		// fetches need another try.
+		for _, name := range fetch {
+			retry[name] = pending[name]
+		}
+		d.requeue(retry, nil, sweep)
+		return err
+	}
+	d.requeue(retry, nil, false)
+	return nil
+}
+
+// project loads the project at name, or with id if that's known, and
+// reports whether it should be indexed. It returns a nil project if it
+// no longer exists.
+func (d *daemon) project(name string, id int) (*gitlab.Project, bool, error) {
+	var pid interface{} = name
+	if id != 0 {
+		pid = id
+	}
+	p, resp, err := d.src.Client.Projects.GetProject(pid, nil)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if p.Archived && !d.src.Archived {
+		return p, false, nil
+	}
+	if !d.src.InScope(p.PathWithNamespace) {
+		return p, false, nil
+	}
+	return p, d.src.Keep(p) && indexspec.Allowed(p.PathWithNamespace, d.ignorelist, d.allowlist), nil
+}
+
+// requeue queues changes again after they failed, unless newer ones
+// have replaced them.
+func (d *daemon) requeue(pending map[string]int, removed map[string]bool, sweep bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name := range removed {
+		if _, ok := d.pending[name]; !ok {
+			d.removed[name] = true
+		}
+	}
+	for name, id := range pending {
+		if _, ok := d.pending[name]; !ok && !d.removed[name] {
+			d.pending[name] = id
+		}
+	}
+	d.sweep = d.sweep || sweep
+	if len(pending) > 0 || len(removed) > 0 || sweep {
+		time.AfterFunc(retryDelay, d.poke)
+	}
+}
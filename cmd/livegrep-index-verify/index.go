@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// These mirror the on-disk format written by src/dump_load.cc; see the
+// structs in src/dump_load.h.
+const (
+	indexMagic   = 0xc0d35eac
+	indexVersion = 17
+	pageSize     = 1 << 14
+
+	headerSize        = 104
+	chunkHeaderSize   = 24
+	contentHeaderSize = 12
+	pieceSize         = 12
+)
+
+type header struct {
+	Magic, Version, ChunkSize        uint32
+	Timestamp                        uint64
+	NameOff                          uint64
+	NTrees                           uint32
+	RefsOff                          uint64
+	NFiles                           uint32
+	FilesOff                         uint64
+	NChunks                          uint32
+	ChunksOff                        uint64
+	NContent                         uint32
+	ContentOff                       uint64
+	NFileData                        uint32
+	FileDataOff, SuffixesOff, PosOff uint64
+}
+
+type tree struct {
+	Name, Version string
+}
+
+// An index is the part of an index file's contents that verification
+// needs.
+type index struct {
+	Name  string
+	Trees []tree
+	Files int
+}
+
+// reader reads little-endian values from an index file, failing with a
+// description of the section being read if it runs off the end.
+type reader struct {
+	data    []byte
+	off     uint64
+	section string
+}
+
+func (r *reader) seek(section string, off uint64) {
+	r.section = section
+	r.off = off
+}
+
+func (r *reader) need(n uint64) error {
+	if r.off > uint64(len(r.data)) || uint64(len(r.data))-r.off < n {
+		return fmt.Errorf("%s: offset %d+%d is past the end of the file (%d bytes)",
+			r.section, r.off, n, len(r.data))
+	}
+	return nil
+}
+
+func (r *reader) uint32() (uint32, error) {
+	if err := r.need(4); err != nil {
+		return 0, err
+	}
+	v := binary.LittleEndian.Uint32(r.data[r.off:])
+	r.off += 4
+	return v, nil
+}
+
+func (r *reader) uint64() (uint64, error) {
+	if err := r.need(8); err != nil {
+		return 0, err
+	}
+	v := binary.LittleEndian.Uint64(r.data[r.off:])
+	r.off += 8
+	return v, nil
+}
+
+func (r *reader) string() (string, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return "", err
+	}
+	if err := r.need(uint64(n)); err != nil {
+		return "", err
+	}
+	s := string(r.data[r.off : r.off+uint64(n)])
+	r.off += uint64(n)
+	return s, nil
+}
+
+// parseIndex checks the structure of an index file: that every section
+// lies within the file, and that every reference between sections (file
+// to tree, chunk to file, content to chunk) is in range. codesearch
+// trusts all of these when it maps an index, so a truncated or corrupt
+// file would otherwise crash or return garbage at search time.
+func parseIndex(data []byte) (*index, error) {
+	r := &reader{data: data}
+	var h header
+	r.seek("header", 0)
+	if err := r.need(headerSize); err != nil {
+		return nil, err
+	}
+	fields := []interface{}{
+		&h.Magic, &h.Version, &h.ChunkSize, &h.Timestamp, &h.NameOff,
+		&h.NTrees, &h.RefsOff, &h.NFiles, &h.FilesOff, &h.NChunks,
+		&h.ChunksOff, &h.NContent, &h.ContentOff, &h.NFileData,
+		&h.FileDataOff, &h.SuffixesOff, &h.PosOff,
+	}
+	for _, f := range fields {
+		var err error
+		switch f := f.(type) {
+		case *uint32:
+			*f, err = r.uint32()
+		case *uint64:
+			*f, err = r.uint64()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if h.Magic != indexMagic {
+		return nil, fmt.Errorf("bad magic %#x; not a livegrep index", h.Magic)
+	}
+	if h.Version != indexVersion {
+		return nil, fmt.Errorf("unsupported index version %d (expected %d)", h.Version, indexVersion)
+	}
+	if h.ChunkSize == 0 || h.ChunkSize&(h.ChunkSize-1) != 0 {
+		return nil, fmt.Errorf("chunk size %d is not a power of two", h.ChunkSize)
+	}
+
+	idx := &index{Files: int(h.NFiles)}
+	var err error
+	r.seek("name", h.NameOff)
+	if idx.Name, err = r.string(); err != nil {
+		return nil, err
+	}
+
+	r.seek("trees", h.RefsOff)
+	for i := uint32(0); i < h.NTrees; i++ {
+		var t tree
+		var metadata string
+		if t.Name, err = r.string(); err != nil {
+			return nil, err
+		}
+		if t.Version, err = r.string(); err != nil {
+			return nil, err
+		}
+		if metadata, err = r.string(); err != nil {
+			return nil, err
+		}
+		if metadata != "" && !json.Valid([]byte(metadata)) {
+			return nil, fmt.Errorf("trees: metadata of %s is not valid JSON", t.Name)
+		}
+		idx.Trees = append(idx.Trees, t)
+	}
+
+	r.seek("files", h.FilesOff)
+	for i := uint32(0); i < h.NFiles; i++ {
+		id, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if id >= h.NTrees {
+			return nil, fmt.Errorf("files: file %d belongs to tree %d, but there are only %d", i, id, h.NTrees)
+		}
+		// Its path, language and flags
+		if _, err := r.string(); err != nil {
+			return nil, err
+		}
+		if _, err := r.string(); err != nil {
+			return nil, err
+		}
+		if _, err := r.uint32(); err != nil {
+			return nil, err
+		}
+	}
+
+	sizes := make([]uint32, h.NChunks)
+	for i := uint32(0); i < h.NChunks; i++ {
+		r.seek("chunk headers", h.ChunksOff+uint64(i)*chunkHeaderSize)
+		dataOff, err := r.uint64()
+		if err != nil {
+			return nil, err
+		}
+		filesOff, _ := r.uint64()
+		size, _ := r.uint32()
+		nfiles, _ := r.uint32()
+		if size > h.ChunkSize {
+			return nil, fmt.Errorf("chunk %d: size %d exceeds the chunk size %d", i, size, h.ChunkSize)
+		}
+		sizes[i] = size
+		// Each chunk is its data followed by a uint32 suffix array.
+		r.seek(fmt.Sprintf("chunk %d data", i), dataOff)
+		if dataOff%pageSize != 0 {
+			return nil, fmt.Errorf("chunk %d: data is not page-aligned", i)
+		}
+		if err := r.need(5 * uint64(h.ChunkSize)); err != nil {
+			return nil, err
+		}
+		r.seek(fmt.Sprintf("chunk %d file map", i), filesOff)
+		for j := uint32(0); j < nfiles; j++ {
+			n, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+			for k := uint32(0); k < n; k++ {
+				no, err := r.uint32()
+				if err != nil {
+					return nil, err
+				}
+				if no >= h.NFiles {
+					return nil, fmt.Errorf("chunk %d: references file %d, but there are only %d", i, no, h.NFiles)
+				}
+			}
+			left, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+			right, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+			if left > right || right > size {
+				return nil, fmt.Errorf("chunk %d: file map range [%d, %d] is outside the chunk", i, left, right)
+			}
+		}
+	}
+
+	// File contents are packed back to back into content chunks, one
+	// per file in file order: a uint32 count of pieces, then each piece
+	// as (chunk, offset, length).
+	contents := uint32(0)
+	for i := uint32(0); i < h.NContent; i++ {
+		r.seek("content headers", h.ContentOff+uint64(i)*contentHeaderSize)
+		fileOff, err := r.uint64()
+		if err != nil {
+			return nil, err
+		}
+		size, _ := r.uint32()
+		r.seek(fmt.Sprintf("content chunk %d", i), fileOff)
+		if err := r.need(uint64(size)); err != nil {
+			return nil, err
+		}
+		end := fileOff + uint64(size)
+		for r.off < end {
+			n, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+			if err := r.need(uint64(n) * pieceSize); err != nil {
+				return nil, err
+			}
+			for p := uint32(0); p < n; p++ {
+				c, _ := r.uint32()
+				off, _ := r.uint32()
+				length, _ := r.uint32()
+				if c >= h.NChunks || uint64(off)+uint64(length) > uint64(sizes[c]) {
+					return nil, fmt.Errorf("content of file %d: piece %d is outside its chunk", contents, p)
+				}
+			}
+			contents++
+		}
+		if r.off != end {
+			return nil, fmt.Errorf("content chunk %d: contents overrun the chunk", i)
+		}
+	}
+	if contents != h.NFiles {
+		return nil, fmt.Errorf("found contents for %d files, expected %d", contents, h.NFiles)
+	}
+
+	r.seek("filename data", h.FileDataOff)
+	if err := r.need(uint64(h.NFileData)); err != nil {
+		return nil, err
+	}
+	r.seek("filename suffixes", h.SuffixesOff)
+	if err := r.need(4 * uint64(h.NFileData)); err != nil {
+		return nil, err
+	}
+	r.seek("filename positions", h.PosOff)
+	for i := uint32(0); i < h.NFiles; i++ {
+		pos, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if pos >= h.NFileData {
+			return nil, fmt.Errorf("filename positions: file %d starts past the end of the filename data", i)
+		}
+	}
+	return idx, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+var (
+	flagRequireChecksum = flag.Bool("require-checksum", false, "fail if the index has no .sha256 checksum file")
+)
+
+var shaRE = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] INDEX [CONFIG...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	data, err := mapFile(path)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	failed := false
+	fail := func(format string, args ...interface{}) {
+		fmt.Printf("%s: %s\n", path, fmt.Sprintf(format, args...))
+		failed = true
+	}
+
+	if err := verifyChecksum(path, data); err != nil {
+		fail("%s", err.Error())
+	}
+
+	idx, err := parseIndex(data)
+	if err != nil {
+		fail("%s", err.Error())
+		os.Exit(1)
+	}
+
+	if flag.NArg() > 1 {
+		spec, err := indexspec.Load(flag.Args()[1:]...)
+		if err != nil {
+			log.Println(err.Error())
+			os.Exit(2)
+		}
+		for _, p := range crossCheck(idx, spec) {
+			fail("%s", p)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok (%d trees, %d files)\n", path, len(idx.Trees), idx.Files)
+}
+
+// verifyChecksum compares data against the checksum livegrep-fetch-reindex
+// writes next to the index, in sha256sum format.
+func verifyChecksum(path string, data []byte) error {
+	sum, err := ioutil.ReadFile(path + ".sha256")
+	if os.IsNotExist(err) && !*flagRequireChecksum {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(sum))
+	if len(fields) == 0 {
+		return fmt.Errorf("%s.sha256 is empty", filepath.Base(path))
+	}
+	got := sha256.Sum256(data)
+	if hex.EncodeToString(got[:]) != fields[0] {
+		return fmt.Errorf("checksum mismatch: the file is corrupt or incomplete")
+	}
+	return nil
+}
+
+// crossCheck reports configured paths and repositories missing from the
+// index, and revisions that were not indexed. Revision globs and aliases
+// can only be checked for at least one indexed tree, since they are
+// resolved when fetching.
+func crossCheck(idx *index, spec *config.IndexSpec) []string {
+	versions := map[string][]string{}
+	for _, t := range idx.Trees {
+		versions[t.Name] = append(versions[t.Name], t.Version)
+	}
+
+	var problems []string
+	for _, p := range spec.Paths {
+		if _, ok := versions[p.Name]; !ok {
+			problems = append(problems, fmt.Sprintf("path %s is not in the index", p.Name))
+		}
+	}
+	for _, r := range spec.Repositories {
+		have, ok := versions[r.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("repository %s is not in the index", r.Name))
+			continue
+		}
+		for _, rev := range r.Revisions {
+			if _, alias := r.RevisionAliases[rev]; alias || strings.ContainsAny(rev, "*?[") {
+				continue
+			}
+			if !indexedRevision(r, rev, have) {
+				problems = append(problems, fmt.Sprintf("repository %s: revision %s is not in the index (indexed: %s)",
+					r.Name, rev, strings.Join(have, ", ")))
+			}
+		}
+	}
+
+	configured := map[string]bool{}
+	for _, p := range spec.Paths {
+		configured[p.Name] = true
+	}
+	for _, r := range spec.Repositories {
+		configured[r.Name] = true
+	}
+	for name := range versions {
+		if !configured[name] {
+			log.Printf("warning: %s is in the index but not the config", name)
+		}
+	}
+	return problems
+}
+
+// indexedRevision reports whether rev of r is among the indexed
+// versions. Indexes built with -revparse record commit IDs, which are
+// compared against the local clone.
+func indexedRevision(r *config.RepoSpec, rev string, have []string) bool {
+	parsed := false
+	for _, v := range have {
+		if v == rev {
+			return true
+		}
+		parsed = parsed || shaRE.MatchString(v)
+	}
+	if !parsed {
+		return false
+	}
+	commit := revParse(r.Path, rev)
+	for _, v := range have {
+		if commit != "" && v == commit {
+			return true
+		}
+	}
+	return false
+}
+
+// mapFile maps the file at path into memory; indexes are often too large
+// to read in.
+func mapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() == 0 {
+		return nil, nil
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(st.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func revParse(repo, rev string) string {
+	cmd := exec.Command("git", "-C", repo, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimSpace(out))
+}
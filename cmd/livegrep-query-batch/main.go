@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	flagFrontend = flag.String("frontend", "", "search through the livegrep frontend at this URL")
+	flagBackend  = flag.String("backend", "", "search the codesearch backend at this HOST:PORT directly")
+	flagIndex    = flag.String("index", "", "with -frontend, the backend to search, if not the default")
+	flagFormat   = flag.String("format", "json", "report format: json or junit")
+	flagOut      = flag.String("out", "", "write the report here rather than to stdout")
+	flagTimeout  = flag.Duration("timeout", time.Minute, "how long each query may take")
+	flagExamples = flag.Int("examples", 10, "how many matches of a failing query to report")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] QUERIES.yaml\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if (*flagFrontend == "") == (*flagBackend == "") {
+		log.Println("Exactly one of -frontend and -backend is required")
+		os.Exit(2)
+	}
+	if *flagFormat != "json" && *flagFormat != "junit" {
+		log.Printf("Unknown -format %q (want json or junit)", *flagFormat)
+		os.Exit(2)
+	}
+
+	b, err := loadBatch(flag.Arg(0))
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(2)
+	}
+
+	var s searcher
+	if *flagFrontend != "" {
+		s, err = newFrontendSearcher(*flagFrontend, *flagIndex)
+	} else {
+		s, err = newBackendSearcher(*flagBackend)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(2)
+	}
+
+	rep := run(s, b)
+
+	out := os.Stdout
+	if *flagOut != "" {
+		if out, err = os.Create(*flagOut); err != nil {
+			log.Println(err.Error())
+			os.Exit(2)
+		}
+	}
+	if *flagFormat == "junit" {
+		err = rep.writeJUnit(out)
+	} else {
+		err = rep.writeJSON(out)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(2)
+	}
+
+	log.Printf("%d passed, %d failed, %d errors", rep.Passed, rep.Failed, rep.Errors)
+	if !rep.ok() {
+		os.Exit(1)
+	}
+}
+
+// run runs every query of the batch in turn.
+func run(s searcher, b *batch) *report {
+	rep := &report{}
+	start := time.Now()
+	for i := range b.Queries {
+		rep.add(runQuery(s, &b.Queries[i]))
+	}
+	rep.took = time.Since(start)
+	return rep
+}
+
+// runQuery runs q, which fails if it matches more than q.MaxCount times.
+// A search that timed out without doing so is an error, since it may
+// have missed matches. There's no need to count matches beyond the
+// first that fails the query and the examples to report.
+func runQuery(s searcher, q *query) *result {
+	res := &result{Name: q.Name, Query: q.text(), MaxCount: q.MaxCount}
+	limit := q.MaxCount + 1
+	if limit < *flagExamples {
+		limit = *flagExamples
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *flagTimeout)
+	defer cancel()
+	start := time.Now()
+	out, err := s.search(ctx, q, limit)
+	res.TimeMs = int64(time.Since(start) / time.Millisecond)
+	switch {
+	case err != nil:
+		res.Status = statusError
+		res.Error = err.Error()
+	case out.count > q.MaxCount:
+		res.Status = statusFail
+		res.Count = out.count
+		res.Truncated = out.exitReason == "MATCH_LIMIT"
+		res.Matches = out.matches
+		if len(res.Matches) > *flagExamples {
+			res.Matches = res.Matches[:*flagExamples]
+		}
+	case out.exitReason == "TIMEOUT":
+		res.Status = statusError
+		res.Count = out.count
+		res.Error = "the search timed out, so may have missed matches"
+	default:
+		res.Status = statusPass
+		res.Count = out.count
+	}
+	return res
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A batch is the file of queries livegrep-query-batch runs.
+type batch struct {
+	// Whether queries are regexes when they don't say; true by default
+	Regex   *bool   `yaml:"regex"`
+	Queries []query `yaml:"queries"`
+}
+
+// A query is one policy: a search, and how many matches it may have.
+type query struct {
+	// Identifies the query in the report
+	Name string `yaml:"name"`
+	// The search, in the query language of the web UI, so it may use
+	// any of its operators, such as -file: or label:
+	Query string `yaml:"query"`
+	// Overrides the batch's regex
+	Regex *bool `yaml:"regex"`
+	// Filters added to the query as repo:, file: and -file:
+	Repo        string `yaml:"repo"`
+	File        string `yaml:"file"`
+	ExcludeFile string `yaml:"exclude_file"`
+	// The most matching lines (or files, for a file: search) the index
+	// may have and the query pass; 0, for "no usages of X", by default
+	MaxCount int `yaml:"max_count"`
+
+	regex bool
+}
+
+// loadBatch reads the batch at path, rejecting fields it doesn't know,
+// so that a misspelt filter fails the run rather than being ignored.
+func loadBatch(path string) (*batch, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var b batch
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&b); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", path, err.Error())
+	}
+	if err := b.check(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return &b, nil
+}
+
+// check validates the batch and fills in each query's defaults.
+func (b *batch) check() error {
+	if len(b.Queries) == 0 {
+		return fmt.Errorf("no queries")
+	}
+	seen := map[string]bool{}
+	for i := range b.Queries {
+		q := &b.Queries[i]
+		if q.Name == "" {
+			return fmt.Errorf("queries[%d]: name is required", i)
+		}
+		if seen[q.Name] {
+			return fmt.Errorf("queries[%d]: duplicate name %q", i, q.Name)
+		}
+		seen[q.Name] = true
+		if strings.TrimSpace(q.Query) == "" {
+			return fmt.Errorf("query %s: query is required", q.Name)
+		}
+		if q.MaxCount < 0 {
+			return fmt.Errorf("query %s: max_count must not be negative", q.Name)
+		}
+		q.regex = true
+		if b.Regex != nil {
+			q.regex = *b.Regex
+		}
+		if q.Regex != nil {
+			q.regex = *q.Regex
+		}
+	}
+	return nil
+}
+
+// text is the query as the frontend would be sent it, with its filters
+// as operators.
+func (q *query) text() string {
+	parts := []string{q.Query}
+	for _, op := range []struct{ name, value string }{
+		{"repo", q.Repo},
+		{"file", q.File},
+		{"-file", q.ExcludeFile},
+	} {
+		if op.value != "" {
+			parts = append(parts, op.name+":"+op.value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	statusPass  = "pass"
+	statusFail  = "fail"
+	statusError = "error"
+)
+
+// A result is how one query fared.
+type result struct {
+	Name     string `json:"name"`
+	Query    string `json:"query"`
+	Status   string `json:"status"`
+	Count    int    `json:"count"`
+	MaxCount int    `json:"max_count"`
+	// Whether the search stopped counting at a limit, so there are at
+	// least Count matches
+	Truncated bool `json:"truncated,omitempty"`
+	// The first matches of a query that failed, as examples of what to
+	// fix
+	Matches []match `json:"matches,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	TimeMs  int64   `json:"time_ms"`
+}
+
+// A report is the outcome of a whole batch.
+type report struct {
+	Passed  int       `json:"passed"`
+	Failed  int       `json:"failed"`
+	Errors  int       `json:"errors"`
+	Results []*result `json:"results"`
+	took    time.Duration
+}
+
+func (r *report) add(res *result) {
+	switch res.Status {
+	case statusPass:
+		r.Passed++
+	case statusFail:
+		r.Failed++
+	default:
+		r.Errors++
+	}
+	r.Results = append(r.Results, res)
+}
+
+// ok reports whether every query passed.
+func (r *report) ok() bool {
+	return r.Failed == 0 && r.Errors == 0
+}
+
+// message describes why res didn't pass.
+func (res *result) message() string {
+	if res.Status == statusError {
+		return res.Error
+	}
+	atLeast := ""
+	if res.Truncated {
+		atLeast = "at least "
+	}
+	return fmt.Sprintf("%s%d matches, at most %d allowed", atLeast, res.Count, res.MaxCount)
+}
+
+func (r *report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeJUnit writes the report as a JUnit XML test suite, one test case
+// per query, for CI systems that show those.
+func (r *report) writeJUnit(w io.Writer) error {
+	suite := junitSuite{
+		Name:     "livegrep-query-batch",
+		Tests:    len(r.Results),
+		Failures: r.Failed,
+		Errors:   r.Errors,
+		Time:     seconds(r.took),
+	}
+	for _, res := range r.Results {
+		c := junitCase{
+			Name:      res.Name,
+			ClassName: "livegrep-query-batch",
+			Time:      seconds(time.Duration(res.TimeMs) * time.Millisecond),
+		}
+		problem := &junitProblem{Message: res.message()}
+		switch res.Status {
+		case statusFail:
+			var lines []string
+			lines = append(lines, "query: "+res.Query)
+			for _, m := range res.Matches {
+				if m.Line == 0 {
+					lines = append(lines, fmt.Sprintf("%s:%s", m.Tree, m.Path))
+				} else {
+					lines = append(lines, fmt.Sprintf("%s:%s:%d: %s", m.Tree, m.Path, m.Line, m.Text))
+				}
+			}
+			problem.Text = strings.Join(lines, "\n")
+			c.Failure = problem
+		case statusError:
+			problem.Text = "query: " + res.Query
+			c.Error = problem
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+
+	"github.com/livegrep/livegrep/pkg/client"
+)
+
+// A match is one line (or file) a query matched.
+type match struct {
+	Tree string `json:"tree"`
+	Path string `json:"path"`
+	Line int    `json:"lno,omitempty"`
+	Text string `json:"line,omitempty"`
+}
+
+// An outcome is what a search found.
+type outcome struct {
+	count   int
+	matches []match
+	// Why the search stopped early, if it did: "MATCH_LIMIT" means
+	// count is only a lower bound, and "TIMEOUT" that it may have
+	// missed matches
+	exitReason string
+}
+
+// A searcher runs queries against a frontend or a backend, stopping at
+// limit matches.
+type searcher interface {
+	search(ctx context.Context, q *query, limit int) (*outcome, error)
+}
+
+// clientSearcher searches with a livegrep client, through a frontend or
+// straight to a backend. backend is the frontend's backend to search.
+type clientSearcher struct {
+	client  client.Client
+	backend string
+}
+
+func newFrontendSearcher(frontend, backend string) (*clientSearcher, error) {
+	c, err := client.NewHTTP(frontend, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &clientSearcher{client: c, backend: backend}, nil
+}
+
+func newBackendSearcher(addr string) (*clientSearcher, error) {
+	c, err := client.NewGRPC(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &clientSearcher{client: c}, nil
+}
+
+func (s *clientSearcher) search(ctx context.Context, q *query, limit int) (*outcome, error) {
+	reply, err := s.client.Search(ctx, &client.Query{
+		Query:      q.text(),
+		Regex:      q.regex,
+		MaxMatches: limit,
+		Backend:    s.backend,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := &outcome{
+		count:      len(reply.Results) + len(reply.FileResults),
+		exitReason: reply.ExitReason,
+	}
+	for _, r := range reply.Results {
+		out.matches = append(out.matches, match{r.Tree, r.Path, r.LineNumber, r.Line})
+	}
+	for _, r := range reply.FileResults {
+		out.matches = append(out.matches, match{Tree: r.Tree, Path: r.Path})
+	}
+	return out, nil
+}
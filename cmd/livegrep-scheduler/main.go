@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/cron"
+	"github.com/livegrep/livegrep/pkg/debugserver"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/sdnotify"
+	"github.com/livegrep/livegrep/pkg/sentry"
+)
+
+var (
+	flagFull         = flag.String("full", "0 2 * * *", "cron `schedule` for full rebuilds")
+	flagIncremental  = flag.String("incremental", "", "cron `schedule` for incremental rebuilds (livegrep-fetch-reindex -incremental); empty to disable")
+	flagFetchReindex = flag.String("fetch-reindex", "", "Path to the livegrep-fetch-reindex binary")
+	flagListen       = flag.String("listen", "127.0.0.1:9091", "Address to serve run history and the schedule on")
+	flagState        = flag.String("state", "", "File to remember the last runs in, so runs missed while the scheduler was down are caught up on")
+	flagHistory      = flag.Int("history", 50, "Number of past runs to keep")
+)
+
+// A job is one of the kinds of run the scheduler starts.
+type job struct {
+	Kind     string    `json:"kind"`
+	Schedule string    `json:"schedule"`
+	Last     time.Time `json:"last_run"`
+	Next     time.Time `json:"next_run"`
+
+	sched *cron.Schedule
+	args  []string
+}
+
+type run struct {
+	Kind    string    `json:"kind"`
+	Trigger string    `json:"trigger"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type scheduler struct {
+	mu      sync.Mutex
+	jobs    []*job // in priority order
+	running *run
+	history []run
+	started time.Time
+
+	trigger chan string
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [--] FETCH-REINDEX-ARGS...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := logging.Init("scheduler"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := sentry.Init("scheduler"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer sentry.Recover()
+	if err := debugserver.Start(); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	s := &scheduler{started: time.Now(), trigger: make(chan string)}
+	specs := []struct{ kind, spec string }{
+		{"full", *flagFull},
+		{"incremental", *flagIncremental},
+	}
+	for _, sp := range specs {
+		if sp.spec == "" {
+			continue
+		}
+		sched, err := cron.Parse(sp.spec)
+		if err != nil {
+			log.Fatalf("-%s: %s", sp.kind, err.Error())
+		}
+		if sched.Next(time.Now()).IsZero() {
+			log.Fatalf("-%s: %q never matches", sp.kind, sp.spec)
+		}
+		args := append(append(logging.Args(), sentry.Args()...), flag.Args()...)
+		if sp.kind == "incremental" {
+			args = append([]string{"-incremental"}, args...)
+		}
+		s.jobs = append(s.jobs, &job{Kind: sp.kind, Schedule: sp.spec, sched: sched, args: args})
+	}
+	if len(s.jobs) == 0 {
+		log.Fatal("nothing to schedule")
+	}
+
+	last, err := loadState(*flagState)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	for _, j := range s.jobs {
+		j.Last = last[j.Kind]
+		if j.Last.IsZero() {
+			j.Next = j.sched.Next(time.Now())
+		} else {
+			// If this is in the past, the run was missed while we
+			// were down, and will start straight away.
+			j.Next = j.sched.Next(j.Last)
+		}
+		logging.Infof("%s: next run at %s", j.Kind, j.Next.Format(time.RFC3339))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveStatus)
+	mux.HandleFunc("/run", s.serveRun)
+	l, err := net.Listen("tcp", *flagListen)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	go func() {
+		log.Fatal(http.Serve(l, mux))
+	}()
+
+	sdnotify.StopOnSignal()
+	sdnotify.StartWatchdog(nil)
+	sdnotify.Ready("waiting for the next run")
+	s.loop()
+}
+
+// loop runs jobs as they come due, one at a time. A job that comes due
+// while another is running starts when it finishes; however many times
+// it came due in the meantime, it only runs once.
+func (s *scheduler) loop() {
+	for {
+		j := s.due()
+		trigger := "schedule"
+		if j.Next.Before(s.started) {
+			trigger = "missed"
+		}
+		timer := time.NewTimer(time.Until(j.Next))
+		select {
+		case <-timer.C:
+		case kind := <-s.trigger:
+			timer.Stop()
+			j = s.job(kind)
+			trigger = "manual"
+		}
+		s.run(j, trigger)
+	}
+}
+
+// due returns the job to run next: the first job in priority order
+// that is already due, or the one that comes due soonest.
+func (s *scheduler) due() *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	next := s.jobs[0]
+	for _, j := range s.jobs {
+		if !j.Next.After(now) {
+			return j
+		}
+		if j.Next.Before(next.Next) {
+			next = j
+		}
+	}
+	return next
+}
+
+func (s *scheduler) job(kind string) *job {
+	for _, j := range s.jobs {
+		if j.Kind == kind {
+			return j
+		}
+	}
+	return nil
+}
+
+func (s *scheduler) run(j *job, trigger string) {
+	r := &run{Kind: j.Kind, Trigger: trigger, Start: time.Now()}
+	s.mu.Lock()
+	s.running = r
+	s.mu.Unlock()
+
+	logging.Infof("Starting %s run (%s)", j.Kind, trigger)
+	sdnotify.Status(fmt.Sprintf("running %s rebuild", j.Kind))
+	cmd := exec.Command(findFetchReindex(*flagFetchReindex), j.args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	r.End = time.Now()
+	if err != nil {
+		r.Error = err.Error()
+		logging.With("job", j.Kind, "duration", r.End.Sub(r.Start), "error", r.Error).Errorf("%s run failed after %s: %s", j.Kind, r.End.Sub(r.Start), r.Error)
+	} else {
+		logging.With("job", j.Kind, "duration", r.End.Sub(r.Start)).Infof("%s run finished in %s", j.Kind, r.End.Sub(r.Start))
+	}
+	sdnotify.Status("waiting for the next run")
+
+	s.mu.Lock()
+	s.running = nil
+	s.history = append(s.history, *r)
+	if len(s.history) > *flagHistory {
+		s.history = s.history[len(s.history)-*flagHistory:]
+	}
+	// A failed run still counts as a run; it is retried at the next
+	// scheduled time rather than in a loop.
+	j.Last = r.Start
+	j.Next = j.sched.Next(r.Start)
+	if j.Kind == "full" {
+		// A full rebuild covers everything an incremental one would
+		// have done.
+		if inc := s.job("incremental"); inc != nil {
+			inc.Last = r.Start
+			inc.Next = inc.sched.Next(r.Start)
+		}
+	}
+	state := map[string]time.Time{}
+	for _, j := range s.jobs {
+		state[j.Kind] = j.Last
+	}
+	s.mu.Unlock()
+
+	if err := saveState(*flagState, state); err != nil {
+		logging.Errorf("saving state: %s", err.Error())
+	}
+}
+
+func (s *scheduler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	status := struct {
+		Running *run   `json:"running"`
+		Jobs    []*job `json:"jobs"`
+		History []run  `json:"history"`
+	}{s.running, s.jobs, s.history}
+	data, err := json.MarshalIndent(status, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// serveRun starts a run of the given kind (POST /run?kind=full) as soon
+// as the current one, if any, finishes.
+func (s *scheduler) serveRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	kind := r.FormValue("kind")
+	if kind == "" {
+		kind = "full"
+	}
+	if s.job(kind) == nil {
+		http.Error(w, fmt.Sprintf("no %q run is configured", kind), http.StatusBadRequest)
+		return
+	}
+	go func() { s.trigger <- kind }()
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "%s run queued\n", kind)
+}
+
+func loadState(file string) (map[string]time.Time, error) {
+	state := map[string]time.Time{}
+	if file == "" {
+		return state, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+	return state, nil
+}
+
+func saveState(file string, state map[string]time.Time) error {
+	if file == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func findFetchReindex(given string) string {
+	if given != "" {
+		return given
+	}
+	try := path.Join(path.Dir(os.Args[0]), "livegrep-fetch-reindex")
+	if st, err := os.Stat(try); err == nil && (st.Mode()&os.ModeDir) == 0 {
+		return try
+	}
+	return "livegrep-fetch-reindex"
+}
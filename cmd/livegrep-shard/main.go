@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/config"
+)
+
+var (
+	flagShards      = flag.Int("n", 2, "Number of shards")
+	flagOutDir      = flag.String("out-dir", "shards", "Directory to write shard-N configs and backends.json to")
+	flagFormat      = flag.String("format", "json", "Format of the shard configs (json or yaml)")
+	flagBy          = flag.String("by", "bytes", "Balance shards by `bytes` or files")
+	flagBackendAddr = flag.String("backend-addr", "codesearch-{shard}:9999", "Address of each shard's backend in backends.json; {shard} is replaced by the shard number")
+	flagBackendId   = flag.String("backend-id", "", "List the shards in backends.json as the shards of one backend with this `id`, searched as a single index, instead of as a backend each")
+)
+
+// shardFile matches the configs written to -out-dir.
+const shardFile = "shard-%d"
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] CONFIG...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+
+	if len(flag.Args()) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *flagShards < 1 {
+		log.Fatal("-n must be at least 1")
+	}
+	if *flagBy != "bytes" && *flagBy != "files" {
+		log.Fatalf("-by must be bytes or files, not %q", *flagBy)
+	}
+	format, err := indexspec.ParseFormat(*flagFormat)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	spec, err := indexspec.Load(flag.Args()...)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	weights := map[string]int64{}
+	for _, p := range spec.Paths {
+		files, size, err := measureDir(p.Path)
+		if err != nil {
+			log.Printf("%s: %s; treating as empty", p.Name, err.Error())
+		}
+		weights[p.Name] = choose(files, size)
+	}
+	for _, r := range spec.Repositories {
+		files, size, err := measureRepo(r)
+		if err != nil {
+			log.Printf("%s: %s; treating as empty", r.Name, err.Error())
+		}
+		weights[r.Name] = choose(files, size)
+	}
+
+	previous, err := loadPrevious(*flagOutDir)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	shards := indexspec.Partition(spec, *flagShards, func(name string) int64 {
+		return weights[name]
+	}, previous)
+
+	if err := os.MkdirAll(*flagOutDir, 0755); err != nil {
+		log.Fatalln(err.Error())
+	}
+	var backends []config.Backend
+	var shardAddrs []config.Shard
+	for i, s := range shards {
+		if spec.Name != "" {
+			s.Name = fmt.Sprintf("%s-%d", spec.Name, i)
+		}
+		out := filepath.Join(*flagOutDir, fmt.Sprintf(shardFile, i)+format.Ext())
+		if err := indexspec.Write(out, s); err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		var total int64
+		moved := 0
+		for _, name := range entryNames(s) {
+			total += weights[name]
+			if prev, ok := previous[name]; ok && prev != i {
+				moved++
+			}
+		}
+		log.Printf("%s: %d entries, %d %s, %d moved in",
+			out, len(s.Paths)+len(s.Repositories), total, *flagBy, moved)
+		if len(s.Paths)+len(s.Repositories) == 0 {
+			log.Printf("%s: warning: shard is empty; use a smaller -n", out)
+		}
+
+		addr := strings.Replace(*flagBackendAddr, "{shard}", strconv.Itoa(i), -1)
+		if *flagBackendId != "" {
+			shardAddrs = append(shardAddrs, config.Shard{Addr: addr})
+			continue
+		}
+		backends = append(backends, config.Backend{
+			Id:   fmt.Sprintf("shard-%d", i),
+			Addr: addr,
+		})
+	}
+	if *flagBackendId != "" {
+		backends = []config.Backend{{Id: *flagBackendId, Shards: shardAddrs}}
+	}
+
+	snippet, err := json.MarshalIndent(map[string]interface{}{"backends": backends}, "", "  ")
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(*flagOutDir, "backends.json"), append(snippet, '\n'), 0644); err != nil {
+		log.Fatalln(err.Error())
+	}
+}
+
+func choose(files, size int64) int64 {
+	if *flagBy == "files" {
+		return files
+	}
+	return size
+}
+
+func entryNames(s *pb.IndexSpec) []string {
+	var names []string
+	for _, p := range s.Paths {
+		names = append(names, p.Name)
+	}
+	for _, r := range s.Repositories {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+// loadPrevious reads the shard configs written by an earlier run, and
+// returns which shard each entry was in. Configs for shards beyond -n
+// are read too, so that shrinking -n only moves their entries.
+func loadPrevious(dir string) (map[string]int, error) {
+	previous := map[string]int{}
+	matches, err := filepath.Glob(filepath.Join(dir, "shard-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		base := filepath.Base(m)
+		var i int
+		if _, err := fmt.Sscanf(strings.TrimSuffix(base, filepath.Ext(base)), shardFile, &i); err != nil {
+			continue
+		}
+		s, err := indexspec.Load(m)
+		if err != nil {
+			return nil, fmt.Errorf("reading previous shards: %s", err.Error())
+		}
+		for _, name := range entryNames(s) {
+			previous[name] = i
+		}
+	}
+	return previous, nil
+}
+
+// measureRepo returns the number and total size of the files in every
+// revision of r in its local clone.
+func measureRepo(r *pb.RepoSpec) (files, size int64, err error) {
+	for _, rev := range r.Revisions {
+		cmd := exec.Command("git", "-C", r.Path, "ls-tree", "-r", "-l", "--full-tree", rev)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return files, size, fmt.Errorf("git ls-tree %s: %s", rev, strings.TrimSpace(stderr.String()))
+		}
+		s := bufio.NewScanner(bytes.NewReader(out))
+		for s.Scan() {
+			// <mode> SP <type> SP <object> SP <size> TAB <path>
+			fields := strings.Fields(strings.SplitN(s.Text(), "\t", 2)[0])
+			if len(fields) != 4 || fields[1] != "blob" {
+				continue
+			}
+			n, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				continue
+			}
+			files++
+			size += n
+		}
+	}
+	return files, size, nil
+}
+
+func measureDir(dir string) (files, size int64, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size, err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+	"google.golang.org/grpc"
+)
+
+type stringList []string
+
+func (s *stringList) String() string     { return strings.Join(*s, ", ") }
+func (s *stringList) Set(v string) error { *s = append(*s, v); return nil }
+
+var (
+	flagCodesearch   = flag.String("codesearch", "", "Path to the `codesearch` binary")
+	flagAddrs        = flag.String("addrs", "localhost:9998,localhost:9999", "The two addresses to alternate the backend between")
+	flagState        = flag.String("state", "", "File recording the running backend's address and pid (required)")
+	flagFrontends    = flag.String("frontend", "", "Comma-separated base URLs of the frontends to repoint (their admin_token must be in $LIVEGREP_ADMIN_TOKEN)")
+	flagBackend      = flag.String("backend", "", "The id of the backend to repoint on each frontend")
+	flagLog          = flag.String("log", "", "File to append the new backend's output to (default: discard it)")
+	flagStartTimeout = flag.Duration("start-timeout", 10*time.Minute, "How long to wait for the new backend to load its index")
+	flagDrain        = flag.Duration("drain", time.Minute, "How long to leave the old backend running after switching, for searches in flight")
+	flagCanaries     stringList
+)
+
+func init() {
+	flag.Var(&flagCanaries, "canary", "A search that must return results from the new backend before it is swapped in (repeatable)")
+}
+
+// state describes the backend a previous swap started.
+type state struct {
+	Addr  string `json:"addr"`
+	Pid   int    `json:"pid"`
+	Index string `json:"index"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] INDEX [-- CODESEARCH-FLAGS...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := logging.Init("swap"); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	if flag.NArg() < 1 || *flagState == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *flagFrontends != "" && *flagBackend == "" {
+		log.Fatal("-frontend requires -backend")
+	}
+	index := flag.Arg(0)
+
+	prev, err := loadState(*flagState)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	addr, err := pickAddr(strings.Split(*flagAddrs, ","), prev)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	logging.Infof("Starting backend for %s on %s", index, addr)
+	cmd, exited, err := startBackend(index, addr, flag.Args()[1:])
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	fail := func(format string, args ...interface{}) {
+		cmd.Process.Kill()
+		log.Fatalf(format, args...)
+	}
+
+	client, err := waitHealthy(addr, exited)
+	if err != nil {
+		fail("new backend: %s", err.Error())
+	}
+	for _, q := range flagCanaries {
+		if err := canary(client, q); err != nil {
+			fail("canary %q: %s", q, err.Error())
+		}
+		logging.Infof("Canary %q ok", q)
+	}
+
+	if *flagFrontends != "" {
+		for _, fe := range strings.Split(*flagFrontends, ",") {
+			if err := repoint(fe, *flagBackend, addr); err != nil {
+				// Some frontends may already be using the new
+				// backend, so leave both running.
+				log.Fatalf("repointing %s: %s; both backends have been left running", fe, err.Error())
+			}
+			logging.With("frontend", fe, "backend", *flagBackend).Infof("%s: backend %s now at %s", fe, *flagBackend, addr)
+		}
+	}
+
+	if err := saveState(*flagState, &state{Addr: addr, Pid: cmd.Process.Pid, Index: index}); err != nil {
+		logging.Errorf("saving state: %s", err.Error())
+	}
+
+	if prev != nil && prev.Pid != 0 {
+		logging.Infof("Retiring old backend (pid %d on %s) in %s", prev.Pid, prev.Addr, *flagDrain)
+		time.Sleep(*flagDrain)
+		if err := syscall.Kill(prev.Pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			logging.Warnf("stopping pid %d: %s", prev.Pid, err.Error())
+		}
+	}
+	logging.Infof("Swapped in %s", index)
+}
+
+// pickAddr returns the address the running backend isn't using.
+func pickAddr(addrs []string, prev *state) (string, error) {
+	for _, a := range addrs {
+		if a = strings.TrimSpace(a); a != "" && (prev == nil || a != prev.Addr) {
+			return a, nil
+		}
+	}
+	return "", errors.New("-addrs needs an address other than the running backend's")
+}
+
+// startBackend starts codesearch serving index on addr, in its own
+// session so that it outlives this command. exited is closed if it
+// exits.
+func startBackend(index, addr string, extra []string) (*exec.Cmd, <-chan struct{}, error) {
+	args := append([]string{"-load_index", index, "-grpc", addr}, extra...)
+	cmd := exec.Command(findCodesearch(*flagCodesearch), args...)
+	if *flagLog != "" {
+		f, err := os.OpenFile(*flagLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		cmd.Stdout, cmd.Stderr = f, f
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	return cmd, exited, nil
+}
+
+// waitHealthy waits for the backend at addr to answer an Info request,
+// which it does once its index is loaded.
+func waitHealthy(addr string, exited <-chan struct{}) (pb.CodeSearchClient, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	client := pb.NewCodeSearchClient(conn)
+	deadline := time.Now().Add(*flagStartTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			return nil, errors.New("codesearch exited")
+		default:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		info, err := client.Info(ctx, &pb.InfoRequest{})
+		cancel()
+		if err == nil {
+			logging.Infof("Backend up: %s, %d trees", info.Name, len(info.Trees))
+			return client, nil
+		}
+		time.Sleep(time.Second)
+	}
+	return nil, fmt.Errorf("not healthy after %s", *flagStartTimeout)
+}
+
+func canary(client pb.CodeSearchClient, line string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	res, err := client.Search(ctx, &pb.Query{Line: line, MaxMatches: 1})
+	if err != nil {
+		return err
+	}
+	if len(res.Results) == 0 {
+		return errors.New("no results")
+	}
+	return nil
+}
+
+// repoint uses the frontend's admin API to point backend at addr.
+func repoint(frontend, backend, addr string) error {
+	u := strings.TrimRight(frontend, "/") + "/api/v1/admin/backends/" + url.PathEscape(backend)
+	req, err := http.NewRequest("POST", u, strings.NewReader(url.Values{"addr": {addr}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("LIVEGREP_ADMIN_TOKEN"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func loadState(file string) (*state, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+	return &st, nil
+}
+
+func saveState(file string, st *state) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func findCodesearch(given string) string {
+	if given != "" {
+		return given
+	}
+	search := []string{
+		path.Join(path.Dir(os.Args[0]), "codesearch"),
+		"bazel-bin/src/tools/codesearch",
+	}
+	for _, try := range search {
+		if st, err := os.Stat(try); err == nil && (st.Mode()&os.ModeDir) == 0 {
+			return try
+		}
+	}
+	return "codesearch"
+}
@@ -4,14 +4,22 @@ import (
 	"encoding/json"
 	_ "expvar"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"path"
+	"time"
 
 	libhoney "github.com/honeycombio/libhoney-go"
+	"github.com/livegrep/livegrep/pkg/debugserver"
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/sdnotify"
+	"github.com/livegrep/livegrep/pkg/sentry"
 	"github.com/livegrep/livegrep/server"
 	"github.com/livegrep/livegrep/server/config"
 	"github.com/livegrep/livegrep/server/middleware"
@@ -23,6 +31,7 @@ var (
 	docRoot     = flag.String("docroot", "", "The livegrep document root (web/ directory). If not provided, this defaults to web/ inside the bazel-created runfiles directory adjacent to the livegrep binary.")
 	indexConfig = flag.String("index-config", "", "Codesearch index config file; provide to enable repo browsing")
 	reload      = flag.Bool("reload", false, "Reload template files on every request")
+	allConfig   = flag.String("config", "", "With serve-all, the all-in-one config `file`")
 	_           = flag.Bool("logtostderr", false, "[DEPRECATED] compatibility with glog")
 )
 
@@ -35,7 +44,26 @@ func runfilesPath(sourcePath string) (string, error) {
 }
 
 func main() {
-	flag.Parse()
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [CONFIG]\n       %s serve-all -config FILE [flags]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	args := os.Args[1:]
+	all := len(args) > 0 && args[0] == "serve-all"
+	if all {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if err := logging.Init("frontend"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := sentry.Init("frontend"); err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer sentry.Recover()
+	if err := debugserver.Start(); err != nil {
+		log.Fatalln(err.Error())
+	}
 
 	if *docRoot == "" {
 		var err error
@@ -58,14 +86,51 @@ func main() {
 		},
 	}
 
-	if *indexConfig != "" {
-		data, err := ioutil.ReadFile(*indexConfig)
-		if err != nil {
-			log.Fatalf(err.Error())
+	if all {
+		if *allConfig == "" {
+			log.Fatal("serve-all requires -config")
+		}
+		if err := serveAll(*allConfig, cfg); err != nil {
+			log.Fatalln(err.Error())
 		}
+	} else {
+		loadConfig(cfg)
+	}
 
-		if err = json.Unmarshal(data, &cfg.IndexConfig); err != nil {
-			log.Fatalf("reading %s: %s", flag.Arg(0), err.Error())
+	if cfg.IndexConfig.Name != "" {
+		sentry.SetTag("config", cfg.IndexConfig.Name)
+	}
+
+	libhoney.Init(libhoney.Config{})
+
+	handler, err := server.New(cfg)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	if cfg.ReverseProxy {
+		handler = middleware.UnwrapProxyHeaders(handler)
+	}
+
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	logging.Infof("Listening on %s.", cfg.Listen)
+	sdnotify.StopOnSignal()
+	sdnotify.StartWatchdog(func() error { return checkHealthz(l.Addr().String()) })
+	sdnotify.Ready("serving on " + cfg.Listen)
+	// Not the default mux, which pkg/debugserver's imports register
+	// their handlers on.
+	log.Fatal(http.Serve(l, handler))
+}
+
+// loadConfig fills in cfg from -index-config and the config file named
+// on the command line, if there is one.
+func loadConfig(cfg *config.Config) {
+	if *indexConfig != "" {
+		if err := loadIndexConfig(*indexConfig, cfg); err != nil {
+			log.Fatalln(err.Error())
 		}
 	}
 
@@ -79,20 +144,33 @@ func main() {
 			log.Fatalf("reading %s: %s", flag.Arg(0), err.Error())
 		}
 	}
+}
 
-	libhoney.Init(libhoney.Config{})
-
-	handler, err := server.New(cfg)
+// loadIndexConfig reads the codesearch index config at path into cfg,
+// enabling repository browsing.
+func loadIndexConfig(path string, cfg *config.Config) error {
+	data, err := indexspec.RenderFiles(path)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
-
-	if cfg.ReverseProxy {
-		handler = middleware.UnwrapProxyHeaders(handler)
+	if err = json.Unmarshal(data, &cfg.IndexConfig); err != nil {
+		return fmt.Errorf("reading %s: %s", path, err.Error())
 	}
+	return nil
+}
 
-	http.DefaultServeMux.Handle("/", handler)
-
-	log.Printf("Listening on %s.", cfg.Listen)
-	log.Fatal(http.ListenAndServe(cfg.Listen, nil))
+// checkHealthz asks the frontend listening on addr for /healthz, so that
+// the systemd watchdog only hears from a frontend still answering
+// requests.
+func checkHealthz(addr string) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + addr + "/healthz")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("/healthz: %s", resp.Status)
+	}
+	return nil
 }
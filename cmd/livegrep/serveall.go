@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/cron"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/sentry"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// allInOne is the config file of livegrep serve-all, which runs the
+// frontend, codesearch and scheduled rebuilds of the index from one
+// process.
+type allInOne struct {
+	// The index config, in JSON or YAML, listing the repositories to
+	// index; relative to this file
+	Index string `json:"index"`
+	// Where to keep the index generations; "livegrep-data", next to
+	// this file, by default
+	DataDir string `json:"data_dir"`
+	// cron schedule on which to rebuild the index; "@hourly" by default
+	Schedule string `json:"schedule"`
+	// The address codesearch listens on; "localhost:9999" by default
+	BackendAddr string `json:"backend_addr"`
+	// More arguments to livegrep-fetch-reindex and codesearch
+	FetchReindexArgs []string `json:"fetch_reindex_args"`
+	CodesearchArgs   []string `json:"codesearch_args"`
+	// Anything else the frontend config can set, such as listen
+	Frontend json.RawMessage `json:"frontend"`
+}
+
+// serveAll reads the serve-all config at path, fills in cfg to serve
+// the index it builds, and starts rebuilding it on schedule.
+func serveAll(path string, cfg *config.Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	all := allInOne{
+		DataDir:     "livegrep-data",
+		Schedule:    "@hourly",
+		BackendAddr: "localhost:9999",
+	}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return fmt.Errorf("reading %s: %s", path, err.Error())
+	}
+	if all.Index == "" {
+		return fmt.Errorf("%s: index is required", path)
+	}
+	dir := filepath.Dir(path)
+	if !filepath.IsAbs(all.Index) {
+		all.Index = filepath.Join(dir, all.Index)
+	}
+	if !filepath.IsAbs(all.DataDir) {
+		all.DataDir = filepath.Join(dir, all.DataDir)
+	}
+	sched, err := cron.Parse(all.Schedule)
+	if err != nil {
+		return fmt.Errorf("%s: schedule: %s", path, err.Error())
+	}
+
+	indexDir := filepath.Join(all.DataDir, "index")
+	if err := os.MkdirAll(indexDir, 0755); err != nil {
+		return err
+	}
+	cfg.Backends = []config.Backend{{
+		Id:   "",
+		Addr: all.BackendAddr,
+		Run: &config.RunBackend{
+			// The current generation; see livegrep-fetch-reindex
+			// -index-dir.
+			Index: filepath.Join(indexDir, "current"),
+			Args:  all.CodesearchArgs,
+		},
+	}}
+	if err := loadIndexConfig(all.Index, cfg); err != nil {
+		return err
+	}
+	if len(all.Frontend) > 0 {
+		if err := json.Unmarshal(all.Frontend, cfg); err != nil {
+			return fmt.Errorf("reading %s: frontend: %s", path, err.Error())
+		}
+	}
+
+	args := append(append(logging.Args(), sentry.Args()...), "-index-dir", indexDir)
+	args = append(append(args, all.FetchReindexArgs...), all.Index)
+	go rebuildLoop(sched, args, filepath.Join(indexDir, "current"))
+	return nil
+}
+
+// rebuildLoop runs livegrep-fetch-reindex with args whenever sched comes
+// due, and straight away if there is no index at current yet.
+func rebuildLoop(sched *cron.Schedule, args []string, current string) {
+	if _, err := os.Stat(current); err != nil {
+		rebuild(args)
+	}
+	for {
+		next := sched.Next(time.Now())
+		if next.IsZero() {
+			return
+		}
+		time.Sleep(time.Until(next))
+		rebuild(args)
+	}
+}
+
+func rebuild(args []string) {
+	start := time.Now()
+	logging.Infof("Rebuilding the index")
+	cmd := exec.Command(findFetchReindex(), args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		logging.With("phase", "index", "duration", time.Since(start), "error", err.Error()).Errorf("Rebuilding the index failed after %s: %s", time.Since(start), err.Error())
+		return
+	}
+	logging.With("phase", "index", "duration", time.Since(start)).Infof("Rebuilt the index in %s", time.Since(start))
+}
+
+// findFetchReindex returns the livegrep-fetch-reindex installed next to
+// livegrep, if there is one, or else the one on the PATH.
+func findFetchReindex() string {
+	if exe, err := os.Executable(); err == nil {
+		try := filepath.Join(filepath.Dir(exe), "livegrep-fetch-reindex")
+		if st, err := os.Stat(try); err == nil && st.Mode().IsRegular() {
+			return try
+		}
+	}
+	return "livegrep-fetch-reindex"
+}
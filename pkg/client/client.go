@@ -0,0 +1,138 @@
+// Package client searches livegrep from Go programs, either through a
+// frontend's JSON API or directly against a codesearch backend over
+// gRPC, so that other services can embed livegrep queries rather than
+// running lg.
+//
+// Both transports take the same Query and return the same Reply, and
+// both retry searches that fail because the frontend or backend is
+// briefly unavailable. The types here are the package's stable API;
+// they don't change as the frontend's reply or the backend's protocol
+// grow.
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// A Query is a search, in the query language of the web UI, so that it
+// may use operators such as file:, repo: and case:.
+type Query struct {
+	Query string
+	// Whether the search term is a regex; if not, it is a literal
+	// string
+	Regex bool
+	// The most matches to return; 0 for the server's default
+	MaxMatches int
+	// Through a frontend, the backend to search, if not its default.
+	// Ignored by gRPC clients, which search the one backend they are
+	// connected to.
+	Backend string
+}
+
+// A Result is one matching line.
+type Result struct {
+	Tree          string
+	Version       string
+	Path          string
+	LineNumber    int
+	Line          string
+	ContextBefore []string
+	ContextAfter  []string
+	// The part of Line that matched, as byte offsets
+	Bounds [2]int
+}
+
+// A FileResult is a file whose path matched a file: search.
+type FileResult struct {
+	Tree    string
+	Version string
+	Path    string
+	Bounds  [2]int
+}
+
+// A Reply is what a search found.
+type Reply struct {
+	Results     []Result
+	FileResults []FileResult
+	// Why the search stopped early, if it did: "MATCH_LIMIT", when it
+	// found MaxMatches matches, or "TIMEOUT", in which case it may
+	// have missed matches; "" if it finished
+	ExitReason string
+}
+
+// Truncated reports whether the search stopped before it finished, so
+// that there may be more matches.
+func (r *Reply) Truncated() bool {
+	return r.ExitReason != ""
+}
+
+// An Error is a search the server refused or failed, such as one with
+// an invalid query, with the code and message it gave. Status is the
+// HTTP status of a frontend's reply, and 0 from a backend.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// A Client searches a frontend or a backend. It is safe for concurrent
+// use.
+type Client interface {
+	Search(ctx context.Context, q *Query) (*Reply, error)
+	// Close releases the client's connections.
+	Close() error
+}
+
+const (
+	defaultRetries = 2
+	defaultBackoff = 100 * time.Millisecond
+)
+
+// Options configure a Client; the zero value is fine.
+type Options struct {
+	// How many times to retry a search that fails because the server is
+	// unavailable; 2 by default, or none if negative
+	Retries int
+	// How long to wait before the first retry, doubling each time;
+	// 100ms by default
+	Backoff time.Duration
+	// The HTTP client for a frontend; http.DefaultClient by default
+	HTTPClient *http.Client
+	// Added to the options a backend is dialed with
+	DialOptions []grpc.DialOption
+}
+
+// retry calls search until it succeeds, fails for good, or has been
+// retried as many times as the options allow, waiting longer each
+// time. search reports whether its error is worth retrying.
+func (o *Options) retry(ctx context.Context, search func() (*Reply, bool, error)) (*Reply, error) {
+	retries := o.Retries
+	if retries == 0 {
+		retries = defaultRetries
+	}
+	backoff := o.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		reply, retryable, err := search()
+		if err == nil || !retryable || attempt >= retries {
+			return reply, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
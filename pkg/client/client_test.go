@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+func TestHTTPSearch(t *testing.T) {
+	var params map[string][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/search/other" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		params = r.URL.Query()
+		json.NewEncoder(w).Encode(&api.ReplySearch{
+			Info: &api.Stats{ExitReason: "MATCH_LIMIT"},
+			Results: []*api.Result{{
+				Tree: "org/a", Version: "main", Path: "main.go", LineNumber: 3,
+				Line: "func main() {", Bounds: [2]int{5, 9},
+			}},
+		})
+	}))
+	defer srv.Close()
+
+	c, err := NewHTTP(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.Search(context.Background(), &Query{Query: "main file:\\.go$", Regex: true, MaxMatches: 1, Backend: "other"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	wantParams := map[string][]string{"q": {"main file:\\.go$"}, "regex": {"true"}, "max_matches": {"1"}}
+	if !reflect.DeepEqual(params, wantParams) {
+		t.Errorf("params = %v, want %v", params, wantParams)
+	}
+	want := &Reply{
+		Results: []Result{{
+			Tree: "org/a", Version: "main", Path: "main.go", LineNumber: 3,
+			Line: "func main() {", Bounds: [2]int{5, 9},
+		}},
+		ExitReason: "MATCH_LIMIT",
+	}
+	if !reflect.DeepEqual(reply, want) {
+		t.Errorf("reply = %+v, want %+v", reply, want)
+	}
+	if !reply.Truncated() {
+		t.Error("reply not truncated")
+	}
+}
+
+func TestHTTPRetries(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   int
+		attempts int
+	}{
+		{"unavailable", 503, 3},
+		{"bad query", 400, 1},
+	}
+	for _, tc := range cases {
+		attempts := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(tc.status)
+			json.NewEncoder(w).Encode(&api.ReplyError{Err: api.InnerError{Code: "code", Message: "message"}})
+		}))
+		c, _ := NewHTTP(srv.URL, &Options{Backoff: time.Millisecond})
+		_, err := c.Search(context.Background(), &Query{Query: "x"})
+		srv.Close()
+		e, ok := err.(*Error)
+		if !ok || e.Status != tc.status || e.Code != "code" || e.Message != "message" {
+			t.Errorf("%s: err = %#v", tc.name, err)
+		}
+		if attempts != tc.attempts {
+			t.Errorf("%s: %d attempts, want %d", tc.name, attempts, tc.attempts)
+		}
+	}
+}
+
+func TestHTTPRetrySucceeds(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts++; attempts == 1 {
+			w.WriteHeader(502)
+			return
+		}
+		json.NewEncoder(w).Encode(&api.ReplySearch{Info: &api.Stats{ExitReason: "NONE"}})
+	}))
+	defer srv.Close()
+
+	c, _ := NewHTTP(srv.URL, &Options{Backoff: time.Millisecond})
+	reply, err := c.Search(context.Background(), &Query{Query: "x"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if attempts != 2 || reply.Truncated() {
+		t.Errorf("attempts = %d, reply = %+v", attempts, reply)
+	}
+}
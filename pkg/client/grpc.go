@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/livegrep/livegrep/server"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// grpcClient searches a codesearch backend directly.
+type grpcClient struct {
+	conn   *grpc.ClientConn
+	client pb.CodeSearchClient
+	opts   Options
+}
+
+// NewGRPC returns a Client that searches the codesearch backend at
+// addr, a HOST:PORT, parsing queries as the frontend would. Without a
+// frontend there are no tag-history defaults, index: or label:
+// operators, which need the frontend's view of its backends.
+func NewGRPC(addr string, opts *Options) (Client, error) {
+	c := &grpcClient{}
+	if opts != nil {
+		c.opts = *opts
+	}
+	dialOpts := append([]grpc.DialOption{grpc.WithInsecure()}, c.opts.DialOptions...)
+	conn, err := grpc.Dial(addr, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	c.conn, c.client = conn, pb.NewCodeSearchClient(conn)
+	return c, nil
+}
+
+func (c *grpcClient) Search(ctx context.Context, q *Query) (*Reply, error) {
+	pq, err := server.ParseQuery(q.Query, q.Regex)
+	if err != nil {
+		return nil, &Error{Code: "bad_query", Message: err.Error()}
+	}
+	pq.MaxMatches = int32(q.MaxMatches)
+	return c.opts.retry(ctx, func() (*Reply, bool, error) {
+		reply, err := c.client.Search(ctx, &pq, grpc.FailFast(false))
+		switch grpc.Code(err) {
+		case codes.OK:
+			return fromPB(reply), false, nil
+		case codes.InvalidArgument:
+			return nil, false, &Error{Code: "query", Message: grpc.ErrorDesc(err)}
+		case codes.Unavailable:
+			return nil, true, err
+		default:
+			return nil, false, err
+		}
+	})
+}
+
+func fromPB(reply *pb.CodeSearchResult) *Reply {
+	out := &Reply{}
+	for _, r := range reply.Results {
+		out.Results = append(out.Results, Result{
+			Tree:          r.Tree,
+			Version:       r.Version,
+			Path:          r.Path,
+			LineNumber:    int(r.LineNumber),
+			Line:          r.Line,
+			ContextBefore: r.ContextBefore,
+			ContextAfter:  r.ContextAfter,
+			Bounds:        [2]int{int(r.Bounds.Left), int(r.Bounds.Right)},
+		})
+	}
+	for _, r := range reply.FileResults {
+		out.FileResults = append(out.FileResults, FileResult{
+			Tree:    r.Tree,
+			Version: r.Version,
+			Path:    r.Path,
+			Bounds:  [2]int{int(r.Bounds.Left), int(r.Bounds.Right)},
+		})
+	}
+	if reply.Stats != nil && reply.Stats.ExitReason != pb.SearchStats_NONE {
+		out.ExitReason = reply.Stats.ExitReason.String()
+	}
+	return out
+}
+
+func (c *grpcClient) Close() error {
+	return c.conn.Close()
+}
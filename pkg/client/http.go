@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+// httpClient searches through a frontend's /api/v1/search/.
+type httpClient struct {
+	base *url.URL
+	opts Options
+}
+
+// NewHTTP returns a Client that searches through the livegrep frontend
+// at frontend, such as "http://localhost:8910" or "livegrep.example.com".
+func NewHTTP(frontend string, opts *Options) (Client, error) {
+	if !strings.Contains(frontend, "://") {
+		frontend = "http://" + frontend
+	}
+	base, err := url.Parse(frontend)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", frontend, err.Error())
+	}
+	c := &httpClient{base: base}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.HTTPClient == nil {
+		c.opts.HTTPClient = http.DefaultClient
+	}
+	return c, nil
+}
+
+func (c *httpClient) Search(ctx context.Context, q *Query) (*Reply, error) {
+	uri := *c.base
+	uri.Path = strings.TrimSuffix(uri.Path, "/") + "/api/v1/search/" + q.Backend
+	params := url.Values{
+		"q":     {q.Query},
+		"regex": {strconv.FormatBool(q.Regex)},
+	}
+	if q.MaxMatches > 0 {
+		params.Set("max_matches", strconv.Itoa(q.MaxMatches))
+	}
+	uri.RawQuery = params.Encode()
+	return c.opts.retry(ctx, func() (*Reply, bool, error) {
+		return c.search(ctx, uri.String())
+	})
+}
+
+func (c *httpClient) search(ctx context.Context, uri string) (*Reply, bool, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := c.opts.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		// The frontend may be restarting, unless we gave up on it.
+		return nil, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		var reply api.ReplyError
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+			return nil, retryStatus(resp.StatusCode),
+				fmt.Errorf("reading reply (status=%d): %s", resp.StatusCode, err.Error())
+		}
+		return nil, retryStatus(resp.StatusCode),
+			&Error{Status: resp.StatusCode, Code: reply.Err.Code, Message: reply.Err.Message}
+	}
+
+	var reply api.ReplySearch
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, false, fmt.Errorf("reading reply: %s", err.Error())
+	}
+	if len(reply.Unavailable) > 0 {
+		u := reply.Unavailable[0]
+		return nil, true, &Error{Status: 503, Code: "backend_unavailable", Message: u.Backend + ": " + u.Error}
+	}
+	return fromAPI(&reply), false, nil
+}
+
+// retryStatus reports whether a reply with status is worth retrying:
+// whether the frontend, or the backend behind it, is unavailable.
+func retryStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable
+}
+
+func fromAPI(reply *api.ReplySearch) *Reply {
+	out := &Reply{}
+	for _, r := range reply.Results {
+		out.Results = append(out.Results, Result{
+			Tree:          r.Tree,
+			Version:       r.Version,
+			Path:          r.Path,
+			LineNumber:    r.LineNumber,
+			Line:          r.Line,
+			ContextBefore: r.ContextBefore,
+			ContextAfter:  r.ContextAfter,
+			Bounds:        r.Bounds,
+		})
+	}
+	for _, r := range reply.FileResults {
+		out.FileResults = append(out.FileResults, FileResult{
+			Tree:    r.Tree,
+			Version: r.Version,
+			Path:    r.Path,
+			Bounds:  r.Bounds,
+		})
+	}
+	if reply.Info != nil && reply.Info.ExitReason != "NONE" {
+		out.ExitReason = reply.Info.ExitReason
+	}
+	return out
+}
+
+func (c *httpClient) Close() error {
+	return nil
+}
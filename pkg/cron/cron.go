@@ -0,0 +1,141 @@
+// Package cron parses cron expressions and finds the times they match,
+// for livegrep-scheduler and livegrep serve-all.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule is a parsed cron expression: minute, hour, day of month,
+// month and day of week, each a bitmask of the values it matches.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, if both day fields are restricted a time matches if
+	// either does.
+	domStar, dowStar bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// Parse parses a five-field cron expression, or one of the macros
+// @hourly, @daily, @midnight, @weekly and @monthly. Each field is `*`
+// or a comma-separated list of values and ranges (`1-5`), optionally
+// with a step (`*/15`, `0-30/10`).
+func Parse(spec string) (*Schedule, error) {
+	if macro, ok := cronMacros[strings.TrimSpace(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q: expected 5 fields, got %d", spec, len(fields))
+	}
+	s := &Schedule{}
+	var err error
+	bounds := []struct {
+		out      *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		if *b.out, err = parseField(fields[i], b.min, b.max); err != nil {
+			return nil, fmt.Errorf("%q: %s", spec, err.Error())
+		}
+	}
+	// Sunday is both 0 and 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+func parseField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if step > 1 {
+				// `5/15` means from 5 to the end, every 15.
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t that the schedule matches, or
+// the zero time if it never does.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every schedule matches at least once in any five years (February
+	// 29th comes around every four).
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
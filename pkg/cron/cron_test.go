@@ -0,0 +1,41 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// A Wednesday.
+	from := time.Date(2024, 5, 1, 12, 30, 15, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"@hourly", time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 5, 1, 12, 45, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2024, 5, 2, 2, 0, 0, 0, time.UTC)},
+		{"0 3 * * 0", time.Date(2024, 5, 5, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2024, 5, 5, 3, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// With both day fields restricted, either matches.
+		{"0 0 15 * 5", time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)},
+	} {
+		s, err := Parse(tc.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tc.want) {
+			t.Errorf("%q: Next = %s, want %s", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded", spec)
+		}
+	}
+}
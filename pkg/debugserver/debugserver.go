@@ -0,0 +1,93 @@
+// Package debugserver serves Go's profiling and runtime metrics on a
+// separate, private port, when a binary is given -debug-listen.
+//
+// It serves net/http/pprof under /debug/pprof/, expvar (which includes
+// runtime.MemStats) under /debug/vars, and every runtime/metrics sample
+// under /debug/metrics. None of them is served on a binary's main port.
+package debugserver
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+)
+
+var flagListen = flag.String("debug-listen", "", "Serve pprof profiles and runtime metrics on this `address`, which should not be reachable by users")
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+}
+
+// Start starts serving in the background if -debug-listen is set. It
+// returns an error if the address can't be listened on.
+func Start() error {
+	if *flagListen == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", *flagListen)
+	if err != nil {
+		return fmt.Errorf("-debug-listen: %s", err.Error())
+	}
+	logging.Infof("Serving debug endpoints on %s", l.Addr())
+	go func() {
+		logging.Errorf("debug server: %s", http.Serve(l, Handler()).Error())
+	}()
+	return nil
+}
+
+// Handler returns the handler for the debug endpoints.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/metrics", serveMetrics)
+	return mux
+}
+
+// serveMetrics writes every runtime/metrics sample as a name and value
+// per line; histograms are written as their count and the buckets that
+// have any.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	descs := metrics.All()
+	samples := make([]metrics.Sample, len(descs))
+	for i := range descs {
+		samples[i].Name = descs[i].Name
+	}
+	metrics.Read(samples)
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Name < samples[j].Name })
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, s := range samples {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			fmt.Fprintf(w, "%s %d\n", s.Name, s.Value.Uint64())
+		case metrics.KindFloat64:
+			fmt.Fprintf(w, "%s %g\n", s.Name, s.Value.Float64())
+		case metrics.KindFloat64Histogram:
+			h := s.Value.Float64Histogram()
+			var total uint64
+			for _, c := range h.Counts {
+				total += c
+			}
+			fmt.Fprintf(w, "%s count=%d", s.Name, total)
+			for i, c := range h.Counts {
+				if c != 0 {
+					fmt.Fprintf(w, " [%g,%g)=%d", h.Buckets[i], h.Buckets[i+1], c)
+				}
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
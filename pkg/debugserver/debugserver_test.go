@@ -0,0 +1,24 @@
+package debugserver
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	h := Handler()
+	for path, want := range map[string]string{
+		"/debug/pprof/":  "goroutine",
+		"/debug/vars":    `"goroutines"`,
+		"/debug/metrics": "/sched/goroutines:goroutines ",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 {
+			t.Errorf("%s: got status %d", path, w.Code)
+		} else if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: body doesn't mention %q", path, want)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+// Package fakebackend serves the codesearch gRPC service from a small
+// in-memory corpus, so that frontend tests, and the tests of programs
+// that use livegrep's API, can exercise searches without building and
+// running the C++ backend.
+//
+// It implements the parts of a query the frontend sends: the line,
+// file, repo, label and version patterns and their negations, case
+// folding, context lines, filename-only searches and max_matches. It
+// searches by brute force, and doesn't try to match codesearch's
+// ordering of results or its timing statistics.
+package fakebackend
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// A Tree is one version of a repository or directory in the corpus.
+type Tree struct {
+	Name     string
+	Version  string
+	Metadata *config.Metadata
+	// The tree's files, by path.
+	Files map[string]string
+}
+
+// A Backend is a fake codesearch. It is safe for concurrent use.
+type Backend struct {
+	mu        sync.Mutex
+	name      string
+	trees     []Tree
+	indexTime time.Time
+	reloads   int
+	// Trees to serve from the next Reload, if set
+	next []Tree
+}
+
+// New returns a Backend serving trees as the index name.
+func New(name string, trees ...Tree) *Backend {
+	return &Backend{name: name, trees: trees, indexTime: time.Now()}
+}
+
+// SetTrees has the next Reload replace the backend's trees with trees,
+// as codesearch does when its index file is rebuilt.
+func (b *Backend) SetTrees(trees ...Tree) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.next = trees
+}
+
+// Reloads returns how many times the backend has been reloaded.
+func (b *Backend) Reloads() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reloads
+}
+
+// Serve serves the backend on lis until the returned server is
+// stopped.
+func (b *Backend) Serve(lis net.Listener) *grpc.Server {
+	srv := grpc.NewServer()
+	pb.RegisterCodeSearchServer(srv, b)
+	go srv.Serve(lis)
+	return srv
+}
+
+// Start serves the backend on a free port on localhost, returning its
+// address and a function that stops it.
+func (b *Backend) Start() (addr string, stop func(), err error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := b.Serve(lis)
+	return lis.Addr().String(), srv.Stop, nil
+}
+
+func (b *Backend) Info(ctx context.Context, r *pb.InfoRequest) (*pb.ServerInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	info := &pb.ServerInfo{Name: b.name, IndexTime: b.indexTime.Unix()}
+	for _, t := range b.trees {
+		info.Trees = append(info.Trees, &pb.ServerInfo_Tree{
+			Name:     t.Name,
+			Version:  t.Version,
+			Metadata: t.Metadata,
+		})
+		info.HasTags = info.HasTags || tag(&t) != ""
+	}
+	return info, nil
+}
+
+func (b *Backend) Reload(ctx context.Context, r *pb.Empty) (*pb.Empty, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.next != nil {
+		b.trees, b.next = b.next, nil
+	}
+	b.indexTime = time.Now()
+	b.reloads++
+	return &pb.Empty{}, nil
+}
+
+func (b *Backend) Search(ctx context.Context, q *pb.Query) (*pb.CodeSearchResult, error) {
+	start := time.Now()
+	m, err := compile(q)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err.Error())
+	}
+
+	b.mu.Lock()
+	trees := b.trees
+	reply := &pb.CodeSearchResult{IndexName: b.name, IndexTime: b.indexTime.Unix()}
+	b.mu.Unlock()
+
+	stats := &pb.SearchStats{}
+	reply.Stats = stats
+	full := func() bool {
+		if q.MaxMatches > 0 && int32(len(reply.Results)+len(reply.FileResults)) >= q.MaxMatches {
+			stats.ExitReason = pb.SearchStats_MATCH_LIMIT
+			return true
+		}
+		return false
+	}
+
+search:
+	for i := range trees {
+		t := &trees[i]
+		if !m.tree(t, q) {
+			continue
+		}
+		for _, path := range sortedPaths(t.Files) {
+			if !m.file(path) {
+				continue
+			}
+			if q.FilenameOnly {
+				if loc := m.line.FindStringIndex(path); loc != nil {
+					if full() {
+						break search
+					}
+					reply.FileResults = append(reply.FileResults, &pb.FileResult{
+						Tree:    t.Name,
+						Version: t.Version,
+						Path:    path,
+						Bounds:  bounds(path, loc),
+					})
+				}
+				continue
+			}
+			lines := strings.Split(strings.TrimSuffix(t.Files[path], "\n"), "\n")
+			for lno, line := range lines {
+				loc := m.line.FindStringIndex(line)
+				if loc == nil {
+					continue
+				}
+				if full() {
+					break search
+				}
+				reply.Results = append(reply.Results, &pb.SearchResult{
+					Tree:          t.Name,
+					Version:       t.Version,
+					Path:          path,
+					LineNumber:    int64(lno + 1),
+					ContextBefore: contextLines(lines, lno, -1, int(q.ContextLines)),
+					ContextAfter:  contextLines(lines, lno, 1, int(q.ContextLines)),
+					Bounds:        bounds(line, loc),
+					Line:          line,
+				})
+			}
+		}
+	}
+	stats.TotalTime = int64(time.Since(start) / time.Millisecond)
+	return reply, nil
+}
+
+// A matcher is a compiled query.
+type matcher struct {
+	line, repo, notRepo *regexp.Regexp
+	files, notFiles     []*regexp.Regexp
+}
+
+func compile(q *pb.Query) (*matcher, error) {
+	var m matcher
+	var err error
+	re := func(pat string, fold bool) (*regexp.Regexp, error) {
+		if fold {
+			pat = "(?i)" + pat
+		}
+		return regexp.Compile(pat)
+	}
+	if m.line, err = re(q.Line, q.FoldCase); err != nil {
+		return nil, err
+	}
+	if q.Repo != "" {
+		if m.repo, err = re(q.Repo, false); err != nil {
+			return nil, err
+		}
+	}
+	if q.NotRepo != "" {
+		if m.notRepo, err = re(q.NotRepo, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, list := range []struct {
+		pats []string
+		out  *[]*regexp.Regexp
+	}{{q.File, &m.files}, {q.NotFile, &m.notFiles}} {
+		for _, p := range list.pats {
+			r, err := re(p, false)
+			if err != nil {
+				return nil, err
+			}
+			*list.out = append(*list.out, r)
+		}
+	}
+	return &m, nil
+}
+
+// tree reports whether q searches t. As in codesearch, trees indexed
+// for a tag are only searched when q asks for a version.
+func (m *matcher) tree(t *Tree, q *pb.Query) bool {
+	if m.repo != nil && !m.repo.MatchString(t.Name) {
+		return false
+	}
+	if m.notRepo != nil && m.notRepo.MatchString(t.Name) {
+		return false
+	}
+	if q.Version == "" && tag(t) != "" {
+		return false
+	}
+	if q.Version != "" && q.Version != t.Version && q.Version != tag(t) {
+		return false
+	}
+	labels := map[string]string{}
+	if t.Metadata != nil {
+		for _, l := range t.Metadata.Labels {
+			labels[l] = ""
+		}
+		for k, v := range t.Metadata.LabelMap {
+			labels[k] = v
+		}
+	}
+	for _, l := range q.Labels {
+		if !hasLabel(labels, l) {
+			return false
+		}
+	}
+	for _, l := range q.NotLabels {
+		if hasLabel(labels, l) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *matcher) file(path string) bool {
+	for _, r := range m.files {
+		if !r.MatchString(path) {
+			return false
+		}
+	}
+	for _, r := range m.notFiles {
+		if r.MatchString(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasLabel reports whether labels has label, a "key=value" or a "key"
+// that may have any value.
+func hasLabel(labels map[string]string, label string) bool {
+	if i := strings.Index(label, "="); i >= 0 {
+		v, ok := labels[label[:i]]
+		return ok && v == label[i+1:]
+	}
+	_, ok := labels[label]
+	return ok
+}
+
+func sortedPaths(files map[string]string) []string {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func tag(t *Tree) string {
+	if t.Metadata == nil {
+		return ""
+	}
+	return t.Metadata.Tag
+}
+
+// bounds converts loc, the byte offsets of a match in s, to the
+// character offsets codesearch reports.
+func bounds(s string, loc []int) *pb.Bounds {
+	return &pb.Bounds{
+		Left:  int32(utf8.RuneCountInString(s[:loc[0]])),
+		Right: int32(utf8.RuneCountInString(s[:loc[1]])),
+	}
+}
+
+// contextLines returns up to n lines before (dir -1) or after (dir 1)
+// line lno of lines, nearest first, as codesearch does.
+func contextLines(lines []string, lno, dir, n int) []string {
+	var out []string
+	for i := lno + dir; len(out) < n && i >= 0 && i < len(lines); i += dir {
+		out = append(out, lines[i])
+	}
+	return out
+}
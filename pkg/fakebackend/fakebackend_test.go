@@ -0,0 +1,130 @@
+package fakebackend
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func testBackend() *Backend {
+	return New("test",
+		Tree{
+			Name:     "org/a",
+			Version:  "main",
+			Metadata: &config.Metadata{LabelMap: map[string]string{"team": "search"}},
+			Files: map[string]string{
+				"main.go":      "package main\n\nfunc main() {\n\tMain()\n}\n",
+				"main_test.go": "package main\n",
+			},
+		},
+		Tree{
+			Name:     "org/a",
+			Version:  "v1",
+			Metadata: &config.Metadata{Tag: "v1"},
+			Files:    map[string]string{"main.go": "func main() {}\n"},
+		},
+		Tree{
+			Name:    "org/b",
+			Version: "main",
+			Files:   map[string]string{"README": "main\n"},
+		},
+	)
+}
+
+type hit struct {
+	tree, version, path string
+	lno                 int64
+}
+
+func hits(reply *pb.CodeSearchResult) []hit {
+	var out []hit
+	for _, r := range reply.Results {
+		out = append(out, hit{r.Tree, r.Version, r.Path, r.LineNumber})
+	}
+	for _, r := range reply.FileResults {
+		out = append(out, hit{r.Tree, r.Version, r.Path, 0})
+	}
+	return out
+}
+
+func TestSearch(t *testing.T) {
+	b := testBackend()
+	cases := []struct {
+		name string
+		q    pb.Query
+		want []hit
+	}{
+		{"line", pb.Query{Line: `func main`}, []hit{{"org/a", "main", "main.go", 3}}},
+		{"fold case", pb.Query{Line: `main\(`, FoldCase: true}, []hit{
+			{"org/a", "main", "main.go", 3},
+			{"org/a", "main", "main.go", 4},
+		}},
+		{"file", pb.Query{Line: `package`, File: []string{`_test`}}, []hit{{"org/a", "main", "main_test.go", 1}}},
+		{"not file", pb.Query{Line: `package`, NotFile: []string{`_test`}}, []hit{{"org/a", "main", "main.go", 1}}},
+		{"repo", pb.Query{Line: `main`, Repo: `b$`}, []hit{{"org/b", "main", "README", 1}}},
+		{"label", pb.Query{Line: `package`, Labels: []string{"team=search"}}, []hit{
+			{"org/a", "main", "main.go", 1},
+			{"org/a", "main", "main_test.go", 1},
+		}},
+		{"not label", pb.Query{Line: `^main`, NotLabels: []string{"team"}}, []hit{{"org/b", "main", "README", 1}}},
+		{"version", pb.Query{Line: `func`, Version: "v1"}, []hit{{"org/a", "v1", "main.go", 1}}},
+		{"filename", pb.Query{Line: `test`, FilenameOnly: true}, []hit{{"org/a", "main", "main_test.go", 0}}},
+		{"max matches", pb.Query{Line: `main`, MaxMatches: 1}, []hit{{"org/a", "main", "main.go", 1}}},
+	}
+	for _, tc := range cases {
+		reply, err := b.Search(context.Background(), &tc.q)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := hits(reply); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSearchResult(t *testing.T) {
+	reply, err := testBackend().Search(context.Background(), &pb.Query{Line: `Main`, ContextLines: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Results) != 1 {
+		t.Fatalf("got %d results", len(reply.Results))
+	}
+	r := reply.Results[0]
+	if r.Line != "\tMain()" || r.Bounds.Left != 1 || r.Bounds.Right != 5 {
+		t.Errorf("line %q, bounds %v", r.Line, r.Bounds)
+	}
+	if want := []string{"func main() {", ""}; !reflect.DeepEqual(r.ContextBefore, want) {
+		t.Errorf("context before: got %q, want %q", r.ContextBefore, want)
+	}
+	if want := []string{"}"}; !reflect.DeepEqual(r.ContextAfter, want) {
+		t.Errorf("context after: got %q, want %q", r.ContextAfter, want)
+	}
+	if reply.Stats.ExitReason != pb.SearchStats_NONE {
+		t.Errorf("exit reason %v", reply.Stats.ExitReason)
+	}
+}
+
+func TestSearchBadRegex(t *testing.T) {
+	if _, err := testBackend().Search(context.Background(), &pb.Query{Line: `(`}); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestReload(t *testing.T) {
+	b := testBackend()
+	b.SetTrees(Tree{Name: "org/c", Version: "main"})
+	info, _ := b.Info(context.Background(), &pb.InfoRequest{})
+	if len(info.Trees) != 3 || !info.HasTags {
+		t.Errorf("before reload: %d trees, has tags %v", len(info.Trees), info.HasTags)
+	}
+	b.Reload(context.Background(), &pb.Empty{})
+	info, _ = b.Info(context.Background(), &pb.InfoRequest{})
+	if len(info.Trees) != 1 || info.Trees[0].Name != "org/c" || b.Reloads() != 1 {
+		t.Errorf("after reload: %v, %d reloads", info.Trees, b.Reloads())
+	}
+}
@@ -0,0 +1,272 @@
+// Package githubapp authenticates to GitHub as an installation of a
+// GitHub App, rather than with a personal access token, so that
+// indexing doesn't depend on any one person's account.
+//
+// An App signs short-lived JWTs with its private key to call the app
+// endpoints of the API, which exchange them for installation access
+// tokens. Those last an hour, and a TokenSource replaces each well
+// before it expires.
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultBaseURL is the API of github.com.
+const DefaultBaseURL = "https://api.github.com/"
+
+// refreshMargin is how long before an installation token expires that
+// a TokenSource replaces it, so that a clone started with it has time
+// to finish.
+const refreshMargin = 10 * time.Minute
+
+// An App is a GitHub App, which can act as any of its installations.
+type App struct {
+	ID  int64
+	Key *rsa.PrivateKey
+	// The API to call, ending in "/"; DefaultBaseURL if empty
+	BaseURL string
+	// The client to call it with; http.DefaultClient if nil
+	Client *http.Client
+
+	now func() time.Time
+}
+
+// An Installation is where an App is installed: on an organization's
+// or a user's account.
+type Installation struct {
+	ID      int64 `json:"id"`
+	Account struct {
+		Login string `json:"login"`
+	} `json:"account"`
+}
+
+// LoadKey reads the PEM private key GitHub generates for an App.
+func LoadKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM private key", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA private key", path)
+	}
+	return key, nil
+}
+
+func (a *App) time() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+// JWT returns a token authenticating as the app itself, good for a few
+// minutes. It is backdated a minute, as GitHub suggests, in case our
+// clock is ahead of GitHub's.
+func (a *App) JWT() (string, error) {
+	now := a.time()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": fmt.Sprint(a.ID),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.Key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// call makes an API request as the app, decoding the reply into out. It
+// returns errNotFound for a 404.
+func (a *App) call(ctx context.Context, method, path string, out interface{}) error {
+	jwt, err := a.JWT()
+	if err != nil {
+		return err
+	}
+	base := a.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+	req, err := http.NewRequest(method, base+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == 404 {
+		return errNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &e)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, e.Message)
+	}
+	return json.Unmarshal(body, out)
+}
+
+var errNotFound = errors.New("not found")
+
+// Installations lists the app's installations.
+func (a *App) Installations(ctx context.Context) ([]Installation, error) {
+	var all []Installation
+	for page := 1; ; page++ {
+		var batch []Installation
+		if err := a.call(ctx, "GET", fmt.Sprintf("app/installations?per_page=100&page=%d", page), &batch); err != nil {
+			return nil, err
+		}
+		all = append(all, batch...)
+		if len(batch) < 100 {
+			return all, nil
+		}
+	}
+}
+
+// FindInstallation returns the ID of the app's installation on owner, an
+// organization or a user, or, if owner is "", of its only installation.
+func (a *App) FindInstallation(ctx context.Context, owner string) (int64, error) {
+	if owner == "" {
+		installs, err := a.Installations(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if len(installs) != 1 {
+			return 0, fmt.Errorf("app %d has %d installations; say which to use", a.ID, len(installs))
+		}
+		return installs[0].ID, nil
+	}
+	var inst Installation
+	err := a.call(ctx, "GET", "orgs/"+owner+"/installation", &inst)
+	if err == errNotFound {
+		err = a.call(ctx, "GET", "users/"+owner+"/installation", &inst)
+	}
+	if err == errNotFound {
+		return 0, fmt.Errorf("app %d isn't installed on %s", a.ID, owner)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return inst.ID, nil
+}
+
+// NewToken creates an access token for the installation, returning it
+// and when it expires.
+func (a *App) NewToken(ctx context.Context, installation int64) (string, time.Time, error) {
+	var tok struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	path := fmt.Sprintf("app/installations/%d/access_tokens", installation)
+	if err := a.call(ctx, "POST", path, &tok); err != nil {
+		if err == errNotFound {
+			return "", time.Time{}, fmt.Errorf("app %d has no installation %d", a.ID, installation)
+		}
+		return "", time.Time{}, err
+	}
+	if tok.Token == "" {
+		return "", time.Time{}, fmt.Errorf("%s: no token in the reply", path)
+	}
+	return tok.Token, tok.ExpiresAt, nil
+}
+
+// A TokenSource hands out an installation's access token, creating a
+// new one when the last is within refreshMargin of expiring. It is safe
+// to use from several goroutines.
+type TokenSource struct {
+	app          *App
+	installation int64
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// TokenSource returns a TokenSource for the installation.
+func (a *App) TokenSource(installation int64) *TokenSource {
+	return &TokenSource{app: a, installation: installation}
+}
+
+// Token returns a current access token and when it expires.
+func (ts *TokenSource) Token(ctx context.Context) (string, time.Time, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && ts.app.time().Add(refreshMargin).Before(ts.expires) {
+		return ts.token, ts.expires, nil
+	}
+	token, expires, err := ts.app.NewToken(ctx, ts.installation)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	ts.token, ts.expires = token, expires
+	return token, expires, nil
+}
+
+// WriteFile writes a current access token to path, readable only by
+// us, for git to clone with. The file is replaced, rather than
+// rewritten, so that nothing reads half a token.
+func (ts *TokenSource) WriteFile(ctx context.Context, path string) error {
+	token, _, err := ts.Token(ctx)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".token-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(token + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
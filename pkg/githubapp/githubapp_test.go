@@ -0,0 +1,186 @@
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeGithub serves the app endpoints, checking each JWT against key,
+// and returns how many tokens it has handed out.
+func fakeGithub(key *rsa.PrivateKey, now func() time.Time) (*httptest.Server, *int32) {
+	var issued int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/app/installations/7/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method", 405)
+			return
+		}
+		n := atomic.AddInt32(&issued, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      fmt.Sprintf("ghs_%d", n),
+			"expires_at": now().Add(time.Hour),
+		})
+	})
+	mux.HandleFunc("/orgs/acme/installation", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": 7, "account": {"login": "acme"}}`)
+	})
+	mux.HandleFunc("/users/alice/installation", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": 8, "account": {"login": "alice"}}`)
+	})
+	mux.HandleFunc("/app/installations", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id": 7, "account": {"login": "acme"}}]`)
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			http.Error(w, `{"message": "no JWT"}`, 401)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+			http.Error(w, `{"message": "bad signature"}`, 401)
+			return
+		}
+		var claims struct {
+			Iss string `json:"iss"`
+			Exp int64  `json:"exp"`
+		}
+		body, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(body, &claims)
+		if claims.Iss != "42" || claims.Exp <= now().Unix() {
+			http.Error(w, `{"message": "bad claims"}`, 401)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return srv, &issued
+}
+
+func TestTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	clock := func() time.Time { return now }
+	srv, issued := fakeGithub(key, clock)
+	defer srv.Close()
+	app := &App{ID: 42, Key: key, BaseURL: srv.URL + "/", now: clock}
+
+	ts := app.TokenSource(7)
+	tok, _, err := ts.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok != "ghs_1" {
+		t.Errorf("token = %q, want ghs_1", tok)
+	}
+	now = now.Add(45 * time.Minute)
+	if tok, _, _ = ts.Token(context.Background()); tok != "ghs_1" {
+		t.Errorf("token 45m in = %q, want the first still", tok)
+	}
+	now = now.Add(10 * time.Minute)
+	if tok, _, _ = ts.Token(context.Background()); tok != "ghs_2" {
+		t.Errorf("token 5m before expiry = %q, want a new one", tok)
+	}
+	if n := atomic.LoadInt32(issued); n != 2 {
+		t.Errorf("%d tokens issued, want 2", n)
+	}
+
+	dir, err := ioutil.TempDir("", "githubapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	if err := ts.WriteFile(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "ghs_2\n" {
+		t.Errorf("token file holds %q", data)
+	}
+	if st, _ := os.Stat(path); st.Mode().Perm() != 0600 {
+		t.Errorf("token file mode = %s", st.Mode())
+	}
+
+	if _, _, err := app.NewToken(context.Background(), 9); err == nil {
+		t.Error("token for a missing installation")
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bad := &App{ID: 42, Key: other, BaseURL: srv.URL + "/", now: clock}
+	if _, _, err := bad.NewToken(context.Background(), 7); err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Errorf("token with the wrong key: %v", err)
+	}
+}
+
+func TestFindInstallation(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := fakeGithub(key, time.Now)
+	defer srv.Close()
+	app := &App{ID: 42, Key: key, BaseURL: srv.URL + "/"}
+
+	for owner, want := range map[string]int64{"acme": 7, "alice": 8, "": 7} {
+		id, err := app.FindInstallation(context.Background(), owner)
+		if err != nil {
+			t.Errorf("FindInstallation(%q): %v", owner, err)
+		} else if id != want {
+			t.Errorf("FindInstallation(%q) = %d, want %d", owner, id, want)
+		}
+	}
+	if _, err := app.FindInstallation(context.Background(), "nobody"); err == nil {
+		t.Error("found an installation on an account without one")
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "githubapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	for name, block := range map[string]*pem.Block{
+		"pkcs1.pem": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		"pkcs8.pem": {Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+		got, err := LoadKey(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if got.N.Cmp(key.N) != 0 {
+			t.Errorf("%s: loaded a different key", name)
+		}
+	}
+	path := filepath.Join(dir, "junk.pem")
+	ioutil.WriteFile(path, []byte("not a key"), 0600)
+	if _, err := LoadKey(path); err == nil {
+		t.Error("loaded a key from junk")
+	}
+}
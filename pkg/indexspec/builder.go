@@ -0,0 +1,271 @@
+package indexspec
+
+import (
+	"strings"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// A Builder assembles an IndexSpec, for discovery scripts that generate
+// configs:
+//
+//	spec, err := indexspec.NewBuilder("github.com/org").
+//		Repo("org/a", "repos/org/a").Revisions("main").Remote(url).
+//		Label("team", "search").
+//		Repo("org/b", "repos/org/b").Revisions("HEAD").Depth(1).
+//		Build()
+//
+// Each method sets one field and returns the builder, and Repo and Path
+// start a new entry, which the methods of the entry set until the next.
+type Builder struct {
+	spec *config.IndexSpec
+}
+
+// NewBuilder starts an IndexSpec with the given name.
+func NewBuilder(name string) *Builder {
+	return &Builder{spec: &config.IndexSpec{Name: name}}
+}
+
+// Spec returns the spec built so far, without validating it. Later
+// calls to the builder go on changing it.
+func (b *Builder) Spec() *config.IndexSpec {
+	return b.spec
+}
+
+// Build validates the spec, returning it, or the problems Validate
+// finds with it as a ValidationError.
+func (b *Builder) Build() (*config.IndexSpec, error) {
+	if problems := Validate(b.spec); len(problems) > 0 {
+		return nil, ValidationError(problems)
+	}
+	return b.spec, nil
+}
+
+// Marshal validates the spec, as Build does, and serializes it.
+func (b *Builder) Marshal(format Format) ([]byte, error) {
+	spec, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return Marshal(spec, format)
+}
+
+// IndexOnlyExtensions and SkipExtensions set the extension filters of
+// the whole index.
+func (b *Builder) IndexOnlyExtensions(exts ...string) *Builder {
+	b.spec.IndexOnlyExtensions = append(b.spec.IndexOnlyExtensions, exts...)
+	return b
+}
+
+func (b *Builder) SkipExtensions(exts ...string) *Builder {
+	b.spec.SkipExtensions = append(b.spec.SkipExtensions, exts...)
+	return b
+}
+
+// Path adds a directory to index as the tree name.
+func (b *Builder) Path(name, path string) *PathBuilder {
+	p := &config.PathSpec{Name: name, Path: path}
+	b.spec.Paths = append(b.spec.Paths, p)
+	return &PathBuilder{Builder: b, path: p}
+}
+
+// Repo adds the git repository at path, cloned there if it has a
+// remote, to index as the tree name.
+func (b *Builder) Repo(name, path string) *RepoBuilder {
+	r := &config.RepoSpec{Name: name, Path: path}
+	b.spec.Repositories = append(b.spec.Repositories, r)
+	return &RepoBuilder{Builder: b, repo: r}
+}
+
+// A ValidationError is the problems Validate found with a spec.
+type ValidationError []Problem
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, p := range e {
+		msgs[i] = p.String()
+	}
+	return "invalid index spec: " + strings.Join(msgs, "; ")
+}
+
+// A PathBuilder sets the fields of the PathSpec most recently added to
+// its Builder.
+type PathBuilder struct {
+	*Builder
+	path *config.PathSpec
+}
+
+// OrderedContents sets the file listing the path's files, in the order
+// to index them.
+func (p *PathBuilder) OrderedContents(file string) *PathBuilder {
+	p.path.OrderedContents = file
+	return p
+}
+
+// URLPattern sets the pattern of links to the path's files.
+func (p *PathBuilder) URLPattern(pattern string) *PathBuilder {
+	p.metadata().UrlPattern = pattern
+	return p
+}
+
+// Label adds a metadata label.
+func (p *PathBuilder) Label(key, value string) *PathBuilder {
+	m := p.metadata()
+	if m.LabelMap == nil {
+		m.LabelMap = map[string]string{}
+	}
+	m.LabelMap[key] = value
+	return p
+}
+
+// Symlinks sets how the path's symlinks are indexed: "follow",
+// "link_text" or "skip".
+func (p *PathBuilder) Symlinks(policy string) *PathBuilder {
+	p.path.Symlinks = policy
+	return p
+}
+
+func (p *PathBuilder) metadata() *config.Metadata {
+	if p.path.Metadata == nil {
+		p.path.Metadata = &config.Metadata{}
+	}
+	return p.path.Metadata
+}
+
+// A RepoBuilder sets the fields of the RepoSpec most recently added to
+// its Builder.
+type RepoBuilder struct {
+	*Builder
+	repo *config.RepoSpec
+}
+
+// Revisions adds revisions to index: branches, tags, commits or globs.
+func (r *RepoBuilder) Revisions(revs ...string) *RepoBuilder {
+	r.repo.Revisions = append(r.repo.Revisions, revs...)
+	return r
+}
+
+// Alias indexes the latest ref matching glob, such as
+// "refs/tags/v2.*", as the revision alias.
+func (r *RepoBuilder) Alias(alias, glob string) *RepoBuilder {
+	if r.repo.RevisionAliases == nil {
+		r.repo.RevisionAliases = map[string]string{}
+	}
+	r.repo.RevisionAliases[alias] = glob
+	r.repo.Revisions = append(r.repo.Revisions, alias)
+	return r
+}
+
+// TagHistory also indexes the latest count tags matching pattern.
+func (r *RepoBuilder) TagHistory(pattern string, count int) *RepoBuilder {
+	r.repo.TagHistory = &config.TagHistory{Pattern: pattern, Count: int32(count)}
+	return r
+}
+
+// Remote sets the URL the repository is cloned and fetched from.
+func (r *RepoBuilder) Remote(url string) *RepoBuilder {
+	r.metadata().Remote = url
+	return r
+}
+
+// WebURL sets the repository's home page on its code host, which links
+// to its files are made from.
+func (r *RepoBuilder) WebURL(url string) *RepoBuilder {
+	r.metadata().WebUrl = url
+	return r
+}
+
+// URLPattern sets the pattern of links to the repository's files.
+func (r *RepoBuilder) URLPattern(pattern string) *RepoBuilder {
+	r.metadata().UrlPattern = pattern
+	return r
+}
+
+// LinkRevision sets whether links are made at the indexed "commit" or
+// the "branch".
+func (r *RepoBuilder) LinkRevision(rev string) *RepoBuilder {
+	r.metadata().LinkRevision = rev
+	return r
+}
+
+// Label adds a metadata label.
+func (r *RepoBuilder) Label(key, value string) *RepoBuilder {
+	m := r.metadata()
+	if m.LabelMap == nil {
+		m.LabelMap = map[string]string{}
+	}
+	m.LabelMap[key] = value
+	return r
+}
+
+// Depth makes clones shallow, of depth commits.
+func (r *RepoBuilder) Depth(depth int) *RepoBuilder {
+	r.cloneOptions().Depth = int32(depth)
+	return r
+}
+
+// Filter makes clones partial, without the blobs filter leaves out;
+// see CloneOptions.filter.
+func (r *RepoBuilder) Filter(filter string) *RepoBuilder {
+	r.cloneOptions().Filter = filter
+	return r
+}
+
+// Credentials sets the username to clone with, and the environment
+// variable holding the password.
+func (r *RepoBuilder) Credentials(username, passwordEnv string) *RepoBuilder {
+	c := r.cloneOptions()
+	c.Username, c.PasswordEnv = username, passwordEnv
+	return r
+}
+
+// WalkSubmodules indexes the repository's submodules too.
+func (r *RepoBuilder) WalkSubmodules() *RepoBuilder {
+	r.repo.WalkSubmodules = true
+	return r
+}
+
+// Include restricts the repository to files matching globs; Exclude
+// leaves out those matching globs.
+func (r *RepoBuilder) Include(globs ...string) *RepoBuilder {
+	r.repo.FileIncludes = append(r.repo.FileIncludes, globs...)
+	return r
+}
+
+func (r *RepoBuilder) Exclude(globs ...string) *RepoBuilder {
+	r.repo.FileExcludes = append(r.repo.FileExcludes, globs...)
+	return r
+}
+
+// IndexOnlyExtensions and SkipExtensions set the repository's own
+// extension filters: its index_only_extensions replace those of the
+// index, and its skip_extensions add to them.
+func (r *RepoBuilder) IndexOnlyExtensions(exts ...string) *RepoBuilder {
+	r.repo.IndexOnlyExtensions = append(r.repo.IndexOnlyExtensions, exts...)
+	return r
+}
+
+func (r *RepoBuilder) SkipExtensions(exts ...string) *RepoBuilder {
+	r.repo.SkipExtensions = append(r.repo.SkipExtensions, exts...)
+	return r
+}
+
+// MaxFileSize leaves out files larger than size bytes.
+func (r *RepoBuilder) MaxFileSize(size int64) *RepoBuilder {
+	r.repo.MaxFileSize = size
+	return r
+}
+
+func (r *RepoBuilder) metadata() *config.Metadata {
+	if r.repo.Metadata == nil {
+		r.repo.Metadata = &config.Metadata{}
+	}
+	return r.repo.Metadata
+}
+
+func (r *RepoBuilder) cloneOptions() *config.CloneOptions {
+	if r.repo.CloneOptions == nil {
+		r.repo.CloneOptions = &config.CloneOptions{}
+	}
+	return r.repo.CloneOptions
+}
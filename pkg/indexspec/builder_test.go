@@ -0,0 +1,79 @@
+package indexspec
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+func TestBuilder(t *testing.T) {
+	spec, err := NewBuilder("github.com/org").
+		SkipExtensions(".min.js").
+		Repo("org/a", "repos/org/a").Revisions("main").Alias("stable", "refs/tags/v*").
+		Remote("https://github.com/org/a.git").Label("team", "search").Depth(1).
+		Repo("org/b", "repos/org/b").Revisions("HEAD").Exclude("vendor/**").
+		Path("docs", "/srv/docs").URLPattern("https://docs.example.com/{path}").
+		Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	want := &config.IndexSpec{
+		Name:           "github.com/org",
+		SkipExtensions: []string{".min.js"},
+		Repositories: []*config.RepoSpec{
+			{
+				Name:            "org/a",
+				Path:            "repos/org/a",
+				Revisions:       []string{"main", "stable"},
+				RevisionAliases: map[string]string{"stable": "refs/tags/v*"},
+				Metadata: &config.Metadata{
+					Remote:   "https://github.com/org/a.git",
+					LabelMap: map[string]string{"team": "search"},
+				},
+				CloneOptions: &config.CloneOptions{Depth: 1},
+			},
+			{
+				Name:         "org/b",
+				Path:         "repos/org/b",
+				Revisions:    []string{"HEAD"},
+				FileExcludes: []string{"vendor/**"},
+			},
+		},
+		Paths: []*config.PathSpec{{
+			Name:     "docs",
+			Path:     "/srv/docs",
+			Metadata: &config.Metadata{UrlPattern: "https://docs.example.com/{path}"},
+		}},
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("Build:\ngot  %+v\nwant %+v", spec, want)
+	}
+}
+
+func TestBuilderValidates(t *testing.T) {
+	_, err := NewBuilder("x").Repo("org/a", "repos/org/a").Build()
+	verr, ok := err.(ValidationError)
+	if !ok || len(verr) != 1 || !strings.Contains(err.Error(), "repositories[0] (org/a): no revisions to index") {
+		t.Errorf("Build: got %v", err)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	repo := NewBuilder("x").Repo("org/a", "repos/org/a").Revisions("main").
+		Credentials("bot", "GIT_TOKEN").Label("team", "search").repo
+	for _, format := range []Format{JSON, YAML} {
+		data, err := MarshalMessage(repo, format)
+		if err != nil {
+			t.Fatalf("%s: MarshalMessage: %v", format, err)
+		}
+		var got config.RepoSpec
+		if err := UnmarshalMessage(data, format, &got); err != nil {
+			t.Fatalf("%s: UnmarshalMessage: %v", format, err)
+		}
+		if !reflect.DeepEqual(&got, repo) {
+			t.Errorf("%s: round trip:\ngot  %+v\nwant %+v", format, &got, repo)
+		}
+	}
+}
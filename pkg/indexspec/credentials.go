@@ -0,0 +1,41 @@
+package indexspec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// Password returns the clone password configured by c, read from the
+// environment variable named by password_env, the file named by
+// password_file, or the output of password_command, whichever is set.
+// Trailing newlines are stripped from file contents and command output.
+// It returns "" if c configures no password.
+func Password(c *config.CloneOptions) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	switch {
+	case c.PasswordEnv != "":
+		return os.Getenv(c.PasswordEnv), nil
+	case c.PasswordFile != "":
+		data, err := ioutil.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("password_file: %s", err.Error())
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case c.PasswordCommand != "":
+		cmd := exec.Command("/bin/sh", "-c", c.PasswordCommand)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("password_command: %s", err.Error())
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,39 @@
+package indexspec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+func TestPassword(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"secret": "hunter2\n"})
+	defer os.RemoveAll(dir)
+	os.Setenv("LIVEGREP_TEST_PASSWORD", "from-env")
+	defer os.Unsetenv("LIVEGREP_TEST_PASSWORD")
+
+	cases := []struct {
+		opts *config.CloneOptions
+		want string
+	}{
+		{nil, ""},
+		{&config.CloneOptions{Username: "git"}, ""},
+		{&config.CloneOptions{PasswordEnv: "LIVEGREP_TEST_PASSWORD"}, "from-env"},
+		{&config.CloneOptions{PasswordFile: filepath.Join(dir, "secret")}, "hunter2"},
+		{&config.CloneOptions{PasswordCommand: "echo from-command"}, "from-command"},
+	}
+	for _, tc := range cases {
+		got, err := Password(tc.opts)
+		if err != nil {
+			t.Errorf("Password(%v): %v", tc.opts, err)
+		} else if got != tc.want {
+			t.Errorf("Password(%v): got %q, want %q", tc.opts, got, tc.want)
+		}
+	}
+
+	if _, err := Password(&config.CloneOptions{PasswordCommand: "exit 1"}); err == nil {
+		t.Errorf("expected an error from a failing password_command")
+	}
+}
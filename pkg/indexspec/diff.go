@@ -0,0 +1,162 @@
+package indexspec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// A SpecDiff describes how the repositories of an IndexSpec changed.
+type SpecDiff struct {
+	Added   []string     `json:"added"`
+	Removed []string     `json:"removed"`
+	Changed []RepoChange `json:"changed"`
+}
+
+// Empty reports whether the specs were equivalent.
+func (d *SpecDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// A RepoChange lists the fields that differ between two definitions of
+// the same repository.
+type RepoChange struct {
+	Name   string        `json:"name"`
+	Fields []FieldChange `json:"fields"`
+}
+
+// A FieldChange is a single changed field of a repository. Nested fields
+// are named by their dotted path, e.g. "metadata.remote"; a field that
+// was only set on one side has a nil Old or New.
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// Diff compares the repositories of two specs by name. Added and Removed
+// follow the order of the spec they appear in; Changed follows the order
+// of b.
+func Diff(a, b *config.IndexSpec) (*SpecDiff, error) {
+	old := map[string]map[string]interface{}{}
+	for _, r := range a.Repositories {
+		fields, err := flatten(r)
+		if err != nil {
+			return nil, err
+		}
+		old[r.Name] = fields
+	}
+
+	d := &SpecDiff{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []RepoChange{},
+	}
+	seen := map[string]bool{}
+	for _, r := range b.Repositories {
+		seen[r.Name] = true
+		fields, err := flatten(r)
+		if err != nil {
+			return nil, err
+		}
+		prev, ok := old[r.Name]
+		if !ok {
+			d.Added = append(d.Added, r.Name)
+			continue
+		}
+		if changes := diffFields(prev, fields); len(changes) > 0 {
+			d.Changed = append(d.Changed, RepoChange{r.Name, changes})
+		}
+	}
+	for _, r := range a.Repositories {
+		if !seen[r.Name] {
+			d.Removed = append(d.Removed, r.Name)
+		}
+	}
+	return d, nil
+}
+
+// WriteText writes d in the form livegrep-config diff prints: a line
+// for each repository, prefixed with + if it was added, - if removed
+// or ~ if changed, followed by its changed fields.
+func (d *SpecDiff) WriteText(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	for _, name := range d.Added {
+		fmt.Fprintf(b, "+ %s\n", name)
+	}
+	for _, name := range d.Removed {
+		fmt.Fprintf(b, "- %s\n", name)
+	}
+	for _, c := range d.Changed {
+		fmt.Fprintf(b, "~ %s\n", c.Name)
+		for _, f := range c.Fields {
+			fmt.Fprintf(b, "    %s: %s -> %s\n", f.Field, showValue(f.Old), showValue(f.New))
+		}
+	}
+	return b.Flush()
+}
+
+func showValue(v interface{}) string {
+	if v == nil {
+		return "(unset)"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+func diffFields(a, b map[string]interface{}) []FieldChange {
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var changes []FieldChange
+	for _, k := range sorted {
+		if !reflect.DeepEqual(a[k], b[k]) {
+			changes = append(changes, FieldChange{k, a[k], b[k]})
+		}
+	}
+	return changes
+}
+
+// flatten returns the JSON fields of r, with nested objects expanded
+// into dotted keys.
+func flatten(r *config.RepoSpec) (map[string]interface{}, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{}
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			if sub, ok := v.(map[string]interface{}); ok {
+				walk(prefix+k+".", sub)
+				continue
+			}
+			out[prefix+k] = v
+		}
+	}
+	walk("", doc)
+	return out, nil
+}
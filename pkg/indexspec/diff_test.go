@@ -0,0 +1,62 @@
+package indexspec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	oldSpec, err := Unmarshal([]byte(`
+repositories:
+  - name: org/a
+    path: repos/org/a
+    revisions: [HEAD]
+    metadata: {remote: "git@example.com:org/a"}
+  - name: org/b
+    path: repos/org/b
+    revisions: [HEAD]
+  - name: org/c
+    path: repos/org/c
+    revisions: [HEAD]
+`), YAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSpec, err := Unmarshal([]byte(`
+repositories:
+  - name: org/d
+    path: repos/org/d
+    revisions: [HEAD]
+  - name: org/a
+    path: repos/org/a
+    revisions: [HEAD, release]
+    metadata: {remote: "https://example.com/org/a", label_map: {team: search}}
+  - name: org/b
+    path: repos/org/b
+    revisions: [HEAD]
+`), YAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := Diff(oldSpec, newSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &SpecDiff{
+		Added:   []string{"org/d"},
+		Removed: []string{"org/c"},
+		Changed: []RepoChange{{"org/a", []FieldChange{
+			{"metadata.label_map.team", nil, "search"},
+			{"metadata.remote", "git@example.com:org/a", "https://example.com/org/a"},
+			{"revisions", []interface{}{"HEAD"}, []interface{}{"HEAD", "release"}},
+		}}},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("Diff:\ngot:  %#v\nwant: %#v", d, want)
+	}
+
+	if d, _ := Diff(oldSpec, oldSpec); !d.Empty() {
+		t.Errorf("Diff of a spec with itself: got %#v", d)
+	}
+}
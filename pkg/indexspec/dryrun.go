@@ -0,0 +1,55 @@
+package indexspec
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// DryRun is -dry-run for the reindex tools: rather than writing spec to
+// path, it prints how spec differs from the config already there, if
+// any, and writes spec to out, if it is set, or prints it, if out is
+// "-". The diff goes to stderr when spec is printed, and to stdout
+// otherwise.
+func DryRun(path string, spec *config.IndexSpec, out string) error {
+	if out == "-" {
+		return dryRun(path, spec, out, os.Stdout, os.Stderr)
+	}
+	return dryRun(path, spec, out, nil, os.Stdout)
+}
+
+func dryRun(path string, spec *config.IndexSpec, out string, stdout, diffOut io.Writer) error {
+	previous := &config.IndexSpec{}
+	if _, err := os.Stat(path); err == nil {
+		if previous, err = Load(path); err != nil {
+			return fmt.Errorf("loading the previous config: %s", err.Error())
+		}
+	}
+	d, err := Diff(previous, spec)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(diffOut, "%s: %d repositories, %d added, %d removed, %d changed\n",
+		path, len(spec.Repositories), len(d.Added), len(d.Removed), len(d.Changed))
+	if err := d.WriteText(diffOut); err != nil {
+		return err
+	}
+
+	switch out {
+	case "":
+		return nil
+	case "-":
+		data, err := Marshal(spec, FormatForPath(path))
+		if err != nil {
+			return err
+		}
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		_, err = stdout.Write(data)
+		return err
+	}
+	return Write(out, spec)
+}
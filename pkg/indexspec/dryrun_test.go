@@ -0,0 +1,64 @@
+package indexspec
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "livegrep.json")
+	previous := NewBuilder("test")
+	previous.Repo("org/a", "repos/org/a").Revisions("HEAD")
+	previous.Repo("org/b", "repos/org/b").Revisions("HEAD")
+	if err := Write(path, previous.Spec()); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(path)
+
+	next := NewBuilder("test")
+	next.Repo("org/a", "repos/org/a").Revisions("HEAD", "release")
+	next.Repo("org/c", "repos/org/c").Revisions("HEAD")
+	spec := next.Spec()
+
+	var stdout, diff bytes.Buffer
+	if err := dryRun(path, spec, "-", &stdout, &diff); err != nil {
+		t.Fatal(err)
+	}
+	want := path + `: 2 repositories, 1 added, 1 removed, 1 changed
++ org/c
+- org/b
+~ org/a
+    revisions: ["HEAD"] -> ["HEAD","release"]
+`
+	if diff.String() != want {
+		t.Errorf("diff:\ngot:\n%s\nwant:\n%s", diff.String(), want)
+	}
+	printed, err := Unmarshal(stdout.Bytes(), JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := Diff(spec, printed); !d.Empty() {
+		t.Errorf("printed config differs: %#v", d)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("dry run changed the previous config")
+	}
+
+	// Written to a file, with no previous config to compare to.
+	out := filepath.Join(dir, "out.yaml")
+	diff.Reset()
+	if err := dryRun(filepath.Join(dir, "missing.json"), spec, out, nil, &diff); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Load(out); err != nil {
+		t.Fatal(err)
+	} else if d, _ := Diff(spec, got); !d.Empty() {
+		t.Errorf("written config differs: %#v", d)
+	}
+	if !bytes.Contains(diff.Bytes(), []byte("2 added, 0 removed")) {
+		t.Errorf("diff against no config:\n%s", diff.String())
+	}
+}
@@ -0,0 +1,78 @@
+package indexspec
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// expandKeys lists the config fields whose values undergo environment
+// variable expansion, wherever they appear in the document.
+var expandKeys = map[string]bool{
+	"path":          true,
+	"remote":        true,
+	"url_pattern":   true,
+	"password_env":  true,
+	"password_file": true,
+}
+
+var envRefRE = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// ExpandEnv expands ${VAR} and ${VAR:-default} references in s using the
+// process environment. A reference to an unset variable without a
+// default is an error, so that a config deployed to the wrong
+// environment fails loudly instead of indexing the wrong paths; use
+// ${VAR:-} to explicitly allow an empty value.
+func ExpandEnv(s string) (string, error) {
+	return expand(s, os.LookupEnv)
+}
+
+func expand(s string, lookup func(string) (string, bool)) (string, error) {
+	var err error
+	out := envRefRE.ReplaceAllStringFunc(s, func(ref string) string {
+		m := envRefRE.FindStringSubmatch(ref)
+		if v, ok := lookup(m[1]); ok && (v != "" || m[2] == "") {
+			return v
+		}
+		if m[2] != "" {
+			return strings.TrimPrefix(m[2], ":-")
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", m[1])
+		}
+		return ""
+	})
+	return out, err
+}
+
+// expandTree expands environment references in place in a decoded
+// config document.
+func expandTree(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if s, ok := e.(string); ok {
+				if !expandKeys[k] {
+					continue
+				}
+				x, err := ExpandEnv(s)
+				if err != nil {
+					return fmt.Errorf("%s: %s", k, err.Error())
+				}
+				v[k] = x
+				continue
+			}
+			if err := expandTree(e); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if err := expandTree(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
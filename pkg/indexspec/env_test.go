@@ -0,0 +1,44 @@
+package indexspec
+
+import "testing"
+
+func TestExpand(t *testing.T) {
+	env := map[string]string{
+		"DIR":   "/srv/repos",
+		"EMPTY": "",
+	}
+	lookup := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+
+	cases := []struct {
+		in  string
+		out string
+		err bool
+	}{
+		{"repos/a", "repos/a", false},
+		{"${DIR}/a", "/srv/repos/a", false},
+		{"${MISSING:-/tmp/repos}/a", "/tmp/repos/a", false},
+		{"${EMPTY:-fallback}", "fallback", false},
+		{"${EMPTY}", "", false},
+		{"${MISSING:-}", "", false},
+		{"${MISSING}/a", "", true},
+		{"$DIR/{name}", "$DIR/{name}", false},
+	}
+
+	for _, tc := range cases {
+		got, err := expand(tc.in, lookup)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expand(%q): expected error, got %q", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expand(%q): unexpected error: %v", tc.in, err)
+		} else if got != tc.out {
+			t.Errorf("expand(%q): got %q, want %q", tc.in, got, tc.out)
+		}
+	}
+}
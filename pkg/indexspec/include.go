@@ -0,0 +1,210 @@
+package indexspec
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// RenderFiles loads the configs at paths and merges them into a single
+// JSON IndexSpec.
+//
+// Each config may list other configs in its top-level "include" field;
+// include paths are relative to the including file and may be globs
+// (e.g. "teams/*.yaml"). Configs may also be remote URLs (see
+// readConfig), whose includes are resolved relative to their URL. The
+// name of the resulting index is taken from
+// the first config that sets one. The paths and repositories of every
+// config are concatenated in order; an entry whose name appears in more
+// than one file is an error unless every definition is identical.
+func RenderFiles(paths ...string) ([]byte, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no config files given")
+	}
+	m := &merger{
+		out:     map[string]interface{}{},
+		sources: map[string]string{},
+		loading: map[string]bool{},
+	}
+	for _, p := range paths {
+		if err := m.load(p); err != nil {
+			return nil, err
+		}
+	}
+	return json.MarshalIndent(m.out, "", "  ")
+}
+
+type merger struct {
+	out map[string]interface{}
+	// sources maps "<list>/<name>" to the file that first defined it
+	sources map[string]string
+	// loading holds the files currently being loaded, to detect cycles
+	loading map[string]bool
+}
+
+// mergedLists are the IndexSpec fields whose entries are combined
+// across files.
+var mergedLists = []string{"paths", "repositories"}
+
+func (m *merger) load(path string) error {
+	remote := IsRemote(path)
+	abs := path
+	if !remote {
+		var err error
+		if abs, err = filepath.Abs(path); err != nil {
+			return err
+		}
+	}
+	name := displayName(path)
+	if m.loading[abs] {
+		return fmt.Errorf("%s: include cycle", name)
+	}
+	m.loading[abs] = true
+	defer delete(m.loading, abs)
+
+	data, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	doc, err := decode(data, FormatForPath(path))
+	if err != nil {
+		return fmt.Errorf("reading %s: %s", name, err.Error())
+	}
+
+	includes, err := stringList(doc["include"])
+	if err != nil {
+		return fmt.Errorf("%s: include: %s", name, err.Error())
+	}
+	delete(doc, "include")
+
+	if err := m.merge(path, doc); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	for _, inc := range includes {
+		if remote || IsRemote(inc) {
+			if remote {
+				resolved, err := resolveInclude(path, inc)
+				if err != nil {
+					return fmt.Errorf("%s: include %s: %s", name, inc, err.Error())
+				}
+				inc = resolved
+			}
+			if err := m.load(inc); err != nil {
+				return err
+			}
+			continue
+		}
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(dir, inc)
+		}
+		matches, err := filepath.Glob(inc)
+		if err != nil {
+			return fmt.Errorf("%s: include %s: %s", path, inc, err.Error())
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("%s: include %s: no such file", path, inc)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			if err := m.load(match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *merger) merge(path string, doc map[string]interface{}) error {
+	if !IsRemote(path) {
+		rebaseOrderedContents(path, doc)
+	}
+	path = displayName(path)
+
+	for k, v := range doc {
+		if k == "paths" || k == "repositories" {
+			continue
+		}
+		if _, ok := m.out[k]; !ok {
+			m.out[k] = v
+		}
+	}
+
+	for _, list := range mergedLists {
+		v, ok := doc[list]
+		if !ok {
+			continue
+		}
+		entries, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %s: expected a list", path, list)
+		}
+		existing, _ := m.out[list].([]interface{})
+	Entries:
+		for _, e := range entries {
+			name := ""
+			if e, ok := e.(map[string]interface{}); ok {
+				name, _ = e["name"].(string)
+			}
+			if name != "" {
+				key := list + "/" + name
+				if first, ok := m.sources[key]; ok {
+					for _, prev := range existing {
+						if prev, ok := prev.(map[string]interface{}); ok && prev["name"] == name {
+							if reflect.DeepEqual(prev, e) {
+								continue Entries
+							}
+						}
+					}
+					return fmt.Errorf("%s: %s %q conflicts with the definition in %s", path, list, name, first)
+				}
+				m.sources[key] = path
+			}
+			existing = append(existing, e)
+		}
+		m.out[list] = existing
+	}
+	return nil
+}
+
+// rebaseOrderedContents makes the ordered_contents file of each path
+// spec absolute. codesearch resolves it relative to the config file it
+// is given, which for an included file is not the file it was written
+// in.
+func rebaseOrderedContents(path string, doc map[string]interface{}) {
+	specs, _ := doc["paths"].([]interface{})
+	for _, s := range specs {
+		s, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if oc, ok := s["ordered_contents"].(string); ok && oc != "" && !filepath.IsAbs(oc) {
+			if abs, err := filepath.Abs(filepath.Join(filepath.Dir(path), oc)); err == nil {
+				s["ordered_contents"] = abs
+			}
+		}
+	}
+}
+
+func stringList(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a list of paths")
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("expected a list of paths")
+}
@@ -0,0 +1,88 @@
+package indexspec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "indexspec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestIncludes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"livegrep.yaml": `
+name: company
+include: [teams/*.yaml]
+repositories:
+  - name: infra/ops
+    path: repos/infra/ops
+`,
+		"teams/payments.yaml": `
+name: ignored
+repositories:
+  - name: payments/api
+    path: repos/payments/api
+  - name: infra/ops
+    path: repos/infra/ops
+`,
+		"teams/search.json": `{"repositories": [{"name": "search/livegrep", "path": "repos/search/livegrep"}]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	spec, err := Load(filepath.Join(dir, "livegrep.yaml"), filepath.Join(dir, "teams/search.json"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if spec.Name != "company" {
+		t.Errorf("name: got %q, want the top-level config's name", spec.Name)
+	}
+	var names []string
+	for _, r := range spec.Repositories {
+		names = append(names, r.Name)
+	}
+	if got, want := strings.Join(names, ","), "infra/ops,payments/api,search/livegrep"; got != want {
+		t.Errorf("repositories: got %s, want %s", got, want)
+	}
+}
+
+func TestIncludeConflicts(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml": `
+include: [b.yaml]
+repositories:
+  - name: org/a
+    path: repos/org/a
+`,
+		"b.yaml": `
+repositories:
+  - name: org/a
+    path: elsewhere/org/a
+`,
+		"cycle.yaml": `include: [cycle.yaml]`,
+	})
+	defer os.RemoveAll(dir)
+
+	if _, err := Load(filepath.Join(dir, "a.yaml")); err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Errorf("expected a conflict error, got %v", err)
+	}
+	if _, err := Load(filepath.Join(dir, "cycle.yaml")); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+}
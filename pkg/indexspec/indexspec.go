@@ -0,0 +1,389 @@
+// Package indexspec reads and writes the IndexSpec configuration files
+// consumed by codesearch and the reindex tools.
+//
+// Configs may be written as JSON or YAML, may reference environment
+// variables, and may include other config files. codesearch itself only
+// understands a single plain JSON file, so configs are rendered (see
+// JSONFor) before being handed to it.
+package indexspec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+type Format int
+
+const (
+	JSON Format = iota
+	YAML
+)
+
+func (f Format) String() string {
+	if f == YAML {
+		return "yaml"
+	}
+	return "json"
+}
+
+// Ext returns the conventional file extension for the format.
+func (f Format) Ext() string {
+	if f == YAML {
+		return ".yaml"
+	}
+	return ".json"
+}
+
+// ParseFormat parses a format name as accepted on the command line.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "json":
+		return JSON, nil
+	case "yaml", "yml":
+		return YAML, nil
+	}
+	return JSON, fmt.Errorf("unknown config format %q (expected json or yaml)", name)
+}
+
+// FormatForPath guesses a config's format from its file extension,
+// defaulting to JSON.
+func FormatForPath(path string) Format {
+	if IsRemote(path) {
+		u, _ := url.Parse(path)
+		path = u.Path
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return YAML
+	}
+	return JSON
+}
+
+// Load reads and merges the IndexSpecs at paths, in the format implied
+// by each file's extension. See RenderFiles for how configs are
+// combined.
+func Load(paths ...string) (*config.IndexSpec, error) {
+	data, err := RenderFiles(paths...)
+	if err != nil {
+		return nil, err
+	}
+	var spec config.IndexSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// Unmarshal parses an IndexSpec in the given format, expanding
+// environment variable references (see ExpandEnv).
+func Unmarshal(data []byte, format Format) (*config.IndexSpec, error) {
+	data, err := Render(data, format)
+	if err != nil {
+		return nil, err
+	}
+	var spec config.IndexSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// Render converts a single config document in the given format into the
+// JSON that codesearch should see, with environment variable references
+// expanded. Configs that include other files must be rendered with
+// RenderFiles, so that the includes can be located.
+func Render(data []byte, format Format) ([]byte, error) {
+	doc, err := decode(data, format)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := doc["include"]; ok {
+		return nil, fmt.Errorf("include is only supported when loading config files")
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func decode(data []byte, format Format) (map[string]interface{}, error) {
+	doc, err := parse(data, format)
+	if err != nil {
+		return nil, err
+	}
+	if err := expandTree(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// parse decodes a config document without expanding environment
+// references.
+func parse(data []byte, format Format) (map[string]interface{}, error) {
+	var v interface{}
+	var err error
+	if format == YAML {
+		err = yaml.Unmarshal(data, &v)
+	} else {
+		err = decodeJSON(data, &v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v, err = jsonCompatible(v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return map[string]interface{}{}, nil
+	}
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a mapping at the top level of the config")
+	}
+	if p, ok := doc["fs_paths"]; ok {
+		// Both spellings are accepted by codesearch; normalize on
+		// the one encoding/json maps onto IndexSpec.Paths.
+		if _, dup := doc["paths"]; dup {
+			return nil, fmt.Errorf("cannot specify both fs_paths and paths")
+		}
+		doc["paths"] = p
+		delete(doc, "fs_paths")
+	}
+	return doc, nil
+}
+
+// decodeJSON decodes a JSON document as json.Unmarshal does, but keeps
+// numbers as json.Numbers, so that int64 fields too large for a float64,
+// such as commit_times, are rendered back out unchanged.
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	return nil
+}
+
+// Marshal serializes an IndexSpec in the given format.
+func Marshal(spec *config.IndexSpec, format Format) ([]byte, error) {
+	return MarshalMessage(spec, format)
+}
+
+// MarshalMessage serializes part of a config, such as a RepoSpec or
+// CloneOptions, in the given format, as Marshal does a whole IndexSpec.
+func MarshalMessage(msg interface{}, format Format) ([]byte, error) {
+	data, err := json.MarshalIndent(msg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if format == YAML {
+		return FromJSON(data, nil)
+	}
+	return data, nil
+}
+
+// UnmarshalMessage parses part of a config, such as one entry of
+// repositories, into msg, expanding environment variable references as
+// Unmarshal does.
+func UnmarshalMessage(data []byte, format Format, msg interface{}) error {
+	data, err := Render(data, format)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, msg)
+}
+
+// Write serializes spec to path in the format implied by its extension,
+// creating the parent directory if needed. When overwriting an existing
+// YAML config, its comments are preserved where the same keys and
+// repositories still exist.
+func Write(path string, spec *config.IndexSpec) error {
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if FormatForPath(path) == YAML {
+		previous, _ := ioutil.ReadFile(path)
+		if data, err = FromJSON(data, previous); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// JSONFor returns a path to a plain JSON rendering of spec, suitable for
+// passing to codesearch. The rendering is written to a temporary file in
+// dir, which should be the directory of the config spec was loaded from
+// so that relative paths inside it resolve the same way. The returned
+// cleanup function removes the temporary file.
+func JSONFor(dir string, spec *config.IndexSpec) (string, func(), error) {
+	data, err := Marshal(spec, JSON)
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := ioutil.TempFile(dir, ".livegrep-*.json")
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	return f.Name(), func() { os.Remove(f.Name()) }, nil
+}
+
+// ToJSON converts a YAML document into the equivalent JSON. Anchors,
+// aliases and merge keys are resolved; comments are dropped.
+func ToJSON(data []byte) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	doc, err := jsonCompatible(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// FromJSON converts a JSON document into block-style YAML, preserving key
+// order. If previous is a YAML document written earlier for the same
+// config, its comments are carried over onto matching keys, and onto
+// list entries with a matching "name", so hand-written annotations
+// survive regeneration.
+func FromJSON(data []byte, previous []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	blockStyle(&doc)
+
+	if len(previous) > 0 {
+		var old yaml.Node
+		if err := yaml.Unmarshal(previous, &old); err == nil {
+			copyComments(&old, &doc)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonCompatible rewrites the map[interface{}]interface{} values yaml
+// can produce for non-string keys into something encoding/json accepts.
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			e, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = e
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			e, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			out[fmt.Sprint(k)] = e
+		}
+		return out, nil
+	case []interface{}:
+		for i, e := range v {
+			e, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = e
+		}
+		return v, nil
+	}
+	return v, nil
+}
+
+// blockStyle clears the flow and quoting styles that parsing JSON leaves
+// on every node, so the output reads like hand-written YAML.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+func copyComments(from, to *yaml.Node) {
+	if from.Kind != to.Kind {
+		return
+	}
+	to.HeadComment = from.HeadComment
+	to.LineComment = from.LineComment
+	to.FootComment = from.FootComment
+
+	switch to.Kind {
+	case yaml.DocumentNode:
+		if len(from.Content) > 0 && len(to.Content) > 0 {
+			copyComments(from.Content[0], to.Content[0])
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(to.Content); i += 2 {
+			key := to.Content[i].Value
+			for j := 0; j+1 < len(from.Content); j += 2 {
+				if from.Content[j].Value == key {
+					copyComments(from.Content[j], to.Content[i])
+					copyComments(from.Content[j+1], to.Content[i+1])
+					break
+				}
+			}
+		}
+	case yaml.SequenceNode:
+		old := make(map[string]*yaml.Node)
+		for _, e := range from.Content {
+			if name := mappingValue(e, "name"); name != "" {
+				old[name] = e
+			}
+		}
+		for _, e := range to.Content {
+			if prev, ok := old[mappingValue(e, "name")]; ok {
+				copyComments(prev, e)
+			}
+		}
+	}
+}
+
+func mappingValue(n *yaml.Node, key string) string {
+	if n.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1].Value
+		}
+	}
+	return ""
+}
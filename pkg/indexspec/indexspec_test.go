@@ -0,0 +1,136 @@
+package indexspec
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalYAML(t *testing.T) {
+	in := `
+name: test index
+defaults: &defaults
+  url_pattern: https://github.com/{name}/blob/{version}/{path}#L{lno}
+repositories:
+  - name: org/a
+    path: repos/org/a
+    revisions: [HEAD]
+    metadata:
+      <<: *defaults
+      remote: git@github.com:org/a.git
+`
+	spec, err := Unmarshal([]byte(in), YAML)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if spec.Name != "test index" {
+		t.Errorf("name: got %q", spec.Name)
+	}
+	if len(spec.Repositories) != 1 {
+		t.Fatalf("expected 1 repository, got %d", len(spec.Repositories))
+	}
+	r := spec.Repositories[0]
+	if r.Metadata.Remote != "git@github.com:org/a.git" {
+		t.Errorf("remote: got %q", r.Metadata.Remote)
+	}
+	if r.Metadata.UrlPattern != "https://github.com/{name}/blob/{version}/{path}#L{lno}" {
+		t.Errorf("url_pattern from merge key: got %q", r.Metadata.UrlPattern)
+	}
+}
+
+func TestUnmarshalOldLabels(t *testing.T) {
+	in := `{
+  "name": "old",
+  "repositories": [{
+    "name": "org/a",
+    "path": "repos/org/a",
+    "revisions": ["HEAD"],
+    "metadata": {"labels": ["archived", "mirror"], "label_map": {"team": "search"}}
+  }]
+}`
+	spec, err := Unmarshal([]byte(in), JSON)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	md := spec.Repositories[0].Metadata
+	if !reflect.DeepEqual(md.Labels, []string{"archived", "mirror"}) {
+		t.Errorf("labels: got %q", md.Labels)
+	}
+	if md.LabelMap["team"] != "search" {
+		t.Errorf("label_map: got %v", md.LabelMap)
+	}
+}
+
+func TestUnmarshalLargeInts(t *testing.T) {
+	// 2^53 + 1, which a float64 can't hold
+	const big = 9007199254740993
+	for format, in := range map[Format]string{
+		JSON: `{"repositories": [{"name": "org/a", "max_file_size": 9007199254740993, "metadata": {"commit_times": {"HEAD": 9007199254740993}}}]}`,
+		YAML: "repositories:\n  - name: org/a\n    max_file_size: 9007199254740993\n    metadata:\n      commit_times: {HEAD: 9007199254740993}\n",
+	} {
+		spec, err := Unmarshal([]byte(in), format)
+		if err != nil {
+			t.Fatalf("%v: unmarshal: %v", format, err)
+		}
+		r := spec.Repositories[0]
+		if r.MaxFileSize != big {
+			t.Errorf("%v: max_file_size: got %d", format, r.MaxFileSize)
+		}
+		if got := r.Metadata.CommitTimes["HEAD"]; got != big {
+			t.Errorf("%v: commit_times: got %d", format, got)
+		}
+		out, err := Render([]byte(in), format)
+		if err != nil {
+			t.Fatalf("%v: render: %v", format, err)
+		}
+		if !strings.Contains(string(out), `"max_file_size": 9007199254740993`) {
+			t.Errorf("%v: render: got %s", format, out)
+		}
+	}
+
+	if _, err := Unmarshal([]byte(`{"name": "a"} {}`), JSON); err == nil {
+		t.Error("unmarshal: want an error for data after the config")
+	}
+}
+
+func TestFromJSONPreservesComments(t *testing.T) {
+	previous := `# Owned by the platform team
+name: test index
+repositories:
+  # keep pinned until the migration lands
+  - name: org/a
+    path: repos/org/a
+  - name: org/b
+    path: repos/org/b
+`
+	data := `{"name": "test index", "repositories": [
+		{"name": "org/b", "path": "repos/org/b"},
+		{"name": "org/c", "path": "repos/org/c"},
+		{"name": "org/a", "path": "repos/org/a"}
+	]}`
+
+	out, err := FromJSON([]byte(data), []byte(previous))
+	if err != nil {
+		t.Fatalf("FromJSON: %v", err)
+	}
+	got := string(out)
+	for _, want := range []string{
+		"# Owned by the platform team",
+		"# keep pinned until the migration lands\n  - name: org/a",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "{") {
+		t.Errorf("expected block-style output, got:\n%s", got)
+	}
+
+	spec, err := Unmarshal(out, YAML)
+	if err != nil {
+		t.Fatalf("unmarshal round-trip: %v", err)
+	}
+	if len(spec.Repositories) != 3 || spec.Repositories[1].Name != "org/c" {
+		t.Errorf("round-trip lost repositories: %+v", spec.Repositories)
+	}
+}
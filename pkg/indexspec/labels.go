@@ -0,0 +1,23 @@
+package indexspec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseLabels parses a list of "key=value" strings, as given to the
+// reindex tools' -label flags, into a Metadata labels map.
+func ParseLabels(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		i := strings.Index(p, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("label %q: expected key=value", p)
+		}
+		labels[p[:i]] = p[i+1:]
+	}
+	return labels, nil
+}
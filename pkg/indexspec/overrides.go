@@ -0,0 +1,198 @@
+package indexspec
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+	"gopkg.in/yaml.v3"
+)
+
+// RevisionOverrides picks the revisions to index for repositories that
+// shouldn't be indexed at the reindex tools' -revision, as read from a
+// -revision-overrides file: a YAML or JSON mapping from repository name
+// patterns, written as in a RepoList, to a revision or a list of them:
+//
+//	legacy/app: develop
+//	"release/*": [main, release-2.x]
+//	"^mobile/": trunk
+//
+// The first pattern, in the file's order, that matches a repository
+// decides its revisions.
+//
+// A nil *RevisionOverrides overrides nothing.
+type RevisionOverrides struct {
+	rules []revisionRule
+}
+
+type revisionRule struct {
+	match     *RepoList
+	revisions []string
+}
+
+// LoadRevisionOverrides reads the RevisionOverrides at path.
+func LoadRevisionOverrides(path string) (*RevisionOverrides, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRevisionOverrides(data)
+}
+
+// ParseRevisionOverrides parses RevisionOverrides from the contents of
+// their file.
+func ParseRevisionOverrides(data []byte) (*RevisionOverrides, error) {
+	o := &RevisionOverrides{}
+	err := parseOverrides(data, "revisions", func(match *RepoList, k, v *yaml.Node) error {
+		rule := revisionRule{match: match}
+		switch v.Kind {
+		case yaml.ScalarNode:
+			rule.revisions = []string{v.Value}
+		case yaml.SequenceNode:
+			if err := v.Decode(&rule.revisions); err != nil {
+				return fmt.Errorf("line %d: %s", v.Line, err.Error())
+			}
+		default:
+			return fmt.Errorf("line %d: expected a revision or a list of them for %q", v.Line, k.Value)
+		}
+		for _, rev := range rule.revisions {
+			if rev == "" {
+				return fmt.Errorf("line %d: empty revision for %q", v.Line, k.Value)
+			}
+		}
+		if len(rule.revisions) == 0 {
+			return fmt.Errorf("line %d: no revisions for %q", v.Line, k.Value)
+		}
+		o.rules = append(o.rules, rule)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// parseOverrides calls rule, in order, with each repository pattern of
+// an overrides file and the node it maps to.
+func parseOverrides(data []byte, what string, rule func(match *RepoList, k, v *yaml.Node) error) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping from repositories to %s", m.Line, what)
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		k, v := m.Content[i], m.Content[i+1]
+		match := &RepoList{names: map[string]bool{}}
+		if err := match.add(k.Value); err != nil {
+			return fmt.Errorf("line %d: %s", k.Line, err.Error())
+		}
+		if err := rule(match, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Revisions returns the revisions to index the repository name at,
+// or def if none of o's patterns match it.
+func (o *RevisionOverrides) Revisions(name string, def ...string) []string {
+	if o != nil {
+		for _, r := range o.rules {
+			if r.match.Match(name) {
+				return append([]string(nil), r.revisions...)
+			}
+		}
+	}
+	return def
+}
+
+// DepthOverrides picks the clone depth of repositories that shouldn't
+// be cloned at the reindex tools' -depth, as read from a
+// -depth-overrides file: a mapping, like that of RevisionOverrides,
+// from repository name patterns to a depth, 0 meaning all of history:
+//
+//	"^monorepo/": 1
+//	tools/history: 0
+//
+// A nil *DepthOverrides overrides nothing.
+type DepthOverrides struct {
+	rules []depthRule
+}
+
+type depthRule struct {
+	match *RepoList
+	depth int
+}
+
+// LoadDepthOverrides reads the DepthOverrides at path.
+func LoadDepthOverrides(path string) (*DepthOverrides, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDepthOverrides(data)
+}
+
+// ParseDepthOverrides parses DepthOverrides from the contents of their
+// file.
+func ParseDepthOverrides(data []byte) (*DepthOverrides, error) {
+	o := &DepthOverrides{}
+	err := parseOverrides(data, "depths", func(match *RepoList, k, v *yaml.Node) error {
+		rule := depthRule{match: match}
+		if v.Kind != yaml.ScalarNode || v.Decode(&rule.depth) != nil || rule.depth < 0 {
+			return fmt.Errorf("line %d: expected a depth of 0 or more for %q", v.Line, k.Value)
+		}
+		o.rules = append(o.rules, rule)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Depth returns the depth to clone the repository name at, and whether
+// one of o's patterns matched it.
+func (o *DepthOverrides) Depth(name string) (int, bool) {
+	if o != nil {
+		for _, r := range o.rules {
+			if r.match.Match(name) {
+				return r.depth, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// A ClonePolicy decides how the reindex tools have each repository
+// cloned: at Depth, unless Overrides names it, or, if it is larger
+// than MaxSize bytes, at LargeDepth and with the partial clone filter
+// LargeFilter, to keep big repositories from filling the disk.
+type ClonePolicy struct {
+	Depth     int
+	Overrides *DepthOverrides
+	// 0 means no repository is too large
+	MaxSize     int64
+	LargeDepth  int
+	LargeFilter string
+}
+
+// Apply sets the depth and filter of c for the repository name, of
+// size bytes, or 0 if its size isn't known.
+func (p *ClonePolicy) Apply(c *config.CloneOptions, name string, size int64) {
+	if depth, ok := p.Overrides.Depth(name); ok {
+		c.Depth = int32(depth)
+		return
+	}
+	if p.MaxSize > 0 && size > p.MaxSize {
+		c.Depth, c.Filter = int32(p.LargeDepth), p.LargeFilter
+		return
+	}
+	c.Depth = int32(p.Depth)
+}
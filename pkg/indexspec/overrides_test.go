@@ -0,0 +1,132 @@
+package indexspec
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+func TestRevisionOverrides(t *testing.T) {
+	o, err := ParseRevisionOverrides([]byte(`
+legacy/app: develop
+"release/*": [main, release-2.x]
+"^mobile/": trunk
+"release/old": ignored
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		want []string
+	}{
+		{"legacy/app", []string{"develop"}},
+		{"release/api", []string{"main", "release-2.x"}},
+		// The first pattern that matches wins.
+		{"release/old", []string{"main", "release-2.x"}},
+		{"mobile/ios", []string{"trunk"}},
+		{"other/repo", []string{"HEAD"}},
+	}
+	for _, tc := range cases {
+		if got := o.Revisions(tc.name, "HEAD"); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Revisions(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	var none *RevisionOverrides
+	if got := none.Revisions("legacy/app", "HEAD"); !reflect.DeepEqual(got, []string{"HEAD"}) {
+		t.Errorf("nil Revisions = %v", got)
+	}
+
+	if o, err := ParseRevisionOverrides([]byte(`{"legacy/app": "develop"}`)); err != nil {
+		t.Errorf("JSON: %s", err)
+	} else if got := o.Revisions("legacy/app"); !reflect.DeepEqual(got, []string{"develop"}) {
+		t.Errorf("JSON: Revisions = %v", got)
+	}
+
+	for _, bad := range []string{
+		"[develop]",
+		"legacy/app: {branch: develop}",
+		"legacy/app: []",
+		`legacy/app: ""`,
+		`"^legacy/(": develop`,
+	} {
+		if _, err := ParseRevisionOverrides([]byte(bad)); err == nil {
+			t.Errorf("ParseRevisionOverrides(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestDepthOverrides(t *testing.T) {
+	o, err := ParseDepthOverrides([]byte(`
+"^monorepo/": 1
+tools/history: 0
+"monorepo/*": 5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name  string
+		depth int
+		ok    bool
+	}{
+		{"monorepo/web", 1, true},
+		{"tools/history", 0, true},
+		{"other/repo", 0, false},
+	}
+	for _, tc := range cases {
+		if depth, ok := o.Depth(tc.name); depth != tc.depth || ok != tc.ok {
+			t.Errorf("Depth(%q) = %d, %v, want %d, %v", tc.name, depth, ok, tc.depth, tc.ok)
+		}
+	}
+
+	var none *DepthOverrides
+	if _, ok := none.Depth("monorepo/web"); ok {
+		t.Error("nil Depth matched")
+	}
+
+	for _, bad := range []string{
+		"[1]",
+		"monorepo/web: -1",
+		"monorepo/web: deep",
+		"monorepo/web: [1]",
+	} {
+		if _, err := ParseDepthOverrides([]byte(bad)); err == nil {
+			t.Errorf("ParseDepthOverrides(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestClonePolicy(t *testing.T) {
+	overrides, err := ParseDepthOverrides([]byte(`tools/history: 0`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ClonePolicy{
+		Depth:       10,
+		Overrides:   overrides,
+		MaxSize:     1 << 30,
+		LargeDepth:  1,
+		LargeFilter: "blob:none",
+	}
+	cases := []struct {
+		name string
+		size int64
+		want config.CloneOptions
+	}{
+		{"org/small", 1 << 20, config.CloneOptions{Depth: 10}},
+		{"org/unknown", 0, config.CloneOptions{Depth: 10}},
+		{"org/big", 2 << 30, config.CloneOptions{Depth: 1, Filter: "blob:none"}},
+		{"tools/history", 2 << 30, config.CloneOptions{Depth: 0}},
+	}
+	for _, tc := range cases {
+		var got config.CloneOptions
+		p.Apply(&got, tc.name, tc.size)
+		if got.Depth != tc.want.Depth || got.Filter != tc.want.Filter {
+			t.Errorf("Apply(%q, %d): depth %d, filter %q, want %d, %q",
+				tc.name, tc.size, got.Depth, got.Filter, tc.want.Depth, tc.want.Filter)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package indexspec
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// remoteSchemes are the URL schemes a config may be loaded from, in
+// addition to local paths.
+var remoteSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+	"s3":    true,
+	"gs":    true,
+}
+
+var httpClient = &http.Client{Timeout: 60 * time.Second}
+
+// IsRemote reports whether location names a remote config rather than a
+// local file.
+func IsRemote(location string) bool {
+	u, err := url.Parse(location)
+	return err == nil && remoteSchemes[u.Scheme]
+}
+
+// readConfig returns the contents of the config at location, which is
+// either a local path or a remote URL.
+//
+// http(s) URLs are fetched directly; credentials may be given as URL
+// userinfo, or as a bearer token in $LIVEGREP_CONFIG_TOKEN. s3:// and
+// gs:// URLs are fetched with the `aws` and `gsutil` command line tools,
+// using whatever credentials those are configured with.
+func readConfig(location string) ([]byte, error) {
+	if !IsRemote(location) {
+		return ioutil.ReadFile(location)
+	}
+	u, _ := url.Parse(location)
+	switch u.Scheme {
+	case "s3":
+		return runFetcher(location, "aws", "s3", "cp", location, "-")
+	case "gs":
+		return runFetcher(location, "gsutil", "cat", location)
+	}
+
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), pass)
+	} else if token := os.Getenv("LIVEGREP_CONFIG_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", redact(u), resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func runFetcher(location, program string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(program, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %s: %s", location, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// resolveInclude resolves an include of a config from a remote config.
+// Globs cannot be expanded remotely.
+func resolveInclude(base, include string) (string, error) {
+	if strings.ContainsAny(include, "*?[") {
+		return "", fmt.Errorf("globs are not supported in includes of remote configs")
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(include)
+	if err != nil {
+		return "", err
+	}
+	return b.ResolveReference(ref).String(), nil
+}
+
+// displayName returns location in a form suitable for error messages,
+// without any password it contains.
+func displayName(location string) string {
+	if !IsRemote(location) {
+		return location
+	}
+	u, _ := url.Parse(location)
+	return redact(u)
+}
+
+// redact returns u as a string without its password.
+func redact(u *url.URL) string {
+	c := *u
+	if c.User != nil {
+		c.User = url.User(c.User.Username())
+	}
+	return c.String()
+}
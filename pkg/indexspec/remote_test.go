@@ -0,0 +1,42 @@
+package indexspec
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestLoadRemote(t *testing.T) {
+	files := map[string]string{
+		"/configs/livegrep.yaml":     "name: remote\ninclude: [teams/search.json]\n",
+		"/configs/teams/search.json": `{"repositories": [{"name": "search/livegrep", "path": "repos/search/livegrep"}]}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sekrit" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	if _, err := Load(srv.URL + "/configs/livegrep.yaml"); err == nil {
+		t.Errorf("expected an error loading without a token")
+	}
+
+	os.Setenv("LIVEGREP_CONFIG_TOKEN", "sekrit")
+	defer os.Unsetenv("LIVEGREP_CONFIG_TOKEN")
+	spec, err := Load(srv.URL + "/configs/livegrep.yaml")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if spec.Name != "remote" || len(spec.Repositories) != 1 || spec.Repositories[0].Name != "search/livegrep" {
+		t.Errorf("Load: got %v", spec)
+	}
+}
@@ -0,0 +1,98 @@
+package indexspec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A RepoList is a list of repository names, as given to the reindex
+// tools' -ignorelist and -allowlist flags. Each line of the file is an
+// entry: a name, such as "org/repo"; a glob, if it has any of "*?[",
+// such as "sandbox/*", where * doesn't match a "/"; or a regexp, if it
+// starts with "^", such as "^internal/.*-deprecated$". Blank lines and
+// lines starting with "#" are skipped.
+//
+// A nil *RepoList matches nothing.
+type RepoList struct {
+	names    map[string]bool
+	globs    []string
+	patterns []*regexp.Regexp
+}
+
+// LoadRepoList reads the RepoList at path.
+func LoadRepoList(path string) (*RepoList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRepoList(string(data))
+}
+
+// ParseRepoList parses a RepoList from the contents of its file.
+func ParseRepoList(data string) (*RepoList, error) {
+	l := &RepoList{names: map[string]bool{}}
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := l.add(line); err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err.Error())
+		}
+	}
+	return l, nil
+}
+
+// add adds the entry pattern to l.
+func (l *RepoList) add(pattern string) error {
+	switch {
+	case strings.HasPrefix(pattern, "^"):
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		l.patterns = append(l.patterns, re)
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad glob %q", pattern)
+		}
+		l.globs = append(l.globs, pattern)
+	default:
+		l.names[pattern] = true
+	}
+	return nil
+}
+
+// Match reports whether name matches any of l's entries.
+func (l *RepoList) Match(name string) bool {
+	if l == nil {
+		return false
+	}
+	if l.names[name] {
+		return true
+	}
+	for _, g := range l.globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	for _, re := range l.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether the repository name should be indexed: it
+// isn't matched by ignore, and, if allow isn't nil, it is matched by
+// allow.
+func Allowed(name string, ignore, allow *RepoList) bool {
+	if ignore.Match(name) {
+		return false
+	}
+	return allow == nil || allow.Match(name)
+}
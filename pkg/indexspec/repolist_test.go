@@ -0,0 +1,59 @@
+package indexspec
+
+import "testing"
+
+func TestRepoList(t *testing.T) {
+	l, err := ParseRepoList(`
+# Retired
+org/old-api
+  org/padded
+sandbox/*
+^internal/.*-deprecated$
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"org/old-api":                  true,
+		"org/old-api2":                 false,
+		"org/padded":                   true,
+		"sandbox/scratch":              true,
+		"sandbox/team/scratch":         false,
+		"internal/billing-deprecated":  true,
+		"internal/billing-deprecated2": false,
+		"# Retired":                    false,
+		"":                             false,
+	}
+	for name, want := range cases {
+		if got := l.Match(name); got != want {
+			t.Errorf("Match(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	for _, bad := range []string{"^internal/(", "sandbox/[a"} {
+		if _, err := ParseRepoList(bad); err == nil {
+			t.Errorf("ParseRepoList(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	ignore, _ := ParseRepoList("team/legacy")
+	allow, _ := ParseRepoList("team/*")
+	cases := []struct {
+		name          string
+		ignore, allow *RepoList
+		want          bool
+	}{
+		{"team/api", nil, nil, true},
+		{"team/api", ignore, allow, true},
+		{"team/legacy", ignore, allow, false},
+		{"other/api", ignore, allow, false},
+		{"other/api", ignore, nil, true},
+	}
+	for _, tc := range cases {
+		if got := Allowed(tc.name, tc.ignore, tc.allow); got != tc.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
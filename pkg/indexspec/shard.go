@@ -0,0 +1,88 @@
+package indexspec
+
+import (
+	"sort"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// shardTolerance is how far over an even split a shard may grow before
+// Partition moves entries off it.
+const shardTolerance = 0.1
+
+// Partition splits the paths and repositories of spec into n shards of
+// roughly equal total weight, where weight gives the cost of indexing
+// the named entry (e.g. its size in bytes).
+//
+// previous maps entry names to the shard they were in last time.
+// Entries keep their previous shard as long as it stays within
+// shardTolerance of an even split, so that adding a repository does not
+// reshuffle the whole index; new and displaced entries go to the
+// lightest shard, heaviest first. Within each shard, entries stay in
+// the order they appear in spec.
+func Partition(spec *config.IndexSpec, n int, weight func(name string) int64, previous map[string]int) []*config.IndexSpec {
+	type entry struct {
+		name   string
+		weight int64
+	}
+	var entries []entry
+	var total int64
+	for _, p := range spec.Paths {
+		entries = append(entries, entry{p.Name, weight(p.Name)})
+	}
+	for _, r := range spec.Repositories {
+		entries = append(entries, entry{r.Name, weight(r.Name)})
+	}
+	for _, e := range entries {
+		total += e.weight
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].weight > entries[j].weight
+	})
+
+	limit := float64(total) / float64(n) * (1 + shardTolerance)
+	loads := make([]int64, n)
+	assigned := map[string]int{}
+	var pending []entry
+	for _, e := range entries {
+		s, ok := previous[e.name]
+		if ok && s >= 0 && s < n && (loads[s] == 0 || float64(loads[s]+e.weight) <= limit) {
+			assigned[e.name] = s
+			loads[s] += e.weight
+			continue
+		}
+		pending = append(pending, e)
+	}
+	for _, e := range pending {
+		s := 0
+		for i := range loads {
+			if loads[i] < loads[s] {
+				s = i
+			}
+		}
+		assigned[e.name] = s
+		loads[s] += e.weight
+	}
+
+	shards := make([]*config.IndexSpec, n)
+	for i := range shards {
+		shards[i] = &config.IndexSpec{
+			Name:                spec.Name,
+			IndexOnlyExtensions: spec.IndexOnlyExtensions,
+			SkipExtensions:      spec.SkipExtensions,
+			BinaryDetection:     spec.BinaryDetection,
+			Symlinks:            spec.Symlinks,
+			Encodings:           spec.Encodings,
+			Redaction:           spec.Redaction,
+		}
+	}
+	for _, p := range spec.Paths {
+		s := shards[assigned[p.Name]]
+		s.Paths = append(s.Paths, p)
+	}
+	for _, r := range spec.Repositories {
+		s := shards[assigned[r.Name]]
+		s.Repositories = append(s.Repositories, r)
+	}
+	return shards
+}
@@ -0,0 +1,65 @@
+package indexspec
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+func shardNames(shards []*config.IndexSpec) [][]string {
+	out := make([][]string, len(shards))
+	for i, s := range shards {
+		out[i] = []string{}
+		for _, r := range s.Repositories {
+			out[i] = append(out[i], r.Name)
+		}
+	}
+	return out
+}
+
+func TestPartition(t *testing.T) {
+	spec := &config.IndexSpec{Name: "all"}
+	weights := map[string]int64{}
+	for i, w := range []int64{50, 10, 40, 30, 20, 10} {
+		name := fmt.Sprintf("r%d", i)
+		spec.Repositories = append(spec.Repositories, &config.RepoSpec{Name: name})
+		weights[name] = w
+	}
+	weight := func(name string) int64 { return weights[name] }
+
+	shards := Partition(spec, 2, weight, nil)
+	got := shardNames(shards)
+	want := [][]string{{"r0", "r1", "r4"}, {"r2", "r3", "r5"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Partition: got %v, want %v", got, want)
+	}
+	if shards[0].Name != "all" {
+		t.Errorf("shard name: got %q", shards[0].Name)
+	}
+
+	// A new repository goes to the lightest shard without moving the
+	// others.
+	previous := map[string]int{}
+	for i, names := range got {
+		for _, n := range names {
+			previous[n] = i
+		}
+	}
+	spec.Repositories = append(spec.Repositories, &config.RepoSpec{Name: "r6"})
+	weights["r6"] = 5
+	got = shardNames(Partition(spec, 2, weight, previous))
+	want = [][]string{{"r0", "r1", "r4", "r6"}, {"r2", "r3", "r5"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Partition with a new repo: got %v, want %v", got, want)
+	}
+
+	// When a repository outgrows its shard, the others move off it.
+	weights["r4"] = 200
+	got = shardNames(Partition(spec, 2, weight, previous))
+	want = [][]string{{"r4"}, {"r0", "r1", "r2", "r3", "r5", "r6"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Partition after growth: got %v, want %v", got, want)
+	}
+}
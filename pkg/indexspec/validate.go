@@ -0,0 +1,296 @@
+package indexspec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// A Problem is a single mistake found in an IndexSpec.
+type Problem struct {
+	// Where identifies the offending entry, e.g.
+	// `repositories[3] (org/service)`; empty for the spec as a whole.
+	Where   string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Where == "" {
+		return p.Message
+	}
+	return p.Where + ": " + p.Message
+}
+
+// urlPatternVars are the placeholders the frontend substitutes in a
+// url_pattern.
+var urlPatternVars = map[string]bool{
+	"name":     true,
+	"basename": true,
+	"version":  true,
+	"sha":      true,
+	"branch":   true,
+	"path":     true,
+	"lno":      true,
+}
+
+var urlPatternRE = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// LoadStrict is like Load, but rejects fields that are not part of the
+// IndexSpec schema instead of silently ignoring them.
+func LoadStrict(paths ...string) (*config.IndexSpec, error) {
+	data, err := RenderFiles(paths...)
+	if err != nil {
+		return nil, err
+	}
+	var spec config.IndexSpec
+	if err := strictUnmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// CheckSchema checks that a single config document only uses fields
+// that are part of the IndexSpec schema, and that they have the right
+// types. Environment references are left unexpanded.
+func CheckSchema(data []byte, format Format) error {
+	doc, err := parse(data, format)
+	if err != nil {
+		return err
+	}
+	delete(doc, "include")
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return strictUnmarshal(data, &config.IndexSpec{})
+}
+
+func strictUnmarshal(data []byte, spec *config.IndexSpec) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(spec)
+}
+
+// Validate checks spec for mistakes that codesearch would either reject
+// late or silently mis-index: missing or duplicate names and paths,
+// repositories without revisions, url_patterns with unknown placeholders
+// and passwords that cannot be found. It does not touch the network or
+// run password commands.
+func Validate(spec *config.IndexSpec) []Problem {
+	var problems []Problem
+	report := func(where, format string, args ...interface{}) {
+		problems = append(problems, Problem{where, fmt.Sprintf(format, args...)})
+	}
+
+	if len(spec.Paths) == 0 && len(spec.Repositories) == 0 {
+		report("", "no paths or repositories to index")
+	}
+	problems = append(problems, validateBinaryDetection("", spec.BinaryDetection)...)
+	problems = append(problems, validateSymlinks("", spec.Symlinks)...)
+	problems = append(problems, validateEncodings("", spec.Encodings)...)
+	problems = append(problems, validateRedaction("", spec.Redaction)...)
+
+	names := map[string]string{}
+	paths := map[string]string{}
+	seen := func(where, kind, value string, in map[string]string) {
+		if first, ok := in[value]; ok {
+			report(where, "duplicate %s %q, also used by %s", kind, value, first)
+			return
+		}
+		in[value] = where
+	}
+
+	for i, p := range spec.Paths {
+		where := entryName("paths", i, p.Name)
+		if p.Name == "" {
+			report(where, "missing name")
+		} else {
+			seen(where, "name", p.Name, names)
+		}
+		if p.Path == "" {
+			report(where, "missing path")
+		} else {
+			seen(where, "path", p.Path, paths)
+		}
+		problems = append(problems, validateMetadata(where, p.Metadata)...)
+		problems = append(problems, validateSymlinks(where, p.Symlinks)...)
+	}
+
+	for i, r := range spec.Repositories {
+		where := entryName("repositories", i, r.Name)
+		if r.Name == "" {
+			report(where, "missing name")
+		} else {
+			seen(where, "name", r.Name, names)
+		}
+		if r.Path == "" {
+			report(where, "missing path")
+		} else {
+			seen(where, "path", r.Path, paths)
+		}
+		if len(r.Revisions) == 0 {
+			report(where, "no revisions to index")
+		}
+		for alias := range r.RevisionAliases {
+			if !contains(r.Revisions, alias) {
+				report(where, "revision alias %q is not listed in revisions", alias)
+			}
+		}
+		if r.MaxFileSize < 0 {
+			report(where, "max_file_size must not be negative")
+		}
+		problems = append(problems, validateMetadata(where, r.Metadata)...)
+		problems = append(problems, validateBinaryDetection(where, r.BinaryDetection)...)
+		problems = append(problems, validateSymlinks(where, r.Symlinks)...)
+		if r.Generated != "" && r.Generated != "exclude" && r.Generated != "index" {
+			report(where, "generated: unknown setting %q (want exclude or index)", r.Generated)
+		}
+		problems = append(problems, validateEncodings(where, r.Encodings)...)
+		problems = append(problems, validateRedaction(where, r.Redaction)...)
+		if c := r.CloneOptions; c != nil {
+			if c.Depth < 0 {
+				report(where, "clone_options.depth must not be negative")
+			}
+			if c.Filter != "" && c.Filter != "blob:none" && !strings.HasPrefix(c.Filter, "blob:limit=") {
+				report(where, "clone_options.filter: unsupported filter %q (want blob:none or blob:limit=<size>)", c.Filter)
+			}
+			sources := 0
+			if c.PasswordEnv != "" {
+				sources++
+				if os.Getenv(c.PasswordEnv) == "" {
+					report(where, "password_env %s is not set", c.PasswordEnv)
+				}
+			}
+			if c.PasswordFile != "" {
+				sources++
+				if _, err := os.Stat(c.PasswordFile); err != nil {
+					report(where, "password_file: %s", err.Error())
+				}
+			}
+			if c.PasswordCommand != "" {
+				sources++
+			}
+			if sources > 1 {
+				report(where, "only one of password_env, password_file and password_command may be set")
+			}
+		}
+	}
+	repos := map[string]bool{}
+	for _, r := range spec.Repositories {
+		repos[r.Name] = true
+	}
+	for i, r := range spec.Repositories {
+		if c := r.CloneOptions; c != nil && c.Reference != "" {
+			where := entryName("repositories", i, r.Name)
+			if c.Reference == r.Name {
+				report(where, "clone_options.reference can't be the repository itself")
+			} else if !repos[c.Reference] {
+				report(where, "clone_options.reference: no repository named %q", c.Reference)
+			}
+		}
+	}
+	return problems
+}
+
+func validateBinaryDetection(where string, bd *config.BinaryDetection) []Problem {
+	if bd == nil {
+		return nil
+	}
+	var problems []Problem
+	if bd.MaxNullFraction < 0 || bd.MaxNullFraction >= 1 {
+		problems = append(problems, Problem{where, "binary_detection.max_null_fraction must be at least 0 and less than 1"})
+	}
+	if bd.CheckBytes < 0 {
+		problems = append(problems, Problem{where, "binary_detection.check_bytes must not be negative"})
+	}
+	return problems
+}
+
+func validateSymlinks(where, policy string) []Problem {
+	switch policy {
+	case "", "follow", "link_text", "skip":
+		return nil
+	}
+	return []Problem{{where, fmt.Sprintf("symlinks: unknown policy %q (want follow, link_text or skip)", policy)}}
+}
+
+// knownEncodings are the encodings codesearch can transcode from; see
+// src/transcode.cc.
+var knownEncodings = map[string]bool{
+	"shift_jis": true, "euc-jp": true, "euc-kr": true, "gbk": true, "gb18030": true,
+	"big5": true, "windows-1251": true, "windows-1252": true, "iso-8859-1": true, "koi8-r": true,
+}
+
+func validateEncodings(where string, encodings []string) []Problem {
+	var problems []Problem
+	for _, e := range encodings {
+		if !knownEncodings[e] {
+			problems = append(problems, Problem{where, fmt.Sprintf("encodings: unknown encoding %q", e)})
+		}
+	}
+	return problems
+}
+
+// validateRedaction checks redaction patterns with Go's regexp, whose
+// syntax is RE2's.
+func validateRedaction(where string, r *config.Redaction) []Problem {
+	if r == nil {
+		return nil
+	}
+	var problems []Problem
+	for _, p := range r.Patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			problems = append(problems, Problem{where, fmt.Sprintf("redaction.patterns: %s", err.Error())})
+		}
+	}
+	if r.MinEntropy < 0 || r.MinEntropyLength < 0 {
+		problems = append(problems, Problem{where, "redaction.min_entropy and min_entropy_length must not be negative"})
+	}
+	return problems
+}
+
+func validateMetadata(where string, m *config.Metadata) []Problem {
+	if m == nil {
+		return nil
+	}
+	var problems []Problem
+	if m.LinkRevision != "" && m.LinkRevision != "commit" && m.LinkRevision != "branch" {
+		problems = append(problems, Problem{where,
+			fmt.Sprintf("link_revision: unknown revision %q (want commit or branch)", m.LinkRevision)})
+	}
+	if m.UrlPattern == "" {
+		return problems
+	}
+	for _, v := range urlPatternRE.FindAllStringSubmatch(m.UrlPattern, -1) {
+		if !urlPatternVars[v[1]] {
+			problems = append(problems, Problem{where,
+				fmt.Sprintf("url_pattern: unknown placeholder {%s}", v[1])})
+		}
+	}
+	rest := urlPatternRE.ReplaceAllString(m.UrlPattern, "")
+	if strings.ContainsAny(rest, "{}") {
+		problems = append(problems, Problem{where, "url_pattern: unbalanced braces"})
+	}
+	return problems
+}
+
+func entryName(list string, i int, name string) string {
+	if name == "" {
+		return fmt.Sprintf("%s[%d]", list, i)
+	}
+	return fmt.Sprintf("%s[%d] (%s)", list, i, name)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
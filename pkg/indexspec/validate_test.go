@@ -0,0 +1,87 @@
+package indexspec
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	os.Unsetenv("LIVEGREP_TEST_UNSET_PASSWORD")
+	spec, err := Unmarshal([]byte(`
+repositories:
+  - name: org/a
+    path: repos/org/a
+    revisions: [HEAD]
+    metadata:
+      url_pattern: https://example.com/{name}/blob/{sha}/{path}#L{lno}?at={branch}
+  - name: org/a
+    path: repos/org/b
+    revisions: [HEAD]
+    metadata:
+      url_pattern: https://example.com/{repo}/{path
+      link_revision: tag
+  - name: org/c
+    path: repos/org/b
+    clone_options:
+      password_env: LIVEGREP_TEST_UNSET_PASSWORD
+      filter: tree:0
+      reference: org/upstream
+    binary_detection:
+      max_null_fraction: 1.5
+    symlinks: resolve
+    generated: skip
+    encodings: [latin1]
+    redaction:
+      patterns: ["secret=(\\w+"]
+`), YAML)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	var got []string
+	for _, p := range Validate(spec) {
+		got = append(got, p.String())
+	}
+	want := []string{
+		`repositories[1] (org/a): duplicate name "org/a", also used by repositories[0] (org/a)`,
+		`repositories[1] (org/a): link_revision: unknown revision "tag" (want commit or branch)`,
+		`repositories[1] (org/a): url_pattern: unknown placeholder {repo}`,
+		`repositories[1] (org/a): url_pattern: unbalanced braces`,
+		`repositories[2] (org/c): duplicate path "repos/org/b", also used by repositories[1] (org/a)`,
+		`repositories[2] (org/c): no revisions to index`,
+		`repositories[2] (org/c): binary_detection.max_null_fraction must be at least 0 and less than 1`,
+		`repositories[2] (org/c): symlinks: unknown policy "resolve" (want follow, link_text or skip)`,
+		`repositories[2] (org/c): generated: unknown setting "skip" (want exclude or index)`,
+		`repositories[2] (org/c): encodings: unknown encoding "latin1"`,
+		"repositories[2] (org/c): redaction.patterns: error parsing regexp: missing closing ): `secret=(\\w+`",
+		`repositories[2] (org/c): clone_options.filter: unsupported filter "tree:0" (want blob:none or blob:limit=<size>)`,
+		`repositories[2] (org/c): password_env LIVEGREP_TEST_UNSET_PASSWORD is not set`,
+		`repositories[2] (org/c): clone_options.reference: no repository named "org/upstream"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Validate:\ngot:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+	}
+}
+
+func TestLoadStrict(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"livegrep.yaml": `
+repositories:
+  - name: org/a
+    path: repos/org/a
+    revison: [HEAD]
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "livegrep.yaml")
+	if _, err := Load(path); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if _, err := LoadStrict(path); err == nil || !strings.Contains(err.Error(), "revison") {
+		t.Errorf("LoadStrict: expected an unknown field error, got %v", err)
+	}
+}
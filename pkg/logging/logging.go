@@ -0,0 +1,335 @@
+// Package logging is the log output shared by livegrep's Go binaries.
+// Each line carries a time, a level, the name of the binary that wrote
+// it and any fields attached with With, and is written as text or JSON
+// according to the -log-level, -log-format and -log-file flags this
+// package registers. -log-sink also ships every line, as JSON, to a log
+// collector.
+//
+// Init also routes the standard library's log package through here, so
+// that plain log.Printf calls come out in the same format, at level
+// info.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	flagLevel  = flag.String("log-level", "info", "Log messages at or above this `level`: debug, info, warn or error")
+	flagFormat = flag.String("log-format", "text", "Write logs as `text` (or console, the same) or json")
+	flagFile   = flag.String("log-file", "", "Append logs to this `file` instead of stderr")
+	flagSink   = flag.String("log-sink", "", "Also send logs, as JSON lines, to a collector at this `url`: tcp://host:port, udp://host:port or unix:///path")
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	// Fatal lines are written just before the program exits, by Fatalf
+	// or the log package's Fatal functions.
+	LevelFatal
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "fatal"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelFatal {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name as accepted by -log-level.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+// output is where, and how, lines are written. Until Init is called it
+// writes text at level info and above to stderr.
+var output = struct {
+	sync.Mutex
+	w         io.Writer
+	level     Level
+	json      bool
+	component string
+	hooks     []hook
+	sink      *sink
+}{w: os.Stderr, level: LevelInfo}
+
+// An Entry is one line, as passed to hooks.
+type Entry struct {
+	Time      time.Time
+	Level     Level
+	Component string
+	Msg       string
+	// The fields attached with With, formatted as in text lines.
+	Fields map[string]string
+}
+
+type hook struct {
+	level Level
+	f     func(Entry)
+}
+
+// AddHook arranges for f to be called with every line logged at level
+// or above, whatever -log-level is. f is called synchronously, so that
+// it sees fatal lines before the program exits.
+func AddHook(level Level, f func(Entry)) {
+	output.Lock()
+	defer output.Unlock()
+	output.hooks = append(output.hooks, hook{level, f})
+}
+
+// Init applies the logging flags, names the component every line will
+// carry, and redirects the standard log package. It must be called
+// after flag.Parse.
+func Init(component string) error {
+	level, err := ParseLevel(*flagLevel)
+	if err != nil {
+		return err
+	}
+	var asJSON bool
+	switch *flagFormat {
+	case "text", "console":
+	case "json":
+		asJSON = true
+	default:
+		return fmt.Errorf("unknown log format %q (want text or json)", *flagFormat)
+	}
+	var sk *sink
+	if *flagSink != "" {
+		if sk, err = newSink(*flagSink); err != nil {
+			return err
+		}
+	}
+	var w io.Writer = os.Stderr
+	if *flagFile != "" {
+		f, err := os.OpenFile(*flagFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	output.Lock()
+	output.w = w
+	output.level = level
+	output.json = asJSON
+	output.component = component
+	output.sink = sk
+	output.Unlock()
+
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(stdlibWriter{})
+	return nil
+}
+
+// Args returns the logging flags as given to this process, for passing
+// on to binaries it runs so that they log the same way.
+func Args() []string {
+	var args []string
+	for _, name := range []string{"log-level", "log-format", "log-file", "log-sink"} {
+		if f := flag.Lookup(name); f != nil && f.Value.String() != f.DefValue {
+			args = append(args, fmt.Sprintf("-%s=%s", name, f.Value.String()))
+		}
+	}
+	return args
+}
+
+// stdlibWriter receives the lines written through the log package.
+type stdlibWriter struct{}
+
+func (stdlibWriter) Write(p []byte) (int, error) {
+	level := LevelInfo
+	if calledFromFatal() {
+		level = LevelFatal
+	}
+	std.output(level, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// calledFromFatal reports whether a line written to the log package
+// came from one of its Fatal functions.
+func calledFromFatal() bool {
+	pcs := make([]uintptr, 8)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		f, more := frames.Next()
+		if strings.HasPrefix(f.Function, "log.Fatal") || strings.HasPrefix(f.Function, "log.(*Logger).Fatal") {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// A Logger writes lines carrying a fixed set of fields. The zero Logger
+// carries none.
+type Logger struct {
+	fields []field
+}
+
+var std = &Logger{}
+
+// With returns a Logger that adds the given alternating keys and values
+// to each line, after any l already adds.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+(len(kv)+1)/2)
+	copy(fields, l.fields)
+	for i := 0; i < len(kv); i += 2 {
+		var v interface{} = "(missing)"
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+		fields = append(fields, field{fmt.Sprint(kv[i]), v})
+	}
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.output(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.output(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.output(LevelError, fmt.Sprintf(format, args...))
+}
+
+// Fatalf logs at level fatal and exits.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.output(LevelFatal, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// With returns a Logger that adds the given fields to each line.
+func With(kv ...interface{}) *Logger { return std.With(kv...) }
+
+func Debugf(format string, args ...interface{}) { std.Debugf(format, args...) }
+func Infof(format string, args ...interface{})  { std.Infof(format, args...) }
+func Warnf(format string, args ...interface{})  { std.Warnf(format, args...) }
+func Errorf(format string, args ...interface{}) { std.Errorf(format, args...) }
+func Fatalf(format string, args ...interface{}) { std.Fatalf(format, args...) }
+
+func (l *Logger) output(level Level, msg string) {
+	t := time.Now().UTC()
+	output.Lock()
+	var hooks []func(Entry)
+	for _, h := range output.hooks {
+		if level >= h.level {
+			hooks = append(hooks, h.f)
+		}
+	}
+	component := output.component
+	sk := output.sink
+	if level >= output.level {
+		output.w.Write(l.format(t, level, msg, output.json))
+		if sk != nil {
+			sk.send(l.format(t, level, msg, true))
+		}
+	}
+	output.Unlock()
+	if sk != nil && level == LevelFatal {
+		// Give the line a chance to reach the collector before the
+		// program exits.
+		sk.flush(time.Second)
+	}
+
+	if len(hooks) == 0 {
+		return
+	}
+	e := Entry{Time: t, Level: level, Component: component, Msg: msg, Fields: map[string]string{}}
+	for _, f := range l.fields {
+		e.Fields[f.key] = fmt.Sprint(f.value)
+	}
+	for _, h := range hooks {
+		h(e)
+	}
+}
+
+// format formats one line, as JSON or text. output must be locked.
+func (l *Logger) format(t time.Time, level Level, msg string, asJSON bool) []byte {
+	var line bytes.Buffer
+	now := t.Format("2006-01-02T15:04:05.000Z")
+	if asJSON {
+		fmt.Fprintf(&line, `{"time":%q,"level":%q`, now, level)
+		if output.component != "" {
+			fmt.Fprintf(&line, `,"component":%s`, jsonValue(output.component))
+		}
+		fmt.Fprintf(&line, `,"msg":%s`, jsonValue(msg))
+		for _, f := range l.fields {
+			fmt.Fprintf(&line, `,%s:%s`, jsonValue(f.key), jsonValue(f.value))
+		}
+		line.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&line, "%s %-5s ", now, strings.ToUpper(level.String()))
+		if output.component != "" {
+			fmt.Fprintf(&line, "%s: ", output.component)
+		}
+		line.WriteString(msg)
+		for _, f := range l.fields {
+			fmt.Fprintf(&line, " %s=%s", f.key, textValue(f.value))
+		}
+		line.WriteByte('\n')
+	}
+	return line.Bytes()
+}
+
+// jsonValue formats v for a JSON line: errors as their message, and
+// durations, such as a duration field, as a number of seconds.
+func jsonValue(v interface{}) []byte {
+	switch x := v.(type) {
+	case error:
+		v = x.Error()
+	case time.Duration:
+		v = x.Seconds()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return data
+}
+
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,178 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// capture points output at a buffer for the duration of a test.
+func capture(t *testing.T, asJSON bool, level Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	w, j, l, c := output.w, output.json, output.level, output.component
+	output.w, output.json, output.level, output.component = &buf, asJSON, level, "test"
+	t.Cleanup(func() {
+		output.w, output.json, output.level, output.component = w, j, l, c
+	})
+	return &buf
+}
+
+func TestText(t *testing.T) {
+	buf := capture(t, false, LevelInfo)
+	With("repo", "livegrep/livegrep").With("err", errors.New("exit status 128")).Warnf("fetch failed after %d tries", 3)
+	Debugf("not shown")
+
+	line := buf.String()
+	if strings.Count(line, "\n") != 1 {
+		t.Fatalf("want one line, got %q", line)
+	}
+	want := ` WARN  test: fetch failed after 3 tries repo=livegrep/livegrep err="exit status 128"` + "\n"
+	if !strings.HasSuffix(line, want) {
+		t.Errorf("got %q, want suffix %q", line, want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := capture(t, true, LevelDebug)
+	With("request_id", "abc", "n", 2).Debugf("hello %s", "world")
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("%q: %v", buf.String(), err)
+	}
+	for k, v := range map[string]interface{}{
+		"level":      "debug",
+		"component":  "test",
+		"msg":        "hello world",
+		"request_id": "abc",
+		"n":          float64(2),
+	} {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if _, ok := got["time"]; !ok {
+		t.Error("no time")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "warning": LevelWarn, "error": LevelError} {
+		if got, err := ParseLevel(s); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(verbose) succeeded")
+	}
+}
+
+func TestHook(t *testing.T) {
+	capture(t, false, LevelError)
+	hooks := output.hooks
+	t.Cleanup(func() { output.hooks = hooks })
+
+	var got []Entry
+	AddHook(LevelError, func(e Entry) { got = append(got, e) })
+	Infof("ignored")
+	With("repo", "a/b").Errorf("failed")
+
+	if len(got) != 1 {
+		t.Fatalf("got %d entries, want 1", len(got))
+	}
+	if e := got[0]; e.Level != LevelError || e.Msg != "failed" || e.Component != "test" || e.Fields["repo"] != "a/b" {
+		t.Errorf("got %+v", e)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	buf := capture(t, true, LevelInfo)
+	With("repo", "a/b", "phase", "fetch", "duration", 1500*time.Millisecond).Infof("fetched")
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("%q: %v", buf.String(), err)
+	}
+	if got["duration"] != 1.5 {
+		t.Errorf("duration = %v, want 1.5 (seconds)", got["duration"])
+	}
+
+	buf = capture(t, false, LevelInfo)
+	With("duration", 1500*time.Millisecond).Infof("fetched")
+	if want := "fetched duration=1.5s\n"; !strings.HasSuffix(buf.String(), want) {
+		t.Errorf("got %q, want suffix %q", buf.String(), want)
+	}
+}
+
+func TestSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sk, err := newSink("tcp://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture(t, false, LevelInfo)
+	output.sink = sk
+	t.Cleanup(func() { output.sink = nil })
+
+	With("repo", "a/b").Errorf("fetch failed")
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(line, &got); err != nil {
+		t.Fatalf("%q: %v", line, err)
+	}
+	if got["msg"] != "fetch failed" || got["level"] != "error" || got["repo"] != "a/b" {
+		t.Errorf("sink got %q", line)
+	}
+
+	for _, spec := range []string{"http://localhost:1", "tcp://", "unix://"} {
+		if _, err := newSink(spec); err == nil {
+			t.Errorf("newSink(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestSinkUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	sk, err := newSink("tcp://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture(t, false, LevelInfo)
+	output.sink = sk
+	t.Cleanup(func() { output.sink = nil })
+
+	start := time.Now()
+	for i := 0; i < 2*sinkQueue; i++ {
+		Infof("line %d", i)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("logging with an unreachable sink took %s", took)
+	}
+	sk.flush(5 * time.Second)
+	if n := atomic.LoadInt64(&sk.dropped); n != 2*sinkQueue {
+		t.Errorf("%d lines dropped, want %d", n, 2*sinkQueue)
+	}
+}
@@ -0,0 +1,108 @@
+package logging
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sinkQueue is how many lines may wait for the collector before
+	// more are dropped.
+	sinkQueue = 1024
+	// sinkTimeout bounds each connection attempt and write, and
+	// sinkRetry is how long to wait after a failed one before trying
+	// again.
+	sinkTimeout = 5 * time.Second
+	sinkRetry   = time.Second
+)
+
+// A sink ships lines to a log collector for -log-sink, such as the
+// socket source of Vector or Fluent Bit. Lines are sent in the
+// background, never holding up the program: while the collector is
+// slow or unreachable they are dropped, and a line saying how many is
+// sent once it's back.
+type sink struct {
+	network, addr string
+	lines         chan []byte
+	pending       int64
+	dropped       int64
+}
+
+func newSink(spec string) (*sink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("-log-sink: %s", err.Error())
+	}
+	s := &sink{network: u.Scheme, lines: make(chan []byte, sinkQueue)}
+	switch u.Scheme {
+	case "tcp", "udp":
+		s.addr = u.Host
+	case "unix":
+		s.addr = u.Path
+	default:
+		return nil, fmt.Errorf("-log-sink: unknown scheme in %q (want tcp, udp or unix)", spec)
+	}
+	if s.addr == "" {
+		return nil, fmt.Errorf("-log-sink: no address in %q", spec)
+	}
+	go s.run()
+	return s, nil
+}
+
+// send queues line, or drops it if the queue is full.
+func (s *sink) send(line []byte) {
+	atomic.AddInt64(&s.pending, 1)
+	select {
+	case s.lines <- line:
+	default:
+		atomic.AddInt64(&s.pending, -1)
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// flush waits up to timeout for the queued lines to be sent or dropped.
+func (s *sink) flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&s.pending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *sink) run() {
+	var conn net.Conn
+	var retry time.Time
+	for line := range s.lines {
+		if conn == nil && time.Now().After(retry) {
+			c, err := net.DialTimeout(s.network, s.addr, sinkTimeout)
+			if err != nil {
+				retry = time.Now().Add(sinkRetry)
+			} else {
+				conn = c
+			}
+		}
+		if conn != nil {
+			n := atomic.SwapInt64(&s.dropped, 0)
+			if n > 0 {
+				output.Lock()
+				notice := std.format(time.Now().UTC(), LevelWarn,
+					fmt.Sprintf("dropped %d log lines while the log sink was unreachable", n), true)
+				output.Unlock()
+				line = append(notice, line...)
+			}
+			conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+			if _, err := conn.Write(line); err != nil {
+				atomic.AddInt64(&s.dropped, n)
+				conn.Close()
+				conn = nil
+				retry = time.Now().Add(sinkRetry)
+			}
+		}
+		if conn == nil {
+			atomic.AddInt64(&s.dropped, 1)
+		}
+		atomic.AddInt64(&s.pending, -1)
+	}
+}
@@ -0,0 +1,279 @@
+// Package metrics keeps counters, gauges and histograms in memory and
+// serves them in the Prometheus text exposition format, so that
+// binaries can be scraped on /metrics without a client library.
+//
+// Metrics are created on a Registry, each with the names of its labels;
+// every update gives a value for each of them, in order:
+//
+//	reg := metrics.NewRegistry()
+//	requests := reg.NewCounter("requests_total", "Requests served.", "status")
+//	requests.Inc("ok")
+//	http.Handle("/metrics", reg)
+//
+// Giving the wrong number of label values, or registering a name twice,
+// panics.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets, in seconds, suited to timing
+// requests.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type kind int
+
+const (
+	counter kind = iota
+	gauge
+	histogram
+)
+
+func (k kind) String() string {
+	return [...]string{"counter", "gauge", "histogram"}[k]
+}
+
+// A Registry holds a set of metrics, and serves them over HTTP.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+type family struct {
+	name, help string
+	kind       kind
+	labels     []string
+	buckets    []float64
+	series     map[string]*series
+	fn         func() float64
+}
+
+type series struct {
+	values []string
+	value  float64
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+}
+
+func (r *Registry) add(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[f.name]; ok {
+		panic("metrics: " + f.name + " registered twice")
+	}
+	f.series = map[string]*series{}
+	if len(f.labels) == 0 && f.fn == nil {
+		// Report unlabelled metrics from the start, as 0.
+		f.get(nil)
+	}
+	r.families[f.name] = f
+	return f
+}
+
+// get returns the series for values, creating it if need be. The
+// registry's lock must be held.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.kind == histogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// A Counter is a value that only goes up, such as a number of requests.
+type Counter struct {
+	r *Registry
+	f *family
+}
+
+// NewCounter registers a counter. Its name should end in _total.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r, r.add(&family{name: name, help: help, kind: counter, labels: labels})}
+}
+
+// Add adds v, which must not be negative, to the series labelled
+// values.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: " + c.f.name + " can't go down")
+	}
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.f.get(values).value += v
+}
+
+// Inc adds 1 to the series labelled values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// A Gauge is a value that goes up and down, such as a size.
+type Gauge struct {
+	r *Registry
+	f *family
+}
+
+// NewGauge registers a gauge.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r, r.add(&family{name: name, help: help, kind: gauge, labels: labels})}
+}
+
+// Set sets the series labelled values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.r.mu.Lock()
+	defer g.r.mu.Unlock()
+	g.f.get(values).value = v
+}
+
+// Add adds v, which may be negative, to the series labelled values.
+func (g *Gauge) Add(v float64, values ...string) {
+	g.r.mu.Lock()
+	defer g.r.mu.Unlock()
+	g.f.get(values).value += v
+}
+
+// NewGaugeFunc registers an unlabelled gauge whose value is fn's
+// whenever the metrics are served.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.add(&family{name: name, help: help, kind: gauge, fn: fn})
+}
+
+// A Histogram counts observations, such as latencies, into buckets.
+type Histogram struct {
+	r *Registry
+	f *family
+}
+
+// NewHistogram registers a histogram with the given bucket upper
+// bounds, which must be sorted; a +Inf bucket is added.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: " + name + " buckets aren't sorted")
+	}
+	return &Histogram{r, r.add(&family{name: name, help: help, kind: histogram, labels: labels,
+		buckets: append([]float64(nil), buckets...)})}
+}
+
+// Observe counts v in the series labelled values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.r.mu.Lock()
+	defer h.r.mu.Unlock()
+	s := h.f.get(values)
+	if i := sort.SearchFloat64s(h.f.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.count++
+	s.value += v
+}
+
+// ServeHTTP serves the metrics in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// Write writes the metrics in the text exposition format, sorted by
+// name and then by label values.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]*family, len(names))
+	for i, name := range names {
+		families[i] = r.families[name]
+	}
+	r.mu.Unlock()
+
+	b := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, helpEscaper.Replace(f.help), f.name, f.kind)
+		if f.fn != nil {
+			// Called without the lock, in case fn reads other metrics.
+			fmt.Fprintf(b, "%s %s\n", f.name, formatValue(f.fn()))
+			continue
+		}
+		r.mu.Lock()
+		f.write(b)
+		r.mu.Unlock()
+	}
+	return b.Flush()
+}
+
+// write writes f's series. The registry's lock must be held.
+func (f *family) write(b *bufio.Writer) {
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.kind != histogram {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, f.labelString(s.values, ""), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, c := range s.counts {
+			cumulative += c
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelString(s.values, formatValue(f.buckets[i])), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelString(s.values, "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, f.labelString(s.values, ""), formatValue(s.value))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, f.labelString(s.values, ""), s.count)
+	}
+}
+
+// labelString formats values as f's labels, and le as a histogram
+// bucket's, if it is set.
+func (f *family) labelString(values []string, le string) string {
+	var parts []string
+	for i, v := range values {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, f.labels[i], labelEscaper.Replace(v)))
+	}
+	if le != "" {
+		parts = append(parts, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Requests served.", "backend", "status")
+	requests.Inc("a", "ok")
+	requests.Add(2, "a", "ok")
+	requests.Inc(`b"\`, "error")
+	r.NewCounter("failures_total", "Failures,\nby cause.")
+	inFlight := r.NewGauge("in_flight", "Requests being served.")
+	inFlight.Add(2)
+	inFlight.Add(-1)
+	r.NewGaugeFunc("answer", "The answer.", func() float64 { return 42 })
+	latency := r.NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1}, "backend")
+	latency.Observe(0.05, "a")
+	latency.Observe(0.1, "a")
+	latency.Observe(0.5, "a")
+	latency.Observe(3, "a")
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP answer The answer.
+# TYPE answer gauge
+answer 42
+# HELP failures_total Failures,\nby cause.
+# TYPE failures_total counter
+failures_total 0
+# HELP in_flight Requests being served.
+# TYPE in_flight gauge
+in_flight 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{backend="a",le="0.1"} 2
+latency_seconds_bucket{backend="a",le="1"} 3
+latency_seconds_bucket{backend="a",le="+Inf"} 4
+latency_seconds_sum{backend="a"} 3.65
+latency_seconds_count{backend="a"} 4
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{backend="a",status="ok"} 3
+requests_total{backend="b\"\\",status="error"} 1
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Write:\n%s\nwant:\n%s", got, want)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if w.Body.String() != want {
+		t.Errorf("ServeHTTP served a different body")
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.", "status")
+	for name, f := range map[string]func(){
+		"too few labels":  func() { c.Inc() },
+		"too many labels": func() { c.Inc("ok", "extra") },
+		"negative add":    func() { c.Add(-1, "ok") },
+		"registered twice": func() {
+			r.NewGauge("requests_total", "Again.")
+		},
+		"unsorted buckets": func() {
+			r.NewHistogram("latency_seconds", "Latency.", []float64{1, 0.1})
+		},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
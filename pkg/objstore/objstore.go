@@ -0,0 +1,232 @@
+// Package objstore copies indexes, and the repository bundles that go
+// with them, to and from object storage, so that they can be built on
+// one machine and served from others: livegrep-fetch-reindex uploads
+// them and downloads them on serving hosts, and the frontend downloads
+// the index of a backend it runs.
+//
+// Rather than linking in each provider's SDK, objects are copied with
+// the provider's own command line tool, which must be installed and
+// configured with credentials: aws for s3:// URLs, gsutil for gs://
+// and azcopy for Azure blob URLs. file:// URLs name a directory, such
+// as a shared mount, and are copied directly.
+package objstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+)
+
+// Latest is the object in a prefix that names the index last uploaded
+// to it.
+const Latest = "latest"
+
+// Supported reports whether url is object storage objstore can copy to
+// and from.
+func Supported(url string) bool {
+	_, err := copyCommand(url)
+	return err == nil
+}
+
+// copyCommand returns the command that copies between a local file and
+// the object at url (or the other way around), or nil for file:// URLs,
+// which are copied directly.
+func copyCommand(url string) ([]string, error) {
+	switch {
+	case strings.HasPrefix(url, "s3://"):
+		return []string{"aws", "s3", "cp", "--only-show-errors"}, nil
+	case strings.HasPrefix(url, "gs://"):
+		return []string{"gsutil", "-q", "cp"}, nil
+	case strings.HasPrefix(url, "https://") && strings.Contains(url, ".blob.core.windows.net/"):
+		return []string{"azcopy", "copy", "--log-level=ERROR"}, nil
+	case strings.HasPrefix(url, "file://"):
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported object storage URL (want s3://, gs://, https://<account>.blob.core.windows.net/ or file://)", url)
+}
+
+// Copy copies src to dst, one of which is a local path and the other an
+// object URL.
+func Copy(src, dst string) error {
+	url := src
+	if Supported(dst) {
+		url = dst
+	}
+	argv, err := copyCommand(url)
+	if err != nil {
+		return err
+	}
+	if argv == nil {
+		return copyFile(strings.TrimPrefix(src, "file://"), strings.TrimPrefix(dst, "file://"))
+	}
+	argv = append(argv, src, dst)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", strings.Join(argv, " "), err.Error())
+	}
+	return nil
+}
+
+// copyFile copies src to dst through a temporary file beside dst, so
+// that readers of dst never see it half written.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, in)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), dst)
+}
+
+// Join returns the URL of the object name in prefix.
+func Join(prefix, name string) string {
+	return strings.TrimRight(prefix, "/") + "/" + name
+}
+
+// Put writes data to the object at url.
+func Put(data, url string) error {
+	tmp, err := ioutil.TempFile("", "livegrep-upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(data)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return Copy(tmp.Name(), url)
+}
+
+// Get reads the object at url, which must be small, as Latest is.
+func Get(url string) (string, error) {
+	tmp, err := ioutil.TempFile("", "livegrep-download")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := Copy(url, tmp.Name()); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(tmp.Name())
+	return string(data), err
+}
+
+// Upload uploads the file at p, and its checksum line (a sum and a
+// name, as sha256sum writes them), to prefix as name, and then points
+// prefix's Latest object at it, so that downloaders never see a
+// half-uploaded index.
+func Upload(p, sum, prefix, name string) error {
+	fields := strings.Fields(sum)
+	if len(fields) == 0 {
+		return fmt.Errorf("%s: empty checksum", p)
+	}
+	if err := Copy(p, Join(prefix, name)); err != nil {
+		return err
+	}
+	if err := Put(fmt.Sprintf("%s  %s\n", fields[0], name), Join(prefix, name+".sha256")); err != nil {
+		return err
+	}
+	if err := Put(name+"\n", Join(prefix, Latest)); err != nil {
+		return err
+	}
+	logging.Infof("Uploaded %s to %s", name, Join(prefix, name))
+	return nil
+}
+
+// Download fetches the index prefix's Latest object names to the path
+// dst returns for that name, unless the checksum file next to that path
+// says it was downloaded already, and verifies its checksum. It returns
+// the path it was written to, or "" if there was nothing new.
+func Download(prefix string, dst func(name string) string) (string, error) {
+	data, err := Get(Join(prefix, Latest))
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(data)
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("%s: bad latest object %q", prefix, name)
+	}
+
+	p := dst(name)
+	// The checksum next to the index in place records which upload it
+	// came from.
+	if have, err := ioutil.ReadFile(p + ".sha256"); err == nil {
+		if f := strings.Fields(string(have)); len(f) == 2 && f[1] == name {
+			return "", nil
+		}
+	}
+
+	tmp := p + ".tmp"
+	defer os.Remove(tmp)
+	defer os.Remove(tmp + ".sha256")
+	if err := Copy(Join(prefix, name), tmp); err != nil {
+		return "", err
+	}
+	if err := Copy(Join(prefix, name+".sha256"), tmp+".sha256"); err != nil {
+		return "", err
+	}
+	sum, err := ioutil.ReadFile(tmp + ".sha256")
+	if err != nil {
+		return "", err
+	}
+	if err := CheckSum(tmp, sum); err != nil {
+		return "", fmt.Errorf("%s: %s", name, err.Error())
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp+".sha256", p+".sha256"); err != nil {
+		return "", err
+	}
+	logging.Infof("Downloaded %s to %s", name, p)
+	return p, nil
+}
+
+// CheckSum compares the file at p with a checksum line as sha256sum
+// writes them.
+func CheckSum(p string, line []byte) error {
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty checksum")
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if fmt.Sprintf("%x", h.Sum(nil)) != fields[0] {
+		return fmt.Errorf("checksum mismatch; the download is corrupt")
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package objstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checksum(data string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+}
+
+func TestUploadDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prefix := "file://" + filepath.Join(dir, "bucket", "livegrep") + "/"
+	local := filepath.Join(dir, "serving")
+	os.MkdirAll(local, 0755)
+
+	upload := func(name, data string) {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := Upload(p, checksum(data)+"  "+name+"\n", prefix, name); err != nil {
+			t.Fatalf("Upload(%s): %v", name, err)
+		}
+	}
+	dst := func(name string) string { return filepath.Join(local, "livegrep.idx") }
+
+	upload("a.idx", "first index")
+	p, err := Download(prefix, dst)
+	if err != nil || p != dst("") {
+		t.Fatalf("Download = %q, %v, want %q", p, err, dst(""))
+	}
+	if data, _ := ioutil.ReadFile(p); string(data) != "first index" {
+		t.Errorf("downloaded %q", data)
+	}
+
+	// Nothing new to fetch.
+	if p, err := Download(prefix, dst); err != nil || p != "" {
+		t.Errorf("Download again = %q, %v, want nothing", p, err)
+	}
+
+	upload("b.idx", "second index")
+	if p, err := Download(prefix, dst); err != nil || p == "" {
+		t.Fatalf("Download after a new upload = %q, %v", p, err)
+	}
+	if data, _ := ioutil.ReadFile(dst("")); string(data) != "second index" {
+		t.Errorf("downloaded %q after a new upload", data)
+	}
+
+	// A corrupt upload is refused, leaving the index in place.
+	upload("c.idx", "third index")
+	ioutil.WriteFile(filepath.Join(dir, "bucket", "livegrep", "c.idx"), []byte("garbage"), 0644)
+	if _, err := Download(prefix, dst); err == nil {
+		t.Errorf("Download of a corrupt index succeeded")
+	}
+	if data, _ := ioutil.ReadFile(dst("")); string(data) != "second index" {
+		t.Errorf("a corrupt download replaced the index with %q", data)
+	}
+}
+
+func TestDownloadBadLatest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prefix := "file://" + dir
+	if err := Put("../etc/passwd\n", Join(prefix, Latest)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Download(prefix, func(name string) string { return filepath.Join(dir, name) }); err == nil {
+		t.Errorf("Download followed a latest object naming another directory")
+	}
+}
+
+func TestSupported(t *testing.T) {
+	for url, want := range map[string]bool{
+		"s3://bucket/livegrep":                          true,
+		"gs://bucket/livegrep":                          true,
+		"https://acct.blob.core.windows.net/c/livegrep": true,
+		"file:///mnt/shared/livegrep":                   true,
+		"https://example.com/livegrep":                  false,
+		"/mnt/shared/livegrep":                          false,
+	} {
+		if got := Supported(url); got != want {
+			t.Errorf("Supported(%q) = %v, want %v", url, got, want)
+		}
+	}
+}
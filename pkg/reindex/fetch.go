@@ -0,0 +1,158 @@
+package reindex
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+)
+
+// A Fetcher brings the clones of the repositories in the config at
+// configPath up to date: all of them, or, if only isn't nil, the ones
+// it names and any not cloned yet.
+type Fetcher interface {
+	Fetch(ctx context.Context, configPath string, only []string) error
+}
+
+// An IndexBuilder builds the index of the config at configPath from
+// the clones as they are.
+type IndexBuilder interface {
+	Build(ctx context.Context, configPath string) error
+}
+
+// FetchReindex runs livegrep-fetch-reindex, as the reindex tools do. It
+// is both a Fetcher and an IndexBuilder, but Run does both in one go.
+type FetchReindex struct {
+	// The livegrep-fetch-reindex binary; FindBinary's if ""
+	Binary string
+	// The index to write, and the codesearch binary to write it with,
+	// if not fetch-reindex's defaults
+	Index      string
+	Codesearch string
+	// How many repositories to fetch at once, if not fetch-reindex's
+	// default
+	Workers int
+	// Further flags, such as --revparse or --incremental
+	Args []string
+	// Added to the environment, such as the PasswordEnv of the repos
+	Env []string
+	// Where to keep the report of each run; a temporary file if ""
+	ReportOut string
+	// Where fetch-reindex's output goes; os.Stdout and os.Stderr if nil
+	Stdout, Stderr io.Writer
+}
+
+// Run fetches the repositories in the config at configPath, or, if
+// only isn't nil, the ones it names and any not cloned yet, and builds
+// the index. It returns fetch-reindex's report of the run, even if the
+// run failed, as long as it got far enough to write one.
+func (f *FetchReindex) Run(ctx context.Context, configPath string, only []string) (*Report, error) {
+	return f.run(ctx, configPath, only, false)
+}
+
+// Fetch fetches the repositories, as Run does, without building the
+// index.
+func (f *FetchReindex) Fetch(ctx context.Context, configPath string, only []string) error {
+	_, err := f.run(ctx, configPath, only, true)
+	return err
+}
+
+// Build builds the index, fetching only the repositories that aren't
+// cloned yet.
+func (f *FetchReindex) Build(ctx context.Context, configPath string) error {
+	_, err := f.run(ctx, configPath, []string{}, false)
+	return err
+}
+
+func (f *FetchReindex) run(ctx context.Context, configPath string, only []string, noIndex bool) (*Report, error) {
+	reportOut := f.ReportOut
+	if reportOut == "" {
+		tmp, err := ioutil.TempFile("", "livegrep-report-*.json")
+		if err != nil {
+			return nil, err
+		}
+		tmp.Close()
+		reportOut = tmp.Name()
+		defer os.Remove(reportOut)
+	}
+
+	args := f.args(configPath, only, noIndex, reportOut)
+	binary := f.Binary
+	if binary == "" {
+		binary = FindBinary("livegrep-fetch-reindex")
+	}
+
+	logging.Infof("Running: %s %v", binary, args)
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout, cmd.Stderr = f.Stdout, f.Stderr
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	if len(f.Env) > 0 {
+		cmd.Env = append(os.Environ(), f.Env...)
+	}
+	start := time.Now()
+	runErr := cmd.Run()
+
+	report, err := LoadReport(reportOut)
+	if err == nil && report.Started.Before(start) {
+		// An earlier run's, so this one didn't get far enough.
+		report, err = nil, fmt.Errorf("%s wasn't written", reportOut)
+	}
+	if runErr != nil {
+		return report, fmt.Errorf("livegrep-fetch-reindex: %s", runErr.Error())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("livegrep-fetch-reindex report: %s", err.Error())
+	}
+	return report, nil
+}
+
+func (f *FetchReindex) args(configPath string, only []string, noIndex bool, reportOut string) []string {
+	var args []string
+	if f.Index != "" {
+		args = append(args, "--out", f.Index)
+	}
+	if f.Codesearch != "" {
+		args = append(args, "--codesearch", f.Codesearch)
+	}
+	if f.Workers != 0 {
+		args = append(args, "--num-workers", strconv.Itoa(f.Workers))
+	}
+	args = append(args, f.Args...)
+	if noIndex {
+		args = append(args, "--no-index")
+	}
+	args = append(args, "--report-out", reportOut)
+	if only != nil {
+		args = append(args, "--fetch-only="+strings.Join(only, ","))
+	}
+	return append(args, configPath)
+}
+
+// FindBinary returns the path of the livegrep binary name, looking
+// next to the running one, as the binaries are installed together, and
+// otherwise leaving it to be found on $PATH.
+func FindBinary(name string) string {
+	paths := []string{
+		path.Join(path.Dir(os.Args[0]), name),
+		strings.Replace(os.Args[0], path.Base(os.Args[0]), name, -1),
+	}
+	for _, try := range paths {
+		if st, err := os.Stat(try); err == nil && (st.Mode()&os.ModeDir) == 0 {
+			return try
+		}
+	}
+	return name
+}
@@ -0,0 +1,305 @@
+package reindex
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/sentry"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// A StringList is a flag that may be passed multiple times, collecting
+// each value.
+type StringList []string
+
+func (s *StringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *StringList) Set(str string) error {
+	*s = append(*s, str)
+	return nil
+}
+
+func (s *StringList) Get() interface{} {
+	return []string(*s)
+}
+
+// FlagOptions says which of the flags that only some code hosts can
+// honor RegisterFlags registers.
+type FlagOptions struct {
+	// -share-objects, for hosts that say what each fork was forked
+	// from
+	Forks bool
+	// -max-repo-size-mb and the -large-repo flags, for hosts that
+	// report the size of each repository
+	Sizes bool
+}
+
+// Flags are the flags the reindex tools share, which say where to keep
+// the clones, how to configure and clone every repository, and what
+// livegrep-fetch-reindex is run with.
+type Flags struct {
+	Codesearch   string
+	FetchReindex string
+	Dir          string
+	Name         string
+	Workers      int
+	Revparse     bool
+	SkipMissing  bool
+	ShareObjects bool
+	ConfigFormat string
+	DryRun       bool
+	DryRunOut    string
+
+	Ignorelist        string
+	Allowlist         string
+	RevisionOverrides string
+	Revisions         StringList
+	Labels            StringList
+
+	Depth          int
+	DepthOverrides string
+	MaxRepoSize    int64
+	LargeDepth     int
+	LargeFilter    string
+
+	NoIndex          bool
+	UploadURL        string
+	UploadBundles    bool
+	ReportOut        string
+	MaxFileSize      int64
+	ExcludeGenerated bool
+	Incremental      bool
+	ReloadBackend    string
+
+	index string
+}
+
+// RegisterFlags registers the flags the reindex tools share on fs, and
+// returns what they are set to once fs is parsed.
+func RegisterFlags(fs *flag.FlagSet, opts FlagOptions) *Flags {
+	f := &Flags{}
+	fs.StringVar(&f.Codesearch, "codesearch", "", "Path to the `codesearch` binary")
+	fs.StringVar(&f.FetchReindex, "fetch-reindex", "", "Path to the `livegrep-fetch-reindex` binary")
+	fs.StringVar(&f.Dir, "dir", "repos", "Directory to store repos")
+	fs.Var(&indexPath{f}, "out", "Path to write the index")
+	fs.StringVar(&f.Name, "name", "livegrep index", "The name to be stored in the index file")
+	fs.IntVar(&f.Workers, "num-repo-update-workers", 8, "Number of workers fetch-reindex will use to update repositories")
+	fs.BoolVar(&f.Revparse, "revparse", true, "whether to `git rev-parse` the provided revision in generated links")
+	fs.BoolVar(&f.SkipMissing, "skip-missing", false, "skip repositories where the specified revision is missing")
+	fs.StringVar(&f.ConfigFormat, "config-format", "json", "Format of the generated index config (json or yaml)")
+	fs.BoolVar(&f.DryRun, "dry-run", false, "Show how the generated config differs from the one in -dir, without replacing it, fetching or indexing")
+	fs.StringVar(&f.DryRunOut, "dry-run-out", "", "With -dry-run, write the generated config to this `file`, or - for stdout")
+
+	fs.StringVar(&f.Ignorelist, "ignorelist", "", "File containing a list of repositories to ignore when indexing, as names, globs or ^regexps")
+	fs.StringVar(&f.Allowlist, "allowlist", "", "File containing a list of repositories to index, as names, globs or ^regexps; others are ignored")
+	fs.StringVar(&f.RevisionOverrides, "revision-overrides", "", "YAML or JSON file mapping repository name patterns to the revisions to index them at instead of -revision")
+	fs.Var(&f.Revisions, "revision", "git revision to index, by default HEAD (may be passed multiple times, or comma-separated)")
+	fs.Var(&f.Labels, "label", "Attach a key=value label to every repository (may be passed multiple times)")
+
+	fs.IntVar(&f.Depth, "depth", 0, "clone repository with specify --depth=N depth.")
+	fs.StringVar(&f.DepthOverrides, "depth-overrides", "", "YAML or JSON file mapping repository name patterns to the clone depth to use for them instead of -depth, 0 for all of history")
+	if opts.Sizes {
+		fs.Int64Var(&f.MaxRepoSize, "max-repo-size-mb", 0, "clone repositories larger than this many MB, as the API reports them, at -large-repo-depth and with -large-repo-filter (0 for no limit)")
+		fs.IntVar(&f.LargeDepth, "large-repo-depth", 1, "clone depth for repositories over -max-repo-size-mb, 0 for all of history")
+		fs.StringVar(&f.LargeFilter, "large-repo-filter", "", "partial clone filter, blob:none or blob:limit=<size>, for repositories over -max-repo-size-mb")
+	}
+	if opts.Forks {
+		fs.BoolVar(&f.ShareObjects, "share-objects", false, "Clone each fork borrowing the objects of the repository it was forked from, when that is indexed too, rather than storing copies of them")
+	}
+
+	fs.BoolVar(&f.NoIndex, "no-index", false, "Skip indexing after writing config and fetching")
+	fs.StringVar(&f.UploadURL, "upload-url", "", "Have fetch-reindex upload each new index to this object storage `prefix`, for frontends and codesearch hosts to download")
+	fs.BoolVar(&f.UploadBundles, "upload-bundles", false, "With -upload-url, have fetch-reindex also upload a git bundle of each repository")
+	fs.StringVar(&f.ReportOut, "report-out", "", "Have fetch-reindex write a JSON report of each run to this `file`")
+	fs.Int64Var(&f.MaxFileSize, "max-file-size", 0, "Have fetch-reindex skip files larger than this many bytes")
+	fs.BoolVar(&f.ExcludeGenerated, "exclude-generated", false, "Have fetch-reindex skip generated, vendored and minified files")
+	fs.BoolVar(&f.Incremental, "incremental", false, "Have fetch-reindex copy repositories whose revisions haven't changed from the previous index")
+	fs.StringVar(&f.ReloadBackend, "reload-backend", "", "Comma-separated backends for fetch-reindex to reload after each build")
+	return f
+}
+
+// indexPath is the -out flag, which defaults to livegrep.idx in -dir.
+type indexPath struct {
+	f *Flags
+}
+
+func (p *indexPath) String() string {
+	if p.f == nil || p.f.index == "" {
+		return "${dir}/livegrep.idx"
+	}
+	return p.f.index
+}
+
+func (p *indexPath) Set(str string) error {
+	p.f.index = str
+	return nil
+}
+
+// Index returns the index to write: -out, or livegrep.idx in -dir.
+func (f *Flags) Index() string {
+	if f.index != "" {
+		return f.index
+	}
+	return path.Join(f.Dir, "livegrep.idx")
+}
+
+// ConfigPath returns where to write the config, in -config-format.
+func (f *Flags) ConfigPath() (string, error) {
+	format, err := indexspec.ParseFormat(f.ConfigFormat)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(f.Dir, "livegrep"+format.Ext()), nil
+}
+
+// Options returns how the flags ask BuildConfig to configure
+// repositories, loading the files they name. The URLPattern is left to
+// the tool.
+func (f *Flags) Options() (*Options, error) {
+	labels, err := indexspec.ParseLabels(f.Labels)
+	if err != nil {
+		return nil, err
+	}
+	var overrides *indexspec.RevisionOverrides
+	if f.RevisionOverrides != "" {
+		overrides, err = indexspec.LoadRevisionOverrides(f.RevisionOverrides)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %s", f.RevisionOverrides, err.Error())
+		}
+	}
+	policy, err := f.ClonePolicy()
+	if err != nil {
+		return nil, err
+	}
+	return &Options{
+		Name:              f.Name,
+		Dir:               f.Dir,
+		Revisions:         f.revisions(),
+		RevisionOverrides: overrides,
+		ClonePolicy:       policy,
+		Labels:            labels,
+		SkipMissing:       f.SkipMissing,
+		ShareObjects:      f.ShareObjects,
+	}, nil
+}
+
+// revisions returns the revisions to index every repository at: those
+// given to -revision, which may each list several separated by commas,
+// or HEAD.
+func (f *Flags) revisions() []string {
+	var out []string
+	for _, s := range f.Revisions {
+		for _, rev := range strings.Split(s, ",") {
+			if rev = strings.TrimSpace(rev); rev != "" {
+				out = append(out, rev)
+			}
+		}
+	}
+	if len(out) == 0 {
+		return []string{"HEAD"}
+	}
+	return out
+}
+
+// ClonePolicy returns the ClonePolicy the clone depth flags ask for.
+func (f *Flags) ClonePolicy() (*indexspec.ClonePolicy, error) {
+	p := &indexspec.ClonePolicy{
+		Depth:       f.Depth,
+		MaxSize:     f.MaxRepoSize << 20,
+		LargeDepth:  f.LargeDepth,
+		LargeFilter: f.LargeFilter,
+	}
+	if f.DepthOverrides != "" {
+		o, err := indexspec.LoadDepthOverrides(f.DepthOverrides)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %s", f.DepthOverrides, err.Error())
+		}
+		p.Overrides = o
+	}
+	return p, nil
+}
+
+// RepoLists loads the -ignorelist and the -allowlist, each nil if it
+// isn't set.
+func (f *Flags) RepoLists() (ignorelist, allowlist *indexspec.RepoList, err error) {
+	if ignorelist, err = loadRepoList(f.Ignorelist); err != nil {
+		return nil, nil, err
+	}
+	if allowlist, err = loadRepoList(f.Allowlist); err != nil {
+		return nil, nil, err
+	}
+	return ignorelist, allowlist, nil
+}
+
+func loadRepoList(path string) (*indexspec.RepoList, error) {
+	if path == "" {
+		return nil, nil
+	}
+	l, err := indexspec.LoadRepoList(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %s", path, err.Error())
+	}
+	return l, nil
+}
+
+// WriteConfig writes cfg to configPath or, with -dry-run, shows how it
+// differs from the config there instead.
+func (f *Flags) WriteConfig(configPath string, cfg *config.IndexSpec) error {
+	if f.DryRun {
+		return indexspec.DryRun(configPath, cfg, f.DryRunOut)
+	}
+	return indexspec.Write(configPath, cfg)
+}
+
+// FetchArgs returns the flags to run livegrep-fetch-reindex with, as
+// well as the logging and sentry ones this process was given.
+func (f *Flags) FetchArgs() []string {
+	args := append(logging.Args(), sentry.Args()...)
+	if f.NoIndex {
+		args = append(args, "--no-index")
+	}
+	if f.Revparse {
+		args = append(args, "--revparse")
+	}
+	if f.SkipMissing {
+		args = append(args, "--skip-missing")
+	}
+	if f.UploadURL != "" {
+		args = append(args, "--upload="+f.UploadURL)
+	}
+	if f.UploadBundles {
+		args = append(args, "--upload-bundles")
+	}
+	if f.MaxFileSize != 0 {
+		args = append(args, fmt.Sprintf("--max-file-size=%d", f.MaxFileSize))
+	}
+	if f.ExcludeGenerated {
+		args = append(args, "--exclude-generated")
+	}
+	if f.Incremental {
+		args = append(args, "--incremental")
+	}
+	if f.ReloadBackend != "" {
+		args = append(args, "--reload-backend", f.ReloadBackend)
+	}
+	return args
+}
+
+// NewFetchReindex returns the FetchReindex the flags ask for, running
+// with FetchArgs.
+func (f *Flags) NewFetchReindex() *FetchReindex {
+	return &FetchReindex{
+		Binary:     f.FetchReindex,
+		Index:      f.Index(),
+		Codesearch: f.Codesearch,
+		Workers:    f.Workers,
+		Args:       f.FetchArgs(),
+		ReportOut:  f.ReportOut,
+	}
+}
@@ -0,0 +1,108 @@
+package reindex
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func parseFlags(t *testing.T, opts FlagOptions, args ...string) *Flags {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := RegisterFlags(fs, opts)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFlagsDefaults(t *testing.T) {
+	f := parseFlags(t, FlagOptions{}, "-dir", "/srv/repos")
+	if got := f.Index(); got != "/srv/repos/livegrep.idx" {
+		t.Errorf("Index: got %q", got)
+	}
+	if got, err := f.ConfigPath(); err != nil || got != "/srv/repos/livegrep.json" {
+		t.Errorf("ConfigPath: got %q, %v", got, err)
+	}
+	opts, err := f.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(opts.Revisions, []string{"HEAD"}) {
+		t.Errorf("Revisions: got %q", opts.Revisions)
+	}
+	if got, want := f.FetchArgs(), []string{"--revparse"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FetchArgs: got %q, want %q", got, want)
+	}
+}
+
+func TestFlagsOptions(t *testing.T) {
+	f := parseFlags(t, FlagOptions{Forks: true, Sizes: true},
+		"-out", "/tmp/x.idx", "-config-format", "yaml", "-name", "test",
+		"-revision", "main, release", "-revision", "v1",
+		"-label", "team=search", "-depth", "3",
+		"-max-repo-size-mb", "2", "-large-repo-filter", "blob:none",
+		"-skip-missing", "-share-objects")
+	if got := f.Index(); got != "/tmp/x.idx" {
+		t.Errorf("Index: got %q", got)
+	}
+	if got, err := f.ConfigPath(); err != nil || got != "repos/livegrep.yaml" {
+		t.Errorf("ConfigPath: got %q, %v", got, err)
+	}
+	opts, err := f.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Options{
+		Name:         "test",
+		Dir:          "repos",
+		Revisions:    []string{"main", "release", "v1"},
+		ClonePolicy:  opts.ClonePolicy,
+		Labels:       map[string]string{"team": "search"},
+		SkipMissing:  true,
+		ShareObjects: true,
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("Options: got %+v, want %+v", opts, want)
+	}
+	if p := opts.ClonePolicy; p.Depth != 3 || p.MaxSize != 2<<20 || p.LargeDepth != 1 || p.LargeFilter != "blob:none" {
+		t.Errorf("ClonePolicy: got %+v", p)
+	}
+
+	if _, err := parseFlags(t, FlagOptions{}, "-config-format", "xml").ConfigPath(); err == nil {
+		t.Error("ConfigPath: want an error for -config-format xml")
+	}
+	if _, err := parseFlags(t, FlagOptions{}, "-label", "team").Options(); err == nil {
+		t.Error("Options: want an error for a label without a value")
+	}
+}
+
+func TestFlagsOnlyRegistered(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs, FlagOptions{})
+	for _, name := range []string{"share-objects", "max-repo-size-mb", "large-repo-depth", "large-repo-filter"} {
+		if fs.Lookup(name) != nil {
+			t.Errorf("-%s registered without being asked for", name)
+		}
+	}
+}
+
+func TestFetchArgs(t *testing.T) {
+	f := parseFlags(t, FlagOptions{},
+		"-revparse=false", "-no-index", "-skip-missing",
+		"-upload-url", "s3://bucket/livegrep", "-upload-bundles",
+		"-max-file-size", "1024", "-exclude-generated",
+		"-incremental", "-reload-backend", "a:9999,b:9999")
+	want := []string{
+		"--no-index", "--skip-missing",
+		"--upload=s3://bucket/livegrep", "--upload-bundles",
+		"--max-file-size=1024", "--exclude-generated",
+		"--incremental", "--reload-backend", "a:9999,b:9999",
+	}
+	if got := f.FetchArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("FetchArgs: got %q, want %q", got, want)
+	}
+	fr := f.NewFetchReindex()
+	if fr.Index != "repos/livegrep.idx" || fr.Workers != 8 || !reflect.DeepEqual(fr.Args, want) {
+		t.Errorf("NewFetchReindex: got %+v", fr)
+	}
+}
@@ -0,0 +1,382 @@
+// Package githubsource is a reindex.RepoSource for GitHub repositories,
+// as livegrep-github-reindex lists them.
+package githubsource
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/github"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/reindex"
+)
+
+// Workers is how many of the organizations, users and repositories of a
+// Source are listed at once.
+const Workers = 8
+
+// A Source lists Repositories, given as owner/name, and the
+// repositories of the organizations Orgs and the users Users.
+type Source struct {
+	Client *github.Client
+
+	Repositories []string
+	Orgs         []string
+	Users        []string
+	// Whether to list every repository the GitHub App installation
+	// Client authenticates as can see
+	Installation bool
+	// How many pages of each organization's or user's repositories to
+	// list at once; 1 if 0
+	MaxConcurrentRequests int
+	// Whether to list forks, and archived repositories
+	Forks    bool
+	Archived bool
+	// Whether to look up the repository each fork was made from, which
+	// the listings leave out, for reindex.Repo.Parent
+	ForkParents bool
+
+	// Whether to clone over HTTPS rather than SSH, and the credentials
+	// for reindex.Repo to clone with
+	HTTP         bool
+	Username     string
+	PasswordEnv  string
+	PasswordFile string
+}
+
+func (s *Source) Repos(ctx context.Context) ([]*reindex.Repo, error) {
+	ghRepos, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.ForkParents {
+		s.getParents(ctx, ghRepos)
+	}
+	repos := make([]*reindex.Repo, len(ghRepos))
+	for i, r := range ghRepos {
+		repos[i] = s.Repo(r)
+	}
+	return repos, nil
+}
+
+// Repo returns how to index r.
+func (s *Source) Repo(r *github.Repository) *reindex.Repo {
+	var remote string
+	if s.HTTP {
+		remote = *r.CloneURL
+	} else {
+		remote = *r.SSHURL
+	}
+	var size int64
+	if r.Size != nil {
+		// The API gives sizes in KB.
+		size = int64(*r.Size) << 10
+	}
+	var parent string
+	if r.Parent != nil && r.Parent.FullName != nil {
+		parent = *r.Parent.FullName
+	}
+	return &reindex.Repo{
+		Name:         *r.FullName,
+		Remote:       remote,
+		WebURL:       *r.HTMLURL,
+		Username:     s.Username,
+		PasswordEnv:  s.PasswordEnv,
+		PasswordFile: s.PasswordFile,
+		Size:         size,
+		Parent:       parent,
+	}
+}
+
+// List lists the repositories, leaving out forks and archived ones
+// unless Forks and Archived are set.
+func (s *Source) List(ctx context.Context) ([]*github.Repository, error) {
+	var jobs []loadJob
+	for _, repo := range s.Repositories {
+		jobs = append(jobs, loadJob{repo, s.getOneRepo})
+	}
+	for _, org := range s.Orgs {
+		jobs = append(jobs, loadJob{org, s.getOrgRepos})
+	}
+	for _, user := range s.Users {
+		jobs = append(jobs, loadJob{user, s.getUserRepos})
+	}
+	if s.Installation {
+		jobs = append(jobs, loadJob{"", s.getInstallationRepos})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobc := make(chan loadJob)
+	repoc := make(chan maybeRepo)
+	go func() {
+		defer close(jobc)
+		for _, j := range jobs {
+			select {
+			case jobc <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	wg.Add(Workers)
+	for i := 0; i < Workers; i++ {
+		go func() {
+			runJobs(ctx, jobc, repoc)
+			wg.Done()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(repoc)
+	}()
+	var out []*github.Repository
+	for repo := range repoc {
+		if repo.err != nil {
+			return nil, repo.err
+		}
+		for _, r := range repo.repos {
+			if s.keep(r) {
+				out = append(out, r)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+func (s *Source) keep(r *github.Repository) bool {
+	if !s.Forks && r.Fork != nil && *r.Fork {
+		logging.With("repo", *r.FullName).Infof("Excluding fork %s...", *r.FullName)
+		return false
+	}
+	if !s.Archived && r.Archived != nil && *r.Archived {
+		logging.With("repo", *r.FullName).Infof("Excluding archived %s...", *r.FullName)
+		return false
+	}
+	return true
+}
+
+// getParents fills in the Parent of each fork in repos, up to Workers
+// at once. A fork whose parent can't be looked up is indexed anyway,
+// just without one.
+func (s *Source) getParents(ctx context.Context, repos []*github.Repository) {
+	sem := make(chan struct{}, Workers)
+	var wg sync.WaitGroup
+	for _, r := range repos {
+		if r.Fork == nil || !*r.Fork || r.Parent != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(r *github.Repository) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			full, err := s.getOneRepo(ctx, *r.FullName)
+			if err != nil {
+				logging.With("repo", *r.FullName).Warnf("Looking up the parent of fork %s: %s", *r.FullName, err.Error())
+				return
+			}
+			r.Parent = full[0].Parent
+		}(r)
+	}
+	wg.Wait()
+}
+
+type loadJob struct {
+	obj string
+	get func(context.Context, string) ([]*github.Repository, error)
+}
+
+type maybeRepo struct {
+	repos []*github.Repository
+	err   error
+}
+
+func runJobs(ctx context.Context, jobc <-chan loadJob, out chan<- maybeRepo) {
+	for {
+		var job loadJob
+		var ok bool
+		select {
+		case job, ok = <-jobc:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		var res maybeRepo
+		res.repos, res.err = job.get(ctx, job.obj)
+		select {
+		case out <- res:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Source) getOneRepo(ctx context.Context, repo string) ([]*github.Repository, error) {
+	bits := strings.SplitN(repo, "/", 2)
+	if len(bits) != 2 {
+		return nil, fmt.Errorf("Bad repository: %s", repo)
+	}
+
+	ghRepo, _, err := s.Client.Repositories.Get(ctx, bits[0], bits[1])
+	if err != nil {
+		return nil, err
+	}
+	return []*github.Repository{ghRepo}, nil
+}
+
+type indexedResponse struct {
+	Page  int
+	Repos []*github.Repository
+	err   error
+}
+
+// listPages lists the pages after the first of a listing whose first
+// page was firstResult, up to MaxConcurrentRequests at once, and
+// returns all of them in order.
+func (s *Source) listPages(ctx context.Context, initialResp *github.Response, firstResult []*github.Repository,
+	list func(ctx context.Context, page int) ([]*github.Repository, error)) ([]*github.Repository, error) {
+	pagesToCall := initialResp.LastPage - 1
+	concurrencyLimit := s.MaxConcurrentRequests
+	if concurrencyLimit < 1 {
+		concurrencyLimit = 1
+	}
+
+	// create the matrix of results and add the first one - this is so we can maintain order
+	// which unfortunately takes an extra O(n) pass
+	resultsMatrix := make([][]*github.Repository, pagesToCall+1)
+	resultsMatrix[0] = firstResult
+
+	semaphores := make(chan bool, concurrencyLimit)
+	resStream := make(chan *indexedResponse, pagesToCall)
+	var wg sync.WaitGroup
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for i := 1; i <= pagesToCall; i++ {
+		wg.Add(1)
+
+		go func(page int) {
+			semaphores <- true // aquire semaphore
+			defer wg.Done()
+
+			repos, err := list(ctx, page)
+			resStream <- &indexedResponse{
+				Page:  page,
+				Repos: repos,
+				err:   err,
+			}
+			<-semaphores // release semaphore
+		}(i + 1) // + 1 because pages are 1 based, and we already called 1st to start with
+	}
+
+	// close the channel in the background
+	go func() {
+		wg.Wait()
+		close(resStream)
+		close(semaphores)
+	}()
+
+	for res := range resStream {
+		if res.err != nil {
+			return nil, res.err // cancel will be called after this early return
+		}
+		resultsMatrix[res.Page-1] = res.Repos // Page index is 1 based
+	}
+
+	// Now flatten the matrix and return it
+	var buf []*github.Repository
+	for _, res := range resultsMatrix {
+		buf = append(buf, res...)
+	}
+
+	return buf, nil
+}
+
+func (s *Source) getOrgRepos(ctx context.Context, org string) ([]*github.Repository, error) {
+	logging.Infof("Fetching repositories for organization: %s", org)
+
+	list := func(ctx context.Context, page int) ([]*github.Repository, error) {
+		repos, _, err := s.Client.Repositories.ListByOrg(ctx, org, &github.RepositoryListByOrgOptions{
+			ListOptions: github.ListOptions{PerPage: 100, Page: page},
+		})
+		return repos, err
+	}
+	opt := &github.RepositoryListByOrgOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	repos, resp, err := s.Client.Repositories.ListByOrg(ctx, org, opt)
+	if err != nil {
+		return nil, err
+	} else if resp.FirstPage == resp.LastPage { // if no more pages, return early
+		return repos, nil
+	}
+
+	// when MaxConcurrentRequests is 1 (default), behaves synchronously
+	return s.listPages(ctx, resp, repos, list)
+}
+
+func (s *Source) getUserRepos(ctx context.Context, user string) ([]*github.Repository, error) {
+	logging.Infof("Fetching repositories for user: %s", user)
+
+	list := func(ctx context.Context, page int) ([]*github.Repository, error) {
+		repos, _, err := s.Client.Repositories.List(ctx, user, &github.RepositoryListOptions{
+			ListOptions: github.ListOptions{PerPage: 100, Page: page},
+		})
+		return repos, err
+	}
+	opt := &github.RepositoryListOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	repos, resp, err := s.Client.Repositories.List(ctx, user, opt)
+	if err != nil {
+		return nil, err
+	} else if resp.FirstPage == resp.LastPage { // if no more pages, return early
+		return repos, nil
+	}
+
+	// when MaxConcurrentRequests is 1 (default), behaves synchronously
+	return s.listPages(ctx, resp, repos, list)
+}
+
+// getInstallationRepos lists the repositories the app installation can
+// see, with the installation endpoint, which the client doesn't wrap.
+func (s *Source) getInstallationRepos(ctx context.Context, _ string) ([]*github.Repository, error) {
+	logging.Infof("Fetching repositories for the app installation")
+
+	list := func(ctx context.Context, page int) ([]*github.Repository, error) {
+		repos, _, err := s.installationPage(ctx, page)
+		return repos, err
+	}
+	repos, resp, err := s.installationPage(ctx, 1)
+	if err != nil {
+		return nil, err
+	} else if resp.LastPage <= 1 { // if no more pages, return early
+		return repos, nil
+	}
+
+	return s.listPages(ctx, resp, repos, list)
+}
+
+func (s *Source) installationPage(ctx context.Context, page int) ([]*github.Repository, *github.Response, error) {
+	req, err := s.Client.NewRequest("GET", fmt.Sprintf("installation/repositories?per_page=100&page=%d", page), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var body struct {
+		Repositories []*github.Repository `json:"repositories"`
+	}
+	resp, err := s.Client.Do(ctx, req, &body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body.Repositories, resp, nil
+}
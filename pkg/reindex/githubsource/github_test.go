@@ -0,0 +1,111 @@
+package githubsource
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/github"
+
+	"github.com/livegrep/livegrep/pkg/reindex"
+)
+
+func TestRepo(t *testing.T) {
+	r := &github.Repository{
+		FullName: github.String("org/app"),
+		SSHURL:   github.String("git@github.com:org/app.git"),
+		CloneURL: github.String("https://github.com/org/app.git"),
+		HTMLURL:  github.String("https://github.com/org/app"),
+		Size:     github.Int(2048),
+	}
+	s := &Source{Username: "git", PasswordEnv: "GITHUB_KEY"}
+	want := &reindex.Repo{
+		Name:        "org/app",
+		Remote:      "git@github.com:org/app.git",
+		WebURL:      "https://github.com/org/app",
+		Username:    "git",
+		PasswordEnv: "GITHUB_KEY",
+		Size:        2 << 20,
+	}
+	if got := s.Repo(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("Repo = %+v, want %+v", got, want)
+	}
+	s.HTTP = true
+	if got := s.Repo(r).Remote; got != "https://github.com/org/app.git" {
+		t.Errorf("Repo over HTTP has remote %s", got)
+	}
+}
+
+func TestKeep(t *testing.T) {
+	fork := &github.Repository{FullName: github.String("me/fork"), Fork: github.Bool(true)}
+	archived := &github.Repository{FullName: github.String("org/old"), Archived: github.Bool(true)}
+	plain := &github.Repository{FullName: github.String("org/app")}
+	s := &Source{}
+	if s.keep(fork) || s.keep(archived) || !s.keep(plain) {
+		t.Error("by default, forks and archived repositories should be left out")
+	}
+	s = &Source{Forks: true, Archived: true}
+	if !s.keep(fork) || !s.keep(archived) {
+		t.Error("Forks and Archived should keep forks and archived repositories")
+	}
+}
+
+func TestInstallationRepos(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.HandleFunc("/installation/repositories", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "1":
+			last := srv.URL + "/installation/repositories?per_page=100&page=2"
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s>; rel="last"`, last, last))
+			fmt.Fprint(w, `{"total_count": 3, "repositories": [{"full_name": "org/a"}, {"full_name": "org/old", "archived": true}]}`)
+		case "2":
+			fmt.Fprint(w, `{"total_count": 3, "repositories": [{"full_name": "me/b"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	gh := github.NewClient(nil)
+	gh.BaseURL, _ = url.Parse(srv.URL + "/")
+
+	s := &Source{Client: gh, Installation: true}
+	repos, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range repos {
+		names = append(names, *r.FullName)
+	}
+	if want := []string{"org/a", "me/b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("installation repositories = %v, want %v", names, want)
+	}
+}
+
+func TestGetParents(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.HandleFunc("/repos/me/app", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"full_name": "me/app", "fork": true, "parent": {"full_name": "org/app"}}`)
+	})
+	gh := github.NewClient(nil)
+	gh.BaseURL, _ = url.Parse(srv.URL + "/")
+
+	fork := &github.Repository{FullName: github.String("me/app"), Fork: github.Bool(true)}
+	gone := &github.Repository{FullName: github.String("me/gone"), Fork: github.Bool(true)}
+	plain := &github.Repository{FullName: github.String("org/app")}
+	s := &Source{Client: gh, ForkParents: true}
+	s.getParents(context.Background(), []*github.Repository{fork, gone, plain})
+	if fork.Parent == nil || *fork.Parent.FullName != "org/app" {
+		t.Errorf("fork's parent = %+v, want org/app", fork.Parent)
+	}
+	if gone.Parent != nil || plain.Parent != nil {
+		t.Error("a parent for a fork that can't be looked up, or for a repository that isn't a fork")
+	}
+}
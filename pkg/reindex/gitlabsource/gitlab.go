@@ -0,0 +1,368 @@
+// Package gitlabsource is a reindex.RepoSource for GitLab projects, as
+// livegrep-gitlab-reindex lists them.
+package gitlabsource
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/reindex"
+)
+
+// How many times to try a GitLab API call that fails with a 429 or a
+// 5xx, and how long to wait before the second try, doubling each time
+// after that unless the response asks for a Retry-After.
+const (
+	apiAttempts = 5
+	apiBackoff  = time.Second
+)
+
+// A Source lists the projects in Groups, the personal projects of
+// Users and the projects named by Projects, or, if none are given,
+// every project with one of Topics, or every project the client can
+// see.
+type Source struct {
+	Client *gitlab.Client
+
+	Groups   []string
+	Users    []string
+	Projects []string
+	// Only list projects with one of Topics, and none of ExcludeTopics
+	Topics        []string
+	ExcludeTopics []string
+	// Only list projects at least this visible; all of them if ""
+	MinVisibility gitlab.VisibilityValue
+	// How many groups, users and projects to list at once; 1 if 0
+	Workers int
+	// Whether to list forks, and archived projects
+	Forks    bool
+	Archived bool
+
+	// Whether to clone over HTTPS rather than SSH, and the credentials
+	// for reindex.Repo to clone with
+	HTTP        bool
+	Username    string
+	PasswordEnv string
+}
+
+// ValidVisibility reports whether v is a visibility MinVisibility can
+// be set to.
+func ValidVisibility(v gitlab.VisibilityValue) bool {
+	_, ok := visibilityRank[v]
+	return ok || v == ""
+}
+
+// visibilityRank orders visibility levels from least to most visible,
+// for MinVisibility.
+var visibilityRank = map[gitlab.VisibilityValue]int{
+	gitlab.PrivateVisibility:  0,
+	gitlab.InternalVisibility: 1,
+	gitlab.PublicVisibility:   2,
+}
+
+func (s *Source) Repos(ctx context.Context) ([]*reindex.Repo, error) {
+	projects, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]*reindex.Repo, len(projects))
+	for i, p := range projects {
+		repos[i] = s.Repo(p)
+	}
+	return repos, nil
+}
+
+// Repo returns how to index p.
+func (s *Source) Repo(p *gitlab.Project) *reindex.Repo {
+	remote := p.SSHURLToRepo
+	if s.HTTP {
+		remote = p.HTTPURLToRepo
+	}
+	repo := &reindex.Repo{
+		Name:        p.PathWithNamespace,
+		Remote:      remote,
+		WebURL:      p.WebURL,
+		Username:    s.Username,
+		PasswordEnv: s.PasswordEnv,
+	}
+	if p.ForkedFromProject != nil {
+		repo.Parent = p.ForkedFromProject.PathWithNamespace
+	}
+	return repo
+}
+
+// List lists the projects Keep keeps. Up to Workers groups, users and
+// projects are listed at once, and a project listed more than once,
+// such as one in a group and a subgroup, is returned once.
+func (s *Source) List(ctx context.Context) ([]*gitlab.Project, error) {
+	var jobs []loadJob
+	for _, group := range s.Groups {
+		jobs = append(jobs, loadJob{group, s.getGroupProjects})
+	}
+	for _, user := range s.Users {
+		jobs = append(jobs, loadJob{user, s.getUserProjects})
+	}
+	for _, repo := range s.Projects {
+		jobs = append(jobs, loadJob{repo, s.getOneProject})
+	}
+	if len(jobs) == 0 {
+		for _, topic := range s.Topics {
+			jobs = append(jobs, loadJob{topic, s.getTopicProjects})
+		}
+	}
+	if len(jobs) == 0 {
+		jobs = append(jobs, loadJob{"", s.getAllProjects})
+	}
+
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobc := make(chan loadJob)
+	repoc := make(chan maybeRepo)
+	go func() {
+		defer close(jobc)
+		for _, j := range jobs {
+			select {
+			case jobc <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			runJobs(ctx, jobc, repoc)
+			wg.Done()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(repoc)
+	}()
+
+	var out []*gitlab.Project
+	seen := map[int]bool{}
+	for res := range repoc {
+		if res.err != nil {
+			return nil, res.err
+		}
+		for _, p := range res.repos {
+			if !seen[p.ID] && s.Keep(p) {
+				seen[p.ID] = true
+				out = append(out, p)
+			}
+		}
+	}
+	return out, nil
+}
+
+// Keep reports whether p, once listed, is to be indexed: whether it's
+// a fork, if Forks is false, and its visibility and topics. Archived
+// projects are left out when listing, where the API can do it.
+func (s *Source) Keep(p *gitlab.Project) bool {
+	if !s.Forks && p.ForkedFromProject != nil {
+		logging.With("repo", p.PathWithNamespace).Infof("Excluding fork %s, was forked from %s", p.PathWithNamespace, p.ForkedFromProject.PathWithNamespace)
+		return false
+	}
+	if s.MinVisibility != "" && visibilityRank[p.Visibility] < visibilityRank[s.MinVisibility] {
+		return false
+	}
+	if len(s.Topics) > 0 && !hasTopic(p, s.Topics) {
+		return false
+	}
+	if hasTopic(p, s.ExcludeTopics) {
+		logging.With("repo", p.PathWithNamespace).Infof("Excluding %s, which has an excluded topic", p.PathWithNamespace)
+		return false
+	}
+	return true
+}
+
+// InScope reports whether the project at name is one List would list,
+// topics aside: directly in one of Groups or the namespace of one of
+// Users, or named by Projects. Without any of them, every project is.
+func (s *Source) InScope(name string) bool {
+	if len(s.Groups) == 0 && len(s.Users) == 0 && len(s.Projects) == 0 {
+		return true
+	}
+	for _, ns := range append(append([]string{}, s.Groups...), s.Users...) {
+		if path.Dir(name) == ns {
+			return true
+		}
+	}
+	for _, repo := range s.Projects {
+		if name == repo {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTopic reports whether p has any of topics. GitLab compares topics
+// without regard to case, so this does too.
+func hasTopic(p *gitlab.Project, topics []string) bool {
+	for _, t := range p.Topics {
+		for _, want := range topics {
+			if strings.EqualFold(t, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type loadJob struct {
+	obj string
+	get func(context.Context, string) ([]*gitlab.Project, error)
+}
+
+type maybeRepo struct {
+	repos []*gitlab.Project
+	err   error
+}
+
+func runJobs(ctx context.Context, jobc <-chan loadJob, out chan<- maybeRepo) {
+	for {
+		var job loadJob
+		var ok bool
+		select {
+		case job, ok = <-jobc:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		var res maybeRepo
+		res.repos, res.err = job.get(ctx, job.obj)
+		select {
+		case out <- res:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Source) getGroupProjects(ctx context.Context, group string) ([]*gitlab.Project, error) {
+	var projects []*gitlab.Project
+	opt := &gitlab.ListGroupProjectsOptions{
+		ListOptions: gitlab.ListOptions{
+			PerPage: 100,
+			Page:    1,
+		},
+	}
+	for {
+		var ps []*gitlab.Project
+		resp, err := retryAPI(func() (resp *gitlab.Response, err error) {
+			ps, resp, err = s.Client.Groups.ListGroupProjects(group, opt, gitlab.WithContext(ctx))
+			return resp, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing group %s: %s", group, err.Error())
+		}
+		projects = append(projects, ps...)
+		if resp.NextPage == 0 {
+			return projects, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (s *Source) getUserProjects(ctx context.Context, user string) ([]*gitlab.Project, error) {
+	return s.listProjects(user, func(opt *gitlab.ListProjectsOptions) ([]*gitlab.Project, *gitlab.Response, error) {
+		return s.Client.Projects.ListUserProjects(user, opt, gitlab.WithContext(ctx))
+	})
+}
+
+// getAllProjects lists every project the client can see.
+func (s *Source) getAllProjects(ctx context.Context, _ string) ([]*gitlab.Project, error) {
+	return s.listProjects("projects", func(opt *gitlab.ListProjectsOptions) ([]*gitlab.Project, *gitlab.Response, error) {
+		return s.Client.Projects.ListProjects(opt, gitlab.WithContext(ctx))
+	})
+}
+
+// getTopicProjects lists every project the client can see with topic.
+func (s *Source) getTopicProjects(ctx context.Context, topic string) ([]*gitlab.Project, error) {
+	return s.listProjects("topic "+topic, func(opt *gitlab.ListProjectsOptions) ([]*gitlab.Project, *gitlab.Response, error) {
+		opt.Topic = gitlab.String(topic)
+		return s.Client.Projects.ListProjects(opt, gitlab.WithContext(ctx))
+	})
+}
+
+func (s *Source) listProjects(what string, list func(*gitlab.ListProjectsOptions) ([]*gitlab.Project, *gitlab.Response, error)) ([]*gitlab.Project, error) {
+	var projects []*gitlab.Project
+	opt := &gitlab.ListProjectsOptions{
+		Archived: gitlab.Bool(s.Archived),
+		ListOptions: gitlab.ListOptions{
+			PerPage: 100,
+			Page:    1,
+		},
+	}
+	for {
+		var ps []*gitlab.Project
+		resp, err := retryAPI(func() (resp *gitlab.Response, err error) {
+			ps, resp, err = list(opt)
+			return resp, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %s", what, err.Error())
+		}
+		projects = append(projects, ps...)
+		if resp.NextPage == 0 {
+			return projects, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (s *Source) getOneProject(ctx context.Context, repo string) ([]*gitlab.Project, error) {
+	var p *gitlab.Project
+	_, err := retryAPI(func() (resp *gitlab.Response, err error) {
+		p, resp, err = s.Client.Projects.GetProject(repo, nil, gitlab.WithContext(ctx))
+		return resp, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading project %s: %s", repo, err.Error())
+	}
+	return []*gitlab.Project{p}, nil
+}
+
+// retryAPI makes a GitLab API call, trying it again, up to apiAttempts
+// times in all, while it fails with a response that says the server is
+// overloaded or broken for now.
+func retryAPI(call func() (*gitlab.Response, error)) (*gitlab.Response, error) {
+	backoff := apiBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := call()
+		if err == nil || attempt >= apiAttempts || !transient(resp) {
+			return resp, err
+		}
+		wait := backoff
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			wait = time.Duration(s) * time.Second
+		}
+		logging.Warnf("GitLab API: %s; retrying in %s", err.Error(), wait)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+func transient(resp *gitlab.Response) bool {
+	if resp == nil || resp.Response == nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
@@ -0,0 +1,77 @@
+package gitlabsource
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/xanzy/go-gitlab"
+
+	"github.com/livegrep/livegrep/pkg/reindex"
+)
+
+func TestKeep(t *testing.T) {
+	s := &Source{
+		Topics:        []string{"Search"},
+		ExcludeTopics: []string{"deprecated"},
+		MinVisibility: gitlab.InternalVisibility,
+	}
+	cases := []struct {
+		name string
+		p    *gitlab.Project
+		want bool
+	}{
+		{"matching", &gitlab.Project{Topics: []string{"search"}, Visibility: gitlab.PublicVisibility}, true},
+		{"no topic", &gitlab.Project{Visibility: gitlab.PublicVisibility}, false},
+		{"excluded topic", &gitlab.Project{Topics: []string{"search", "Deprecated"}, Visibility: gitlab.PublicVisibility}, false},
+		{"private", &gitlab.Project{Topics: []string{"search"}, Visibility: gitlab.PrivateVisibility}, false},
+		{"fork", &gitlab.Project{Topics: []string{"search"}, Visibility: gitlab.InternalVisibility,
+			ForkedFromProject: &gitlab.ForkParent{PathWithNamespace: "org/upstream"}}, false},
+	}
+	for _, tc := range cases {
+		if got := s.Keep(tc.p); got != tc.want {
+			t.Errorf("%s: Keep = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestInScope(t *testing.T) {
+	s := &Source{Groups: []string{"org"}, Users: []string{"alice"}, Projects: []string{"other/app"}}
+	for name, want := range map[string]bool{
+		"org/app":       true,
+		"org/sub/app":   false,
+		"alice/dotfile": true,
+		"other/app":     true,
+		"other/lib":     false,
+	} {
+		if got := s.InScope(name); got != want {
+			t.Errorf("InScope(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if !(&Source{}).InScope("any/thing") {
+		t.Error("a Source listing everything left out any/thing")
+	}
+}
+
+func TestRepo(t *testing.T) {
+	p := &gitlab.Project{
+		PathWithNamespace: "org/app",
+		SSHURLToRepo:      "git@gitlab.example.com:org/app.git",
+		HTTPURLToRepo:     "https://gitlab.example.com/org/app.git",
+		WebURL:            "https://gitlab.example.com/org/app",
+	}
+	s := &Source{HTTP: true, Username: "git", PasswordEnv: "GITLAB_TOKEN"}
+	want := &reindex.Repo{
+		Name:        "org/app",
+		Remote:      "https://gitlab.example.com/org/app.git",
+		WebURL:      "https://gitlab.example.com/org/app",
+		Username:    "git",
+		PasswordEnv: "GITLAB_TOKEN",
+	}
+	if got := s.Repo(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("Repo = %+v, want %+v", got, want)
+	}
+	p.ForkedFromProject = &gitlab.ForkParent{PathWithNamespace: "upstream/app"}
+	if got := s.Repo(p).Parent; got != "upstream/app" {
+		t.Errorf("fork's Parent = %q, want upstream/app", got)
+	}
+}
@@ -0,0 +1,54 @@
+package reindex
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// A Pipeline does what one run of a reindex tool does: lists the
+// repositories of Source, leaves out those Ignore and Allow rule out,
+// writes their config to ConfigPath, and has them fetched and indexed.
+type Pipeline struct {
+	Source RepoSource
+	// As for indexspec.Allowed; either may be nil
+	Ignore, Allow *indexspec.RepoList
+	Options       Options
+	// Where to write the config; its extension picks JSON or YAML
+	ConfigPath string
+	// Don't fetch if Fetcher is nil, or build the index if Builder is
+	Fetcher Fetcher
+	Builder IndexBuilder
+}
+
+// Run runs the pipeline, returning the config it wrote.
+func (p *Pipeline) Run(ctx context.Context) (*config.IndexSpec, error) {
+	start := time.Now()
+	repos, err := p.Source.Repos(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing repositories: %s", err.Error())
+	}
+	repos = Filter(repos, p.Ignore, p.Allow)
+	logging.With("phase", "list", "duration", time.Since(start), "repos", len(repos)).Infof("Listed %d repositories", len(repos))
+	SortByName(repos)
+
+	cfg := BuildConfig(repos, &p.Options)
+	if err := indexspec.Write(p.ConfigPath, cfg); err != nil {
+		return nil, err
+	}
+	if p.Fetcher != nil {
+		if err := p.Fetcher.Fetch(ctx, p.ConfigPath, nil); err != nil {
+			return cfg, err
+		}
+	}
+	if p.Builder != nil {
+		if err := p.Builder.Build(ctx, p.ConfigPath); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,122 @@
+package reindex
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+)
+
+type fakeIndexer struct {
+	calls []string
+}
+
+func (f *fakeIndexer) Fetch(ctx context.Context, configPath string, only []string) error {
+	f.calls = append(f.calls, "fetch "+configPath)
+	return nil
+}
+
+func (f *fakeIndexer) Build(ctx context.Context, configPath string) error {
+	f.calls = append(f.calls, "build "+configPath)
+	return nil
+}
+
+func TestPipeline(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "livegrep.yaml")
+	allow, _ := indexspec.ParseRepoList("org/*\n")
+	fake := &fakeIndexer{}
+	p := &Pipeline{
+		Source: SourceFunc(func(ctx context.Context) ([]*Repo, error) {
+			return []*Repo{{Name: "org/b"}, {Name: "other/c"}, {Name: "org/a"}}, nil
+		}),
+		Allow:      allow,
+		Options:    Options{Name: "test", Dir: dir},
+		ConfigPath: configPath,
+		Fetcher:    fake,
+		Builder:    fake,
+	}
+	cfg, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range cfg.Repositories {
+		names = append(names, r.Name)
+	}
+	if want := []string{"org/a", "org/b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("configured %v, want %v", names, want)
+	}
+	if written, err := indexspec.Load(configPath); err != nil {
+		t.Fatal(err)
+	} else if d, _ := indexspec.Diff(cfg, written); !d.Empty() {
+		t.Errorf("written config differs: %+v", d)
+	}
+	if want := []string{"fetch " + configPath, "build " + configPath}; !reflect.DeepEqual(fake.calls, want) {
+		t.Errorf("calls = %v, want %v", fake.calls, want)
+	}
+}
+
+// fakeFetchReindex stands in for livegrep-fetch-reindex, recording its
+// arguments and writing a report where --report-out says.
+const fakeFetchReindex = `#!/bin/sh
+echo "$@" > "$ARGS_OUT"
+while test $# -gt 0; do
+  if test "$1" = "--report-out"; then
+    echo '{"name": "test", "started": "'$(date -u +%Y-%m-%dT%H:%M:%S.999999999Z)'", "ok": true,
+      "repositories": [{"name": "org/a", "fetch": "ok"}]}' > "$2"
+  fi
+  shift
+done
+`
+
+func TestFetchReindex(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "livegrep-fetch-reindex")
+	if err := ioutil.WriteFile(binary, []byte(fakeFetchReindex), 0755); err != nil {
+		t.Fatal(err)
+	}
+	argsOut := filepath.Join(dir, "args")
+	reportOut := filepath.Join(dir, "report.json")
+	f := &FetchReindex{
+		Binary:    binary,
+		Index:     filepath.Join(dir, "livegrep.idx"),
+		Workers:   4,
+		Args:      []string{"--revparse"},
+		Env:       []string{"ARGS_OUT=" + argsOut},
+		ReportOut: reportOut,
+	}
+	report, err := f.Run(context.Background(), "livegrep.json", []string{"org/a", "org/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK || len(report.Repositories) != 1 || report.Repositories[0].Fetch != "ok" {
+		t.Errorf("report = %+v", report)
+	}
+	args, _ := ioutil.ReadFile(argsOut)
+	want := "--out " + f.Index + " --num-workers 4 --revparse --report-out " + reportOut +
+		" --fetch-only=org/a,org/b livegrep.json"
+	if got := strings.TrimSpace(string(args)); got != want {
+		t.Errorf("args:\ngot:  %s\nwant: %s", got, want)
+	}
+
+	if err := f.Fetch(context.Background(), "livegrep.json", nil); err != nil {
+		t.Fatal(err)
+	}
+	args, _ = ioutil.ReadFile(argsOut)
+	if !strings.Contains(string(args), "--no-index") || strings.Contains(string(args), "--fetch-only") {
+		t.Errorf("Fetch args: %s", args)
+	}
+
+	// A run that fails before writing its report returns no report.
+	os.Remove(reportOut)
+	f.Binary = "false"
+	if report, err := f.Run(context.Background(), "livegrep.json", nil); err == nil || report != nil {
+		t.Errorf("failed Run = %+v, %v", report, err)
+	}
+}
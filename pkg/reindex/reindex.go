@@ -0,0 +1,217 @@
+// Package reindex is what the livegrep-*-reindex tools share: it lists
+// the repositories a RepoSource, such as a code host, knows about,
+// generates the index config for them, and has them fetched and
+// indexed, so that programs embedding livegrep can do the same without
+// running the tools and reading their logs.
+//
+//	p := &reindex.Pipeline{
+//		Source:     reindex.Static{{Name: "org/app", Remote: "git@git.example.com:org/app"}},
+//		Options:    reindex.Options{Name: "example", Dir: "repos"},
+//		ConfigPath: "repos/livegrep.json",
+//		Fetcher:    fr,
+//		Builder:    fr,
+//	}
+//	spec, err := p.Run(ctx)
+//
+// where fr is a *FetchReindex, which runs livegrep-fetch-reindex.
+package reindex
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+// A Repo is a repository to index, as a RepoSource describes it.
+type Repo struct {
+	// Its name, such as org/name, which is also where it is cloned
+	// under Options.Dir
+	Name   string
+	Remote string
+	WebURL string
+	// How to link to its files, if not with Options.URLPattern
+	URLPattern string
+	// What to clone it with, if it needs credentials: the user, and
+	// the environment variable or the file holding the password or
+	// token
+	Username     string
+	PasswordEnv  string
+	PasswordFile string
+	// Its size in bytes, as the host reports it, for the ClonePolicy;
+	// 0 if the host doesn't say
+	Size int64
+	// The name of the repository it was forked from, if the host says,
+	// for Options.ShareObjects
+	Parent string
+}
+
+// A RepoSource lists repositories to index.
+type RepoSource interface {
+	Repos(ctx context.Context) ([]*Repo, error)
+}
+
+// A SourceFunc is a RepoSource that calls itself.
+type SourceFunc func(ctx context.Context) ([]*Repo, error)
+
+func (f SourceFunc) Repos(ctx context.Context) ([]*Repo, error) {
+	return f(ctx)
+}
+
+// Static is a RepoSource that lists the same repositories every time.
+type Static []*Repo
+
+func (s Static) Repos(ctx context.Context) ([]*Repo, error) {
+	return s, nil
+}
+
+// Options says how BuildConfig configures repositories, as the reindex
+// tools' flags of the same names do.
+type Options struct {
+	// The name of the index
+	Name string
+	// Where the repositories are cloned
+	Dir string
+	// The revisions to index each repository at, unless
+	// RevisionOverrides says otherwise; HEAD if empty
+	Revisions         []string
+	RevisionOverrides *indexspec.RevisionOverrides
+	// How to clone each repository; at the remote's defaults if nil
+	ClonePolicy *indexspec.ClonePolicy
+	// Added to every repository
+	Labels     map[string]string
+	URLPattern string
+	// Leave out repositories whose clones are missing any of their
+	// revisions, rather than failing to index them
+	SkipMissing bool
+	// Have each fork's clone borrow the objects of its Parent's, if
+	// that is indexed too, rather than storing copies of them
+	ShareObjects bool
+}
+
+// BuildConfig returns the config that indexes repos, in their order.
+func BuildConfig(repos []*Repo, opts *Options) *config.IndexSpec {
+	cfg := &config.IndexSpec{
+		Name: opts.Name,
+	}
+	revisions := opts.Revisions
+	if len(revisions) == 0 {
+		revisions = []string{"HEAD"}
+	}
+
+	var forks []fork
+	for _, r := range repos {
+		dir := path.Join(opts.Dir, r.Name)
+		revs := opts.RevisionOverrides.Revisions(r.Name, revisions...)
+		if opts.SkipMissing && !HasRevisions(dir, r.Name, revs) {
+			continue
+		}
+
+		urlPattern := r.URLPattern
+		if urlPattern == "" {
+			urlPattern = opts.URLPattern
+		}
+
+		clone := &config.CloneOptions{
+			Username:     r.Username,
+			PasswordEnv:  r.PasswordEnv,
+			PasswordFile: r.PasswordFile,
+		}
+		if opts.ClonePolicy != nil {
+			opts.ClonePolicy.Apply(clone, r.Name, r.Size)
+		}
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			clone.Size = r.Size
+		}
+
+		spec := &config.RepoSpec{
+			Path:      dir,
+			Name:      r.Name,
+			Revisions: revs,
+			Metadata: &config.Metadata{
+				WebUrl:     r.WebURL,
+				Remote:     r.Remote,
+				UrlPattern: urlPattern,
+				LabelMap:   opts.Labels,
+			},
+			CloneOptions: clone,
+		}
+		cfg.Repositories = append(cfg.Repositories, spec)
+		if opts.ShareObjects && r.Parent != "" {
+			forks = append(forks, fork{spec, r.Parent})
+		}
+	}
+	shareObjects(cfg.Repositories, forks)
+
+	return cfg
+}
+
+type fork struct {
+	spec   *config.RepoSpec
+	parent string
+}
+
+// shareObjects points each fork's clone at its parent's, if the parent
+// is in repos and cloned in full: git can't borrow from a shallow or a
+// partial clone.
+func shareObjects(repos []*config.RepoSpec, forks []fork) {
+	if len(forks) == 0 {
+		return
+	}
+	byName := make(map[string]*config.RepoSpec, len(repos))
+	for _, r := range repos {
+		byName[r.Name] = r
+	}
+	for _, f := range forks {
+		parent := byName[f.parent]
+		if parent == nil || parent == f.spec {
+			continue
+		}
+		if c := parent.CloneOptions; c != nil && (c.Depth != 0 || c.Filter != "") {
+			logging.With("repo", f.spec.Name).Warnf("Not sharing objects with %s, which is cloned shallow or partially", parent.Name)
+			continue
+		}
+		f.spec.CloneOptions.Reference = parent.Name
+	}
+}
+
+// Filter returns the repositories of repos that ignore and allow let
+// through, as for indexspec.Allowed.
+func Filter(repos []*Repo, ignore, allow *indexspec.RepoList) []*Repo {
+	var out []*Repo
+	for _, r := range repos {
+		if indexspec.Allowed(r.Name, ignore, allow) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// SortByName sorts repos by name, as the reindex tools write them.
+func SortByName(repos []*Repo) {
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+}
+
+// HasRevisions reports whether the clone at gitDir has all of
+// revisions, logging the first that it's missing.
+func HasRevisions(gitDir, name string, revisions []string) bool {
+	for _, rev := range revisions {
+		cmd := exec.Command("git",
+			"--git-dir",
+			gitDir,
+			"rev-parse",
+			"--verify",
+			rev,
+		)
+		if e := cmd.Run(); e != nil {
+			logging.With("repo", name, "rev", rev).Warnf("Skipping missing revision")
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package reindex
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/pkg/indexspec"
+	"github.com/livegrep/livegrep/src/proto/config"
+)
+
+func TestBuildConfig(t *testing.T) {
+	overrides, err := indexspec.ParseRevisionOverrides([]byte(`legacy/app: develop`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := []*Repo{
+		{Name: "org/app", Remote: "git@git.example.com:org/app", WebURL: "https://git.example.com/org/app",
+			Username: "git", PasswordEnv: "TOKEN", Size: 2 << 20},
+		{Name: "legacy/app", Remote: "git@git.example.com:legacy/app",
+			URLPattern: "https://old.example.com/{name}/{path}"},
+	}
+	cfg := BuildConfig(repos, &Options{
+		Name:              "test",
+		Dir:               "repos",
+		RevisionOverrides: overrides,
+		ClonePolicy:       &indexspec.ClonePolicy{MaxSize: 1 << 20, LargeDepth: 1, LargeFilter: "blob:none"},
+		Labels:            map[string]string{"team": "search"},
+		URLPattern:        "https://git.example.com/{name}/blob/{version}/{path}",
+	})
+	want := &config.IndexSpec{
+		Name: "test",
+		Repositories: []*config.RepoSpec{
+			{
+				Path:      "repos/org/app",
+				Name:      "org/app",
+				Revisions: []string{"HEAD"},
+				Metadata: &config.Metadata{
+					WebUrl:     "https://git.example.com/org/app",
+					Remote:     "git@git.example.com:org/app",
+					UrlPattern: "https://git.example.com/{name}/blob/{version}/{path}",
+					LabelMap:   map[string]string{"team": "search"},
+				},
+				CloneOptions: &config.CloneOptions{Username: "git", PasswordEnv: "TOKEN", Depth: 1, Filter: "blob:none", Size: 2 << 20},
+			},
+			{
+				Path:      "repos/legacy/app",
+				Name:      "legacy/app",
+				Revisions: []string{"develop"},
+				Metadata: &config.Metadata{
+					Remote:     "git@git.example.com:legacy/app",
+					UrlPattern: "https://old.example.com/{name}/{path}",
+					LabelMap:   map[string]string{"team": "search"},
+				},
+				CloneOptions: &config.CloneOptions{},
+			},
+		},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("BuildConfig:\ngot:  %+v\nwant: %+v", cfg, want)
+	}
+}
+
+func TestBuildConfigSkipMissing(t *testing.T) {
+	dir := t.TempDir()
+	clone := filepath.Join(dir, "org", "app")
+	if out, err := exec.Command("git", "init", "-q", "--bare", clone).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %s", out)
+	}
+	cfg := BuildConfig([]*Repo{{Name: "org/app"}}, &Options{Dir: dir, SkipMissing: true})
+	if len(cfg.Repositories) != 0 {
+		t.Errorf("a clone without HEAD was configured: %+v", cfg.Repositories)
+	}
+}
+
+func TestBuildConfigSizes(t *testing.T) {
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "-q", "--bare", filepath.Join(dir, "org", "app")).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %s", out)
+	}
+	cfg := BuildConfig([]*Repo{{Name: "org/app", Size: 1 << 20}, {Name: "org/new", Size: 2 << 20}}, &Options{Dir: dir})
+	// Only repositories yet to be cloned have their size recorded.
+	var sizes []int64
+	for _, r := range cfg.Repositories {
+		sizes = append(sizes, r.CloneOptions.Size)
+	}
+	if want := []int64{0, 2 << 20}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("sizes = %v, want %v", sizes, want)
+	}
+}
+
+func TestBuildConfigShareObjects(t *testing.T) {
+	repos := []*Repo{
+		{Name: "org/app"},
+		{Name: "me/app", Parent: "org/app"},
+		{Name: "me/big", Parent: "org/big"},
+		{Name: "org/big", Size: 2 << 20},
+		{Name: "me/lib", Parent: "org/lib"},
+	}
+	opts := &Options{
+		Dir:          "repos",
+		ClonePolicy:  &indexspec.ClonePolicy{MaxSize: 1 << 20, LargeDepth: 1},
+		ShareObjects: true,
+	}
+	references := func(cfg *config.IndexSpec) map[string]string {
+		out := map[string]string{}
+		for _, r := range cfg.Repositories {
+			if r.CloneOptions.Reference != "" {
+				out[r.Name] = r.CloneOptions.Reference
+			}
+		}
+		return out
+	}
+	// Not org/big, which is cloned shallow, nor org/lib, which isn't
+	// indexed.
+	want := map[string]string{"me/app": "org/app"}
+	if got := references(BuildConfig(repos, opts)); !reflect.DeepEqual(got, want) {
+		t.Errorf("references = %v, want %v", got, want)
+	}
+	opts.ShareObjects = false
+	if got := references(BuildConfig(repos, opts)); len(got) != 0 {
+		t.Errorf("references without ShareObjects = %v", got)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	ignore, err := indexspec.ParseRepoList("sandbox/*\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos, _ := Static{{Name: "org/app"}, {Name: "sandbox/toy"}, {Name: "org/lib"}}.Repos(context.Background())
+	var got []string
+	for _, r := range Filter(repos, ignore, nil) {
+		got = append(got, r.Name)
+	}
+	if want := []string{"org/app", "org/lib"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Filter = %v, want %v", got, want)
+	}
+}
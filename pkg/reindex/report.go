@@ -0,0 +1,65 @@
+package reindex
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// A Report is livegrep-fetch-reindex's -report-out summary of a run,
+// for monitoring to alert on: how each repository's fetch went, the
+// revisions that had to be skipped, and what was indexed, so that a
+// repository that has silently stopped updating shows up as a failed
+// fetch or an old commit.
+type Report struct {
+	Name            string        `json:"name"`
+	Started         time.Time     `json:"started"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	OK              bool          `json:"ok"`
+	Error           string        `json:"error,omitempty"`
+	Index           *IndexReport  `json:"index,omitempty"`
+	Repositories    []*RepoReport `json:"repositories"`
+}
+
+type IndexReport struct {
+	Path            string  `json:"path,omitempty"`
+	SizeBytes       int64   `json:"size_bytes,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	OK              bool    `json:"ok"`
+}
+
+type RepoReport struct {
+	Name string `json:"name"`
+	// "ok", "failed", or "skipped" if it wasn't fetched this run,
+	// because of -fetch-only or because the run stopped first
+	Fetch            string   `json:"fetch"`
+	Error            string   `json:"error,omitempty"`
+	DurationSeconds  float64  `json:"duration_seconds,omitempty"`
+	BytesFetched     int64    `json:"bytes_fetched,omitempty"`
+	MissingRevisions []string `json:"missing_revisions,omitempty"`
+	// The commit each revision was indexed at, and its committer time
+	// as a unix timestamp
+	Commits     map[string]string `json:"commits,omitempty"`
+	CommitTimes map[string]int64  `json:"commit_times,omitempty"`
+	// The files left out of the index for exceeding max_file_size
+	SkippedTooLarge []SkippedFile `json:"skipped_too_large,omitempty"`
+}
+
+type SkippedFile struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// LoadReport reads the report at path.
+func LoadReport(path string) (*Report, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return &r, nil
+}
@@ -0,0 +1,136 @@
+// Package sdnotify tells systemd how a livegrep daemon is doing, for
+// units with Type=notify, and pets the systemd watchdog for units with
+// WatchdogSec set.
+//
+// It speaks the sd_notify protocol directly, sending datagrams to the
+// socket named by $NOTIFY_SOCKET, rather than linking in libsystemd.
+// Outside systemd, with $NOTIFY_SOCKET unset, everything here does
+// nothing.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+)
+
+// Notify sends state, which is one or more newline-separated
+// assignments such as "READY=1", to systemd. It reports whether it was
+// sent: false, with a nil error, if not running under systemd.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	if socket[0] == '@' {
+		// An abstract socket.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// notify sends state, logging failures rather than returning them:
+// systemd being unreachable is never a reason for a daemon to stop.
+func notify(state string) {
+	if _, err := Notify(state); err != nil {
+		logging.Warnf("sd_notify %q: %s", state, err.Error())
+	}
+}
+
+// Ready tells systemd that startup is finished, or that a reload is,
+// along with status, a line describing what the daemon is doing, if it
+// isn't "".
+func Ready(status string) {
+	notify(withStatus("READY=1", status))
+}
+
+// Reloading tells systemd that the daemon is reloading its
+// configuration; Ready must be called when it has finished.
+func Reloading(status string) {
+	notify(withStatus("RELOADING=1", status))
+}
+
+// Stopping tells systemd that the daemon is shutting down.
+func Stopping() {
+	notify("STOPPING=1")
+}
+
+// Status tells systemd what the daemon is doing, for systemctl status.
+func Status(status string) {
+	notify("STATUS=" + status)
+}
+
+func withStatus(state, status string) string {
+	if status == "" {
+		return state
+	}
+	return state + "\nSTATUS=" + status
+}
+
+// WatchdogInterval returns how often systemd expects to hear from the
+// watchdog, from $WATCHDOG_USEC, or 0 if the unit has no watchdog or it
+// is meant for another process.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// StartWatchdog pets the watchdog in the background, at half the
+// interval systemd asks for, as long as healthy (if it isn't nil)
+// returns nil. Once it doesn't, the watchdog goes unpetted, and
+// systemd restarts the daemon when it runs out. It does nothing if the
+// unit has no watchdog.
+func StartWatchdog(healthy func() error) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	logging.Infof("Petting the systemd watchdog every %s", interval/2)
+	go func() {
+		for range time.Tick(interval / 2) {
+			if healthy != nil {
+				if err := healthy(); err != nil {
+					logging.Errorf("unhealthy; not petting the systemd watchdog: %s", err.Error())
+					continue
+				}
+			}
+			notify("WATCHDOG=1")
+		}
+	}()
+}
+
+// StopOnSignal sends STOPPING=1 when the process gets SIGTERM or
+// SIGINT, and then lets the signal kill it as it would have otherwise.
+func StopOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-c
+		Stopping()
+		signal.Reset(sig)
+		// Where the signal can't be sent again, as on Windows, exit
+		// as it would have.
+		if p, err := os.FindProcess(os.Getpid()); err != nil || p.Signal(sig) != nil {
+			os.Exit(1)
+		}
+	}()
+}
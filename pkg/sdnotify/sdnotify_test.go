@@ -0,0 +1,53 @@
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := Notify("READY=1"); sent || err != nil {
+		t.Fatalf("Notify outside systemd = %v, %v", sent, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	Ready("serving")
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "READY=1\nSTATUS=serving"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := WatchdogInterval(); got != 30*time.Second {
+		t.Errorf("interval = %s, want 30s", got)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if got := WatchdogInterval(); got != 0 {
+		t.Errorf("interval for another process = %s, want 0", got)
+	}
+	t.Setenv("WATCHDOG_USEC", "")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := WatchdogInterval(); got != 0 {
+		t.Errorf("interval without a watchdog = %s, want 0", got)
+	}
+}
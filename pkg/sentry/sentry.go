@@ -0,0 +1,242 @@
+// Package sentry reports panics and fatal errors in livegrep's Go
+// binaries to Sentry, when they are given a -sentry-dsn.
+//
+// Rather than linking in Sentry's SDK, events are posted to the
+// project's store endpoint directly. Each is tagged with the component
+// that sent it, the tags set with SetTag (such as the name of the index
+// config) and the fields of the log line that reported it (such as the
+// repository or request ID).
+package sentry
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+)
+
+var flagDSN = flag.String("sentry-dsn", "", "Report panics and fatal errors to the Sentry project with this `DSN`")
+
+// sendTimeout bounds how long reporting can hold up a program that is
+// about to exit.
+const sendTimeout = 5 * time.Second
+
+type client struct {
+	store     string // the project's store endpoint
+	auth      string // its X-Sentry-Auth header
+	component string
+	hostname  string
+	http      *http.Client
+
+	mu   sync.Mutex
+	tags map[string]string
+}
+
+// std is the client Init sets up, or nil without -sentry-dsn.
+var std *client
+
+// Init starts reporting fatal log lines from the named component, if
+// -sentry-dsn is set. It must be called after flag.Parse.
+func Init(component string) error {
+	if *flagDSN == "" {
+		return nil
+	}
+	c, err := newClient(*flagDSN)
+	if err != nil {
+		return err
+	}
+	c.component = component
+	std = c
+	logging.AddHook(logging.LevelFatal, func(e logging.Entry) {
+		c.send(c.event("fatal", e.Msg, e.Fields, nil))
+	})
+	return nil
+}
+
+// Args returns -sentry-dsn as given to this process, for passing on to
+// binaries it runs.
+func Args() []string {
+	if *flagDSN == "" {
+		return nil
+	}
+	return []string{"-sentry-dsn=" + *flagDSN}
+}
+
+func newClient(dsn string) (*client, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("-sentry-dsn: %s", err.Error())
+	}
+	dir, project := "", strings.TrimPrefix(u.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		dir, project = project[:i+1], project[i+1:]
+	}
+	if u.User == nil || u.User.Username() == "" || project == "" || u.Host == "" {
+		return nil, fmt.Errorf("-sentry-dsn: %q is not of the form https://<key>@<host>/<project>", dsn)
+	}
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=livegrep/1.0, sentry_key=%s", u.User.Username())
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	hostname, _ := os.Hostname()
+	return &client{
+		store:    fmt.Sprintf("%s://%s/%sapi/%s/store/", u.Scheme, u.Host, dir, project),
+		auth:     auth,
+		hostname: hostname,
+		http:     &http.Client{Timeout: sendTimeout},
+		tags:     map[string]string{},
+	}, nil
+}
+
+// SetTag adds a tag to every event reported from now on.
+func SetTag(key, value string) {
+	if std == nil {
+		return
+	}
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.tags[key] = value
+}
+
+// Recover reports a panic in progress, and then carries on panicking.
+// Deferring it at the top of main catches panics in the main goroutine.
+func Recover() {
+	if p := recover(); p != nil {
+		ReportPanic(p)
+		panic(p)
+	}
+}
+
+// ReportPanic reports p, recovered from a panic in the calling
+// goroutine, tagged with the given alternating keys and values.
+func ReportPanic(p interface{}, kv ...string) {
+	if std == nil {
+		return
+	}
+	fields := map[string]string{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields[kv[i]] = kv[i+1]
+	}
+	msg := fmt.Sprint(p)
+	std.send(std.event("fatal", msg, fields, &exception{
+		Type:       "panic",
+		Value:      msg,
+		Stacktrace: &stacktrace{Frames: callers()},
+	}))
+}
+
+type exception struct {
+	Type       string      `json:"type"`
+	Value      string      `json:"value"`
+	Stacktrace *stacktrace `json:"stacktrace,omitempty"`
+}
+
+type stacktrace struct {
+	Frames []frame `json:"frames"`
+}
+
+type frame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+}
+
+type event struct {
+	EventID    string            `json:"event_id"`
+	Timestamp  string            `json:"timestamp"`
+	Level      string            `json:"level"`
+	Logger     string            `json:"logger"`
+	Platform   string            `json:"platform"`
+	ServerName string            `json:"server_name,omitempty"`
+	Message    string            `json:"message"`
+	Tags       map[string]string `json:"tags"`
+	Exception  *exceptions       `json:"exception,omitempty"`
+}
+
+type exceptions struct {
+	Values []exception `json:"values"`
+}
+
+func (c *client) event(level, msg string, fields map[string]string, exc *exception) *event {
+	id := make([]byte, 16)
+	rand.Read(id)
+	e := &event{
+		EventID:    hex.EncodeToString(id),
+		Timestamp:  time.Now().UTC().Format("2006-01-02T15:04:05"),
+		Level:      level,
+		Logger:     c.component,
+		Platform:   "go",
+		ServerName: c.hostname,
+		Message:    msg,
+		Tags:       map[string]string{"component": c.component},
+	}
+	c.mu.Lock()
+	for k, v := range c.tags {
+		e.Tags[k] = v
+	}
+	c.mu.Unlock()
+	for k, v := range fields {
+		e.Tags[k] = v
+	}
+	if exc != nil {
+		e.Exception = &exceptions{[]exception{*exc}}
+	}
+	return e
+}
+
+func (c *client) send(e *event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("POST", c.store, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", c.auth)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		logging.Warnf("sentry: %s", err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logging.Warnf("sentry: %s", resp.Status)
+	}
+}
+
+// callers returns the stack of the panicking goroutine below the panic
+// itself, outermost call first as Sentry expects.
+func callers() []frame {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(1, pcs)])
+	var out []frame
+	for {
+		f, more := frames.Next()
+		if f.Function == "runtime.gopanic" {
+			// Everything above it is Recover and ReportPanic.
+			out = out[:0]
+		} else {
+			out = append(out, frame{Function: f.Function, Filename: f.File, Lineno: f.Line})
+		}
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
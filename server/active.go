@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// defaultActiveWindow is the age the search page's "active repos only"
+// option asks for, if the config doesn't set active_window.
+const defaultActiveWindow = "365d"
+
+var errBadAge = errors.New("active: must be an age such as 90d, 12w, 1y or 36h")
+
+// parseAge parses the age given to active:, in days ("90d"), weeks
+// ("12w") or years ("1y"), or as a Go duration ("36h").
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, errBadAge
+	}
+	units := map[byte]time.Duration{
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+		'y': 365 * 24 * time.Hour,
+	}
+	if unit, ok := units[s[len(s)-1]]; ok {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || n <= 0 {
+			return 0, errBadAge
+		}
+		return time.Duration(n) * unit, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errBadAge
+	}
+	return d, nil
+}
+
+// activeWindow returns the age the search page's "active repos only"
+// option asks for.
+func (s *server) activeWindow() string {
+	if s.config.ActiveWindow != "" {
+		return s.config.ActiveWindow
+	}
+	return defaultActiveWindow
+}
+
+// staleRepos returns the names of the repositories on backends with no
+// commit since since, in order. A repository is active if any of its
+// trees is, on any of the backends, and trees whose commit time wasn't
+// recorded count as active, since there is nothing to judge them by.
+// The trees of a tag_history are left out: searches only reach them by
+// asking for a version.
+func staleRepos(backends []*Backend, since time.Time) []string {
+	active := map[string]bool{}
+	seen := map[string]bool{}
+	for _, bk := range backends {
+		bk.I.Lock()
+		for _, t := range bk.I.Trees {
+			if t.Tag != "" {
+				continue
+			}
+			seen[t.Name] = true
+			if t.CommitTime.IsZero() || t.CommitTime.After(since) {
+				active[t.Name] = true
+			}
+		}
+		bk.I.Unlock()
+	}
+	var stale []string
+	for name := range seen {
+		if !active[name] {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// excludeRepos makes q leave out the repositories named, as well as
+// those its -repo: does.
+func excludeRepos(q *pb.Query, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = regexp.QuoteMeta(name)
+	}
+	re := "^(?:" + strings.Join(quoted, "|") + ")$"
+	if q.NotRepo != "" {
+		re = "(?:" + q.NotRepo + ")|" + re
+	}
+	q.NotRepo = re
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func TestParseAge(t *testing.T) {
+	cases := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"90d", 90 * 24 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"1y", 365 * 24 * time.Hour},
+		{"36h", 36 * time.Hour},
+		{"", 0},
+		{"d", 0},
+		{"-3d", 0},
+		{"soon", 0},
+	}
+	for _, tc := range cases {
+		got, err := parseAge(tc.in)
+		if (err != nil) != (tc.want == 0) || got != tc.want {
+			t.Errorf("parseAge(%q) = %v, %v, want %v", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestParseQueryActive(t *testing.T) {
+	_, interp, err := parseQuery("foo active:30d", regexAuto)
+	if err != nil || interp.active != 30*24*time.Hour {
+		t.Errorf("active = %v, err %v", interp.active, err)
+	}
+	if _, _, err := parseQuery("foo active:recently", regexAuto); err != errBadAge {
+		t.Errorf("active:recently: err %v", err)
+	}
+}
+
+func TestStaleRepos(t *testing.T) {
+	now := time.Now()
+	old, recent := now.Add(-400*24*time.Hour), now.Add(-time.Hour)
+	a := &Backend{Id: "a", I: &I{Trees: []Tree{
+		{Name: "org/live", Version: "main", CommitTime: recent},
+		{Name: "org/mirror", Version: "main", CommitTime: old},
+		{Name: "org/unknown", Version: "main"},
+		// A repository is active if any of its branches is.
+		{Name: "org/split", Version: "main", CommitTime: old},
+		{Name: "org/split", Version: "dev", CommitTime: recent},
+		// Old tags don't make a repository stale.
+		{Name: "org/live", Version: "v1", Tag: "v1", CommitTime: old},
+	}}}
+	b := &Backend{Id: "b", I: &I{Trees: []Tree{
+		{Name: "org/mirror", Version: "main", CommitTime: old},
+		{Name: "org/gone", Version: "main", CommitTime: old},
+	}}}
+	got := staleRepos([]*Backend{a, b}, now.Add(-365*24*time.Hour))
+	if want := []string{"org/gone", "org/mirror"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("staleRepos = %v, want %v", got, want)
+	}
+}
+
+func TestExcludeRepos(t *testing.T) {
+	q := pb.Query{NotRepo: "test"}
+	excludeRepos(&q, []string{"org/a.b", "org/c"})
+	if want := `(?:test)|^(?:org/a\.b|org/c)$`; q.NotRepo != want {
+		t.Errorf("NotRepo = %q, want %q", q.NotRepo, want)
+	}
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+const (
+	// defaultAnalyticsEntries bounds the distinct queries, repositories
+	// and files each counter tracks, unless max_entries says otherwise.
+	defaultAnalyticsEntries = 10000
+	// analyticsLatencies is how many recent searches the latency
+	// percentiles are computed over.
+	analyticsLatencies = 10000
+	// analyticsSaveInterval is how often the counters are saved to
+	// analytics.path.
+	analyticsSaveInterval = time.Minute
+)
+
+// A counter counts occurrences of strings, keeping at most max of them.
+// When it is full, the strings seen only once are forgotten, so that
+// the frequent ones survive a long tail of one-off queries.
+type counter struct {
+	Counts map[string]int64 `json:"counts"`
+	max    int
+}
+
+func newCounter(max int) *counter {
+	return &counter{Counts: map[string]int64{}, max: max}
+}
+
+func (c *counter) add(key string) {
+	if _, ok := c.Counts[key]; !ok && len(c.Counts) >= c.max {
+		for k, n := range c.Counts {
+			if n <= 1 {
+				delete(c.Counts, k)
+			}
+		}
+		if len(c.Counts) >= c.max {
+			return
+		}
+	}
+	c.Counts[key]++
+}
+
+type countEntry struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// top returns the n most frequent strings, most frequent first.
+func (c *counter) top(n int) []countEntry {
+	out := make([]countEntry, 0, len(c.Counts))
+	for k, v := range c.Counts {
+		out = append(out, countEntry{k, v})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// analytics aggregates what people search for and look at, for
+// /api/v2/stats, and logs each search to query_log. A nil *analytics
+// records nothing.
+type analytics struct {
+	path string
+	qlog *queryLog
+
+	mu          sync.Mutex
+	since       time.Time
+	searches    int64
+	queries     *counter
+	zeroResults *counter
+	truncated   *counter
+	repos       *counter
+	files       *counter
+	// A ring of the most recent search latencies, in milliseconds.
+	latencies []int64
+	next      int
+}
+
+// savedAnalytics is the form analytics are saved in.
+type savedAnalytics struct {
+	Since       time.Time `json:"since"`
+	Searches    int64     `json:"searches"`
+	Queries     *counter  `json:"queries"`
+	ZeroResults *counter  `json:"zero_results"`
+	Truncated   *counter  `json:"truncated"`
+	Repos       *counter  `json:"repos"`
+	Files       *counter  `json:"files"`
+}
+
+func newAnalytics(cfg config.Analytics) (*analytics, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	max := cfg.MaxEntries
+	if max <= 0 {
+		max = defaultAnalyticsEntries
+	}
+	a := &analytics{
+		path:        cfg.Path,
+		since:       time.Now().UTC(),
+		queries:     newCounter(max),
+		zeroResults: newCounter(max),
+		truncated:   newCounter(max),
+		repos:       newCounter(max),
+		files:       newCounter(max),
+	}
+	if cfg.QueryLog != "" {
+		var err error
+		if a.qlog, err = newQueryLog(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if a.path != "" {
+		if err := a.load(); err != nil {
+			return nil, err
+		}
+		go func() {
+			for range time.Tick(analyticsSaveInterval) {
+				if err := a.save(); err != nil {
+					log.Errorf(context.Background(), "saving analytics: %s", err.Error())
+				}
+			}
+		}()
+	}
+	return a, nil
+}
+
+func (a *analytics) load() error {
+	data, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := savedAnalytics{
+		Queries:     a.queries,
+		ZeroResults: a.zeroResults,
+		Truncated:   a.truncated,
+		Repos:       a.repos,
+		Files:       a.files,
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	a.since, a.searches = saved.Since, saved.Searches
+	return nil
+}
+
+func (a *analytics) save() error {
+	a.mu.Lock()
+	data, err := json.Marshal(&savedAnalytics{
+		Since:       a.since,
+		Searches:    a.searches,
+		Queries:     a.queries,
+		ZeroResults: a.zeroResults,
+		Truncated:   a.truncated,
+		Repos:       a.repos,
+		Files:       a.files,
+	})
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// recordSearch counts a successful search for query, which found
+// results and was truncated if it stopped at a limit before finding
+// them all.
+func (a *analytics) recordSearch(query string, results int, truncated bool, took time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.searches++
+	a.queries.add(query)
+	if results == 0 {
+		a.zeroResults.add(query)
+	}
+	if truncated {
+		a.truncated.add(query)
+	}
+	ms := int64(took / time.Millisecond)
+	if len(a.latencies) < analyticsLatencies {
+		a.latencies = append(a.latencies, ms)
+	} else {
+		a.latencies[a.next] = ms
+		a.next = (a.next + 1) % analyticsLatencies
+	}
+}
+
+// recordView counts a view of path in repo in the file viewer.
+func (a *analytics) recordView(repo, path string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.repos.add(repo)
+	a.files.add(repo + "/" + path)
+}
+
+type analyticsReport struct {
+	Since             time.Time        `json:"since"`
+	Searches          int64            `json:"searches"`
+	TopQueries        []countEntry     `json:"top_queries"`
+	ZeroResultQueries []countEntry     `json:"zero_result_queries"`
+	TruncatedQueries  []countEntry     `json:"truncated_queries"`
+	TopRepos          []countEntry     `json:"top_repos"`
+	TopFiles          []countEntry     `json:"top_files"`
+	LatencyMs         map[string]int64 `json:"latency_ms"`
+}
+
+func (a *analytics) report(n int) *analyticsReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := &analyticsReport{
+		Since:             a.since,
+		Searches:          a.searches,
+		TopQueries:        a.queries.top(n),
+		ZeroResultQueries: a.zeroResults.top(n),
+		TruncatedQueries:  a.truncated.top(n),
+		TopRepos:          a.repos.top(n),
+		TopFiles:          a.files.top(n),
+		LatencyMs:         map[string]int64{},
+	}
+	if len(a.latencies) > 0 {
+		sorted := append([]int64(nil), a.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		for _, p := range []int{50, 90, 95, 99} {
+			out.LatencyMs["p"+strconv.Itoa(p)] = sorted[(len(sorted)-1)*p/100]
+		}
+	}
+	return out
+}
+
+// ServeAnalytics reports the analytics as JSON (GET /api/v2/stats, or
+// /api/admin/analytics as it used to be, with the admin token as a
+// bearer token). limit says how many of each top list to include; the
+// default is 20.
+func (s *server) ServeAnalytics(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdmin(ctx, w, r) {
+		return
+	}
+	if s.analytics == nil {
+		writeError(ctx, w, 404, "not_enabled", "Analytics are not enabled")
+		return
+	}
+	n := 20
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		var err error
+		if n, err = strconv.Atoi(strings.TrimSpace(limit)); err != nil || n < 1 {
+			writeError(ctx, w, 400, "bad_request", "limit must be a positive number")
+			return
+		}
+	}
+	replyJSON(ctx, w, 200, s.analytics.report(n))
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestAnalytics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.json")
+	a, err := newAnalytics(config.Analytics{Enabled: true, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 100; i++ {
+		a.recordSearch("foo", 3, false, time.Duration(i)*time.Millisecond)
+	}
+	a.recordSearch("bar", 0, false, 0)
+	a.recordSearch("bar", 0, false, 0)
+	a.recordSearch("baz", 1, true, 0)
+	a.recordView("livegrep", "README.md")
+	a.recordView("livegrep", "README.md")
+	a.recordView("linux", "Makefile")
+
+	got := a.report(2)
+	if got.Searches != 103 {
+		t.Errorf("searches = %d, want 103", got.Searches)
+	}
+	if want := []countEntry{{"foo", 100}, {"bar", 2}}; !reflect.DeepEqual(got.TopQueries, want) {
+		t.Errorf("top queries = %v, want %v", got.TopQueries, want)
+	}
+	if want := []countEntry{{"bar", 2}}; !reflect.DeepEqual(got.ZeroResultQueries, want) {
+		t.Errorf("zero result queries = %v, want %v", got.ZeroResultQueries, want)
+	}
+	if want := []countEntry{{"baz", 1}}; !reflect.DeepEqual(got.TruncatedQueries, want) {
+		t.Errorf("truncated queries = %v, want %v", got.TruncatedQueries, want)
+	}
+	if want := []countEntry{{"livegrep/README.md", 2}, {"linux/Makefile", 1}}; !reflect.DeepEqual(got.TopFiles, want) {
+		t.Errorf("top files = %v, want %v", got.TopFiles, want)
+	}
+	if got.LatencyMs["p50"] != 49 || got.LatencyMs["p99"] != 98 {
+		t.Errorf("latencies = %v", got.LatencyMs)
+	}
+
+	if err := a.save(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := newAnalytics(config.Analytics{Enabled: true, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded := b.report(2); reloaded.Searches != 103 || !reflect.DeepEqual(reloaded.TopQueries, got.TopQueries) ||
+		!reflect.DeepEqual(reloaded.TruncatedQueries, got.TruncatedQueries) {
+		t.Errorf("reloaded %+v, want %+v", reloaded, got)
+	}
+}
+
+func TestCounterLimit(t *testing.T) {
+	c := newCounter(2)
+	c.add("a")
+	c.add("a")
+	c.add("b")
+	c.add("c") // evicts b, seen once
+	c.add("d") // evicts c
+	if want := map[string]int64{"a": 2, "d": 1}; !reflect.DeepEqual(c.Counts, want) {
+		t.Errorf("counts = %v, want %v", c.Counts, want)
+	}
+}
@@ -1,12 +1,15 @@
 package server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
@@ -16,6 +19,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
 	"github.com/livegrep/livegrep/server/log"
 	"github.com/livegrep/livegrep/server/reqid"
 
@@ -26,51 +30,70 @@ func replyJSON(ctx context.Context, w http.ResponseWriter, status int, obj inter
 	w.WriteHeader(status)
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(obj); err != nil {
-		log.Printf(ctx, "writing http response, data=%s err=%q",
+		log.Warnf(ctx, "writing http response, data=%s err=%q",
 			asJSON{obj},
 			err.Error())
 	}
 }
 
 func writeError(ctx context.Context, w http.ResponseWriter, status int, code, message string) {
-	log.Printf(ctx, "error status=%d code=%s message=%q",
-		status, code, message)
+	l := log.FromContext(ctx).With("status", status, "code", code)
+	if status >= 500 {
+		l.Errorf("error status=%d code=%s message=%q", status, code, message)
+	} else {
+		l.Infof("error status=%d code=%s message=%q", status, code, message)
+	}
 	replyJSON(ctx, w, status, &api.ReplyError{Err: api.InnerError{Code: code, Message: message}})
 }
 
-func writeQueryError(ctx context.Context, w http.ResponseWriter, err error) {
-	if code := grpc.Code(err); code == codes.InvalidArgument {
-		writeError(ctx, w, 400, "query", grpc.ErrorDesc(err))
-	} else {
-		writeError(ctx, w, 500, "internal_error",
-			fmt.Sprintf("Talking to backend: %s", err.Error()))
+// queryError returns the status, code and message to reply with for err,
+// the error of a search that had timeout to run.
+func queryError(err error, timeout time.Duration) (int, string, string) {
+	switch grpc.Code(err) {
+	case codes.InvalidArgument:
+		return 400, "query", grpc.ErrorDesc(err)
+	case codes.FailedPrecondition:
+		// The backend has no tags index to search
+		return 400, "query", "This index has no symbols loaded, so it can't search with sym: or tags:"
+	case codes.DeadlineExceeded:
+		return 504, "timeout",
+			fmt.Sprintf("Query timed out after %s; consider narrowing it with file: or repo:, or a more specific regex", timeout)
+	default:
+		return 500, "internal_error", fmt.Sprintf("Talking to backend: %s", err.Error())
 	}
 }
 
-func extractQuery(ctx context.Context, r *http.Request) (pb.Query, bool, error) {
+// extractQuery reads the query to search for from r, and reports how
+// its main search term was read.
+func extractQuery(ctx context.Context, r *http.Request) (pb.Query, interpretation, error) {
 	var query pb.Query
 
 	if err := r.ParseForm(); err != nil {
-		return query, false, err
+		return query, interpretation{}, err
 	}
 
 	params := r.Form
 	var err error
 
-	regex := true
-	if re, ok := params["regex"]; ok && re[0] == "false" {
-		regex = false
+	mode := regexYes
+	if re, ok := params["regex"]; ok && re[0] != "" {
+		if mode, err = parseRegexMode(re[0]); err != nil {
+			return query, interpretation{}, err
+		}
 	}
+	regex := mode != regexNo
+	interp := interpretation{mode: mode, regex: regex}
 
 	if q, ok := params["q"]; ok {
-		query, err = ParseQuery(q[0], regex)
+		query, interp, err = parseQuery(q[0], mode)
 		log.Printf(ctx, "parsing query q=%q out=%s", q[0], asJSON{query})
 	}
 
 	// Support old-style query arguments
 	if line, ok := params["line"]; ok {
 		query.Line = line[0]
-		if !regex {
+		interp.regex = !mode.literal(query.Line)
+		if !interp.regex {
 			query.Line = regexp.QuoteMeta(query.Line)
 		}
 	}
@@ -106,6 +129,29 @@ func extractQuery(ctx context.Context, r *http.Request) (pb.Query, bool, error)
 		}
 	}
 
+	// The version selector, only if "version:" is not in the query.
+	if v, ok := params["version"]; ok && query.Version == "" && interp.rev == "" && v[0] != "" {
+		query.Version = "^" + regexp.QuoteMeta(v[0]) + "$"
+	}
+
+	// A max_matches parameter, for API callers, unless the query
+	// has a max_matches: of its own.
+	if mm, ok := params["max_matches"]; ok && mm[0] != "" && query.MaxMatches == 0 {
+		n, err := strconv.Atoi(mm[0])
+		if err != nil || n <= 0 {
+			return query, interp, errors.New("max_matches must be a positive number")
+		}
+		query.MaxMatches = int32(n)
+	}
+
+	// The search page's "active repos only" option, unless the query
+	// has an active: of its own.
+	if a, ok := params["active"]; ok && a[0] != "" && interp.active == 0 {
+		if interp.active, err = parseAge(a[0]); err != nil {
+			return query, interp, err
+		}
+	}
+
 	if fc, ok := params["fold_case"]; ok {
 		if fc[0] == "false" {
 			query.FoldCase = false
@@ -116,7 +162,7 @@ func extractQuery(ctx context.Context, r *http.Request) (pb.Query, bool, error)
 		}
 	}
 
-	return query, regex, err
+	return query, interp, err
 }
 
 var (
@@ -130,25 +176,72 @@ func stringSlice(ss []string) []string {
 	return []string{}
 }
 
-func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*api.ReplySearch, error) {
+// backendTimeout returns how long a search of backend may take: its
+// search_timeout_ms, or else the frontend's, up to RequestTimeout.
+func (s *server) backendTimeout(backend *Backend) time.Duration {
+	timeout := RequestTimeout
+	if backend.searchTimeout > 0 {
+		timeout = backend.searchTimeout
+	} else if s.config.SearchTimeoutMs > 0 {
+		timeout = time.Duration(s.config.SearchTimeoutMs) * time.Millisecond
+	}
+	if timeout > RequestTimeout {
+		// The request itself would time out first.
+		timeout = RequestTimeout
+	}
+	return timeout
+}
+
+// limitMatches fills in the default limit on the matches q may return,
+// if it doesn't ask for one, and holds it to max_matches_limit.
+func (s *server) limitMatches(q *pb.Query) {
+	if q.MaxMatches == 0 && q.FilenameOnly {
+		q.MaxMatches = s.config.DefaultMaxFiles
+	}
+	if q.MaxMatches == 0 {
+		q.MaxMatches = s.config.DefaultMaxMatches
+	}
+	if limit := s.config.MaxMatchesLimit; limit > 0 && (q.MaxMatches == 0 || q.MaxMatches > limit) {
+		q.MaxMatches = limit
+	}
+}
+
+// searchTimeout returns how long the search r asks for may take: the
+// backend's timeout, unless a timeout_ms parameter shortens it.
+func (s *server) searchTimeout(backend *Backend, r *http.Request) (time.Duration, error) {
+	timeout := s.backendTimeout(backend)
+	if v := r.FormValue("timeout_ms"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return 0, fmt.Errorf("timeout_ms must be a positive number of milliseconds")
+		}
+		if t := time.Duration(ms) * time.Millisecond; t < timeout {
+			timeout = t
+		}
+	}
+	return timeout, nil
+}
+
+func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query, timeout time.Duration, timing *searchTiming) (*api.ReplySearch, error) {
 	var search *pb.CodeSearchResult
 	var err error
 
 	start := time.Now()
 
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	if id, ok := reqid.FromContext(ctx); ok {
 		ctx = metadata.AppendToOutgoingContext(ctx, "Request-Id", string(id))
 	}
 
-	search, err = backend.Codesearch.Search(
+	search, err = backend.Client().Search(
 		ctx, q,
 		grpc.FailFast(false),
 	)
+	timing.backend = time.Since(start)
 	if err != nil {
-		log.Printf(ctx, "error talking to backend err=%s", err)
+		log.FromContext(ctx).With("err", err).Errorf("error talking to backend")
 		return nil, err
 	}
 
@@ -157,12 +250,17 @@ func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*
 		FileResults: make([]*api.FileResult, 0),
 		SearchType:  "normal",
 	}
+	timing.stats = search.Stats
 
 	if q.FilenameOnly {
 		reply.SearchType = "filename_only"
 	}
 
+	labels := backend.labels()
+	revisions := backend.revisions()
+
 	for _, r := range search.Results {
+		rev := revisions[[2]string{r.Tree, r.Version}]
 		reply.Results = append(reply.Results, &api.Result{
 			Tree:          r.Tree,
 			Version:       r.Version,
@@ -172,15 +270,30 @@ func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*
 			ContextAfter:  stringSlice(r.ContextAfter),
 			Bounds:        [2]int{int(r.Bounds.Left), int(r.Bounds.Right)},
 			Line:          r.Line,
+			Labels:        labels[r.Tree],
+			Commit:        rev.commit,
+			IndexedAt:     unixTime(rev.indexedAt),
+			Branch:        rev.branch,
+			Definition:    r.Definition,
+			Language:      r.Language,
 		})
 	}
 
+	spans := fileMatcher(q)
 	for _, r := range search.FileResults {
+		bounds := [2]int{int(r.Bounds.Left), int(r.Bounds.Right)}
+		rev := revisions[[2]string{r.Tree, r.Version}]
 		reply.FileResults = append(reply.FileResults, &api.FileResult{
-			Tree:    r.Tree,
-			Version: r.Version,
-			Path:    r.Path,
-			Bounds:  [2]int{int(r.Bounds.Left), int(r.Bounds.Right)},
+			Tree:      r.Tree,
+			Version:   r.Version,
+			Path:      r.Path,
+			Bounds:    bounds,
+			Spans:     spans(r.Path, bounds),
+			Labels:    labels[r.Tree],
+			Commit:    rev.commit,
+			IndexedAt: unixTime(rev.indexedAt),
+			Branch:    rev.branch,
+			Language:  r.Language,
 		})
 	}
 
@@ -196,49 +309,311 @@ func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*
 	return reply, nil
 }
 
+// unixTime returns t as a unix timestamp, or 0 if it is the zero time.
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// errBackendOpen is returned for searches of a backend whose breaker is
+// open.
+var errBackendOpen = errors.New("backend is failing; searches of it are paused")
+
+// searchOne searches backend, or its canary if it is picked, with the
+// timeout r asks for, unless its breaker is open. A successful search
+// may also be repeated on the backend's shadow. A sharded backend's
+// shards are all searched (see searchShards).
+func (s *server) searchOne(ctx context.Context, backend *Backend, q *pb.Query, r *http.Request, timing *searchTiming) (*api.ReplySearch, time.Duration, error) {
+	if len(backend.shards) > 0 {
+		return s.searchShards(ctx, backend, q, r, timing)
+	}
+	timeout, err := s.searchTimeout(backend, r)
+	if err != nil {
+		return nil, 0, err
+	}
+	bk, target := backend, targetStable
+	if backend.routeToCanary() && backend.canary.breaker.allow() {
+		bk, target = backend.canary, targetCanary
+	} else if !backend.breaker.allow() {
+		return nil, timeout, errBackendOpen
+	}
+	timing.target = target
+	reply, err := s.doSearch(ctx, bk, q, timeout, timing)
+	bk.breaker.record(backendFailed(err, timeout, s.backendTimeout(backend)))
+	if err == nil {
+		s.auth.filter(r, reply)
+	}
+	if err == nil && backend.routeToShadow() {
+		s.shadowSearch(ctx, backend, q, timeout, reply, timing.backend)
+	}
+	return reply, timeout, err
+}
+
+// searchAll searches all of backends at once and merges their results,
+// in the order of backends. Any that can't be searched are listed in the
+// reply as unavailable, rather than failing the search, unless none
+// can; then the first one's error is returned. The timing is that of
+// the slowest backend, and its target is canary if any backend's
+// canary was searched.
+func (s *server) searchAll(ctx context.Context, backends []*Backend, q *pb.Query, r *http.Request, timing *searchTiming) (*api.ReplySearch, time.Duration, error) {
+	replies := make([]*api.ReplySearch, len(backends))
+	timeouts := make([]time.Duration, len(backends))
+	timings := make([]*searchTiming, len(backends))
+	errs := make([]error, len(backends))
+	var wg sync.WaitGroup
+	for i, bk := range backends {
+		timings[i] = &searchTiming{start: timing.start}
+		wg.Add(1)
+		go func(i int, bk *Backend) {
+			defer wg.Done()
+			replies[i], timeouts[i], errs[i] = s.searchOne(ctx, bk, q, r, timings[i])
+		}(i, bk)
+	}
+	wg.Wait()
+
+	merged := &api.ReplySearch{
+		Results:     make([]*api.Result, 0),
+		FileResults: make([]*api.FileResult, 0),
+		SearchType:  "normal",
+		Info:        &api.Stats{ExitReason: pb.SearchStats_NONE.String()},
+	}
+	var timeout time.Duration
+	for i, reply := range replies {
+		if timeouts[i] > timeout {
+			timeout = timeouts[i]
+		}
+		if errs[i] != nil {
+			log.FromContext(ctx).With("backend", backends[i].Id, "err", errs[i]).Warnf("backend unavailable; results are incomplete")
+			merged.Unavailable = append(merged.Unavailable, &api.Unavailable{
+				Backend: backends[i].Id,
+				Error:   unavailableReason(errs[i]),
+			})
+			continue
+		}
+		if timings[i].target == targetCanary {
+			timing.target = targetCanary
+		} else if timing.target == "" {
+			timing.target = timings[i].target
+		}
+		if timings[i].backend >= timing.backend {
+			timing.backend, timing.stats = timings[i].backend, timings[i].stats
+		}
+		merged.SearchType = reply.SearchType
+		for _, res := range reply.Results {
+			res.Backend = backends[i].Id
+		}
+		for _, res := range reply.FileResults {
+			res.Backend = backends[i].Id
+		}
+		merged.Results = append(merged.Results, reply.Results...)
+		merged.FileResults = append(merged.FileResults, reply.FileResults...)
+		merged.Unavailable = append(merged.Unavailable, reply.Unavailable...)
+		mergeStats(merged.Info, reply.Info)
+	}
+	for _, err := range errs {
+		if err == nil {
+			return merged, timeout, nil
+		}
+	}
+	return nil, timeout, errs[0]
+}
+
+// mergeStats adds the stats of one of several backends searched at once
+// to into. The backends ran concurrently, so each time is the longest.
+func mergeStats(into, from *api.Stats) {
+	max := func(a *int64, b int64) {
+		if b > *a {
+			*a = b
+		}
+	}
+	max(&into.RE2Time, from.RE2Time)
+	max(&into.GitTime, from.GitTime)
+	max(&into.SortTime, from.SortTime)
+	max(&into.IndexTime, from.IndexTime)
+	max(&into.AnalyzeTime, from.AnalyzeTime)
+	max(&into.TotalTime, from.TotalTime)
+	if from.ExitReason != pb.SearchStats_NONE.String() {
+		into.ExitReason = from.ExitReason
+	}
+}
+
+// unavailableReason describes err, which kept a backend from being
+// searched, for users.
+func unavailableReason(err error) string {
+	switch {
+	case err == errBackendOpen:
+		return err.Error()
+	case grpc.Code(err) == codes.DeadlineExceeded:
+		return "timed out"
+	case grpc.Code(err) == codes.Unavailable:
+		return "unreachable"
+	}
+	return grpc.ErrorDesc(err)
+}
+
+// finishSearch records the outcome of a search, whose reply is nil if
+// it failed, in the metrics, the analytics and the audit log. target is
+// "" if the search failed before it was sent to a backend.
+func (s *server) finishSearch(ctx context.Context, r *http.Request, backend, target, status string, reply *api.ReplySearch) {
+	s.searchMetrics(backend, target, status, reply)
+	s.prom.record(backend, status, reply)
+	results := 0
+	if reply != nil {
+		results = len(reply.Results)
+		s.analytics.recordSearch(r.FormValue("q"), results, reply.Truncated,
+			time.Duration(reply.Info.TotalTime)*time.Millisecond)
+	}
+	s.analytics.logSearch(ctx, r, backend, status, reply)
+	s.audit.record(ctx, r, backend, status, results)
+}
+
 func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if err := checkFormat(format); err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+	reply, serr := s.search(ctx, r, searchOptions{})
+	if serr != nil {
+		writeError(ctx, w, serr.status, serr.code, serr.message)
+		return
+	}
+	if _, ok := exporters[format]; ok {
+		writeExport(ctx, w, format, r.FormValue("q"), reply)
+		return
+	}
+	replyJSON(ctx, w, 200, reply)
+}
+
+// A searchError is why a search failed, as the API replies with it.
+type searchError struct {
+	status        int
+	code, message string
+}
+
+// searchOptions changes how search searches, for /api/v2/search.
+type searchOptions struct {
+	// Called on the query before the default max_matches is filled in
+	page func(q *pb.Query)
+	// Leave the results in the backends' order rather than ranking
+	// them, so that a search for more of them keeps the same ones first
+	noRank bool
+}
+
+// search runs the search r asks for and records it in the metrics and
+// logs, returning the reply, or why it failed.
+func (s *server) search(ctx context.Context, r *http.Request, opts searchOptions) (*api.ReplySearch, *searchError) {
+	defer s.prom.begin()()
 	backendName := r.URL.Query().Get(":backend")
 	var backend *Backend
+	// A comma-separated list of backends searches all of them.
+	var backends []*Backend
 	if backendName != "" {
-		backend = s.bk[backendName]
-		if backend == nil {
-			writeError(ctx, w, 400, "bad_backend",
-				fmt.Sprintf("Unknown backend: %s", backendName))
-			return
+		for _, id := range strings.Split(backendName, ",") {
+			backend = s.bk[id]
+			if backend == nil {
+				s.finishSearch(ctx, r, backendName, "", "bad_backend", nil)
+				return nil, &searchError{400, "bad_backend",
+					fmt.Sprintf("Unknown backend: %s", id)}
+			}
+			backends = append(backends, backend)
 		}
+		backend = backends[0]
 	} else {
 		for _, backend = range s.bk {
 			break
 		}
 	}
+	if backend != nil && len(backends) <= 1 {
+		backendName = backend.Id
+	}
 
-	q, is_regex, err := extractQuery(ctx, r)
+	timing := newSearchTiming()
+	q, interp, err := extractQuery(ctx, r)
+	timing.parse = time.Since(timing.start)
 
 	if err != nil {
-		writeError(ctx, w, 400, "bad_query", err.Error())
-		return
+		s.finishSearch(ctx, r, backendName, "", "bad_query", nil)
+		return nil, &searchError{400, "bad_query", err.Error()}
 	}
 
 	if q.Line == "" {
 		kind := "string"
-		if is_regex {
+		if interp.regex {
 			kind = "regex"
 		}
 		msg := fmt.Sprintf("You must specify a %s to match", kind)
-		writeError(ctx, w, 400, "bad_query", msg)
-		return
+		s.finishSearch(ctx, r, backendName, "", "bad_query", nil)
+		return nil, &searchError{400, "bad_query", msg}
+	}
+	if err := s.limiter.checkCost(q.Line); err != nil {
+		s.finishSearch(ctx, r, backendName, "", "query_too_expensive", nil)
+		return nil, &searchError{400, "query_too_expensive", err.Error()}
 	}
 
-	if q.MaxMatches == 0 {
-		q.MaxMatches = s.config.DefaultMaxMatches
+	if len(interp.indexes) > 0 {
+		if backends, err = s.selectIndexes(interp.indexes); err != nil {
+			s.finishSearch(ctx, r, backendName, "", "bad_backend", nil)
+			return nil, &searchError{400, "bad_backend", err.Error()}
+		}
+		backend = backends[0]
+		ids := make([]string, len(backends))
+		for i, bk := range backends {
+			ids[i] = bk.Id
+		}
+		backendName = strings.Join(ids, ",")
 	}
 
-	reply, err := s.doSearch(ctx, backend, &q)
+	if opts.page != nil {
+		opts.page(&q)
+	}
+	s.limitMatches(&q)
+
+	searched := backends
+	if len(searched) == 0 && backend != nil {
+		searched = []*Backend{backend}
+	}
+	if interp.active > 0 {
+		excludeRepos(&q, staleRepos(searched, time.Now().Add(-interp.active)))
+	}
+	excludeRepos(&q, s.auth.hiddenRepos(r, searched))
+	if interp.rev != "" {
+		q.Version = versionPattern(revVersions(searched, interp.rev))
+	}
+
+	if _, err := s.searchTimeout(backend, r); err != nil {
+		s.finishSearch(ctx, r, backendName, "", "bad_query", nil)
+		return nil, &searchError{400, "bad_query", err.Error()}
+	}
+
+	var reply *api.ReplySearch
+	var timeout time.Duration
+	if len(backends) > 1 {
+		reply, timeout, err = s.searchAll(ctx, backends, &q, r, timing)
+	} else {
+		reply, timeout, err = s.searchOne(ctx, backend, &q, r, timing)
+	}
 
+	if err == errBackendOpen {
+		s.finishSearch(ctx, r, backendName, timing.target, "backend_unavailable", nil)
+		return nil, &searchError{503, "backend_unavailable",
+			fmt.Sprintf("The %s backend is failing, so searches of it are paused; please try again in a little while", backendName)}
+	}
 	if err != nil {
-		log.Printf(ctx, "error in search err=%s", err)
-		writeQueryError(ctx, w, err)
-		return
+		log.FromContext(ctx).With("err", err).Errorf("error in search")
+		switch grpc.Code(err) {
+		case codes.InvalidArgument, codes.FailedPrecondition:
+			s.finishSearch(ctx, r, backendName, timing.target, "query", nil)
+		case codes.DeadlineExceeded:
+			s.finishSearch(ctx, r, backendName, timing.target, "timeout", nil)
+		default:
+			s.finishSearch(ctx, r, backendName, timing.target, "internal_error", nil)
+		}
+		s.logSlowQuery(ctx, backendName, &q, timing, nil, err)
+		status, code, message := queryError(err, timeout)
+		return nil, &searchError{status, code, message}
 	}
 
 	if s.honey != nil {
@@ -247,13 +622,19 @@ func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *h
 		if ok {
 			e.AddField("request_id", reqid)
 		}
-		e.AddField("backend", backend.Id)
+		e.AddField("backend", backendName)
+		e.AddField("target", timing.target)
 		e.AddField("query_line", q.Line)
 		e.AddField("query_file", q.File)
 		e.AddField("query_repo", q.Repo)
 		e.AddField("query_foldcase", q.FoldCase)
 		e.AddField("query_not_file", q.NotFile)
 		e.AddField("query_not_repo", q.NotRepo)
+		e.AddField("query_labels", q.Labels)
+		e.AddField("query_not_labels", q.NotLabels)
+		e.AddField("query_lang", q.Lang)
+		e.AddField("query_not_lang", q.NotLang)
+		e.AddField("query_version", q.Version)
 		e.AddField("max_matches", q.MaxMatches)
 
 		e.AddField("result_count", len(reply.Results))
@@ -267,11 +648,191 @@ func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *h
 		e.Send()
 	}
 
+	if !opts.noRank {
+		rank := interp.rank
+		if rank == nil {
+			rank = configRankOptions(s.config.Ranking)
+		}
+		(&ranker{opts: rank, cfg: s.config.Ranking}).rank(reply.Results)
+	}
+	if interp.fileSort != "" {
+		searched := backends
+		if len(searched) == 0 {
+			searched = []*Backend{backend}
+		}
+		sortFileResults(reply.FileResults, interp.fileSort, indexTimes(searched))
+	}
+	reply.Languages = languageFacet(reply)
+	reply.MaxMatches = q.MaxMatches
+	reply.TimeoutMs = int64(timeout / time.Millisecond)
+	reply.Truncated = reply.Info.ExitReason != pb.SearchStats_NONE.String()
+	reply.RegexMode = string(interp.mode)
+	reply.QueryMode = "literal"
+	if interp.regex {
+		reply.QueryMode = "regex"
+	}
+
+	s.finishSearch(ctx, r, backendName, timing.target, "ok", reply)
+
 	log.Printf(ctx,
 		"responding success results=%d why=%s stats=%s",
 		len(reply.Results),
 		reply.Info.ExitReason,
 		asJSON{reply.Info})
 
-	replyJSON(ctx, w, 200, reply)
+	s.logSlowQuery(ctx, backendName, &q, timing, reply, nil)
+	return reply, nil
+}
+
+// selectIndexes returns the backends that index: names, by id or by the
+// name of their index, in the order given, or every backend, in the
+// order configured, for index:all.
+func (s *server) selectIndexes(names []string) ([]*Backend, error) {
+	if len(names) == 1 && names[0] == "all" {
+		all := make([]*Backend, 0, len(s.bkOrder))
+		for _, id := range s.bkOrder {
+			all = append(all, s.bk[id])
+		}
+		return all, nil
+	}
+	var out []*Backend
+	seen := make(map[*Backend]bool)
+	for _, name := range names {
+		bk := s.bk[name]
+		if bk == nil {
+			for _, id := range s.bkOrder {
+				s.bk[id].I.Lock()
+				match := s.bk[id].I.Name == name
+				s.bk[id].I.Unlock()
+				if match {
+					bk = s.bk[id]
+					break
+				}
+			}
+		}
+		if bk == nil {
+			return nil, fmt.Errorf("Unknown index: %s", name)
+		}
+		if !seen[bk] {
+			seen[bk] = true
+			out = append(out, bk)
+		}
+	}
+	return out, nil
+}
+
+// ServeSetBackend points a configured backend at a new address
+// (POST /api/v1/admin/backends/:backend with an addr form value), for
+// swapping in a backend serving a new index without restarting the
+// frontend. It is only enabled when admin_token is configured, and
+// requires it as a bearer token.
+func (s *server) ServeSetBackend(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdmin(ctx, w, r) {
+		return
+	}
+	backendName := r.URL.Query().Get(":backend")
+	backend := s.bk[backendName]
+	if backend == nil {
+		writeError(ctx, w, 400, "bad_backend",
+			fmt.Sprintf("Unknown backend: %s", backendName))
+		return
+	}
+	if len(backend.shards) > 0 {
+		writeError(ctx, w, 400, "bad_backend",
+			fmt.Sprintf("Backend %s is sharded; point its shards at new addresses in the config", backend.Id))
+		return
+	}
+	addr := r.FormValue("addr")
+	if addr == "" {
+		writeError(ctx, w, 400, "bad_request", "addr is required")
+		return
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	old := backend.Addr()
+	if err := backend.SetAddr(connectCtx, addr); err != nil {
+		writeError(ctx, w, 502, "backend_unavailable",
+			fmt.Sprintf("Talking to %s: %s", addr, err.Error()))
+		return
+	}
+	log.FromContext(ctx).With("backend", backend.Id).Infof("backend %s moved from %s to %s", backend.Id, old, addr)
+	replyJSON(ctx, w, 200, &config.Backend{Id: backend.Id, Addr: addr})
+}
+
+// backendReloadTimeout is how long a backend may take to load its new
+// index, which for a large one is minutes.
+const backendReloadTimeout = 10 * time.Minute
+
+// ServeReloadBackend asks a backend to reload its index (POST
+// /api/v1/admin/backends/:backend/reload), replying once it serves the
+// new one. The backend's codesearch must run with -reload_rpc. Like
+// ServeSetBackend it requires admin_token.
+func (s *server) ServeReloadBackend(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.checkAdmin(ctx, w, r) {
+		return
+	}
+	backendName := r.URL.Query().Get(":backend")
+	backend := s.bk[backendName]
+	if backend == nil {
+		writeError(ctx, w, 400, "bad_backend",
+			fmt.Sprintf("Unknown backend: %s", backendName))
+		return
+	}
+
+	reloadCtx, cancel := context.WithTimeout(ctx, backendReloadTimeout)
+	defer cancel()
+	start := time.Now()
+	// A sharded backend's shards all reload at once.
+	reload := []*Backend{backend}
+	if len(backend.shards) > 0 {
+		reload = backend.shards
+	}
+	errs := make([]error, len(reload))
+	var wg sync.WaitGroup
+	for i, bk := range reload {
+		wg.Add(1)
+		go func(i int, bk *Backend) {
+			defer wg.Done()
+			errs[i] = reloadBackend(reloadCtx, bk)
+		}(i, bk)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if grpc.Code(err) == codes.Unimplemented {
+			writeError(ctx, w, 400, "bad_backend",
+				fmt.Sprintf("Backend %s doesn't take reloads; run its codesearch with -reload_rpc", reload[i].Id))
+			return
+		}
+		if err != nil {
+			writeError(ctx, w, 502, "backend_unavailable",
+				fmt.Sprintf("Reloading %s: %s", reload[i].Id, err.Error()))
+			return
+		}
+	}
+	log.FromContext(ctx).With("backend", backend.Id, "duration", time.Since(start)).Infof("backend %s reloaded in %s", backend.Id, time.Since(start))
+	replyJSON(ctx, w, 200, &config.Backend{Id: backend.Id, Addr: backend.Addr()})
+}
+
+// reloadBackend has bk reload its index, and then refreshes its trees,
+// to show the new index's without waiting for the next poll.
+func reloadBackend(ctx context.Context, bk *Backend) error {
+	if _, err := bk.Client().Reload(ctx, &pb.Empty{}, grpc.FailFast(false)); err != nil {
+		return err
+	}
+	if info, err := bk.Client().Info(ctx, &pb.InfoRequest{}, grpc.FailFast(false)); err == nil {
+		bk.refresh(info)
+	}
+	return nil
+}
+
+// checkAdmin reports whether r carries the admin token as a bearer
+// token, replying 401 if it doesn't.
+func (s *server) checkAdmin(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	want := "Bearer " + s.config.AdminToken
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+		writeError(ctx, w, 401, "unauthorized", "A valid admin token is required")
+		return false
+	}
+	return true
 }
@@ -16,6 +16,44 @@ type ReplySearch struct {
 	Results     []*Result     `json:"results"`
 	FileResults []*FileResult `json:"file_results"`
 	SearchType  string        `json:"search_type"`
+	// When searching several backends, or a sharded one, those (or
+	// the shards) that couldn't be searched, so whose results are
+	// missing
+	Unavailable []*Unavailable `json:"unavailable,omitempty"`
+	// The regex mode the query was parsed in, "yes", "no" or "auto",
+	// and whether its main search term was then read as a "regex" or
+	// a "literal" string
+	RegexMode string `json:"regex_mode,omitempty"`
+	QueryMode string `json:"query_mode,omitempty"`
+	// The limits the search ran with, 0 for no limit on matches, and
+	// whether it stopped at one of them, so may have missed matches
+	MaxMatches int32 `json:"max_matches"`
+	TimeoutMs  int64 `json:"timeout_ms"`
+	Truncated  bool  `json:"truncated"`
+	// How many distinct files among the results are in each language,
+	// for narrowing the search with lang:
+	Languages map[string]int `json:"languages,omitempty"`
+}
+
+// ReplyDiff compares the results of one query on two backends.
+type ReplyDiff struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Query string `json:"query"`
+	// How many lines matched on each
+	FromCount int `json:"from_count"`
+	ToCount   int `json:"to_count"`
+	// The matches only on To, and only on From
+	Added   []*Result `json:"added"`
+	Removed []*Result `json:"removed"`
+	// Set if either search stopped early, at max_matches or its
+	// timeout, so the counts are only lower bounds
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+type Unavailable struct {
+	Backend string `json:"backend"`
+	Error   string `json:"error"`
 }
 
 type Stats struct {
@@ -37,6 +75,20 @@ type Result struct {
 	ContextAfter  []string `json:"context_after"`
 	Bounds        [2]int   `json:"bounds"`
 	Line          string   `json:"line"`
+	// Labels are the metadata labels of the result's tree, if any
+	Labels map[string]string `json:"labels,omitempty"`
+	// The commit the result's tree was at, if known, and when it was
+	// indexed, as a unix timestamp in seconds
+	Commit    string `json:"commit,omitempty"`
+	IndexedAt int64  `json:"indexed_at,omitempty"`
+	// The revision, such as a branch, the tree was indexed from, if known
+	Branch string `json:"branch,omitempty"`
+	// When searching several backends, the one the result is from
+	Backend string `json:"backend,omitempty"`
+	// Whether the line defines a symbol that a tag names
+	Definition bool `json:"definition,omitempty"`
+	// The file's language, as detected when it was indexed
+	Language string `json:"language,omitempty"`
 }
 
 type FileResult struct {
@@ -44,4 +96,202 @@ type FileResult struct {
 	Version string `json:"version"`
 	Path    string `json:"path"`
 	Bounds  [2]int `json:"bounds"`
+	// Every part of the path the query matched, for highlighting;
+	// Bounds is the first
+	Spans     [][2]int          `json:"spans"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Commit    string            `json:"commit,omitempty"`
+	IndexedAt int64             `json:"indexed_at,omitempty"`
+	Branch    string            `json:"branch,omitempty"`
+	Backend   string            `json:"backend,omitempty"`
+	Language  string            `json:"language,omitempty"`
+}
+
+// SearchPage is a page of the results of /api/v2/search, the stable
+// search API.
+type SearchPage struct {
+	Matches []*Match `json:"matches"`
+	// The files whose paths matched; these aren't paged, so only the
+	// first page has them, unless the search was filename-only
+	Files []*FileMatch `json:"files"`
+	PageInfo
+}
+
+// PageInfo describes a page of results of /api/v2/search, and ends its
+// NDJSON stream.
+type PageInfo struct {
+	// The cursor to pass to get the next page; "" on the last
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Whether there are no more pages because the search stopped at a
+	// limit, its timeout or max_matches_limit, rather than because it
+	// ran out of matches
+	Truncated bool `json:"truncated"`
+	// Whether the main search term was read as a "regex" or a
+	// "literal" string
+	QueryMode   string         `json:"query_mode"`
+	Stats       *Stats         `json:"stats"`
+	Unavailable []*Unavailable `json:"unavailable,omitempty"`
+	// The files of all the search's results by language, as in
+	// ReplySearch
+	Languages map[string]int `json:"languages,omitempty"`
+}
+
+// A Match is a line that matched a search of /api/v2/search.
+type Match struct {
+	Repo       string `json:"repo"`
+	Version    string `json:"version"`
+	Path       string `json:"path"`
+	LineNumber int    `json:"lno"`
+	// The bytes of Line that matched, as [start, end)
+	Bounds        [2]int   `json:"bounds"`
+	Line          string   `json:"line"`
+	ContextBefore []string `json:"context_before"`
+	ContextAfter  []string `json:"context_after"`
+
+	Labels     map[string]string `json:"labels,omitempty"`
+	Commit     string            `json:"commit,omitempty"`
+	Branch     string            `json:"branch,omitempty"`
+	IndexedAt  int64             `json:"indexed_at,omitempty"`
+	Backend    string            `json:"backend,omitempty"`
+	Definition bool              `json:"definition,omitempty"`
+	Language   string            `json:"language,omitempty"`
+}
+
+// A FileMatch is a file whose path matched a search of /api/v2/search.
+type FileMatch struct {
+	Repo    string   `json:"repo"`
+	Version string   `json:"version"`
+	Path    string   `json:"path"`
+	Bounds  [2]int   `json:"bounds"`
+	Spans   [][2]int `json:"spans"`
+
+	Labels    map[string]string `json:"labels,omitempty"`
+	Commit    string            `json:"commit,omitempty"`
+	Branch    string            `json:"branch,omitempty"`
+	IndexedAt int64             `json:"indexed_at,omitempty"`
+	Backend   string            `json:"backend,omitempty"`
+	Language  string            `json:"language,omitempty"`
+}
+
+// A StreamLine is a line of /api/v2/search's NDJSON stream: one of the
+// page's matches or files, or, last, the rest of the page.
+type StreamLine struct {
+	Match *Match     `json:"match,omitempty"`
+	File  *FileMatch `json:"file,omitempty"`
+	End   *PageInfo  `json:"end,omitempty"`
+}
+
+// ReplyBlame is returned to /api/v2/blame: which commit last changed
+// each line of a file, as of Commit.
+type ReplyBlame struct {
+	Commit  string                  `json:"commit"`
+	Commits map[string]*BlameCommit `json:"commits"`
+	// The file's lines, in order, grouped into runs from one commit
+	Hunks []BlameHunk `json:"hunks"`
+}
+
+// A BlameHunk is Lines lines, starting at Line (from 1), that Commit
+// last changed.
+type BlameHunk struct {
+	Commit string `json:"commit"`
+	Line   int    `json:"line"`
+	Lines  int    `json:"lines"`
+}
+
+type BlameCommit struct {
+	Hash       string `json:"hash"`
+	Author     string `json:"author"`
+	AuthorTime int64  `json:"author_time"`
+	Summary    string `json:"summary"`
+	// The commit on the repository's forge, if it is known
+	URL string `json:"url,omitempty"`
+}
+
+// ReplyHistory is returned to /api/v2/history: the latest commits to
+// change a file as of Commit, newest first.
+type ReplyHistory struct {
+	Commit  string         `json:"commit"`
+	Commits []*BlameCommit `json:"commits"`
+}
+
+// FileList is returned to /api/v2/files: the files whose paths best
+// match a quick-open query, best first.
+type FileList struct {
+	Files []*FoundFile `json:"files"`
+	// Whether more files matched than were returned
+	Truncated bool `json:"truncated"`
+}
+
+// A FoundFile is a file whose path matched a query of /api/v2/files.
+type FoundFile struct {
+	Repo string `json:"repo"`
+	Path string `json:"path"`
+	// The bytes of Path that matched the query, as [start, end) spans
+	Spans [][2]int `json:"spans"`
+	// How well it matched; higher is better
+	Score int `json:"score"`
+}
+
+// A SavedSearch is a search a user saved under a name, for
+// /api/v2/saved.
+type SavedSearch struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// The search, as the search page's URL gives it
+	Query    string   `json:"q"`
+	FoldCase string   `json:"fold_case,omitempty"`
+	Regex    bool     `json:"regex"`
+	Repos    []string `json:"repos,omitempty"`
+	Path     string   `json:"path,omitempty"`
+	Backend  string   `json:"backend,omitempty"`
+	Owner    string   `json:"owner"`
+	// When it was saved, in seconds since the epoch
+	Created int64 `json:"created"`
+	// The short link that opens the search, for sharing it
+	URL string `json:"url"`
+}
+
+// SavedSearchList is returned to /api/v2/saved: the user's saved
+// searches, newest first.
+type SavedSearchList struct {
+	Searches []*SavedSearch `json:"searches"`
+}
+
+// IndexInfo is returned to /api/v2/index-info: what each backend is
+// serving, and how fresh it is.
+type IndexInfo struct {
+	Backends []*BackendIndex `json:"backends"`
+}
+
+type BackendIndex struct {
+	ID string `json:"id"`
+	// Whether the backend answered the frontend's last request for its
+	// info, and its circuit breaker is closed; if not, why
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+	IndexName string `json:"index_name"`
+	// When the index was built, in seconds since the epoch, and how
+	// many seconds ago that was; both 0 if it isn't known
+	IndexTime  int64 `json:"index_time"`
+	AgeSeconds int64 `json:"age_seconds"`
+	// How many repositories the index has, and the trees indexed for
+	// them, one per repository and tag
+	RepoCount int            `json:"repo_count"`
+	Repos     []*IndexedRepo `json:"repos"`
+}
+
+// An IndexedRepo is one tree in a backend's index: a repository, at
+// the version it was indexed at.
+type IndexedRepo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// The commit and the revision, such as a branch, it was indexed
+	// from, if they are known
+	Commit string `json:"commit,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+	// When it was indexed, and when its commit was made, in seconds
+	// since the epoch; 0 if it isn't known
+	IndexedAt  int64 `json:"indexed_at"`
+	CommitTime int64 `json:"commit_time,omitempty"`
 }
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/log"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// /api/v2/search takes the same parameters and query language as
+// /api/v1/search, but pages through the results: each reply has up to
+// limit of them, and a cursor for the next page. codesearch can't
+// resume a search, so each page searches again for as many matches as
+// it and the pages before it need, one more to tell whether there's
+// another, and leaves the results in codesearch's order, so that the
+// pages line up.
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+	// The furthest a cursor may start, since each page searches for
+	// every match before it too
+	maxPageOffset = 1000 * maxPageLimit
+	// How many lines of a stream to buffer before flushing them
+	streamFlushLines = 100
+)
+
+// A pageCursor is where the next page of a search starts. Query
+// fingerprints the search, so that a cursor isn't used for another.
+type pageCursor struct {
+	Offset int    `json:"o"`
+	Query  string `json:"q"`
+}
+
+var errBadCursor = errors.New("cursor is not from this search")
+
+// queryFingerprint identifies the search r asks for, whatever page of
+// it: its backend and parameters, other than limit and cursor.
+func queryFingerprint(r *http.Request) string {
+	params := url.Values{}
+	for k, v := range r.Form {
+		if k != "limit" && k != "cursor" {
+			params[k] = v
+		}
+	}
+	sum := sha256.Sum256([]byte(params.Encode()))
+	return hex.EncodeToString(sum[:8])
+}
+
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns the offset that cursor, from a search with the
+// fingerprint query, starts at.
+func decodeCursor(cursor, query string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errBadCursor
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Query != query ||
+		c.Offset < 0 || c.Offset > maxPageOffset {
+		return 0, errBadCursor
+	}
+	return c.Offset, nil
+}
+
+// pageParams reads the page size and the offset of the page r asks
+// for.
+func pageParams(r *http.Request, query string) (limit, offset int, err error) {
+	limit = defaultPageLimit
+	if v := r.Form.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			return 0, 0, errors.New("limit must be a number from 1 to " + strconv.Itoa(maxPageLimit))
+		}
+	}
+	if v := r.Form.Get("cursor"); v != "" {
+		if offset, err = decodeCursor(v, query); err != nil {
+			return 0, 0, err
+		}
+	}
+	return limit, offset, nil
+}
+
+// pageLimit sets the max_matches of q to what the page at offset needs,
+// unless q asks for fewer: that limits every page together.
+func pageLimit(q *pb.Query, limit, offset int) {
+	want := int32(math.MaxInt32)
+	if n := int64(offset) + int64(limit) + 1; n < math.MaxInt32 {
+		want = int32(n)
+	}
+	if q.MaxMatches == 0 || q.MaxMatches > want {
+		q.MaxMatches = want
+	}
+}
+
+// searchPage returns the page of reply, the results of a search run by
+// pageLimit, that starts at offset.
+func searchPage(reply *api.ReplySearch, limit, offset int, query string) *api.SearchPage {
+	page := &api.SearchPage{
+		Matches: []*api.Match{},
+		Files:   []*api.FileMatch{},
+		PageInfo: api.PageInfo{
+			QueryMode:   reply.QueryMode,
+			Stats:       reply.Info,
+			Unavailable: reply.Unavailable,
+			Languages:   reply.Languages,
+		},
+	}
+	paged := len(reply.Results)
+	if reply.SearchType == "filename_only" {
+		paged = len(reply.FileResults)
+	}
+	end := offset + limit
+	switch {
+	case paged > end && end > maxPageOffset:
+		// No cursor may start this far in.
+		page.Truncated = true
+	case paged > end:
+		page.NextCursor = encodeCursor(pageCursor{Offset: end, Query: query})
+	default:
+		// The search stopped at max_matches before getting as far
+		// as the page after this one, or timed out.
+		end = paged
+		page.Truncated = reply.Truncated
+	}
+
+	if reply.SearchType == "filename_only" {
+		for i := offset; i < end; i++ {
+			page.Files = append(page.Files, pageFile(reply.FileResults[i]))
+		}
+		return page
+	}
+	for i := offset; i < end; i++ {
+		page.Matches = append(page.Matches, pageMatch(reply.Results[i]))
+	}
+	if offset == 0 {
+		for _, f := range reply.FileResults {
+			page.Files = append(page.Files, pageFile(f))
+		}
+	}
+	return page
+}
+
+func pageMatch(r *api.Result) *api.Match {
+	return &api.Match{
+		Repo:          r.Tree,
+		Version:       r.Version,
+		Path:          r.Path,
+		LineNumber:    r.LineNumber,
+		Bounds:        r.Bounds,
+		Line:          r.Line,
+		ContextBefore: stringSlice(r.ContextBefore),
+		ContextAfter:  stringSlice(r.ContextAfter),
+		Labels:        r.Labels,
+		Commit:        r.Commit,
+		Branch:        r.Branch,
+		IndexedAt:     r.IndexedAt,
+		Backend:       r.Backend,
+		Definition:    r.Definition,
+		Language:      r.Language,
+	}
+}
+
+func pageFile(f *api.FileResult) *api.FileMatch {
+	return &api.FileMatch{
+		Repo:      f.Tree,
+		Version:   f.Version,
+		Path:      f.Path,
+		Bounds:    f.Bounds,
+		Spans:     f.Spans,
+		Labels:    f.Labels,
+		Commit:    f.Commit,
+		Branch:    f.Branch,
+		IndexedAt: f.IndexedAt,
+		Backend:   f.Backend,
+		Language:  f.Language,
+	}
+}
+
+// wantsStream reports whether r asks for an NDJSON stream.
+func wantsStream(r *http.Request) bool {
+	for _, accept := range r.Header["Accept"] {
+		for _, t := range strings.Split(accept, ",") {
+			if strings.HasPrefix(strings.TrimSpace(t), "application/x-ndjson") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *server) ServeAPISearchV2(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+	query := queryFingerprint(r)
+	limit, offset, err := pageParams(r, query)
+	if err == errBadCursor {
+		writeError(ctx, w, 400, "bad_cursor", err.Error())
+		return
+	}
+	if err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+
+	reply, serr := s.search(ctx, r, searchOptions{
+		page:   func(q *pb.Query) { pageLimit(q, limit, offset) },
+		noRank: true,
+	})
+	if serr != nil {
+		writeError(ctx, w, serr.status, serr.code, serr.message)
+		return
+	}
+	page := searchPage(reply, limit, offset, query)
+	if !wantsStream(r) {
+		replyJSON(ctx, w, 200, page)
+		return
+	}
+	writeStream(ctx, w, page)
+}
+
+// writeStream writes page as NDJSON: a line for each match and file,
+// then one with the rest of the page, flushing every streamFlushLines
+// lines so that clients can start on the results before they have all
+// of them.
+func writeStream(ctx context.Context, w http.ResponseWriter, page *api.SearchPage) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	lines := 0
+	write := func(line *api.StreamLine) bool {
+		if err := enc.Encode(line); err != nil {
+			log.Warnf(ctx, "writing stream: %s", err.Error())
+			return false
+		}
+		if lines++; lines%streamFlushLines == 0 && flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+	for _, m := range page.Matches {
+		if !write(&api.StreamLine{Match: m}) {
+			return
+		}
+	}
+	for _, f := range page.Files {
+		if !write(&api.StreamLine{File: f}) {
+			return
+		}
+	}
+	write(&api.StreamLine{End: &page.PageInfo})
+}
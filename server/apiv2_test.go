@@ -0,0 +1,125 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func pageRequest(params url.Values) *http.Request {
+	return &http.Request{Form: params, Header: http.Header{}}
+}
+
+func TestPageCursor(t *testing.T) {
+	r := pageRequest(url.Values{"q": {"foo"}, ":backend": {"a"}, "limit": {"10"}})
+	query := queryFingerprint(r)
+	cursor := encodeCursor(pageCursor{Offset: 20, Query: query})
+
+	r.Form.Set("cursor", cursor)
+	r.Form.Set("limit", "50")
+	if queryFingerprint(r) != query {
+		t.Fatal("limit and cursor changed the fingerprint")
+	}
+	limit, offset, err := pageParams(r, query)
+	if err != nil || limit != 50 || offset != 20 {
+		t.Errorf("pageParams = %d, %d, %v; want 50, 20, nil", limit, offset, err)
+	}
+
+	other := pageRequest(url.Values{"q": {"bar"}, ":backend": {"a"}, "cursor": {cursor}})
+	if _, _, err := pageParams(other, queryFingerprint(other)); err != errBadCursor {
+		t.Errorf("cursor of another search: err = %v, want errBadCursor", err)
+	}
+	for _, bad := range []string{
+		"!!",
+		encodeCursor(pageCursor{Offset: -1, Query: query}),
+		encodeCursor(pageCursor{Offset: maxPageOffset + 1, Query: query}),
+		encodeCursor(pageCursor{Offset: math.MaxInt32, Query: query}),
+	} {
+		r.Form.Set("cursor", bad)
+		if _, _, err := pageParams(r, query); err != errBadCursor {
+			t.Errorf("cursor %q: err = %v, want errBadCursor", bad, err)
+		}
+	}
+
+	r.Form.Del("cursor")
+	for _, limit := range []string{"0", "1001", "x"} {
+		r.Form.Set("limit", limit)
+		if _, _, err := pageParams(r, query); err == nil {
+			t.Errorf("limit=%s: no error", limit)
+		}
+	}
+}
+
+func TestPageLimit(t *testing.T) {
+	cases := []struct {
+		max, want int32
+	}{
+		{0, 31},
+		{10, 10},
+		{100, 31},
+	}
+	for _, tc := range cases {
+		q := pb.Query{MaxMatches: tc.max}
+		pageLimit(&q, 10, 20)
+		if q.MaxMatches != tc.want {
+			t.Errorf("max_matches %d: got %d, want %d", tc.max, q.MaxMatches, tc.want)
+		}
+	}
+
+	q := pb.Query{}
+	pageLimit(&q, 10, math.MaxInt32-5)
+	if q.MaxMatches != math.MaxInt32 {
+		t.Errorf("huge offset: got max_matches %d, want %d", q.MaxMatches, math.MaxInt32)
+	}
+}
+
+func TestSearchPage(t *testing.T) {
+	reply := &api.ReplySearch{
+		Info:        &api.Stats{},
+		FileResults: []*api.FileResult{{Tree: "r", Path: "foo.go"}},
+	}
+	for i := 0; i < 5; i++ {
+		reply.Results = append(reply.Results, &api.Result{Tree: "r", Path: "a.go", LineNumber: i + 1})
+	}
+
+	page := searchPage(reply, 2, 0, "fp")
+	if len(page.Matches) != 2 || page.Matches[0].LineNumber != 1 || len(page.Files) != 1 {
+		t.Fatalf("first page: %d matches, %d files", len(page.Matches), len(page.Files))
+	}
+	offset, err := decodeCursor(page.NextCursor, "fp")
+	if err != nil || offset != 2 {
+		t.Fatalf("next cursor: %d, %v", offset, err)
+	}
+
+	page = searchPage(reply, 2, 2, "fp")
+	if len(page.Matches) != 2 || page.Matches[0].LineNumber != 3 || len(page.Files) != 0 {
+		t.Errorf("second page: %d matches, %d files", len(page.Matches), len(page.Files))
+	}
+
+	reply.Truncated = true
+	page = searchPage(reply, 2, 4, "fp")
+	if len(page.Matches) != 1 || page.NextCursor != "" || !page.Truncated {
+		t.Errorf("last page: %d matches, cursor %q, truncated %v",
+			len(page.Matches), page.NextCursor, page.Truncated)
+	}
+
+	page = searchPage(reply, 2, 10, "fp")
+	if len(page.Matches) != 0 || page.NextCursor != "" {
+		t.Errorf("past the end: %d matches, cursor %q", len(page.Matches), page.NextCursor)
+	}
+}
+
+func TestWantsStream(t *testing.T) {
+	r := pageRequest(nil)
+	if wantsStream(r) {
+		t.Error("no Accept: wants a stream")
+	}
+	r.Header.Set("Accept", "application/json, application/x-ndjson;q=0.9")
+	if !wantsStream(r) {
+		t.Error("Accept of application/x-ndjson: doesn't want a stream")
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/reqid"
+)
+
+// auditRecord is what the audit log keeps about one search.
+type auditRecord struct {
+	Time      time.Time           `json:"time"`
+	RequestID string              `json:"request_id,omitempty"`
+	User      string              `json:"user,omitempty"`
+	Remote    string              `json:"remote_addr"`
+	Backend   string              `json:"backend"`
+	Query     string              `json:"query"`
+	Params    map[string][]string `json:"params,omitempty"`
+	Status    string              `json:"status"`
+	Results   int                 `json:"result_count"`
+}
+
+// auditDayFormat suffixes the files the audit log is rotated into.
+const auditDayFormat = "2006-01-02"
+
+// auditQueueSize is how many records may wait to be posted to the
+// audit URL before new ones are dropped.
+const auditQueueSize = 1024
+
+// An auditLog records every search to a file, rotated daily, and/or an
+// HTTP endpoint that receives each record as a JSON POST. A nil
+// *auditLog records nothing.
+type auditLog struct {
+	cfg config.AuditLog
+
+	mu  sync.Mutex
+	f   *os.File
+	day string
+
+	queue  chan []byte
+	client *http.Client
+}
+
+func newAuditLog(cfg config.AuditLog) (*auditLog, error) {
+	if cfg.Path == "" && cfg.URL == "" {
+		return nil, nil
+	}
+	a := &auditLog{cfg: cfg}
+	if cfg.Path != "" {
+		a.mu.Lock()
+		err := a.open(time.Now())
+		a.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.URL != "" {
+		a.queue = make(chan []byte, auditQueueSize)
+		a.client = &http.Client{Timeout: 10 * time.Second}
+		go a.post()
+	}
+	return a, nil
+}
+
+// record notes a search made by r that finished with the given status
+// ("ok" or an error code) and number of results.
+func (a *auditLog) record(ctx context.Context, r *http.Request, backend, status string, results int) {
+	if a == nil {
+		return
+	}
+	r.ParseForm()
+	rec := auditRecord{
+		Time:    time.Now().UTC(),
+		User:    a.user(r),
+		Remote:  r.RemoteAddr,
+		Backend: backend,
+		Query:   r.Form.Get("q"),
+		Status:  status,
+		Results: results,
+	}
+	if id, ok := reqid.FromContext(ctx); ok {
+		rec.RequestID = string(id)
+	}
+	for k, v := range r.Form {
+		if k == "q" || strings.HasPrefix(k, ":") {
+			continue
+		}
+		if rec.Params == nil {
+			rec.Params = map[string][]string{}
+		}
+		rec.Params[k] = v
+	}
+	line, err := json.Marshal(&rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	if a.cfg.Path != "" {
+		if err := a.write(line); err != nil {
+			log.FromContext(ctx).Errorf("audit log: %s", err.Error())
+		}
+	}
+	if a.queue != nil {
+		select {
+		case a.queue <- line:
+		default:
+			log.FromContext(ctx).Errorf("audit log: %s is not keeping up; dropped a record", a.cfg.URL)
+		}
+	}
+}
+
+// user returns who made r: the user_header set by the authenticating
+// proxy in front of the frontend, or else the basic auth user.
+func (a *auditLog) user(r *http.Request) string {
+	return requestUser(r, a.cfg.UserHeader)
+}
+
+func (a *auditLog) write(line []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now := time.Now(); now.Format(auditDayFormat) != a.day {
+		a.f.Close()
+		if err := a.open(now); err != nil {
+			return err
+		}
+	}
+	_, err := a.f.Write(line)
+	return err
+}
+
+// open opens the log for appending on the day of now, first moving any
+// records from an earlier day aside into path.YYYY-MM-DD and deleting
+// rotated files older than retention_days. a.mu must be held.
+func (a *auditLog) open(now time.Time) error {
+	path := a.cfg.Path
+	if st, err := os.Stat(path); err == nil && st.Size() > 0 {
+		if day := st.ModTime().Format(auditDayFormat); day != now.Format(auditDayFormat) {
+			if err := os.Rename(path, path+"."+day); err != nil {
+				return err
+			}
+		}
+	}
+	if a.cfg.RetentionDays > 0 {
+		a.expire(now)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	a.f, a.day = f, now.Format(auditDayFormat)
+	return nil
+}
+
+// expire deletes the rotated files more than retention_days old.
+func (a *auditLog) expire(now time.Time) {
+	cutoff := now.AddDate(0, 0, -a.cfg.RetentionDays).Format(auditDayFormat)
+	rotated, _ := filepath.Glob(a.cfg.Path + ".*")
+	for _, p := range rotated {
+		day := strings.TrimPrefix(p, a.cfg.Path+".")
+		if _, err := time.Parse(auditDayFormat, day); err != nil {
+			continue
+		}
+		if day < cutoff {
+			os.Remove(p)
+		}
+	}
+}
+
+// post sends queued records to the audit URL, one request each, until
+// the process exits.
+func (a *auditLog) post() {
+	for line := range a.queue {
+		if err := a.send(line); err != nil {
+			log.Errorf(context.Background(), "audit log: %s", err.Error())
+		}
+	}
+}
+
+func (a *auditLog) send(line []byte) error {
+	resp, err := a.client.Post(a.cfg.URL, "application/json", bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", a.cfg.URL, resp.Status)
+	}
+	return nil
+}
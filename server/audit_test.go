@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/reqid"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	// Left over from two days ago, and from long ago.
+	earlier := time.Now().AddDate(0, 0, -2)
+	if err := ioutil.WriteFile(path, []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, earlier, earlier)
+	old := path + "." + time.Now().AddDate(0, 0, -30).Format(auditDayFormat)
+	ioutil.WriteFile(old, []byte("{}\n"), 0600)
+
+	a, err := newAuditLog(config.AuditLog{Path: path, RetentionDays: 7, UserHeader: "X-Forwarded-User"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + "." + earlier.Format(auditDayFormat)); err != nil {
+		t.Errorf("previous day's log wasn't rotated: %v", err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("expired log wasn't deleted: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/search/?q=hello&fold_case=auto&:backend=", nil)
+	req.Header.Set("X-Forwarded-User", "alice")
+	ctx := reqid.NewContext(context.Background(), "abc")
+	a.record(ctx, req, "main", "ok", 3)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec auditRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatalf("%q: %v", data, err)
+	}
+	if rec.User != "alice" || rec.Query != "hello" || rec.Backend != "main" ||
+		rec.RequestID != "abc" || rec.Results != 3 || rec.Status != "ok" {
+		t.Errorf("got %+v", rec)
+	}
+	if len(rec.Params) != 1 || rec.Params["fold_case"][0] != "auto" {
+		t.Errorf("got params %v", rec.Params)
+	}
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bmizerany/pat"
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// auth requires the users of the frontend to sign in, and decides which
+// repositories each may see, so that restricted repositories can be
+// indexed alongside the rest. A nil *auth lets anyone see everything.
+type auth struct {
+	authn      authenticator
+	restricted []restriction
+}
+
+// A restriction limits the repositories matching repos to the users in
+// any of groups.
+type restriction struct {
+	repos  *regexp.Regexp
+	groups map[string]bool
+}
+
+// An authUser is a signed-in user.
+type authUser struct {
+	Name string `json:"u"`
+	// Only the groups that matter to the restrictions
+	Groups []string `json:"g,omitempty"`
+}
+
+// An authenticator is a way of signing users in.
+type authenticator interface {
+	// user returns the user who made r, or nil if no one has signed
+	// in.
+	user(r *http.Request) *authUser
+	// signIn replies to r, from no one signed in, with how to sign in.
+	signIn(w http.ResponseWriter, r *http.Request)
+	// register adds the handlers the authenticator needs, under
+	// /auth/, to m.
+	register(m *pat.PatternServeMux)
+}
+
+func newAuth(cfg config.Auth) (*auth, error) {
+	a := &auth{}
+	for _, r := range cfg.Restricted {
+		re, err := regexp.Compile("^(?:" + r.Repos + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("restricted: %s", err.Error())
+		}
+		if len(r.Groups) == 0 {
+			return nil, fmt.Errorf("restricted: %s: no groups may see them", r.Repos)
+		}
+		groups := make(map[string]bool, len(r.Groups))
+		for _, g := range r.Groups {
+			groups[g] = true
+		}
+		a.restricted = append(a.restricted, restriction{re, groups})
+	}
+
+	var err error
+	switch cfg.Mode {
+	case "":
+		if len(a.restricted) > 0 {
+			return nil, fmt.Errorf("restricted repositories need a mode to sign users in")
+		}
+		return nil, nil
+	case "header":
+		a.authn = newHeaderAuth(cfg)
+	case "oidc":
+		a.authn, err = newOIDCAuth(cfg.OIDC, a.keepGroups)
+	default:
+		err = fmt.Errorf("unknown mode %q (want header or oidc)", cfg.Mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// keepGroups returns those of groups that a restriction names.
+func (a *auth) keepGroups(groups []string) []string {
+	var keep []string
+	for _, g := range groups {
+		for _, r := range a.restricted {
+			if r.groups[g] {
+				keep = append(keep, g)
+				break
+			}
+		}
+	}
+	return keep
+}
+
+// authPublic reports whether path is served to anyone: the health
+// checks and metrics, for monitoring, the admin API, which has its own
+// token, and signing in.
+func authPublic(path string) bool {
+	switch path {
+	case "/healthz", "/readyz", "/debug/healthcheck", "/metrics", "/api/v2/stats":
+		return true
+	}
+	return strings.HasPrefix(path, "/auth/") ||
+		strings.HasPrefix(path, "/api/v1/admin/") ||
+		strings.HasPrefix(path, "/api/admin/")
+}
+
+type authUserKey struct{}
+
+// register adds the authenticator's handlers to m.
+func (a *auth) register(m *pat.PatternServeMux) {
+	if a != nil {
+		a.authn.register(m)
+	}
+}
+
+// wrap has h serve only signed-in users, apart from its public paths,
+// asking anyone else to sign in.
+func (a *auth) wrap(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authPublic(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u := a.authn.user(r)
+		if u == nil {
+			a.authn.signIn(w, r)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authUserKey{}, u)))
+	})
+}
+
+// signedInUser returns the user who made r, if they signed in.
+func signedInUser(r *http.Request) *authUser {
+	u, _ := r.Context().Value(authUserKey{}).(*authUser)
+	return u
+}
+
+// canSee reports whether the user who made r may see the repository
+// repo.
+func (a *auth) canSee(r *http.Request, repo string) bool {
+	if a == nil {
+		return true
+	}
+	u := signedInUser(r)
+	for _, res := range a.restricted {
+		if !res.repos.MatchString(repo) {
+			continue
+		}
+		if u == nil || !u.inAny(res.groups) {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *authUser) inAny(groups map[string]bool) bool {
+	for _, g := range u.Groups {
+		if groups[g] {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenRepos returns the repositories of backends that the user who
+// made r may not see, for searches to leave out.
+func (a *auth) hiddenRepos(r *http.Request, backends []*Backend) []string {
+	if a == nil || len(a.restricted) == 0 {
+		return nil
+	}
+	hidden := map[string]bool{}
+	for _, bk := range backends {
+		bk.I.Lock()
+		for _, t := range bk.I.Trees {
+			if !hidden[t.Name] && !a.canSee(r, t.Name) {
+				hidden[t.Name] = true
+			}
+		}
+		bk.I.Unlock()
+	}
+	names := make([]string, 0, len(hidden))
+	for name := range hidden {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// filter removes the results the user who made r may not see from
+// reply. Searches leave out hiddenRepos already; this catches the
+// trees a backend has added since it was last polled.
+func (a *auth) filter(r *http.Request, reply *api.ReplySearch) {
+	if a == nil || len(a.restricted) == 0 {
+		return
+	}
+	results := reply.Results[:0]
+	for _, res := range reply.Results {
+		if a.canSee(r, res.Tree) {
+			results = append(results, res)
+		}
+	}
+	reply.Results = results
+	files := reply.FileResults[:0]
+	for _, res := range reply.FileResults {
+		if a.canSee(r, res.Tree) {
+			files = append(files, res)
+		}
+	}
+	reply.FileResults = files
+}
+
+// headerAuth trusts the user and groups that an authenticating proxy in
+// front of the frontend sets in the request headers.
+type headerAuth struct {
+	userHeader, groupsHeader string
+}
+
+func newHeaderAuth(cfg config.Auth) *headerAuth {
+	h := &headerAuth{userHeader: cfg.UserHeader, groupsHeader: cfg.GroupsHeader}
+	if h.userHeader == "" {
+		h.userHeader = "X-Forwarded-User"
+	}
+	if h.groupsHeader == "" {
+		h.groupsHeader = "X-Forwarded-Groups"
+	}
+	return h
+}
+
+func (h *headerAuth) user(r *http.Request) *authUser {
+	name := r.Header.Get(h.userHeader)
+	if name == "" {
+		return nil
+	}
+	u := &authUser{Name: name}
+	for _, v := range r.Header[http.CanonicalHeaderKey(h.groupsHeader)] {
+		for _, g := range strings.Split(v, ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				u.Groups = append(u.Groups, g)
+			}
+		}
+	}
+	return u
+}
+
+func (h *headerAuth) signIn(w http.ResponseWriter, r *http.Request) {
+	unauthenticated(w, r, fmt.Sprintf("No %s header; sign in through the proxy in front of livegrep", h.userHeader))
+}
+
+func (h *headerAuth) register(m *pat.PatternServeMux) {}
+
+// unauthenticated tells the client of r that it must sign in: in JSON,
+// for the API, or else in plain text.
+func unauthenticated(w http.ResponseWriter, r *http.Request, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeError(context.Background(), w, 401, "unauthenticated", message)
+		return
+	}
+	http.Error(w, message, 401)
+}
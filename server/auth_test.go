@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestNewAuth(t *testing.T) {
+	restricted := []config.RestrictedRepos{{Repos: "org/secret.*", Groups: []string{"security"}}}
+	cases := []struct {
+		name string
+		cfg  config.Auth
+	}{
+		{"restricted without a mode", config.Auth{Restricted: restricted}},
+		{"unknown mode", config.Auth{Mode: "ldap"}},
+		{"bad regex", config.Auth{Mode: "header", Restricted: []config.RestrictedRepos{{Repos: "(", Groups: []string{"a"}}}}},
+		{"no groups", config.Auth{Mode: "header", Restricted: []config.RestrictedRepos{{Repos: "a"}}}},
+		{"oidc without an issuer", config.Auth{Mode: "oidc"}},
+	}
+	for _, tc := range cases {
+		if _, err := newAuth(tc.cfg); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+	if a, err := newAuth(config.Auth{}); a != nil || err != nil {
+		t.Errorf("no mode: got %v, %v; want nil, nil", a, err)
+	}
+}
+
+// signedIn returns the request a reaches its handler with, having been
+// made with headers.
+func signedIn(t *testing.T, a *auth, headers map[string]string) *http.Request {
+	req := httptest.NewRequest("GET", "/search", nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	var got *http.Request
+	a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if got == nil {
+		t.Fatalf("%v: not signed in", headers)
+	}
+	return got
+}
+
+func TestAuthRestricted(t *testing.T) {
+	a, err := newAuth(config.Auth{
+		Mode: "header",
+		Restricted: []config.RestrictedRepos{
+			{Repos: "org/secret.*", Groups: []string{"security", "admins"}},
+			{Repos: "org/secret-payments", Groups: []string{"payments"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bk := &Backend{Id: "a", I: &I{Trees: []Tree{
+		{Name: "org/api"}, {Name: "org/secret-keys"}, {Name: "org/secret-payments"},
+	}}}
+
+	cases := []struct {
+		groups string
+		hidden []string
+	}{
+		{"", []string{"org/secret-keys", "org/secret-payments"}},
+		{"security", []string{"org/secret-payments"}},
+		{"payments", []string{"org/secret-keys", "org/secret-payments"}},
+		{"admins, payments", []string{}},
+	}
+	for _, tc := range cases {
+		r := signedIn(t, a, map[string]string{"X-Forwarded-User": "ann", "X-Forwarded-Groups": tc.groups})
+		if got := a.hiddenRepos(r, []*Backend{bk}); !reflect.DeepEqual(got, tc.hidden) {
+			t.Errorf("groups %q: hidden %v, want %v", tc.groups, got, tc.hidden)
+		}
+		if !a.canSee(r, "org/api") {
+			t.Errorf("groups %q: can't see org/api", tc.groups)
+		}
+		if requestUser(r, "") != "ann" {
+			t.Errorf("groups %q: user %q", tc.groups, requestUser(r, ""))
+		}
+	}
+
+	r := signedIn(t, a, map[string]string{"X-Forwarded-User": "ann", "X-Forwarded-Groups": "security"})
+	reply := &api.ReplySearch{
+		Results:     []*api.Result{{Tree: "org/api"}, {Tree: "org/secret-payments"}, {Tree: "org/secret-keys"}},
+		FileResults: []*api.FileResult{{Tree: "org/secret-payments"}},
+	}
+	a.filter(r, reply)
+	if len(reply.Results) != 2 || reply.Results[1].Tree != "org/secret-keys" || len(reply.FileResults) != 0 {
+		t.Errorf("filtered to %d results, %d files", len(reply.Results), len(reply.FileResults))
+	}
+
+	var none *auth
+	if !none.canSee(r, "org/secret-keys") || none.hiddenRepos(r, []*Backend{bk}) != nil {
+		t.Error("nil auth hides repositories")
+	}
+}
+
+func TestAuthWrap(t *testing.T) {
+	a, err := newAuth(config.Auth{Mode: "header", UserHeader: "X-User"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		path, user string
+		status     int
+		json       bool
+	}{
+		{"/search", "", 401, false},
+		{"/api/v1/search/", "", 401, true},
+		{"/search", "ann", 200, false},
+		{"/healthz", "", 200, false},
+		{"/api/v1/admin/backends/a", "", 200, false},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.user != "" {
+			req.Header.Set("X-User", tc.user)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s as %q: status %d, want %d", tc.path, tc.user, w.Code, tc.status)
+		}
+		if tc.json && !strings.Contains(w.Body.String(), `"unauthenticated"`) {
+			t.Errorf("%s: body %q", tc.path, w.Body.String())
+		}
+	}
+}
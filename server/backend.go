@@ -2,11 +2,15 @@ package server
 
 import (
 	"context"
-	"log"
 	"net/url"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/livegrep/livegrep/pkg/logging"
+	configpb "github.com/livegrep/livegrep/src/proto/config"
 	pb "github.com/livegrep/livegrep/src/proto/go_proto"
 	"google.golang.org/grpc"
 )
@@ -15,6 +19,22 @@ type Tree struct {
 	Name    string
 	Version string
 	Url     string
+	Labels  map[string]string
+	// Tag is set on trees indexed for a repository's tag_history.
+	Tag string
+	// The commit the tree's version was when it was indexed, and when
+	// that was, if livegrep-fetch-reindex recorded them.
+	Commit    string
+	IndexedAt time.Time
+	// The revision the tree was indexed from, such as a branch, if it
+	// is known; with -revparse, the version is the commit instead.
+	Branch string
+	// What links to the tree's files are made at: "commit", "branch",
+	// or "" for its version.
+	LinkRevision string
+	// When the tree's commit was made, if livegrep-fetch-reindex
+	// recorded it.
+	CommitTime time.Time
 }
 
 type I struct {
@@ -25,48 +45,302 @@ type I struct {
 }
 
 type Backend struct {
-	Id         string
-	Addr       string
-	I          *I
-	Codesearch pb.CodeSearchClient
+	Id string
+	I  *I
+
+	// How long searches of this backend may take, if it overrides the
+	// frontend's search_timeout_ms.
+	searchTimeout time.Duration
+	breaker       *breaker
+
+	// The codesearch server that canaryPercent of searches are sent
+	// to instead, if there is one. It has its own breaker, and while
+	// that is open all searches go to the backend itself.
+	canary        *Backend
+	canaryPercent int
+
+	// The codesearch server that shadowPercent of searches are repeated
+	// on, if there is one, and a slot for each shadow search that may
+	// run at once.
+	shadow        *Backend
+	shadowPercent int
+	shadowSlots   chan struct{}
+
+	// The backends serving each part of the index of a sharded backend,
+	// which has no address of its own, and for each of those, the
+	// backend it is a shard of.
+	shards []*Backend
+	parent *Backend
+
+	// The address can be changed while the frontend is running (see
+	// SetAddr), so it and the clients for it are only accessed through
+	// Addr and Client.
+	mu       sync.Mutex
+	addr     string
+	conns    []*grpc.ClientConn
+	clients  []pb.CodeSearchClient
+	next     int
+	dialOpts []grpc.DialOption
+	// Whether the last Info request to the address has succeeded, and
+	// if not, its error.
+	infoOK  bool
+	infoErr string
 }
 
-func NewBackend(id string, addr string, extraOpts ...grpc.DialOption) (*Backend, error) {
+// NewBackend connects to the codesearch server at addr, over conns
+// connections, which searches are spread across.
+func NewBackend(id string, addr string, conns int, extraOpts ...grpc.DialOption) (*Backend, error) {
 	dialOpts := []grpc.DialOption{grpc.WithInsecure()}
 	dialOpts = append(dialOpts, extraOpts...)
-	client, err := grpc.Dial(addr, dialOpts...)
-	if err != nil {
-		return nil, err
+	if conns < 1 {
+		conns = 1
 	}
 	bk := &Backend{
-		Id:         id,
-		Addr:       addr,
-		I:          &I{Name: id},
-		Codesearch: pb.NewCodeSearchClient(client),
+		Id:       id,
+		I:        &I{Name: id},
+		addr:     addr,
+		conns:    make([]*grpc.ClientConn, conns),
+		dialOpts: dialOpts,
+	}
+	clients, err := bk.dial(addr, bk.conns)
+	if err != nil {
+		return nil, err
 	}
+	bk.clients = clients
 	return bk, nil
 }
 
+// dial fills conns with connections to addr, and returns a client for
+// each.
+func (bk *Backend) dial(addr string, conns []*grpc.ClientConn) ([]pb.CodeSearchClient, error) {
+	clients := make([]pb.CodeSearchClient, len(conns))
+	for i := range conns {
+		conn, err := grpc.Dial(addr, bk.dialOpts...)
+		if err != nil {
+			closeAll(conns[:i])
+			return nil, err
+		}
+		conns[i], clients[i] = conn, pb.NewCodeSearchClient(conn)
+	}
+	return clients, nil
+}
+
+func closeAll(conns []*grpc.ClientConn) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (bk *Backend) Addr() string {
+	if len(bk.shards) > 0 {
+		addrs := make([]string, len(bk.shards))
+		for i, shard := range bk.shards {
+			addrs[i] = shard.Addr()
+		}
+		return strings.Join(addrs, ",")
+	}
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	return bk.addr
+}
+
+// Client returns a client for one of the backend's connections, taking
+// each in turn.
+func (bk *Backend) Client() pb.CodeSearchClient {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	c := bk.clients[bk.next%len(bk.clients)]
+	bk.next++
+	return c
+}
+
+// SetAddr points the backend at a codesearch server at a new address,
+// once it has answered an Info request. Searches already sent to the
+// old address are given time to finish before its connections are
+// closed.
+func (bk *Backend) SetAddr(ctx context.Context, addr string) error {
+	if len(bk.shards) > 0 {
+		return errSharded
+	}
+	bk.mu.Lock()
+	conns := make([]*grpc.ClientConn, len(bk.conns))
+	bk.mu.Unlock()
+	clients, err := bk.dial(addr, conns)
+	if err != nil {
+		return err
+	}
+	info, err := clients[0].Info(ctx, &pb.InfoRequest{}, grpc.FailFast(false))
+	if err != nil {
+		closeAll(conns)
+		return err
+	}
+
+	bk.mu.Lock()
+	old := bk.conns
+	bk.addr, bk.conns, bk.clients = addr, conns, clients
+	bk.mu.Unlock()
+
+	bk.refresh(info)
+	bk.noteInfo(nil)
+	bk.breaker.reset()
+	time.AfterFunc(time.Minute, func() { closeAll(old) })
+	return nil
+}
+
 func (bk *Backend) Start() {
 	if bk.I == nil {
 		bk.I = &I{Name: bk.Id}
 	}
+	if len(bk.shards) > 0 {
+		for _, shard := range bk.shards {
+			shard.Start()
+		}
+		return
+	}
 	go bk.poll()
 }
 
 func (bk *Backend) poll() {
 	for {
-		info, e := bk.Codesearch.Info(context.Background(), &pb.InfoRequest{}, grpc.FailFast(false))
+		info, e := bk.Client().Info(context.Background(), &pb.InfoRequest{}, grpc.FailFast(false))
 		if e == nil {
 			bk.refresh(info)
 		} else {
-			log.Printf("refresh %s: %v", bk.Id, e)
+			logging.With("backend", bk.Id).Warnf("refresh %s: %v", bk.Id, e)
 		}
+		bk.noteInfo(e)
 		time.Sleep(60 * time.Second)
 	}
 }
 
+// noteInfo records how an Info request to the backend went.
+func (bk *Backend) noteInfo(err error) {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	bk.infoOK, bk.infoErr = err == nil, ""
+	if err != nil {
+		bk.infoErr = err.Error()
+	}
+}
+
+// connected reports whether the frontend can reach the backend, or each
+// of its shards: whether its last Info request succeeded and its
+// breaker is closed. If not, it returns why.
+func (bk *Backend) connected() (bool, string) {
+	for _, shard := range bk.shards {
+		if ok, why := shard.connected(); !ok {
+			return false, shard.Id + ": " + why
+		}
+	}
+	if len(bk.shards) > 0 {
+		return true, ""
+	}
+	if bk.breaker.isOpen() {
+		return false, "circuit breaker open after repeated failures"
+	}
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	if !bk.infoOK {
+		if bk.infoErr == "" {
+			return false, "not yet reached"
+		}
+		return false, bk.infoErr
+	}
+	return true, ""
+}
+
+// labels returns the labels of each tree on the backend, by tree name.
+func (bk *Backend) labels() map[string]map[string]string {
+	bk.I.Lock()
+	defer bk.I.Unlock()
+	out := make(map[string]map[string]string, len(bk.I.Trees))
+	for _, t := range bk.I.Trees {
+		if len(t.Labels) > 0 {
+			out[t.Name] = t.Labels
+		}
+	}
+	return out
+}
+
+// An indexedRevision is the commit a version of a tree was and the
+// revision it was indexed from, and when it was indexed.
+type indexedRevision struct {
+	commit    string
+	branch    string
+	indexedAt time.Time
+}
+
+var commitRE = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// revisions returns the indexed revision of each version of each tree
+// on the backend, keyed by tree name and version. A version indexed with
+// -revparse is its own commit, any other version is its own branch, and
+// trees without an indexed_at of their own were indexed when the
+// backend's index was.
+func (bk *Backend) revisions() map[[2]string]indexedRevision {
+	bk.I.Lock()
+	defer bk.I.Unlock()
+	out := make(map[[2]string]indexedRevision, len(bk.I.Trees))
+	for _, t := range bk.I.Trees {
+		rev := indexedRevision{commit: t.Commit, branch: t.Branch, indexedAt: t.IndexedAt}
+		if rev.commit == "" && commitRE.MatchString(t.Version) {
+			rev.commit = t.Version
+		}
+		if rev.branch == "" && !commitRE.MatchString(t.Version) {
+			rev.branch = t.Version
+		}
+		if rev.indexedAt.IsZero() {
+			rev.indexedAt = bk.I.IndexTime
+		}
+		out[[2]string{t.Name, t.Version}] = rev
+	}
+	return out
+}
+
+// treeRevision returns the commit and the revision a tree of version
+// was indexed at, given the commits livegrep-fetch-reindex recorded for
+// its repository's revisions. The version is the revision, unless the
+// tree was indexed with -revparse, when it is the commit a revision
+// resolved to, and the first such revision by name is taken. Either is
+// "" if it isn't known.
+func treeRevision(version string, commits map[string]string) (commit, branch string) {
+	if commit, ok := commits[version]; ok {
+		return commit, version
+	}
+	revs := make([]string, 0, len(commits))
+	for rev := range commits {
+		revs = append(revs, rev)
+	}
+	sort.Strings(revs)
+	for _, rev := range revs {
+		if commits[rev] == version {
+			return version, rev
+		}
+	}
+	return "", ""
+}
+
+// treeLabels returns a tree's labels, including those given in the old
+// list form, which have no values.
+func treeLabels(md *configpb.Metadata) map[string]string {
+	if len(md.Labels) == 0 {
+		return md.LabelMap
+	}
+	out := make(map[string]string, len(md.LabelMap)+len(md.Labels))
+	for _, l := range md.Labels {
+		out[l] = ""
+	}
+	for k, v := range md.LabelMap {
+		out[k] = v
+	}
+	return out
+}
+
 func (bk *Backend) refresh(info *pb.ServerInfo) {
+	if bk.parent != nil {
+		// Deferred first, so run once bk.I is unlocked.
+		defer bk.parent.mergeShards()
+	}
 	bk.I.Lock()
 	defer bk.I.Unlock()
 
@@ -77,8 +351,16 @@ func (bk *Backend) refresh(info *pb.ServerInfo) {
 	if len(info.Trees) > 0 {
 		bk.I.Trees = nil
 		for _, r := range info.Trees {
-			pattern := r.Metadata.UrlPattern
-			if v := r.Metadata.Github; v != "" {
+			md := r.Metadata
+			if md == nil {
+				md = &configpb.Metadata{}
+			}
+			pattern := md.UrlPattern
+			v := md.WebUrl
+			if v == "" {
+				v = md.Github
+			}
+			if v != "" {
 				value := v
 				base := ""
 				_, err := url.ParseRequestURI(value)
@@ -89,8 +371,18 @@ func (bk *Backend) refresh(info *pb.ServerInfo) {
 				}
 				pattern = base + "/blob/{version}/{path}#L{lno}"
 			}
+			var indexedAt time.Time
+			if md.IndexedAt != 0 {
+				indexedAt = time.Unix(md.IndexedAt, 0)
+			}
+			commit, branch := treeRevision(r.Version, md.Commits)
+			var commitTime time.Time
+			if t, ok := md.CommitTimes[branch]; ok && branch != "" {
+				commitTime = time.Unix(t, 0)
+			}
 			bk.I.Trees = append(bk.I.Trees,
-				Tree{r.Name, r.Version, pattern})
+				Tree{r.Name, r.Version, pattern, treeLabels(md), md.Tag,
+					commit, indexedAt, branch, md.LinkRevision, commitTime})
 		}
 	}
 }
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+const (
+	// blameCacheEntries is how many files' blame, and history, are kept
+	// for whoever views them next. They are keyed by commit, so never go
+	// stale.
+	blameCacheEntries = 500
+	// blameTimeout bounds the git blame or log of one file.
+	blameTimeout = 30 * time.Second
+	// historyCommits is how many of a file's commits its history lists.
+	historyCommits = 50
+)
+
+// blameCache is a least recently used cache of blame and history
+// replies, by repository, commit, path and kind.
+type blameCache struct {
+	mu    sync.Mutex
+	max   int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type blameCacheEntry struct {
+	key   string
+	value interface{}
+}
+
+func newBlameCache(max int) *blameCache {
+	return &blameCache{max: max, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *blameCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*blameCacheEntry).value, true
+}
+
+func (c *blameCache) put(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*blameCacheEntry).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&blameCacheEntry{key, value})
+	if c.order.Len() > c.max {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.items, last.Value.(*blameCacheEntry).key)
+	}
+}
+
+// commitURL returns the link to commit on the repository's forge: its
+// commit_url_pattern metadata with {name} and {commit} filled in, or
+// else the commit page of the forge its url_pattern points into, or ""
+// if that isn't one livegrep knows.
+func commitURL(repo config.RepoConfig, commit string) string {
+	pattern := repo.Metadata["commit_url_pattern"]
+	if pattern == "" {
+		file := repo.Metadata["url_pattern"]
+		for _, f := range []struct{ file, commit string }{
+			// GitHub, and GitLab's /-/blob/
+			{"/blob/", "/commit/{commit}"},
+			// Gitea
+			{"/src/commit/", "/commit/{commit}"},
+			// Bitbucket Server
+			{"/browse/", "/commits/{commit}"},
+		} {
+			if i := strings.Index(file, f.file); i >= 0 {
+				pattern = file[:i] + f.commit
+				break
+			}
+		}
+	}
+	if pattern == "" {
+		return ""
+	}
+	return strings.NewReplacer("{name}", repo.Name, "{commit}", commit).Replace(pattern)
+}
+
+// gitBlame blames each line of file at commit, which must be a commit
+// ID, in the repository at repoPath.
+func gitBlame(ctx context.Context, repoPath, commit, file string) (*api.ReplyBlame, error) {
+	ctx, cancel := context.WithTimeout(ctx, blameTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "blame", "--porcelain", commit, "--", file).Output()
+	if err != nil {
+		return nil, gitError(err)
+	}
+	return parseBlame(out)
+}
+
+// parseBlame parses the output of git blame --porcelain. Each group of
+// lines from one commit starts with a header of the commit, the line's
+// numbers before and now, and the number of lines in the group; the
+// first time a commit appears, lines describing it follow. Each line of
+// the file itself follows a tab.
+func parseBlame(out []byte) (*api.ReplyBlame, error) {
+	reply := &api.ReplyBlame{Commits: map[string]*api.BlameCommit{}, Hunks: []api.BlameHunk{}}
+	var current *api.BlameCommit
+	s := bufio.NewScanner(bytes.NewReader(out))
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "\t") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields[0]) == 40 && (len(fields) == 3 || len(fields) == 4) {
+			if current = reply.Commits[fields[0]]; current == nil {
+				current = &api.BlameCommit{Hash: fields[0]}
+				reply.Commits[fields[0]] = current
+			}
+			if len(fields) == 4 {
+				start, err1 := strconv.Atoi(fields[2])
+				n, err2 := strconv.Atoi(fields[3])
+				if err1 != nil || err2 != nil {
+					return nil, fmt.Errorf("bad blame header %q", line)
+				}
+				reply.Hunks = append(reply.Hunks, api.BlameHunk{Commit: fields[0], Line: start, Lines: n})
+			}
+			continue
+		}
+		if current == nil {
+			return nil, fmt.Errorf("blame line %q is not in a group", line)
+		}
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "author":
+			current.Author = value
+		case "author-time":
+			current.AuthorTime, _ = strconv.ParseInt(value, 10, 64)
+		case "summary":
+			current.Summary = value
+		}
+	}
+	return reply, s.Err()
+}
+
+// gitHistory lists the last historyCommits commits to change file, as
+// of commit, in the repository at repoPath, newest first.
+func gitHistory(ctx context.Context, repoPath, commit, file string) (*api.ReplyHistory, error) {
+	ctx, cancel := context.WithTimeout(ctx, blameTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "git", "-C", repoPath, "log",
+		"-n", strconv.Itoa(historyCommits), "--follow", "--format=%H%x00%an%x00%at%x00%s",
+		commit, "--", file).Output()
+	if err != nil {
+		return nil, gitError(err)
+	}
+	reply := &api.ReplyHistory{Commits: []*api.BlameCommit{}}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.SplitN(line, "\x00", 4)
+		if len(parts) != 4 {
+			continue
+		}
+		t, _ := strconv.ParseInt(parts[2], 10, 64)
+		reply.Commits = append(reply.Commits, &api.BlameCommit{
+			Hash: parts[0], Author: parts[1], AuthorTime: t, Summary: parts[3],
+		})
+	}
+	return reply, nil
+}
+
+// gitError returns err, from running git, with what git said about it.
+func gitError(err error) error {
+	if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+		return fmt.Errorf("%s", strings.TrimSpace(string(ee.Stderr)))
+	}
+	return err
+}
+
+// blameRequest reads the repository, file and commit r asks about,
+// replying with an error if they don't name a file that can be shown.
+func (s *server) blameRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) (repo config.RepoConfig, file, commit string, ok bool) {
+	if len(s.repos) == 0 {
+		writeError(ctx, w, 404, "not_enabled", "Blame needs the file viewer, which the frontend's index_config enables")
+		return
+	}
+	name := r.FormValue("repo")
+	repo, found := s.repos[name]
+	if !found || !s.auth.canSee(r, name) {
+		writeError(ctx, w, 404, "not_found", "No such repo: "+name)
+		return
+	}
+	file = strings.TrimPrefix(path.Clean("/"+r.FormValue("path")), "/")
+	if file == "" {
+		writeError(ctx, w, 400, "bad_request", "path is required")
+		return
+	}
+	rev := r.FormValue("commit")
+	if rev == "" {
+		rev = "HEAD"
+	}
+	if strings.HasPrefix(rev, "-") {
+		writeError(ctx, w, 400, "bad_request", "Bad commit: "+rev)
+		return
+	}
+	// A commit ID, so that the reply can be cached for good
+	out, err := gitCommitHash(rev+"^{commit}", repo.Path)
+	if err != nil {
+		writeError(ctx, w, 404, "not_found", "No such commit: "+rev)
+		return
+	}
+	commit = strings.TrimSpace(out)
+	return repo, file, commit, true
+}
+
+// ServeAPIBlame says which commit last changed each line of a file
+// (GET /api/v2/blame?repo=...&path=...&commit=...), in hunks of lines
+// from the same commit, with each commit's author, time and summary and
+// a link to it on the repository's forge.
+func (s *server) ServeAPIBlame(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	repo, file, commit, ok := s.blameRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+	key := strings.Join([]string{"blame", repo.Name, commit, file}, "\x00")
+	if reply, ok := s.blame.get(key); ok {
+		replyJSON(ctx, w, 200, reply)
+		return
+	}
+	reply, err := gitBlame(ctx, repo.Path, commit, file)
+	if err != nil {
+		writeError(ctx, w, 500, "internal_error", "Blaming "+file+": "+err.Error())
+		return
+	}
+	reply.Commit = commit
+	for _, c := range reply.Commits {
+		c.URL = commitURL(repo, c.Hash)
+	}
+	s.blame.put(key, reply)
+	replyJSON(ctx, w, 200, reply)
+}
+
+// ServeAPIHistory lists the commits that last changed a file, newest
+// first (GET /api/v2/history, with the parameters of /api/v2/blame).
+func (s *server) ServeAPIHistory(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	repo, file, commit, ok := s.blameRequest(ctx, w, r)
+	if !ok {
+		return
+	}
+	key := strings.Join([]string{"history", repo.Name, commit, file}, "\x00")
+	if reply, ok := s.blame.get(key); ok {
+		replyJSON(ctx, w, 200, reply)
+		return
+	}
+	reply, err := gitHistory(ctx, repo.Path, commit, file)
+	if err != nil {
+		writeError(ctx, w, 500, "internal_error", "Listing the history of "+file+": "+err.Error())
+		return
+	}
+	reply.Commit = commit
+	for _, c := range reply.Commits {
+		c.URL = commitURL(repo, c.Hash)
+	}
+	s.blame.put(key, reply)
+	replyJSON(ctx, w, 200, reply)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+const (
+	blameA = "1111111111111111111111111111111111111111"
+	blameB = "2222222222222222222222222222222222222222"
+)
+
+var blamePorcelain = blameA + ` 1 1 2
+author Alice
+author-mail <alice@example.com>
+author-time 1600000000
+author-tz +0000
+committer Alice
+summary Add the file
+filename main.go
+	package main
+` + blameA + ` 2 2
+	
+` + blameB + ` 3 3 1
+author Bob
+author-time 1700000000
+summary Say hello
+previous ` + blameA + ` main.go
+filename main.go
+	func main() { println("hello") }
+` + blameA + ` 3 4 1
+filename main.go
+	// the end
+`
+
+func TestParseBlame(t *testing.T) {
+	reply, err := parseBlame([]byte(blamePorcelain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Commits) != 2 {
+		t.Fatalf("commits %v", reply.Commits)
+	}
+	if a := reply.Commits[blameA]; a.Author != "Alice" || a.AuthorTime != 1600000000 || a.Summary != "Add the file" {
+		t.Errorf("commit A %+v", a)
+	}
+	if b := reply.Commits[blameB]; b.Author != "Bob" || b.Summary != "Say hello" {
+		t.Errorf("commit B %+v", b)
+	}
+	want := []struct {
+		commit      string
+		line, lines int
+	}{{blameA, 1, 2}, {blameB, 3, 1}, {blameA, 4, 1}}
+	if len(reply.Hunks) != len(want) {
+		t.Fatalf("hunks %+v", reply.Hunks)
+	}
+	for i, w := range want {
+		if h := reply.Hunks[i]; h.Commit != w.commit || h.Line != w.line || h.Lines != w.lines {
+			t.Errorf("hunk %d = %+v, want %+v", i, h, w)
+		}
+	}
+}
+
+func TestCommitURL(t *testing.T) {
+	cases := []struct {
+		metadata map[string]string
+		want     string
+	}{
+		{map[string]string{"url_pattern": "https://github.com/{name}/blob/{version}/{path}#L{lno}"},
+			"https://github.com/org/repo/commit/abc"},
+		{map[string]string{"url_pattern": "https://gitlab.com/{name}/-/blob/{version}/{path}#L{lno}"},
+			"https://gitlab.com/org/repo/-/commit/abc"},
+		{map[string]string{"url_pattern": "https://git.example.com/projects/P/repos/r/browse/{path}?at={version}#L{lno}"},
+			"https://git.example.com/projects/P/repos/r/commits/abc"},
+		{map[string]string{
+			"url_pattern":        "https://github.com/{name}/blob/{version}/{path}",
+			"commit_url_pattern": "https://review.example.com/{name}/+/{commit}",
+		}, "https://review.example.com/org/repo/+/abc"},
+		{map[string]string{"url_pattern": "https://example.com/{path}"}, ""},
+		{nil, ""},
+	}
+	for _, tc := range cases {
+		repo := config.RepoConfig{Name: "org/repo", Metadata: tc.metadata}
+		if got := commitURL(repo, "abc"); got != tc.want {
+			t.Errorf("commitURL(%v) = %q, want %q", tc.metadata, got, tc.want)
+		}
+	}
+}
+
+func TestBlameCache(t *testing.T) {
+	c := newBlameCache(2)
+	c.put("a", 1)
+	c.put("b", 2)
+	c.get("a")
+	c.put("c", 3) // evicts b, used least recently
+	if _, ok := c.get("b"); ok {
+		t.Errorf("b wasn't evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.get(k); !ok {
+			t.Errorf("%s was evicted", k)
+		}
+	}
+}
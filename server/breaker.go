@@ -0,0 +1,121 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerOpen     = 30 * time.Second
+)
+
+// A breaker stops searches being sent to a backend that has failed
+// several times in a row, so that while it is down users are told so at
+// once instead of each waiting out the search timeout. Once it has been
+// open for a while, it lets one search through to probe the backend:
+// if that succeeds it closes again, and if not it stays open for
+// another while. A nil *breaker lets everything through.
+type breaker struct {
+	id       string
+	failures int
+	open     time.Duration
+
+	mu          sync.Mutex
+	consecutive int
+	openUntil   time.Time // zero while closed
+	probing     bool
+}
+
+func newBreaker(id string, cfg config.CircuitBreaker) *breaker {
+	if cfg.Disabled {
+		return nil
+	}
+	b := &breaker{id: id, failures: cfg.Failures, open: time.Duration(cfg.OpenMs) * time.Millisecond}
+	if b.failures <= 0 {
+		b.failures = defaultBreakerFailures
+	}
+	if b.open <= 0 {
+		b.open = defaultBreakerOpen
+	}
+	return b
+}
+
+// allow reports whether a search may be sent to the backend.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// isOpen reports whether the breaker is open, without letting a probe
+// through as allow does.
+func (b *breaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
+
+// record notes whether a search sent to the backend failed because of
+// the backend.
+func (b *breaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if !b.openUntil.IsZero() {
+			logging.With("backend", b.id).Infof("backend %s: circuit closed", b.id)
+		}
+		b.consecutive, b.openUntil, b.probing = 0, time.Time{}, false
+		return
+	}
+	b.consecutive++
+	if b.probing || b.consecutive >= b.failures {
+		if b.openUntil.IsZero() {
+			logging.With("backend", b.id, "failures", b.consecutive).Warnf("backend %s: circuit open after %d consecutive failures", b.id, b.consecutive)
+		}
+		b.openUntil, b.probing = time.Now().Add(b.open), false
+	}
+}
+
+// reset closes the breaker, as when the backend is moved to a new
+// address.
+func (b *breaker) reset() {
+	b.record(false)
+}
+
+// backendFailed reports whether err, from a search that was given
+// timeout out of the backend's full search timeout, is the backend's
+// fault rather than the query's or the user's: an invalid query isn't,
+// nor a sym: search of a backend without symbols, and nor is timing out
+// after being given less time than usual.
+func backendFailed(err error, timeout, full time.Duration) bool {
+	switch grpc.Code(err) {
+	case codes.OK, codes.InvalidArgument, codes.FailedPrecondition, codes.Canceled:
+		return false
+	case codes.DeadlineExceeded:
+		return timeout >= full
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker("test", config.CircuitBreaker{Failures: 2, OpenMs: 50})
+	b.record(true)
+	if !b.allow() {
+		t.Fatal("open after one failure")
+	}
+	b.record(true)
+	if b.allow() {
+		t.Fatal("still closed after two failures")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("no probe allowed once open_ms passed")
+	}
+	if b.allow() {
+		t.Fatal("second search allowed while probing")
+	}
+	b.record(true)
+	if b.allow() {
+		t.Fatal("closed after a failed probe")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("no probe allowed once open_ms passed again")
+	}
+	b.record(false)
+	if !b.allow() || !b.allow() {
+		t.Fatal("still open after a successful probe")
+	}
+}
+
+func TestBackendFailed(t *testing.T) {
+	full := 10 * time.Second
+	for _, tc := range []struct {
+		err     error
+		timeout time.Duration
+		want    bool
+	}{
+		{nil, full, false},
+		{grpc.Errorf(codes.InvalidArgument, "bad regex"), full, false},
+		{grpc.Errorf(codes.FailedPrecondition, "No tags file available."), full, false},
+		{grpc.Errorf(codes.DeadlineExceeded, "timeout"), full, true},
+		{grpc.Errorf(codes.DeadlineExceeded, "timeout"), time.Second, false},
+		{grpc.Errorf(codes.Unavailable, "connection refused"), time.Second, true},
+		{errors.New("broken"), full, true},
+	} {
+		if got := backendFailed(tc.err, tc.timeout, full); got != tc.want {
+			t.Errorf("backendFailed(%v, %s) = %v, want %v", tc.err, tc.timeout, got, tc.want)
+		}
+	}
+}
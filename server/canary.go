@@ -0,0 +1,18 @@
+package server
+
+import (
+	"math/rand"
+)
+
+// The targets a search of a backend can be sent to, as tagged in its
+// metrics and logs.
+const (
+	targetStable = "stable"
+	targetCanary = "canary"
+)
+
+// routeToCanary reports whether a search of bk should go to its canary,
+// which it picks for canary.percent of searches at random.
+func (bk *Backend) routeToCanary() bool {
+	return bk.canary != nil && rand.Intn(100) < bk.canaryPercent
+}
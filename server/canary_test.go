@@ -0,0 +1,33 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestRouteToCanary(t *testing.T) {
+	stable := &Backend{Id: "stable"}
+	if stable.routeToCanary() {
+		t.Error("routed to a canary that isn't configured")
+	}
+
+	canary := &Backend{Id: "stable-canary"}
+	for _, tc := range []struct {
+		percent  int
+		min, max int
+	}{
+		{0, 0, 0},
+		{100, 1000, 1000},
+		{25, 150, 350},
+	} {
+		stable.canary, stable.canaryPercent = canary, tc.percent
+		n := 0
+		for i := 0; i < 1000; i++ {
+			if stable.routeToCanary() {
+				n++
+			}
+		}
+		if n < tc.min || n > tc.max {
+			t.Errorf("percent %d: %d of 1000 searches routed to canary", tc.percent, n)
+		}
+	}
+}
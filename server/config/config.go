@@ -7,6 +7,60 @@ import (
 type Backend struct {
 	Id   string `json:"id"`
 	Addr string `json:"addr"`
+	// Overrides the frontend's search_timeout_ms for this backend
+	SearchTimeoutMs int `json:"search_timeout_ms"`
+	// Send some of this backend's searches to another codesearch
+	// server, such as one running a new version
+	Canary Canary `json:"canary"`
+	// Repeat some of this backend's searches on another codesearch
+	// server, discarding its results, to compare the two
+	Shadow Shadow `json:"shadow"`
+	// Run the codesearch for this backend as a child of the frontend,
+	// listening on addr
+	Run *RunBackend `json:"run"`
+	// Serve this backend's index from several codesearch servers, each
+	// holding some of its repositories (see livegrep-shard), instead of
+	// from addr. Searches are sent to every shard and their results
+	// merged
+	Shards []Shard `json:"shards"`
+}
+
+type Shard struct {
+	// host:port of the codesearch server serving the shard
+	Addr string `json:"addr"`
+}
+
+type RunBackend struct {
+	// The codesearch binary; the one next to the frontend, or else
+	// on the PATH, by default
+	Codesearch string `json:"codesearch"`
+	// The index to serve, which is reloaded whenever it changes
+	Index string `json:"index"`
+	// More arguments to codesearch, such as "-threads=4"
+	Args []string `json:"args"`
+	// How often to check the index for changes; 10000 by default
+	PollMs int `json:"poll_ms"`
+	// An object storage prefix that livegrep-fetch-reindex -upload
+	// writes to, such as s3://bucket/livegrep/, to download Index from
+	// at startup and whenever a new one is uploaded
+	IndexURL string `json:"index_url"`
+	// How often to check IndexURL for a new index; 300000 by default
+	IndexPollMs int `json:"index_poll_ms"`
+}
+
+type Canary struct {
+	// host:port of the canary codesearch server
+	Addr string `json:"addr"`
+	// Percentage, 0 to 100, of searches sent to it instead of addr
+	Percent int `json:"percent"`
+}
+
+type Shadow struct {
+	// host:port of the shadow codesearch server
+	Addr string `json:"addr"`
+	// Percentage, 1 to 100, of searches repeated on it; 100 by
+	// default
+	Percent int `json:"percent"`
 }
 
 type Honeycomb struct {
@@ -14,6 +68,228 @@ type Honeycomb struct {
 	Dataset  string `json:"dataset"`
 }
 
+type StatsD struct {
+	// host:port of the StatsD or DogStatsD agent
+	Address string `json:"address"`
+	// Prepended, with a ".", to every metric name
+	Prefix string `json:"prefix"`
+	// How tags are sent: "datadog" (the default), "influxdb", or
+	// "none" for a plain StatsD server, which drops them
+	TagsFormat string `json:"tags_format"`
+	// Tags sent with every metric, such as {"env": "prod"}
+	Tags map[string]string `json:"tags"`
+}
+
+type AuditLog struct {
+	// Append a JSON line for each search to this file, which is
+	// rotated daily into path.YYYY-MM-DD
+	Path string `json:"path"`
+	// Delete rotated files after this many days; 0 keeps them
+	RetentionDays int `json:"retention_days"`
+	// POST each search's record, as JSON, to this URL
+	URL string `json:"url"`
+	// Request header naming the user, set by the authenticating
+	// proxy in front of the frontend (such as "X-Forwarded-User");
+	// without it, or if it is missing, the basic auth user is
+	// recorded
+	UserHeader string `json:"user_header"`
+}
+
+type Analytics struct {
+	// Aggregate searches and file views for /api/v2/stats
+	Enabled bool `json:"enabled"`
+	// Save the counts to this file every minute, and load them
+	// from it at startup, so they survive restarts
+	Path string `json:"path"`
+	// How many distinct queries, repositories and files to count;
+	// 10000 by default
+	MaxEntries int `json:"max_entries"`
+	// Append a JSON line for each search to this file, rotated daily
+	// into query_log.YYYY-MM-DD: its query, backend, status,
+	// latency, results and whether it was truncated, with the user
+	// only as an anonymous id
+	QueryLog string `json:"query_log"`
+	// Secret the anonymous user ids in query_log are keyed with;
+	// without it one is chosen at startup, so ids change with each
+	// restart
+	UserIDKey string `json:"user_id_key"`
+	// Request header naming the user, as for audit_log
+	UserHeader string `json:"user_header"`
+}
+
+type RateLimit struct {
+	// The most searches that may run at once; 0 for no limit
+	MaxConcurrent int `json:"max_concurrent"`
+	// How long a search may wait for one of those to finish before
+	// it is turned away; 0 turns it away at once
+	QueueTimeoutMs int `json:"queue_timeout_ms"`
+	// Searches per second each user may run on average, and how many
+	// at once after a lull; 0 for no limit. Anonymous searches are
+	// limited by client address. The burst is the rate, or at least
+	// 1, by default
+	PerUserRate  float64 `json:"per_user_rate"`
+	PerUserBurst int     `json:"per_user_burst"`
+	// Quotas for particular users or client addresses, such as a CI
+	// job that searches more, in place of per_user_rate
+	Quotas map[string]Quota `json:"quotas"`
+	// Request header naming the user, as for audit_log
+	UserHeader string `json:"user_header"`
+	// Limit anonymous searches by the first address in
+	// X-Forwarded-For, for a frontend behind a proxy
+	TrustForwardedFor bool `json:"trust_forwarded_for"`
+	// Turn away regexes with more than this many unbounded wildcards,
+	// such as the three of .*.*.*; 0 for no limit
+	MaxWildcards int `json:"max_wildcards"`
+}
+
+type Quota struct {
+	// Searches per second, and the burst, as for per_user_rate; 0 for
+	// no limit
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+type CircuitBreaker struct {
+	// Never stop sending searches to a failing backend
+	Disabled bool `json:"disabled"`
+	// Consecutive failures or timeouts after which a backend's
+	// searches fail at once; 5 by default
+	Failures int `json:"failures"`
+	// How long to wait before trying the backend again; 30000 by
+	// default
+	OpenMs int `json:"open_ms"`
+}
+
+// Ranking reorders the results of each search by how relevant they
+// look, where the backend returns them in index order. Searches can
+// choose their own signals with rank:.
+type Ranking struct {
+	// Put matches in tests and fixtures after the rest
+	DemoteTests bool `json:"demote_tests"`
+	// Prefer matches in files nearer the root of their repository
+	PreferShallow bool `json:"prefer_shallow"`
+	// Prefer matches in files whose name contains the match
+	BoostFilename bool `json:"boost_filename"`
+	// Prefer matches of whole words over matches inside longer ones
+	BoostExactWord bool `json:"boost_exact_word"`
+	// Prefer the definitions of symbols, found through the backend's
+	// tags index, over other matches
+	BoostDefinitions bool `json:"boost_definitions"`
+	// Weights added to the score of matches in repositories, by name,
+	// and in repositories with labels, given as key=value or just key;
+	// negative to demote. A test file costs 100, a definition is worth
+	// 8, a filename match 4, an exact word 2 and each directory deep -1.
+	RepoPriority  map[string]int `json:"repo_priority"`
+	LabelPriority map[string]int `json:"label_priority"`
+}
+
+type FeatureFlag struct {
+	// Enable the feature for everyone
+	Enabled bool `json:"enabled"`
+	// Enable it for these users
+	Users []string `json:"users"`
+	// Enable it for this percentage, 0 to 100, of users, chosen by
+	// a hash of the user and the flag's name so that each user
+	// either always has it or never does
+	Percent int `json:"percent"`
+}
+
+type Features struct {
+	// Request header naming the user, set by the authenticating
+	// proxy in front of the frontend; without it, or if it is
+	// missing, the basic auth user, or else the client's address,
+	// is used
+	UserHeader string `json:"user_header"`
+	// Flags by name, such as "streaming_results"
+	Flags map[string]FeatureFlag `json:"flags"`
+}
+
+// Embed serves a compact search widget at /embed for other sites, such
+// as wikis and team portals, to frame or load with the snippet at
+// /assets/js/embed.js.
+type Embed struct {
+	Enabled bool `json:"enabled"`
+	// Origins, such as "https://wiki.example.com", of the pages that
+	// may frame the widget, receive its messages, and call the search
+	// API from script; "*" allows any. Without them, only livegrep's
+	// own pages may.
+	Origins []string `json:"origins"`
+}
+
+// Auth requires users to sign in, and hides the restricted repositories
+// from those who may not see them: in search results, the file viewer
+// and the lists of repositories.
+type Auth struct {
+	// "header" trusts the user and groups set by an authenticating
+	// proxy in front of the frontend, such as oauth2-proxy, which must
+	// be the only way to reach it; "oidc" signs users in with an
+	// OpenID Connect provider. "" disables authentication.
+	Mode string `json:"mode"`
+	// With mode "header", the request headers naming the user,
+	// "X-Forwarded-User" by default, and their groups, separated by
+	// commas, "X-Forwarded-Groups" by default
+	UserHeader   string `json:"user_header"`
+	GroupsHeader string `json:"groups_header"`
+	OIDC         OIDC   `json:"oidc"`
+	// Repositories only some groups may see; every signed-in user may
+	// see the rest
+	Restricted []RestrictedRepos `json:"restricted"`
+}
+
+type OIDC struct {
+	// The provider's issuer URL, whose
+	// /.well-known/openid-configuration gives its endpoints
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"client_id"`
+	// The environment variable holding the client secret
+	ClientSecretEnv string `json:"client_secret_env"`
+	// This frontend's /auth/callback, as registered with the
+	// provider, such as "https://livegrep.example.com/auth/callback"
+	RedirectURL string `json:"redirect_url"`
+	// Scopes to ask for besides "openid"; "profile" and "email" by
+	// default, and whichever the provider needs for GroupsClaim
+	Scopes []string `json:"scopes"`
+	// The ID token claims naming the user, "email" by default, and
+	// listing their groups, "groups" by default
+	UserClaim   string `json:"user_claim"`
+	GroupsClaim string `json:"groups_claim"`
+	// The environment variable holding the key that session cookies
+	// are signed with, which every frontend behind one URL must share;
+	// without it, a random key, so sessions end when the frontend
+	// restarts
+	SessionKeyEnv string `json:"session_key_env"`
+	// How long a sign-in lasts; 12 by default
+	SessionHours int `json:"session_hours"`
+}
+
+type RestrictedRepos struct {
+	// A regex matching the whole names of the repositories
+	Repos string `json:"repos"`
+	// The groups that may see them. A repository matched by more than
+	// one entry may be seen only by those in a group of each.
+	Groups []string `json:"groups"`
+}
+
+// SavedSearches lets signed-in users save searches under a name, and
+// share them by short links, /s/<id>. It needs auth, to know whose
+// searches are whose.
+type SavedSearches struct {
+	Enabled bool `json:"enabled"`
+	// Where saved searches are kept: "bolt", the default, in the
+	// BoltDB file at Path, or "memory", only until the frontend
+	// restarts
+	Store string `json:"store"`
+	Path  string `json:"path"`
+	// How many searches each user may save; 100 by default
+	MaxPerUser int `json:"max_per_user"`
+}
+
+// Prometheus serves search metrics at /metrics for Prometheus to
+// scrape.
+type Prometheus struct {
+	Enabled bool `json:"enabled"`
+}
+
 type Config struct {
 	// Location of the directory containing templates and static
 	// assets. This should point at the "web" directory of the
@@ -33,6 +309,11 @@ type Config struct {
 	// the "id" and "addr" fields.
 	Backends []Backend `json:"backends"`
 
+	// With more than one backend, offer "All indexes" first in the
+	// search page's backend selector, so by default, which searches
+	// every backend at once and labels each result with its index
+	SearchAllBackends bool `json:"search_all_backends"`
+
 	// The address to listen on, as HOST:PORT.
 	Listen string `json:"listen"`
 
@@ -51,10 +332,67 @@ type Config struct {
 	// Whether to re-load templates on every request
 	Reload bool `json:"reload"`
 
+	// If set, enables the admin API for changing a backend's address
+	// while running, which requires this as a bearer token.
+	AdminToken string `json:"admin_token"`
+
 	// honeycomb API write key
 	Honeycomb Honeycomb `json:"honeycomb"`
 
+	// If address is set, search metrics are sent over StatsD
+	StatsD StatsD `json:"statsd"`
+
+	// Search metrics for Prometheus
+	Prometheus Prometheus `json:"prometheus"`
+
+	// If path or url is set, every search is recorded there
+	AuditLog AuditLog `json:"audit_log"`
+
+	// Query analytics, served to admins (see admin_token)
+	Analytics Analytics `json:"analytics"`
+
+	// Features being rolled out to some users before everyone
+	Features Features `json:"features"`
+
+	// The search widget for other sites to embed
+	Embed Embed `json:"embed"`
+
+	// Signing in, and which repositories each user may see
+	Auth Auth `json:"auth"`
+
+	// Signed-in users' saved searches and their short links
+	SavedSearches SavedSearches `json:"saved_searches"`
+
+	// How to order search results; in the backend's order by default
+	Ranking Ranking `json:"ranking"`
+
 	DefaultMaxMatches int32 `json:"default_max_matches"`
+	// The limit on files returned by filename-only searches that don't
+	// give a max_files:, if it isn't default_max_matches
+	DefaultMaxFiles int32 `json:"default_max_files"`
+	// The most matches a search may ask for, with max_matches: or the
+	// max_matches parameter; unlimited if 0
+	MaxMatchesLimit int32 `json:"max_matches_limit"`
+
+	// How long a search may wait on its backend before the user is
+	// told it timed out; at most, and by default, 30000
+	SearchTimeoutMs int `json:"search_timeout_ms"`
+
+	// When to give up on a failing backend for a while
+	CircuitBreaker CircuitBreaker `json:"circuit_breaker"`
+
+	// Have /readyz report the frontend not ready while a backend's
+	// index is older than this, so that a load balancer routes around
+	// an instance whose indexing has stalled; 0 disables
+	MaxIndexAgeHours int `json:"max_index_age_hours"`
+
+	// How many searches may run at once, and how often each user may
+	// search, so that one client can't starve everyone else
+	RateLimit RateLimit `json:"rate_limit"`
+
+	// Log searches that take longer than this, with a breakdown of
+	// where the time went; 0 disables
+	SlowQueryThresholdMs int `json:"slow_query_threshold_ms"`
 
 	// Same json config structure that the backend uses when building indexes;
 	// used here for repository browsing.
@@ -62,6 +400,10 @@ type Config struct {
 
 	DefaultSearchRepos []string `json:"default_search_repos"`
 
+	// The age the search page's "active repos only" option passes as
+	// active:, such as "90d"; "365d" by default
+	ActiveWindow string `json:"active_window"`
+
 	LinkConfigs []LinkConfig `json:"file_links"`
 
 	// Maximum gRPC receive message size in bytes: this allows larger result sets from codesearch
@@ -70,6 +412,23 @@ type Config struct {
 	// Maximum gRPC send message size in bytes: this allows larger queries to codesearch
 	GrpcMaxSendMessageSize int `json:"grpc_max_send_message_size"`
 
+	// Number of gRPC connections to open to each backend, over which
+	// searches are spread; 1 by default
+	GrpcConnections int `json:"grpc_connections"`
+
+	// Ping each backend connection when it has been idle this long,
+	// so that connections through NATs and load balancers that drop
+	// idle flows are kept open, or noticed to be dead; 0 disables
+	GrpcKeepaliveTimeMs int `json:"grpc_keepalive_time_ms"`
+
+	// Close a connection whose keepalive ping isn't answered within
+	// this long; 20000 by default
+	GrpcKeepaliveTimeoutMs int `json:"grpc_keepalive_timeout_ms"`
+
+	// The longest to wait between attempts to reconnect to a backend;
+	// 120000 by default
+	GrpcMaxBackoffMs int `json:"grpc_max_backoff_ms"`
+
 	// Additional file extensions to highlight with PrismJS in the built-in fileview
 	FileExtToLang map[string]string `json:"file_ext_to_lang"`
 
@@ -82,6 +441,19 @@ type Config struct {
 type IndexConfig struct {
 	Name         string       `json:"name"`
 	Repositories []RepoConfig `json:"repositories"`
+	// The encodings codesearch transcodes files from, and the secrets it
+	// masks, so that the file viewer can do the same. Repositories may
+	// set their own.
+	Encodings []string   `json:"encodings"`
+	Redaction *Redaction `json:"redaction"`
+}
+
+// Redaction mirrors the Redaction message of src/proto/config.proto.
+type Redaction struct {
+	BuiltinRules     bool     `json:"builtin_rules"`
+	Patterns         []string `json:"patterns"`
+	MinEntropy       float64  `json:"min_entropy"`
+	MinEntropyLength int      `json:"min_entropy_length"`
 }
 
 type RepoConfig struct {
@@ -90,6 +462,8 @@ type RepoConfig struct {
 	Revisions      []string          `json:"revisions"`
 	Metadata       map[string]string `json:"metadata"`
 	WalkSubmodules bool              `json:"walk_submodules"`
+	Encodings      []string          `json:"encodings"`
+	Redaction      *Redaction        `json:"redaction"`
 }
 
 type LinkConfig struct {
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// symbolRE matches the names jump to definition looks up, as the tags
+// index names them.
+var symbolRE = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// maxDefinitions is how many definitions of a symbol jump to definition
+// asks the backend for; it only needs to know if there is more than one.
+const maxDefinitions = 50
+
+// ServeDefinition takes the fileview's jump to definition, of the symbol
+// ?symbol= from the repository ?repo=, to the line that defines it, if
+// the backend's tags index has just one definition in that repository,
+// or else just one anywhere. Otherwise, it lists the definitions with a
+// sym: search.
+func (s *server) ServeDefinition(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	repo := r.FormValue("repo")
+	symbol := strings.TrimSpace(r.FormValue("symbol"))
+	if !symbolRE.MatchString(symbol) {
+		http.Error(w, fmt.Sprintf("%q isn't a symbol name", symbol), 400)
+		return
+	}
+	line := "^" + regexp.QuoteMeta(symbol) + "$"
+
+	backend := s.backendWithTree(repo)
+	list := "/search"
+	if backend != nil {
+		list += "/" + url.PathEscape(backend.Id)
+	}
+	list += "?q=" + url.QueryEscape("regex:yes sym:"+line)
+	if backend == nil {
+		http.Redirect(w, r, list, 303)
+		return
+	}
+
+	q := pb.Query{Line: line, Tags: ".", MaxMatches: maxDefinitions}
+	excludeRepos(&q, s.auth.hiddenRepos(r, []*Backend{backend}))
+	reply, _, err := s.searchOne(ctx, backend, &q, r, newSearchTiming())
+	if err != nil {
+		// The search page explains the error
+		http.Redirect(w, r, list, 303)
+		return
+	}
+	if d := onlyDefinition(reply.Results, repo); d != nil {
+		http.Redirect(w, r, internalURL(d.Tree, d.Path, d.LineNumber), 303)
+		return
+	}
+	http.Redirect(w, r, list, 303)
+}
+
+// backendWithTree returns the first backend to index the tree named
+// name, or the first backend if none does.
+func (s *server) backendWithTree(name string) *Backend {
+	for _, id := range s.bkOrder {
+		bk := s.bk[id]
+		bk.I.Lock()
+		found := false
+		for _, t := range bk.I.Trees {
+			if t.Name == name {
+				found = true
+				break
+			}
+		}
+		bk.I.Unlock()
+		if found {
+			return bk
+		}
+	}
+	if len(s.bkOrder) > 0 {
+		return s.bk[s.bkOrder[0]]
+	}
+	return nil
+}
+
+// onlyDefinition returns the definition among results to jump to: the
+// only one in repo, or failing any there, the only one at all; or nil,
+// to list them.
+func onlyDefinition(results []*api.Result, repo string) *api.Result {
+	var in []*api.Result
+	for _, r := range results {
+		if r.Tree == repo {
+			in = append(in, r)
+		}
+	}
+	switch {
+	case len(in) == 1:
+		return in[0]
+	case len(in) == 0 && len(results) == 1:
+		return results[0]
+	}
+	return nil
+}
+
+// internalURL returns the fileview's URL for line lno of path in tree.
+func internalURL(tree, path string, lno int) string {
+	return fmt.Sprintf("/view/%s/%s#L%d", tree, strings.TrimLeft(path, "/"), lno)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+	"golang.org/x/net/context"
+)
+
+func TestOnlyDefinition(t *testing.T) {
+	a := &api.Result{Tree: "a", Path: "a.go"}
+	b := &api.Result{Tree: "b", Path: "b.go"}
+	b2 := &api.Result{Tree: "b", Path: "b2.go"}
+	cases := []struct {
+		results []*api.Result
+		repo    string
+		want    *api.Result
+	}{
+		{nil, "a", nil},
+		{[]*api.Result{a, b}, "a", a},
+		{[]*api.Result{b}, "a", b},
+		{[]*api.Result{b, b2}, "a", nil},
+		{[]*api.Result{a, b, b2}, "b", nil},
+	}
+	for i, tc := range cases {
+		if got := onlyDefinition(tc.results, tc.repo); got != tc.want {
+			t.Errorf("%d: got %+v, want %+v", i, got, tc.want)
+		}
+	}
+}
+
+func TestServeDefinition(t *testing.T) {
+	s := &server{}
+	for url, want := range map[string]int{
+		"/definition?repo=a&symbol=parseQuery": 303,
+		"/definition?repo=a&symbol=a.b":        400,
+		"/definition?repo=a&symbol=%28%29":     400,
+		"/definition?repo=a&symbol=+_Parse2$+": 303,
+		"/definition?repo=a":                   400,
+	} {
+		w := httptest.NewRecorder()
+		s.ServeDefinition(context.Background(), w, httptest.NewRequest("GET", url, nil))
+		if w.Code != want {
+			t.Errorf("%s: status %d, want %d", url, w.Code, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeDefinition(context.Background(), w, httptest.NewRequest("GET", "/definition?repo=a&symbol=Foo", nil))
+	if loc := w.Header().Get("Location"); loc != "/search?q=regex%3Ayes+sym%3A%5EFoo%24" {
+		t.Errorf("redirected to %q", loc)
+	}
+}
+
+func TestInternalURL(t *testing.T) {
+	if got := internalURL("org/repo", "/src/a.go", 12); got != "/view/org/repo/src/a.go#L12" {
+		t.Errorf("internalURL = %q", got)
+	}
+}
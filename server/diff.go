@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/log"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// A diffError is why a diff couldn't be run, as the status, code and
+// message to reply with.
+type diffError struct {
+	status  int
+	code    string
+	message string
+}
+
+// A diffKey identifies a matching line in either of the indexes being
+// compared. Line numbers shift as code around a line changes, and
+// versions differ from one index to the next, so it is the file and the
+// text of the line.
+type diffKey struct {
+	tree, path, line string
+}
+
+// diffResults compares the results of a search of one index, from,
+// with those of the same search of another, to, returning the results
+// only in to (added) and those only in from (removed). A line that
+// appears several times in a file counts each time.
+func diffResults(from, to []*api.Result) (added, removed []*api.Result) {
+	only := func(these, others []*api.Result) []*api.Result {
+		count := make(map[diffKey]int, len(others))
+		for _, r := range others {
+			count[diffKey{r.Tree, r.Path, r.Line}]++
+		}
+		out := make([]*api.Result, 0)
+		for _, r := range these {
+			k := diffKey{r.Tree, r.Path, r.Line}
+			if count[k] > 0 {
+				count[k]--
+				continue
+			}
+			out = append(out, r)
+		}
+		return out
+	}
+	return only(to, from), only(from, to)
+}
+
+// diff runs the query r asks for on the backends named by the :from
+// and :to of its URL, and compares their results.
+func (s *server) diff(ctx context.Context, r *http.Request) (*api.ReplyDiff, *diffError) {
+	params := r.URL.Query()
+	var backends [2]*Backend
+	for i, name := range []string{params.Get(":from"), params.Get(":to")} {
+		if backends[i] = s.bk[name]; backends[i] == nil {
+			return nil, &diffError{400, "bad_backend", fmt.Sprintf("Unknown backend: %s", name)}
+		}
+	}
+
+	q, interp, err := extractQuery(ctx, r)
+	if err != nil {
+		return nil, &diffError{400, "bad_query", err.Error()}
+	}
+	if q.Line == "" {
+		kind := "string"
+		if interp.regex {
+			kind = "regex"
+		}
+		return nil, &diffError{400, "bad_query", fmt.Sprintf("You must specify a %s to match", kind)}
+	}
+	if err := s.limiter.checkCost(q.Line); err != nil {
+		return nil, &diffError{400, "query_too_expensive", err.Error()}
+	}
+	s.limitMatches(&q)
+	excludeRepos(&q, s.auth.hiddenRepos(r, backends[:]))
+
+	var replies [2]*api.ReplySearch
+	var timeouts [2]time.Duration
+	var errs [2]error
+	var wg sync.WaitGroup
+	for i, bk := range backends {
+		wg.Add(1)
+		go func(i int, bk *Backend) {
+			defer wg.Done()
+			replies[i], timeouts[i], errs[i] = s.searchOne(ctx, bk, &q, r, newSearchTiming())
+		}(i, bk)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == errBackendOpen {
+			return nil, &diffError{503, "backend_unavailable",
+				fmt.Sprintf("The %s backend is failing, so searches of it are paused; please try again in a little while", backends[i].Id)}
+		}
+		if err != nil {
+			log.FromContext(ctx).With("backend", backends[i].Id, "err", err).Errorf("error in diff search")
+			status, code, message := queryError(err, timeouts[i])
+			return nil, &diffError{status, code, message}
+		}
+	}
+
+	from, to := replies[0], replies[1]
+	reply := &api.ReplyDiff{
+		From:      backends[0].Id,
+		To:        backends[1].Id,
+		Query:     r.FormValue("q"),
+		FromCount: len(from.Results),
+		ToCount:   len(to.Results),
+		Incomplete: from.Info.ExitReason != pb.SearchStats_NONE.String() ||
+			to.Info.ExitReason != pb.SearchStats_NONE.String(),
+	}
+	reply.Added, reply.Removed = diffResults(from.Results, to.Results)
+	log.Printf(ctx, "diff from=%s to=%s added=%d removed=%d",
+		reply.From, reply.To, len(reply.Added), len(reply.Removed))
+	return reply, nil
+}
+
+// ServeAPIDiff runs a search on two backends, such as one serving an
+// older generation of an index and one serving the current one, and
+// replies with the matches added and removed between them.
+func (s *server) ServeAPIDiff(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	reply, derr := s.diff(ctx, r)
+	if derr != nil {
+		writeError(ctx, w, derr.status, derr.code, derr.message)
+		return
+	}
+	replyJSON(ctx, w, 200, reply)
+}
+
+// ServeDiff shows the same comparison as ServeAPIDiff as a page.
+func (s *server) ServeDiff(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	reply, derr := s.diff(ctx, r)
+	if derr != nil {
+		http.Error(w, derr.message, derr.status)
+		return
+	}
+	s.renderPage(ctx, w, r, "diff.html", &page{
+		Title:         "diff",
+		IncludeHeader: true,
+		Data:          reply,
+	})
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+func TestDiffResults(t *testing.T) {
+	res := func(path string, lno int, line string) *api.Result {
+		return &api.Result{Tree: "repo", Path: path, LineNumber: lno, Line: line}
+	}
+	from := []*api.Result{
+		res("a.go", 10, "legacy.Call()"),
+		res("a.go", 20, "legacy.Call()"),
+		res("b.go", 5, "legacy.Call()"),
+	}
+	// a.go lost a call and its other one moved; c.go gained one.
+	to := []*api.Result{
+		res("a.go", 12, "legacy.Call()"),
+		res("b.go", 5, "legacy.Call()"),
+		res("c.go", 1, "legacy.Call()"),
+	}
+	added, removed := diffResults(from, to)
+	if want := []*api.Result{to[2]}; !reflect.DeepEqual(added, want) {
+		t.Errorf("added = %v, want %v", added, want)
+	}
+	if want := []*api.Result{from[1]}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed = %v, want %v", removed, want)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// embedScriptData initializes the search widget. Besides what the
+// search page knows, it carries the widget's settings from its URL:
+//
+//	/embed?scope=repo:^org/payments-+-file:test&backend=prod&open=top
+type embedScriptData struct {
+	*searchScriptData
+	// Query text added to every search, such as "repo:^org/team-"
+	Scope string `json:"scope"`
+	// The backend to search; the first by default
+	Backend string `json:"backend"`
+	// The search to start with
+	Query string `json:"query"`
+	// How many matches to show
+	MaxMatches int `json:"max_matches"`
+	// Where clicking a result opens it: "tab" (the default), "top",
+	// to replace the embedding page, or "none", to leave it to the
+	// embedding page, which is sent a message either way
+	Open string `json:"open"`
+	// The origins the widget may post messages to
+	Origins []string `json:"origins"`
+}
+
+const (
+	defaultEmbedMatches = 10
+	maxEmbedMatches     = 50
+)
+
+func (s *server) ServeEmbed(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	search, _, _ := s.makeSearchScriptData(r)
+	data := &embedScriptData{
+		searchScriptData: search,
+		Scope:            params.Get("scope"),
+		Backend:          params.Get("backend"),
+		Query:            params.Get("q"),
+		MaxMatches:       defaultEmbedMatches,
+		Open:             params.Get("open"),
+		Origins:          s.config.Embed.Origins,
+	}
+	if data.Backend == "" && len(s.bkOrder) > 0 {
+		data.Backend = s.bkOrder[0]
+	} else if s.bk[data.Backend] == nil {
+		http.Error(w, "No such backend", 404)
+		return
+	}
+	if n, err := strconv.Atoi(params.Get("max_matches")); err == nil && n > 0 {
+		data.MaxMatches = n
+		if n > maxEmbedMatches {
+			data.MaxMatches = maxEmbedMatches
+		}
+	}
+	switch data.Open {
+	case "", "tab":
+		data.Open = "tab"
+	case "top", "none":
+	default:
+		http.Error(w, "open must be tab, top or none", 400)
+		return
+	}
+
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+s.frameAncestors())
+	s.renderPage(ctx, w, r, "embed.html", &page{
+		Title:      "code search",
+		ScriptName: "embed",
+		ScriptData: data,
+	})
+}
+
+// frameAncestors returns the sources of the widget's frame-ancestors
+// directive: livegrep itself and the configured origins.
+func (s *server) frameAncestors() string {
+	sources := []string{"'self'"}
+	for _, o := range s.config.Embed.Origins {
+		if o == "*" {
+			return "*"
+		}
+		sources = append(sources, o)
+	}
+	return strings.Join(sources, " ")
+}
+
+// allowedOrigin reports whether pages from origin may embed the widget
+// and call the API.
+func (s *server) allowedOrigin(origin string) bool {
+	for _, o := range s.config.Embed.Origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// cors lets the configured origins call h from script. Their requests
+// are made without credentials, so h must be reachable without them.
+func (s *server) cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" || !s.allowedOrigin(origin) {
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(403)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(204)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestServeEmbed(t *testing.T) {
+	bk, err := NewBackend("prod", "localhost:1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{
+		config:  &config.Config{Embed: config.Embed{Enabled: true, Origins: []string{"https://wiki.example.com"}}},
+		bk:      map[string]*Backend{"prod": bk},
+		bkOrder: []string{"prod"},
+	}
+	cases := []struct {
+		url    string
+		status int
+	}{
+		{"/embed?scope=repo:x", 200},
+		{"/embed?backend=prod&open=top", 200},
+		{"/embed?backend=other", 404},
+		{"/embed?open=window", 400},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		srv.ServeEmbed(context.Background(), w, httptest.NewRequest("GET", tc.url, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.url, w.Code, tc.status)
+		}
+		want := "frame-ancestors 'self' https://wiki.example.com"
+		if got := w.Header().Get("Content-Security-Policy"); w.Code == 200 && got != want {
+			t.Errorf("%s: got CSP %q, want %q", tc.url, got, want)
+		}
+	}
+}
+
+func TestEmbedCORS(t *testing.T) {
+	srv := &server{config: &config.Config{Embed: config.Embed{Origins: []string{"https://wiki.example.com"}}}}
+	h := srv.cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	cases := []struct {
+		method, origin string
+		status         int
+		allowed        string
+	}{
+		{"POST", "https://wiki.example.com", 200, "https://wiki.example.com"},
+		{"OPTIONS", "https://wiki.example.com", 204, "https://wiki.example.com"},
+		{"POST", "https://evil.example.com", 200, ""},
+		{"OPTIONS", "https://evil.example.com", 403, ""},
+		{"GET", "", 200, ""},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(tc.method, "/api/v1/search/", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s from %q: got status %d, want %d", tc.method, tc.origin, w.Code, tc.status)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.allowed {
+			t.Errorf("%s from %q: got allowed origin %q, want %q", tc.method, tc.origin, got, tc.allowed)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// /api/v1/search/ replies in another format if given one as the format
+// parameter: SARIF, for code-scanning dashboards to ingest searches for
+// banned APIs and the like as findings, or CSV, for spreadsheets.
+type exporter struct {
+	contentType string
+	// Writes reply, the results of a search for query
+	write func(w io.Writer, query string, reply *api.ReplySearch) error
+}
+
+var exporters = map[string]exporter{
+	"sarif": {"application/sarif+json", writeSARIF},
+	"csv":   {"text/csv; charset=utf-8", writeCSV},
+}
+
+// checkFormat returns an error unless format, the format parameter of
+// a search, is one it can reply in.
+func checkFormat(format string) error {
+	if _, ok := exporters[format]; ok || format == "" || format == "json" {
+		return nil
+	}
+	return fmt.Errorf("Unknown format %q (want json, sarif or csv)", format)
+}
+
+// writeExport writes reply, the results of a search for query, in
+// format, one of exporters.
+func writeExport(ctx context.Context, w http.ResponseWriter, format, query string, reply *api.ReplySearch) {
+	e := exporters[format]
+	w.Header().Set("Content-Type", e.contentType)
+	if format == "csv" {
+		w.Header().Set("Content-Disposition", `attachment; filename="livegrep.csv"`)
+	}
+	w.WriteHeader(200)
+	if err := e.write(w, query, reply); err != nil {
+		log.Warnf(ctx, "writing %s export: %s", format, err.Error())
+	}
+}
+
+// The parts of SARIF 2.1.0 a search fills in.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool          `json:"tool"`
+	Invocations []sarifInvocation  `json:"invocations"`
+	ColumnKind  string             `json:"columnKind"`
+	Results     []sarifResult      `json:"results"`
+	Properties  sarifRunProperties `json:"properties"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful bool                `json:"executionSuccessful"`
+	Notifications       []sarifNotification `json:"toolExecutionNotifications,omitempty"`
+}
+
+type sarifNotification struct {
+	Level   string       `json:"level"`
+	Message sarifMessage `json:"message"`
+}
+
+type sarifRunProperties struct {
+	Query      string `json:"query"`
+	SearchType string `json:"searchType"`
+	Truncated  bool   `json:"truncated"`
+}
+
+type sarifResult struct {
+	RuleID     string                `json:"ruleId"`
+	Level      string                `json:"level"`
+	Message    sarifMessage          `json:"message"`
+	Locations  []sarifLocation       `json:"locations"`
+	Properties sarifResultProperties `json:"properties"`
+}
+
+type sarifResultProperties struct {
+	Repo    string `json:"repo"`
+	Version string `json:"version"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+// The path of a result is relative to its repository, which is its
+// uriBaseId, as code-scanning tools expect.
+type sarifArtifactLocation struct {
+	URI       string `json:"uri"`
+	URIBaseID string `json:"uriBaseId,omitempty"`
+}
+
+type sarifRegion struct {
+	StartLine   int          `json:"startLine"`
+	StartColumn int          `json:"startColumn"`
+	EndColumn   int          `json:"endColumn"`
+	Snippet     sarifMessage `json:"snippet"`
+}
+
+const sarifRuleID = "livegrep/search"
+
+// writeSARIF writes reply as a SARIF log with one run, whose one rule
+// is the search, and a result for each match.
+func writeSARIF(w io.Writer, query string, reply *api.ReplySearch) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "livegrep",
+			InformationURI: "https://github.com/livegrep/livegrep",
+			Rules: []sarifRule{{
+				ID:               sarifRuleID,
+				ShortDescription: sarifMessage{Text: query},
+			}},
+		}},
+		Invocations: []sarifInvocation{{ExecutionSuccessful: true}},
+		// Columns are counted in characters, not the UTF-16 units
+		// SARIF assumes otherwise.
+		ColumnKind: "unicodeCodePoints",
+		Results:    []sarifResult{},
+		Properties: sarifRunProperties{
+			Query:      query,
+			SearchType: reply.SearchType,
+			Truncated:  reply.Truncated,
+		},
+	}
+	if reply.Truncated {
+		run.Invocations[0].Notifications = []sarifNotification{{
+			Level:   "warning",
+			Message: sarifMessage{Text: "The search stopped at its match limit or timeout, so there may be more matches"},
+		}}
+	}
+
+	for _, r := range reply.Results {
+		run.Results = append(run.Results, sarifResult{
+			RuleID:  sarifRuleID,
+			Level:   "warning",
+			Message: sarifMessage{Text: r.Line},
+			Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: r.Path, URIBaseID: r.Tree},
+				Region: &sarifRegion{
+					StartLine:   r.LineNumber,
+					StartColumn: column(r.Line, r.Bounds[0]),
+					EndColumn:   column(r.Line, r.Bounds[1]),
+					Snippet:     sarifMessage{Text: r.Line},
+				},
+			}}},
+			Properties: sarifResultProperties{Repo: r.Tree, Version: r.Version},
+		})
+	}
+	for _, f := range reply.FileResults {
+		run.Results = append(run.Results, sarifResult{
+			RuleID:  sarifRuleID,
+			Level:   "warning",
+			Message: sarifMessage{Text: "Path matched: " + f.Path},
+			Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: f.Path, URIBaseID: f.Tree},
+			}}},
+			Properties: sarifResultProperties{Repo: f.Tree, Version: f.Version},
+		})
+	}
+
+	return json.NewEncoder(w).Encode(&sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
+
+// column returns the 1-based column, in characters, of the byte offset
+// off in line.
+func column(line string, off int) int {
+	if off > len(line) {
+		off = len(line)
+	}
+	return utf8.RuneCountInString(line[:off]) + 1
+}
+
+// writeCSV writes reply as CSV, with a row for each matching line and
+// then each matching file, whose line and text are empty.
+func writeCSV(w io.Writer, query string, reply *api.ReplySearch) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"repo", "version", "path", "line", "text"})
+	for _, r := range reply.Results {
+		cw.Write([]string{
+			csvCell(r.Tree), csvCell(r.Version), csvCell(r.Path),
+			strconv.Itoa(r.LineNumber), csvCell(r.Line),
+		})
+	}
+	for _, f := range reply.FileResults {
+		cw.Write([]string{csvCell(f.Tree), csvCell(f.Version), csvCell(f.Path), "", ""})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvCell quotes s, if it would otherwise be read as a formula by a
+// spreadsheet, with a leading '.
+func csvCell(s string) string {
+	if s == "" {
+		return s
+	}
+	switch s[0] {
+	case '=', '+', '-', '@':
+		return "'" + s
+	}
+	return s
+}
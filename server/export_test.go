@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+var exportReply = &api.ReplySearch{
+	Results: []*api.Result{
+		{Tree: "org/api", Version: "main", Path: "hash.go", LineNumber: 12,
+			Line: "\th := md5.New() // é", Bounds: [2]int{6, 13}},
+		{Tree: "org/web", Version: "main", Path: "=cmd.sh", LineNumber: 1,
+			Line: "-md5.New", Bounds: [2]int{1, 8}},
+	},
+	SearchType: "normal",
+	Truncated:  true,
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, `md5\.New`, exportReply); err != nil {
+		t.Fatal(err)
+	}
+	want := "repo,version,path,line,text\n" +
+		"org/api,main,hash.go,12,\"\th := md5.New() // é\"\n" +
+		"org/web,main,'=cmd.sh,1,'-md5.New\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteSARIF(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeSARIF(&buf, `md5\.New`, exportReply); err != nil {
+		t.Fatal(err)
+	}
+	var log sarifLog
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		t.Fatal(err)
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 {
+		t.Fatalf("version %q, %d runs", log.Version, len(log.Runs))
+	}
+	run := log.Runs[0]
+	if run.Properties.Query != `md5\.New` || !run.Properties.Truncated ||
+		run.Tool.Driver.Rules[0].ShortDescription.Text != `md5\.New` {
+		t.Errorf("run properties %+v, rules %+v", run.Properties, run.Tool.Driver.Rules)
+	}
+	if len(run.Invocations[0].Notifications) != 1 {
+		t.Error("no notification that the search was truncated")
+	}
+	if len(run.Results) != 2 {
+		t.Fatalf("%d results, want 2", len(run.Results))
+	}
+	loc := run.Results[0].Locations[0].PhysicalLocation
+	if loc.ArtifactLocation.URI != "hash.go" || loc.ArtifactLocation.URIBaseID != "org/api" {
+		t.Errorf("artifact location %+v", loc.ArtifactLocation)
+	}
+	if r := loc.Region; r.StartLine != 12 || r.StartColumn != 7 || r.EndColumn != 14 {
+		t.Errorf("region %+v", r)
+	}
+}
+
+func TestColumn(t *testing.T) {
+	line := "é = x"
+	if c := column(line, 0); c != 1 {
+		t.Errorf("column(0) = %d", c)
+	}
+	if c := column(line, 3); c != 3 {
+		t.Errorf("column(3) = %d, want 3", c)
+	}
+	if c := column(line, 100); c != 6 {
+		t.Errorf("column(100) = %d, want 6", c)
+	}
+}
+
+func TestCheckFormat(t *testing.T) {
+	for _, f := range []string{"", "json", "sarif", "csv"} {
+		if err := checkFormat(f); err != nil {
+			t.Errorf("%q: %v", f, err)
+		}
+	}
+	if checkFormat("xml") == nil {
+		t.Error("xml: no error")
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// features decides which of the configured feature flags are on for
+// the user making a request, so that new capabilities can be tried by
+// some users before everyone gets them. A nil *features has every flag
+// off.
+type features struct {
+	userHeader string
+	flags      map[string]config.FeatureFlag
+	users      map[string]map[string]bool // flag -> user -> enabled
+}
+
+func newFeatures(cfg config.Features) (*features, error) {
+	if len(cfg.Flags) == 0 {
+		return nil, nil
+	}
+	f := &features{
+		userHeader: cfg.UserHeader,
+		flags:      cfg.Flags,
+		users:      make(map[string]map[string]bool, len(cfg.Flags)),
+	}
+	for name, flag := range cfg.Flags {
+		if flag.Percent < 0 || flag.Percent > 100 {
+			return nil, fmt.Errorf("%s: percent must be between 0 and 100", name)
+		}
+		users := make(map[string]bool, len(flag.Users))
+		for _, u := range flag.Users {
+			users[u] = true
+		}
+		f.users[name] = users
+	}
+	return f, nil
+}
+
+// enabled reports whether the flag name is on for the user making r.
+func (f *features) enabled(r *http.Request, name string) bool {
+	if f == nil {
+		return false
+	}
+	flag, ok := f.flags[name]
+	if !ok {
+		return false
+	}
+	if flag.Enabled {
+		return true
+	}
+	user := f.user(r)
+	if f.users[name][user] {
+		return true
+	}
+	return flag.Percent > 0 && rolloutBucket(name, user) < flag.Percent
+}
+
+// enabledFor returns the names of the flags that are on for the user
+// making r, sorted, for the UI.
+func (f *features) enabledFor(r *http.Request) []string {
+	names := []string{}
+	if f == nil {
+		return names
+	}
+	for name := range f.flags {
+		if f.enabled(r, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// user returns who made r: the user_header set by the authenticating
+// proxy, or the basic auth user, or else the client's address, so that
+// percentage rollouts are stable even for anonymous users.
+func (f *features) user(r *http.Request) string {
+	if u := requestUser(r, f.userHeader); u != "" {
+		return u
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rolloutBucket places user in one of 100 buckets for the flag name.
+// Hashing the name in too means each flag is rolled out to a different
+// subset of users.
+func rolloutBucket(name, user string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(user))
+	return int(h.Sum32() % 100)
+}
+
+// requestUser returns the user who signed in to make r, if auth is
+// configured, or else the user named by header in r, as set by the
+// authenticating proxy in front of the frontend, or else the basic
+// auth user, or "" if there is none of them.
+func requestUser(r *http.Request, header string) string {
+	if u := signedInUser(r); u != nil {
+		return u.Name
+	}
+	if header != "" {
+		if u := r.Header.Get(header); u != "" {
+			return u
+		}
+	}
+	u, _, _ := r.BasicAuth()
+	return u
+}
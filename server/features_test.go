@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestFeatures(t *testing.T) {
+	f, err := newFeatures(config.Features{
+		UserHeader: "X-Forwarded-User",
+		Flags: map[string]config.FeatureFlag{
+			"everyone": {Enabled: true},
+			"alice":    {Users: []string{"alice"}},
+			"half":     {Percent: 50},
+			"nobody":   {},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/search", nil)
+	r.Header.Set("X-Forwarded-User", "alice")
+	if !f.enabled(r, "everyone") || !f.enabled(r, "alice") {
+		t.Error("flags not on for alice")
+	}
+	if f.enabled(r, "nobody") || f.enabled(r, "unknown") {
+		t.Error("unconfigured flags on for alice")
+	}
+	r.Header.Set("X-Forwarded-User", "bob")
+	if f.enabled(r, "alice") {
+		t.Error("alice's flag on for bob")
+	}
+
+	on := 0
+	for i := 0; i < 1000; i++ {
+		r.Header.Set("X-Forwarded-User", fmt.Sprintf("user%d", i))
+		if f.enabled(r, "half") {
+			on++
+		}
+		if f.enabled(r, "half") != f.enabled(r, "half") {
+			t.Fatal("rollout isn't stable")
+		}
+	}
+	if on < 400 || on > 600 {
+		t.Errorf("half rollout on for %d of 1000 users", on)
+	}
+
+	r.Header.Set("X-Forwarded-User", "alice")
+	want := []string{"alice", "everyone"}
+	if f.enabled(r, "half") {
+		want = []string{"alice", "everyone", "half"}
+	}
+	if got := f.enabledFor(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("enabledFor = %v, want %v", got, want)
+	}
+
+	var none *features
+	if none.enabled(r, "everyone") || len(none.enabledFor(r)) != 0 {
+		t.Error("flags on without any configured")
+	}
+	if _, err := newFeatures(config.Features{Flags: map[string]config.FeatureFlag{"x": {Percent: 101}}}); err == nil {
+		t.Error("no error for percent over 100")
+	}
+}
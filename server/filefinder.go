@@ -0,0 +1,448 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// The file finder answers /api/v2/files, the web UI's quick-open. It
+// keeps the path of every file in the file viewer's repositories, as of
+// their HEAD, in memory, and matches queries against them fuzzily: a
+// query's characters must appear in a path in order, but not
+// necessarily together.
+const (
+	// How often to check the repositories for new commits
+	fileFinderRefresh = 5 * time.Minute
+	defaultFileLimit  = 50
+	maxFileLimit      = 500
+)
+
+// How much each part of a match adds to a file's score. Matching a
+// whole run of characters, or the start of a word, counts for more
+// than anything else, so that "api" finds api.go and api/ before
+// rapid.go; matching in the file's name, rather than its
+// directory, breaks ties.
+const (
+	fuzzyCharScore     = 1
+	fuzzyRunBonus      = 5 // for each character right after the one before
+	fuzzyBoundaryBonus = 4 // after /, _, -, . or a space, or a capital in camelCase
+	fuzzyBasenameBonus = 2
+	fuzzyNameBonus     = 20 // for a term that is the whole file name, with or without its extension
+	fuzzyPreferBonus   = 10 // for a file in the repository the query prefers
+	// Each character skipped between the first and last matched costs
+	// a point, up to this many
+	fuzzyMaxGapPenalty = 10
+)
+
+// A finderFile is a file the finder can find.
+type finderFile struct {
+	repo, path string
+	// path with its ASCII letters lowered, so that its bytes line up
+	// with path's
+	lower string
+	// chars has bit c%64 set for each byte c of lower, to rule out
+	// files that lack some of a query's characters quickly
+	chars uint64
+}
+
+// A finderRepo is the files of a repository at a commit.
+type finderRepo struct {
+	commit string
+	paths  []string
+}
+
+// A fileFinder matches quick-open queries against the paths of the
+// files in repos.
+type fileFinder struct {
+	repos map[string]config.RepoConfig
+	// What each repository was last listed as, by refresh alone
+	listed map[string]*finderRepo
+
+	mu    sync.RWMutex
+	ready bool
+	files []finderFile
+	// trigrams maps each three bytes of a lowered path to the indexes,
+	// in files and in order, of the paths containing them
+	trigrams map[uint32][]uint32
+}
+
+func newFileFinder(repos map[string]config.RepoConfig) *fileFinder {
+	return &fileFinder{repos: repos, listed: map[string]*finderRepo{}}
+}
+
+// run lists the repositories' files, and lists them again whenever
+// they have new commits. It never returns.
+func (f *fileFinder) run() {
+	for {
+		f.refresh()
+		time.Sleep(fileFinderRefresh)
+	}
+}
+
+// refresh lists the files of each repository whose HEAD has moved since
+// it was last listed, and if any has, rebuilds the index. A repository
+// that can't be listed keeps the files it had.
+func (f *fileFinder) refresh() {
+	ctx := context.Background()
+	changed := false
+	for name, repo := range f.repos {
+		prev := f.listed[name]
+		commit, err := gitCommitHash("HEAD", repo.Path)
+		if err != nil {
+			log.Warnf(ctx, "file finder: %s: %s", name, err.Error())
+			continue
+		}
+		commit = strings.TrimSpace(commit)
+		if prev != nil && prev.commit == commit {
+			continue
+		}
+		paths, err := gitListFiles(commit, repo.Path)
+		if err != nil {
+			log.Warnf(ctx, "file finder: %s: %s", name, err.Error())
+			continue
+		}
+		f.listed[name] = &finderRepo{commit, paths}
+		changed = true
+	}
+
+	f.mu.RLock()
+	ready := f.ready
+	f.mu.RUnlock()
+	if !changed && ready {
+		return
+	}
+	paths := make(map[string][]string, len(f.listed))
+	n := 0
+	for name, repo := range f.listed {
+		paths[name] = repo.paths
+		n += len(repo.paths)
+	}
+	start := time.Now()
+	f.build(paths)
+	log.FromContext(ctx).With("duration", time.Since(start)).Infof("file finder: indexed %d files from %d repositories in %s", n, len(paths), time.Since(start))
+}
+
+// gitListFiles returns the paths of the files at commit in the
+// repository at repoPath.
+func gitListFiles(commit, repoPath string) ([]string, error) {
+	out, err := exec.Command("git", "-C", repoPath, "ls-tree", "-r", "-z", "--name-only", commit).Output()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, p := range bytes.Split(out, []byte{0}) {
+		if len(p) > 0 {
+			paths = append(paths, string(p))
+		}
+	}
+	return paths, nil
+}
+
+// build replaces the files the finder searches with paths, by
+// repository name.
+func (f *fileFinder) build(paths map[string][]string) {
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []finderFile
+	trigrams := make(map[uint32][]uint32)
+	for _, name := range names {
+		for _, p := range paths[name] {
+			i := uint32(len(files))
+			lower := lowerASCII(p)
+			files = append(files, finderFile{repo: name, path: p, lower: lower, chars: charMask(lower)})
+			for j := 0; j+3 <= len(lower); j++ {
+				t := trigram(lower[j:])
+				// Each path is added once, however often the
+				// trigram recurs in it
+				if l := trigrams[t]; len(l) == 0 || l[len(l)-1] != i {
+					trigrams[t] = append(l, i)
+				}
+			}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files, f.trigrams, f.ready = files, trigrams, true
+}
+
+func trigram(s string) uint32 {
+	return uint32(s[0])<<16 | uint32(s[1])<<8 | uint32(s[2])
+}
+
+// lowerASCII lowers the ASCII letters of s, leaving every other byte,
+// so that offsets into it are offsets into s.
+func lowerASCII(s string) string {
+	for i := 0; i < len(s); i++ {
+		if 'A' <= s[i] && s[i] <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if 'A' <= b[j] && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+func charMask(s string) uint64 {
+	var m uint64
+	for i := 0; i < len(s); i++ {
+		m |= 1 << (s[i] % 64)
+	}
+	return m
+}
+
+// find returns the limit files that best match query, best first, and
+// whether more matched, leaving out the repositories in hidden and
+// scoring files in prefer higher. ok is false if the repositories
+// haven't been listed yet.
+func (f *fileFinder) find(query string, limit int, prefer string, hidden map[string]bool) (found []*api.FoundFile, truncated, ok bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if !f.ready {
+		return nil, false, false
+	}
+	terms := strings.Fields(lowerASCII(query))
+	if len(terms) == 0 {
+		return []*api.FoundFile{}, false, true
+	}
+	var mask uint64
+	for _, t := range terms {
+		mask |= charMask(t)
+	}
+	try := func(file *finderFile) {
+		if file.chars&mask != mask || hidden[file.repo] {
+			return
+		}
+		if m := matchFile(file, terms); m != nil {
+			if file.repo == prefer {
+				m.Score += fuzzyPreferBonus
+			}
+			found = append(found, m)
+		}
+	}
+
+	// Files that contain every term whole, which the trigrams find,
+	// score above nearly all of those that only match fuzzily, so if
+	// there are enough of them, there's no need to look further.
+	if candidates, ok := f.substringCandidates(terms); ok {
+		for _, i := range candidates {
+			try(&f.files[i])
+		}
+		if len(found) <= limit {
+			found = found[:0]
+		}
+	}
+	if len(found) == 0 {
+		for i := range f.files {
+			try(&f.files[i])
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if len(a.Path) != len(b.Path) {
+			return len(a.Path) < len(b.Path)
+		}
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		return a.Path < b.Path
+	})
+	if len(found) > limit {
+		return found[:limit], true, true
+	}
+	if found == nil {
+		found = []*api.FoundFile{}
+	}
+	return found, false, true
+}
+
+// substringCandidates returns the files containing every trigram of
+// terms, in order, or false if the terms are too short to have any.
+func (f *fileFinder) substringCandidates(terms []string) ([]uint32, bool) {
+	var lists [][]uint32
+	for _, t := range terms {
+		for j := 0; j+3 <= len(t); j++ {
+			lists = append(lists, f.trigrams[trigram(t[j:])])
+		}
+	}
+	if len(lists) == 0 {
+		return nil, false
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	out := append([]uint32(nil), lists[0]...)
+	for _, l := range lists[1:] {
+		out = intersect(out, l)
+	}
+	return out, true
+}
+
+// intersect returns the indexes in both a and b, both in order, reusing
+// a.
+func intersect(a, b []uint32) []uint32 {
+	out := a[:0]
+	j := 0
+	for _, i := range a {
+		for j < len(b) && b[j] < i {
+			j++
+		}
+		if j < len(b) && b[j] == i {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// matchFile matches file against every one of terms, returning nil if
+// any doesn't match.
+func matchFile(file *finderFile, terms []string) *api.FoundFile {
+	m := &api.FoundFile{Repo: file.repo, Path: file.path}
+	var matched []int
+	for _, t := range terms {
+		score, pos := fuzzyMatch(file.path, file.lower, t)
+		if pos == nil {
+			return nil
+		}
+		m.Score += score
+		matched = append(matched, pos...)
+	}
+	m.Spans = positionSpans(matched)
+	return m
+}
+
+// fuzzyMatch matches term, in lower case, against path, whose lowered
+// form is lower, returning the match's score and the offsets of the
+// bytes it matched, or nil if it doesn't.
+func fuzzyMatch(path, lower, term string) (int, []int) {
+	// Match term's last character as late in the path as it appears,
+	// and each before it as late as it can be before the next, so that
+	// a match in the file's name wins over one in a directory. Then
+	// pull each character after the first as early as it can go after
+	// the one before, to match as tightly as the path allows.
+	pos := make([]int, len(term))
+	j := len(term) - 1
+	for i := len(lower) - 1; i >= 0 && j >= 0; i-- {
+		if lower[i] == term[j] {
+			pos[j] = i
+			j--
+		}
+	}
+	if j >= 0 {
+		return 0, nil
+	}
+	for k := 1; k < len(pos); k++ {
+		i := pos[k-1] + 1
+		for lower[i] != term[k] {
+			i++
+		}
+		pos[k] = i
+	}
+
+	base := strings.LastIndexByte(path, '/') + 1
+	score := 0
+	for k, p := range pos {
+		score += fuzzyCharScore
+		if k > 0 && p == pos[k-1]+1 {
+			score += fuzzyRunBonus
+		}
+		if atWordStart(path, p) {
+			score += fuzzyBoundaryBonus
+		}
+		if p >= base {
+			score += fuzzyBasenameBonus
+		}
+	}
+	gap := pos[len(pos)-1] - pos[0] + 1 - len(pos)
+	if gap > fuzzyMaxGapPenalty {
+		gap = fuzzyMaxGapPenalty
+	}
+	score -= gap
+	name := lower[base:]
+	if dot := strings.LastIndexByte(name, '.'); name == term || dot > 0 && name[:dot] == term {
+		score += fuzzyNameBonus
+	}
+	return score, pos
+}
+
+// atWordStart reports whether the byte at i of path starts a word.
+func atWordStart(path string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	switch prev := path[i-1]; {
+	case strings.IndexByte("/_-. ", prev) >= 0:
+		return true
+	case 'a' <= prev && prev <= 'z' && 'A' <= path[i] && path[i] <= 'Z':
+		return true
+	}
+	return false
+}
+
+// positionSpans merges the offsets pos into [start, end) spans, in
+// order.
+func positionSpans(pos []int) [][2]int {
+	sort.Ints(pos)
+	var spans [][2]int
+	for _, p := range pos {
+		if n := len(spans); n > 0 && p <= spans[n-1][1] {
+			if p == spans[n-1][1] {
+				spans[n-1][1]++
+			}
+			continue
+		}
+		spans = append(spans, [2]int{p, p + 1})
+	}
+	return spans
+}
+
+// ServeAPIFiles lists the files whose paths match ?q=, best first, up to
+// ?limit= of them, ranking those in the repository ?repo= higher.
+func (s *server) ServeAPIFiles(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if s.finder == nil {
+		writeError(ctx, w, 404, "not_enabled", "Finding files needs the file viewer, which the frontend's index_config enables")
+		return
+	}
+	limit := defaultFileLimit
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxFileLimit {
+			writeError(ctx, w, 400, "bad_query", "limit must be a number from 1 to "+strconv.Itoa(maxFileLimit))
+			return
+		}
+	}
+	hidden := map[string]bool{}
+	for name := range s.repos {
+		if !s.auth.canSee(r, name) {
+			hidden[name] = true
+		}
+	}
+	files, truncated, ok := s.finder.find(r.FormValue("q"), limit, r.FormValue("repo"), hidden)
+	if !ok {
+		writeError(ctx, w, 503, "not_ready", "Still listing the repositories' files; please try again in a moment")
+		return
+	}
+	replyJSON(ctx, w, 200, &api.FileList{Files: files, Truncated: truncated})
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func testFinder() *fileFinder {
+	f := newFileFinder(nil)
+	f.build(map[string][]string{
+		"livegrep": {
+			"server/fileview.go",
+			"server/fileview_test.go",
+			"server/api/types.go",
+			"web/src/fileview/fileview.js",
+			"src/tools/grpc_server.cc",
+			"README.md",
+		},
+		"other": {
+			"api.go",
+			"lib/rapid.go",
+			"FileView.java",
+		},
+	})
+	return f
+}
+
+func foundPaths(found []*api.FoundFile) []string {
+	var out []string
+	for _, f := range found {
+		out = append(out, f.Repo+":"+f.Path)
+	}
+	return out
+}
+
+func TestFileFinder(t *testing.T) {
+	f := testFinder()
+	cases := []struct {
+		query string
+		first []string
+	}{
+		{"fileview.go", []string{"livegrep:server/fileview.go"}},
+		{"fv", []string{"other:FileView.java", "livegrep:server/fileview.go"}},
+		{"api", []string{"other:api.go"}},
+		{"readme", []string{"livegrep:README.md"}},
+		{"srv grpc", []string{"livegrep:src/tools/grpc_server.cc"}},
+		{"fileview js", []string{"livegrep:web/src/fileview/fileview.js"}},
+	}
+	for _, tc := range cases {
+		found, _, ok := f.find(tc.query, 10, "", nil)
+		if !ok {
+			t.Fatal("not ready")
+		}
+		if got := foundPaths(found); len(got) < len(tc.first) || !reflect.DeepEqual(got[:len(tc.first)], tc.first) {
+			t.Errorf("find(%q) = %v, want %v first", tc.query, got, tc.first)
+		}
+	}
+
+	if found, _, _ := f.find("zzz", 10, "", nil); len(found) != 0 {
+		t.Errorf("find(zzz) = %v", foundPaths(found))
+	}
+	if found, truncated, _ := f.find("go", 2, "", nil); len(found) != 2 || !truncated {
+		t.Errorf("find(go) with limit 2: %v, truncated %v", foundPaths(found), truncated)
+	}
+	if found, _, _ := f.find("fv", 10, "livegrep", nil); foundPaths(found)[0] != "livegrep:server/fileview.go" {
+		t.Errorf("preferring livegrep, found %v", foundPaths(found))
+	}
+	found, _, _ := f.find("api", 10, "", map[string]bool{"other": true})
+	for _, file := range found {
+		if file.Repo == "other" {
+			t.Errorf("found %s in a hidden repository", file.Path)
+		}
+	}
+
+	if _, _, ok := newFileFinder(nil).find("a", 10, "", nil); ok {
+		t.Error("ready before being built")
+	}
+}
+
+func TestFuzzyMatchSpans(t *testing.T) {
+	f := testFinder()
+	found, _, _ := f.find("fv", 1, "livegrep", nil)
+	if want := [][2]int{{7, 8}, {11, 12}}; !reflect.DeepEqual(found[0].Spans, want) {
+		t.Errorf("spans of fv in %s = %v, want %v", found[0].Path, found[0].Spans, want)
+	}
+	found, _, _ = f.find("types", 1, "", nil)
+	if want := [][2]int{{11, 16}}; !reflect.DeepEqual(found[0].Spans, want) {
+		t.Errorf("spans of types in %s = %v, want %v", found[0].Path, found[0].Spans, want)
+	}
+}
+
+func TestServeAPIFiles(t *testing.T) {
+	s := &server{}
+	w := httptest.NewRecorder()
+	s.ServeAPIFiles(context.Background(), w, httptest.NewRequest("GET", "/api/v2/files?q=a", nil))
+	if w.Code != 404 {
+		t.Errorf("without a file viewer: status %d", w.Code)
+	}
+
+	s = &server{repos: map[string]config.RepoConfig{"livegrep": {}, "other": {}}, finder: testFinder()}
+	for url, want := range map[string]int{
+		"/api/v2/files?q=fileview":          200,
+		"/api/v2/files?q=fileview&limit=0":  400,
+		"/api/v2/files?q=fileview&limit=xx": 400,
+	} {
+		w := httptest.NewRecorder()
+		s.ServeAPIFiles(context.Background(), w, httptest.NewRequest("GET", url, nil))
+		if w.Code != want {
+			t.Errorf("%s: status %d, want %d", url, w.Code, want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeAPIFiles(context.Background(), w, httptest.NewRequest("GET", "/api/v2/files?q=rapid&limit=1", nil))
+	var reply api.FileList
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Files) != 1 || reply.Files[0].Path != "lib/rapid.go" || reply.Truncated {
+		t.Errorf("reply %+v", reply)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeAPIFiles(context.Background(), w, httptest.NewRequest("GET", "/api/v2/files?q=", nil))
+	if !strings.Contains(w.Body.String(), `"files":[]`) {
+		t.Errorf("empty query: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/livegrep/livegrep/server/api"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// fileMatcher returns a function giving every span of a path that q's
+// pattern matches, for highlighting in file results. The backend only
+// reports the first, bounds, which is all there is if the pattern is
+// RE2 syntax that Go's regexp doesn't take, or matches nothing in Go.
+func fileMatcher(q *pb.Query) func(path string, bounds [2]int) [][2]int {
+	pat := q.Line
+	if q.FoldCase {
+		pat = "(?i)" + pat
+	}
+	re, err := regexp.Compile(pat)
+	return func(path string, bounds [2]int) [][2]int {
+		if err != nil {
+			return [][2]int{bounds}
+		}
+		var spans [][2]int
+		for _, m := range re.FindAllStringIndex(path, -1) {
+			if m[0] < m[1] {
+				spans = append(spans, [2]int{m[0], m[1]})
+			}
+		}
+		if len(spans) == 0 {
+			return [][2]int{bounds}
+		}
+		return spans
+	}
+}
+
+// indexTimes returns when each tree of backends was last indexed.
+func indexTimes(backends []*Backend) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, bk := range backends {
+		for key, rev := range bk.revisions() {
+			if rev.indexedAt.After(times[key[0]]) {
+				times[key[0]] = rev.indexedAt
+			}
+		}
+	}
+	return times
+}
+
+// sortFileResults orders the file results of a search by path, by
+// repository and then path ("repo"), or most recently indexed
+// repository first and then by path ("indexed"), using indexed for the
+// time each tree was indexed.
+func sortFileResults(results []*api.FileResult, by string, indexed map[string]time.Time) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		switch by {
+		case "repo":
+			if a.Tree != b.Tree {
+				return a.Tree < b.Tree
+			}
+		case "indexed":
+			if ta, tb := indexed[a.Tree], indexed[b.Tree]; !ta.Equal(tb) {
+				return ta.After(tb)
+			}
+		}
+		return a.Path < b.Path
+	})
+}
+
+// languageFacet counts the distinct files among the results of a
+// search, line and file results alike, in each language the backend
+// detected, or returns nil if it detected none, as older backends
+// don't.
+func languageFacet(reply *api.ReplySearch) map[string]int {
+	type file struct{ backend, tree, version, path string }
+	seen := map[file]bool{}
+	var langs map[string]int
+	add := func(f file, lang string) {
+		if lang == "" || seen[f] {
+			return
+		}
+		seen[f] = true
+		if langs == nil {
+			langs = map[string]int{}
+		}
+		langs[lang]++
+	}
+	for _, r := range reply.Results {
+		add(file{r.Backend, r.Tree, r.Version, r.Path}, r.Language)
+	}
+	for _, r := range reply.FileResults {
+		add(file{r.Backend, r.Tree, r.Version, r.Path}, r.Language)
+	}
+	return langs
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/livegrep/livegrep/server/api"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func TestFileMatcher(t *testing.T) {
+	spans := fileMatcher(&pb.Query{Line: "test", FoldCase: true})
+	got := spans("src/test/foo_Test.go", [2]int{4, 8})
+	if want := [][2]int{{4, 8}, {13, 17}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("spans = %v, want %v", got, want)
+	}
+	// Syntax that only RE2 takes falls back to the backend's bounds.
+	spans = fileMatcher(&pb.Query{Line: `\C`})
+	if got := spans("abc", [2]int{0, 1}); !reflect.DeepEqual(got, [][2]int{{0, 1}}) {
+		t.Errorf("spans = %v, want the bounds", got)
+	}
+}
+
+func TestSortFileResults(t *testing.T) {
+	files := func() []*api.FileResult {
+		return []*api.FileResult{
+			{Tree: "b", Path: "z.go"},
+			{Tree: "a", Path: "y.go"},
+			{Tree: "b", Path: "x.go"},
+		}
+	}
+	order := func(results []*api.FileResult) []string {
+		var out []string
+		for _, r := range results {
+			out = append(out, r.Tree+":"+r.Path)
+		}
+		return out
+	}
+	now := time.Now()
+	indexed := map[string]time.Time{"a": now.Add(-time.Hour), "b": now}
+
+	for _, tc := range []struct {
+		by   string
+		want []string
+	}{
+		{"path", []string{"b:x.go", "a:y.go", "b:z.go"}},
+		{"repo", []string{"a:y.go", "b:x.go", "b:z.go"}},
+		{"indexed", []string{"b:x.go", "b:z.go", "a:y.go"}},
+	} {
+		results := files()
+		sortFileResults(results, tc.by, indexed)
+		if got := order(results); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("sort:%s = %v, want %v", tc.by, got, tc.want)
+		}
+	}
+}
+
+func TestLanguageFacet(t *testing.T) {
+	reply := &api.ReplySearch{
+		Results: []*api.Result{
+			{Tree: "a", Path: "main.go", LineNumber: 1, Language: "go"},
+			{Tree: "a", Path: "main.go", LineNumber: 2, Language: "go"},
+			{Tree: "b", Path: "main.go", Language: "go"},
+			{Tree: "a", Path: "BUILD", Language: "starlark"},
+			{Tree: "a", Path: "LICENSE"},
+		},
+		FileResults: []*api.FileResult{
+			{Tree: "a", Path: "main.go", Language: "go"},
+			{Tree: "a", Path: "x.py", Language: "python"},
+		},
+	}
+	want := map[string]int{"go": 2, "starlark": 1, "python": 1}
+	if got := languageFacet(reply); !reflect.DeepEqual(got, want) {
+		t.Errorf("languageFacet = %v, want %v", got, want)
+	}
+	if got := languageFacet(&api.ReplySearch{Results: []*api.Result{{Path: "a"}}}); got != nil {
+		t.Errorf("languageFacet without languages = %v, want nil", got)
+	}
+}
+
+func TestBackendRevisions(t *testing.T) {
+	indexed := time.Unix(1700000000, 0)
+	recorded := time.Unix(1700001000, 0)
+	sha := "0123456789abcdef0123456789abcdef01234567"
+	bk := &Backend{I: &I{
+		IndexTime: indexed,
+		Trees: []Tree{
+			{Name: "a", Version: "main", Commit: "fedcba", IndexedAt: recorded},
+			{Name: "b", Version: sha},
+			{Name: "c", Version: "HEAD"},
+			{Name: "d", Version: sha, Commit: sha, Branch: "release"},
+		},
+	}}
+	want := map[[2]string]indexedRevision{
+		{"a", "main"}: {commit: "fedcba", branch: "main", indexedAt: recorded},
+		{"b", sha}:    {commit: sha, indexedAt: indexed},
+		{"c", "HEAD"}: {branch: "HEAD", indexedAt: indexed},
+		{"d", sha}:    {commit: sha, branch: "release", indexedAt: indexed},
+	}
+	if got := bk.revisions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("revisions = %v, want %v", got, want)
+	}
+}
+
+func TestTreeRevision(t *testing.T) {
+	commits := map[string]string{"main": "aaaa", "release": "bbbb", "v1": "bbbb"}
+	cases := []struct {
+		version, commit, branch string
+	}{
+		{"main", "aaaa", "main"},
+		{"bbbb", "bbbb", "release"},
+		{"HEAD", "", ""},
+	}
+	for _, tc := range cases {
+		commit, branch := treeRevision(tc.version, commits)
+		if commit != tc.commit || branch != tc.branch {
+			t.Errorf("treeRevision(%q) = %q, %q, want %q, %q",
+				tc.version, commit, branch, tc.commit, tc.branch)
+		}
+	}
+}
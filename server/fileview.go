@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"html/template"
 	"net/url"
 	"os/exec"
 	"path"
@@ -10,6 +11,11 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
 
 	"github.com/livegrep/livegrep/server/config"
 )
@@ -103,6 +109,7 @@ type fileViewerContext struct {
 	PathSegments   []breadCrumbEntry
 	Repo           config.RepoConfig
 	Commit         string
+	CommitHash     string
 	DirContent     *directoryContent
 	FileContent    *sourceFileContent
 	ExternalDomain string
@@ -119,6 +126,8 @@ type sourceFileContent struct {
 type directoryContent struct {
 	Entries       []directoryListEntry
 	ReadmeContent *sourceFileContent
+	// The README rendered, if it is Markdown
+	ReadmeHTML template.HTML
 }
 
 type DirListingSort []directoryListEntry
@@ -164,6 +173,38 @@ func gitCatBlob(obj string, repoPath string) (string, error) {
 	return string(out), nil
 }
 
+// decodeContent converts content to UTF-8 the way codesearch did when
+// indexing it with the same encodings (see src/transcode.h), so that
+// the file viewer shows what search results do.
+func decodeContent(content string, encodings []string) string {
+	if len(encodings) == 0 || utf8.ValidString(content) {
+		return content
+	}
+	var bom encoding.Encoding
+	if strings.HasPrefix(content, "\xff\xfe") {
+		bom = unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)
+	} else if strings.HasPrefix(content, "\xfe\xff") {
+		bom = unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)
+	}
+	if bom != nil {
+		if out, err := bom.NewDecoder().String(content); err == nil {
+			return out
+		}
+	}
+	for _, name := range encodings {
+		enc, err := htmlindex.Get(name)
+		if err != nil {
+			continue
+		}
+		// Decoders replace what they can't decode rather than failing.
+		out, err := enc.NewDecoder().String(content)
+		if err == nil && !strings.ContainsRune(out, utf8.RuneError) {
+			return out
+		}
+	}
+	return content
+}
+
 type gitTreeEntry struct {
 	Mode       string
 	ObjectType string
@@ -201,6 +242,30 @@ func viewUrl(repo string, path string) string {
 	return "/view/" + repo + "/" + path
 }
 
+// readmeLink returns the file viewer's page for target, a relative
+// link in the README of dir, at the commit of query. Links to "/" are
+// from the top of the repository, as on GitHub.
+func readmeLink(repo, dir, target, query string) string {
+	target, fragment, _ := strings.Cut(target, "#")
+	if fragment != "" {
+		fragment = "#" + fragment
+	}
+	if target == "" {
+		return fragment
+	}
+	target, _, _ = strings.Cut(target, "?")
+	p := target
+	if !strings.HasPrefix(target, "/") {
+		p = path.Join(dir, target)
+	}
+	// Cleaned from the top, links out of the repository stay in it
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if strings.HasSuffix(target, "/") && p != "" {
+		p += "/"
+	}
+	return viewUrl(repo, p) + query + fragment
+}
+
 func getFileUrl(repo string, pathFromRoot string, name string, isDir bool) string {
 	fileUrl := viewUrl(repo, filepath.Join(pathFromRoot, path.Clean(name)))
 	if isDir {
@@ -229,7 +294,7 @@ func buildReadmeRegex(supportedReadmeExtensions []string) *regexp.Regexp {
 	return repoFileRegex
 }
 
-func buildDirectoryListEntry(treeEntry gitTreeEntry, pathFromRoot string, repo config.RepoConfig) directoryListEntry {
+func buildDirectoryListEntry(treeEntry gitTreeEntry, pathFromRoot string, repo config.RepoConfig, query string) directoryListEntry {
 	var fileUrl string
 	var symlinkTarget string
 	if treeEntry.Mode == "120000" {
@@ -238,7 +303,7 @@ func buildDirectoryListEntry(treeEntry gitTreeEntry, pathFromRoot string, repo c
 			symlinkTarget = resolvedPath
 		}
 	} else {
-		fileUrl = getFileUrl(repo.Name, pathFromRoot, treeEntry.ObjectName, treeEntry.ObjectType == "tree")
+		fileUrl = getFileUrl(repo.Name, pathFromRoot, treeEntry.ObjectName, treeEntry.ObjectType == "tree") + query
 	}
 	return directoryListEntry{
 		Name:          treeEntry.ObjectName,
@@ -257,7 +322,7 @@ func languageFromFirstLine(line string) string {
 	return ""
 }
 
-func buildFileData(relativePath string, repo config.RepoConfig, commit string) (*fileViewerContext, error) {
+func buildFileData(relativePath string, repo config.RepoConfig, commit string, red *redactor) (*fileViewerContext, error) {
 	commitHash := commit
 	out, err := gitCommitHash(commit, repo.Path)
 	if err == nil {
@@ -269,6 +334,11 @@ func buildFileData(relativePath string, repo config.RepoConfig, commit string) (
 	}
 	obj := commitHash + ":" + cleanPath
 	pathSplits := strings.Split(cleanPath, "/")
+	// Links within the repository stay at the commit being viewed
+	query := ""
+	if commit != "HEAD" {
+		query = "?commit=" + url.QueryEscape(commit)
+	}
 
 	var fileContent *sourceFileContent
 	var dirContent *directoryContent
@@ -286,7 +356,7 @@ func buildFileData(relativePath string, repo config.RepoConfig, commit string) (
 		dirEntries := make([]directoryListEntry, len(treeEntries))
 		var readmePath, readmeLang string
 		for i, treeEntry := range treeEntries {
-			dirEntries[i] = buildDirectoryListEntry(treeEntry, cleanPath, repo)
+			dirEntries[i] = buildDirectoryListEntry(treeEntry, cleanPath, repo, query)
 			// Git supports case sensitive files, so README.md & readme.md in the same tree is possible
 			// so in this case we just grab the first matching file
 			if readmePath != "" {
@@ -302,13 +372,20 @@ func buildFileData(relativePath string, repo config.RepoConfig, commit string) (
 		}
 
 		var readmeContent *sourceFileContent
+		var readmeHTML template.HTML
 		if readmePath != "" {
 			if content, err := gitCatBlob(readmePath, repo.Path); err == nil {
+				content = red.redact(decodeContent(content, repo.Encodings))
 				readmeContent = &sourceFileContent{
 					Content:   content,
 					LineCount: strings.Count(content, "\n"),
 					Language:  extToLangMap["."+readmeLang],
 				}
+				if markdownExtensions[strings.ToLower(readmeLang)] {
+					readmeHTML = renderMarkdown(content, func(target string) string {
+						return readmeLink(repo.Name, cleanPath, target, query)
+					})
+				}
 			}
 		}
 
@@ -316,12 +393,14 @@ func buildFileData(relativePath string, repo config.RepoConfig, commit string) (
 		dirContent = &directoryContent{
 			Entries:       dirEntries,
 			ReadmeContent: readmeContent,
+			ReadmeHTML:    readmeHTML,
 		}
 	} else if objectType == "blob" {
 		content, err := gitCatBlob(obj, repo.Path)
 		if err != nil {
 			return nil, err
 		}
+		content = red.redact(decodeContent(content, repo.Encodings))
 		language := filenameToLangMap[filepath.Base(cleanPath)]
 		if language == "" {
 			language = extToLangMap[filepath.Ext(cleanPath)]
@@ -344,7 +423,7 @@ func buildFileData(relativePath string, repo config.RepoConfig, commit string) (
 		parentPath := path.Clean(strings.Join(pathSplits[0:i], "/"))
 		segments[i] = breadCrumbEntry{
 			Name: name,
-			Path: getFileUrl(repo.Name, parentPath, name, true),
+			Path: getFileUrl(repo.Name, parentPath, name, true) + query,
 		}
 	}
 
@@ -358,17 +437,14 @@ func buildFileData(relativePath string, repo config.RepoConfig, commit string) (
 	if !strings.HasPrefix(commitHash, commit) {
 		permalink = "?commit=" + commitHash[:16]
 	} else {
-		if dirContent != nil {
-			headlink = "."
-		} else {
-			headlink = segments[len(segments)-1].Name
-		}
+		headlink = "?commit=HEAD"
 	}
 
 	return &fileViewerContext{
 		PathSegments:   segments,
 		Repo:           repo,
 		Commit:         commit,
+		CommitHash:     commitHash,
 		DirContent:     dirContent,
 		FileContent:    fileContent,
 		ExternalDomain: externalDomain,
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/livegrep/livegrep/server/api"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// readyTimeout bounds how long /readyz waits for each backend to answer.
+const readyTimeout = 2 * time.Second
+
+type backendReadiness struct {
+	Id        string    `json:"id"`
+	Addr      string    `json:"addr"`
+	Ready     bool      `json:"ready"`
+	IndexName string    `json:"index_name,omitempty"`
+	IndexTime time.Time `json:"index_time,omitempty"`
+	Trees     int       `json:"trees"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready    bool               `json:"ready"`
+	Backends []backendReadiness `json:"backends"`
+}
+
+// ServeHealthz reports that the process is up and serving HTTP, for
+// liveness probes; it doesn't depend on the backends.
+func (s *server) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// ServeReadyz asks every backend, or each shard of a sharded one, for
+// its info, and reports ready (200) only if each answers and is serving
+// an index no older than max_index_age_hours, and 503 otherwise, with
+// the details for each backend in the body. Like /healthz, it isn't
+// logged, since probes call it every few seconds.
+func (s *server) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var backends []*Backend
+	for _, id := range s.bkOrder {
+		if shards := s.bk[id].shards; len(shards) > 0 {
+			backends = append(backends, shards...)
+		} else {
+			backends = append(backends, s.bk[id])
+		}
+	}
+	out := readiness{Ready: true, Backends: make([]backendReadiness, len(backends))}
+	var wg sync.WaitGroup
+	for i, bk := range backends {
+		wg.Add(1)
+		go func(i int, bk *Backend) {
+			defer wg.Done()
+			out.Backends[i] = bk.readiness(ctx)
+		}(i, bk)
+	}
+	wg.Wait()
+
+	status := 200
+	for i := range out.Backends {
+		b := &out.Backends[i]
+		if b.Ready {
+			b.Ready, b.Error = s.fresh(b.IndexTime, time.Now())
+		}
+		if !b.Ready {
+			out.Ready = false
+			status = 503
+		}
+	}
+	replyJSON(ctx, w, status, &out)
+}
+
+// fresh reports whether an index built at indexTime is within
+// max_index_age_hours of now, and if not, why.
+func (s *server) fresh(indexTime, now time.Time) (bool, string) {
+	limit := time.Duration(s.config.MaxIndexAgeHours) * time.Hour
+	if limit <= 0 || indexTime.IsZero() || now.Sub(indexTime) <= limit {
+		return true, ""
+	}
+	return false, fmt.Sprintf("index is %s old, more than max_index_age_hours",
+		now.Sub(indexTime).Truncate(time.Minute))
+}
+
+func (bk *Backend) readiness(ctx context.Context) backendReadiness {
+	out := backendReadiness{Id: bk.Id, Addr: bk.Addr()}
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	info, err := bk.Client().Info(ctx, &pb.InfoRequest{}, grpc.FailFast(true))
+	bk.noteInfo(err)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	bk.refresh(info)
+	out.IndexName = info.Name
+	out.Trees = len(info.Trees)
+	if info.IndexTime != 0 {
+		out.IndexTime = time.Unix(info.IndexTime, 0).UTC()
+	}
+	// A backend that is still loading its index doesn't answer Info, but
+	// one started without an index answers with nothing in it.
+	out.Ready = info.IndexTime != 0 || len(info.Trees) > 0
+	if !out.Ready {
+		out.Error = "not serving an index"
+	}
+	return out
+}
+
+// ServeAPIIndexInfo serves /api/v2/index-info: for each backend, whether
+// the frontend can reach it, the name and build time of its index, and
+// the commit each repository the user may see was indexed at. It
+// answers from what the backends last said, without asking them again,
+// so it is cheap enough for a dashboard to poll.
+func (s *server) ServeAPIIndexInfo(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	out := &api.IndexInfo{Backends: make([]*api.BackendIndex, 0, len(s.bkOrder))}
+	now := time.Now()
+	for _, id := range s.bkOrder {
+		out.Backends = append(out.Backends, s.backendIndex(r, s.bk[id], now))
+	}
+	replyJSON(ctx, w, 200, out)
+}
+
+func (s *server) backendIndex(r *http.Request, bk *Backend, now time.Time) *api.BackendIndex {
+	out := &api.BackendIndex{ID: bk.Id, Repos: []*api.IndexedRepo{}}
+	out.Connected, out.Error = bk.connected()
+
+	revs := bk.revisions()
+	bk.I.Lock()
+	out.IndexName = bk.I.Name
+	indexTime := bk.I.IndexTime
+	trees := append([]Tree(nil), bk.I.Trees...)
+	bk.I.Unlock()
+	if indexTime.Unix() > 0 {
+		out.IndexTime = indexTime.Unix()
+		out.AgeSeconds = int64(now.Sub(indexTime) / time.Second)
+	}
+
+	repos := make(map[string]bool)
+	for _, t := range trees {
+		if !s.auth.canSee(r, t.Name) {
+			continue
+		}
+		repos[t.Name] = true
+		rev := revs[[2]string{t.Name, t.Version}]
+		repo := &api.IndexedRepo{
+			Name:    t.Name,
+			Version: t.Version,
+			Commit:  rev.commit,
+			Branch:  rev.branch,
+			Tag:     t.Tag,
+		}
+		if rev.indexedAt.Unix() > 0 {
+			repo.IndexedAt = rev.indexedAt.Unix()
+		}
+		if !t.CommitTime.IsZero() {
+			repo.CommitTime = t.CommitTime.Unix()
+		}
+		out.Repos = append(out.Repos, repo)
+	}
+	sort.SliceStable(out.Repos, func(i, j int) bool { return out.Repos[i].Name < out.Repos[j].Name })
+	out.RepoCount = len(repos)
+	return out
+}
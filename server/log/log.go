@@ -1,21 +1,31 @@
 package log
 
 import (
-	"bytes"
-	"fmt"
-	"time"
-
+	"github.com/livegrep/livegrep/pkg/logging"
 	"github.com/livegrep/livegrep/server/reqid"
 	"golang.org/x/net/context"
 )
 
+// Printf logs at level info, with the request ID from c, if it has one,
+// as the request_id field.
 func Printf(c context.Context, msg string, args ...interface{}) {
-	var line bytes.Buffer
-	line.WriteString(time.Now().UTC().Format("[2006-01-02T15:04:05.999] "))
+	FromContext(c).Infof(msg, args...)
+}
+
+// Warnf logs at level warn, as Printf does at info.
+func Warnf(c context.Context, msg string, args ...interface{}) {
+	FromContext(c).Warnf(msg, args...)
+}
+
+// Errorf logs at level error, as Printf does at info.
+func Errorf(c context.Context, msg string, args ...interface{}) {
+	FromContext(c).Errorf(msg, args...)
+}
 
+// FromContext returns a logger that tags each line with c's request ID.
+func FromContext(c context.Context) *logging.Logger {
 	if reqID, ok := reqid.FromContext(c); ok {
-		fmt.Fprintf(&line, "[%s] ", reqID)
+		return logging.With("request_id", string(reqID))
 	}
-	fmt.Fprintf(&line, msg, args...)
-	fmt.Println(line.String())
+	return logging.With()
 }
@@ -0,0 +1,754 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// markdownExtensions are the README extensions rendered as Markdown,
+// rather than shown as source.
+var markdownExtensions = map[string]bool{"md": true, "markdown": true, "mdown": true, "mkdn": true}
+
+var (
+	atxHeadingRE  = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	hrRE          = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fenceRE       = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})[ \t]*([^`\\s]*)")
+	bulletRE      = regexp.MustCompile(`^( {0,3})([-*+])( +|$)`)
+	orderedRE     = regexp.MustCompile(`^( {0,3})([0-9]{1,9})([.)])( +|$)`)
+	tableDelimRE  = regexp.MustCompile(`^:?-+:?$`)
+	htmlBlockRE   = regexp.MustCompile(`^ {0,3}(?:<!--|</?[A-Za-z][A-Za-z0-9-]*(?:[\s/>]|$))`)
+	htmlTagRE     = regexp.MustCompile(`<!--.*?-->|</?[A-Za-z][A-Za-z0-9-]*(?:\s[^<>]*)?/?>`)
+	htmlInlineRE  = regexp.MustCompile(`^(?:` + htmlTagRE.String() + `)`)
+	autolinkRE    = regexp.MustCompile(`^<((?:https?|mailto):[^<>\s]+)>`)
+	bareURLRE     = regexp.MustCompile(`^https?://[^\s<]+`)
+	linkSchemeRE  = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*:`)
+	setextLevelRE = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	linkRefRE     = regexp.MustCompile(`^ {0,3}\[([^\]]+)\]:[ \t]*(\S+)`)
+)
+
+// asciiPunct is what a backslash escapes.
+const asciiPunct = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// A markdown renders the Markdown of a README to HTML: the CommonMark
+// blocks and inlines READMEs use, with GitHub's tables, task lists,
+// strikethrough and bare links. Raw HTML is left out rather than
+// passed through, so that all it renders is safe to show.
+type markdown struct {
+	// link returns where a relative link or image in the README goes.
+	link func(target string) string
+	out  bytes.Buffer
+	// Whether paragraphs are those of a tight list's items, which
+	// aren't wrapped in <p>
+	tight bool
+	// Whether the text is a link's, which can't have links of its own
+	inLink bool
+	// How many headings have each anchor so far
+	ids map[string]int
+	// The targets of the link reference definitions, by label
+	refs map[string]string
+}
+
+// renderMarkdown renders src, resolving relative links with link.
+func renderMarkdown(src string, link func(target string) string) template.HTML {
+	m := &markdown{link: link, ids: map[string]int{}}
+	src = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(src)
+	lines, refs := linkRefs(strings.Split(src, "\n"))
+	m.refs = refs
+	m.blocks(lines)
+	return template.HTML(m.out.String())
+}
+
+// indentOf returns the width of line's leading white space, counting
+// tabs to the next multiple of four.
+func indentOf(line string) int {
+	n := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			n++
+		case '\t':
+			n += 4 - n%4
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// dedent removes n columns of leading white space from line.
+func dedent(line string, n int) string {
+	col := 0
+	for i, c := range line {
+		if col >= n {
+			return strings.Repeat(" ", col-n) + line[i:]
+		}
+		if c != ' ' && c != '\t' {
+			return line[i:]
+		}
+		if c == '\t' {
+			col += 4 - col%4
+		} else {
+			col++
+		}
+	}
+	return ""
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// A listMarker is the marker that starts a list item.
+type listMarker struct {
+	ordered bool
+	// The bullet, or the delimiter after an ordered item's number
+	char  byte
+	start int
+	// The column the item's content starts at
+	content int
+}
+
+func parseListMarker(line string) (listMarker, bool) {
+	line = expandMarkerTab(line)
+	if hrRE.MatchString(line) {
+		return listMarker{}, false
+	}
+	if m := bulletRE.FindStringSubmatch(line); m != nil {
+		return listMarker{char: m[2][0], content: markerContent(m[0], m[3])}, true
+	}
+	if m := orderedRE.FindStringSubmatch(line); m != nil {
+		start, _ := strconv.Atoi(m[2])
+		return listMarker{ordered: true, char: m[3][0], start: start, content: markerContent(m[0], m[4])}, true
+	}
+	return listMarker{}, false
+}
+
+// expandMarkerTab expands the tab that may follow a list item's marker,
+// for its content's column to be a byte offset.
+func expandMarkerTab(line string) string {
+	return strings.Replace(line, "\t", "    ", 1)
+}
+
+// itemContent returns the content of the first line of the item that
+// starts with mk.
+func itemContent(line string, mk listMarker) string {
+	line = expandMarkerTab(line)
+	if mk.content >= len(line) {
+		return ""
+	}
+	return line[mk.content:]
+}
+
+// markerContent returns the column an item's content starts at, given
+// its marker and the spaces after it: one space in, if there are more
+// than four, as the rest indent a code block.
+func markerContent(marker, spaces string) int {
+	if len(spaces) == 0 || len(spaces) > 4 {
+		return len(marker) - len(spaces) + 1
+	}
+	return len(marker)
+}
+
+// startsBlock says whether line starts a block that ends a paragraph.
+func startsBlock(line string) bool {
+	if atxHeadingRE.MatchString(line) || hrRE.MatchString(line) || fenceRE.MatchString(line) ||
+		htmlBlockRE.MatchString(line) || strings.HasPrefix(strings.TrimLeft(line, " "), ">") {
+		return true
+	}
+	// An ordered list only interrupts a paragraph when it starts at one
+	mk, ok := parseListMarker(line)
+	return ok && (!mk.ordered || mk.start == 1) && !isBlank(itemContent(line, mk))
+}
+
+func (m *markdown) blocks(lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+		case fenceRE.MatchString(line):
+			i = m.fencedCode(lines, i)
+		case indentOf(line) >= 4:
+			i = m.indentedCode(lines, i)
+		case atxHeadingRE.MatchString(line):
+			h := atxHeadingRE.FindStringSubmatch(line)
+			m.heading(len(h[1]), h[2])
+			i++
+		case hrRE.MatchString(line):
+			m.out.WriteString("<hr>\n")
+			i++
+		case strings.HasPrefix(strings.TrimLeft(line, " "), ">"):
+			i = m.blockquote(lines, i)
+		case isListItem(line):
+			i = m.list(lines, i)
+		case i+1 < len(lines) && strings.Contains(line, "|") && isTableDelim(lines[i+1]):
+			i = m.table(lines, i)
+		case htmlBlockRE.MatchString(line):
+			i = m.htmlBlock(lines, i)
+		default:
+			i = m.paragraph(lines, i)
+		}
+	}
+}
+
+func isListItem(line string) bool {
+	_, ok := parseListMarker(line)
+	return ok
+}
+
+func (m *markdown) fencedCode(lines []string, i int) int {
+	f := fenceRE.FindStringSubmatch(lines[i])
+	fence, lang := f[1], f[2]
+	indent := indentOf(lines[i])
+	var code []string
+	for i++; i < len(lines); i++ {
+		if t := strings.TrimSpace(lines[i]); strings.HasPrefix(t, fence[:1]) &&
+			strings.Trim(t, fence[:1]) == "" && len(t) >= len(fence) && indentOf(lines[i]) < 4 {
+			i++
+			break
+		}
+		code = append(code, dedent(lines[i], indent))
+	}
+	m.code(code, lang)
+	return i
+}
+
+func (m *markdown) indentedCode(lines []string, i int) int {
+	var code []string
+	for ; i < len(lines) && (isBlank(lines[i]) || indentOf(lines[i]) >= 4); i++ {
+		code = append(code, dedent(lines[i], 4))
+	}
+	for len(code) > 0 && isBlank(code[len(code)-1]) {
+		code = code[:len(code)-1]
+	}
+	m.code(code, "")
+	return i
+}
+
+func (m *markdown) code(lines []string, lang string) {
+	m.out.WriteString("<pre><code")
+	if lang != "" {
+		fmt.Fprintf(&m.out, ` class="language-%s"`, html.EscapeString(lang))
+	}
+	m.out.WriteString(">")
+	for _, l := range lines {
+		m.out.WriteString(html.EscapeString(l))
+		m.out.WriteString("\n")
+	}
+	m.out.WriteString("</code></pre>\n")
+}
+
+func (m *markdown) heading(level int, text string) {
+	inner := m.inline(strings.TrimSpace(text))
+	id := headingID(inner)
+	if n := m.ids[id]; n > 0 {
+		m.ids[id] = n + 1
+		id = fmt.Sprintf("%s-%d", id, n)
+	} else {
+		m.ids[id] = 1
+	}
+	fmt.Fprintf(&m.out, "<h%d id=\"%s\">%s</h%d>\n", level, html.EscapeString(id), inner, level)
+}
+
+// headingID returns the anchor of a heading with the given HTML, as
+// GitHub makes them: its text in lower case, with spaces as hyphens and
+// punctuation left out.
+func headingID(inner string) string {
+	text := html.UnescapeString(htmlTagRE.ReplaceAllString(inner, ""))
+	var b strings.Builder
+	for _, c := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || c == '-' || c == '_':
+			b.WriteRune(c)
+		case c == ' ':
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
+
+func (m *markdown) blockquote(lines []string, i int) int {
+	var inner []string
+	for ; i < len(lines); i++ {
+		t := strings.TrimLeft(lines[i], " ")
+		if !strings.HasPrefix(t, ">") {
+			// A paragraph in the quote may go on without its >
+			if isBlank(lines[i]) || len(inner) == 0 || isBlank(inner[len(inner)-1]) || startsBlock(lines[i]) {
+				break
+			}
+			inner = append(inner, lines[i])
+			continue
+		}
+		t = t[1:]
+		if strings.HasPrefix(t, " ") {
+			t = t[1:]
+		}
+		inner = append(inner, t)
+	}
+	m.out.WriteString("<blockquote>\n")
+	tight := m.tight
+	m.tight = false
+	m.blocks(inner)
+	m.tight = tight
+	m.out.WriteString("</blockquote>\n")
+	return i
+}
+
+func (m *markdown) list(lines []string, i int) int {
+	first, _ := parseListMarker(lines[i])
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		mk, ok := parseListMarker(lines[i])
+		if !ok || mk.ordered != first.ordered || mk.char != first.char {
+			break
+		}
+		item := []string{itemContent(lines[i], mk)}
+		for i++; i < len(lines); i++ {
+			l := lines[i]
+			if isBlank(l) {
+				next := i + 1
+				for next < len(lines) && isBlank(lines[next]) {
+					next++
+				}
+				if next < len(lines) && indentOf(lines[next]) >= mk.content {
+					item = append(item, "")
+					continue
+				}
+				break
+			}
+			if indentOf(l) >= mk.content {
+				item = append(item, dedent(l, mk.content))
+			} else if !isBlank(item[len(item)-1]) && !isListItem(l) && !startsBlock(l) {
+				// A lazy continuation of the item's paragraph
+				item = append(item, strings.TrimSpace(l))
+			} else {
+				break
+			}
+		}
+		items = append(items, item)
+		// A blank line between items makes the list loose
+		next := i
+		for next < len(lines) && isBlank(lines[next]) {
+			next++
+		}
+		if next > i && next < len(lines) {
+			if mk, ok := parseListMarker(lines[next]); ok && mk.ordered == first.ordered && mk.char == first.char {
+				loose = true
+				i = next
+				continue
+			}
+		}
+		for _, l := range item[:len(item)-1] {
+			if isBlank(l) {
+				loose = true
+			}
+		}
+	}
+
+	tag := "ul"
+	if first.ordered {
+		tag = "ol"
+	}
+	m.out.WriteString("<" + tag)
+	if first.ordered && first.start != 1 {
+		fmt.Fprintf(&m.out, ` start="%d"`, first.start)
+	}
+	m.out.WriteString(">\n")
+	tight := m.tight
+	m.tight = !loose
+	for _, item := range items {
+		m.out.WriteString("<li>")
+		if t := item[0]; len(t) >= 4 && t[0] == '[' && t[2] == ']' && (t[3] == ' ') && strings.ContainsRune(" xX", rune(t[1])) {
+			checked := ""
+			if t[1] != ' ' {
+				checked = " checked"
+			}
+			fmt.Fprintf(&m.out, `<input type="checkbox" disabled%s> `, checked)
+			item[0] = t[4:]
+		}
+		m.blocks(item)
+		m.out.WriteString("</li>\n")
+	}
+	m.tight = tight
+	m.out.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// tableCells splits a row of a table into its cells, at each | that
+// isn't escaped.
+func tableCells(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	start := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '|':
+			cells = append(cells, strings.TrimSpace(line[start:i]))
+			start = i + 1
+		}
+	}
+	return append(cells, strings.TrimSpace(line[start:]))
+}
+
+func isTableDelim(line string) bool {
+	if !strings.Contains(line, "-") || indentOf(line) >= 4 {
+		return false
+	}
+	for _, c := range tableCells(line) {
+		if !tableDelimRE.MatchString(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *markdown) table(lines []string, i int) int {
+	head := tableCells(lines[i])
+	var align []string
+	for _, c := range tableCells(lines[i+1]) {
+		switch {
+		case strings.HasPrefix(c, ":") && strings.HasSuffix(c, ":"):
+			align = append(align, "center")
+		case strings.HasSuffix(c, ":"):
+			align = append(align, "right")
+		case strings.HasPrefix(c, ":"):
+			align = append(align, "left")
+		default:
+			align = append(align, "")
+		}
+	}
+	if len(align) != len(head) {
+		return m.paragraph(lines, i)
+	}
+	row := func(cells []string, tag string) {
+		m.out.WriteString("<tr>")
+		for j, a := range align {
+			m.out.WriteString("<" + tag)
+			if a != "" {
+				fmt.Fprintf(&m.out, ` style="text-align: %s"`, a)
+			}
+			m.out.WriteString(">")
+			if j < len(cells) {
+				m.out.WriteString(m.inline(strings.ReplaceAll(cells[j], `\|`, "|")))
+			}
+			m.out.WriteString("</" + tag + ">")
+		}
+		m.out.WriteString("</tr>\n")
+	}
+	m.out.WriteString("<table>\n<thead>\n")
+	row(head, "th")
+	m.out.WriteString("</thead>\n<tbody>\n")
+	for i += 2; i < len(lines) && !isBlank(lines[i]) && !startsBlock(lines[i]); i++ {
+		row(tableCells(lines[i]), "td")
+	}
+	m.out.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+// htmlBlock leaves out a block of raw HTML, keeping whatever text it
+// has as a paragraph.
+func (m *markdown) htmlBlock(lines []string, i int) int {
+	var text []string
+	if strings.HasPrefix(strings.TrimSpace(lines[i]), "<!--") {
+		for ; i < len(lines); i++ {
+			if strings.Contains(lines[i], "-->") {
+				return i + 1
+			}
+		}
+		return i
+	}
+	for ; i < len(lines) && !isBlank(lines[i]); i++ {
+		if t := strings.TrimSpace(htmlTagRE.ReplaceAllString(lines[i], "")); t != "" {
+			text = append(text, t)
+		}
+	}
+	if len(text) > 0 {
+		m.para(strings.Join(text, "\n"))
+	}
+	return i
+}
+
+func (m *markdown) paragraph(lines []string, i int) int {
+	// Trailing spaces are kept, as two of them break the line
+	text := []string{strings.TrimLeft(lines[i], " \t")}
+	for i++; i < len(lines); i++ {
+		l := lines[i]
+		if s := setextLevelRE.FindStringSubmatch(l); s != nil {
+			level := 1
+			if s[1][0] == '-' {
+				level = 2
+			}
+			m.heading(level, strings.TrimSpace(strings.Join(text, " ")))
+			return i + 1
+		}
+		if isBlank(l) || startsBlock(l) {
+			break
+		}
+		text = append(text, strings.TrimLeft(l, " \t"))
+	}
+	m.para(strings.TrimRight(strings.Join(text, "\n"), " \t"))
+	return i
+}
+
+func (m *markdown) para(text string) {
+	if m.tight {
+		m.out.WriteString(m.inline(text))
+		return
+	}
+	m.out.WriteString("<p>")
+	m.out.WriteString(m.inline(text))
+	m.out.WriteString("</p>\n")
+}
+
+// href returns the URL a link or image to target goes to, or "" if
+// it isn't safe to link to.
+func (m *markdown) href(target string) string {
+	if strings.HasPrefix(target, "#") {
+		return target
+	}
+	if scheme := linkSchemeRE.FindString(target); scheme != "" {
+		switch strings.ToLower(scheme) {
+		case "http:", "https:", "mailto:":
+			return target
+		}
+		return ""
+	}
+	if strings.HasPrefix(target, "//") {
+		return target
+	}
+	return m.link(target)
+}
+
+// linkEnd finds the end of the link whose text starts at s[i]: an
+// inline [text](target "title"), or a [text][label], [text][] or [text]
+// of a link reference definition. It returns the link's text, its
+// target and the index after it.
+func (m *markdown) linkEnd(s string, i int) (text, target string, end int, ok bool) {
+	depth := 0
+	j := i
+	for ; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+		case ']':
+			depth--
+		}
+		if depth == 0 {
+			break
+		}
+	}
+	if j >= len(s) {
+		return "", "", 0, false
+	}
+	text = s[i+1 : j]
+	if j+1 < len(s) && s[j+1] == '(' {
+		close := strings.IndexByte(s[j+2:], ')')
+		if close < 0 {
+			return "", "", 0, false
+		}
+		dest := strings.TrimSpace(s[j+2 : j+2+close])
+		// Leave out a title
+		if k := strings.IndexAny(dest, " \t\n"); k >= 0 {
+			dest = dest[:k]
+		}
+		dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+		return text, dest, j + 3 + close, true
+	}
+	label, end := text, j+1
+	if j+1 < len(s) && s[j+1] == '[' {
+		if close := strings.IndexByte(s[j+2:], ']'); close >= 0 {
+			if l := s[j+2 : j+2+close]; l != "" {
+				label = l
+			}
+			end = j + 3 + close
+		}
+	}
+	target, ok = m.refs[refLabel(label)]
+	return text, target, end, ok
+}
+
+// refLabel normalizes the label of a link reference, which matches
+// regardless of case and spacing.
+func refLabel(label string) string {
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+// linkRefs removes the link reference definitions from lines, outside
+// of code blocks, returning their targets by label.
+func linkRefs(lines []string) ([]string, map[string]string) {
+	refs := map[string]string{}
+	var out []string
+	fence := ""
+	for _, l := range lines {
+		if f := fenceRE.FindStringSubmatch(l); f != nil && (fence == "" || strings.HasPrefix(strings.TrimSpace(l), fence)) {
+			if fence == "" {
+				fence = f[1]
+			} else {
+				fence = ""
+			}
+		} else if d := linkRefRE.FindStringSubmatch(l); d != nil && fence == "" {
+			if label := refLabel(d[1]); refs[label] == "" {
+				refs[label] = strings.TrimSuffix(strings.TrimPrefix(d[2], "<"), ">")
+			}
+			continue
+		}
+		out = append(out, l)
+	}
+	return out, refs
+}
+
+func isWordChar(b byte) bool {
+	return b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= 0x80
+}
+
+// inline renders the text of a paragraph, heading or cell.
+func (m *markdown) inline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(asciiPunct, s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br>\n")
+			i += 2
+			continue
+		case c == '\n':
+			if strings.HasSuffix(s[:i], "  ") {
+				b.WriteString("<br>")
+			}
+			b.WriteByte('\n')
+			i++
+			continue
+		case c == '`':
+			n := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			ticks := s[i : i+n]
+			if end := strings.Index(s[i+n:], ticks); end >= 0 {
+				code := strings.ReplaceAll(s[i+n:i+n+end], "\n", " ")
+				if strings.TrimSpace(code) != "" && strings.HasPrefix(code, " ") && strings.HasSuffix(code, " ") {
+					code = code[1 : len(code)-1]
+				}
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += 2*n + end
+				continue
+			}
+			b.WriteString(ticks)
+			i += n
+			continue
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if alt, target, end, ok := m.linkEnd(s, i+1); ok {
+				// The file viewer has pages of files, but not the files
+				// themselves, so only images from elsewhere are shown
+				if src := m.href(target); src != "" && !strings.HasPrefix(src, "/") && !strings.HasPrefix(src, "#") {
+					fmt.Fprintf(&b, `<img src="%s" alt="%s">`, html.EscapeString(src), html.EscapeString(alt))
+				} else {
+					b.WriteString(html.EscapeString(alt))
+				}
+				i = end
+				continue
+			}
+		case c == '[':
+			if text, target, end, ok := m.linkEnd(s, i); ok {
+				inLink := m.inLink
+				m.inLink = true
+				inner := m.inline(text)
+				m.inLink = inLink
+				if href := m.href(target); href != "" && !inLink {
+					fmt.Fprintf(&b, `<a href="%s">%s</a>`, html.EscapeString(href), inner)
+				} else {
+					b.WriteString(inner)
+				}
+				i = end
+				continue
+			}
+		case c == '<':
+			if a := autolinkRE.FindStringSubmatch(s[i:]); a != nil && !m.inLink {
+				fmt.Fprintf(&b, `<a href="%s">%s</a>`, html.EscapeString(a[1]), html.EscapeString(a[1]))
+				i += len(a[0])
+				continue
+			}
+			if tag := htmlInlineRE.FindString(s[i:]); tag != "" {
+				if strings.HasPrefix(tag, "<br") {
+					b.WriteString("<br>")
+				}
+				i += len(tag)
+				continue
+			}
+		case c == 'h' && !m.inLink && (i == 0 || !isWordChar(s[i-1])):
+			if u := bareURLRE.FindString(s[i:]); u != "" {
+				u = strings.TrimRight(u, ".,:;!?*_~'\")")
+				fmt.Fprintf(&b, `<a href="%s">%s</a>`, html.EscapeString(u), html.EscapeString(u))
+				i += len(u)
+				continue
+			}
+		case c == '*' || c == '_' || c == '~':
+			if out, end, ok := m.emphasis(s, i); ok {
+				b.WriteString(out)
+				i = end
+				continue
+			}
+		}
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// emphasis renders the emphasis, strong emphasis or strikethrough
+// starting at s[i], if it is closed.
+func (m *markdown) emphasis(s string, i int) (string, int, bool) {
+	c := s[i]
+	n := 1
+	if i+1 < len(s) && s[i+1] == c {
+		n = 2
+	}
+	if c == '~' && n == 1 {
+		return "", 0, false
+	}
+	delim := s[i : i+n]
+	// Opening delimiters are followed by text, and _ isn't in a word
+	if i+n >= len(s) || s[i+n] == ' ' || s[i+n] == '\n' ||
+		c == '_' && i > 0 && isWordChar(s[i-1]) {
+		return "", 0, false
+	}
+	for j := i + n; j+n <= len(s); j++ {
+		if s[j] == '`' {
+			// Code spans take precedence
+			if end := strings.IndexByte(s[j+1:], '`'); end >= 0 {
+				j += end + 1
+			}
+			continue
+		}
+		if s[j:j+n] != delim || s[j-1] == ' ' || s[j-1] == '\n' {
+			continue
+		}
+		// A single delimiter doesn't close on half of a double one
+		if n == 1 && j+1 < len(s) && s[j+1] == c {
+			j++
+			continue
+		}
+		if c == '_' && j+n < len(s) && isWordChar(s[j+n]) {
+			continue
+		}
+		tag := map[string]string{"*": "em", "_": "em", "**": "strong", "__": "strong", "~~": "del"}[delim]
+		return "<" + tag + ">" + m.inline(s[i+n:j]) + "</" + tag + ">", j + n, true
+	}
+	return "", 0, false
+}
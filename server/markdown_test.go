@@ -0,0 +1,61 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	link := func(target string) string { return "/view/repo/" + target }
+	cases := []struct {
+		in, out string
+	}{
+		{"# Title\n\nSome *text*, **bold** and `code`.",
+			"<h1 id=\"title\">Title</h1>\n<p>Some <em>text</em>, <strong>bold</strong> and <code>code</code>.</p>\n"},
+		{"Title\n=====\nSub title\n---",
+			"<h1 id=\"title\">Title</h1>\n<h2 id=\"sub-title\">Sub title</h2>\n"},
+		{"## Usage\n## Usage", "<h2 id=\"usage\">Usage</h2>\n<h2 id=\"usage-1\">Usage</h2>\n"},
+		{"```go\nfunc main() {}\n```", "<pre><code class=\"language-go\">func main() {}\n</code></pre>\n"},
+		{"    indented <code>", "<pre><code>indented &lt;code&gt;\n</code></pre>\n"},
+		{"- one\n- two\n  - nested\n- [x] done",
+			"<ul>\n<li>one</li>\n<li>two<ul>\n<li>nested</li>\n</ul>\n</li>\n<li><input type=\"checkbox\" disabled checked> done</li>\n</ul>\n"},
+		{"3. three\n\n4. four", "<ol start=\"3\">\n<li><p>three</p>\n</li>\n<li><p>four</p>\n</li>\n</ol>\n"},
+		{"> quoted\ngoes on", "<blockquote>\n<p>quoted\ngoes on</p>\n</blockquote>\n"},
+		{"| a | b |\n|:--|--:|\n| 1 | 2 |",
+			"<table>\n<thead>\n<tr><th style=\"text-align: left\">a</th><th style=\"text-align: right\">b</th></tr>\n</thead>\n<tbody>\n<tr><td style=\"text-align: left\">1</td><td style=\"text-align: right\">2</td></tr>\n</tbody>\n</table>\n"},
+		{"[docs](docs/) and [site](https://example.com \"Site\")",
+			"<p><a href=\"/view/repo/docs/\">docs</a> and <a href=\"https://example.com\">site</a></p>\n"},
+		{"See https://example.com/x. Or <https://example.org>.",
+			"<p>See <a href=\"https://example.com/x\">https://example.com/x</a>. Or <a href=\"https://example.org\">https://example.org</a>.</p>\n"},
+		{"snake_case_name and ~~gone~~", "<p>snake_case_name and <del>gone</del></p>\n"},
+		{"2 * 3 * 4 \\*not\\*", "<p>2 * 3 * 4 *not*</p>\n"},
+		{"***", "<hr>\n"},
+		{"Built with [bazel][] and [Go][go], see [docs].\n\n[Bazel]: https://bazel.build\n[go]: <https://go.dev> \"Go\"\n[docs]: doc/\n\n```\n[kept]: in code\n```",
+			"<p>Built with <a href=\"https://bazel.build\">bazel</a> and <a href=\"https://go.dev\">Go</a>, see <a href=\"/view/repo/doc/\">docs</a>.</p>\n<pre><code>[kept]: in code\n</code></pre>\n"},
+		{"[not a link] and [x][missing]", "<p>[not a link] and [x][missing]</p>\n"},
+	}
+	for _, tc := range cases {
+		if got := string(renderMarkdown(tc.in, link)); got != tc.out {
+			t.Errorf("renderMarkdown(%q):\n got %q\nwant %q", tc.in, got, tc.out)
+		}
+	}
+}
+
+func TestRenderMarkdownIsSafe(t *testing.T) {
+	link := func(target string) string { return "/view/repo/" + target }
+	for _, in := range []string{
+		"<script>alert(1)</script>",
+		"<p onclick=\"alert(1)\">hi</p>",
+		"[x](javascript:alert(1))",
+		"![x](data:text/html,<script>)",
+		"text <img src=x onerror=alert(1)> more",
+		"[x](\"onmouseover=\"alert(1))",
+	} {
+		out := string(renderMarkdown(in, link))
+		for _, bad := range []string{"<script", "javascript:", "onclick", "onerror", "data:", "\"onmouseover"} {
+			if strings.Contains(out, bad) {
+				t.Errorf("renderMarkdown(%q) = %q, which has %q", in, out, bad)
+			}
+		}
+	}
+}
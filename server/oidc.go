@@ -0,0 +1,407 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmizerany/pat"
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+const (
+	sessionCookie = "livegrep_session"
+	// Holds the state of a sign-in in progress
+	signInCookie  = "livegrep_signin"
+	signInTimeout = 10 * time.Minute
+)
+
+// oidcAuth signs users in with an OpenID Connect provider, with the
+// authorization code flow, and keeps them signed in with a signed
+// session cookie.
+type oidcAuth struct {
+	cfg          config.OIDC
+	clientSecret string
+	scopes       []string
+	userClaim    string
+	groupsClaim  string
+	ttl          time.Duration
+	secure       bool
+	signer       cookieSigner
+	keepGroups   func([]string) []string
+	client       *http.Client
+
+	mu        sync.Mutex
+	endpoints *oidcEndpoints
+}
+
+// oidcEndpoints are the parts of the provider's discovery document the
+// flow needs.
+type oidcEndpoints struct {
+	Issuer        string `json:"issuer"`
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+}
+
+// A session is who a session cookie signed in, until when.
+type session struct {
+	User    authUser `json:"user"`
+	Expires int64    `json:"exp"`
+}
+
+// A pendingSignIn is the state of a sign-in in progress, to check the
+// provider's redirect back against.
+type pendingSignIn struct {
+	State   string `json:"state"`
+	Nonce   string `json:"nonce"`
+	Return  string `json:"return"`
+	Expires int64  `json:"exp"`
+}
+
+func newOIDCAuth(cfg config.OIDC, keepGroups func([]string) []string) (*oidcAuth, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc: issuer, client_id and redirect_url are required")
+	}
+	o := &oidcAuth{
+		cfg:         cfg,
+		scopes:      cfg.Scopes,
+		userClaim:   cfg.UserClaim,
+		groupsClaim: cfg.GroupsClaim,
+		ttl:         time.Duration(cfg.SessionHours) * time.Hour,
+		secure:      strings.HasPrefix(cfg.RedirectURL, "https://"),
+		keepGroups:  keepGroups,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	o.cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if cfg.ClientSecretEnv != "" {
+		if o.clientSecret = os.Getenv(cfg.ClientSecretEnv); o.clientSecret == "" {
+			return nil, fmt.Errorf("oidc: $%s is empty", cfg.ClientSecretEnv)
+		}
+	}
+	if len(o.scopes) == 0 {
+		o.scopes = []string{"profile", "email"}
+	}
+	if o.userClaim == "" {
+		o.userClaim = "email"
+	}
+	if o.groupsClaim == "" {
+		o.groupsClaim = "groups"
+	}
+	if o.ttl <= 0 {
+		o.ttl = 12 * time.Hour
+	}
+
+	var key []byte
+	if cfg.SessionKeyEnv != "" {
+		if key = []byte(os.Getenv(cfg.SessionKeyEnv)); len(key) < 16 {
+			return nil, fmt.Errorf("oidc: $%s must be at least 16 bytes", cfg.SessionKeyEnv)
+		}
+	} else {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		log.Warnf(context.Background(), "oidc: no session_key_env; sessions will end when the frontend restarts")
+	}
+	o.signer = cookieSigner{key}
+	return o, nil
+}
+
+func (o *oidcAuth) user(r *http.Request) *authUser {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	var s session
+	if !o.signer.verify(c.Value, &s) || time.Now().Unix() >= s.Expires {
+		return nil
+	}
+	return &s.User
+}
+
+// signIn sends a browser to sign in, and back to the page it asked
+// for; API clients, which can't follow the flow, are refused.
+func (o *oidcAuth) signIn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || strings.HasPrefix(r.URL.Path, "/api/") {
+		unauthenticated(w, r, "Not signed in; sign in at /auth/login")
+		return
+	}
+	http.Redirect(w, r, "/auth/login?"+url.Values{"return": {r.URL.RequestURI()}}.Encode(), 302)
+}
+
+func (o *oidcAuth) register(m *pat.PatternServeMux) {
+	m.Add("GET", "/auth/login", http.HandlerFunc(o.serveLogin))
+	m.Add("GET", "/auth/callback", http.HandlerFunc(o.serveCallback))
+	m.Add("GET", "/auth/logout", http.HandlerFunc(o.serveLogout))
+}
+
+func (o *oidcAuth) serveLogin(w http.ResponseWriter, r *http.Request) {
+	ep, err := o.discover(r.Context())
+	if err != nil {
+		log.Errorf(context.Background(), "oidc discovery: %s", err.Error())
+		http.Error(w, "Can't reach the sign-in provider", 502)
+		return
+	}
+	s := pendingSignIn{
+		State:   randomToken(),
+		Nonce:   randomToken(),
+		Return:  safeReturn(r.FormValue("return")),
+		Expires: time.Now().Add(signInTimeout).Unix(),
+	}
+	o.setCookie(w, signInCookie, "/auth/", o.signer.sign(&s), signInTimeout)
+
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.cfg.ClientID},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"scope":         {strings.Join(append([]string{"openid"}, o.scopes...), " ")},
+		"state":         {s.State},
+		"nonce":         {s.Nonce},
+	}
+	sep := "?"
+	if strings.Contains(ep.Authorization, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, ep.Authorization+sep+params.Encode(), 302)
+}
+
+func (o *oidcAuth) serveCallback(w http.ResponseWriter, r *http.Request) {
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "Sign-in failed: "+e+" "+r.FormValue("error_description"), 401)
+		return
+	}
+	var s pendingSignIn
+	c, err := r.Cookie(signInCookie)
+	if err != nil || !o.signer.verify(c.Value, &s) || time.Now().Unix() >= s.Expires ||
+		!hmac.Equal([]byte(s.State), []byte(r.FormValue("state"))) {
+		http.Error(w, "Sign-in expired or was not started here; try again", 400)
+		return
+	}
+
+	u, err := o.exchange(r.Context(), r.FormValue("code"), s.Nonce)
+	if err != nil {
+		log.Warnf(context.Background(), "oidc sign-in: %s", err.Error())
+		http.Error(w, "Sign-in failed", 401)
+		return
+	}
+	expires := time.Now().Add(o.ttl)
+	o.setCookie(w, sessionCookie, "/", o.signer.sign(&session{User: *u, Expires: expires.Unix()}), o.ttl)
+	o.setCookie(w, signInCookie, "/auth/", "", -1)
+	http.Redirect(w, r, s.Return, 302)
+}
+
+func (o *oidcAuth) serveLogout(w http.ResponseWriter, r *http.Request) {
+	o.setCookie(w, sessionCookie, "/", "", -1)
+	http.Redirect(w, r, "/", 302)
+}
+
+func (o *oidcAuth) setCookie(w http.ResponseWriter, name, path, value string, maxAge time.Duration) {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		HttpOnly: true,
+		Secure:   o.secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		c.MaxAge = -1
+	} else {
+		c.MaxAge = int(maxAge / time.Second)
+	}
+	http.SetCookie(w, c)
+}
+
+// discover fetches the provider's endpoints, the first time they are
+// needed, rather than at startup, so that the frontend still starts if
+// the provider is down.
+func (o *oidcAuth) discover(ctx context.Context) (*oidcEndpoints, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.endpoints != nil {
+		return o.endpoints, nil
+	}
+	req, err := http.NewRequest("GET", o.cfg.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s: status %d", req.URL, resp.StatusCode)
+	}
+	var ep oidcEndpoints
+	if err := json.NewDecoder(resp.Body).Decode(&ep); err != nil {
+		return nil, fmt.Errorf("%s: %s", req.URL, err.Error())
+	}
+	if strings.TrimSuffix(ep.Issuer, "/") != o.cfg.Issuer {
+		return nil, fmt.Errorf("%s: issuer is %q, not %q", req.URL, ep.Issuer, o.cfg.Issuer)
+	}
+	if ep.Authorization == "" || ep.Token == "" {
+		return nil, fmt.Errorf("%s: no authorization or token endpoint", req.URL)
+	}
+	o.endpoints = &ep
+	return &ep, nil
+}
+
+// exchange trades code for the user's ID token, and returns who it
+// names.
+func (o *oidcAuth) exchange(ctx context.Context, code, nonce string) (*authUser, error) {
+	ep, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.cfg.RedirectURL},
+	}
+	req, err := http.NewRequest("POST", ep.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.clientSecret))
+	resp, err := o.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("token endpoint (status=%d): %s", resp.StatusCode, err.Error())
+	}
+	if tok.Error != "" || resp.StatusCode != 200 {
+		return nil, fmt.Errorf("token endpoint (status=%d): %s %s", resp.StatusCode, tok.Error, tok.Description)
+	}
+	return o.idTokenUser(tok.IDToken, nonce, time.Now())
+}
+
+// idTokenUser checks the claims of an ID token and returns the user it
+// names. The token came straight from the token endpoint, over the
+// connection the client secret authenticated, so, as OpenID Connect
+// allows, its signature isn't checked.
+func (o *oidcAuth) idTokenUser(token, nonce string, now time.Time) (*authUser, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token: %s", err.Error())
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token: %s", err.Error())
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != o.cfg.Issuer {
+		return nil, fmt.Errorf("ID token is from %q, not %q", iss, o.cfg.Issuer)
+	}
+	if !contains(claimStrings(claims["aud"]), o.cfg.ClientID) {
+		return nil, errors.New("ID token is not for this client")
+	}
+	if exp, _ := claims["exp"].(float64); int64(exp) <= now.Unix() {
+		return nil, errors.New("ID token has expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+	name, _ := claims[o.userClaim].(string)
+	if name == "" {
+		return nil, fmt.Errorf("ID token has no %s claim", o.userClaim)
+	}
+	return &authUser{Name: name, Groups: o.keepGroups(claimStrings(claims[o.groupsClaim]))}, nil
+}
+
+// claimStrings reads a claim that is a string or a list of them.
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// safeReturn returns where to send the user once signed in: ret, if it
+// is a path on this site, or else the search page.
+func safeReturn(ret string) string {
+	if !strings.HasPrefix(ret, "/") || strings.HasPrefix(ret, "//") || strings.HasPrefix(ret, "/\\") {
+		return "/search"
+	}
+	return ret
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// A cookieSigner encodes values as cookies that can't be forged
+// without its key.
+type cookieSigner struct {
+	key []byte
+}
+
+func (c cookieSigner) sign(v interface{}) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + c.mac(payload)
+}
+
+// verify decodes a cookie that sign encoded into v, reporting whether
+// it was intact.
+func (c cookieSigner) verify(cookie string, v interface{}) bool {
+	i := strings.LastIndexByte(cookie, '.')
+	if i < 0 || !hmac.Equal([]byte(cookie[i+1:]), []byte(c.mac(cookie[:i]))) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cookie[:i])
+	return err == nil && json.Unmarshal(data, v) == nil
+}
+
+func (c cookieSigner) mac(payload string) string {
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
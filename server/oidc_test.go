@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func fakeIDToken(claims map[string]interface{}) string {
+	payload, _ := json.Marshal(claims)
+	return "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+func TestCookieSigner(t *testing.T) {
+	c := cookieSigner{[]byte("0123456789abcdef")}
+	cookie := c.sign(&session{User: authUser{Name: "ann"}, Expires: 5})
+	var s session
+	if !c.verify(cookie, &s) || s.User.Name != "ann" || s.Expires != 5 {
+		t.Fatalf("verify(%q) = %+v", cookie, s)
+	}
+	forged := cookieSigner{[]byte("fedcba9876543210")}.sign(&session{User: authUser{Name: "ann"}})
+	for _, bad := range []string{"", "x", cookie[1:], forged} {
+		if c.verify(bad, &s) {
+			t.Errorf("verify(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestIDTokenUser(t *testing.T) {
+	o, err := newOIDCAuth(config.OIDC{
+		Issuer:      "https://idp.example.com/",
+		ClientID:    "livegrep",
+		RedirectURL: "https://livegrep.example.com/auth/callback",
+	}, func(groups []string) []string { return groups[:1] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	claims := func(change func(map[string]interface{})) string {
+		c := map[string]interface{}{
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"other", "livegrep"},
+			"exp":    2000,
+			"nonce":  "n",
+			"email":  "ann@example.com",
+			"groups": []string{"security", "eng"},
+		}
+		if change != nil {
+			change(c)
+		}
+		return fakeIDToken(c)
+	}
+
+	u, err := o.idTokenUser(claims(nil), "n", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&authUser{Name: "ann@example.com", Groups: []string{"security"}}); !reflect.DeepEqual(u, want) {
+		t.Errorf("got %+v, want %+v", u, want)
+	}
+
+	bad := map[string]string{
+		"issuer":   claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }),
+		"audience": claims(func(c map[string]interface{}) { c["aud"] = "other" }),
+		"expired":  claims(func(c map[string]interface{}) { c["exp"] = 999 }),
+		"nonce":    claims(func(c map[string]interface{}) { c["nonce"] = "m" }),
+		"no user":  claims(func(c map[string]interface{}) { delete(c, "email") }),
+		"garbage":  "not.a-token",
+	}
+	for name, token := range bad {
+		if _, err := o.idTokenUser(token, "n", now); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestOIDCFlow(t *testing.T) {
+	var nonce string
+	idp := httptest.NewServer(nil)
+	defer idp.Close()
+	idp.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(&oidcEndpoints{
+				Issuer:        idp.URL,
+				Authorization: idp.URL + "/authorize",
+				Token:         idp.URL + "/token",
+			})
+		case "/token":
+			if id, secret, _ := r.BasicAuth(); id != "livegrep" || secret != "s3cret" || r.FormValue("code") != "c0de" {
+				w.WriteHeader(400)
+				fmt.Fprint(w, `{"error": "invalid_grant"}`)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"id_token": fakeIDToken(map[string]interface{}{
+				"iss": idp.URL, "aud": "livegrep", "exp": time.Now().Add(time.Hour).Unix(),
+				"nonce": nonce, "email": "ann@example.com",
+			})})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	t.Setenv("LIVEGREP_TEST_OIDC_SECRET", "s3cret")
+	o, err := newOIDCAuth(config.OIDC{
+		Issuer:          idp.URL,
+		ClientID:        "livegrep",
+		ClientSecretEnv: "LIVEGREP_TEST_OIDC_SECRET",
+		RedirectURL:     "http://livegrep.example.com/auth/callback",
+	}, func(groups []string) []string { return groups })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	o.signIn(w, httptest.NewRequest("GET", "/search?q=foo", nil))
+	if loc := w.Header().Get("Location"); w.Code != 302 || loc != "/auth/login?return=%2Fsearch%3Fq%3Dfoo" {
+		t.Fatalf("signIn: %d to %q", w.Code, loc)
+	}
+
+	w = httptest.NewRecorder()
+	o.serveLogin(w, httptest.NewRequest("GET", "/auth/login?return=%2Fsearch%3Fq%3Dfoo", nil))
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != 302 || loc.Path != "/authorize" {
+		t.Fatalf("login: %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	nonce = loc.Query().Get("nonce")
+	state := loc.Query().Get("state")
+	signInCookies := w.Result().Cookies()
+
+	callback := func(state, code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/auth/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+		for _, c := range signInCookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		o.serveCallback(w, req)
+		return w
+	}
+	if w := callback("wrong", "c0de"); w.Code != 400 {
+		t.Errorf("wrong state: status %d", w.Code)
+	}
+	if w := callback(state, "wrong"); w.Code != 401 {
+		t.Errorf("wrong code: status %d", w.Code)
+	}
+	w = callback(state, "c0de")
+	if w.Code != 302 || w.Header().Get("Location") != "/search?q=foo" {
+		t.Fatalf("callback: %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	req := httptest.NewRequest("GET", "/search", nil)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			req.AddCookie(c)
+		}
+	}
+	if u := o.user(req); u == nil || u.Name != "ann@example.com" {
+		t.Errorf("signed in as %+v", u)
+	}
+	if u := o.user(httptest.NewRequest("GET", "/search", nil)); u != nil {
+		t.Errorf("no cookie: signed in as %+v", u)
+	}
+}
+
+func TestSafeReturn(t *testing.T) {
+	for in, want := range map[string]string{
+		"/search?q=x":          "/search?q=x",
+		"":                     "/search",
+		"//evil.example.com":   "/search",
+		"/\\evil.example.com":  "/search",
+		"https://evil.example": "/search",
+	} {
+		if got := safeReturn(in); got != want {
+			t.Errorf("safeReturn(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"time"
+
+	"github.com/livegrep/livegrep/pkg/metrics"
+	"github.com/livegrep/livegrep/server/api"
+)
+
+// promMetrics are the search metrics served at /metrics when
+// prometheus is enabled. Its methods do nothing on a nil *promMetrics.
+type promMetrics struct {
+	registry *metrics.Registry
+	requests *metrics.Counter
+	latency  *metrics.Histogram
+	inFlight *metrics.Gauge
+}
+
+func newPromMetrics() *promMetrics {
+	reg := metrics.NewRegistry()
+	return &promMetrics{
+		registry: reg,
+		requests: reg.NewCounter("livegrep_search_requests_total",
+			"Searches, by backend and status: ok, or the error code returned.", "backend", "status"),
+		latency: reg.NewHistogram("livegrep_search_duration_seconds",
+			"How long backends took to answer searches that succeeded.", metrics.DefaultBuckets, "backend"),
+		inFlight: reg.NewGauge("livegrep_searches_in_flight",
+			"Searches being served."),
+	}
+}
+
+// begin counts a search as in flight, until the func it returns is
+// called.
+func (p *promMetrics) begin() func() {
+	if p == nil {
+		return func() {}
+	}
+	p.inFlight.Add(1)
+	return func() { p.inFlight.Add(-1) }
+}
+
+// record counts the outcome of one search, as searchMetrics does for
+// StatsD.
+func (p *promMetrics) record(backend, status string, reply *api.ReplySearch) {
+	if p == nil {
+		return
+	}
+	if status == "bad_backend" {
+		// Whatever was asked for, which needn't be a backend at all.
+		backend = ""
+	}
+	p.requests.Inc(backend, status)
+	if reply != nil && reply.Info != nil {
+		took := time.Duration(reply.Info.TotalTime) * time.Millisecond
+		p.latency.Observe(took.Seconds(), backend)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+func TestPromMetrics(t *testing.T) {
+	p := newPromMetrics()
+	done := p.begin()
+	p.begin()()
+	p.record("linux", "ok", &api.ReplySearch{Info: &api.Stats{TotalTime: 20}})
+	p.record("linux", "timeout", nil)
+	p.record("nope", "bad_backend", nil)
+
+	w := httptest.NewRecorder()
+	p.registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`livegrep_search_requests_total{backend="linux",status="ok"} 1`,
+		`livegrep_search_requests_total{backend="linux",status="timeout"} 1`,
+		`livegrep_search_requests_total{backend="",status="bad_backend"} 1`,
+		`livegrep_search_duration_seconds_bucket{backend="linux",le="0.025"} 1`,
+		`livegrep_search_duration_seconds_bucket{backend="linux",le="0.01"} 0`,
+		`livegrep_search_duration_seconds_count{backend="linux"} 1`,
+		"livegrep_searches_in_flight 1",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+	done()
+	w = httptest.NewRecorder()
+	p.registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "livegrep_searches_in_flight 0\n") {
+		t.Errorf("search still in flight:\n%s", w.Body.String())
+	}
+
+	// Without prometheus enabled, there's nothing to record.
+	var off *promMetrics
+	off.begin()()
+	off.record("linux", "ok", nil)
+}
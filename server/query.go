@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"regexp/syntax"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	pb "github.com/livegrep/livegrep/src/proto/go_proto"
@@ -23,9 +25,77 @@ var knownTags = map[string]bool{
 	"-repo":       true,
 	"tags":        true,
 	"-tags":       true,
+	"sym":         true,
+	"label":       true,
+	"-label":      true,
+	"lang":        true,
+	"-lang":       true,
+	"version":     true,
+	"rev":         true,
 	"case":        true,
 	"lit":         true,
+	"regex":       true,
 	"max_matches": true,
+	"max_files":   true,
+	"sort":        true,
+	"index":       true,
+	"rank":        true,
+	"active":      true,
+}
+
+// langAliases maps other names people give languages to the ones the
+// indexer detects.
+var langAliases = map[string]string{
+	"golang":    "go",
+	"c++":       "cpp",
+	"cxx":       "cpp",
+	"js":        "javascript",
+	"ts":        "typescript",
+	"py":        "python",
+	"sh":        "shell",
+	"bash":      "shell",
+	"rb":        "ruby",
+	"rs":        "rust",
+	"objc":      "objective-c",
+	"cs":        "csharp",
+	"c#":        "csharp",
+	"kt":        "kotlin",
+	"md":        "markdown",
+	"yml":       "yaml",
+	"bazel":     "starlark",
+	"make":      "makefile",
+	"docker":    "dockerfile",
+	"proto":     "protobuf",
+	"hs":        "haskell",
+	"ex":        "elixir",
+	"elisp":     "emacs-lisp",
+	"emacs":     "emacs-lisp",
+	"terraform": "hcl",
+	"ps1":       "powershell",
+}
+
+// parseLangs normalizes the values of lang: or -lang: atoms, each a
+// comma-separated list of languages any one of which a file may be in,
+// to the lower-case names the indexer detects.
+func parseLangs(values []string) ([]string, error) {
+	var out []string
+	for _, v := range values {
+		var langs []string
+		for _, l := range strings.Split(strings.ToLower(v), ",") {
+			if l = strings.TrimSpace(l); l == "" {
+				continue
+			}
+			if alias, ok := langAliases[l]; ok {
+				l = alias
+			}
+			langs = append(langs, l)
+		}
+		if len(langs) == 0 {
+			return nil, errors.New("lang: must be given a language, such as lang:go or lang:generated")
+		}
+		out = append(out, strings.Join(langs, ","))
+	}
+	return out, nil
 }
 
 func onlyOneSynonym(ops map[string]string, op1 string, op2 string) (string, error) {
@@ -38,8 +108,21 @@ func onlyOneSynonym(ops map[string]string, op1 string, op2 string) (string, erro
 	return ops[op2], nil
 }
 
+// setFilters are the single-valued filters that regex searches can
+// instead give a set of values, any of which may match, as in
+// repo:(a|b).
+var setFilters = map[string]bool{
+	"repo":  true,
+	"-repo": true,
+	"tags":  true,
+	"-tags": true,
+}
+
 func ensureSingleValue(ops map[string][]string, key string) (string, error) {
 	if len(ops[key]) > 1 {
+		if setFilters[key] {
+			return "", fmt.Errorf("multiple values for %s:; to match any of several, give them as a set in a regex search, as in %s:(a|b)", key, key)
+		}
 		return "", fmt.Errorf("multiple values for %s:", key)
 	}
 	if len(ops[key]) == 1 {
@@ -48,13 +131,232 @@ func ensureSingleValue(ops map[string][]string, key string) (string, error) {
 	return "", nil
 }
 
+// splitTop splits s at each sep that isn't inside a group, a character
+// class or an escape. It returns s whole if its groups aren't balanced.
+func splitTop(s, sep string) []string {
+	var out []string
+	depth, start, inClass := 0, 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth > 0 {
+				depth--
+			}
+		case depth == 0 && strings.HasPrefix(s[i:], sep):
+			out = append(out, s[start:i])
+			start = i + len(sep)
+			i = start - 1
+		}
+	}
+	if depth != 0 {
+		return []string{s}
+	}
+	return append(out, s[start:])
+}
+
+// ungroup returns what is inside s, if s is a single parenthesized
+// group, such as (a|b) but not (a)|(b).
+func ungroup(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '(' || s[len(s)-1] != ')' {
+		return "", false
+	}
+	depth, inClass := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 && i != len(s)-1 {
+				return "", false
+			}
+		}
+	}
+	if depth != 0 {
+		return "", false
+	}
+	return s[1 : len(s)-1], true
+}
+
+// valueSet returns the members of the value v of the filter key:, if it
+// is given as a set of alternatives in parentheses, as in repo:(a|b),
+// and nil if it is a single value.
+func valueSet(key, v string) ([]string, error) {
+	inner, ok := ungroup(strings.TrimSpace(v))
+	if !ok {
+		return nil, nil
+	}
+	members := splitTop(inner, "|")
+	for i, m := range members {
+		if members[i] = strings.TrimSpace(m); members[i] == "" {
+			return nil, fmt.Errorf("%s:%s has an empty alternative", key, v)
+		}
+	}
+	return members, nil
+}
+
+var errDanglingOr = errors.New("OR must be between two search terms, as in foo OR bar; to match any of several values of a filter, give them as a set, as in repo:(a|b)")
+
+// orTerms splits the main search term into the alternatives OR joins,
+// as in foo OR bar, or (foo OR bar). A term without an OR is returned
+// as it is. A term with unbalanced parentheses is split at every OR, so
+// that literal alternatives such as foo( can be joined.
+func orTerms(term string) ([]string, error) {
+	parts := splitTop(term, " OR ")
+	if len(parts) == 1 && strings.Count(term, "(") != strings.Count(term, ")") {
+		parts = strings.Split(term, " OR ")
+	}
+	if len(parts) == 1 {
+		if inner, ok := ungroup(term); ok {
+			if p := splitTop(inner, " OR "); len(p) > 1 {
+				parts = p
+			}
+		}
+	}
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" || p == "OR" || strings.HasPrefix(p, "OR ") || strings.HasSuffix(p, " OR") {
+			return nil, errDanglingOr
+		}
+		parts[i] = p
+	}
+	return parts, nil
+}
+
+// orLine joins the alternatives of an OR into one regex, reading each as
+// a regex or a literal on its own according to mode, and reports
+// whether any was read as a regex.
+func orLine(alternatives []string, mode regexMode) (string, bool) {
+	anyRegex := false
+	bits := make([]string, len(alternatives))
+	for i, alt := range alternatives {
+		if mode.literal(alt) {
+			bits[i] = regexp.QuoteMeta(alt)
+		} else {
+			bits[i] = "(?:" + alt + ")"
+			anyRegex = true
+		}
+	}
+	return strings.Join(bits, "|"), anyRegex
+}
+
+// A regexMode says how the patterns in a query are read: as regexes,
+// as literal strings, or, for regexAuto, the main search term as a regex
+// unless it looks like code that happens to contain regex
+// metacharacters (see looksLiteral), and the rest as regexes.
+type regexMode string
+
+const (
+	regexYes  regexMode = "yes"
+	regexNo   regexMode = "no"
+	regexAuto regexMode = "auto"
+)
+
+func parseRegexMode(s string) (regexMode, error) {
+	switch s {
+	case "yes", "true":
+		return regexYes, nil
+	case "no", "false":
+		return regexNo, nil
+	case "auto":
+		return regexAuto, nil
+	}
+	return "", fmt.Errorf("regex must be yes, no or auto, not %q", s)
+}
+
+// literal reports whether line is to be searched for as a literal
+// string, rather than a regex, under m.
+func (m regexMode) literal(line string) bool {
+	return m == regexNo || m == regexAuto && looksLiteral(line)
+}
+
+// intentionalRegexRE matches the regex syntax that is unlikely to turn
+// up in code: escapes such as \w or \., .*, quantified groups and
+// classes, letter and digit ranges, alternation between words, counted
+// repetition, group flags and anchors at either end.
+var intentionalRegexRE = regexp.MustCompile(
+	`\\[wdsbWDSB]|\\[^\w\s]|\.[*+?]|[)\]][*+?](?:[^*+?]|$)|\[\^?[^\]]*(?:a-z|A-Z|0-9)|\w\|\w|\{\d+(?:,\d*)?\}|\(\?|^\^|\$$`)
+
+// looksLiteral reports whether line, though it may contain regex
+// metacharacters, looks like a snippet of code, such as foo(bar) or
+// arr[0], meant to be matched as it is. It is if it isn't a valid regex
+// at all, or if it contains metacharacters but none of the syntax in
+// intentionalRegexRE.
+func looksLiteral(line string) bool {
+	if _, err := syntax.Parse(line, syntax.Perl); err != nil {
+		return true
+	}
+	if intentionalRegexRE.MatchString(line) {
+		return false
+	}
+	return strings.ContainsAny(line, `.+*?()|[]{}^$\`)
+}
+
+// An interpretation records how the frontend read a query, beyond what
+// it sends the backend.
+type interpretation struct {
+	mode  regexMode // the regex mode in effect
+	regex bool      // whether the main search term was read as a regex, not a literal
+	// How to order the file results: one of fileSorts, or "" to leave
+	// them in the backend's order
+	fileSort string
+	// The indexes index: names, to search instead of the one the
+	// request does, or just "all"
+	indexes []string
+	// The ranking signals rank: picks, if it is given, to use instead
+	// of those configured
+	rank rankOptions
+	// How recent a commit active: asks repositories to have, or 0
+	active time.Duration
+	// The regex rev: matches whole revision names against, such as
+	// branches, or ""
+	rev string
+}
+
+// fileSorts are the orders sort: can give file results in.
+var fileSorts = map[string]bool{
+	"path":    true,
+	"repo":    true,
+	"indexed": true,
+}
+
+// ParseQuery parses query, reading its patterns as regexes if
+// globalRegex is set and as literal strings if not.
 func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
+	mode := regexYes
+	if !globalRegex {
+		mode = regexNo
+	}
+	out, _, err := parseQuery(query, mode)
+	return out, err
+}
+
+// parseQuery parses query, reading its patterns according to mode,
+// unless the query gives a regex: of its own, and reports how it read
+// the main search term, how to sort and rank results and which indexes
+// to search.
+func parseQuery(query string, mode regexMode) (pb.Query, interpretation, error) {
 	var out pb.Query
 
 	ops := make(map[string][]string)
 	key := ""
 	term := ""
 	q := strings.TrimSpace(query)
+	globalRegex := mode != regexNo
 	inRegex := globalRegex
 	justGotSpace := true
 
@@ -150,9 +452,8 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 	// This is a special case to provide a better error message,
 	// since the main search term is represented by the "" op.
 	if len(ops[""]) > 1 {
-		return out, fmt.Errorf("main search term must be contiguous")
+		return out, interpretation{}, fmt.Errorf("main search term must be contiguous")
 	}
-
 	// Handle synonyms
 	out.File = append(ops["file"], ops["path"]...)
 	out.NotFile = append(ops["-file"], ops["-path"]...)
@@ -160,28 +461,96 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 	var err error
 	out.Repo, err = ensureSingleValue(ops, "repo")
 	if err != nil {
-		return out, err
+		return out, interpretation{}, err
 	}
 	out.Tags, err = ensureSingleValue(ops, "tags")
 	if err != nil {
-		return out, err
+		return out, interpretation{}, err
 	}
 	out.NotRepo, err = ensureSingleValue(ops, "-repo")
 	if err != nil {
-		return out, err
+		return out, interpretation{}, err
 	}
 	out.NotTags, err = ensureSingleValue(ops, "-tags")
 	if err != nil {
-		return out, err
+		return out, interpretation{}, err
+	}
+	out.Version, err = ensureSingleValue(ops, "version")
+	if err != nil {
+		return out, interpretation{}, err
+	}
+	// A tree must have every label: given, so only -label: takes a set,
+	// excluding trees with any of them.
+	out.Labels = ops["label"]
+	for _, l := range out.Labels {
+		if members, err := valueSet("label", l); err != nil {
+			return out, interpretation{}, err
+		} else if members != nil {
+			return out, interpretation{}, errors.New("label: can't be given a set, since a tree must have every label: given; give label: once for each, or use -label:(a|b) to leave out trees with any of them")
+		}
+	}
+	for _, l := range ops["-label"] {
+		members, err := valueSet("-label", l)
+		if err != nil {
+			return out, interpretation{}, err
+		}
+		if members == nil {
+			members = []string{l}
+		}
+		out.NotLabels = append(out.NotLabels, members...)
+	}
+	for _, l := range append(out.Labels, out.NotLabels...) {
+		if l == "" || l[0] == '=' {
+			return out, interpretation{}, errors.New("label: must be given a label name, optionally followed by =value")
+		}
+	}
+	// lang:(go|rust) is lang:go,rust.
+	for _, key := range []string{"lang", "-lang"} {
+		for i, v := range ops[key] {
+			if members, err := valueSet(key, v); err != nil {
+				return out, interpretation{}, err
+			} else if members != nil {
+				ops[key][i] = strings.Join(members, ",")
+			}
+		}
+	}
+	if out.Lang, err = parseLangs(ops["lang"]); err != nil {
+		return out, interpretation{}, err
+	}
+	if out.NotLang, err = parseLangs(ops["-lang"]); err != nil {
+		return out, interpretation{}, err
+	}
+	if v, err := ensureSingleValue(ops, "regex"); err != nil {
+		return out, interpretation{}, err
+	} else if v != "" {
+		if mode, err = parseRegexMode(v); err != nil {
+			return out, interpretation{}, err
+		}
+		globalRegex = mode != regexNo
+	}
+	// OR is only read in regex searches, where a literal " OR " can be
+	// written foo\ OR bar, and not alongside case: or lit:, so that
+	// literal searches such as a OR b mean what they always have.
+	var alternatives []string
+	_, hasCase := ops["case"]
+	_, hasLit := ops["lit"]
+	if main := ops[""]; globalRegex && !hasCase && !hasLit && len(main) > 0 && strings.TrimSpace(main[0]) != "" {
+		if alternatives, err = orTerms(strings.TrimSpace(main[0])); err != nil {
+			return out, interpretation{}, err
+		}
 	}
 	var bits []string
+	isRegex := globalRegex
 	for _, k := range []string{"", "case", "lit"} {
 		if _, ok := ops[k]; !ok {
 			continue
 		}
 		bit := strings.TrimSpace(ops[k][0])
-		if k == "lit" || !globalRegex {
+		if k == "" && len(alternatives) > 1 {
+			bit, isRegex = orLine(alternatives, mode)
+		} else if k == "lit" || mode.literal(bit) {
 			bit = regexp.QuoteMeta(bit)
+			isRegex = false
 		}
 		if len(bit) != 0 {
 			bits = append(bits, bit)
@@ -189,13 +558,35 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 	}
 
 	if len(bits) > 1 {
-		return out, errors.New("You cannot provide multiple of case:, lit:, and a bare regex")
+		return out, interpretation{}, errors.New("You cannot provide multiple of case:, lit:, and a bare regex")
 	}
 
 	if len(bits) > 0 {
 		out.Line = bits[0]
 	}
 
+	// sym: searches the backend's tags index alone, for the
+	// definitions of symbols whose names match.
+	if sym, err := ensureSingleValue(ops, "sym"); err != nil {
+		return out, interpretation{}, err
+	} else if sym = strings.TrimSpace(sym); sym != "" {
+		if out.Line != "" {
+			return out, interpretation{}, errors.New("sym: can't be combined with another search term")
+		}
+		if mode.literal(sym) {
+			sym = regexp.QuoteMeta(sym)
+			isRegex = false
+		} else {
+			isRegex = true
+		}
+		out.Line = sym
+		if out.Tags == "" {
+			out.Tags = "."
+		}
+	}
+
+	// Sets such as repo:(a|b) are regex alternations, so read literally
+	// they are parentheses like any other.
 	if !globalRegex {
 		for i, f := range out.File {
 			out.File[i] = regexp.QuoteMeta(f)
@@ -229,11 +620,81 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 		if err == nil {
 			out.MaxMatches = int32(i)
 		} else {
-			return out, errors.New("Value given to max_matches: must be a valid integer")
+			return out, interpretation{}, errors.New("Value given to max_matches: must be a valid integer")
 		}
 	} else {
 		out.MaxMatches = 0
 	}
+	if v, ok := ops["max_files"]; ok && v[0] != "" && out.FilenameOnly {
+		// A filename-only search returns files rather than lines,
+		// so has a limit of its own.
+		i, err := strconv.Atoi(v[0])
+		if err != nil {
+			return out, interpretation{}, errors.New("Value given to max_files: must be a valid integer")
+		}
+		out.MaxMatches = int32(i)
+	}
 
-	return out, nil
+	sort, err := ensureSingleValue(ops, "sort")
+	if err != nil {
+		return out, interpretation{}, err
+	}
+	if sort != "" && !fileSorts[sort] {
+		return out, interpretation{}, errors.New("sort: must be path, repo or indexed")
+	}
+
+	index, err := ensureSingleValue(ops, "index")
+	if err != nil {
+		return out, interpretation{}, err
+	}
+	var indexes []string
+	for _, name := range strings.Split(index, ",") {
+		if name != "" {
+			indexes = append(indexes, name)
+		}
+	}
+
+	var rank rankOptions
+	if v, ok := ops["rank"]; ok {
+		if len(v) > 1 {
+			return out, interpretation{}, errors.New("multiple values for rank:")
+		}
+		rank = rankOptions{}
+		for _, name := range strings.Split(v[0], ",") {
+			switch {
+			case name == "" || name == "off":
+			case rankSignals[name]:
+				rank[name] = true
+			default:
+				return out, interpretation{}, fmt.Errorf("rank: must be off, or some of tests, depth, filename, word, definition and priority, not %q", name)
+			}
+		}
+	}
+
+	rev, err := ensureSingleValue(ops, "rev")
+	if err != nil {
+		return out, interpretation{}, err
+	}
+	if rev != "" {
+		if !globalRegex {
+			rev = regexp.QuoteMeta(rev)
+		}
+		if _, err := regexp.Compile(rev); err != nil {
+			return out, interpretation{}, fmt.Errorf("rev: %s", err.Error())
+		}
+		if out.Version != "" {
+			return out, interpretation{}, errors.New("rev: and version: can't be combined")
+		}
+	}
+
+	var active time.Duration
+	if v, err := ensureSingleValue(ops, "active"); err != nil {
+		return out, interpretation{}, err
+	} else if v != "" {
+		if active, err = parseAge(v); err != nil {
+			return out, interpretation{}, err
+		}
+	}
+
+	return out, interpretation{mode: mode, regex: isRegex, fileSort: sort, indexes: indexes, rank: rank, active: active, rev: rev}, nil
 }
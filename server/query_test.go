@@ -109,6 +109,21 @@ func TestParseQuery(t *testing.T) {
 			pb.Query{Line: "re", NotTags: "kind:class", FoldCase: true},
 			true,
 		},
+		{
+			`label:team=payments label:tier -label:deprecated re`,
+			pb.Query{Line: "re", Labels: []string{"team=payments", "tier"}, NotLabels: []string{"deprecated"}, FoldCase: true},
+			true,
+		},
+		{
+			`lang:Go,py lang:golang -lang:generated re`,
+			pb.Query{Line: "re", Lang: []string{"go,python", "go"}, NotLang: []string{"generated"}, FoldCase: true},
+			true,
+		},
+		{
+			`version:v1\.2 re`,
+			pb.Query{Line: "re", Version: `v1\.2`, FoldCase: true},
+			true,
+		},
 		{
 			`case:foo:`,
 			pb.Query{Line: "foo:", FoldCase: false},
@@ -216,11 +231,73 @@ func TestParseQuery(t *testing.T) {
 			pb.Query{Line: "zoo", File: []string{"a", "b", "c", `\.rb$`}, FoldCase: true},
 			true,
 		},
+		{
+			"file:a max_files:5 sort:repo",
+			pb.Query{Line: "a", File: []string{"a"}, FilenameOnly: true, FoldCase: true, MaxMatches: 5},
+			true,
+		},
+		{
+			"a max_files:5",
+			pb.Query{Line: "a", FoldCase: true},
+			true,
+		},
 		{
 			`-file:a -path:b -file:c -path:\.rb$ zoo`,
 			pb.Query{Line: "zoo", NotFile: []string{"a", "c", "b", `\.rb$`}, FoldCase: true},
 			true,
 		},
+		{
+			"sym:parseQuery file:server/",
+			pb.Query{Line: "parseQuery", File: []string{"server/"}, Tags: ".", FoldCase: false},
+			true,
+		},
+		{
+			"sym:Foo.Bar tags:function",
+			pb.Query{Line: `Foo\.Bar`, Tags: "function", FoldCase: false},
+			false,
+		},
+
+		// sets and OR
+		{
+			"(foo|bar) repo:(svc-a|svc-b) -path:(vendor/|third_party/)",
+			pb.Query{Line: "(foo|bar)", Repo: "(svc-a|svc-b)", NotFile: []string{"(vendor/|third_party/)"}, FoldCase: true},
+			true,
+		},
+		{
+			"(foo|bar) repo:(svc-a|svc-b) -path:(vendor/|third_party/)",
+			pb.Query{Line: `\(foo\|bar\)`, Repo: `\(svc-a\|svc-b\)`, NotFile: []string{`\(vendor/\|third_party/\)`}, FoldCase: true},
+			false,
+		},
+		{
+			"a OR b",
+			pb.Query{Line: "a OR b", FoldCase: false},
+			false,
+		},
+		{
+			"file:(x)",
+			pb.Query{Line: `\(x\)`, File: []string{`\(x\)`}, FilenameOnly: true, FoldCase: true},
+			false,
+		},
+		{
+			`foo\ OR bar`,
+			pb.Query{Line: `foo\ OR bar`, FoldCase: false},
+			true,
+		},
+		{
+			"foo.* OR bar",
+			pb.Query{Line: "(?:foo.*)|(?:bar)", FoldCase: true},
+			true,
+		},
+		{
+			"(foo OR Bar) file:\\.go$",
+			pb.Query{Line: "(?:foo)|(?:Bar)", File: []string{`\.go$`}, FoldCase: false},
+			true,
+		},
+		{
+			"lang:(go|rs) -lang:(generated) -label:(deprecated|archived) x",
+			pb.Query{Line: "x", Lang: []string{"go,rust"}, NotLang: []string{"generated"}, NotLabels: []string{"deprecated", "archived"}, FoldCase: true},
+			true,
+		},
 	}
 
 	for _, tc := range cases {
@@ -249,6 +326,23 @@ func TestParseQueryError(t *testing.T) {
 		{"a file:((abc()())()) c"},
 		{"a repo:b repo:c"},
 		{"a -repo:b -repo:c"},
+		{"a label:=payments"},
+		{"a lang:,"},
+		{"a version:b version:c"},
+		{"a regex:maybe"},
+		{"a regex:yes regex:no"},
+		{"file:a max_files:a"},
+		{"a sort:size"},
+		{"a index:b index:c"},
+		{"a sym:b"},
+		{"sym:a sym:b"},
+		{"foo OR"},
+		{"OR foo"},
+		{"foo OR OR bar"},
+		{"repo:a OR repo:b"},
+		{"a label:(b|c)"},
+		{"a lang:(go|)"},
+		{"lit:a OR b"},
 	}
 
 	for _, tc := range cases {
@@ -258,3 +352,80 @@ func TestParseQueryError(t *testing.T) {
 		}
 	}
 }
+
+func TestLooksLiteral(t *testing.T) {
+	cases := []struct {
+		in      string
+		literal bool
+	}{
+		{"hello", false},
+		{"a->b", false},
+		{"foo(bar)", true},
+		{"foo(", true},
+		{"x.y()", true},
+		{"arr[0]", true},
+		{"arr[i]++", true},
+		{"*ptr", true},
+		{`printf("%d\n", x)`, true},
+		{"func.*Handler", false},
+		{`\bfoo\b`, false},
+		{`foo\.bar`, false},
+		{"foo|bar", false},
+		{"^import", false},
+		{"return;$", false},
+		{"[a-z]+_test", false},
+		{"(foo|bar)+", false},
+		{"a{2,3}", false},
+		{"(?i)hello", false},
+	}
+	for _, tc := range cases {
+		if got := looksLiteral(tc.in); got != tc.literal {
+			t.Errorf("looksLiteral(%q) = %v, want %v", tc.in, got, tc.literal)
+		}
+	}
+}
+
+func TestParseQueryRegexMode(t *testing.T) {
+	cases := []struct {
+		in    string
+		mode  regexMode
+		line  string
+		file  string
+		regex bool
+	}{
+		{"foo(bar) file:\\.go$", regexAuto, `foo\(bar\)`, `\.go$`, false},
+		{"f.*o file:\\.go$", regexAuto, "f.*o", `\.go$`, true},
+		{"foo(bar)", regexYes, "foo(bar)", "", true},
+		{"foo(bar) regex:auto", regexYes, `foo\(bar\)`, "", false},
+		{"f.*o regex:no", regexYes, `f\.\*o`, "", false},
+		{"f.*o regex:yes", regexNo, "f.*o", "", true},
+		{"lit:f.*o regex:yes", regexYes, `f\.\*o`, "", false},
+		{"foo( OR f.*o", regexAuto, `foo\(|(?:f.*o)`, "", true},
+		{"foo( OR bar(", regexAuto, `foo\(|bar\(`, "", false},
+	}
+	for _, tc := range cases {
+		parsed, interp, err := parseQuery(tc.in, tc.mode)
+		if err != nil {
+			t.Errorf("parseQuery(%q, %s): %v", tc.in, tc.mode, err)
+			continue
+		}
+		var file string
+		if len(parsed.File) > 0 {
+			file = parsed.File[0]
+		}
+		if parsed.Line != tc.line || file != tc.file || interp.regex != tc.regex {
+			t.Errorf("parseQuery(%q, %s) = line %q, file %q, regex %v; want %q, %q, %v",
+				tc.in, tc.mode, parsed.Line, file, interp.regex, tc.line, tc.file, tc.regex)
+		}
+	}
+}
+
+func TestParseQueryIndexes(t *testing.T) {
+	_, interp, err := parseQuery("a index:main,third-party,", regexYes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"main", "third-party"}; !reflect.DeepEqual(interp.indexes, want) {
+		t.Errorf("indexes = %v, want %v", interp.indexes, want)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// queryLogRecord is what the query log keeps about one search. Unlike
+// the audit log's records, they don't say who searched, only which
+// searches were made by the same person.
+type queryLogRecord struct {
+	Time        time.Time `json:"time"`
+	UserID      string    `json:"user_id,omitempty"`
+	Backend     string    `json:"backend"`
+	Query       string    `json:"query"`
+	Status      string    `json:"status"`
+	LatencyMs   int64     `json:"latency_ms"`
+	Results     int       `json:"result_count"`
+	FileResults int       `json:"file_result_count"`
+	Truncated   bool      `json:"truncated"`
+	// Why the backend stopped searching, if it was truncated
+	Why string `json:"why,omitempty"`
+}
+
+// A queryLog logs each search to analytics.query_log, for working out
+// from past searches what the statistics of /api/v2/stats don't say.
+type queryLog struct {
+	// The file is written, and rotated, as the audit log's is
+	file       *auditLog
+	key        []byte
+	userHeader string
+}
+
+func newQueryLog(cfg config.Analytics) (*queryLog, error) {
+	file, err := newAuditLog(config.AuditLog{Path: cfg.QueryLog})
+	if err != nil {
+		return nil, fmt.Errorf("query_log: %s", err.Error())
+	}
+	l := &queryLog{file: file, key: []byte(cfg.UserIDKey), userHeader: cfg.UserHeader}
+	if len(l.key) == 0 {
+		l.key = make([]byte, 32)
+		if _, err := rand.Read(l.key); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// userID returns the anonymous id of user, or "" for no one.
+func (l *queryLog) userID(user string) string {
+	if user == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// logSearch logs a search made by r that finished with the given status
+// ("ok" or an error code) and reply, which is nil if it failed.
+func (a *analytics) logSearch(ctx context.Context, r *http.Request, backend, status string, reply *api.ReplySearch) {
+	if a == nil || a.qlog == nil {
+		return
+	}
+	rec := queryLogRecord{
+		Time:    time.Now().UTC(),
+		UserID:  a.qlog.userID(requestUser(r, a.qlog.userHeader)),
+		Backend: backend,
+		Query:   r.FormValue("q"),
+		Status:  status,
+	}
+	if reply != nil {
+		rec.Results = len(reply.Results)
+		rec.FileResults = len(reply.FileResults)
+		rec.Truncated = reply.Truncated
+		if reply.Info != nil {
+			rec.LatencyMs = reply.Info.TotalTime
+			if reply.Truncated {
+				rec.Why = reply.Info.ExitReason
+			}
+		}
+	}
+	line, err := json.Marshal(&rec)
+	if err != nil {
+		return
+	}
+	if err := a.qlog.file.write(append(line, '\n')); err != nil {
+		log.FromContext(ctx).Errorf("query log: %s", err.Error())
+	}
+}
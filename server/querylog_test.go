@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestQueryLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	a, err := newAnalytics(config.Analytics{
+		Enabled:    true,
+		QueryLog:   path,
+		UserIDKey:  "k",
+		UserHeader: "X-Forwarded-User",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := func(user string) {
+		req := httptest.NewRequest("GET", "/api/v1/search/?q=hello", nil)
+		req.Header.Set("X-Forwarded-User", user)
+		a.logSearch(context.Background(), req, "main", "ok", &api.ReplySearch{
+			Info:      &api.Stats{TotalTime: 42, ExitReason: "MATCH_LIMIT"},
+			Results:   make([]*api.Result, 3),
+			Truncated: true,
+		})
+	}
+	search("alice")
+	search("alice")
+	search("bob")
+	req := httptest.NewRequest("GET", "/api/v1/search/?q=(", nil)
+	a.logSearch(context.Background(), req, "main", "query", nil)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "alice") {
+		t.Errorf("the log names a user: %s", data)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("logged %d searches, want 4: %s", len(lines), data)
+	}
+	var recs []queryLogRecord
+	for _, line := range lines {
+		var rec queryLogRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	if r := recs[0]; r.Query != "hello" || r.LatencyMs != 42 || r.Results != 3 || !r.Truncated || r.Why != "MATCH_LIMIT" {
+		t.Errorf("logged %+v", r)
+	}
+	if recs[0].UserID == "" || recs[0].UserID != recs[1].UserID || recs[0].UserID == recs[2].UserID {
+		t.Errorf("user ids %q, %q, %q; want the same id for the same user only",
+			recs[0].UserID, recs[1].UserID, recs[2].UserID)
+	}
+	if r := recs[3]; r.Status != "query" || r.UserID != "" || r.Truncated {
+		t.Errorf("logged the failed search as %+v", r)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// The ranking signals, by the names rank: gives them.
+const (
+	rankTests      = "tests"
+	rankDepth      = "depth"
+	rankFilename   = "filename"
+	rankWord       = "word"
+	rankPriority   = "priority"
+	rankDefinition = "definition"
+)
+
+var rankSignals = map[string]bool{
+	rankTests:      true,
+	rankDepth:      true,
+	rankFilename:   true,
+	rankWord:       true,
+	rankPriority:   true,
+	rankDefinition: true,
+}
+
+// How much each signal moves a file's score. A test file ranks below
+// any other, whatever else it has going for it (unless its repository
+// has a priority of over 100); a filename or exact word match outweighs
+// a file being a few directories deeper, and defining the symbol
+// matched outweighs both.
+const (
+	testPenalty     = 100
+	depthPenalty    = 1
+	definitionBoost = 8
+	filenameBoost   = 4
+	exactWordBoost  = 2
+)
+
+// testPathRE matches the paths of tests and test fixtures.
+var testPathRE = regexp.MustCompile(
+	`(^|/)(tests?|__tests__|spec|testdata|fixtures?)/|_test\.[^/]*$|\.(test|spec)\.[^/]*$|(^|/)test_[^/]*$`)
+
+// rankOptions are the ranking signals a search uses.
+type rankOptions map[string]bool
+
+// configRankOptions returns the signals cfg turns on; priority is on if
+// it gives any repository or label a priority.
+func configRankOptions(cfg config.Ranking) rankOptions {
+	opts := rankOptions{}
+	if cfg.DemoteTests {
+		opts[rankTests] = true
+	}
+	if cfg.PreferShallow {
+		opts[rankDepth] = true
+	}
+	if cfg.BoostFilename {
+		opts[rankFilename] = true
+	}
+	if cfg.BoostExactWord {
+		opts[rankWord] = true
+	}
+	if cfg.BoostDefinitions {
+		opts[rankDefinition] = true
+	}
+	if len(cfg.RepoPriority) > 0 || len(cfg.LabelPriority) > 0 {
+		opts[rankPriority] = true
+	}
+	return opts
+}
+
+// A ranker orders results by the signals a search uses, with the
+// repository and label priorities configured.
+type ranker struct {
+	opts rankOptions
+	cfg  config.Ranking
+}
+
+// priority returns the weight cfg gives the repository of r, by its
+// name and its labels.
+func (rk *ranker) priority(r *api.Result) int {
+	p := rk.cfg.RepoPriority[r.Tree]
+	for k, v := range r.Labels {
+		p += rk.cfg.LabelPriority[k]
+		if v != "" {
+			p += rk.cfg.LabelPriority[k+"="+v]
+		}
+	}
+	return p
+}
+
+// score rates how relevant r looks; higher is better.
+func (rk *ranker) score(r *api.Result) int {
+	opts := rk.opts
+	score := 0
+	if opts[rankPriority] {
+		score += rk.priority(r)
+	}
+	if opts[rankTests] && testPathRE.MatchString(r.Path) {
+		score -= testPenalty
+	}
+	if opts[rankDepth] {
+		score -= depthPenalty * strings.Count(strings.Trim(r.Path, "/"), "/")
+	}
+	if opts[rankDefinition] && r.Definition {
+		score += definitionBoost
+	}
+	match := ""
+	if r.Bounds[0] >= 0 && r.Bounds[0] <= r.Bounds[1] && r.Bounds[1] <= len(r.Line) {
+		match = r.Line[r.Bounds[0]:r.Bounds[1]]
+	}
+	if opts[rankFilename] && match != "" &&
+		strings.Contains(strings.ToLower(path.Base(r.Path)), strings.ToLower(match)) {
+		score += filenameBoost
+	}
+	if opts[rankWord] && match != "" && isWordMatch(r.Line, r.Bounds) {
+		score += exactWordBoost
+	}
+	return score
+}
+
+// isWordMatch reports whether the match at bounds in line is of whole
+// words, not starting or ending inside a longer one.
+func isWordMatch(line string, bounds [2]int) bool {
+	return !isWordByte(line, bounds[0]-1) && !isWordByte(line, bounds[1])
+}
+
+func isWordByte(s string, i int) bool {
+	if i < 0 || i >= len(s) {
+		return false
+	}
+	c := s[i]
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// rank reorders results, best first. Results are shown grouped by
+// file, so files are ranked, by the score of their best match, and a
+// file's matches stay together, in order; files that score the same
+// stay in the backend's order.
+func (rk *ranker) rank(results []*api.Result) {
+	if len(rk.opts) == 0 || len(results) < 2 {
+		return
+	}
+	type file struct{ tree, version, path string }
+	best := make(map[file]int)
+	first := make(map[file]int)
+	for i, r := range results {
+		f := file{r.Tree, r.Version, r.Path}
+		score := rk.score(r)
+		if _, ok := first[f]; !ok {
+			first[f] = i
+			best[f] = score
+		} else if score > best[f] {
+			best[f] = score
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		fi := file{results[i].Tree, results[i].Version, results[i].Path}
+		fj := file{results[j].Tree, results[j].Version, results[j].Path}
+		if best[fi] != best[fj] {
+			return best[fi] > best[fj]
+		}
+		return first[fi] < first[fj]
+	})
+}
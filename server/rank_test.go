@@ -0,0 +1,106 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestRankResults(t *testing.T) {
+	res := func(path, line string, bounds [2]int) *api.Result {
+		return &api.Result{Tree: "repo", Path: path, Line: line, Bounds: bounds}
+	}
+	paths := func(results []*api.Result) []string {
+		var out []string
+		for _, r := range results {
+			out = append(out, r.Path)
+		}
+		return out
+	}
+	results := func() []*api.Result {
+		return []*api.Result{
+			res("src/parse_test.go", "parse(x)", [2]int{0, 5}),
+			res("vendor/a/b/parse.go", "parse(x)", [2]int{0, 5}),
+			res("src/util.go", "reparse(x)", [2]int{2, 7}),
+			res("src/util.go", "parse(y)", [2]int{0, 5}),
+			res("main.go", "reparse(x)", [2]int{2, 7}),
+		}
+	}
+
+	for _, tc := range []struct {
+		opts rankOptions
+		want []string
+	}{
+		{rankOptions{}, []string{"src/parse_test.go", "vendor/a/b/parse.go", "src/util.go", "src/util.go", "main.go"}},
+		{rankOptions{rankTests: true}, []string{"vendor/a/b/parse.go", "src/util.go", "src/util.go", "main.go", "src/parse_test.go"}},
+		{rankOptions{rankDepth: true}, []string{"main.go", "src/parse_test.go", "src/util.go", "src/util.go", "vendor/a/b/parse.go"}},
+		{rankOptions{rankFilename: true, rankTests: true}, []string{"vendor/a/b/parse.go", "src/util.go", "src/util.go", "main.go", "src/parse_test.go"}},
+		{rankOptions{rankWord: true}, []string{"src/parse_test.go", "vendor/a/b/parse.go", "src/util.go", "src/util.go", "main.go"}},
+	} {
+		got := results()
+		(&ranker{opts: tc.opts}).rank(got)
+		if !reflect.DeepEqual(paths(got), tc.want) {
+			t.Errorf("rank %v: got %v, want %v", tc.opts, paths(got), tc.want)
+		}
+	}
+}
+
+func TestRankDefinitions(t *testing.T) {
+	results := []*api.Result{
+		{Path: "parse.go", Line: "x := parse(y)", Bounds: [2]int{5, 10}},
+		{Path: "src/a/util.go", Line: "func parse(s string) {", Bounds: [2]int{5, 10}, Definition: true},
+	}
+	(&ranker{opts: configRankOptions(config.Ranking{BoostDefinitions: true, BoostFilename: true, PreferShallow: true})}).rank(results)
+	if results[0].Path != "src/a/util.go" {
+		t.Errorf("ranked %s first, not the definition", results[0].Path)
+	}
+}
+
+func TestRankPriority(t *testing.T) {
+	cfg := config.Ranking{
+		RepoPriority:  map[string]int{"monorepo": 10},
+		LabelPriority: map[string]int{"archived": -20, "team=core": 5},
+	}
+	results := []*api.Result{
+		{Tree: "mirror", Path: "a.go", Labels: map[string]string{"archived": ""}},
+		{Tree: "other", Path: "b.go"},
+		{Tree: "lib", Path: "c.go", Labels: map[string]string{"team": "core"}},
+		{Tree: "monorepo", Path: "d.go"},
+	}
+	(&ranker{opts: configRankOptions(cfg), cfg: cfg}).rank(results)
+	var got []string
+	for _, r := range results {
+		got = append(got, r.Tree)
+	}
+	if want := []string{"monorepo", "lib", "other", "mirror"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ranked %v, want %v", got, want)
+	}
+}
+
+func TestConfigRankOptions(t *testing.T) {
+	got := configRankOptions(config.Ranking{DemoteTests: true, BoostExactWord: true})
+	if want := (rankOptions{rankTests: true, rankWord: true}); !reflect.DeepEqual(got, want) {
+		t.Errorf("configRankOptions = %v, want %v", got, want)
+	}
+}
+
+func TestParseQueryRank(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want rankOptions
+	}{
+		{"a", nil},
+		{"a rank:off", rankOptions{}},
+		{"a rank:tests,word", rankOptions{rankTests: true, rankWord: true}},
+	} {
+		_, interp, err := parseQuery(tc.in, regexYes)
+		if err != nil || !reflect.DeepEqual(interp.rank, tc.want) {
+			t.Errorf("parseQuery(%q): rank %v, %v; want %v", tc.in, interp.rank, err, tc.want)
+		}
+	}
+	if _, _, err := parseQuery("a rank:stars", regexYes); err == nil {
+		t.Error("no error for an unknown signal")
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// maxBuckets is how many clients' buckets are kept before those that
+// have refilled are dropped.
+const maxBuckets = 10000
+
+// A rateLimiter turns away searches beyond the rate_limit config: once
+// max_concurrent are running, and once a user has used up their token
+// bucket. A nil *rateLimiter lets everything through.
+type rateLimiter struct {
+	cfg   config.RateLimit
+	slots chan struct{} // nil without max_concurrent
+	queue time.Duration
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// A bucket holds up to burst tokens, refilled at rate a second; each
+// search takes one.
+type bucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newRateLimiter(cfg config.RateLimit) (*rateLimiter, error) {
+	if cfg.MaxConcurrent < 0 || cfg.QueueTimeoutMs < 0 || cfg.PerUserRate < 0 ||
+		cfg.PerUserBurst < 0 || cfg.MaxWildcards < 0 {
+		return nil, fmt.Errorf("limits can't be negative")
+	}
+	for name, q := range cfg.Quotas {
+		if q.Rate < 0 || q.Burst < 0 {
+			return nil, fmt.Errorf("quota for %s can't be negative", name)
+		}
+	}
+	if cfg.MaxConcurrent == 0 && cfg.PerUserRate == 0 && len(cfg.Quotas) == 0 && cfg.MaxWildcards == 0 {
+		return nil, nil
+	}
+	l := &rateLimiter{
+		cfg:     cfg,
+		queue:   time.Duration(cfg.QueueTimeoutMs) * time.Millisecond,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+	if cfg.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	return l, nil
+}
+
+// client returns who made r, for their quota: the signed-in or
+// user_header user, or else the client's address.
+func (l *rateLimiter) client(r *http.Request) string {
+	if u := requestUser(r, l.cfg.UserHeader); u != "" {
+		return u
+	}
+	if l.cfg.TrustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// quota returns the rate and burst of client's bucket, or a rate of 0
+// if it has no limit.
+func (l *rateLimiter) quota(client string) (rate, burst float64) {
+	rate, b := l.cfg.PerUserRate, l.cfg.PerUserBurst
+	if q, ok := l.cfg.Quotas[client]; ok {
+		rate, b = q.Rate, q.Burst
+	}
+	burst = float64(b)
+	if b == 0 {
+		burst = math.Max(1, rate)
+	}
+	return rate, burst
+}
+
+// take takes a token from client's bucket, returning 0 if there was one
+// and otherwise how long until there will be.
+func (l *rateLimiter) take(client string) time.Duration {
+	rate, burst := l.quota(client)
+	if rate == 0 {
+		return 0
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[client]
+	if b == nil || b.rate != rate || b.burst != burst {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now)
+		}
+		b = &bucket{rate: rate, burst: burst, tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled since they were last used,
+// which are no different from new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// acquire waits up to queue_timeout_ms for one of the max_concurrent
+// slots, returning the func that frees it, or nil if none came free.
+func (l *rateLimiter) acquire(ctx context.Context) func() {
+	release := func() { <-l.slots }
+	if l.slots == nil {
+		return func() {}
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return release
+	default:
+	}
+	if l.queue <= 0 {
+		return nil
+	}
+	t := time.NewTimer(l.queue)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// checkCost returns an error if the regex line is too costly to search
+// for, having more than max_wildcards unbounded wildcards. Each can
+// make the backend try every length of match at every position, so a
+// handful of them can tie it up for the whole search timeout. Regexes
+// that don't parse are left for the backend to reject.
+func (l *rateLimiter) checkCost(line string) error {
+	if l == nil || l.cfg.MaxWildcards == 0 {
+		return nil
+	}
+	re, err := syntax.Parse(line, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	if n := wildcards(re); n > l.cfg.MaxWildcards {
+		return fmt.Errorf("This regex has %d unbounded wildcards, such as .*, which is more than the %d allowed; make some of them more specific, or split the search with file: or repo:",
+			n, l.cfg.MaxWildcards)
+	}
+	return nil
+}
+
+// wildcards counts the unbounded repetitions in re of broad character
+// classes, such as .* and [^x]+.
+func wildcards(re *syntax.Regexp) int {
+	n := 0
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus:
+		if broad(re.Sub[0]) {
+			n++
+		}
+	case syntax.OpRepeat:
+		if re.Max == -1 && broad(re.Sub[0]) {
+			n++
+		}
+	}
+	for _, sub := range re.Sub {
+		n += wildcards(sub)
+	}
+	return n
+}
+
+// broadClass is how many characters a class must match to count as a
+// wildcard: more than any alphabet, so [a-z] isn't one but \S is.
+const broadClass = 1 << 12
+
+func broad(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return true
+	case syntax.OpCharClass:
+		size := 0
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			size += int(re.Rune[i+1]-re.Rune[i]) + 1
+		}
+		return size > broadClass
+	}
+	return false
+}
+
+// limited has f turn searches away with 429 Too Many Requests, and a
+// Retry-After header, when the server or the client are over their
+// limits.
+func (s *server) limited(f handler) handler {
+	l := s.limiter
+	if l == nil {
+		return f
+	}
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		reject := func(retry time.Duration, message string) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			backend := r.URL.Query().Get(":backend")
+			if s.bk[backend] == nil {
+				backend = ""
+			}
+			s.finishSearch(ctx, r, backend, "", "rate_limited", nil)
+			writeError(ctx, w, 429, "rate_limited", message)
+		}
+		if wait := l.take(l.client(r)); wait > 0 {
+			reject(wait, "You are searching too often; please slow down and try again shortly")
+			return
+		}
+		release := l.acquire(ctx)
+		if release == nil {
+			reject(time.Second, "The server is busy with other searches; please try again shortly")
+			return
+		}
+		defer release()
+		f(ctx, w, r)
+	}
+}
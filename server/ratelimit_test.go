@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp/syntax"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	l, err := newRateLimiter(config.RateLimit{
+		PerUserRate:  2,
+		PerUserBurst: 3,
+		Quotas:       map[string]config.Quota{"ci-bot": {Rate: 0}, "slow": {Rate: 0.5}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if wait := l.take("alice"); wait != 0 {
+			t.Fatalf("search %d of a burst of 3 waits %s", i+1, wait)
+		}
+	}
+	if wait := l.take("alice"); wait != 500*time.Millisecond {
+		t.Errorf("search past the burst waits %s, want 500ms", wait)
+	}
+	if wait := l.take("bob"); wait != 0 {
+		t.Errorf("another user's search waits %s", wait)
+	}
+	now = now.Add(time.Second)
+	if wait := l.take("alice"); wait != 0 {
+		t.Errorf("search a second later waits %s", wait)
+	}
+
+	for i := 0; i < 10; i++ {
+		if wait := l.take("ci-bot"); wait != 0 {
+			t.Fatalf("search %d by an unlimited quota waits %s", i+1, wait)
+		}
+	}
+	l.take("slow")
+	if wait := l.take("slow"); wait != 2*time.Second {
+		t.Errorf("second search by a quota of 0.5/s waits %s, want 2s", wait)
+	}
+}
+
+func TestRateLimiterAcquire(t *testing.T) {
+	l, err := newRateLimiter(config.RateLimit{MaxConcurrent: 1, QueueTimeoutMs: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := l.acquire(context.Background())
+	if release == nil {
+		t.Fatal("no slot for the first search")
+	}
+	if l.acquire(context.Background()) != nil {
+		t.Error("a second search ran at once with max_concurrent 1")
+	}
+	go func() {
+		time.Sleep(time.Millisecond)
+		release()
+	}()
+	l.queue = time.Second
+	if r := l.acquire(context.Background()); r == nil {
+		t.Error("a queued search didn't get the slot once it was freed")
+	} else {
+		r()
+	}
+}
+
+func TestWildcards(t *testing.T) {
+	for re, want := range map[string]int{
+		`foo`:                0,
+		`foo.*bar`:           1,
+		`.*.*.*`:             3,
+		`[a-z]+_[0-9]*`:      0,
+		`[^"]*"\S+`:          2,
+		`(.{2,}|x.+)y`:       2,
+		`a.{1,100}b`:         0,
+		`(?s:.)*`:            1,
+		`func\s+\w+\(.*`:     1,
+		`\Q.*.*\E`:           0,
+		`(.*)*`:              1,
+		`[\x00-\x{10FFFF}]+`: 1,
+	} {
+		parsed, err := syntax.Parse(re, syntax.Perl)
+		if err != nil {
+			t.Fatalf("%s: %v", re, err)
+		}
+		if got := wildcards(parsed); got != want {
+			t.Errorf("wildcards(%s) = %d, want %d", re, got, want)
+		}
+	}
+
+	l, _ := newRateLimiter(config.RateLimit{MaxWildcards: 2})
+	if err := l.checkCost(`a.*b.*c`); err != nil {
+		t.Errorf("two wildcards turned away: %v", err)
+	}
+	if err := l.checkCost(`.*.*.*`); err == nil {
+		t.Error("three wildcards allowed with max_wildcards 2")
+	}
+	if err := (*rateLimiter)(nil).checkCost(`.*.*.*`); err != nil {
+		t.Errorf("checkCost without limits: %v", err)
+	}
+}
+
+func TestLimited(t *testing.T) {
+	s := &server{config: &config.Config{}, bk: map[string]*Backend{}}
+	var err error
+	if s.limiter, err = newRateLimiter(config.RateLimit{PerUserRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	h := handler(s.limited(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	search := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/search/?q=foo", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := search("10.0.0.1:1234"); w.Code != 200 {
+		t.Fatalf("first search = %d", w.Code)
+	}
+	w := search("10.0.0.1:1235")
+	if w.Code != 429 {
+		t.Fatalf("second search at once = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+	if w := search("10.0.0.2:1234"); w.Code != 200 {
+		t.Errorf("another client's search = %d", w.Code)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// builtinRedactions are src/redact.cc's kBuiltinRules, and must be kept
+// in step with them, as TestBuiltinRedactionsMatchCodesearch checks.
+var builtinRedactions = []string{
+	`-----BEGIN [A-Z ]*PRIVATE KEY(?: BLOCK)?-----([\s\S]*?)-----END [A-Z ]*PRIVATE KEY(?: BLOCK)?-----`,
+	`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`,
+	`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`,
+	`\b(gh[pousr]_[A-Za-z0-9]{36,255})\b`,
+	`\b(github_pat_[A-Za-z0-9_]{82})\b`,
+	`\b(glpat-[A-Za-z0-9_-]{20})\b`,
+	`\b(xox[abprs]-[A-Za-z0-9-]{10,})\b`,
+	`hooks\.slack\.com/services/(T[A-Za-z0-9_]+/B[A-Za-z0-9_]+/[A-Za-z0-9_]+)`,
+	`\b(AIza[0-9A-Za-z_-]{35})\b`,
+	`\b((?:sk|rk)_live_[0-9A-Za-z]{24,})\b`,
+	`\b(eyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,})`,
+	`[A-Za-z][A-Za-z0-9+.-]*://[^/\s:@]+:([^/\s:@]+)@`,
+}
+
+var tokenRE = regexp.MustCompile(`[A-Za-z0-9+/=_-]+`)
+
+// A redactor masks secrets in files shown by the file viewer the way
+// codesearch masks them when indexing (see src/redact.h), so that
+// browsing a file doesn't show what searching it hides.
+type redactor struct {
+	rules            []*regexp.Regexp
+	minEntropy       float64
+	minEntropyLength int
+}
+
+// newRedactor combines the index-wide and repository Redactions, either
+// of which may be nil, as codesearch does. It returns nil if nothing is
+// to be masked.
+func newRedactor(specs ...*config.Redaction) (*redactor, error) {
+	r := &redactor{minEntropyLength: 20}
+	builtin := false
+	for _, spec := range specs {
+		if spec == nil {
+			continue
+		}
+		patterns := spec.Patterns
+		if spec.BuiltinRules && !builtin {
+			builtin = true
+			patterns = append(builtinRedactions[:len(builtinRedactions):len(builtinRedactions)], patterns...)
+		}
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("redaction pattern %q: %s", p, err.Error())
+			}
+			r.rules = append(r.rules, re)
+		}
+		if spec.MinEntropy > 0 {
+			r.minEntropy = spec.MinEntropy
+		}
+		if spec.MinEntropyLength > 0 {
+			r.minEntropyLength = spec.MinEntropyLength
+		}
+	}
+	if len(r.rules) == 0 && r.minEntropy == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+func (r *redactor) randomToken(token string) bool {
+	if len(token) < r.minEntropyLength ||
+		!strings.ContainsAny(token, "0123456789") ||
+		!strings.ContainsAny(token, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+		return false
+	}
+	var counts [256]int
+	for i := 0; i < len(token); i++ {
+		counts[token[i]]++
+	}
+	entropy := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(token))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy > r.minEntropy
+}
+
+// redact returns content with its secrets overwritten by '*', keeping
+// newlines. A nil redactor returns content unchanged.
+func (r *redactor) redact(content string) string {
+	if r == nil {
+		return content
+	}
+	var spans [][2]int
+	for _, re := range r.rules {
+		for _, m := range re.FindAllStringSubmatchIndex(content, -1) {
+			if len(m) >= 4 && m[2] >= 0 {
+				spans = append(spans, [2]int{m[2], m[3]})
+			} else {
+				spans = append(spans, [2]int{m[0], m[1]})
+			}
+		}
+	}
+	if r.minEntropy > 0 {
+		for _, m := range tokenRE.FindAllStringIndex(content, -1) {
+			if r.randomToken(content[m[0]:m[1]]) {
+				spans = append(spans, [2]int{m[0], m[1]})
+			}
+		}
+	}
+	if len(spans) == 0 {
+		return content
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	out := []byte(content)
+	for _, s := range spans {
+		for i := s[0]; i < s[1]; i++ {
+			if out[i] != '\n' {
+				out[i] = '*'
+			}
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+type redactionCase struct {
+	in, out string
+}
+
+// loadRedactionCases reads the Redaction and cases of
+// test/testdata/redaction.txt, which test/codesearch_test.cc runs
+// codesearch's redactor on too.
+func loadRedactionCases(t *testing.T) (*config.Redaction, []redactionCase) {
+	path, err := bazel.Runfile("test/testdata/redaction.txt")
+	if err != nil {
+		t.Fatalf("runfile: %s", err.Error())
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	spec := &config.Redaction{}
+	var cases []redactionCase
+	unescape := strings.NewReplacer(`\n`, "\n").Replace
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "builtin_rules":
+			spec.BuiltinRules = true
+		case "pattern":
+			spec.Patterns = append(spec.Patterns, value)
+		case "min_entropy":
+			spec.MinEntropy, err = strconv.ParseFloat(value, 64)
+		case "min_entropy_length":
+			spec.MinEntropyLength, err = strconv.Atoi(value)
+		case "in":
+			cases = append(cases, redactionCase{in: unescape(value)})
+		case "out":
+			if len(cases) == 0 {
+				t.Fatalf("%s: out %q before any in", path, value)
+			}
+			cases[len(cases)-1].out = unescape(value)
+		default:
+			t.Fatalf("%s: bad line %q", path, line)
+		}
+		if err != nil {
+			t.Fatalf("%s: %q: %s", path, line, err.Error())
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return spec, cases
+}
+
+func TestRedact(t *testing.T) {
+	spec, cases := loadRedactionCases(t)
+	red, err := newRedactor(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range cases {
+		if got := red.redact(tc.in); got != tc.out {
+			t.Errorf("redact(%q) = %q, want %q", tc.in, got, tc.out)
+		}
+	}
+
+	if red, _ := newRedactor(nil, &config.Redaction{}); red != nil {
+		t.Errorf("empty Redaction: got a redactor")
+	}
+}
+
+func TestRedactCombinesSpecs(t *testing.T) {
+	red, err := newRedactor(
+		&config.Redaction{Patterns: []string{`user = (\w+)`}, MinEntropy: 4.5},
+		&config.Redaction{Patterns: []string{`password = (\w+)`}, MinEntropyLength: 32},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := "user = bob password = swordfish tok Zx9Qw3Er7Ty1Ui5Op2As6Df4 Zx9Qw3Er7Ty1Ui5Op2As6Df4Gh8Jk0LmNbVcXz"
+	want := "user = *** password = ********* tok Zx9Qw3Er7Ty1Ui5Op2As6Df4 **************************************"
+	if got := red.redact(in); got != want {
+		t.Errorf("redact(%q) = %q, want %q", in, got, want)
+	}
+}
+
+// builtinRulesRE picks the string literals out of kBuiltinRules.
+var builtinRulesRE = regexp.MustCompile(`(?s)kBuiltinRules\[\] = \{(.*?)\n\};`)
+
+func TestBuiltinRedactionsMatchCodesearch(t *testing.T) {
+	path, err := bazel.Runfile("src/redact.cc")
+	if err != nil {
+		t.Fatalf("runfile: %s", err.Error())
+	}
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := builtinRulesRE.FindSubmatch(src)
+	if m == nil {
+		t.Fatalf("%s: no kBuiltinRules", path)
+	}
+	var rules []string
+	for _, line := range strings.Split(string(m[1]), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rule, err := strconv.Unquote(strings.TrimSuffix(line, ","))
+		if err != nil {
+			t.Fatalf("%s: %s: %s", path, line, err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	if !reflect.DeepEqual(rules, builtinRedactions) {
+		t.Errorf("builtinRedactions differ from kBuiltinRules in %s:\n got %q\nwant %q", path, builtinRedactions, rules)
+	}
+}
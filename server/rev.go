@@ -0,0 +1,51 @@
+package server
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// noVersion is a version pattern that no tree matches, to search
+// nothing when rev: matches no revision.
+const noVersion = `[^\x00-\x{10FFFF}]`
+
+// revVersions returns the versions, in order, of the trees on backends
+// indexed from a revision, such as a branch, that rev matches all of.
+// Trees whose revision isn't known are matched by their version, as
+// are those indexed with -revparse at a commit. Trees indexed for a
+// tag_history are left out; version: searches those.
+func revVersions(backends []*Backend, rev string) []string {
+	re := regexp.MustCompile("^(?:" + rev + ")$")
+	seen := map[string]bool{}
+	for _, bk := range backends {
+		bk.I.Lock()
+		for _, t := range bk.I.Trees {
+			if t.Tag != "" {
+				continue
+			}
+			if t.Branch != "" && re.MatchString(t.Branch) || re.MatchString(t.Version) {
+				seen[t.Version] = true
+			}
+		}
+		bk.I.Unlock()
+	}
+	versions := make([]string, 0, len(seen))
+	for v := range seen {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// versionPattern returns a version: pattern matching exactly versions.
+func versionPattern(versions []string) string {
+	if len(versions) == 0 {
+		return noVersion
+	}
+	quoted := make([]string, len(versions))
+	for i, v := range versions {
+		quoted[i] = regexp.QuoteMeta(v)
+	}
+	return "^(?:" + strings.Join(quoted, "|") + ")$"
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestParseQueryRev(t *testing.T) {
+	_, interp, err := parseQuery("foo rev:release-.*", regexAuto)
+	if err != nil || interp.rev != "release-.*" {
+		t.Errorf("rev = %q, err %v", interp.rev, err)
+	}
+	_, interp, err = parseQuery("foo rev:release-.* regex:no", regexAuto)
+	if err != nil || interp.rev != `release-\.\*` {
+		t.Errorf("regex:no: rev = %q, err %v", interp.rev, err)
+	}
+	if _, _, err := parseQuery("foo rev:main version:v1", regexAuto); err == nil {
+		t.Error("rev: with version: should be an error")
+	}
+	if _, _, err := parseQuery("foo rev:(main", regexAuto); err == nil {
+		t.Error("rev:(main should be an error")
+	}
+}
+
+func TestRevVersions(t *testing.T) {
+	sha1 := "1111111111111111111111111111111111111111"
+	sha2 := "2222222222222222222222222222222222222222"
+	bk := &Backend{Id: "a", I: &I{Trees: []Tree{
+		{Name: "org/api", Version: "main"},
+		{Name: "org/api", Version: "release-2.0"},
+		{Name: "org/web", Version: sha1, Branch: "main"},
+		{Name: "org/web", Version: sha2, Branch: "release-2.1"},
+		{Name: "org/web", Version: "v1.0", Tag: "v1.0"},
+	}}}
+	cases := []struct {
+		rev  string
+		want []string
+	}{
+		{"main", []string{sha1, "main"}},
+		{"release-.*", []string{sha2, "release-2.0"}},
+		{"release", []string{}},
+		{sha2, []string{sha2}},
+		{"v1.0", []string{}},
+	}
+	for _, tc := range cases {
+		if got := revVersions([]*Backend{bk}, tc.rev); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("revVersions(%q) = %v, want %v", tc.rev, got, tc.want)
+		}
+	}
+}
+
+func TestVersionPattern(t *testing.T) {
+	re := regexp.MustCompile(versionPattern([]string{"main", "release-2.0"}))
+	for v, want := range map[string]bool{"main": true, "release-2.0": true, "release-2x0": false, "mainline": false} {
+		if re.MatchString(v) != want {
+			t.Errorf("%q: got %v, want %v", v, !want, want)
+		}
+	}
+	none := regexp.MustCompile(versionPattern(nil))
+	for _, v := range []string{"", "main", "\x00"} {
+		if none.MatchString(v) {
+			t.Errorf("versionPattern(nil) matches %q", v)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+const (
+	defaultSavedPerUser = 100
+	maxSavedName        = 100
+	maxSavedQuery       = 2000
+	// savedIDBytes is how many random bytes a saved search's ID, and so
+	// its short link, holds: 8 characters of base64.
+	savedIDBytes = 6
+)
+
+// A savedStore keeps saved searches. Each is stored whole, as
+// api.SavedSearch, under its ID.
+type savedStore interface {
+	// put saves s, replacing any saved search with its ID.
+	put(s *api.SavedSearch) error
+	// get returns the saved search id, or nil if there is none.
+	get(id string) (*api.SavedSearch, error)
+	// list returns the searches owner has saved, in no order.
+	list(owner string) ([]*api.SavedSearch, error)
+	delete(id string) error
+}
+
+// savedSearches serves signed-in users' saved searches. A nil
+// *savedSearches serves none.
+type savedSearches struct {
+	store   savedStore
+	perUser int
+}
+
+func newSavedSearches(cfg config.SavedSearches, a *auth) (*savedSearches, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if a == nil {
+		return nil, fmt.Errorf("saved searches need auth.mode, to know whose they are")
+	}
+	ss := &savedSearches{perUser: cfg.MaxPerUser}
+	if ss.perUser <= 0 {
+		ss.perUser = defaultSavedPerUser
+	}
+	switch cfg.Store {
+	case "", "bolt":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("the bolt store needs a path")
+		}
+		store, err := openBoltStore(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		ss.store = store
+	case "memory":
+		ss.store = newMemoryStore()
+	default:
+		return nil, fmt.Errorf("unknown store %q (want bolt or memory)", cfg.Store)
+	}
+	return ss, nil
+}
+
+// savedURL returns the search page's URL for s.
+func savedURL(s *api.SavedSearch) string {
+	v := url.Values{}
+	v.Set("q", s.Query)
+	if s.FoldCase != "" {
+		v.Set("fold_case", s.FoldCase)
+	}
+	v.Set("regex", strconv.FormatBool(s.Regex))
+	for _, repo := range s.Repos {
+		v.Add("repo[]", repo)
+	}
+	if s.Path != "" {
+		v.Set("file", s.Path)
+	}
+	p := "/search"
+	if s.Backend != "" {
+		p += "/" + url.PathEscape(s.Backend)
+	}
+	return p + "?" + v.Encode()
+}
+
+func newSavedID() string {
+	b := make([]byte, savedIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("rand.Read: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// savedUser returns the name of the user who made r, replying 401 if no
+// one signed in.
+func savedUser(ctx context.Context, w http.ResponseWriter, r *http.Request) (string, bool) {
+	u := signedInUser(r)
+	if u == nil {
+		writeError(ctx, w, 401, "unauthenticated", "Sign in to save searches")
+		return "", false
+	}
+	return u.Name, true
+}
+
+// ServeSavedList lists the searches the user has saved, newest first
+// (GET /api/v2/saved).
+func (s *server) ServeSavedList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	owner, ok := savedUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	list, err := s.saved.store.list(owner)
+	if err != nil {
+		writeError(ctx, w, 500, "internal_error", err.Error())
+		return
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Created != list[j].Created {
+			return list[i].Created > list[j].Created
+		}
+		return list[i].Name < list[j].Name
+	})
+	for _, ss := range list {
+		ss.URL = "/s/" + ss.ID
+	}
+	if list == nil {
+		list = []*api.SavedSearch{}
+	}
+	replyJSON(ctx, w, 200, &api.SavedSearchList{Searches: list})
+}
+
+// ServeSaveSearch saves the search in the JSON body, an api.SavedSearch
+// of which only the name and the search itself are read (POST
+// /api/v2/saved). Saving under a name the user already has replaces
+// that search, keeping its short link.
+func (s *server) ServeSaveSearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	owner, ok := savedUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	// A form, unlike JSON, can be posted from another site
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		writeError(ctx, w, 415, "bad_request", "Saved searches are posted as application/json")
+		return
+	}
+	var req api.SavedSearch
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(ctx, w, 400, "bad_request", "Parsing the search: "+err.Error())
+		return
+	}
+	if msg := s.checkSaved(&req); msg != "" {
+		writeError(ctx, w, 400, "bad_request", msg)
+		return
+	}
+
+	list, err := s.saved.store.list(owner)
+	if err != nil {
+		writeError(ctx, w, 500, "internal_error", err.Error())
+		return
+	}
+	saved := &api.SavedSearch{
+		Name:     req.Name,
+		Query:    req.Query,
+		FoldCase: req.FoldCase,
+		Regex:    req.Regex,
+		Repos:    req.Repos,
+		Path:     req.Path,
+		Backend:  req.Backend,
+		Owner:    owner,
+		Created:  time.Now().Unix(),
+	}
+	for _, old := range list {
+		if old.Name == req.Name {
+			saved.ID = old.ID
+		}
+	}
+	if saved.ID == "" {
+		if len(list) >= s.saved.perUser {
+			writeError(ctx, w, 409, "too_many_saved",
+				fmt.Sprintf("You can save at most %d searches; delete one first", s.saved.perUser))
+			return
+		}
+		for saved.ID == "" {
+			id := newSavedID()
+			old, err := s.saved.store.get(id)
+			if err != nil {
+				writeError(ctx, w, 500, "internal_error", err.Error())
+				return
+			}
+			if old == nil {
+				saved.ID = id
+			}
+		}
+	}
+	if err := s.saved.store.put(saved); err != nil {
+		writeError(ctx, w, 500, "internal_error", err.Error())
+		return
+	}
+	saved.URL = "/s/" + saved.ID
+	replyJSON(ctx, w, 200, saved)
+}
+
+// checkSaved returns what is wrong with the search req would save, or
+// "" if nothing is.
+func (s *server) checkSaved(req *api.SavedSearch) string {
+	req.Name = strings.TrimSpace(req.Name)
+	switch {
+	case req.Name == "":
+		return "A saved search needs a name"
+	case len(req.Name) > maxSavedName:
+		return fmt.Sprintf("Names are at most %d bytes long", maxSavedName)
+	case strings.TrimSpace(req.Query) == "":
+		return "There is no search to save"
+	case len(req.Query) > maxSavedQuery:
+		return fmt.Sprintf("Saved searches are at most %d bytes long", maxSavedQuery)
+	}
+	switch req.FoldCase {
+	case "", "auto", "true", "false":
+	default:
+		return fmt.Sprintf("fold_case is auto, true or false, not %q", req.FoldCase)
+	}
+	if req.Backend != "" && s.bk[req.Backend] == nil && req.Backend != s.allBackendsKey() {
+		return fmt.Sprintf("Unknown backend: %s", req.Backend)
+	}
+	return ""
+}
+
+// ServeDeleteSaved deletes one of the user's saved searches (DELETE
+// /api/v2/saved/:id).
+func (s *server) ServeDeleteSaved(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	owner, ok := savedUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	id := r.URL.Query().Get(":id")
+	saved, err := s.saved.store.get(id)
+	if err != nil {
+		writeError(ctx, w, 500, "internal_error", err.Error())
+		return
+	}
+	// Someone else's search is as good as missing
+	if saved == nil || saved.Owner != owner {
+		writeError(ctx, w, 404, "not_found", "No such saved search")
+		return
+	}
+	if err := s.saved.store.delete(id); err != nil {
+		writeError(ctx, w, 500, "internal_error", err.Error())
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// ServeSavedLink follows a saved search's short link, /s/:id, to the
+// search page, for anyone who can sign in.
+func (s *server) ServeSavedLink(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	saved, err := s.saved.store.get(r.URL.Query().Get(":id"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if saved == nil {
+		http.Error(w, "No such saved search", 404)
+		return
+	}
+	http.Redirect(w, r, savedURL(saved), 303)
+}
+
+// boltStore keeps saved searches in a BoltDB file, as JSON under their
+// IDs. Listing a user's searches reads every one, which is quick for as
+// many as people save.
+type boltStore struct {
+	db *bolt.DB
+}
+
+var savedBucket = []byte("saved_searches")
+
+func openBoltStore(path string) (*boltStore, error) {
+	// Another frontend holding the file would block us forever
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %s", path, err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(savedBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db}, nil
+}
+
+func (b *boltStore) put(s *api.SavedSearch) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(savedBucket).Put([]byte(s.ID), data)
+	})
+}
+
+func (b *boltStore) get(id string) (*api.SavedSearch, error) {
+	var s *api.SavedSearch
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(savedBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		s = &api.SavedSearch{}
+		return json.Unmarshal(data, s)
+	})
+	return s, err
+}
+
+func (b *boltStore) list(owner string) ([]*api.SavedSearch, error) {
+	var list []*api.SavedSearch
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(savedBucket).ForEach(func(k, v []byte) error {
+			s := &api.SavedSearch{}
+			if err := json.Unmarshal(v, s); err != nil {
+				return fmt.Errorf("saved search %s: %s", k, err.Error())
+			}
+			if s.Owner == owner {
+				list = append(list, s)
+			}
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (b *boltStore) delete(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(savedBucket).Delete([]byte(id))
+	})
+}
+
+// memoryStore keeps saved searches only as long as the frontend runs.
+type memoryStore struct {
+	mu       sync.Mutex
+	searches map[string]api.SavedSearch
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{searches: map[string]api.SavedSearch{}}
+}
+
+func (m *memoryStore) put(s *api.SavedSearch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.searches[s.ID] = *s
+	return nil
+}
+
+func (m *memoryStore) get(id string) (*api.SavedSearch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.searches[id]
+	if !ok {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func (m *memoryStore) list(owner string) ([]*api.SavedSearch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []*api.SavedSearch
+	for _, s := range m.searches {
+		if s.Owner == owner {
+			s := s
+			list = append(list, &s)
+		}
+	}
+	return list, nil
+}
+
+func (m *memoryStore) delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.searches, id)
+	return nil
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/pat"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestNewSavedSearches(t *testing.T) {
+	a, _ := newAuth(config.Auth{Mode: "header"})
+	cases := []struct {
+		name string
+		cfg  config.SavedSearches
+		auth *auth
+	}{
+		{"without auth", config.SavedSearches{Enabled: true, Store: "memory"}, nil},
+		{"bolt without a path", config.SavedSearches{Enabled: true}, a},
+		{"unknown store", config.SavedSearches{Enabled: true, Store: "sqlite"}, a},
+	}
+	for _, tc := range cases {
+		if _, err := newSavedSearches(tc.cfg, tc.auth); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+	if ss, err := newSavedSearches(config.SavedSearches{}, a); ss != nil || err != nil {
+		t.Errorf("disabled: got %v, %v; want nil, nil", ss, err)
+	}
+}
+
+// savedServer returns a handler serving the saved searches of store to
+// users named by X-Forwarded-User.
+func savedServer(t *testing.T, store savedStore, perUser int) http.Handler {
+	a, err := newAuth(config.Auth{Mode: "header"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		bk:    map[string]*Backend{"main": {Id: "main"}},
+		auth:  a,
+		saved: &savedSearches{store: store, perUser: perUser},
+	}
+	m := pat.New()
+	m.Add("GET", "/s/:id", s.Handler(s.ServeSavedLink))
+	m.Add("GET", "/api/v2/saved", s.Handler(s.ServeSavedList))
+	m.Add("POST", "/api/v2/saved", s.Handler(s.ServeSaveSearch))
+	m.Add("DELETE", "/api/v2/saved/:id", s.Handler(s.ServeDeleteSaved))
+	return a.wrap(m)
+}
+
+func savedRequest(h http.Handler, user, method, url, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("X-Forwarded-User", user)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func testSavedSearches(t *testing.T, store savedStore) {
+	h := savedServer(t, store, 2)
+
+	w := savedRequest(h, "alice", "POST", "/api/v2/saved",
+		`{"name": "todo", "q": "TODO", "fold_case": "true", "repos": ["livegrep", "other"], "path": "\\.go$", "backend": "main"}`)
+	if w.Code != 200 {
+		t.Fatalf("saving: status %d: %s", w.Code, w.Body.String())
+	}
+	var saved api.SavedSearch
+	if err := json.NewDecoder(w.Body).Decode(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.ID == "" || saved.URL != "/s/"+saved.ID || saved.Owner != "alice" {
+		t.Errorf("saved %+v", saved)
+	}
+
+	// Saving the name again replaces it under the same link
+	w = savedRequest(h, "alice", "POST", "/api/v2/saved", `{"name": "todo", "q": "TODO|FIXME", "regex": true}`)
+	var again api.SavedSearch
+	json.NewDecoder(w.Body).Decode(&again)
+	if again.ID != saved.ID || again.Query != "TODO|FIXME" {
+		t.Errorf("saved again %+v, want ID %s", again, saved.ID)
+	}
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"name": "", "q": "x"}`, 400},
+		{`{"name": "x", "q": " "}`, 400},
+		{`{"name": "x", "q": "x", "fold_case": "y"}`, 400},
+		{`{"name": "x", "q": "x", "backend": "no"}`, 400},
+		{`{"name": "x"`, 400},
+		{`{"name": "fixme", "q": "FIXME"}`, 200},
+		{`{"name": "xxx", "q": "XXX"}`, 409},
+	} {
+		if w := savedRequest(h, "alice", "POST", "/api/v2/saved", tc.body); w.Code != tc.want {
+			t.Errorf("saving %s: status %d, want %d", tc.body, w.Code, tc.want)
+		}
+	}
+	req := httptest.NewRequest("POST", "/api/v2/saved", strings.NewReader("name=x&q=x"))
+	req.Header.Set("X-Forwarded-User", "alice")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 415 {
+		t.Errorf("saving a form: status %d", w.Code)
+	}
+
+	var list api.SavedSearchList
+	json.NewDecoder(savedRequest(h, "alice", "GET", "/api/v2/saved", "").Body).Decode(&list)
+	if len(list.Searches) != 2 {
+		t.Errorf("alice's searches: %+v", list.Searches)
+	}
+	w = savedRequest(h, "bob", "GET", "/api/v2/saved", "")
+	if !strings.Contains(w.Body.String(), `"searches":[]`) {
+		t.Errorf("bob's searches: %s", w.Body.String())
+	}
+
+	// Anyone can follow the link, but only its owner can delete it
+	w = savedRequest(h, "bob", "GET", "/s/"+saved.ID, "")
+	if want := "/search?q=TODO%7CFIXME&regex=true"; w.Code != 303 || w.Header().Get("Location") != want {
+		t.Errorf("following the link: %d to %s, want %s", w.Code, w.Header().Get("Location"), want)
+	}
+	if w := savedRequest(h, "bob", "DELETE", "/api/v2/saved/"+saved.ID, ""); w.Code != 404 {
+		t.Errorf("deleting someone else's search: status %d", w.Code)
+	}
+	if w := savedRequest(h, "alice", "DELETE", "/api/v2/saved/"+saved.ID, ""); w.Code != 204 {
+		t.Errorf("deleting: status %d", w.Code)
+	}
+	if w := savedRequest(h, "bob", "GET", "/s/"+saved.ID, ""); w.Code != 404 {
+		t.Errorf("following a deleted link: status %d", w.Code)
+	}
+}
+
+func TestSavedSearchesMemory(t *testing.T) {
+	testSavedSearches(t, newMemoryStore())
+}
+
+func TestSavedSearchesBolt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "saved.db")
+	store, err := openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSavedSearches(t, store)
+
+	if err := store.put(&api.SavedSearch{ID: "abc", Name: "kept", Query: "x", Owner: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	store.db.Close()
+	if store, err = openBoltStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.db.Close()
+	if s, err := store.get("abc"); err != nil || s == nil || s.Name != "kept" {
+		t.Errorf("after reopening: %+v, %v", s, err)
+	}
+}
+
+func TestSavedURL(t *testing.T) {
+	s := &api.SavedSearch{Query: "foo bar", FoldCase: "auto", Repos: []string{"a/b"}, Path: "_test.go", Backend: "x,y"}
+	if got, want := savedURL(s), "/search/x%2Cy?file=_test.go&fold_case=auto&q=foo+bar&regex=false&repo%5B%5D=a%2Fb"; got != want {
+		t.Errorf("savedURL = %s, want %s", got, want)
+	}
+}
@@ -9,15 +9,20 @@ import (
 	"path"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	texttemplate "text/template"
 	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 
 	"github.com/bmizerany/pat"
 	libhoney "github.com/honeycombio/libhoney-go"
+	"gopkg.in/alexcesaro/statsd.v2"
 
+	"github.com/livegrep/livegrep/pkg/sentry"
 	"github.com/livegrep/livegrep/server/config"
 	"github.com/livegrep/livegrep/server/log"
 	"github.com/livegrep/livegrep/server/reqid"
@@ -42,13 +47,24 @@ type server struct {
 	bk          map[string]*Backend
 	bkOrder     []string
 	repos       map[string]config.RepoConfig
+	redactors   map[string]*redactor
 	inner       http.Handler
 	Templates   map[string]*template.Template
 	OpenSearch  *texttemplate.Template
 	AssetHashes map[string]string
 	Layout      *template.Template
 
-	honey *libhoney.Builder
+	honey     *libhoney.Builder
+	statsd    *statsd.Client
+	prom      *promMetrics
+	audit     *auditLog
+	analytics *analytics
+	features  *features
+	auth      *auth
+	finder    *fileFinder
+	blame     *blameCache
+	saved     *savedSearches
+	limiter   *rateLimiter
 
 	serveFilePathRegex *regexp.Regexp
 }
@@ -81,14 +97,27 @@ func (s *server) ServeRoot(ctx context.Context, w http.ResponseWriter, r *http.R
 }
 
 type searchScriptData struct {
-	RepoUrls           map[string]map[string]string `json:"repo_urls"`
+	RepoUrls map[string]map[string]string `json:"repo_urls"`
+	// The link_revision of each tree on each backend that sets one.
+	LinkRevisions      map[string]map[string]string `json:"link_revisions"`
 	InternalViewRepos  map[string]config.RepoConfig `json:"internal_view_repos"`
 	DefaultSearchRepos []string                     `json:"default_search_repos"`
 	LinkConfigs        []config.LinkConfig          `json:"link_configs"`
+	// The tags indexed on each backend, latest first, for the version
+	// selector.
+	Versions map[string][]string `json:"versions"`
+	// The feature flags that are on for this user.
+	Features []string `json:"features"`
+	// What the "active repos only" option passes as active:.
+	ActiveWindow string `json:"active_window"`
+	// Whether the user may save searches.
+	SavedSearches bool `json:"saved_searches"`
 }
 
-func (s *server) makeSearchScriptData() (script_data *searchScriptData, backends []*Backend, sampleRepo string) {
+func (s *server) makeSearchScriptData(r *http.Request) (script_data *searchScriptData, backends []*Backend, sampleRepo string) {
 	urls := make(map[string]map[string]string, len(s.bk))
+	linkRevisions := make(map[string]map[string]string, len(s.bk))
+	versions := make(map[string][]string, len(s.bk))
 	backends = make([]*Backend, 0, len(s.bk))
 	sampleRepo = ""
 	for _, bkId := range s.bkOrder {
@@ -97,29 +126,138 @@ func (s *server) makeSearchScriptData() (script_data *searchScriptData, backends
 		bk.I.Lock()
 		m := make(map[string]string, len(bk.I.Trees))
 		urls[bk.Id] = m
-		for _, r := range bk.I.Trees {
+		lr := map[string]string{}
+		linkRevisions[bk.Id] = lr
+		tags := map[string]bool{}
+		for _, t := range bk.I.Trees {
+			if !s.auth.canSee(r, t.Name) {
+				continue
+			}
 			if sampleRepo == "" {
-				sampleRepo = r.Name
+				sampleRepo = t.Name
+			}
+			m[t.Name] = t.Url
+			if t.LinkRevision != "" {
+				lr[t.Name] = t.LinkRevision
+			}
+			if t.Tag != "" && !tags[t.Tag] {
+				tags[t.Tag] = true
+				versions[bk.Id] = append(versions[bk.Id], t.Tag)
 			}
-			m[r.Name] = r.Url
 		}
 		bk.I.Unlock()
+		sort.Slice(versions[bk.Id], func(i, j int) bool {
+			return versionLess(versions[bk.Id][j], versions[bk.Id][i])
+		})
 	}
 
-	script_data = &searchScriptData{urls, s.repos, s.config.DefaultSearchRepos, s.config.LinkConfigs}
+	if key := s.allBackendsKey(); key != "" {
+		urls[key], linkRevisions[key], versions[key] = allBackendsData(s.bkOrder, urls, linkRevisions, versions)
+	}
+
+	viewRepos, defaultRepos := s.repos, s.config.DefaultSearchRepos
+	if s.auth != nil {
+		viewRepos = make(map[string]config.RepoConfig, len(s.repos))
+		for name, repo := range s.repos {
+			if s.auth.canSee(r, name) {
+				viewRepos[name] = repo
+			}
+		}
+		defaultRepos = nil
+		for _, name := range s.config.DefaultSearchRepos {
+			if s.auth.canSee(r, name) {
+				defaultRepos = append(defaultRepos, name)
+			}
+		}
+	}
+
+	script_data = &searchScriptData{urls, linkRevisions, viewRepos, defaultRepos, s.config.LinkConfigs, versions, s.features.enabledFor(r), s.activeWindow(), s.saved != nil}
 
 	return script_data, backends, sampleRepo
 }
 
+// allBackendsKey returns the backend the search page's "All indexes"
+// choice searches, the ids of every backend separated by commas, which
+// /search/ and /api/v1/search/ take as a search of all of them; or ""
+// if it isn't offered.
+func (s *server) allBackendsKey() string {
+	if !s.config.SearchAllBackends || len(s.bkOrder) < 2 {
+		return ""
+	}
+	return strings.Join(s.bkOrder, ",")
+}
+
+// allBackendsData merges the repository URLs, link revisions and
+// versions of the backends in order into those of "All indexes", so
+// that its repository and version selectors list those of every
+// backend. A repository on more than one backend takes the first's.
+func allBackendsData(order []string, urls, linkRevisions map[string]map[string]string, versions map[string][]string) (map[string]string, map[string]string, []string) {
+	allUrls, allRevisions := map[string]string{}, map[string]string{}
+	var allVersions []string
+	seen := map[string]bool{}
+	for _, id := range order {
+		for name, url := range urls[id] {
+			if _, ok := allUrls[name]; !ok {
+				allUrls[name] = url
+			}
+		}
+		for name, rev := range linkRevisions[id] {
+			if _, ok := allRevisions[name]; !ok {
+				allRevisions[name] = rev
+			}
+		}
+		for _, v := range versions[id] {
+			if !seen[v] {
+				seen[v] = true
+				allVersions = append(allVersions, v)
+			}
+		}
+	}
+	sort.Slice(allVersions, func(i, j int) bool {
+		return versionLess(allVersions[j], allVersions[i])
+	})
+	return allUrls, allRevisions, allVersions
+}
+
+// versionLess orders version strings like "v1.9" before "v1.10",
+// comparing runs of digits numerically.
+func versionLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if da != "" && db != "" {
+			na, _ := strconv.ParseUint(da, 10, 64)
+			nb, _ := strconv.ParseUint(db, 10, 64)
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
 // Serve the page initialization data that is usually injected into the index.html go text template.
 // This is useful in a custom frontend to initialize a repo list, links to GitHub, etc.
 func (s *server) ServeRepoInfo(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	script_data, _, _ := s.makeSearchScriptData()
+	script_data, _, _ := s.makeSearchScriptData(r)
 	replyJSON(ctx, w, 200, script_data)
 }
 
 func (s *server) ServeSearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	script_data, backends, sampleRepo := s.makeSearchScriptData()
+	script_data, backends, sampleRepo := s.makeSearchScriptData(r)
 
 	s.renderPage(ctx, w, r, "index.html", &page{
 		Title:         "code search",
@@ -127,25 +265,37 @@ func (s *server) ServeSearch(ctx context.Context, w http.ResponseWriter, r *http
 		ScriptData:    script_data,
 		IncludeHeader: true,
 		Data: struct {
-			Backends   []*Backend
-			SampleRepo string
+			Backends    []*Backend
+			AllBackends string
+			SampleRepo  string
 		}{
-			Backends:   backends,
-			SampleRepo: sampleRepo,
+			Backends:    backends,
+			AllBackends: s.allBackendsKey(),
+			SampleRepo:  sampleRepo,
 		},
 	})
 }
 
 func (s *server) ServeFile(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if len(s.repos) > 0 {
+		tail := pat.Tail("/view/", r.URL.Path)
+		if tail == "" {
+			s.serveRepoList(ctx, w, r)
+			return
+		}
+		if _, ok := s.repos[tail]; ok {
+			http.Redirect(w, r, "/view/"+tail+"/", http.StatusMovedPermanently)
+			return
+		}
+	}
 	repoName, path, err := getRepoPathFromURL(s.serveFilePathRegex, r.URL.Path)
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
-
-	commit := r.URL.Query().Get("commit")
-	if commit == "" {
-		commit = "HEAD"
+	if !s.auth.canSee(r, repoName) {
+		http.Error(w, "No such repo", 404)
+		return
 	}
 
 	if len(s.repos) == 0 {
@@ -159,17 +309,32 @@ func (s *server) ServeFile(ctx context.Context, w http.ResponseWriter, r *http.R
 		return
 	}
 
-	data, err := buildFileData(path, repo, commit)
+	// By default, files are shown as they were indexed, so that they
+	// match what searches found in them
+	commit := r.URL.Query().Get("commit")
+	if commit == "" {
+		commit = "HEAD"
+		if c := s.indexedCommit(repoName); c != "" {
+			if t, err := gitObjectType(c, repo.Path); err == nil && t == "commit" {
+				commit = c
+			}
+		}
+	}
+
+	data, err := buildFileData(path, repo, commit, s.redactors[repoName])
 	if err != nil {
 		http.Error(w, "Error reading file: "+err.Error(), 500)
 		return
 	}
+	s.analytics.recordView(repoName, path)
 
 	script_data := &struct {
-		RepoInfo config.RepoConfig `json:"repo_info"`
-		FilePath string            `json:"file_path"`
-		Commit   string            `json:"commit"`
-	}{repo, path, commit}
+		RepoInfo   config.RepoConfig `json:"repo_info"`
+		FilePath   string            `json:"file_path"`
+		Commit     string            `json:"commit"`
+		CommitHash string            `json:"commit_hash"`
+		IsFile     bool              `json:"is_file"`
+	}{repo, path, commit, data.CommitHash, data.FileContent != nil}
 
 	s.renderPage(ctx, w, r, "fileview.html", &page{
 		Title:         data.PathSegments[len(data.PathSegments)-1].Name,
@@ -180,6 +345,57 @@ func (s *server) ServeFile(ctx context.Context, w http.ResponseWriter, r *http.R
 	})
 }
 
+// indexedCommit returns the commit the first backend with the
+// repository called name indexed it at, or "" if that isn't known.
+func (s *server) indexedCommit(name string) string {
+	for _, id := range s.bkOrder {
+		bk := s.bk[id]
+		bk.I.Lock()
+		for _, t := range bk.I.Trees {
+			if t.Name != name || t.Tag != "" {
+				continue
+			}
+			commit := t.Commit
+			if commit == "" && commitRE.MatchString(t.Version) {
+				commit = t.Version
+			}
+			if commit != "" {
+				bk.I.Unlock()
+				return commit
+			}
+		}
+		bk.I.Unlock()
+	}
+	return ""
+}
+
+// repoListEntry is a repository in the file viewer's list of them.
+type repoListEntry struct {
+	Name string
+	Path string
+	// The commit it was indexed at, if that is known
+	Commit string
+}
+
+// serveRepoList lists the repositories whose files can be browsed, for
+// /view/.
+func (s *server) serveRepoList(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var repos []repoListEntry
+	for name := range s.repos {
+		if !s.auth.canSee(r, name) {
+			continue
+		}
+		repos = append(repos, repoListEntry{Name: name, Path: viewUrl(name, ""), Commit: s.indexedCommit(name)})
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+
+	s.renderPage(ctx, w, r, "repos.html", &page{
+		Title:         "repositories",
+		IncludeHeader: true,
+		Data:          repos,
+	})
+}
+
 func (s *server) ServeAbout(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	s.renderPage(ctx, w, r, "about.html", &page{
 		Title:         "about",
@@ -187,6 +403,16 @@ func (s *server) ServeAbout(ctx context.Context, w http.ResponseWriter, r *http.
 	})
 }
 
+// ServeAdminStats serves the page showing /api/v2/stats, which asks for
+// the admin token to fetch them with.
+func (s *server) ServeAdminStats(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	s.renderPage(ctx, w, r, "stats.html", &page{
+		Title:         "search statistics",
+		ScriptName:    "stats",
+		IncludeHeader: true,
+	})
+}
+
 func (s *server) ServeHelp(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	// Help is now shown in the main search page when no search has been entered.
 	http.Redirect(w, r, "/search", 303)
@@ -199,7 +425,7 @@ func (s *server) ServeHealthcheck(w http.ResponseWriter, r *http.Request) {
 	// it.
 	for _, bk := range s.bk {
 		if bk.I.IndexTime.IsZero() {
-			http.Error(w, fmt.Sprintf("unhealthy backend '%s' '%s'\n", bk.Id, bk.Addr), 500)
+			http.Error(w, fmt.Sprintf("unhealthy backend '%s' '%s'\n", bk.Id, bk.Addr()), 500)
 			return
 		}
 	}
@@ -259,7 +485,7 @@ func (s *server) ServeOpensearch(ctx context.Context, w http.ResponseWriter, r *
 	w.Header().Set("Content-Type", "application/xml")
 	err := s.OpenSearch.ExecuteTemplate(w, templateName, data)
 	if err != nil {
-		log.Printf(ctx, "Error rendering %s: %s", templateName, err)
+		log.FromContext(ctx).Errorf("Error rendering %s: %s", templateName, err)
 		return
 	}
 }
@@ -267,7 +493,7 @@ func (s *server) ServeOpensearch(ctx context.Context, w http.ResponseWriter, r *
 func (s *server) renderPage(ctx context.Context, w io.Writer, r *http.Request, templateName string, pageData *page) {
 	t, ok := s.Templates[templateName]
 	if !ok {
-		log.Printf(ctx, "Error: no template named %v", templateName)
+		log.FromContext(ctx).Errorf("no template named %v", templateName)
 		return
 	}
 
@@ -282,7 +508,7 @@ func (s *server) renderPage(ctx context.Context, w io.Writer, r *http.Request, t
 
 	err := t.ExecuteTemplate(w, templateName, pageData)
 	if err != nil {
-		log.Printf(ctx, "Error rendering %v: %s", templateName, err)
+		log.FromContext(ctx).Errorf("Error rendering %v: %s", templateName, err)
 		return
 	}
 }
@@ -305,9 +531,17 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
 	defer cancel()
-	ctx = reqid.NewContext(ctx, reqid.New())
-	log.Printf(ctx, "http request: remote=%q method=%q url=%q",
-		r.RemoteAddr, r.Method, r.URL)
+	id := reqid.New()
+	ctx = reqid.NewContext(ctx, id)
+	log.FromContext(ctx).With("remote", r.RemoteAddr, "method", r.Method, "url", r.URL.String()).Infof(
+		"http request: remote=%q method=%q url=%q", r.RemoteAddr, r.Method, r.URL)
+	defer func() {
+		// net/http recovers the panic and logs it; report it first.
+		if p := recover(); p != nil {
+			sentry.ReportPanic(p, "request_id", string(id), "url", r.URL.String())
+			panic(p)
+		}
+	}()
 	h(ctx, w, r)
 }
 
@@ -317,9 +551,10 @@ func (s *server) Handler(f func(c context.Context, w http.ResponseWriter, r *htt
 
 func New(cfg *config.Config) (http.Handler, error) {
 	srv := &server{
-		config: cfg,
-		bk:     make(map[string]*Backend),
-		repos:  make(map[string]config.RepoConfig),
+		config:    cfg,
+		bk:        make(map[string]*Backend),
+		repos:     make(map[string]config.RepoConfig),
+		redactors: make(map[string]*redactor),
 	}
 	srv.loadTemplates()
 
@@ -331,6 +566,40 @@ func New(cfg *config.Config) (http.Handler, error) {
 		srv.honey.Dataset = cfg.Honeycomb.Dataset
 	}
 
+	var err error
+	if cfg.StatsD.Address != "" {
+		log.Printf(context.Background(),
+			"Sending metrics to statsd address=%s", cfg.StatsD.Address)
+		if srv.statsd, err = newStatsd(cfg.StatsD); err != nil {
+			return nil, fmt.Errorf("statsd: %s", err.Error())
+		}
+	}
+	if cfg.Prometheus.Enabled {
+		srv.prom = newPromMetrics()
+	}
+
+	if srv.audit, err = newAuditLog(cfg.AuditLog); err != nil {
+		return nil, fmt.Errorf("audit log: %s", err.Error())
+	}
+	if srv.analytics, err = newAnalytics(cfg.Analytics); err != nil {
+		return nil, fmt.Errorf("analytics: %s", err.Error())
+	}
+	if srv.features, err = newFeatures(cfg.Features); err != nil {
+		return nil, fmt.Errorf("features: %s", err.Error())
+	}
+	if srv.auth, err = newAuth(cfg.Auth); err != nil {
+		return nil, fmt.Errorf("auth: %s", err.Error())
+	}
+	if srv.saved, err = newSavedSearches(cfg.SavedSearches, srv.auth); err != nil {
+		return nil, fmt.Errorf("saved_searches: %s", err.Error())
+	}
+	if srv.limiter, err = newRateLimiter(cfg.RateLimit); err != nil {
+		return nil, fmt.Errorf("rate_limit: %s", err.Error())
+	}
+	if _, err := parseAge(srv.activeWindow()); err != nil {
+		return nil, fmt.Errorf("active_window: %s", err.Error())
+	}
+
 	dialOpts := []grpc.DialOption{}
 	callOpts := []grpc.CallOption{}
 	if cfg.GrpcMaxRecvMessageSize != 0 {
@@ -342,22 +611,109 @@ func New(cfg *config.Config) (http.Handler, error) {
 	if len(callOpts) > 0 {
 		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(callOpts...))
 	}
+	if cfg.GrpcKeepaliveTimeMs > 0 {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                time.Duration(cfg.GrpcKeepaliveTimeMs) * time.Millisecond,
+			Timeout:             time.Duration(cfg.GrpcKeepaliveTimeoutMs) * time.Millisecond,
+			PermitWithoutStream: true,
+		}))
+	}
+	if cfg.GrpcMaxBackoffMs > 0 {
+		dialOpts = append(dialOpts, grpc.WithBackoffMaxDelay(time.Duration(cfg.GrpcMaxBackoffMs)*time.Millisecond))
+	}
 
 	for _, bk := range srv.config.Backends {
-		be, e := NewBackend(bk.Id, bk.Addr, dialOpts...)
+		if len(bk.Shards) > 0 {
+			if bk.Addr != "" || bk.Run != nil || bk.Canary.Addr != "" || bk.Shadow.Addr != "" {
+				return nil, fmt.Errorf("%s: a backend with shards can't have an addr, run, canary or shadow", bk.Id)
+			}
+			var shards []*Backend
+			for i, sh := range bk.Shards {
+				shard, e := NewBackend(shardId(bk.Id, i), sh.Addr, cfg.GrpcConnections, dialOpts...)
+				if e != nil {
+					return nil, e
+				}
+				shard.breaker = newBreaker(shard.Id, cfg.CircuitBreaker)
+				shards = append(shards, shard)
+			}
+			be := newShardedBackend(bk.Id, shards)
+			be.searchTimeout = time.Duration(bk.SearchTimeoutMs) * time.Millisecond
+			be.Start()
+			log.Printf(context.Background(), "Searching %s across %d shards", bk.Id, len(shards))
+			srv.bk[be.Id] = be
+			srv.bkOrder = append(srv.bkOrder, be.Id)
+			continue
+		}
+
+		be, e := NewBackend(bk.Id, bk.Addr, cfg.GrpcConnections, dialOpts...)
 		if e != nil {
 			return nil, e
 		}
+		be.searchTimeout = time.Duration(bk.SearchTimeoutMs) * time.Millisecond
+		if bk.Run != nil {
+			sv, e := newSupervisor(be, bk.Addr, *bk.Run)
+			if e != nil {
+				return nil, e
+			}
+			sv.Start()
+		}
+		be.breaker = newBreaker(be.Id, cfg.CircuitBreaker)
 		be.Start()
+		if bk.Canary.Addr != "" {
+			if bk.Canary.Percent < 0 || bk.Canary.Percent > 100 {
+				return nil, fmt.Errorf("%s: canary percent must be between 0 and 100", bk.Id)
+			}
+			canary, e := NewBackend(bk.Id+"-canary", bk.Canary.Addr, cfg.GrpcConnections, dialOpts...)
+			if e != nil {
+				return nil, e
+			}
+			canary.breaker = newBreaker(canary.Id, cfg.CircuitBreaker)
+			canary.Start()
+			be.canary, be.canaryPercent = canary, bk.Canary.Percent
+			log.Printf(context.Background(), "Sending %d%% of searches of %s to canary addr=%s",
+				bk.Canary.Percent, bk.Id, bk.Canary.Addr)
+		}
+		if bk.Shadow.Addr != "" {
+			percent := bk.Shadow.Percent
+			if percent == 0 {
+				percent = 100
+			}
+			if percent < 0 || percent > 100 {
+				return nil, fmt.Errorf("%s: shadow percent must be between 1 and 100", bk.Id)
+			}
+			shadow, e := NewBackend(bk.Id+"-shadow", bk.Shadow.Addr, cfg.GrpcConnections, dialOpts...)
+			if e != nil {
+				return nil, e
+			}
+			shadow.breaker = newBreaker(shadow.Id, cfg.CircuitBreaker)
+			shadow.Start()
+			be.shadow, be.shadowPercent = shadow, percent
+			be.shadowSlots = make(chan struct{}, shadowConcurrency)
+			log.Printf(context.Background(), "Repeating %d%% of searches of %s on shadow addr=%s",
+				percent, bk.Id, bk.Shadow.Addr)
+		}
 		srv.bk[be.Id] = be
 		srv.bkOrder = append(srv.bkOrder, be.Id)
 	}
 
 	var repoNames []string
 	for _, r := range srv.config.IndexConfig.Repositories {
+		if len(r.Encodings) == 0 {
+			r.Encodings = srv.config.IndexConfig.Encodings
+		}
+		red, err := newRedactor(srv.config.IndexConfig.Redaction, r.Redaction)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", r.Name, err.Error())
+		}
 		srv.repos[r.Name] = r
+		srv.redactors[r.Name] = red
 		repoNames = append(repoNames, r.Name)
 	}
+	if len(srv.repos) > 0 {
+		srv.finder = newFileFinder(srv.repos)
+		go srv.finder.run()
+		srv.blame = newBlameCache(blameCacheEntries)
+	}
 
 	for ext, lang := range srv.config.FileExtToLang {
 		extToLangMap[ext] = lang
@@ -379,28 +735,79 @@ func New(cfg *config.Config) (http.Handler, error) {
 
 	m := pat.New()
 	m.Add("GET", "/debug/healthcheck", http.HandlerFunc(srv.ServeHealthcheck))
+	m.Add("GET", "/healthz", http.HandlerFunc(srv.ServeHealthz))
+	m.Add("GET", "/readyz", http.HandlerFunc(srv.ServeReadyz))
 	m.Add("GET", "/debug/stats", srv.Handler(srv.ServeStats))
+	if srv.prom != nil {
+		m.Add("GET", "/metrics", srv.prom.registry)
+	}
 	m.Add("GET", "/search/:backend", srv.Handler(srv.ServeSearch))
 	m.Add("GET", "/search/", srv.Handler(srv.ServeSearch))
 	m.Add("GET", "/view/", srv.Handler(srv.ServeFile))
+	m.Add("GET", "/definition", srv.Handler(srv.limited(srv.ServeDefinition)))
+	m.Add("GET", "/diff/:from/:to", srv.Handler(srv.limited(srv.ServeDiff)))
 	m.Add("GET", "/about", srv.Handler(srv.ServeAbout))
 	m.Add("GET", "/help", srv.Handler(srv.ServeHelp))
 	m.Add("GET", "/opensearch.xml", srv.Handler(srv.ServeOpensearch))
+	if cfg.Embed.Enabled {
+		m.Add("GET", "/embed", srv.Handler(srv.ServeEmbed))
+	}
+	if srv.saved != nil {
+		m.Add("GET", "/s/:id", srv.Handler(srv.ServeSavedLink))
+	}
 	m.Add("GET", "/", srv.Handler(srv.ServeRoot))
 
 	// GET (with query parameters) is for backward compatibility; the UI now
 	// uses POST (with form parameters).
-	m.Add("GET", "/api/v1/search/:backend", srv.Handler(srv.ServeAPISearch))
-	m.Add("GET", "/api/v1/search/", srv.Handler(srv.ServeAPISearch))
-	m.Add("POST", "/api/v1/search/:backend", srv.Handler(srv.ServeAPISearch))
-	m.Add("POST", "/api/v1/search/", srv.Handler(srv.ServeAPISearch))
+	search := srv.Handler(srv.limited(srv.ServeAPISearch))
+	if cfg.Embed.Enabled {
+		search = srv.cors(search)
+		m.Add("OPTIONS", "/api/v1/search/:backend", search)
+		m.Add("OPTIONS", "/api/v1/search/", search)
+	}
+	m.Add("GET", "/api/v1/search/:backend", search)
+	m.Add("GET", "/api/v1/search/", search)
+	m.Add("POST", "/api/v1/search/:backend", search)
+	m.Add("POST", "/api/v1/search/", search)
+	searchV2 := srv.Handler(srv.limited(srv.ServeAPISearchV2))
+	if cfg.Embed.Enabled {
+		searchV2 = srv.cors(searchV2)
+		m.Add("OPTIONS", "/api/v2/search/:backend", searchV2)
+		m.Add("OPTIONS", "/api/v2/search/", searchV2)
+	}
+	m.Add("GET", "/api/v2/search/:backend", searchV2)
+	m.Add("GET", "/api/v2/search/", searchV2)
+	m.Add("POST", "/api/v2/search/:backend", searchV2)
+	m.Add("POST", "/api/v2/search/", searchV2)
+	m.Add("GET", "/api/v2/files", srv.Handler(srv.ServeAPIFiles))
+	m.Add("GET", "/api/v2/blame", srv.Handler(srv.limited(srv.ServeAPIBlame)))
+	m.Add("GET", "/api/v2/history", srv.Handler(srv.limited(srv.ServeAPIHistory)))
+	m.Add("GET", "/api/v2/index-info", srv.Handler(srv.ServeAPIIndexInfo))
+	if srv.saved != nil {
+		m.Add("GET", "/api/v2/saved", srv.Handler(srv.ServeSavedList))
+		m.Add("POST", "/api/v2/saved", srv.Handler(srv.ServeSaveSearch))
+		m.Add("DELETE", "/api/v2/saved/:id", srv.Handler(srv.ServeDeleteSaved))
+	}
 	m.Add("GET", "/api/v1/repos", srv.Handler(srv.ServeRepoInfo))
+	apiDiff := srv.Handler(srv.limited(srv.ServeAPIDiff))
+	m.Add("GET", "/api/v1/diff/:from/:to", apiDiff)
+	m.Add("POST", "/api/v1/diff/:from/:to", apiDiff)
+	if cfg.AdminToken != "" {
+		m.Add("POST", "/api/v1/admin/backends/:backend/reload", srv.Handler(srv.ServeReloadBackend))
+		m.Add("POST", "/api/v1/admin/backends/:backend", srv.Handler(srv.ServeSetBackend))
+		m.Add("GET", "/api/admin/analytics", srv.Handler(srv.ServeAnalytics))
+		m.Add("GET", "/api/v2/stats", srv.Handler(srv.ServeAnalytics))
+		m.Add("GET", "/admin/stats", srv.Handler(srv.ServeAdminStats))
+	}
+
+	srv.auth.register(m)
 
 	var h http.Handler = m
 
 	if cfg.Reload {
 		h = &reloadHandler{srv, h}
 	}
+	h = srv.auth.wrap(h)
 
 	mux := http.NewServeMux()
 	mux.Handle("/assets/", http.FileServer(http.Dir(path.Join(cfg.DocRoot, "htdocs"))))
@@ -1,11 +1,22 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/bazelbuild/rules_go/go/tools/bazel"
+	"github.com/livegrep/livegrep/server/api"
 	"github.com/livegrep/livegrep/server/config"
+	configpb "github.com/livegrep/livegrep/src/proto/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
 )
 
 func assertRepoPath(t *testing.T,
@@ -54,3 +65,283 @@ func TestTemplatesLoad(t *testing.T) {
 	}}
 	srv.loadTemplates()
 }
+
+func TestSetBackendAuth(t *testing.T) {
+	srv := &server{
+		config: &config.Config{AdminToken: "s3cret"},
+		bk:     map[string]*Backend{},
+	}
+	cases := []struct {
+		auth   string
+		status int
+	}{
+		{"", 401},
+		{"Bearer wrong", 401},
+		{"s3cret", 401},
+		// Authorized, but there is no such backend.
+		{"Bearer s3cret", 400},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("POST", "/api/v1/admin/backends/?:backend=nope",
+			strings.NewReader("addr=localhost:1"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeSetBackend(context.Background(), w, req)
+		if w.Code != tc.status {
+			t.Errorf("Authorization %q: got status %d, want %d", tc.auth, w.Code, tc.status)
+		}
+	}
+}
+
+func TestReloadBackendAuth(t *testing.T) {
+	srv := &server{
+		config: &config.Config{AdminToken: "s3cret"},
+		bk:     map[string]*Backend{},
+	}
+	for auth, status := range map[string]int{"": 401, "Bearer wrong": 401, "Bearer s3cret": 400} {
+		req := httptest.NewRequest("POST", "/api/v1/admin/backends/nope/reload?:backend=nope", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeReloadBackend(context.Background(), w, req)
+		if w.Code != status {
+			t.Errorf("Authorization %q: got status %d, want %d", auth, w.Code, status)
+		}
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	bk, err := NewBackend("down", "localhost:1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"down": bk},
+		bkOrder: []string{"down"},
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != 503 {
+		t.Errorf("got status %d, want 503", w.Code)
+	}
+	var got readiness
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Ready || len(got.Backends) != 1 || got.Backends[0].Id != "down" || got.Backends[0].Error == "" {
+		t.Errorf("got %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 200 {
+		t.Errorf("/healthz: got status %d, want 200", w.Code)
+	}
+}
+
+func TestReadyzIndexAge(t *testing.T) {
+	srv := &server{config: &config.Config{MaxIndexAgeHours: 24}}
+	now := time.Unix(1700000000, 0)
+	if ok, why := srv.fresh(now.Add(-23*time.Hour), now); !ok {
+		t.Errorf("an index 23h old isn't fresh: %s", why)
+	}
+	if ok, why := srv.fresh(now.Add(-25*time.Hour), now); ok || !strings.Contains(why, "25h0m0s old") {
+		t.Errorf("an index 25h old: fresh = %v, %q", ok, why)
+	}
+	if ok, _ := srv.fresh(time.Time{}, now); !ok {
+		t.Error("an index of unknown age isn't fresh")
+	}
+	srv.config.MaxIndexAgeHours = 0
+	if ok, _ := srv.fresh(now.Add(-1000*time.Hour), now); !ok {
+		t.Error("an old index isn't fresh without max_index_age_hours")
+	}
+}
+
+func TestIndexInfo(t *testing.T) {
+	indexed := time.Unix(1700000000, 0)
+	commit := strings.Repeat("a", 40)
+	up := &Backend{Id: "up", I: &I{
+		Name:      "main",
+		IndexTime: indexed,
+		Trees: []Tree{
+			{Name: "org/b", Version: "main", Commit: commit, CommitTime: indexed.Add(-time.Hour)},
+			{Name: "org/a", Version: commit},
+			{Name: "org/a", Version: "v1.0", Tag: "v1.0", IndexedAt: indexed.Add(-time.Minute)},
+		},
+	}}
+	up.noteInfo(nil)
+	down := &Backend{Id: "down", I: &I{Name: "down"}}
+	down.noteInfo(errors.New("connection refused"))
+	srv := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"up": up, "down": down},
+		bkOrder: []string{"up", "down"},
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeAPIIndexInfo(context.Background(), w, httptest.NewRequest("GET", "/api/v2/index-info", nil))
+	if w.Code != 200 {
+		t.Fatalf("got status %d", w.Code)
+	}
+	var got api.IndexInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Backends) != 2 {
+		t.Fatalf("got %d backends, want 2", len(got.Backends))
+	}
+	b := got.Backends[0]
+	if b.ID != "up" || !b.Connected || b.IndexName != "main" || b.IndexTime != indexed.Unix() || b.AgeSeconds <= 0 || b.RepoCount != 2 {
+		t.Errorf("up: got %+v", b)
+	}
+	want := []api.IndexedRepo{
+		{Name: "org/a", Version: commit, Commit: commit, IndexedAt: indexed.Unix()},
+		{Name: "org/a", Version: "v1.0", Branch: "v1.0", Tag: "v1.0", IndexedAt: indexed.Unix() - 60},
+		{Name: "org/b", Version: "main", Commit: commit, Branch: "main", IndexedAt: indexed.Unix(), CommitTime: indexed.Unix() - 3600},
+	}
+	if len(b.Repos) != len(want) {
+		t.Fatalf("up: got %d repos, want %d", len(b.Repos), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(*b.Repos[i], want[i]) {
+			t.Errorf("up repo %d: got %+v, want %+v", i, *b.Repos[i], want[i])
+		}
+	}
+	if b := got.Backends[1]; b.ID != "down" || b.Connected || b.Error != "connection refused" || b.IndexTime != 0 || len(b.Repos) != 0 {
+		t.Errorf("down: got %+v", b)
+	}
+}
+
+func TestRefreshLabels(t *testing.T) {
+	bk := &Backend{Id: "main", I: &I{}}
+	bk.refresh(&pb.ServerInfo{Trees: []*pb.ServerInfo_Tree{
+		{Name: "a", Version: "main", Metadata: &configpb.Metadata{
+			Labels:   []string{"archived"},
+			LabelMap: map[string]string{"team": "search"},
+		}},
+		{Name: "b", Version: "main"},
+	}})
+	if len(bk.I.Trees) != 2 {
+		t.Fatalf("%d trees, want 2", len(bk.I.Trees))
+	}
+	want := map[string]string{"archived": "", "team": "search"}
+	if got := bk.I.Trees[0].Labels; !reflect.DeepEqual(got, want) {
+		t.Errorf("labels = %v, want %v", got, want)
+	}
+	if got := bk.I.Trees[1].Labels; len(got) != 0 {
+		t.Errorf("labels of a tree without metadata = %v", got)
+	}
+}
+
+func TestSearchTimeout(t *testing.T) {
+	srv := &server{config: &config.Config{SearchTimeoutMs: 5000}}
+	plain := &Backend{Id: "plain"}
+	slow := &Backend{Id: "slow", searchTimeout: 20 * time.Second}
+	for _, tc := range []struct {
+		backend *Backend
+		url     string
+		want    time.Duration
+		err     bool
+	}{
+		{plain, "/api/v1/search/plain?q=x", 5 * time.Second, false},
+		{slow, "/api/v1/search/slow?q=x", 20 * time.Second, false},
+		{slow, "/api/v1/search/slow?q=x&timeout_ms=1500", 1500 * time.Millisecond, false},
+		{plain, "/api/v1/search/plain?q=x&timeout_ms=60000", 5 * time.Second, false},
+		{plain, "/api/v1/search/plain?q=x&timeout_ms=soon", 0, true},
+	} {
+		got, err := srv.searchTimeout(tc.backend, httptest.NewRequest("GET", tc.url, nil))
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("%s: got %s, %v; want %s", tc.url, got, err, tc.want)
+		}
+	}
+}
+
+func TestSelectIndexes(t *testing.T) {
+	main := &Backend{Id: "main", I: &I{Name: "main"}}
+	third := &Backend{Id: "tp", I: &I{Name: "third-party"}}
+	srv := &server{
+		bk:      map[string]*Backend{"main": main, "tp": third},
+		bkOrder: []string{"main", "tp"},
+	}
+	for _, tc := range []struct {
+		names []string
+		want  []*Backend
+	}{
+		{[]string{"main"}, []*Backend{main}},
+		{[]string{"third-party", "main"}, []*Backend{third, main}},
+		{[]string{"tp", "third-party"}, []*Backend{third}},
+		{[]string{"all"}, []*Backend{main, third}},
+	} {
+		got, err := srv.selectIndexes(tc.names)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("selectIndexes(%v) = %v, %v", tc.names, got, err)
+		}
+	}
+	if _, err := srv.selectIndexes([]string{"main", "other"}); err == nil {
+		t.Error("no error for an unknown index")
+	}
+}
+
+func TestLimitMatches(t *testing.T) {
+	srv := &server{config: &config.Config{DefaultMaxMatches: 50, DefaultMaxFiles: 10, MaxMatchesLimit: 1000}}
+	for _, tc := range []struct {
+		q    pb.Query
+		want int32
+	}{
+		{pb.Query{}, 50},
+		{pb.Query{FilenameOnly: true}, 10},
+		{pb.Query{MaxMatches: 200}, 200},
+		{pb.Query{MaxMatches: 5000}, 1000},
+	} {
+		q := tc.q
+		srv.limitMatches(&q)
+		if q.MaxMatches != tc.want {
+			t.Errorf("limitMatches(%+v) = %d, want %d", tc.q, q.MaxMatches, tc.want)
+		}
+	}
+}
+
+func TestAllBackendsScriptData(t *testing.T) {
+	main := &Backend{Id: "main", I: &I{Name: "main", Trees: []Tree{
+		{Name: "org/app", Url: "https://git.example.com/org/app"},
+		{Name: "org/app", Tag: "v1.9"},
+	}}}
+	third := &Backend{Id: "tp", I: &I{Name: "third-party", Trees: []Tree{
+		{Name: "org/app", Url: "https://mirror.example.com/org/app"},
+		{Name: "vendor/lib", Url: "https://mirror.example.com/vendor/lib", LinkRevision: "main"},
+		{Name: "vendor/lib", Tag: "v1.10"},
+	}}}
+	srv := &server{
+		config:  &config.Config{SearchAllBackends: true},
+		bk:      map[string]*Backend{"main": main, "tp": third},
+		bkOrder: []string{"main", "tp"},
+	}
+	if key := srv.allBackendsKey(); key != "main,tp" {
+		t.Fatalf("allBackendsKey() = %q", key)
+	}
+	data, _, _ := srv.makeSearchScriptData(httptest.NewRequest("GET", "/search", nil))
+	wantUrls := map[string]string{
+		"org/app":    "https://git.example.com/org/app",
+		"vendor/lib": "https://mirror.example.com/vendor/lib",
+	}
+	if got := data.RepoUrls["main,tp"]; !reflect.DeepEqual(got, wantUrls) {
+		t.Errorf("repo_urls of all indexes = %v, want %v", got, wantUrls)
+	}
+	if got := data.LinkRevisions["main,tp"]; !reflect.DeepEqual(got, map[string]string{"vendor/lib": "main"}) {
+		t.Errorf("link_revisions of all indexes = %v", got)
+	}
+	if got, want := data.Versions["main,tp"], []string{"v1.10", "v1.9"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("versions of all indexes = %v, want %v", got, want)
+	}
+
+	srv.config.SearchAllBackends = false
+	if key := srv.allBackendsKey(); key != "" {
+		t.Errorf("allBackendsKey() = %q with search_all_backends off", key)
+	}
+}
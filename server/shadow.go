@@ -0,0 +1,111 @@
+package server
+
+import (
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/reqid"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// shadowConcurrency is how many shadow searches may be running at once;
+// beyond that they're dropped, so that a slow shadow can't pile up work
+// in the frontend.
+const shadowConcurrency = 16
+
+// A shadowResult is the comparison of one search with its shadow.
+type shadowResult struct {
+	latencyDelta time.Duration // the shadow's latency less the backend's
+	resultsDelta int           // the shadow's result count less the backend's
+}
+
+// compareShadow compares the reply the backend gave with the one its
+// shadow gave, each having taken the time given.
+func compareShadow(reply *api.ReplySearch, took time.Duration, shadow *api.ReplySearch, shadowTook time.Duration) shadowResult {
+	return shadowResult{
+		latencyDelta: shadowTook - took,
+		resultsDelta: len(shadow.Results) - len(reply.Results),
+	}
+}
+
+// routeToShadow reports whether a search of bk should be repeated on
+// its shadow, which it picks for shadow.percent of searches at random,
+// and there is room for another shadow search.
+func (bk *Backend) routeToShadow() bool {
+	if bk.shadow == nil || rand.Intn(100) >= bk.shadowPercent {
+		return false
+	}
+	select {
+	case bk.shadowSlots <- struct{}{}:
+		return true
+	default:
+		log.Warnf(context.Background(), "backend %s: too many shadow searches running; dropping one", bk.Id)
+		return false
+	}
+}
+
+// shadowSearch repeats q, which the backend answered with reply after
+// took, on the backend's shadow in the background, and records how the
+// two compare. Its results go nowhere else. routeToShadow must have
+// reported true.
+func (s *server) shadowSearch(ctx context.Context, backend *Backend, q *pb.Query, timeout time.Duration, reply *api.ReplySearch, took time.Duration) {
+	// The request's context ends when it has been answered.
+	shadowCtx := context.Background()
+	if id, ok := reqid.FromContext(ctx); ok {
+		shadowCtx = reqid.NewContext(shadowCtx, id)
+	}
+	go func() {
+		defer func() { <-backend.shadowSlots }()
+		shadow := backend.shadow
+		if !shadow.breaker.allow() {
+			return
+		}
+		timing := newSearchTiming()
+		shadowReply, err := s.doSearch(shadowCtx, shadow, q, timeout, timing)
+		shadow.breaker.record(backendFailed(err, timeout, s.backendTimeout(backend)))
+
+		l := log.FromContext(shadowCtx).With("backend", backend.Id, "query", q.Line)
+		if err != nil {
+			l.With("err", err).Warnf("shadow search failed")
+			s.shadowMetrics(backend.Id, nil)
+			return
+		}
+		res := compareShadow(reply, took, shadowReply, timing.backend)
+		l = l.With(
+			"latency_delta_ms", int64(res.latencyDelta/time.Millisecond),
+			"results", len(reply.Results),
+			"shadow_results", len(shadowReply.Results),
+		)
+		if res.resultsDelta != 0 {
+			l.Warnf("shadow search results differ")
+		} else {
+			l.Debugf("shadow search")
+		}
+		s.shadowMetrics(backend.Id, &res)
+	}()
+}
+
+// shadowMetrics sends the outcome of one shadow search to StatsD, if it
+// is configured: a shadow.requests count tagged with the backend, and
+// then either a shadow.errors count, or the shadow.latency_delta and
+// shadow.results_delta histograms, of the shadow's latency in
+// milliseconds and result count less the backend's. res is nil if the
+// shadow search failed.
+func (s *server) shadowMetrics(backend string, res *shadowResult) {
+	if s.statsd == nil {
+		return
+	}
+	c := s.statsd.Clone(statsd.Tags("backend", backend))
+	c.Increment("shadow.requests")
+	if res == nil {
+		c.Increment("shadow.errors")
+		return
+	}
+	c.Histogram("shadow.latency_delta", int64(res.latencyDelta/time.Millisecond))
+	c.Histogram("shadow.results_delta", res.resultsDelta)
+}
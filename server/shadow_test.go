@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+func TestCompareShadow(t *testing.T) {
+	reply := &api.ReplySearch{Results: make([]*api.Result, 3)}
+	shadow := &api.ReplySearch{Results: make([]*api.Result, 1)}
+	got := compareShadow(reply, 100*time.Millisecond, shadow, 40*time.Millisecond)
+	if got.latencyDelta != -60*time.Millisecond || got.resultsDelta != -2 {
+		t.Errorf("compareShadow = %+v, want latency -60ms and results -2", got)
+	}
+}
+
+func TestRouteToShadow(t *testing.T) {
+	bk := &Backend{Id: "livegrep"}
+	if bk.routeToShadow() {
+		t.Error("routed to a shadow that isn't configured")
+	}
+	bk.shadow = &Backend{Id: "livegrep-shadow"}
+	bk.shadowPercent = 100
+	bk.shadowSlots = make(chan struct{}, 2)
+	if !bk.routeToShadow() || !bk.routeToShadow() {
+		t.Fatal("search not repeated on the shadow")
+	}
+	if bk.routeToShadow() {
+		t.Error("shadow search started with no slots free")
+	}
+	<-bk.shadowSlots
+	if !bk.routeToShadow() {
+		t.Error("shadow search not started once a slot was freed")
+	}
+}
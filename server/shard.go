@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/log"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// errSharded is returned for changes that can only be made to each of
+// a sharded backend's shards.
+var errSharded = errors.New("backend is sharded; its shards have addresses of their own")
+
+// shardId names the i'th shard of the backend id, in its metrics and in
+// the unavailable list of a search missing it.
+func shardId(id string, i int) string {
+	return fmt.Sprintf("%s-shard-%d", id, i)
+}
+
+// newShardedBackend returns a backend whose index is split, by
+// repository, across shards. Its index info is the union of theirs,
+// kept up to date as they refresh.
+func newShardedBackend(id string, shards []*Backend) *Backend {
+	bk := &Backend{Id: id, I: &I{Name: id}, shards: shards}
+	for _, shard := range shards {
+		shard.parent = bk
+	}
+	return bk
+}
+
+// mergeShards rebuilds a sharded backend's index info from its shards'.
+// Its trees are all of theirs, and its index time is the oldest of
+// theirs, since it is only as fresh as its stalest shard.
+func (bk *Backend) mergeShards() {
+	var trees []Tree
+	var indexTime time.Time
+	for _, shard := range bk.shards {
+		shard.I.Lock()
+		trees = append(trees, shard.I.Trees...)
+		if t := shard.I.IndexTime; t.Unix() > 0 && (indexTime.IsZero() || t.Before(indexTime)) {
+			indexTime = t
+		}
+		shard.I.Unlock()
+	}
+	bk.I.Lock()
+	defer bk.I.Unlock()
+	bk.I.Trees, bk.I.IndexTime = trees, indexTime
+}
+
+// searchShards searches every shard of a sharded backend at once, with
+// the timeout r asks for, and merges their results as if they came from
+// one index (see mergeShardReplies). Each shard has its own breaker.
+// The timing is that of the slowest shard.
+func (s *server) searchShards(ctx context.Context, backend *Backend, q *pb.Query, r *http.Request, timing *searchTiming) (*api.ReplySearch, time.Duration, error) {
+	timeout, err := s.searchTimeout(backend, r)
+	if err != nil {
+		return nil, 0, err
+	}
+	replies := make([]*api.ReplySearch, len(backend.shards))
+	timings := make([]*searchTiming, len(backend.shards))
+	errs := make([]error, len(backend.shards))
+	var wg sync.WaitGroup
+	for i, shard := range backend.shards {
+		timings[i] = &searchTiming{start: timing.start}
+		if !shard.breaker.allow() {
+			errs[i] = errBackendOpen
+			continue
+		}
+		wg.Add(1)
+		go func(i int, shard *Backend) {
+			defer wg.Done()
+			replies[i], errs[i] = s.doSearch(ctx, shard, q, timeout, timings[i])
+			shard.breaker.record(backendFailed(errs[i], timeout, s.backendTimeout(backend)))
+		}(i, shard)
+	}
+	wg.Wait()
+
+	timing.target = targetStable
+	for i := range timings {
+		if errs[i] == nil && timings[i].backend >= timing.backend {
+			timing.backend, timing.stats = timings[i].backend, timings[i].stats
+		}
+	}
+	reply, err := mergeShardReplies(backend, q, replies, errs)
+	for _, u := range reply.Unavailable {
+		log.FromContext(ctx).With("shard", u.Backend, "err", u.Error).Warnf("shard unavailable; results are incomplete")
+	}
+	if err != nil {
+		return nil, timeout, err
+	}
+	s.auth.filter(r, reply)
+	return reply, timeout, nil
+}
+
+// mergeShardReplies merges the replies of a search of each of a sharded
+// backend's shards, or the errors that kept each from being searched.
+// Since every shard may return up to q's max_matches, their results are
+// interleaved, so that cutting them down to max_matches keeps the first
+// few of each, and the merged reply is truncated if any shard's was or
+// if there were more than that. Shards that failed are listed in the
+// reply as unavailable, unless all of them did; then the first one's
+// error is returned.
+func mergeShardReplies(backend *Backend, q *pb.Query, replies []*api.ReplySearch, errs []error) (*api.ReplySearch, error) {
+	merged := &api.ReplySearch{
+		Results:     make([]*api.Result, 0),
+		FileResults: make([]*api.FileResult, 0),
+		SearchType:  "normal",
+		Info:        &api.Stats{ExitReason: pb.SearchStats_NONE.String()},
+	}
+	var results [][]*api.Result
+	var files [][]*api.FileResult
+	for i, reply := range replies {
+		if errs[i] != nil {
+			merged.Unavailable = append(merged.Unavailable, &api.Unavailable{
+				Backend: shardId(backend.Id, i),
+				Error:   unavailableReason(errs[i]),
+			})
+			continue
+		}
+		merged.SearchType = reply.SearchType
+		results = append(results, reply.Results)
+		files = append(files, reply.FileResults)
+		mergeStats(merged.Info, reply.Info)
+	}
+	if len(merged.Unavailable) == len(replies) {
+		return merged, errs[0]
+	}
+
+	for n := 0; ; n++ {
+		more := false
+		for i := range results {
+			if n < len(results[i]) {
+				merged.Results = append(merged.Results, results[i][n])
+				more = true
+			}
+			if n < len(files[i]) {
+				merged.FileResults = append(merged.FileResults, files[i][n])
+				more = true
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	if limit := int(q.MaxMatches); limit > 0 {
+		if len(merged.Results) > limit {
+			merged.Results = merged.Results[:limit]
+			merged.Info.ExitReason = pb.SearchStats_MATCH_LIMIT.String()
+		}
+		if q.FilenameOnly && len(merged.FileResults) > limit {
+			merged.FileResults = merged.FileResults[:limit]
+			merged.Info.ExitReason = pb.SearchStats_MATCH_LIMIT.String()
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/livegrep/livegrep/server/api"
+	configpb "github.com/livegrep/livegrep/src/proto/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func shardReply(exit string, paths ...string) *api.ReplySearch {
+	reply := &api.ReplySearch{
+		Results:     make([]*api.Result, 0),
+		FileResults: make([]*api.FileResult, 0),
+		SearchType:  "normal",
+		Info:        &api.Stats{ExitReason: exit},
+	}
+	for _, p := range paths {
+		reply.Results = append(reply.Results, &api.Result{Path: p})
+	}
+	return reply
+}
+
+func resultPaths(reply *api.ReplySearch) []string {
+	var out []string
+	for _, r := range reply.Results {
+		out = append(out, r.Path)
+	}
+	return out
+}
+
+func TestMergeShardReplies(t *testing.T) {
+	bk := &Backend{Id: "main"}
+	none := pb.SearchStats_NONE.String()
+	limit := pb.SearchStats_MATCH_LIMIT.String()
+
+	reply, err := mergeShardReplies(bk, &pb.Query{MaxMatches: 10},
+		[]*api.ReplySearch{shardReply(none, "a1", "a2", "a3"), shardReply(none, "b1")},
+		[]error{nil, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resultPaths(reply), []string{"a1", "b1", "a2", "a3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merged results = %v, want %v", got, want)
+	}
+	if reply.Info.ExitReason != none || len(reply.Unavailable) != 0 {
+		t.Errorf("merged reply truncated=%s unavailable=%v", reply.Info.ExitReason, reply.Unavailable)
+	}
+
+	// More than max_matches between them keeps the first of each.
+	reply, _ = mergeShardReplies(bk, &pb.Query{MaxMatches: 3},
+		[]*api.ReplySearch{shardReply(limit, "a1", "a2", "a3"), shardReply(none, "b1", "b2")},
+		[]error{nil, nil})
+	if got, want := resultPaths(reply), []string{"a1", "b1", "a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("truncated results = %v, want %v", got, want)
+	}
+	if reply.Info.ExitReason != limit {
+		t.Errorf("exit reason = %s, want %s", reply.Info.ExitReason, limit)
+	}
+
+	// A failed shard leaves the others' results, marked incomplete.
+	down := grpc.Errorf(codes.Unavailable, "connection refused")
+	reply, err = mergeShardReplies(bk, &pb.Query{MaxMatches: 10},
+		[]*api.ReplySearch{nil, shardReply(none, "b1")},
+		[]error{down, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resultPaths(reply), []string{"b1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("results with a shard down = %v, want %v", got, want)
+	}
+	if len(reply.Unavailable) != 1 || reply.Unavailable[0].Backend != "main-shard-0" || reply.Unavailable[0].Error != "unreachable" {
+		t.Errorf("unavailable = %+v", reply.Unavailable)
+	}
+
+	// Only if every shard failed does the search.
+	if _, err := mergeShardReplies(bk, &pb.Query{}, []*api.ReplySearch{nil, nil}, []error{down, errBackendOpen}); err != down {
+		t.Errorf("error with every shard down = %v, want %v", err, down)
+	}
+}
+
+func TestMergeShards(t *testing.T) {
+	a := &Backend{Id: "main-shard-0", I: &I{}}
+	b := &Backend{Id: "main-shard-1", I: &I{}}
+	bk := newShardedBackend("main", []*Backend{a, b})
+
+	a.refresh(&pb.ServerInfo{IndexTime: 2000, Trees: []*pb.ServerInfo_Tree{
+		{Name: "a", Version: "main", Metadata: &configpb.Metadata{}},
+	}})
+	b.refresh(&pb.ServerInfo{IndexTime: 1000, Trees: []*pb.ServerInfo_Tree{
+		{Name: "b", Version: "main", Metadata: &configpb.Metadata{}},
+	}})
+	if n := len(bk.I.Trees); n != 2 {
+		t.Errorf("sharded backend has %d trees, want 2", n)
+	}
+	if !bk.I.IndexTime.Equal(time.Unix(1000, 0)) {
+		t.Errorf("sharded backend's index time = %s, want its oldest shard's", bk.I.IndexTime)
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/log"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// searchTiming breaks down where the time handling one search went.
+type searchTiming struct {
+	start time.Time
+	// Whether the stable backend or its canary was searched.
+	target string
+	// Parsing the request into a query.
+	parse time.Duration
+	// The Search RPC, as the frontend saw it.
+	backend time.Duration
+	// The backend's own account of the search, if it answered.
+	stats *pb.SearchStats
+}
+
+func newSearchTiming() *searchTiming {
+	return &searchTiming{start: time.Now()}
+}
+
+// logSlowQuery logs a search that took longer than
+// slow_query_threshold_ms, with its timing breakdown: parse_ms, then
+// queue_ms, the part of the RPC the backend didn't spend searching
+// (waiting for a search thread, or on the network), then backend_ms
+// and its parts as the backend reports them, then render_ms, the rest.
+// reply is nil if the search failed with err.
+func (s *server) logSlowQuery(ctx context.Context, backend string, q *pb.Query, t *searchTiming, reply *api.ReplySearch, err error) {
+	threshold := time.Duration(s.config.SlowQueryThresholdMs) * time.Millisecond
+	total := time.Since(t.start)
+	if threshold <= 0 || total < threshold {
+		return
+	}
+	ms := func(d time.Duration) int64 { return int64(d / time.Millisecond) }
+
+	l := log.FromContext(ctx).With(
+		"backend", backend,
+		"target", t.target,
+		"query", q.Line,
+		"file", q.File,
+		"repo", q.Repo,
+		"fold_case", q.FoldCase,
+		"max_matches", q.MaxMatches,
+		"total_ms", ms(total),
+		"parse_ms", ms(t.parse),
+	)
+	if st := t.stats; st != nil {
+		queue := t.backend - time.Duration(st.TotalTime)*time.Millisecond
+		if queue < 0 {
+			queue = 0
+		}
+		l = l.With(
+			"queue_ms", ms(queue),
+			"backend_ms", st.TotalTime,
+			"re2_ms", st.Re2Time,
+			"git_ms", st.GitTime,
+			"sort_ms", st.SortTime,
+			"index_ms", st.IndexTime,
+			"analyze_ms", st.AnalyzeTime,
+			"exit_reason", st.ExitReason.String(),
+		)
+	} else {
+		l = l.With("backend_ms", ms(t.backend))
+	}
+	l = l.With("render_ms", ms(total-t.parse-t.backend))
+	if reply != nil {
+		l = l.With("results", len(reply.Results))
+	}
+	if err != nil {
+		l = l.With("err", err)
+	}
+	l.Warnf("slow query")
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/net/context"
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+func newStatsd(cfg config.StatsD) (*statsd.Client, error) {
+	opts := []statsd.Option{
+		statsd.Address(cfg.Address),
+		statsd.ErrorHandler(func(err error) {
+			log.Warnf(context.Background(), "statsd: %s", err.Error())
+		}),
+	}
+	if cfg.Prefix != "" {
+		opts = append(opts, statsd.Prefix(cfg.Prefix))
+	}
+	switch cfg.TagsFormat {
+	case "", "datadog":
+		opts = append(opts, statsd.TagsFormat(statsd.Datadog))
+	case "influxdb":
+		opts = append(opts, statsd.TagsFormat(statsd.InfluxDB))
+	case "none":
+	default:
+		return nil, fmt.Errorf("unknown tags_format %q (want datadog, influxdb or none)", cfg.TagsFormat)
+	}
+	keys := make([]string, 0, len(cfg.Tags))
+	for k := range cfg.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var tags []string
+	for _, k := range keys {
+		tags = append(tags, k, cfg.Tags[k])
+	}
+	opts = append(opts, statsd.Tags(tags...))
+	return statsd.New(opts...)
+}
+
+// searchMetrics sends the outcome of one search to StatsD, if it is
+// configured: a search.requests count tagged with the backend, the
+// target searched (stable or canary, if the search got that far) and
+// the status (ok, or the error code returned), and then either a
+// search.errors count or the search.latency timing and search.results
+// histogram.
+func (s *server) searchMetrics(backend, target, status string, reply *api.ReplySearch) {
+	if s.statsd == nil {
+		return
+	}
+	c := s.statsd.Clone(statsd.Tags("backend", backend, "status", status))
+	if target != "" {
+		c = c.Clone(statsd.Tags("target", target))
+	}
+	c.Increment("search.requests")
+	if reply == nil {
+		c.Increment("search.errors")
+		return
+	}
+	if reply.Info != nil {
+		c = c.Clone(statsd.Tags("exit_reason", reply.Info.ExitReason))
+		c.Timing("search.latency", reply.Info.TotalTime)
+	}
+	c.Histogram("search.results", len(reply.Results))
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/livegrep/livegrep/pkg/logging"
+	"github.com/livegrep/livegrep/pkg/objstore"
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+const (
+	defaultSupervisePoll = 10 * time.Second
+	defaultIndexURLPoll  = 5 * time.Minute
+	// How long to wait before restarting codesearch after it exits; the
+	// wait doubles each time it exits soon after starting, up to
+	// maxRestartDelay.
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+	// How long codesearch must run before an exit counts as a crash of
+	// a healthy process rather than a failure to start.
+	stableRun = time.Minute
+)
+
+// A supervisor runs the codesearch serving a backend as a child of the
+// frontend, restarting it whenever it exits, and has it reload its index
+// whenever the index file changes, so a single-host deployment has only
+// the frontend to manage.
+type supervisor struct {
+	bk   *Backend
+	cfg  config.RunBackend
+	path string // the codesearch binary
+	args []string
+	poll time.Duration
+	log  *logging.Logger
+}
+
+func newSupervisor(bk *Backend, addr string, cfg config.RunBackend) (*supervisor, error) {
+	if cfg.Index == "" {
+		return nil, fmt.Errorf("%s: run requires an index", bk.Id)
+	}
+	if cfg.IndexURL != "" && !objstore.Supported(cfg.IndexURL) {
+		return nil, fmt.Errorf("%s: unsupported index_url %s (want s3://, gs://, an Azure blob URL or file://)", bk.Id, cfg.IndexURL)
+	}
+	sv := &supervisor{
+		bk:   bk,
+		cfg:  cfg,
+		path: cfg.Codesearch,
+		poll: time.Duration(cfg.PollMs) * time.Millisecond,
+		log:  logging.With("backend", bk.Id),
+	}
+	if sv.path == "" {
+		sv.path = findCodesearch()
+	}
+	if sv.poll <= 0 {
+		sv.poll = defaultSupervisePoll
+	}
+	sv.args = append([]string{
+		"-grpc", addr,
+		"-load_index", cfg.Index,
+		"-reload_rpc",
+	}, cfg.Args...)
+	return sv, nil
+}
+
+// findCodesearch returns the codesearch installed next to the frontend,
+// if there is one, or else "codesearch", to be found on the PATH.
+func findCodesearch() string {
+	if exe, err := os.Executable(); err == nil {
+		p := filepath.Join(filepath.Dir(exe), "codesearch")
+		if st, err := os.Stat(p); err == nil && st.Mode().IsRegular() {
+			return p
+		}
+	}
+	return "codesearch"
+}
+
+// Start runs codesearch, and watches its index, in the background,
+// first downloading the index if it comes from object storage.
+func (sv *supervisor) Start() {
+	if sv.cfg.IndexURL != "" {
+		go sv.download()
+	}
+	go sv.run()
+	go sv.watch()
+}
+
+// download fetches the latest index uploaded to the index_url into the
+// index, if it is new, and again at every index_poll_ms. It is written
+// beside the index and renamed into place, which watch notices.
+func (sv *supervisor) download() {
+	poll := time.Duration(sv.cfg.IndexPollMs) * time.Millisecond
+	if poll <= 0 {
+		poll = defaultIndexURLPoll
+	}
+	for ; ; time.Sleep(poll) {
+		if err := sv.downloadOnce(); err != nil {
+			sv.log.With("err", err).Errorf("downloading the index from %s", sv.cfg.IndexURL)
+		}
+	}
+}
+
+func (sv *supervisor) downloadOnce() error {
+	if err := os.MkdirAll(filepath.Dir(sv.cfg.Index), 0755); err != nil {
+		return err
+	}
+	p, err := objstore.Download(sv.cfg.IndexURL, func(string) string { return sv.cfg.Index })
+	if err == nil && p != "" {
+		sv.log.Infof("Downloaded a new index from %s", sv.cfg.IndexURL)
+	}
+	return err
+}
+
+// run starts codesearch, once there is an index for it to serve, and
+// starts it again each time it exits.
+func (sv *supervisor) run() {
+	if indexFingerprint(sv.cfg.Index) == "" {
+		sv.log.Infof("Waiting for %s to be built", sv.cfg.Index)
+		for indexFingerprint(sv.cfg.Index) == "" {
+			time.Sleep(sv.poll)
+		}
+	}
+	delay := minRestartDelay
+	for {
+		sv.log.Infof("Starting %s %v", sv.path, sv.args)
+		cmd := exec.Command(sv.path, sv.args...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		setParentDeathSignal(cmd)
+		start := time.Now()
+		err := cmd.Run()
+		if time.Since(start) >= stableRun {
+			delay = minRestartDelay
+		}
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		sv.log.With("err", err).Errorf("codesearch stopped after %s; restarting in %s",
+			time.Since(start).Round(time.Second), delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// watch asks codesearch to reload whenever the index changes, as when
+// livegrep-fetch-reindex replaces it or points the current symlink of an
+// -index-dir at a new generation.
+func (sv *supervisor) watch() {
+	last := indexFingerprint(sv.cfg.Index)
+	for range time.Tick(sv.poll) {
+		fp := indexFingerprint(sv.cfg.Index)
+		if fp == last || fp == "" {
+			continue
+		}
+		if last == "" {
+			// The first index; run loads it when it starts.
+			last = fp
+			continue
+		}
+		sv.log.Infof("Index %s changed; reloading", sv.cfg.Index)
+		ctx, cancel := context.WithTimeout(context.Background(), backendReloadTimeout)
+		_, err := sv.bk.Client().Reload(ctx, &pb.Empty{}, grpc.FailFast(false))
+		cancel()
+		if err != nil {
+			// Try again at the next poll.
+			sv.log.With("err", err).Errorf("reloading codesearch")
+			continue
+		}
+		last = fp
+	}
+}
+
+// indexFingerprint identifies the version of the index at p: the file it
+// resolves to, its size and its modification time. It is "" if p
+// doesn't exist.
+func indexFingerprint(p string) string {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return ""
+	}
+	st, err := os.Stat(resolved)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s %d %d", resolved, st.Size(), st.ModTime().UnixNano())
+}
@@ -0,0 +1,12 @@
+package server
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setParentDeathSignal has the kernel kill cmd if the frontend dies, so
+// a crashed frontend doesn't leave codesearch holding its port.
+func setParentDeathSignal(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
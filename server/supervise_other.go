@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+import (
+	"os/exec"
+)
+
+func setParentDeathSignal(cmd *exec.Cmd) {}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/livegrep/livegrep/pkg/objstore"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestIndexFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	current := filepath.Join(dir, "current")
+	if fp := indexFingerprint(current); fp != "" {
+		t.Errorf("fingerprint of a missing index = %q", fp)
+	}
+
+	for _, gen := range []string{"a.idx", "b.idx"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, gen), []byte("index"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a.idx", current); err != nil {
+		t.Fatal(err)
+	}
+	a := indexFingerprint(current)
+	if a == "" || a != indexFingerprint(current) {
+		t.Fatalf("unstable fingerprint %q", a)
+	}
+
+	os.Remove(current)
+	os.Symlink("b.idx", current)
+	if b := indexFingerprint(current); b == a || b == "" {
+		t.Errorf("fingerprint %q didn't change when current moved to b.idx", b)
+	}
+}
+
+func TestSupervisorDownload(t *testing.T) {
+	dir := t.TempDir()
+	prefix := "file://" + filepath.Join(dir, "bucket")
+	built := filepath.Join(dir, "built.idx")
+	if err := ioutil.WriteFile(built, []byte("index"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := fmt.Sprintf("%x  built.idx\n", sha256.Sum256([]byte("index")))
+	if err := objstore.Upload(built, sum, prefix, "20261014T000000.idx"); err != nil {
+		t.Fatal(err)
+	}
+
+	bk := &Backend{Id: "main"}
+	if _, err := newSupervisor(bk, "localhost:0", config.RunBackend{
+		Index:    filepath.Join(dir, "livegrep.idx"),
+		IndexURL: "https://example.com/livegrep/",
+	}); err == nil {
+		t.Errorf("newSupervisor accepted an unsupported index_url")
+	}
+	sv, err := newSupervisor(bk, "localhost:0", config.RunBackend{
+		Index:    filepath.Join(dir, "serving", "livegrep.idx"),
+		IndexURL: prefix,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sv.downloadOnce(); err != nil {
+		t.Fatalf("downloadOnce: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(sv.cfg.Index); string(data) != "index" {
+		t.Errorf("downloaded index = %q", data)
+	}
+	if err := sv.downloadOnce(); err != nil {
+		t.Errorf("downloadOnce with nothing new: %v", err)
+	}
+}
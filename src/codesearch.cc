@@ -10,6 +10,7 @@
 #include <string.h>
 #include <sys/mman.h>
 
+#include <algorithm>
 #include <locale>
 #include <list>
 #include <iostream>
@@ -30,6 +31,7 @@
 #include "src/chunk_allocator.h"
 #include "src/query_planner.h"
 #include "src/content.h"
+#include "src/language.h"
 
 #include "absl/strings/string_view.h"
 
@@ -152,6 +154,35 @@ protected:
 class code_searcher;
 struct match_finger;
 
+static bool has_label(const indexed_tree *tree, const pair<string, string> &label) {
+    auto it = tree->metadata.label_map().find(label.first);
+    if (it != tree->metadata.label_map().end())
+        return label.second.empty() || it->second == label.second;
+    // The old list form has no values
+    if (!label.second.empty())
+        return false;
+    const auto &list = tree->metadata.labels();
+    return std::find(list.begin(), list.end(), label.first) != list.end();
+}
+
+static bool in_language(const indexed_file *file, const string &lang) {
+    if (lang == kLanguageGenerated)
+        return file->generated;
+    return file->language == lang;
+}
+
+bool accept_language(const query &q, const indexed_file *file) {
+    for (const auto &langs : q.langs)
+        if (std::none_of(langs.begin(), langs.end(),
+                         [&](const string &l) { return in_language(file, l); }))
+            return false;
+
+    for (const auto &lang : q.negate.langs)
+        if (in_language(file, lang))
+            return false;
+    return true;
+}
+
 bool accept(const query *q, const indexed_file *file) {
     for (const auto &pat : q->file_pats)
         if (!pat->Match(file->path, 0, file->path.size(),
@@ -175,7 +206,25 @@ bool accept(const query *q, const indexed_file *file) {
                                   RE2::UNANCHORED, 0, 0))
         return false;
 
-    return true;
+    for (const auto &label : q->labels)
+        if (!has_label(file->tree, label))
+            return false;
+
+    for (const auto &label : q->negate.labels)
+        if (has_label(file->tree, label))
+            return false;
+
+    if (!accept_language(*q, file))
+        return false;
+
+    const string &tag = file->tree->metadata.tag();
+    if (!q->version_pat)
+        return tag.empty();
+    return q->version_pat->Match(file->tree->version, 0,
+                                 file->tree->version.size(),
+                                 RE2::UNANCHORED, 0, 0) ||
+        (!tag.empty() && q->version_pat->Match(tag, 0, tag.size(),
+                                               RE2::UNANCHORED, 0, 0));
 }
 
 bool accept(const query *q, const list<indexed_file *> &sfs) {
@@ -545,6 +594,16 @@ void code_searcher::index_file(const indexed_tree *tree,
                                StringPiece contents) {
     assert(!finalized_);
     assert(alloc_);
+    // NUL separates lines while chunks are sorted, so it can't be
+    // stored. The indexers skip binary files; any NULs left in a file
+    // they decided is text are indexed as spaces.
+    string cleaned;
+    if (memchr(contents.data(), 0, contents.size()) != NULL) {
+        cleaned = contents.ToString();
+        std::replace(cleaned.begin(), cleaned.end(), '\0', ' ');
+        contents = cleaned;
+    }
+
     size_t len = contents.size();
     const char *p = contents.data();
     const char *end = p + len;
@@ -553,9 +612,6 @@ void code_searcher::index_file(const indexed_tree *tree,
     chunk *prev = NULL;
     StringPiece line;
 
-    if (memchr(p, 0, len) != NULL)
-        return;
-
     idx_bytes.inc(len);
     idx_files.inc();
 
@@ -563,6 +619,8 @@ void code_searcher::index_file(const indexed_tree *tree,
     file->tree = tree;
     file->path = path;
     file->no  = files_.size();
+    file->language = detect_language(path, contents);
+    file->generated = detect_generated(path, file->language, contents);
     auto *sf = file.get();
     files_.push_back(move(file));
 
@@ -782,7 +840,7 @@ void searcher::search_lines(uint32_t *indexes, int count,
         return;
     }
 
-    if ((!query_->file_pats.empty() || query_->tree_pat) &&
+    if ((!query_->file_pats.empty() || query_->tree_pat || !query_->langs.empty()) &&
         double(count * 30) / chunk->size > files_density()) {
         full_search(chunk);
         return;
@@ -826,7 +884,8 @@ void searcher::full_search(const chunk *chunk)
 void searcher::next_range(match_finger *finger,
                           int& pos, int& endpos, int maxpos)
 {
-    if ((query_->file_pats.empty() && !query_->tree_pat) || !FLAGS_index)
+    if ((query_->file_pats.empty() && !query_->tree_pat && query_->langs.empty()) ||
+        !FLAGS_index)
         return;
 
     debug(kDebugSearch, "next_range(%d, %d, %d)", pos, endpos, maxpos);
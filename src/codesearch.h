@@ -85,6 +85,10 @@ struct indexed_file {
     string path;
     file_contents *content;
     int no;
+    // As detect_language and detect_generated found when the file was
+    // indexed
+    string language;
+    bool generated = false;
 };
 
 struct index_info {
@@ -117,16 +121,31 @@ struct query {
     vector<std::shared_ptr<RE2>> file_pats;
     std::shared_ptr<RE2> tree_pat;
     std::shared_ptr<RE2> tags_pat;
+    // (key, value) pairs a tree's metadata labels must contain; an empty
+    // value matches any value.
+    vector<pair<string, string>> labels;
+    // Matched against a tree's version and tag. If NULL, trees with a
+    // tag are left out.
+    std::shared_ptr<RE2> version_pat;
+    // Languages a file must be in: one of each entry's, where
+    // kLanguageGenerated stands for generated files.
+    vector<vector<string>> langs;
     struct {
         vector<std::shared_ptr<RE2>> file_pats;
         std::shared_ptr<RE2> tree_pat;
         std::shared_ptr<RE2> tags_pat;
+        vector<pair<string, string>> labels;
+        vector<string> langs;
     } negate;
 
     bool filename_only;
     int context_lines;
 };
 
+// Returns true if file is in the languages q asks for, and none of
+// those it leaves out.
+bool accept_language(const query &q, const indexed_file *file);
+
 class code_searcher {
 public:
     code_searcher();
@@ -35,3 +35,13 @@ file_contents *file_contents_builder::build(chunk_allocator *alloc) {
     }
     return out;
 }
+
+std::string file_contents::text(chunk_allocator *alloc) {
+    // Each piece is one or more lines, without the final newline.
+    std::string out;
+    for (auto it = begin(alloc); it != end(alloc); ++it) {
+        out.append(it->data(), it->size());
+        out.push_back('\n');
+    }
+    return out;
+}
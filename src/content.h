@@ -8,6 +8,7 @@
 #ifndef CODESEARCH_CONTENT_H
 #define CODESEARCH_CONTENT_H
 
+#include <string>
 #include <vector>
 #include "re2/re2.h"
 
@@ -94,6 +95,9 @@ public:
         return npieces_;
     }
 
+    // Reassembles the text of the file, with a newline after every line.
+    std::string text(chunk_allocator *alloc);
+
     friend class codesearch_index;
     friend class load_allocator;
     friend class file_contents_builder;
@@ -259,6 +259,8 @@ std::unique_ptr<chunk_allocator> make_dump_allocator(code_searcher *search, cons
 void codesearch_index::dump_file(map<const indexed_tree*, int>& ids, indexed_file *sf) {
     dump_int32(ids[sf->tree]);
     dump_string(sf->path);
+    dump_string(sf->language);
+    dump_int32(sf->generated ? kFileGenerated : 0);
 }
 
 void codesearch_index::dump_chunk_file(chunk_file *cf) {
@@ -456,6 +458,8 @@ unique_ptr<indexed_file> load_allocator::load_file(code_searcher *cs) {
     auto sf = std::make_unique<indexed_file>();
     sf->tree = cs->trees_[load_int32()].get();
     sf->path = load_string();
+    sf->language = load_string();
+    sf->generated = (load_int32() & kFileGenerated) != 0;
     sf->no = cs->files_.size();
     return sf;
 }
@@ -11,13 +11,16 @@
 #include <stdint.h>
 
 const uint32_t kIndexMagic   = 0xc0d35eac;
-const uint32_t kIndexVersion = 16;
+const uint32_t kIndexVersion = 17;
 
 // 16k is the page size on Apple M1 macs, which is the largest page
 // size of supported platforms. We use a consistent page size
 // everywhere for simplicity
 const uint32_t kPageSize     = (1 << 14);
 
+// Flags stored with each file, after its path and language
+const uint32_t kFileGenerated = 1 << 0;
+
 struct index_header {
     uint32_t magic;
     uint32_t version;
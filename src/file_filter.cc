@@ -0,0 +1,368 @@
+#include <algorithm>
+#include <gflags/gflags.h>
+#include <sstream>
+
+#include "src/lib/debug.h"
+#include "src/lib/metrics.h"
+
+#include "src/file_filter.h"
+#include "src/transcode.h"
+
+using namespace std;
+
+static metric idx_files_binary("index.files.binary");
+static metric idx_files_generated("index.files.generated");
+static metric idx_files_minified("index.files.minified");
+static metric idx_files_too_large("index.files.too_large");
+
+DEFINE_int64(max_file_size, 0, "Skip files larger than this many bytes, unless a repository sets its own max_file_size. 0 means no limit.");
+DEFINE_bool(exclude_generated, false, "Skip generated and vendored files, unless a repository sets generated.");
+
+// Files that are usually generated or vendored, after GitHub's
+// linguist. Repositories can correct these in their .gitattributes.
+static const char *const kGeneratedGlobs[] = {
+    "*.min.js", "*.min.css", "*.js.map", "*.css.map",
+    "*.pb.go", "*.pb.cc", "*.pb.h", "*_pb2.py", "*_pb2_grpc.py", "*_pb.js", "*_pb.d.ts",
+    "package-lock.json", "yarn.lock", "pnpm-lock.yaml", "composer.lock",
+    "Gemfile.lock", "Cargo.lock", "poetry.lock", "go.sum",
+};
+static const char *const kVendoredGlobs[] = {
+    "**/vendor/**", "**/node_modules/**", "**/bower_components/**", "**/dist/**",
+    "**/third_party/**", "**/third-party/**", "**/Godeps/_workspace/**",
+};
+
+file_filter::file_filter()
+    : max_file_size_(FLAGS_max_file_size), max_null_fraction_(0), check_bytes_(0),
+      symlinks_(SYMLINKS_DEFAULT), exclude_generated_(FLAGS_exclude_generated) {
+}
+
+file_filter::file_filter(const IndexSpec &index) : file_filter() {
+    for (auto &ext : index.index_only_extensions())
+        only_extensions_.push_back(normalize_extension(ext));
+    for (auto &ext : index.skip_extensions())
+        skip_extensions_.push_back(normalize_extension(ext));
+    add_binary_detection(index.binary_detection());
+    set_symlinks(index.symlinks());
+    set_encodings(index.encodings());
+    redactor_.add(index.redaction());
+}
+
+file_filter::file_filter(const IndexSpec &index, const PathSpec &spec)
+    : file_filter(index) {
+    if (spec.max_file_size())
+        max_file_size_ = spec.max_file_size();
+    for (auto &glob : spec.file_includes())
+        includes_.push_back(compile(glob));
+    for (auto &glob : spec.file_excludes())
+        excludes_.push_back(compile(glob));
+    set_symlinks(spec.symlinks());
+}
+
+file_filter::file_filter(const IndexSpec &index, const RepoSpec &spec)
+    : file_filter(index) {
+    if (spec.max_file_size())
+        max_file_size_ = spec.max_file_size();
+    for (auto &glob : spec.file_includes())
+        includes_.push_back(compile(glob));
+    for (auto &glob : spec.file_excludes())
+        excludes_.push_back(compile(glob));
+    if (spec.index_only_extensions_size()) {
+        only_extensions_.clear();
+        for (auto &ext : spec.index_only_extensions())
+            only_extensions_.push_back(normalize_extension(ext));
+    }
+    for (auto &ext : spec.skip_extensions())
+        skip_extensions_.push_back(normalize_extension(ext));
+    add_binary_detection(spec.binary_detection());
+    set_symlinks(spec.symlinks());
+    if (spec.generated() == "exclude")
+        exclude_generated_ = true;
+    else if (spec.generated() == "index")
+        exclude_generated_ = false;
+    else if (!spec.generated().empty())
+        die("%s: unknown generated setting '%s' (want exclude or index)",
+            spec.name().c_str(), spec.generated().c_str());
+    if (spec.encodings_size())
+        set_encodings(spec.encodings());
+    redactor_.add(spec.redaction());
+}
+
+void file_filter::set_encodings(const google::protobuf::RepeatedPtrField<std::string> &encodings) {
+    encodings_.clear();
+    for (auto &enc : encodings) {
+        if (!known_encoding(enc))
+            die("unknown encoding '%s'", enc.c_str());
+        encodings_.push_back(enc);
+    }
+}
+
+void file_filter::set_symlinks(const string &policy) {
+    if (policy.empty())
+        return;
+    if (policy == "follow")
+        symlinks_ = SYMLINKS_FOLLOW;
+    else if (policy == "link_text")
+        symlinks_ = SYMLINKS_LINK_TEXT;
+    else if (policy == "skip")
+        symlinks_ = SYMLINKS_SKIP;
+    else
+        die("unknown symlinks policy '%s' (want follow, link_text or skip)", policy.c_str());
+}
+
+void file_filter::add_binary_detection(const BinaryDetection &bd) {
+    if (bd.max_null_fraction() > 0)
+        max_null_fraction_ = bd.max_null_fraction();
+    if (bd.check_bytes() > 0)
+        check_bytes_ = bd.check_bytes();
+    for (auto &ext : bd.text_extensions())
+        text_extensions_.push_back(normalize_extension(ext));
+    for (auto &ext : bd.binary_extensions())
+        binary_extensions_.push_back(normalize_extension(ext));
+    for (auto &glob : bd.force_text())
+        force_text_.push_back(compile(glob));
+    for (auto &glob : bd.force_binary())
+        force_binary_.push_back(compile(glob));
+}
+
+// Lower-case ext and give it a leading dot, so "proto", ".proto" and
+// ".PROTO" are equivalent.
+string file_filter::normalize_extension(const string &ext) {
+    string e = ext;
+    transform(e.begin(), e.end(), e.begin(), ::tolower);
+    if (e.empty() || e[0] != '.')
+        e = "." + e;
+    return e;
+}
+
+bool file_filter::has_extension(const string &path, const vector<string> &exts) {
+    size_t slash = path.rfind('/');
+    string base = path.substr(slash == string::npos ? 0 : slash + 1);
+    transform(base.begin(), base.end(), base.begin(), ::tolower);
+    for (auto &ext : exts) {
+        if (base.size() > ext.size() &&
+            base.compare(base.size() - ext.size(), ext.size(), ext) == 0)
+            return true;
+    }
+    return false;
+}
+
+// Translate a glob into an anchored RE2 pattern.
+file_filter::pattern file_filter::compile(const string &glob) {
+    pattern p;
+    p.re = std::make_shared<RE2>(glob_regex(glob, &p.recursive));
+    if (!p.re->ok())
+        die("invalid file glob '%s': %s", glob.c_str(), p.re->error().c_str());
+    return p;
+}
+
+string file_filter::glob_regex(const string &glob, bool *recursive) {
+    string g = glob;
+    if (!g.empty() && g[0] == '/')
+        g = g.substr(1);
+    if (!g.empty() && g[g.size() - 1] == '/')
+        g += "**";
+
+    string re = "^";
+    if (g.find('/') == string::npos)
+        re += "(?:.*/)?";
+    for (size_t i = 0; i < g.size(); ++i) {
+        char c = g[i];
+        if (c == '*' && i + 1 < g.size() && g[i + 1] == '*') {
+            i++;
+            if (i + 1 < g.size() && g[i + 1] == '/' && (i == 1 || g[i - 2] == '/')) {
+                i++;
+                re += "(?:.*/)?";
+            } else {
+                re += ".*";
+            }
+        } else if (c == '*') {
+            re += "[^/]*";
+        } else if (c == '?') {
+            re += "[^/]";
+        } else if (c == '[') {
+            size_t end = g.find(']', i + 2);
+            if (end == string::npos) {
+                re += "\\[";
+                continue;
+            }
+            string cls = g.substr(i + 1, end - i - 1);
+            if (cls[0] == '!')
+                cls[0] = '^';
+            re += "[" + cls + "]";
+            i = end;
+        } else {
+            re += RE2::QuoteMeta(string(1, c));
+        }
+    }
+    re += "$";
+    *recursive = g.size() >= 2 && g.compare(g.size() - 2, 2, "**") == 0;
+    return re;
+}
+
+bool file_filter::matches(const string &path, const vector<pattern> &patterns) {
+    for (auto &p : patterns) {
+        if (RE2::FullMatch(path, *p.re))
+            return true;
+    }
+    return false;
+}
+
+bool file_filter::include(const string &path) const {
+    if (has_extension(path, skip_extensions_))
+        return false;
+    if (!only_extensions_.empty() && !has_extension(path, only_extensions_))
+        return false;
+    if (matches(path, excludes_))
+        return false;
+    return includes_.empty() || matches(path, includes_);
+}
+
+bool file_filter::too_large(size_t size) const {
+    if (max_file_size_ == 0 || size <= max_file_size_)
+        return false;
+    idx_files_too_large.inc();
+    return true;
+}
+
+bool file_filter::binary(const string &path, re2::StringPiece contents) const {
+    bool bin;
+    if (matches(path, force_binary_))
+        bin = true;
+    else if (matches(path, force_text_))
+        bin = false;
+    else if (has_extension(path, binary_extensions_))
+        bin = true;
+    else if (has_extension(path, text_extensions_))
+        bin = false;
+    else {
+        size_t n = contents.size();
+        if (check_bytes_ > 0 && n > check_bytes_)
+            n = check_bytes_;
+        size_t nulls = count(contents.data(), contents.data() + n, '\0');
+        bin = max_null_fraction_ > 0 ? nulls > max_null_fraction_ * n : nulls > 0;
+    }
+    if (bin)
+        idx_files_binary.inc();
+    return bin;
+}
+
+bool file_filter::prune(const string &dir) const {
+    string d = dir;
+    if (d.empty() || d[d.size() - 1] != '/')
+        d += "/";
+    for (auto &p : excludes_) {
+        if (p.recursive && RE2::FullMatch(d, *p.re))
+            return true;
+    }
+    return false;
+}
+
+bool file_filter::transcode(re2::StringPiece contents, string *out) const {
+    return ::transcode(contents, encodings_, out);
+}
+
+bool file_filter::generated_path(const string &path) {
+    static const vector<pattern> generated_globs = [] {
+        vector<pattern> globs;
+        for (const char *g : kGeneratedGlobs)
+            globs.push_back(compile(g));
+        return globs;
+    }();
+    return matches(path, generated_globs);
+}
+
+bool file_filter::generated(const string &path) const {
+    if (!exclude_generated_)
+        return false;
+    static const vector<pattern> vendored_globs = [] {
+        vector<pattern> globs;
+        for (const char *g : kVendoredGlobs)
+            globs.push_back(compile(g));
+        return globs;
+    }();
+
+    bool gen = generated_path(path);
+    bool vendored = matches(path, vendored_globs);
+    apply_attributes(path, &gen, &vendored);
+    if (gen || vendored) {
+        idx_files_generated.inc();
+        return true;
+    }
+    return false;
+}
+
+bool file_filter::minified(const string &path, re2::StringPiece contents) const {
+    static const vector<string> exts = {".js", ".mjs", ".cjs", ".css"};
+    if (!exclude_generated_ || !has_extension(path, exts) || !minified_contents(contents))
+        return false;
+    bool gen = true, vendored = false;
+    apply_attributes(path, &gen, &vendored);
+    if (gen || vendored) {
+        idx_files_minified.inc();
+        return true;
+    }
+    return false;
+}
+
+bool file_filter::minified_contents(re2::StringPiece contents) {
+    // Short files are left alone, however long their lines.
+    if (contents.size() <= 1024)
+        return false;
+    size_t lines = std::count(contents.begin(), contents.end(), '\n') + 1;
+    return contents.size() / lines > 110;
+}
+
+void file_filter::apply_attributes(const string &path, bool *gen, bool *vendored) const {
+    // Deeper directories' rules come later, and the last match wins, as
+    // in git.
+    for (auto &attr : attributes_) {
+        if (path.compare(0, attr.dir.size(), attr.dir) != 0)
+            continue;
+        re2::StringPiece rel(path.data() + attr.dir.size(), path.size() - attr.dir.size());
+        if (!RE2::FullMatch(rel, *attr.glob.re))
+            continue;
+        *(attr.vendored ? vendored : gen) = attr.value;
+    }
+}
+
+void file_filter::add_attributes(const string &dir, re2::StringPiece contents) {
+    if (!exclude_generated_)
+        return;
+    RE2::Options opts;
+    opts.set_log_errors(false);
+    istringstream lines(contents.as_string());
+    string line;
+    while (getline(lines, line)) {
+        istringstream fields(line);
+        string glob, name;
+        if (!(fields >> glob) || glob[0] == '#')
+            continue;
+        pattern p;
+        while (fields >> name) {
+            bool value = true;
+            if (name[0] == '-') {
+                value = false;
+                name = name.substr(1);
+            } else if (name.size() > 6 && name.compare(name.size() - 6, 6, "=false") == 0) {
+                value = false;
+                name = name.substr(0, name.size() - 6);
+            } else if (name.size() > 5 && name.compare(name.size() - 5, 5, "=true") == 0) {
+                name = name.substr(0, name.size() - 5);
+            }
+            if (name != "linguist-generated" && name != "linguist-vendored")
+                continue;
+            if (!p.re)
+                p.re = std::make_shared<RE2>(glob_regex(glob, &p.recursive), opts);
+            // Unlike globs in the config, a bad pattern here is the
+            // repository's problem, not ours.
+            if (!p.re->ok())
+                break;
+            attributes_.push_back({dir, p, name == "linguist-vendored", value});
+        }
+    }
+}
+
+void file_filter::drop_attributes(const string &dir) {
+    while (!attributes_.empty() && attributes_.back().dir == dir)
+        attributes_.pop_back();
+}
@@ -0,0 +1,162 @@
+/********************************************************************
+ * livegrep -- file_filter.h
+ * Copyright (c) 2011-2013 Nelson Elhage
+ *
+ * This program is free software. You may use, redistribute, and/or
+ * modify it under the terms listed in the COPYING file.
+ ********************************************************************/
+#ifndef CODESEARCH_FILE_FILTER_H
+#define CODESEARCH_FILE_FILTER_H
+
+#include <memory>
+#include <string>
+#include <vector>
+
+#include "re2/re2.h"
+#include "src/proto/config.pb.h"
+#include "src/redact.h"
+
+// A file left out of the index for exceeding the size limit.
+struct skipped_file {
+    std::string path;
+    size_t size;
+};
+
+// file_filter decides which files of a repository get indexed, based on
+// the file_includes and file_excludes globs and the max_file_size of its
+// RepoSpec (or PathSpec), and on the index_only_extensions and
+// skip_extensions of the RepoSpec and its IndexSpec.
+//
+// Globs are matched against the full path of a file within the
+// repository. `*` and `?` do not match `/`, `**` matches any number of
+// directories, and a glob without a `/` matches the file's basename at
+// any depth (so `*.min.js` excludes minified files everywhere).
+//
+// Extensions are compared case-insensitively against the end of a
+// file's basename, so `.min.js` works as well as `.js`. A repository's
+// index_only_extensions replace the index-wide list; skip_extensions
+// from both are honored.
+//
+// Files that pass are then checked for being binary, per the
+// BinaryDetection of the IndexSpec and RepoSpec, and, if generated
+// files are excluded (--exclude_generated, or the RepoSpec's
+// generated), for being generated or vendored.
+//
+// The filter also carries the symlinks policy, which the indexers
+// apply since following a link depends on what is being walked.
+class file_filter {
+public:
+    enum symlink_policy {
+        // Whatever the indexer did before the policy existed.
+        SYMLINKS_DEFAULT,
+        SYMLINKS_FOLLOW,
+        SYMLINKS_LINK_TEXT,
+        SYMLINKS_SKIP,
+    };
+
+    file_filter();
+    explicit file_filter(const IndexSpec &index);
+    // A filter for a PathSpec, which only has index-wide settings apart
+    // from its globs, symlinks policy and size limit.
+    file_filter(const IndexSpec &index, const PathSpec &spec);
+    file_filter(const IndexSpec &index, const RepoSpec &spec);
+
+    // Returns true if the file at path should be indexed.
+    bool include(const std::string &path) const;
+    // Returns true if a file of the given size is over the size limit,
+    // counting it in the index.files.too_large metric.
+    bool too_large(size_t size) const;
+    // Returns true if the file at path, with the given contents, is
+    // binary and should not be indexed.
+    bool binary(const std::string &path, re2::StringPiece contents) const;
+    // Returns true if generated files are excluded and the file at path
+    // is generated or vendored, going by GitHub linguist's path
+    // heuristics and the linguist-generated and linguist-vendored
+    // attributes added by add_attributes.
+    bool generated(const std::string &path) const;
+    bool exclude_generated() const { return exclude_generated_; }
+    // Returns true if the file at path is of a kind that is usually
+    // generated, by linguist's path heuristics alone.
+    static bool generated_path(const std::string &path);
+    // Returns true if generated files are excluded and the file at path
+    // is minified JavaScript or CSS, going by its contents, unless a
+    // .gitattributes file marks it -linguist-generated.
+    bool minified(const std::string &path, re2::StringPiece contents) const;
+    // Returns true if contents look minified: as in linguist, their
+    // lines average over 110 bytes.
+    static bool minified_contents(re2::StringPiece contents);
+    // If contents isn't UTF-8 but decodes in one of the configured
+    // encodings, stores it converted to UTF-8 in *out and returns true.
+    // Done before the binary check, since UTF-16 is full of NULs.
+    bool transcode(re2::StringPiece contents, std::string *out) const;
+    // Masks secrets in contents per the Redaction of the IndexSpec and
+    // RepoSpec; see redactor::redact.
+    int redact(re2::StringPiece contents, std::string *out) const {
+        return redactor_.redact(contents, out);
+    }
+    // Adds the rules of the .gitattributes file in dir, "" or ending in
+    // "/", for files below it. Indexers add each directory's rules as
+    // they walk into it and drop them as they leave.
+    void add_attributes(const std::string &dir, re2::StringPiece contents);
+    void drop_attributes(const std::string &dir);
+    // Returns true if no file below the directory at path can be
+    // indexed, so the walk can skip it entirely.
+    bool prune(const std::string &dir) const;
+
+    symlink_policy symlinks() const { return symlinks_; }
+
+private:
+    struct pattern {
+        std::shared_ptr<RE2> re;
+        // set for globs ending in `**`, which match everything below
+        // any directory they match
+        bool recursive;
+    };
+
+    // A linguist-generated or linguist-vendored attribute from a
+    // .gitattributes file.
+    struct attribute {
+        std::string dir;
+        pattern glob;
+        bool vendored;
+        bool value;
+    };
+
+    static pattern compile(const std::string &glob);
+    static std::string glob_regex(const std::string &glob, bool *recursive);
+    static std::string normalize_extension(const std::string &ext);
+    static bool has_extension(const std::string &path,
+                              const std::vector<std::string> &exts);
+    static bool matches(const std::string &path,
+                        const std::vector<pattern> &patterns);
+    // Applies the linguist-generated and linguist-vendored attributes
+    // that match path to *gen and *vendored.
+    void apply_attributes(const std::string &path, bool *gen, bool *vendored) const;
+    void add_binary_detection(const BinaryDetection &bd);
+    void set_symlinks(const std::string &policy);
+    void set_encodings(const google::protobuf::RepeatedPtrField<std::string> &encodings);
+
+    std::vector<pattern> includes_;
+    std::vector<pattern> excludes_;
+    std::vector<std::string> only_extensions_;
+    std::vector<std::string> skip_extensions_;
+    size_t max_file_size_;
+
+    std::vector<pattern> force_text_;
+    std::vector<pattern> force_binary_;
+    std::vector<std::string> text_extensions_;
+    std::vector<std::string> binary_extensions_;
+    double max_null_fraction_;
+    size_t check_bytes_;
+
+    symlink_policy symlinks_;
+
+    bool exclude_generated_;
+    std::vector<attribute> attributes_;
+
+    std::vector<std::string> encodings_;
+
+    redactor redactor_;
+};
+
+#endif
@@ -18,18 +18,64 @@ fs_indexer::fs_indexer(code_searcher *cs,
                        const string& repopath,
                        const string& name,
                        const Metadata &metadata,
-                       const bool& ignore_symlinks)
-    : cs_(cs), repopath_(repopath), name_(name), ignore_symlinks_(ignore_symlinks) {
+                       const bool& ignore_symlinks,
+                       const file_filter &filter)
+    : cs_(cs), repopath_(repopath), name_(name), filter_(filter),
+      symlinks_(filter.symlinks()) {
+    if (symlinks_ == file_filter::SYMLINKS_DEFAULT)
+        symlinks_ = ignore_symlinks ? file_filter::SYMLINKS_SKIP : file_filter::SYMLINKS_FOLLOW;
     tree_ = cs->open_tree(name, metadata, "");
 }
 
 fs_indexer::~fs_indexer() {
 }
 
+// Returns path relative to the root being indexed. Unlike fs::relative
+// this doesn't resolve symlinks, so followed links are indexed at their
+// own paths rather than their targets'.
+fs::path fs_indexer::relative(const fs::path& path) {
+    return path.lexically_normal().lexically_relative(fs::path(repopath_).lexically_normal());
+}
+
+// Applies the symlinks policy if path is a link, returning true if the
+// walk should not follow it.
+bool fs_indexer::skip_symlink(const fs::path& path) {
+    if (symlinks_ == file_filter::SYMLINKS_FOLLOW || !fs::is_symlink(path))
+        return false;
+    if (symlinks_ == file_filter::SYMLINKS_LINK_TEXT) {
+        fs::path relpath = relative(path);
+        if (filter_.include(relpath.string()))
+            cs_->index_file(tree_, relpath.string(), fs::read_symlink(path).string());
+    }
+    return true;
+}
+
 void fs_indexer::read_file(const fs::path& path) {
+    fs::path relpath = relative(path);
+    if (!filter_.include(relpath.string()) || filter_.generated(relpath.string()))
+        return;
+    boost::system::error_code ec;
+    uintmax_t size = fs::file_size(path, ec);
+    if (!ec && filter_.too_large(size)) {
+        skipped_too_large_.push_back({relpath.string(), size_t(size)});
+        return;
+    }
     ifstream in(path.c_str(), ios::in);
-    fs::path relpath = fs::relative(path, repopath_);
-    cs_->index_file(tree_, relpath.string(), StringPiece(static_cast<stringstream const&>(stringstream() << in.rdbuf()).str().c_str(), fs::file_size(path)));
+    stringstream contents;
+    contents << in.rdbuf();
+    string data = contents.str();
+    string utf8;
+    if (filter_.transcode(data, &utf8))
+        data.swap(utf8);
+    if (filter_.binary(relpath.string(), data) ||
+        filter_.minified(relpath.string(), data))
+        return;
+    string redacted;
+    if (int secrets = filter_.redact(data, &redacted)) {
+        data.swap(redacted);
+        redacted_.push_back({relpath.string(), secrets});
+    }
+    cs_->index_file(tree_, relpath.string(), data);
 }
 
 void fs_indexer::walk_contents_file(const fs::path& contents_file_path) {
@@ -40,7 +86,9 @@ void fs_indexer::walk_contents_file(const fs::path& contents_file_path) {
     string path;
     while (std::getline(contents_file, path)) {
         if (path.length()) {
-            read_file(fs::path(repopath_) / path);
+            fs::path p = fs::path(repopath_) / path;
+            if (!skip_symlink(p))
+                read_file(p);
         }
     }
 }
@@ -53,14 +101,32 @@ void fs_indexer::walk(const fs::path& path) {
     if (!fs::exists(path)) return;
     fs::directory_iterator end_itr;
     if (fs::is_directory(path)) {
+        boost::system::error_code cec;
+        string dir = fs::canonical(path, cec).string();
+        if (!cec && !walking_.insert(dir).second) {
+            fprintf(stderr, "WARN: %s is a symlink cycle, skipping.\n", path.c_str());
+            return;
+        }
+        string reldir = relative(path).string();
+        reldir = reldir == "." ? "" : reldir + "/";
+        if (filter_.exclude_generated()) {
+            ifstream in((path / ".gitattributes").c_str(), ios::in);
+            if (in.is_open()) {
+                stringstream attrs;
+                attrs << in.rdbuf();
+                filter_.add_attributes(reldir, attrs.str());
+            }
+        }
         for (fs::directory_iterator itr(path, fs::directory_options::skip_permission_denied);
                 itr != end_itr;
                 ++itr) {
             boost::system::error_code ec;
-            if (ignore_symlinks_ && fs::is_symlink(itr->path())) {
+            if (skip_symlink(itr->path())) {
                 continue;
             }
             if (fs::is_directory(itr->status(ec)) ) {
+                if (filter_.prune(relative(itr->path()).string()))
+                    continue;
                 fs_indexer::walk(itr->path());
             } else if (fs::is_regular_file(itr->status(ec)) ) {
                 fs_indexer::read_file(itr->path());
@@ -69,6 +135,9 @@ void fs_indexer::walk(const fs::path& path) {
                 fprintf(stderr, "WARN: %s is inaccessible.\n", itr->path().c_str());
             }
         }
+        filter_.drop_attributes(reldir);
+        if (!cec)
+            walking_.erase(dir);
     } else if (fs::is_regular_file(path)) {
         fs_indexer::read_file(path);
     }
@@ -8,7 +8,10 @@
 #ifndef CODESEARCH_FS_INDEXER_H
 #define CODESEARCH_FS_INDEXER_H
 
+#include <set>
 #include <string>
+#include <vector>
+#include "src/file_filter.h"
 #include "src/proto/config.pb.h"
 
 class code_searcher;
@@ -22,17 +25,31 @@ public:
                const string& repopath,
                const string& name,
                const Metadata &metadata,
-               const bool& ignore_symlinks);
+               const bool& ignore_symlinks,
+               const file_filter &filter = file_filter());
     ~fs_indexer();
     void walk(const boost::filesystem::path& path);
     void walk_contents_file(const boost::filesystem::path& contents_file_path);
+
+    // The files skipped for exceeding the size limit.
+    const std::vector<skipped_file> &skipped_too_large() const { return skipped_too_large_; }
+    // The files that had secrets masked.
+    const std::vector<redacted_file> &redacted() const { return redacted_; }
 protected:
     code_searcher *cs_;
     std::string repopath_;
     std::string name_;
     const indexed_tree *tree_;
-    bool ignore_symlinks_;
+    file_filter filter_;
+    file_filter::symlink_policy symlinks_;
+    // The directories being walked, to stop followed links from
+    // leading back into one of them.
+    std::set<std::string> walking_;
+    std::vector<skipped_file> skipped_too_large_;
+    std::vector<redacted_file> redacted_;
 
+    boost::filesystem::path relative(const boost::filesystem::path& path);
+    bool skip_symlink(const boost::filesystem::path& path);
     void read_file(const boost::filesystem::path& path);
 };
 
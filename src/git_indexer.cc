@@ -1,4 +1,5 @@
 #include <gflags/gflags.h>
+#include <memory>
 #include <sstream>
 
 #include "src/lib/metrics.h"
@@ -6,6 +7,7 @@
 
 #include "src/codesearch.h"
 #include "src/git_indexer.h"
+#include "src/previous_index.h"
 #include "src/smart_git.h"
 
 #include "src/proto/config.pb.h"
@@ -15,13 +17,63 @@ using namespace std;
 DEFINE_string(order_root, "", "Walk top-level directories in this order.");
 DEFINE_bool(revparse, false, "Display parsed revisions, rather than as-provided");
 
+static metric idx_files_filtered("index.files.filtered");
+static metric idx_symlinks_skipped("index.symlinks.skipped");
+
+// As many symlinks as a path may go through before it is assumed to be
+// a loop, as in Linux.
+static const int kMaxLinkHops = 40;
+
+static string blob_text(git_blob *blob) {
+    return string(static_cast<const char*>(git_blob_rawcontent(blob)), git_blob_rawsize(blob));
+}
+
+// Replaces *path, the path of a symlink within a tree, with the path
+// target resolves to from there. Returns false if that is outside the
+// tree, or the tree itself.
+static bool resolve_link(string *path, const string &target) {
+    if (target.empty() || target[0] == '/')
+        return false;
+    size_t slash = path->rfind('/');
+    string joined = (slash == string::npos ? "" : path->substr(0, slash + 1)) + target;
+
+    vector<string> parts;
+    size_t start = 0;
+    while (start <= joined.size()) {
+        size_t end = joined.find('/', start);
+        if (end == string::npos)
+            end = joined.size();
+        string part = joined.substr(start, end - start);
+        if (part == "..") {
+            if (parts.empty())
+                return false;
+            parts.pop_back();
+        } else if (!part.empty() && part != ".") {
+            parts.push_back(part);
+        }
+        start = end + 1;
+    }
+    if (parts.empty())
+        return false;
+
+    path->clear();
+    for (auto &part : parts) {
+        if (!path->empty())
+            *path += "/";
+        *path += part;
+    }
+    return true;
+}
+
 git_indexer::git_indexer(code_searcher *cs,
                          const string& repopath,
                          const string& name,
                          const Metadata &metadata,
-                         bool walk_submodules)
-    : cs_(cs), repo_(0), repopath_(repopath), name_(name), metadata_(metadata)
-    , walk_submodules_(walk_submodules) {
+                         bool walk_submodules,
+                         const file_filter &filter,
+                         previous_index *previous)
+    : cs_(cs), repo_(0), root_tree_(0), repopath_(repopath), name_(name), metadata_(metadata)
+    , walk_submodules_(walk_submodules), filter_(filter), previous_(previous) {
     int err;
     if ((err = git_libgit2_init()) < 0)
         die("git_libgit2_init: %s", giterr_last()->message);
@@ -54,12 +106,35 @@ void git_indexer::walk(const string& ref) {
         strdup(git_oid_tostr(oidstr, sizeof(oidstr), git_commit_id(commit))) : ref;
 
     idx_tree_ = cs_->open_tree(name_, metadata_, version);
+    // Submodules are indexed as trees of their own, which the previous
+    // index can't tell apart from the parent's, so repositories with
+    // submodules are always walked.
+    if (previous_ && FLAGS_revparse && !walk_submodules_ &&
+        previous_->copy_tree(cs_, idx_tree_, filter_, &skipped_too_large_, &redacted_)) {
+        fprintf(stderr, "  unchanged since the previous index, reused it\n");
+        return;
+    }
+    root_tree_ = tree;
     walk_tree("", FLAGS_order_root, tree);
+    root_tree_ = 0;
 }
 
 void git_indexer::walk_tree(const string& pfx,
                             const string& order,
                             git_tree *tree) {
+    char tree_oid[GIT_OID_HEXSZ + 1];
+    git_oid_tostr(tree_oid, sizeof(tree_oid), git_tree_id(tree));
+    walking_.insert(tree_oid);
+
+    string dir = submodule_prefix_ + pfx;
+    if (filter_.exclude_generated()) {
+        const git_tree_entry *attrs = git_tree_entry_byname(tree, ".gitattributes");
+        smart_object<git_object> obj;
+        if (attrs && git_tree_entry_type(attrs) == GIT_OBJ_BLOB &&
+            git_tree_entry_to_object(obj, repo_, attrs) == 0)
+            filter_.add_attributes(dir, blob_text(obj));
+    }
+
     map<string, const git_tree_entry *> root;
     vector<const git_tree_entry *> ordered;
     int entries = git_tree_entrycount(tree);
@@ -96,10 +171,20 @@ void git_indexer::walk_tree(const string& pfx,
         string path = pfx + git_tree_entry_name(*it);
 
         if (git_tree_entry_type(*it) == GIT_OBJ_TREE) {
+            if (filter_.prune(submodule_prefix_ + path))
+                continue;
             walk_tree(path + "/", "", obj);
         } else if (git_tree_entry_type(*it) == GIT_OBJ_BLOB) {
-            const char *data = static_cast<const char*>(git_blob_rawcontent(obj));
-            cs_->index_file(idx_tree_, submodule_prefix_ + path, StringPiece(data, git_blob_rawsize(obj)));
+            // Symlinks are blobs holding the link text, which is
+            // indexed unless the policy says otherwise.
+            if (git_tree_entry_filemode(*it) == GIT_FILEMODE_LINK &&
+                (filter_.symlinks() == file_filter::SYMLINKS_FOLLOW ||
+                 filter_.symlinks() == file_filter::SYMLINKS_SKIP)) {
+                if (filter_.symlinks() == file_filter::SYMLINKS_FOLLOW)
+                    follow_link(path, blob_text(obj));
+                continue;
+            }
+            index_blob(path, obj);
         } else if (git_tree_entry_type(*it) == GIT_OBJ_COMMIT) {
             // Submodule
             if (!walk_submodules_) {
@@ -114,10 +199,78 @@ void git_indexer::walk_tree(const string& pfx,
             string sub_repopath = repopath_ + "/" + path;
             Metadata meta;
 
-            git_indexer sub_indexer(cs_, sub_repopath, string(sub_name), meta, walk_submodules_);
+            git_indexer sub_indexer(cs_, sub_repopath, string(sub_name), meta, walk_submodules_, filter_);
             sub_indexer.submodule_prefix_ = submodule_prefix_ + path + "/";
 
             sub_indexer.walk(string(oid));
+            auto &sub_skipped = sub_indexer.skipped_too_large();
+            skipped_too_large_.insert(skipped_too_large_.end(), sub_skipped.begin(), sub_skipped.end());
+            redacted_.insert(redacted_.end(), sub_indexer.redacted().begin(), sub_indexer.redacted().end());
+        }
+    }
+    filter_.drop_attributes(dir);
+    walking_.erase(tree_oid);
+}
+
+void git_indexer::index_blob(const string& path, git_blob *blob) {
+    if (!filter_.include(submodule_prefix_ + path)) {
+        idx_files_filtered.inc();
+        return;
+    }
+    if (filter_.generated(submodule_prefix_ + path))
+        return;
+    git_off_t size = git_blob_rawsize(blob);
+    if (filter_.too_large(size)) {
+        skipped_too_large_.push_back({submodule_prefix_ + path, size_t(size)});
+        return;
+    }
+    StringPiece contents(static_cast<const char*>(git_blob_rawcontent(blob)), size);
+    string utf8;
+    if (filter_.transcode(contents, &utf8))
+        contents = utf8;
+    if (filter_.binary(submodule_prefix_ + path, contents) ||
+        filter_.minified(submodule_prefix_ + path, contents))
+        return;
+    string redacted;
+    if (int secrets = filter_.redact(contents, &redacted)) {
+        contents = redacted;
+        redacted_.push_back({submodule_prefix_ + path, secrets});
+    }
+    cs_->index_file(idx_tree_, submodule_prefix_ + path, contents);
+}
+
+// Indexes what the symlink at path, pointing at target, resolves to as
+// though it were a copy at path. Links that leave the tree, dangle, or
+// lead back into a directory being walked are skipped.
+void git_indexer::follow_link(const string& path, const string& target) {
+    string resolved = path;
+    string link = target;
+    for (int hops = 0; hops < kMaxLinkHops; ++hops) {
+        if (!resolve_link(&resolved, link))
+            break;
+        git_tree_entry *ent;
+        if (git_tree_entry_bypath(&ent, root_tree_, resolved.c_str()) != 0)
+            break;
+        unique_ptr<git_tree_entry, void (*)(git_tree_entry *)> guard(ent, git_tree_entry_free);
+        smart_object<git_object> obj;
+        if (git_tree_entry_type(ent) == GIT_OBJ_COMMIT ||
+            git_tree_entry_to_object(obj, repo_, ent) != 0)
+            break;
+
+        if (git_tree_entry_type(ent) == GIT_OBJ_TREE) {
+            char oid[GIT_OID_HEXSZ + 1];
+            git_oid_tostr(oid, sizeof(oid), git_tree_entry_id(ent));
+            if (walking_.count(oid))
+                break;
+            if (!filter_.prune(submodule_prefix_ + path))
+                walk_tree(path + "/", "", obj);
+            return;
+        }
+        if (git_tree_entry_filemode(ent) != GIT_FILEMODE_LINK) {
+            index_blob(path, obj);
+            return;
         }
+        link = blob_text(obj);
     }
+    idx_symlinks_skipped.inc();
 }
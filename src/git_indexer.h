@@ -8,12 +8,17 @@
 #ifndef CODESEARCH_GIT_INDEXER_H
 #define CODESEARCH_GIT_INDEXER_H
 
+#include <set>
 #include <string>
+#include <vector>
 #include "src/proto/config.pb.h"
+#include "src/file_filter.h"
 
 class code_searcher;
 class git_repository;
 class git_tree;
+class git_blob;
+class previous_index;
 struct indexed_tree;
 
 class git_indexer {
@@ -22,21 +27,39 @@ public:
                 const std::string& repopath,
                 const std::string& name,
                 const Metadata &metadata,
-                bool walk_submodules);
+                bool walk_submodules,
+                const file_filter &filter = file_filter(),
+                previous_index *previous = nullptr);
     ~git_indexer();
     void walk(const std::string& ref);
+
+    // The files skipped for exceeding the size limit.
+    const std::vector<skipped_file> &skipped_too_large() const { return skipped_too_large_; }
+    // The files that had secrets masked.
+    const std::vector<redacted_file> &redacted() const { return redacted_; }
 protected:
     void walk_tree(const std::string& pfx,
                    const std::string& order,
                    git_tree *tree);
+    void index_blob(const std::string& path, git_blob *blob);
+    void follow_link(const std::string& path, const std::string& target);
 
     code_searcher *cs_;
     git_repository *repo_;
     const indexed_tree *idx_tree_;
+    // The tree walk() is walking, which symlinks are resolved within.
+    git_tree *root_tree_;
+    // The IDs of the trees being walked, to stop followed symlinks from
+    // leading back into one of them.
+    std::set<std::string> walking_;
     std::string repopath_;
     std::string name_;
     Metadata metadata_;
     bool walk_submodules_;
+    file_filter filter_;
+    previous_index *previous_;
+    std::vector<skipped_file> skipped_too_large_;
+    std::vector<redacted_file> redacted_;
     std::string submodule_prefix_;
 };
 
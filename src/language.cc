@@ -0,0 +1,282 @@
+/********************************************************************
+ * livegrep -- language.cc
+ * Copyright (c) 2011-2013 Nelson Elhage
+ *
+ * This program is free software. You may use, redistribute, and/or
+ * modify it under the terms listed in the COPYING file.
+ ********************************************************************/
+#include <algorithm>
+#include <ctype.h>
+#include <string.h>
+#include <unordered_map>
+
+#include "src/language.h"
+#include "src/file_filter.h"
+
+using namespace std;
+using re2::StringPiece;
+
+const char kLanguageGenerated[] = "generated";
+
+// How much of a file's start its header, #! line and modeline are
+// looked for in.
+static const size_t kHeaderBytes = 1024;
+
+// Files known by their whole name.
+static const unordered_map<string, string> kFilenames = {
+    {"Makefile", "makefile"}, {"makefile", "makefile"}, {"GNUmakefile", "makefile"},
+    {"Dockerfile", "dockerfile"}, {"Containerfile", "dockerfile"},
+    {"BUILD", "starlark"}, {"BUILD.bazel", "starlark"}, {"WORKSPACE", "starlark"},
+    {"WORKSPACE.bazel", "starlark"}, {"MODULE.bazel", "starlark"}, {"BUCK", "starlark"},
+    {"Tiltfile", "starlark"},
+    {"CMakeLists.txt", "cmake"}, {"meson.build", "meson"},
+    {"Gemfile", "ruby"}, {"Rakefile", "ruby"}, {"Podfile", "ruby"}, {"Vagrantfile", "ruby"},
+    {"Guardfile", "ruby"}, {"Fastfile", "ruby"},
+    {"Jenkinsfile", "groovy"},
+    {"SConstruct", "python"}, {"SConscript", "python"},
+    {"go.mod", "go-module"}, {"go.work", "go-module"}, {"go.sum", "go-module"},
+    {"Cargo.lock", "toml"}, {"Pipfile", "toml"},
+    {"PKGBUILD", "shell"}, {".bashrc", "shell"}, {".bash_profile", "shell"},
+    {".zshrc", "shell"}, {".profile", "shell"},
+    {".vimrc", "vim"}, {".emacs", "emacs-lisp"},
+};
+
+// Extensions, lower case and without their dot, of one language, or
+// of the one most files with them are in.
+static const unordered_map<string, string> kExtensions = {
+    {"go", "go"},
+    {"c", "c"}, {"h", "c"},
+    {"cc", "cpp"}, {"cpp", "cpp"}, {"cxx", "cpp"}, {"c++", "cpp"}, {"hh", "cpp"},
+    {"hpp", "cpp"}, {"hxx", "cpp"}, {"h++", "cpp"}, {"ipp", "cpp"}, {"inl", "cpp"},
+    {"cu", "cuda"}, {"cuh", "cuda"},
+    {"m", "objective-c"}, {"mm", "objective-c++"},
+    {"java", "java"}, {"kt", "kotlin"}, {"kts", "kotlin"}, {"scala", "scala"}, {"sc", "scala"},
+    {"groovy", "groovy"}, {"gradle", "groovy"}, {"clj", "clojure"}, {"cljs", "clojure"},
+    {"cljc", "clojure"}, {"edn", "clojure"},
+    {"cs", "csharp"}, {"fs", "fsharp"}, {"fsx", "fsharp"}, {"vb", "visual-basic"},
+    {"py", "python"}, {"pyi", "python"}, {"pyw", "python"}, {"pyx", "cython"}, {"pxd", "cython"},
+    {"bzl", "starlark"}, {"star", "starlark"},
+    {"rb", "ruby"}, {"rake", "ruby"}, {"gemspec", "ruby"}, {"erb", "html+erb"},
+    {"rs", "rust"}, {"swift", "swift"}, {"dart", "dart"}, {"zig", "zig"}, {"nim", "nim"},
+    {"d", "d"}, {"cr", "crystal"}, {"v", "verilog"}, {"sv", "systemverilog"},
+    {"vhd", "vhdl"}, {"vhdl", "vhdl"},
+    {"js", "javascript"}, {"mjs", "javascript"}, {"cjs", "javascript"}, {"jsx", "javascript"},
+    {"ts", "typescript"}, {"mts", "typescript"}, {"cts", "typescript"}, {"tsx", "typescript"},
+    {"vue", "vue"}, {"svelte", "svelte"}, {"coffee", "coffeescript"}, {"elm", "elm"},
+    {"html", "html"}, {"htm", "html"}, {"xhtml", "html"},
+    {"css", "css"}, {"scss", "scss"}, {"sass", "sass"}, {"less", "less"}, {"styl", "stylus"},
+    {"php", "php"}, {"phtml", "php"},
+    {"pl", "perl"}, {"pm", "perl"}, {"t", "perl"}, {"pod", "perl"},
+    {"sh", "shell"}, {"bash", "shell"}, {"zsh", "shell"}, {"ksh", "shell"}, {"fish", "fish"},
+    {"ps1", "powershell"}, {"psm1", "powershell"}, {"bat", "batch"}, {"cmd", "batch"},
+    {"lua", "lua"}, {"tcl", "tcl"}, {"r", "r"}, {"jl", "julia"},
+    {"hs", "haskell"}, {"lhs", "haskell"}, {"ml", "ocaml"}, {"mli", "ocaml"},
+    {"ex", "elixir"}, {"exs", "elixir"}, {"erl", "erlang"}, {"hrl", "erlang"},
+    {"el", "emacs-lisp"}, {"lisp", "common-lisp"}, {"lsp", "common-lisp"},
+    {"scm", "scheme"}, {"ss", "scheme"}, {"rkt", "racket"}, {"vim", "vim"},
+    {"f", "fortran"}, {"f90", "fortran"}, {"f95", "fortran"}, {"for", "fortran"},
+    {"pas", "pascal"}, {"s", "assembly"}, {"asm", "assembly"},
+    {"sql", "sql"}, {"graphql", "graphql"}, {"gql", "graphql"},
+    {"proto", "protobuf"}, {"thrift", "thrift"}, {"capnp", "capn-proto"},
+    {"json", "json"}, {"jsonc", "json"}, {"json5", "json5"}, {"jsonnet", "jsonnet"},
+    {"libsonnet", "jsonnet"},
+    {"yaml", "yaml"}, {"yml", "yaml"}, {"toml", "toml"}, {"ini", "ini"}, {"cfg", "ini"},
+    {"xml", "xml"}, {"xsd", "xml"}, {"xsl", "xslt"}, {"xslt", "xslt"}, {"plist", "xml"},
+    {"svg", "svg"},
+    {"tf", "hcl"}, {"tfvars", "hcl"}, {"hcl", "hcl"}, {"nix", "nix"},
+    {"cmake", "cmake"}, {"mk", "makefile"}, {"mak", "makefile"}, {"ninja", "ninja"},
+    {"dockerfile", "dockerfile"},
+    {"md", "markdown"}, {"markdown", "markdown"}, {"mdown", "markdown"}, {"mkdn", "markdown"},
+    {"rst", "restructuredtext"}, {"adoc", "asciidoc"}, {"asciidoc", "asciidoc"},
+    {"org", "org"}, {"tex", "tex"}, {"sty", "tex"}, {"bib", "bibtex"}, {"txt", "text"},
+    {"sol", "solidity"}, {"tpl", "smarty"}, {"mustache", "mustache"},
+    {"hbs", "handlebars"}, {"j2", "jinja"}, {"jinja", "jinja"},
+    {"diff", "diff"}, {"patch", "diff"}, {"csv", "csv"}, {"tsv", "tsv"},
+};
+
+// Interpreters of #! lines, and the names of Emacs modes and Vim
+// filetypes, that aren't languages' own names, the versions of
+// interpreters left out.
+static const unordered_map<string, string> kInterpreters = {
+    {"sh", "shell"}, {"bash", "shell"}, {"zsh", "shell"}, {"ksh", "shell"}, {"dash", "shell"},
+    {"ash", "shell"}, {"mksh", "shell"}, {"csh", "shell"}, {"tcsh", "shell"},
+    {"shell-script", "shell"},
+    {"node", "javascript"}, {"nodejs", "javascript"}, {"js", "javascript"},
+    {"deno", "typescript"}, {"ts-node", "typescript"}, {"bun", "typescript"},
+    {"js2", "javascript"},
+    {"python", "python"}, {"pypy", "python"}, {"py", "python"},
+    {"ruby", "ruby"}, {"jruby", "ruby"}, {"rb", "ruby"},
+    {"perl", "perl"}, {"cperl", "perl"},
+    {"php", "php"}, {"lua", "lua"}, {"luajit", "lua"},
+    {"rscript", "r"}, {"tclsh", "tcl"}, {"wish", "tcl"},
+    {"awk", "awk"}, {"gawk", "awk"}, {"mawk", "awk"}, {"nawk", "awk"},
+    {"make", "makefile"}, {"runghc", "haskell"}, {"runhaskell", "haskell"},
+    {"escript", "erlang"}, {"elixir", "elixir"}, {"julia", "julia"},
+    {"swift", "swift"}, {"groovy", "groovy"}, {"scala", "scala"},
+    {"pwsh", "powershell"}, {"powershell", "powershell"},
+    {"osascript", "applescript"}, {"crystal", "crystal"}, {"fish", "fish"},
+    {"c++", "cpp"}, {"emacs-lisp", "emacs-lisp"}, {"elisp", "emacs-lisp"},
+    {"go", "go"}, {"rust", "rust"}, {"c", "c"}, {"cpp", "cpp"}, {"java", "java"},
+    {"yaml", "yaml"}, {"json", "json"}, {"sql", "sql"},
+};
+
+static string base_name(const string &path) {
+    size_t slash = path.rfind('/');
+    return slash == string::npos ? path : path.substr(slash + 1);
+}
+
+static string lower(string s) {
+    std::transform(s.begin(), s.end(), s.begin(), ::tolower);
+    return s;
+}
+
+static bool has_prefix(StringPiece contents, StringPiece prefix) {
+    return contents.size() >= prefix.size() &&
+        memcmp(contents.data(), prefix.data(), prefix.size()) == 0;
+}
+
+static bool contains(StringPiece contents, const RE2 &re) {
+    return RE2::PartialMatch(contents, re);
+}
+
+// Returns the language of an interpreter or mode named name, such as
+// "python3.11" or "/usr/bin/env", with its version left out.
+static string interpreter_language(string name) {
+    name = lower(base_name(name));
+    auto it = kInterpreters.find(name);
+    if (it != kInterpreters.end())
+        return it->second;
+    size_t end = name.find_last_not_of("0123456789.");
+    if (end != string::npos && end + 1 < name.size()) {
+        it = kInterpreters.find(name.substr(0, end + 1));
+        if (it != kInterpreters.end())
+            return it->second;
+    }
+    return "";
+}
+
+// Returns the language the #! line at the start of contents runs, if
+// it is one.
+static string shebang_language(StringPiece header) {
+    static const RE2 shebang("^#![ \\t]*(\\S+)[ \\t]*([^\\n]*)");
+    string interpreter, args;
+    if (!RE2::PartialMatch(header, shebang, &interpreter, &args))
+        return "";
+    if (base_name(interpreter) == "env") {
+        // The interpreter is the first argument that isn't a flag or a
+        // variable setting, as in `#!/usr/bin/env -S FOO=1 python3 -u`.
+        static const RE2 arg("(\\S+)");
+        StringPiece rest(args);
+        string a;
+        interpreter.clear();
+        while (RE2::FindAndConsume(&rest, arg, &a)) {
+            if (a[0] != '-' && a.find('=') == string::npos) {
+                interpreter = a;
+                break;
+            }
+        }
+    }
+    return interpreter_language(interpreter);
+}
+
+// Returns the language an Emacs or Vim modeline near the start of
+// contents sets, if it has one.
+static string modeline_language(StringPiece header) {
+    static const RE2 emacs("-\\*-(?:[^\\n]*;)?[ \\t]*(?:mode:[ \\t]*)?([\\w+-]+)[ \\t]*(?:;[^\\n]*)?-\\*-");
+    static const RE2 vim("(?:vim?|ex):[^\\n]*\\b(?:ft|filetype|syntax)=([\\w+-]+)");
+    string mode;
+    if (RE2::PartialMatch(header, emacs, &mode) || RE2::PartialMatch(header, vim, &mode)) {
+        string lang = interpreter_language(mode);
+        if (!lang.empty())
+            return lang;
+        mode = lower(mode);
+        for (auto &ext : kExtensions)
+            if (ext.second == mode)
+                return mode;
+    }
+    return "";
+}
+
+// Picks between the languages that files with the extension ext may
+// be in, going by their contents, or returns "" if ext isn't one of
+// those.
+static string disambiguate(const string &ext, StringPiece contents) {
+    if (ext == "h") {
+        static const RE2 objc("(?m)^[ \\t]*(?:@(?:interface|protocol|end|class)\\b|#import\\b)");
+        static const RE2 cpp("(?m)^[ \\t]*(?:(?:template[ \\t]*<|namespace[ \\t]+\\w*[ \\t]*\\{|"
+                             "class[ \\t]+\\w+[^;\\n]*\\{|using[ \\t]+namespace\\b|#include[ \\t]*<"
+                             "(?:iostream|string|vector|map|memory|algorithm|cstdint|cstdio|"
+                             "cstdlib|utility|functional|thread|mutex)>)|(?:public|private|protected):)|std::");
+        if (contains(contents, objc))
+            return "objective-c";
+        if (contains(contents, cpp))
+            return "cpp";
+        return "c";
+    }
+    if (ext == "m") {
+        static const RE2 objc("(?m)^[ \\t]*(?:@(?:interface|implementation|protocol|end|import)\\b|#import\\b)");
+        static const RE2 matlab("(?m)^[ \\t]*(?:function\\b[^\\n]*[=(]|%[ \\t{]|end[ \\t]*;?[ \\t]*$)");
+        if (!contains(contents, objc) && contains(contents, matlab))
+            return "matlab";
+        return "objective-c";
+    }
+    if (ext == "ts") {
+        // Qt's translations are XML
+        if (has_prefix(contents, "<?xml") || has_prefix(contents, "<!DOCTYPE TS"))
+            return "xml";
+        return "typescript";
+    }
+    if (ext == "inc") {
+        static const RE2 php("<\\?(?:php|=)");
+        return contains(contents, php) ? "php" : "";
+    }
+    if (ext == "pl") {
+        // Prolog's rules and directives; Perl's lines never start so
+        static const RE2 prolog("(?m)^[a-z][\\w]*(?:\\([^\\n]*\\))?[ \\t]*:-|^:-[ \\t]*\\w");
+        static const RE2 perl("(?m)\\buse[ \\t]+(?:strict|warnings)\\b|^[ \\t]*(?:my|sub|package)[ \\t]");
+        if (!contains(contents, perl) && contains(contents, prolog))
+            return "prolog";
+        return "perl";
+    }
+    return "";
+}
+
+string detect_language(const string &path, StringPiece contents) {
+    string name = base_name(path);
+    auto f = kFilenames.find(name);
+    if (f != kFilenames.end())
+        return f->second;
+    if (name.compare(0, 11, "Dockerfile.") == 0 || name.compare(0, 9, "Makefile.") == 0)
+        return name[0] == 'D' ? "dockerfile" : "makefile";
+
+    StringPiece header = contents.substr(0, kHeaderBytes);
+    size_t dot = name.rfind('.');
+    if (dot != string::npos && dot > 0 && dot + 1 < name.size()) {
+        string ext = lower(name.substr(dot + 1));
+        string lang = disambiguate(ext, contents.substr(0, 64 << 10));
+        if (!lang.empty())
+            return lang;
+        auto e = kExtensions.find(ext);
+        if (e != kExtensions.end())
+            return e->second;
+    }
+
+    string lang = shebang_language(header);
+    if (lang.empty())
+        lang = modeline_language(header);
+    return lang;
+}
+
+bool detect_generated(const string &path, const string &language, StringPiece contents) {
+    if (file_filter::generated_path(path))
+        return true;
+
+    static const RE2 header(
+        "DO NOT EDIT|@generated\\b|"
+        "(?i:auto(?:matically)?[ -]?generated|this file (?:is|was) (?:automatically )?generated)");
+    if (contains(contents.substr(0, kHeaderBytes), header))
+        return true;
+
+    return (language == "javascript" || language == "css") &&
+        file_filter::minified_contents(contents);
+}
@@ -0,0 +1,35 @@
+/********************************************************************
+ * livegrep -- language.h
+ * Copyright (c) 2011-2013 Nelson Elhage
+ *
+ * This program is free software. You may use, redistribute, and/or
+ * modify it under the terms listed in the COPYING file.
+ ********************************************************************/
+#ifndef CODESEARCH_LANGUAGE_H
+#define CODESEARCH_LANGUAGE_H
+
+#include <string>
+
+#include "re2/re2.h"
+
+// The pseudo-language lang: matches generated files by, whatever their
+// language.
+extern const char kLanguageGenerated[];
+
+// Returns the language of the file at path with the given contents, as
+// a lower-case name such as "go", "cpp" or "shell", or "" if it isn't
+// recognized. After GitHub's linguist (and enry), the file's name is
+// tried, then its extension, disambiguated by its contents where one
+// extension is used by several languages (such as .h and .m), and then,
+// for files without a known extension, a #! line or an Emacs or Vim
+// modeline.
+std::string detect_language(const std::string &path, re2::StringPiece contents);
+
+// Returns true if the file at path, with the given contents, looks
+// generated: by linguist's path heuristics, a "generated" or "DO NOT
+// EDIT" header near its start, or, for JavaScript and CSS, being
+// minified.
+bool detect_generated(const std::string &path, const std::string &language,
+                      re2::StringPiece contents);
+
+#endif
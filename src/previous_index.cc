@@ -0,0 +1,87 @@
+/********************************************************************
+ * livegrep -- previous_index.cc
+ * Copyright (c) 2011-2013 Nelson Elhage
+ *
+ * This program is free software. You may use, redistribute, and/or
+ * modify it under the terms listed in the COPYING file.
+ ********************************************************************/
+#include "src/lib/metrics.h"
+#include "src/lib/debug.h"
+
+#include "src/previous_index.h"
+#include "src/content.h"
+
+using namespace std;
+
+static metric idx_trees_reused("index.trees.reused");
+static metric idx_files_reused("index.files.reused");
+
+previous_index::previous_index(const string &path) : trees_copied_(0) {
+    prev_.load_index(path);
+
+    map<pair<string, string>, const indexed_tree*> first;
+    for (auto it = prev_.begin_files(); it != prev_.end_files(); ++it) {
+        indexed_file *f = it->get();
+        auto key = make_pair(f->tree->name, f->tree->version);
+        auto ins = first.emplace(key, f->tree);
+        // An index should not contain the same tree twice, but if it
+        // does only reuse one copy of it.
+        if (ins.first->second != f->tree)
+            continue;
+        trees_[key].push_back(f);
+    }
+}
+
+bool previous_index::copy_tree(code_searcher *cs, const indexed_tree *tree,
+                               file_filter filter,
+                               vector<skipped_file> *skipped_too_large,
+                               vector<redacted_file> *redacted) {
+    auto it = trees_.find(make_pair(tree->name, tree->version));
+    if (it == trees_.end())
+        return false;
+
+    if (filter.exclude_generated()) {
+        // The tree isn't walked, so take the linguist attributes from
+        // the .gitattributes files it indexed, by directory so that
+        // parents' rules come first.
+        static const string kAttributes = ".gitattributes";
+        map<string, indexed_file*> attrs;
+        for (indexed_file *f : it->second) {
+            const string &path = f->path;
+            size_t dir = path.size() - kAttributes.size();
+            if (path.size() >= kAttributes.size() &&
+                path.compare(dir, kAttributes.size(), kAttributes) == 0 &&
+                (dir == 0 || path[dir - 1] == '/'))
+                attrs[path.substr(0, dir)] = f;
+        }
+        for (auto &a : attrs)
+            filter.add_attributes(a.first, a.second->content->text(prev_.alloc()));
+    }
+
+    // The same steps as git_indexer::index_blob, so that settings
+    // changed since the previous build apply to the copied files too.
+    for (indexed_file *f : it->second) {
+        if (!filter.include(f->path) || filter.generated(f->path))
+            continue;
+        string buf = f->content->text(prev_.alloc());
+        if (filter.too_large(buf.size())) {
+            skipped_too_large->push_back({f->path, buf.size()});
+            continue;
+        }
+        string utf8;
+        if (filter.transcode(buf, &utf8))
+            buf.swap(utf8);
+        if (filter.binary(f->path, buf) || filter.minified(f->path, buf))
+            continue;
+        string masked;
+        if (int secrets = filter.redact(buf, &masked)) {
+            buf.swap(masked);
+            redacted->push_back({f->path, secrets});
+        }
+        cs->index_file(tree, f->path, buf);
+        idx_files_reused.inc();
+    }
+    idx_trees_reused.inc();
+    trees_copied_++;
+    return true;
+}
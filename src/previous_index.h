@@ -0,0 +1,50 @@
+/********************************************************************
+ * livegrep -- previous_index.h
+ * Copyright (c) 2011-2013 Nelson Elhage
+ *
+ * This program is free software. You may use, redistribute, and/or
+ * modify it under the terms listed in the COPYING file.
+ ********************************************************************/
+#ifndef CODESEARCH_PREVIOUS_INDEX_H
+#define CODESEARCH_PREVIOUS_INDEX_H
+
+#include <map>
+#include <string>
+#include <utility>
+#include <vector>
+
+#include "src/codesearch.h"
+#include "src/file_filter.h"
+
+// previous_index makes incremental rebuilds cheap: it holds an index
+// built by an earlier run, so that trees whose commit has not changed
+// since can be copied out of it instead of being read from their git
+// repositories again.
+//
+// Trees are matched by name and version, so this is only meaningful
+// when versions are commit IDs (--revparse).
+class previous_index {
+public:
+    explicit previous_index(const std::string &path);
+
+    // If the previous index has a tree with the same name and version as
+    // tree, indexes its files into cs under tree and returns true.
+    // Files go through filter as git_indexer's would, so files it now
+    // excludes are dropped and newly configured redactions are applied,
+    // with the files skipped for their size and those that had secrets
+    // masked added to skipped_too_large and redacted. Files excluded at
+    // the time cannot be recovered, so changing a repository's filters
+    // to index more needs a full rebuild to take effect.
+    bool copy_tree(code_searcher *cs, const indexed_tree *tree,
+                   file_filter filter,
+                   std::vector<skipped_file> *skipped_too_large,
+                   std::vector<redacted_file> *redacted);
+
+    int trees_copied() const { return trees_copied_; }
+private:
+    code_searcher prev_;
+    std::map<std::pair<std::string, std::string>, std::vector<indexed_file*>> trees_;
+    int trees_copied_;
+};
+
+#endif
@@ -0,0 +1,60 @@
+/********************************************************************
+ * livegrep -- redact.h
+ * Copyright (c) 2011-2013 Nelson Elhage
+ *
+ * This program is free software. You may use, redistribute, and/or
+ * modify it under the terms listed in the COPYING file.
+ ********************************************************************/
+#ifndef CODESEARCH_REDACT_H
+#define CODESEARCH_REDACT_H
+
+#include <memory>
+#include <string>
+#include <vector>
+
+#include "re2/re2.h"
+#include "src/proto/config.pb.h"
+
+// A file that had secrets masked, for reporting.
+struct redacted_file {
+    std::string path;
+    int secrets;
+};
+
+// redactor masks secrets in file contents before they are indexed, per
+// the Redaction of an IndexSpec and RepoSpec: built-in patterns for
+// private keys and well-known credential formats, patterns from the
+// config, and long tokens random enough to look like keys.
+//
+// Secrets are overwritten with '*' byte for byte, keeping newlines, so
+// that line numbers and the rest of each line are unaffected. A pattern
+// with a capturing group only masks what the group matched.
+//
+// server/redact.go does the same for the file viewer, and must be kept
+// in step with this: both are tested against the cases in
+// test/testdata/redaction.txt.
+class redactor {
+public:
+    redactor();
+    // Adds spec's patterns to those already configured. Its non-zero
+    // entropy thresholds replace the current ones.
+    void add(const Redaction &spec);
+
+    bool enabled() const {
+        return !rules_.empty() || min_entropy_ > 0;
+    }
+    // Returns the number of secrets found in contents, and if there are
+    // any stores contents with them masked in *out.
+    int redact(re2::StringPiece contents, std::string *out) const;
+
+private:
+    void add_rule(const std::string &pattern);
+    bool random_token(re2::StringPiece token) const;
+
+    std::vector<std::shared_ptr<RE2>> rules_;
+    bool builtin_;
+    double min_entropy_;
+    size_t min_entropy_length_;
+};
+
+#endif
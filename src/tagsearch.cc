@@ -96,6 +96,8 @@ bool tag_searcher::transform(query *q, match_result *m) const {
         return false;
     }
     auto file = value->second;
+    if (!accept_language(*q, file))
+        return false;
 
     // iterate through the lines to add context information
     auto line_it = file->content->begin(file_alloc_);
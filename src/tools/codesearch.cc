@@ -11,29 +11,39 @@
 #include "src/lib/fs.h"
 
 #include "src/codesearch.h"
+#include "src/chunk.h"
 #include "src/chunk_allocator.h"
 #include "src/tagsearch.h"
 #include "src/re_width.h"
 #include "src/git_indexer.h"
 #include "src/fs_indexer.h"
+#include "src/previous_index.h"
 
 #include "src/tools/limits.h"
 #include "src/tools/grpc_server.h"
 #include "src/proto/config.pb.h"
 
 #include <stdio.h>
+#include <errno.h>
+#include <string.h>
+#include <unistd.h>
 #include <sys/socket.h>
 #include <arpa/inet.h>
 #include <netdb.h>
 #include <sys/un.h>
 #include <sys/wait.h>
+#include <signal.h>
+#include <pthread.h>
 #include <semaphore.h>
 
+#include <algorithm>
 #include <iostream>
 #include <functional>
+#include <map>
 #include <future>
 #include <thread>
 #include <memory>
+#include <mutex>
 
 #include <gflags/gflags.h>
 
@@ -49,14 +59,25 @@
 DEFINE_string(dump_index, "", "Dump the produced index to a specified file");
 DEFINE_string(load_index, "", "Load the index from a file instead of walking the repository");
 DEFINE_string(load_tags, "", "Load the index built from a tags file.");
+DEFINE_string(reuse_index, "", "Copy repositories whose revisions are unchanged from this previously built index instead of walking them (requires --revparse)");
 DEFINE_bool(quiet, false, "Do the search, but don't print results.");
 DEFINE_bool(index_only, false, "Build the index and don't serve queries");
 DEFINE_string(grpc, "localhost:9999", "GRPC listener address");
 DEFINE_bool(reload_rpc, false, "Enable the Reload RPC");
 DEFINE_bool(hot_index_reload, false, "Enable automatic reloads when the index file changes");
+DEFINE_bool(reload_signal, false, "Reload the index when sent SIGHUP");
+DEFINE_bool(reload_swap, false, "Reload a --load_index by loading it alongside the old index and swapping searches over to it, rather than stopping serving until it has loaded. This needs the memory for both indexes at once, roughly twice what serving one takes");
 DEFINE_bool(reuseport, true, "Set SO_REUSEPORT to enable multiple concurrent server instances.");
 DEFINE_int32(max_recv_message_size, 0, "Maximum gRPC receive (inbound) message size in bytes");
 DEFINE_int32(max_send_message_size, 0, "Maximum gRPC send (outbound) message size in bytes");
+DEFINE_int32(grpc_keepalive_min_time_ms, 0, "Accept keepalive pings from clients as often as this, even when no RPCs are in flight; by default pings more often than every 5 minutes close the connection");
+DEFINE_int32(report_too_large, 10, "After building, list this many of the largest files skipped for exceeding the size limit");
+DEFINE_string(too_large_report, "", "Write each file skipped for exceeding the size limit to this file, as tab-separated repository, path and size in bytes");
+DEFINE_string(redaction_report, "", "Write each file that had secrets masked to this file, as tab-separated repository, path and number of secrets");
+DEFINE_bool(estimate, false, "Walk the configured repositories and print an estimate of the memory needed to serve their index. The deduplicated lines are still built in memory, only the suffix arrays are skipped, so this needs about a fifth of the memory of a full build");
+
+DECLARE_bool(revparse);
+DECLARE_bool(index);
 
 using namespace std;
 using namespace re2;
@@ -70,6 +91,72 @@ void die_errno(const char *str) {
     exit(1);
 }
 
+static string human_bytes(double n) {
+    const char *units[] = {"B", "KiB", "MiB", "GiB", "TiB"};
+    int i = 0;
+    while (n >= 1024 && i < 4) {
+        n /= 1024;
+        i++;
+    }
+    char buf[32];
+    snprintf(buf, sizeof buf, i ? "%.1f%s" : "%.0f%s", n, units[i]);
+    return buf;
+}
+
+// Lists the largest of the files the build skipped for exceeding the
+// size limit, which are usually generated or vendored files worth
+// excluding outright, and writes them all to the --too_large_report, if
+// any. skipped maps (repo, path) to size; a file skipped in several
+// revisions is listed once.
+static void report_too_large(const map<pair<string, string>, size_t> &skipped) {
+    if (FLAGS_too_large_report.size()) {
+        FILE *report = fopen(FLAGS_too_large_report.c_str(), "w");
+        if (!report)
+            die_errno(FLAGS_too_large_report.c_str());
+        for (auto &f : skipped)
+            fprintf(report, "%s\t%s\t%zu\n", f.first.first.c_str(), f.first.second.c_str(), f.second);
+        if (fclose(report) != 0)
+            die_errno(FLAGS_too_large_report.c_str());
+    }
+    if (skipped.empty())
+        return;
+    vector<pair<size_t, string>> files;
+    size_t total = 0;
+    for (auto &f : skipped) {
+        files.emplace_back(f.second, f.first.first + ":" + f.first.second);
+        total += f.second;
+    }
+    fprintf(stderr, "Skipped %zu files over the size limit (%s in all)",
+            files.size(), human_bytes(total).c_str());
+    if (FLAGS_report_too_large <= 0) {
+        fprintf(stderr, "\n");
+        return;
+    }
+    fprintf(stderr, "; the largest:\n");
+    size_t n = min(files.size(), size_t(FLAGS_report_too_large));
+    partial_sort(files.begin(), files.begin() + n, files.end(),
+                 greater<pair<size_t, string>>());
+    for (size_t i = 0; i < n; i++)
+        fprintf(stderr, "  %10s  %s\n", human_bytes(files[i].first).c_str(),
+                files[i].second.c_str());
+}
+
+// Reports the secrets masked in a path or repository, to stderr and to
+// the --redaction_report, if any. Secrets themselves are never
+// reported, only where they were.
+static void report_redactions(const string &name, const vector<redacted_file> &files,
+                              FILE *report) {
+    if (files.empty())
+        return;
+    int secrets = 0;
+    for (auto &f : files) {
+        secrets += f.secrets;
+        if (report)
+            fprintf(report, "%s\t%s\t%d\n", name.c_str(), f.path.c_str(), f.secrets);
+    }
+    fprintf(stderr, "  masked %d secrets in %zu files\n", secrets, files.size());
+}
+
 void build_index(code_searcher *cs, const vector<std::string> &argv) {
     if (argv.size() != 2) {
         fprintf(stderr, "Usage: %s [OPTIONS] config.json\n", argv[0].c_str());
@@ -86,6 +173,11 @@ void build_index(code_searcher *cs, const vector<std::string> &argv) {
         fprintf(stderr, "Parsing %s: %s\n", argv[1].c_str(), status.message().data());
         exit(1);
     }
+    if (spec.include_size()) {
+        fprintf(stderr, "%s: include is not supported by codesearch; "
+                "run the config through livegrep-fetch-reindex instead.\n", argv[1].c_str());
+        exit(1);
+    }
     if (!spec.paths_size() && !spec.repositories_size()) {
         fprintf(stderr, "%s: You must specify at least one path to index.\n", argv[1].c_str());
         exit(1);
@@ -93,10 +185,26 @@ void build_index(code_searcher *cs, const vector<std::string> &argv) {
 
     if (spec.name().size())
         cs->set_name(spec.name());
+    FILE *report = nullptr;
+    if (FLAGS_redaction_report.size()) {
+        report = fopen(FLAGS_redaction_report.c_str(), "w");
+        if (!report)
+            die_errno(FLAGS_redaction_report.c_str());
+    }
+    map<pair<string, string>, size_t> skipped;
+    auto note_skipped = [&](const string &name, const vector<skipped_file> &files) {
+        if (files.size())
+            fprintf(stderr, "  skipped %zu files over the size limit\n", files.size());
+        for (auto &f : files) {
+            size_t &size = skipped[make_pair(name, f.path)];
+            size = max(size, f.size);
+        }
+    };
     for (auto &path : spec.paths()) {
         fprintf(stderr, "Walking path_spec name=%s, path=%s\n",
                 path.name().c_str(), path.path().c_str());
-        fs_indexer indexer(cs, path.path(), path.name(), path.metadata(), path.ignore_symlinks());
+        fs_indexer indexer(cs, path.path(), path.name(), path.metadata(), path.ignore_symlinks(),
+                            file_filter(spec, path));
         if (path.ordered_contents().empty()) {
             fprintf(stderr, "  walking full tree\n");
             indexer.walk(path.path());
@@ -105,24 +213,101 @@ void build_index(code_searcher *cs, const vector<std::string> &argv) {
             fs::path contents_file_path = fs::canonical(path.ordered_contents(), config_file_path.remove_filename());
             indexer.walk_contents_file(contents_file_path);
         }
+        note_skipped(path.name(), indexer.skipped_too_large());
+        report_redactions(path.name(), indexer.redacted(), report);
         fprintf(stderr, "done\n");
     }
 
+    unique_ptr<previous_index> previous;
+    if (FLAGS_reuse_index.size()) {
+        if (!FLAGS_revparse)
+            die("--reuse_index requires --revparse, so that changed revisions can be detected");
+        fprintf(stderr, "Loading previous index %s\n", FLAGS_reuse_index.c_str());
+        previous.reset(new previous_index(FLAGS_reuse_index));
+    }
+
     for (auto &repo  : spec.repositories()) {
         fprintf(stderr, "Walking repo_spec name=%s, path=%s (including  submodules: %s)\n",
                 repo.name().c_str(), repo.path().c_str(), repo.walk_submodules() ? "true" : "false");
-        git_indexer indexer(cs, repo.path(), repo.name(), repo.metadata(), repo.walk_submodules());
+        git_indexer indexer(cs, repo.path(), repo.name(), repo.metadata(), repo.walk_submodules(),
+                            file_filter(spec, repo), previous.get());
         for (auto &rev : repo.revisions()) {
             fprintf(stderr, "  walking %s\n", rev.c_str());
             indexer.walk(rev);
             fprintf(stderr, "  done\n");
         }
+        note_skipped(repo.name(), indexer.skipped_too_large());
+        report_redactions(repo.name(), indexer.redacted(), report);
+    }
+    report_too_large(skipped);
+    if (report && fclose(report) != 0)
+        die_errno(FLAGS_redaction_report.c_str());
+    if (previous)
+        fprintf(stderr, "Reused %d trees from %s\n", previous->trees_copied(), FLAGS_reuse_index.c_str());
+}
+
+// Prints the memory needed to serve the index search has built without
+// suffix arrays. Everything else the backend holds can be measured, and
+// the suffix arrays take four bytes for each byte of chunk data. Chunk
+// data and contents are mapped from the index file rather than
+// allocated, but searches touch all of it, so it needs to fit in memory
+// alongside the rest.
+static void print_estimate(code_searcher *search) {
+    chunk_allocator *alloc = search->alloc();
+    size_t chunks = 0, chunk_data = 0;
+    size_t chunk_files = 0, file_refs = 0;
+    for (auto it = alloc->begin(); it != alloc->end(); ++it) {
+        chunks++;
+        chunk_data += (*it)->size;
+        chunk_files += (*it)->files.size();
+        for (auto &cf : (*it)->files)
+            file_refs += cf.files.size();
+    }
+    size_t content = 0;
+    for (auto it = alloc->begin_content(); it != alloc->end_content(); ++it)
+        content += it->end - it->data;
+    size_t files = 0, paths = 0;
+    for (auto it = search->begin_files(); it != search->end_files(); ++it) {
+        files++;
+        paths += (*it)->path.size() + 1;
     }
+
+    size_t suffixes = chunk_data * sizeof(uint32_t);
+    size_t filenames = paths * (1 + sizeof(uint32_t)) +
+        files * sizeof(pair<int, indexed_file*>);
+    // A list node per file referencing each chunk_file, and a node of the
+    // tree built over them.
+    size_t file_index =
+        files * (sizeof(indexed_file) + sizeof(unique_ptr<indexed_file>)) + paths +
+        chunk_files * (sizeof(chunk_file) + sizeof(chunk_file_node)) +
+        file_refs * 3 * sizeof(void*);
+    size_t total = chunk_data + suffixes + content + filenames + file_index;
+
+    printf("Files:               %zu\n", files);
+    printf("Unique line data:    %s in %zu chunks\n", human_bytes(chunk_data).c_str(), chunks);
+    printf("Suffix arrays:       %s\n", human_bytes(suffixes).c_str());
+    printf("File contents:       %s\n", human_bytes(content).c_str());
+    printf("Filename index:      %s\n", human_bytes(filenames).c_str());
+    printf("File and chunk maps: %s\n", human_bytes(file_index).c_str());
+    printf("Estimated memory to serve: %s\n", human_bytes(total).c_str());
 }
 
 void initialize_search(code_searcher *search,
                        int argc, char **argv) {
+    if (FLAGS_estimate) {
+        if (FLAGS_load_index.size() || FLAGS_dump_index.size())
+            die("--estimate cannot be combined with --load_index or --dump_index");
+        // Suffix arrays are most of an index, and their size follows
+        // from the data's, so don't build them.
+        FLAGS_index = false;
+    }
     if (FLAGS_load_index.size() == 0) {
+        // The dump allocator truncates its file, which would pull the
+        // previous index out from under us.
+        if (FLAGS_reuse_index.size() && FLAGS_dump_index.size() &&
+            fs::exists(FLAGS_reuse_index) && fs::exists(FLAGS_dump_index) &&
+            fs::equivalent(FLAGS_reuse_index, FLAGS_dump_index))
+            die("--reuse_index and --dump_index must be different files");
         if (FLAGS_dump_index.size())
             search->set_alloc(make_dump_allocator(search, FLAGS_dump_index));
         else
@@ -141,6 +326,8 @@ void initialize_search(code_searcher *search,
         fprintf(stderr, "repository indexed in %d.%06ds\n",
                 (int)elapsed.tv_sec, (int)elapsed.tv_usec);
         metric::dump_all();
+        if (FLAGS_estimate)
+            print_estimate(search);
     } else {
         search->load_index(FLAGS_load_index);
     }
@@ -148,11 +335,64 @@ void initialize_search(code_searcher *search,
         search->dump_index(FLAGS_dump_index);
 }
 
-void listen_grpc(code_searcher *search, code_searcher *tags, const string& addr) {
-    promise<void> reload_request;
-    auto reload_request_ptr = FLAGS_reload_rpc ? &reload_request : NULL;
+// load_tags loads --load_tags, if it is given.
+static unique_ptr<code_searcher> load_tags() {
+    unique_ptr<code_searcher> tags;
+    if (FLAGS_load_tags.size() != 0) {
+        tags.reset(new code_searcher());
+        tags->load_index(FLAGS_load_tags);
+    }
+    return tags;
+}
+
+// swap_index loads --load_index, and --load_tags, again, and swaps the
+// searches index serves over to them.
+static grpc::Status swap_index(index_holder *index) {
+    // Loading dies on an index it can't read, so check first that there
+    // is one, to carry on serving the old one if not.
+    for (const string &path : {FLAGS_load_index, FLAGS_load_tags}) {
+        if (path.size() && access(path.c_str(), R_OK) != 0) {
+            string err = path + ": " + strerror(errno);
+            log("Not reloading: %s", err.c_str());
+            return grpc::Status(grpc::StatusCode::FAILED_PRECONDITION, err);
+        }
+    }
+    timer tm;
+    shared_ptr<code_searcher> search(new code_searcher());
+    search->load_index(FLAGS_load_index);
+    shared_ptr<code_searcher> tags(load_tags());
+    log("Loaded the new index in %ldms", timeval_ms(tm.elapsed()));
+    index->swap(search, tags);
+    return grpc::Status::OK;
+}
+
+void listen_grpc(unique_ptr<code_searcher> search, unique_ptr<code_searcher> tags, const string& addr) {
+    index_holder index(move(search), move(tags));
 
-    unique_ptr<CodeSearch::Service> service(build_grpc_server(search, tags, reload_request_ptr));
+    // A reload either swaps the new index in while the server carries
+    // on, with --reload_swap and a --load_index to load again, or stops
+    // the server, for main to start it again once it has built or
+    // loaded the new one.
+    bool swap = FLAGS_reload_swap && FLAGS_load_index.size();
+    mutex reload_mu;
+    promise<void> restart;
+    bool restarting = false;
+    auto reload = [&]() {
+        // One reload at a time, as each needs the memory for an index
+        lock_guard<mutex> lock(reload_mu);
+        if (swap)
+            return swap_index(&index);
+        if (!restarting) {
+            restarting = true;
+            restart.set_value();
+        }
+        return grpc::Status::OK;
+    };
+
+    function<grpc::Status()> reload_rpc;
+    if (FLAGS_reload_rpc)
+        reload_rpc = reload;
+    unique_ptr<CodeSearch::Service> service(build_grpc_server(&index, reload_rpc));
 
     ServerBuilder builder;
     builder.AddListeningPort(addr, grpc::InsecureServerCredentials());
@@ -166,39 +406,63 @@ void listen_grpc(code_searcher *search, code_searcher *tags, const string& addr)
     if (FLAGS_max_send_message_size > 0) {
         builder.AddChannelArgument(GRPC_ARG_MAX_SEND_MESSAGE_LENGTH, FLAGS_max_send_message_size);
     }
+    if (FLAGS_grpc_keepalive_min_time_ms > 0) {
+        builder.AddChannelArgument(GRPC_ARG_HTTP2_MIN_RECV_PING_INTERVAL_WITHOUT_DATA_MS, FLAGS_grpc_keepalive_min_time_ms);
+        builder.AddChannelArgument(GRPC_ARG_KEEPALIVE_PERMIT_WITHOUT_CALLS, 1);
+    }
     std::unique_ptr<Server> server(builder.BuildAndStart());
     if (!server) {
         die("Error starting GRPC server.");
     }
 
-    if (FLAGS_reload_rpc && FLAGS_hot_index_reload) {
-        die("reload_rpc and hot_index_reload options are mutually exclusive");
+    if (FLAGS_reload_rpc + FLAGS_hot_index_reload + FLAGS_reload_signal > 1) {
+        die("reload_rpc, hot_index_reload and reload_signal options are mutually exclusive");
     }
 
     log("Serving...");
 
-    if (FLAGS_reload_rpc) {
-        thread shutdown_thread([&]() {
-            reload_request.get_future().wait();
-            server->Shutdown();
+    // The reloads that don't come over RPC are waited for here. Each
+    // loop ends after a reload that restarts the server.
+    thread watch_thread;
+    if (FLAGS_hot_index_reload && FLAGS_load_index.size()) {
+        watch_thread = thread([&]() {
+            do {
+                // Watch the index as it is now; fswatchers can't overlap.
+                {
+                    fswatcher watcher(FLAGS_load_index);
+                    if (!watcher.wait_for_event()) {
+                        log("Error initializing filesystem watch. Hot index reloads will be disabled.");
+                        return;
+                    }
+                }
+                log("Detected change to index file; reloading...");
+                reload();
+            } while (swap);
         });
-        server->Wait();
-        shutdown_thread.join();
-    } else if (FLAGS_hot_index_reload && FLAGS_load_index.size()) {
-        thread shutdown_thread([&]() {
-            fswatcher watcher(FLAGS_load_index);
-            if (!watcher.wait_for_event()) {
-                log("Error initializing filesystem watch. Hot index reloads will be disabled.");
-                std::promise<void>().get_future().wait();  // Block forever.
-            }
-            log("Detected change to index file; reloading...");
-            server->Shutdown();
+    } else if (FLAGS_reload_signal) {
+        watch_thread = thread([&]() {
+            // SIGHUP is blocked in every thread (see main), so it can
+            // only be received here.
+            sigset_t set;
+            sigemptyset(&set);
+            sigaddset(&set, SIGHUP);
+            int sig;
+            do {
+                sigwait(&set, &sig);
+                log("Received SIGHUP; reloading...");
+                reload();
+            } while (swap);
         });
-        server->Wait();
-        shutdown_thread.join();
-    } else {
-        server->Wait();
     }
+
+    thread shutdown_thread([&]() {
+        restart.get_future().wait();
+        server->Shutdown();
+    });
+    server->Wait();
+    shutdown_thread.join();
+    if (watch_thread.joinable())
+        watch_thread.join();
 }
 
 int main(int argc, char **argv) {
@@ -206,22 +470,28 @@ int main(int argc, char **argv) {
     gflags::ParseCommandLineFlags(&argc, &argv, true);
 
     signal(SIGPIPE, SIG_IGN);
+    if (FLAGS_reload_signal) {
+        // Block SIGHUP before any threads are started, so that they all
+        // inherit the mask and listen_grpc can sigwait for it.
+        sigset_t set;
+        sigemptyset(&set);
+        sigaddset(&set, SIGHUP);
+        pthread_sigmask(SIG_BLOCK, &set, NULL);
+    }
 
     while (true) {
-        code_searcher search;
-        unique_ptr<code_searcher> tags;
+        unique_ptr<code_searcher> search(new code_searcher());
 
-        initialize_search(&search, argc, argv);
-        if (FLAGS_load_tags.size() != 0) {
-            tags.reset(new code_searcher());
-            tags->load_index(FLAGS_load_tags);
-        }
+        initialize_search(search.get(), argc, argv);
+        if (FLAGS_estimate)
+            return 0;
+        unique_ptr<code_searcher> tags = load_tags();
 
         if (FLAGS_index_only)
             return 0;
 
         if (FLAGS_grpc.size()) {
-            listen_grpc(&search, tags.get(), FLAGS_grpc);
+            listen_grpc(move(search), move(tags), FLAGS_grpc);
         }
     }
 }
@@ -8,6 +8,8 @@ using std::string;
 extern int analyze_re(int, char**);
 extern int dump_file(int, char**);
 extern int inspect_index(int, char**);
+extern int index_stats(int, char**);
+extern int index_merge(int, char**);
 
 struct _command {
     string name;
@@ -16,6 +18,8 @@ struct _command {
     {"analyze-re", analyze_re},
     {"inspect-index", inspect_index},
     {"dump-file", dump_file},
+    {"index-stats", index_stats},
+    {"index-merge", index_merge},
 };
 
 int main(int argc, char **argv) {
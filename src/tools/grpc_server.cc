@@ -17,6 +17,7 @@
 #include <functional>
 #include <future>
 #include <numeric>
+#include <sstream>
 #include <string>
 
 #include "utf8.h"
@@ -33,45 +34,96 @@ using std::string;
 DEFINE_int32(context_lines, 3, "The default number of result context lines to provide for a single query.");
 DEFINE_int32(max_matches, 50, "The default maximum number of matches to return for a single query.");
 
+struct served_index {
+    served_index(std::shared_ptr<code_searcher> c, std::shared_ptr<code_searcher> t);
+    ~served_index();
+
+    std::shared_ptr<code_searcher> cs;
+    std::shared_ptr<code_searcher> tagdata;
+    std::unique_ptr<tag_searcher> tagmatch;
+
+    thread_queue <code_searcher::search_thread*> pool;
+};
+
+served_index::served_index(std::shared_ptr<code_searcher> c, std::shared_ptr<code_searcher> t)
+    : cs(c), tagdata(t) {
+    if (tagdata != nullptr) {
+        tagmatch.reset(new tag_searcher);
+        tagmatch->cache_indexed_files(cs.get());
+    }
+}
+
+served_index::~served_index() {
+    pool.close();
+    code_searcher::search_thread* thread;
+    while (pool.pop(&thread))
+        delete thread;
+}
+
+index_holder::index_holder(std::shared_ptr<code_searcher> cs, std::shared_ptr<code_searcher> tagdata)
+    : index_(std::make_shared<served_index>(cs, tagdata)) {
+}
+
+std::shared_ptr<served_index> index_holder::get() {
+    std::lock_guard<std::mutex> lock(mu_);
+    return index_;
+}
+
+void index_holder::swap(std::shared_ptr<code_searcher> cs, std::shared_ptr<code_searcher> tagdata) {
+    // Cache the tags' files before taking the lock, so that searches
+    // starting meanwhile aren't held up.
+    std::shared_ptr<served_index> next = std::make_shared<served_index>(cs, tagdata);
+    std::shared_ptr<served_index> old;
+    {
+        std::lock_guard<std::mutex> lock(mu_);
+        old = index_;
+        index_ = next;
+    }
+    log("Swapped in the new index; %ld searches in flight finish on the old one",
+        old.use_count() - 1);
+}
+
 class CodeSearchImpl final : public CodeSearch::Service {
  public:
-    explicit CodeSearchImpl(code_searcher *cs, code_searcher *tagdata, std::promise<void> *reload_request);
-    virtual ~CodeSearchImpl();
+    CodeSearchImpl(index_holder *index, std::unique_ptr<index_holder> owned,
+                   std::function<grpc::Status()> reload);
 
     virtual grpc::Status Info(grpc::ServerContext* context, const ::InfoRequest* request, ::ServerInfo* response);
-    void TagsFirstSearch_(::CodeSearchResult* response, query& q, match_stats& stats);
+    void TagsFirstSearch_(served_index *index, ::CodeSearchResult* response, query& q, match_stats& stats);
     virtual grpc::Status Search(grpc::ServerContext* context, const ::Query* request, ::CodeSearchResult* response);
     virtual grpc::Status Reload(grpc::ServerContext* context, const ::Empty* request, ::Empty* response);
 
  private:
-    code_searcher *cs_;
-    code_searcher *tagdata_;
-    std::promise<void> *reload_request_;
-    tag_searcher *tagmatch_;
-
-    thread_queue <code_searcher::search_thread*> pool_;
+    index_holder *index_;
+    // The index_holder of indexes the caller keeps alive
+    std::unique_ptr<index_holder> owned_;
+    std::function<grpc::Status()> reload_;
 };
 
+// borrowed is the deleter of the indexes that callers of
+// build_grpc_server keep alive themselves.
+static void borrowed(code_searcher *) {}
+
 std::unique_ptr<CodeSearch::Service> build_grpc_server(code_searcher *cs,
                                                        code_searcher *tagdata,
-                                                       std::promise<void> *reload_request) {
-    return std::unique_ptr<CodeSearch::Service>(new CodeSearchImpl(cs, tagdata, reload_request));
+                                                       std::function<grpc::Status()> reload) {
+    std::shared_ptr<code_searcher> tags;
+    if (tagdata != nullptr)
+        tags.reset(tagdata, borrowed);
+    std::unique_ptr<index_holder> index(
+        new index_holder(std::shared_ptr<code_searcher>(cs, borrowed), tags));
+    index_holder *held = index.get();
+    return std::unique_ptr<CodeSearch::Service>(new CodeSearchImpl(held, std::move(index), reload));
 }
 
-CodeSearchImpl::CodeSearchImpl(code_searcher *cs, code_searcher *tagdata, std::promise<void> *reload_request)
-    : cs_(cs), tagdata_(tagdata), reload_request_(reload_request), tagmatch_(nullptr) {
-    if (tagdata != nullptr) {
-        tagmatch_ = new tag_searcher;
-        tagmatch_->cache_indexed_files(cs_);
-    }
+std::unique_ptr<CodeSearch::Service> build_grpc_server(index_holder *index,
+                                                       std::function<grpc::Status()> reload) {
+    return std::unique_ptr<CodeSearch::Service>(new CodeSearchImpl(index, nullptr, reload));
 }
 
-CodeSearchImpl::~CodeSearchImpl() {
-    pool_.close();
-    code_searcher::search_thread* thread;
-    while (pool_.pop(&thread))
-        delete thread;
-    delete tagmatch_;
+CodeSearchImpl::CodeSearchImpl(index_holder *index, std::unique_ptr<index_holder> owned,
+                               std::function<grpc::Status()> reload)
+    : index_(index), owned_(std::move(owned)), reload_(reload) {
 }
 
 string trace_id_from_request(ServerContext *ctx) {
@@ -85,16 +137,18 @@ Status CodeSearchImpl::Info(ServerContext* context, const ::InfoRequest* request
     scoped_trace_id trace(trace_id_from_request(context));
     log("Info()");
 
-    response->set_name(cs_->name());
-    std::vector<indexed_tree> trees = cs_->trees();
+    std::shared_ptr<served_index> index = index_->get();
+    code_searcher *cs = index->cs.get();
+    response->set_name(cs->name());
+    std::vector<indexed_tree> trees = cs->trees();
     for (auto it = trees.begin(); it != trees.end(); ++it) {
         auto insert = response->add_trees();
         insert->set_name(it->name);
         insert->set_version(it->version);
         insert->mutable_metadata()->CopyFrom(it->metadata);
     }
-    response->set_has_tags(tagdata_ != nullptr);
-    response->set_index_time(cs_->index_timestamp());
+    response->set_has_tags(index->tagdata != nullptr);
+    response->set_index_time(cs->index_timestamp());
     return Status::OK;
 }
 
@@ -167,6 +221,38 @@ Status extract_regexes(vector<std::shared_ptr<RE2>> *out,
     return extract_regexes(out, label, inputs, case_sensitive);
 }
 
+Status extract_labels(vector<pair<string, string>> *out,
+                      const std::string &label,
+                      const google::protobuf::RepeatedPtrField<std::string> &inputs) {
+    out->clear();
+    for (auto &input : inputs) {
+        size_t eq = input.find('=');
+        string key = input.substr(0, eq);
+        if (key.empty())
+            return Status(StatusCode::INVALID_ARGUMENT, label + ": missing label name");
+        out->push_back(std::make_pair(key, eq == string::npos ? string() : input.substr(eq + 1)));
+    }
+    return Status::OK;
+}
+
+Status extract_langs(vector<vector<string>> *out,
+                     const std::string &label,
+                     const google::protobuf::RepeatedPtrField<std::string> &inputs) {
+    out->clear();
+    for (auto &input : inputs) {
+        vector<string> langs;
+        std::istringstream in(input);
+        string lang;
+        while (std::getline(in, lang, ','))
+            if (!lang.empty())
+                langs.push_back(lang);
+        if (langs.empty())
+            return Status(StatusCode::INVALID_ARGUMENT, label + ": missing language");
+        out->push_back(std::move(langs));
+    }
+    return Status::OK;
+}
+
 Status parse_query(query *q, const ::Query* request, ::CodeSearchResult* response) {
     Status status = Status::OK;
     status = extract_regex(&q->line_pat, "line", request->line(), !request->fold_case());
@@ -182,6 +268,21 @@ Status parse_query(query *q, const ::Query* request, ::CodeSearchResult* respons
         status = extract_regex(&q->negate.tree_pat, "-repo", request->not_repo());
     if (status.ok())
         status = extract_regex(&q->negate.tags_pat, "-tags", request->not_tags());
+    if (status.ok())
+        status = extract_labels(&q->labels, "label", request->labels());
+    if (status.ok())
+        status = extract_labels(&q->negate.labels, "-label", request->not_labels());
+    if (status.ok())
+        status = extract_langs(&q->langs, "lang", request->lang());
+    if (status.ok()) {
+        vector<vector<string>> not_langs;
+        status = extract_langs(&not_langs, "-lang", request->not_lang());
+        q->negate.langs.clear();
+        for (auto &langs : not_langs)
+            q->negate.langs.insert(q->negate.langs.end(), langs.begin(), langs.end());
+    }
+    if (status.ok())
+        status = extract_regex(&q->version_pat, "version", request->version());
     q->filename_only = request->filename_only();
     q->context_lines = request->context_lines();
     if (q->context_lines <= 0 && FLAGS_context_lines) {
@@ -202,8 +303,14 @@ class add_match {
 public:
     typedef std::set<std::pair<indexed_file*, int>> line_set;
 
-    add_match(line_set* ls, CodeSearchResult* response)
-        : unique_lines_(ls), response_(response) {}
+    add_match(line_set* ls, CodeSearchResult* response, bool definitions = false)
+        : unique_lines_(ls), response_(response), definitions_(definitions) {}
+
+    // A callback adding to the same results, marking its matches as
+    // symbol definitions, for searches of the tags index.
+    add_match definitions() const {
+        return add_match(unique_lines_, response_, true);
+    }
 
     int match_count() {
         return response_->results_size();
@@ -231,6 +338,8 @@ public:
         result->mutable_bounds()->set_left(m->matchleft);
         result->mutable_bounds()->set_right(m->matchright);
         result->set_line(m->line.ToString());
+        result->set_definition(definitions_);
+        result->set_language(m->file->language);
     }
 
     void operator()(const file_result *f) const {
@@ -238,6 +347,7 @@ public:
         result->set_tree(f->file->tree->name);
         result->set_version(f->file->tree->version);
         result->set_path(f->file->path);
+        result->set_language(f->file->language);
         result->mutable_bounds()->set_left(f->matchleft);
         result->mutable_bounds()->set_right(f->matchright);
     }
@@ -245,6 +355,7 @@ public:
 private:
     line_set* unique_lines_;
     CodeSearchResult* response_;
+    bool definitions_;
 };
 
 static void run_tags_search(const query& main_query, std::string regex,
@@ -261,6 +372,10 @@ static void run_tags_search(const query& main_query, std::string regex,
     constraints.line_pat = main_query.line_pat;  // tell it what to highlight
     constraints.negate.file_pats.swap(q.negate.file_pats);
     constraints.negate.tags_pat.swap(q.negate.tags_pat);
+    // and the languages, which are those of the files the tags point
+    // into rather than of the tags files
+    constraints.langs.swap(q.langs);
+    constraints.negate.langs.swap(q.negate.langs);
 
     // modify the line pattern to match the constraints that we can handle now
     regex = tag_searcher::create_tag_line_regex_from_query(&q);
@@ -268,10 +383,11 @@ static void run_tags_search(const query& main_query, std::string regex,
     q.file_pats.clear();
     q.tags_pat.reset();
 
+    add_match tag_cb = cb.definitions();
     code_searcher::search_thread search(tagdata);
     search.match(q,
-                 cb,
-                 cb,
+                 tag_cb,
+                 tag_cb,
                  boost::bind(&tag_searcher::transform, searcher, &constraints, _1),
                  &stats);
 }
@@ -293,7 +409,7 @@ static std::string pat(const vector<std::shared_ptr<RE2>> &ps) {
     return absl::StrJoin(pats, ",");
 }
 
-void CodeSearchImpl::TagsFirstSearch_(::CodeSearchResult* response, query& q, match_stats& stats) {
+void CodeSearchImpl::TagsFirstSearch_(served_index *index, ::CodeSearchResult* response, query& q, match_stats& stats) {
     string line_pat = q.line_pat->pattern();
     string regex;
     int32_t original_max_matches = q.max_matches;  // remember original value
@@ -304,7 +420,7 @@ void CodeSearchImpl::TagsFirstSearch_(::CodeSearchResult* response, query& q, ma
     /* To surface the most important matches first, start with tags.
        First pass: is the pattern an exact match for any tags? */
     regex = "^" + line_pat + "$";
-    run_tags_search(q, regex, tagdata_, cb, tagmatch_, stats);
+    run_tags_search(q, regex, index->tagdata.get(), cb, index->tagmatch.get(), stats);
 
     q.max_matches = original_max_matches - cb.match_count();
     if (q.max_matches <= 0)
@@ -312,7 +428,7 @@ void CodeSearchImpl::TagsFirstSearch_(::CodeSearchResult* response, query& q, ma
 
     /* Second pass: is the pattern a prefix match for any tags? */
     regex = "^" + line_pat + "[^\t]";
-    run_tags_search(q, regex, tagdata_, cb, tagmatch_, stats);
+    run_tags_search(q, regex, index->tagdata.get(), cb, index->tagmatch.get(), stats);
 
     q.max_matches = original_max_matches - cb.match_count();
     if (q.max_matches <= 0)
@@ -320,10 +436,10 @@ void CodeSearchImpl::TagsFirstSearch_(::CodeSearchResult* response, query& q, ma
 
     /* Third and final pass: full corpus search. */
     code_searcher::search_thread *search;
-    if (!pool_.try_pop(&search))
-        search = new code_searcher::search_thread(cs_);
+    if (!index->pool.try_pop(&search))
+        search = new code_searcher::search_thread(index->cs.get());
     search->match(q, cb, cb, &stats);
-    pool_.push(search);
+    index->pool.push(search);
 }
 
 Status CodeSearchImpl::Search(ServerContext* context, const ::Query* request, ::CodeSearchResult* response) {
@@ -331,8 +447,11 @@ Status CodeSearchImpl::Search(ServerContext* context, const ::Query* request, ::
 
     scoped_trace_id trace(trace_id_from_request(context));
 
-    response->set_index_name(cs_->name());
-    response->set_index_time(cs_->index_timestamp());
+    // The search runs on the index it starts on to the end, even if a
+    // reload swaps in another meanwhile.
+    std::shared_ptr<served_index> index = index_->get();
+    response->set_index_name(index->cs->name());
+    response->set_index_time(index->cs->index_timestamp());
 
     query q;
     Status st;
@@ -402,23 +521,23 @@ Status CodeSearchImpl::Search(ServerContext* context, const ::Query* request, ::
 
     match_stats stats;
     timer search_tm(true);
-    if (q.tags_pat == NULL && tagdata_ && might_match_tags) {
-        CodeSearchImpl::TagsFirstSearch_(response, q, stats);
+    if (q.tags_pat == NULL && index->tagdata && might_match_tags) {
+        CodeSearchImpl::TagsFirstSearch_(index.get(), response, q, stats);
     } else if (q.tags_pat == NULL) {
         code_searcher::search_thread *search;
-        if (!pool_.try_pop(&search))
-            search = new code_searcher::search_thread(cs_);
+        if (!index->pool.try_pop(&search))
+            search = new code_searcher::search_thread(index->cs.get());
         add_match::line_set ls;
         add_match cb(&ls, response);
         search->match(q, cb, cb, &stats);
-        pool_.push(search);
+        index->pool.push(search);
     } else {
-        if (tagdata_ == NULL)
+        if (index->tagdata == NULL)
             return Status(StatusCode::FAILED_PRECONDITION, "No tags file available.");
 
         add_match::line_set ls;
         add_match cb(&ls, response);
-        run_tags_search(q, line_pat, tagdata_, cb, tagmatch_, stats);
+        run_tags_search(q, line_pat, index->tagdata.get(), cb, index->tagmatch.get(), stats);
     }
     search_tm.pause();
 
@@ -446,9 +565,8 @@ Status CodeSearchImpl::Search(ServerContext* context, const ::Query* request, ::
 
 Status CodeSearchImpl::Reload(ServerContext* context, const ::Empty* request, ::Empty* response) {
     log("Reload()");
-    if (reload_request_ == NULL) {
+    if (!reload_) {
       return Status(StatusCode::UNIMPLEMENTED, "reload rpc not enabled");
     }
-    reload_request_->set_value();
-    return Status::OK;
+    return reload_();
 }
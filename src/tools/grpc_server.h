@@ -2,14 +2,43 @@
 #define CODESEARCH_GRPC_SERVER_H
 
 #include "src/proto/livegrep.grpc.pb.h"
+#include <functional>
 #include <future>
 #include <memory>
+#include <mutex>
 
 class code_searcher;
 class tag_searcher;
 
+// A served_index is an index searches run against: the code index, the
+// tags index if there is one, and the search threads bound to them.
+struct served_index;
+
+// An index_holder holds the index a server searches. Each search keeps
+// hold of the index it started on, so swap replaces the index without
+// waiting for the searches in flight; the old one is freed when the last
+// of them finishes.
+class index_holder {
+ public:
+    index_holder(std::shared_ptr<code_searcher> cs, std::shared_ptr<code_searcher> tagdata);
+
+    std::shared_ptr<served_index> get();
+    void swap(std::shared_ptr<code_searcher> cs, std::shared_ptr<code_searcher> tagdata);
+
+ private:
+    std::mutex mu_;
+    std::shared_ptr<served_index> index_;
+};
+
+// build_grpc_server serves searches of cs, and of the tags index tagdata
+// if it isn't null, which the caller keeps alive. The Reload RPC calls
+// reload, or is unimplemented if reload is empty.
 std::unique_ptr<CodeSearch::Service> build_grpc_server(code_searcher *cs,
                                                        code_searcher *tagdata,
-                                                       std::promise<void> *reload_request);
+                                                       std::function<grpc::Status()> reload);
+
+// This build_grpc_server serves searches of whichever index index holds.
+std::unique_ptr<CodeSearch::Service> build_grpc_server(index_holder *index,
+                                                       std::function<grpc::Status()> reload);
 
 #endif /* CODESEARCH_GRPC_SERVER_H */
@@ -0,0 +1,142 @@
+#include <stdio.h>
+
+#include <map>
+#include <memory>
+#include <set>
+#include <string>
+#include <utility>
+#include <vector>
+
+#include "src/lib/debug.h"
+
+#include "src/codesearch.h"
+#include "src/chunk_allocator.h"
+#include "src/content.h"
+
+#include <gflags/gflags.h>
+
+using std::make_pair;
+using std::map;
+using std::pair;
+using std::set;
+using std::string;
+using std::unique_ptr;
+using std::vector;
+
+DEFINE_string(o, "", "index-merge: path to write the merged index to.");
+DEFINE_string(merge_name, "", "index-merge: name of the merged index (default: the first input's name).");
+DEFINE_string(merge_duplicates, "error",
+              "index-merge: what to do with a repository that is in more than one input: "
+              "'error', 'first' (keep the copy from the first input that has it), "
+              "or 'rename' (prefix each copy after the first with its input's name).");
+
+namespace {
+
+// The name an input is known by when renaming its repositories: the
+// name it was built with or, failing that, its file name.
+string input_name(const code_searcher &cs, const string &path) {
+    if (!cs.name().empty())
+        return cs.name();
+    string base = path.substr(path.rfind('/') == string::npos ? 0 : path.rfind('/') + 1);
+    if (base.size() > 4 && base.compare(base.size() - 4, 4, ".idx") == 0)
+        base.resize(base.size() - 4);
+    return base;
+}
+
+}
+
+int index_merge(int argc, char **argv) {
+    if (argc < 2 || FLAGS_o.empty()) {
+        fprintf(stderr, "Usage: %s <options> -o MERGED.idx INDEX.idx INDEX.idx...\n",
+                gflags::GetArgv0());
+        return 1;
+    }
+    if (FLAGS_merge_duplicates != "error" &&
+        FLAGS_merge_duplicates != "first" &&
+        FLAGS_merge_duplicates != "rename") {
+        fprintf(stderr, "Unknown -merge_duplicates mode: %s\n", FLAGS_merge_duplicates.c_str());
+        return 1;
+    }
+
+    vector<unique_ptr<code_searcher>> inputs;
+    for (int i = 0; i < argc; ++i) {
+        if (FLAGS_o == argv[i])
+            die("%s is both an input and the output", argv[i]);
+        inputs.emplace_back(new code_searcher);
+        inputs.back()->load_index(argv[i]);
+    }
+
+    // Decide what each input's repositories are called in the merged
+    // index. A repository is a duplicate if an earlier input already
+    // has one by that name; "" drops it.
+    vector<map<string, string>> names(inputs.size());
+    map<string, int> owner;
+    bool conflict = false;
+    for (size_t i = 0; i < inputs.size(); ++i) {
+        set<string> repos;
+        for (auto &t : inputs[i]->trees())
+            repos.insert(t.name);
+        for (auto &repo : repos) {
+            auto ins = owner.emplace(repo, i);
+            if (ins.second) {
+                names[i][repo] = repo;
+                continue;
+            }
+            int first = ins.first->second;
+            if (FLAGS_merge_duplicates == "error") {
+                fprintf(stderr, "%s: repository %s is also in %s\n",
+                        argv[i], repo.c_str(), argv[first]);
+                conflict = true;
+            } else if (FLAGS_merge_duplicates == "first") {
+                fprintf(stderr, "%s: skipping %s, already merged from %s\n",
+                        argv[i], repo.c_str(), argv[first]);
+                names[i][repo] = "";
+            } else {
+                string renamed = input_name(*inputs[i], argv[i]) + "/" + repo;
+                if (!owner.emplace(renamed, i).second)
+                    die("%s: cannot rename %s to %s, which is already taken",
+                        argv[i], repo.c_str(), renamed.c_str());
+                fprintf(stderr, "%s: renaming %s to %s\n",
+                        argv[i], repo.c_str(), renamed.c_str());
+                names[i][repo] = renamed;
+            }
+        }
+    }
+    if (conflict) {
+        fprintf(stderr, "Use -merge_duplicates=first or -merge_duplicates=rename to merge anyway.\n");
+        return 1;
+    }
+
+    code_searcher out;
+    out.set_alloc(make_dump_allocator(&out, FLAGS_o));
+    out.set_name(FLAGS_merge_name.size() ? FLAGS_merge_name : inputs[0]->name());
+
+    long files = 0;
+    for (size_t i = 0; i < inputs.size(); ++i) {
+        code_searcher *in = inputs[i].get();
+        // Files point at their input's trees; find the merged tree for
+        // each by name and version.
+        map<pair<string, string>, const indexed_tree*> trees;
+        for (auto &t : in->trees()) {
+            const string &name = names[i][t.name];
+            if (name.empty())
+                continue;
+            trees[make_pair(t.name, t.version)] = out.open_tree(name, t.metadata, t.version);
+        }
+        for (auto it = in->begin_files(); it != in->end_files(); ++it) {
+            indexed_file *f = it->get();
+            auto tree = trees.find(make_pair(f->tree->name, f->tree->version));
+            if (tree == trees.end())
+                continue;
+            out.index_file(tree->second, f->path, f->content->text(in->alloc()));
+            files++;
+        }
+        fprintf(stderr, "Merged %s\n", argv[i]);
+    }
+
+    fprintf(stderr, "Finalizing...\n");
+    out.finalize();
+    fprintf(stderr, "Wrote %s: %zu trees, %ld files\n",
+            FLAGS_o.c_str(), out.trees().size(), files);
+    return 0;
+}
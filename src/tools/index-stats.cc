@@ -0,0 +1,330 @@
+#include <ctype.h>
+#include <errno.h>
+#include <stdio.h>
+#include <string.h>
+#include <sys/stat.h>
+
+#include <algorithm>
+#include <iterator>
+#include <map>
+#include <string>
+#include <unordered_map>
+#include <vector>
+
+#include "src/lib/debug.h"
+
+#include "src/codesearch.h"
+#include "src/chunk.h"
+#include "src/chunk_allocator.h"
+#include "src/content.h"
+
+#include <gflags/gflags.h>
+
+using std::string;
+using std::vector;
+
+DEFINE_bool(stats_json, false, "index-stats: print the report as JSON.");
+DEFINE_int32(stats_top, 10, "index-stats: number of largest files and repositories to list.");
+DEFINE_bool(stats_overlap, false, "index-stats: report which repositories share content. Needs memory proportional to the number of distinct lines.");
+
+namespace {
+
+struct usage {
+    string name;
+    long files = 0;
+    long bytes = 0;
+};
+
+// Sorts largest first, breaking ties by name so reports are stable.
+bool larger(const usage &a, const usage &b) {
+    if (a.bytes != b.bytes)
+        return a.bytes > b.bytes;
+    return a.name < b.name;
+}
+
+// The extension of the file at path, including the dot, or "" if it has
+// none. Dotfiles like .gitignore have no extension.
+string extension(const string &path) {
+    size_t slash = path.rfind('/');
+    string base = path.substr(slash == string::npos ? 0 : slash + 1);
+    size_t dot = base.rfind('.');
+    if (dot == string::npos || dot == 0)
+        return "";
+    string ext = base.substr(dot);
+    std::transform(ext.begin(), ext.end(), ext.begin(), ::tolower);
+    return ext;
+}
+
+// The number of bytes of source the file held when it was indexed. Each
+// piece of a file is a line without its trailing newline.
+long file_bytes(code_searcher *cs, indexed_file *f) {
+    long bytes = 0;
+    for (auto it = f->content->begin(cs->alloc());
+         it != f->content->end(cs->alloc()); ++it) {
+        bytes += it->size() + 1;
+    }
+    return bytes;
+}
+
+// Content shared between two repositories.
+struct overlap {
+    string a, b;
+    long bytes = 0;
+};
+
+// The repositories that share content with another, the content they
+// share and the pairs that share the most. Lines are deduplicated across
+// the whole index, so the bytes of a file's pieces that another
+// repository's file already points at are content the two have in
+// common. Each shared byte is attributed to the first repository that
+// stored it; a repository's own revisions overlapping don't count.
+struct overlap_report {
+    std::map<string, usage> shared;
+    vector<overlap> pairs;
+};
+
+// The bytes [begin, end) of a chunk, and the first repository to store
+// them.
+struct claim {
+    uint32_t end;
+    int repo;
+};
+
+// The ranges of a chunk claimed so far, keyed by where they begin. They
+// never overlap.
+typedef std::map<uint32_t, claim> claims;
+
+// Claims [begin, end) for repo: calls shared(owner, bytes) for each part
+// already claimed by another repository, and claims the rest.
+template <typename F>
+void claim_range(claims *claimed, uint32_t begin, uint32_t end, int repo, F shared) {
+    auto it = claimed->upper_bound(begin);
+    if (it != claimed->begin() && std::prev(it)->second.end > begin)
+        --it;
+    vector<std::pair<uint32_t, uint32_t>> unclaimed;
+    uint32_t pos = begin;
+    for (; it != claimed->end() && it->first < end; ++it) {
+        if (it->first > pos)
+            unclaimed.emplace_back(pos, it->first);
+        if (it->second.repo != repo)
+            shared(it->second.repo, std::min(it->second.end, end) - std::max(it->first, begin));
+        pos = std::max(pos, it->second.end);
+    }
+    if (pos < end)
+        unclaimed.emplace_back(pos, end);
+    for (auto &r : unclaimed)
+        (*claimed)[r.first] = claim{r.second, repo};
+}
+
+overlap_report find_overlap(code_searcher *cs, size_t limit) {
+    std::map<string, int> ids;
+    vector<string> names;
+    // The ranges of each chunk's data stored so far, by the first repo to
+    // use them. Pieces of different files can start at different places
+    // in the same lines, so they're compared as byte ranges.
+    std::unordered_map<uint32_t, claims> owner;
+    std::map<std::pair<int, int>, long> pairs;
+    overlap_report report;
+
+    for (auto it = cs->begin_files(); it != cs->end_files(); ++it) {
+        indexed_file *f = it->get();
+        auto id = ids.emplace(f->tree->name, names.size());
+        if (id.second)
+            names.push_back(f->tree->name);
+        int repo = id.first->second;
+
+        long shared = 0;
+        for (auto p = f->content->begin(); p != f->content->end(); ++p) {
+            claim_range(&owner[p->chunk], p->off, p->off + p->len + 1, repo,
+                        [&](int first, long bytes) {
+                            pairs[std::make_pair(first, repo)] += bytes;
+                            shared += bytes;
+                        });
+        }
+        if (shared) {
+            usage &u = report.shared[f->tree->name];
+            u.name = f->tree->name;
+            u.files++;
+            u.bytes += shared;
+        }
+    }
+
+    for (auto &e : pairs) {
+        overlap o;
+        o.a = names[e.first.first];
+        o.b = names[e.first.second];
+        o.bytes = e.second;
+        report.pairs.push_back(o);
+    }
+    std::sort(report.pairs.begin(), report.pairs.end(),
+              [](const overlap &l, const overlap &r) {
+                  if (l.bytes != r.bytes)
+                      return l.bytes > r.bytes;
+                  return std::make_pair(l.a, l.b) < std::make_pair(r.a, r.b);
+              });
+    if (limit && report.pairs.size() > limit)
+        report.pairs.resize(limit);
+    return report;
+}
+
+vector<usage> sorted(const std::map<string, usage> &m, size_t limit) {
+    vector<usage> out;
+    for (auto &e : m)
+        out.push_back(e.second);
+    std::sort(out.begin(), out.end(), larger);
+    if (limit && out.size() > limit)
+        out.resize(limit);
+    return out;
+}
+
+string json_string(const string &s) {
+    string out = "\"";
+    for (char c : s) {
+        switch (c) {
+        case '"':  out += "\\\""; break;
+        case '\\': out += "\\\\"; break;
+        case '\n': out += "\\n"; break;
+        case '\t': out += "\\t"; break;
+        default:
+            if ((unsigned char)c < 0x20)
+                out += strprintf("\\u%04x", c);
+            else
+                out += c;
+        }
+    }
+    return out + "\"";
+}
+
+void print_json_list(const char *key, const vector<usage> &list, bool last) {
+    printf("  %s: [", json_string(key).c_str());
+    for (size_t i = 0; i < list.size(); ++i) {
+        printf("%s\n    {\"name\": %s, \"files\": %ld, \"bytes\": %ld}",
+               i ? "," : "", json_string(list[i].name).c_str(),
+               list[i].files, list[i].bytes);
+    }
+    printf("%s]%s\n", list.empty() ? "" : "\n  ", last ? "" : ",");
+}
+
+void print_json_pairs(const vector<overlap> &pairs, bool last) {
+    printf("  \"overlapping_pairs\": [");
+    for (size_t i = 0; i < pairs.size(); ++i) {
+        printf("%s\n    {\"first\": %s, \"second\": %s, \"bytes\": %ld}",
+               i ? "," : "", json_string(pairs[i].a).c_str(),
+               json_string(pairs[i].b).c_str(), pairs[i].bytes);
+    }
+    printf("%s]%s\n", pairs.empty() ? "" : "\n  ", last ? "" : ",");
+}
+
+void print_text_list(const char *title, const vector<usage> &list) {
+    printf("\n%s:\n", title);
+    for (auto &u : list) {
+        printf("  %12ld bytes %8ld files  %s\n", u.bytes, u.files,
+               u.name.empty() ? "(none)" : u.name.c_str());
+    }
+}
+
+}
+
+int index_stats(int argc, char **argv) {
+    if (argc != 1) {
+        fprintf(stderr, "Usage: %s <options> INDEX.idx\n", gflags::GetArgv0());
+        return 1;
+    }
+
+    struct stat st;
+    if (stat(argv[0], &st) != 0)
+        die("stat('%s'): %s", argv[0], strerror(errno));
+
+    code_searcher cs;
+    cs.load_index(argv[0]);
+
+    std::map<string, usage> repos, exts;
+    vector<usage> files;
+    long total_files = 0, total_bytes = 0;
+    for (auto it = cs.begin_files(); it != cs.end_files(); ++it) {
+        indexed_file *f = it->get();
+        long bytes = file_bytes(&cs, f);
+        total_files++;
+        total_bytes += bytes;
+
+        usage &repo = repos[f->tree->name];
+        repo.name = f->tree->name;
+        repo.files++;
+        repo.bytes += bytes;
+
+        string ext = extension(f->path);
+        usage &e = exts[ext];
+        e.name = ext;
+        e.files++;
+        e.bytes += bytes;
+
+        usage file;
+        file.name = f->tree->name +
+            (f->tree->version.empty() ? "" : ":" + f->tree->version) +
+            ":" + f->path;
+        file.files = 1;
+        file.bytes = bytes;
+        files.push_back(file);
+    }
+    std::sort(files.begin(), files.end(), larger);
+    if (FLAGS_stats_top > 0 && files.size() > (size_t)FLAGS_stats_top)
+        files.resize(FLAGS_stats_top);
+
+    // Lines are deduplicated as they are indexed, so the line data stored
+    // in chunks is usually smaller than the source it represents.
+    long stored = 0;
+    for (auto it = cs.alloc()->begin(); it != cs.alloc()->end(); ++it)
+        stored += (*it)->size;
+    double dedup = stored ? double(total_bytes) / stored : 0;
+
+    size_t top = FLAGS_stats_top > 0 ? FLAGS_stats_top : 0;
+    auto top_repos = sorted(repos, top);
+    auto all_exts = sorted(exts, 0);
+
+    overlap_report shared;
+    if (FLAGS_stats_overlap)
+        shared = find_overlap(&cs, top);
+    auto top_shared = sorted(shared.shared, top);
+
+    if (FLAGS_stats_json) {
+        printf("{\n");
+        printf("  \"name\": %s,\n", json_string(cs.name()).c_str());
+        printf("  \"index_bytes\": %ld,\n", (long)st.st_size);
+        printf("  \"repos\": %zu,\n", repos.size());
+        printf("  \"trees\": %zu,\n", cs.trees().size());
+        printf("  \"files\": %ld,\n", total_files);
+        printf("  \"bytes\": %ld,\n", total_bytes);
+        printf("  \"stored_bytes\": %ld,\n", stored);
+        printf("  \"dedup_ratio\": %.3f,\n", dedup);
+        print_json_list("largest_repos", top_repos, false);
+        print_json_list("largest_files", files, false);
+        print_json_list("extensions", all_exts, !FLAGS_stats_overlap);
+        if (FLAGS_stats_overlap) {
+            print_json_list("shared_repos", top_shared, false);
+            print_json_pairs(shared.pairs, true);
+        }
+        printf("}\n");
+        return 0;
+    }
+
+    printf("Index: %s\n", argv[0]);
+    printf("Name: %s\n", cs.name().c_str());
+    printf(" Index size: %ld (%0.2fM)\n", (long)st.st_size, st.st_size / double(1 << 20));
+    printf(" Repositories: %zu (%zu trees)\n", repos.size(), cs.trees().size());
+    printf(" Files: %ld\n", total_files);
+    printf(" Source bytes: %ld (%0.2fM)\n", total_bytes, total_bytes / double(1 << 20));
+    printf(" Stored bytes: %ld (%0.2fM)\n", stored, stored / double(1 << 20));
+    printf(" Dedup ratio: %.2fx\n", dedup);
+    print_text_list("Largest repositories", top_repos);
+    print_text_list("Largest files", files);
+    print_text_list("Extensions", all_exts);
+    if (FLAGS_stats_overlap) {
+        print_text_list("Repositories sharing content with another", top_shared);
+        printf("\nMost overlapping repositories:\n");
+        for (auto &o : shared.pairs) {
+            printf("  %12ld bytes  %s and %s\n",
+                   o.bytes, o.a.c_str(), o.b.c_str());
+        }
+    }
+    return 0;
+}
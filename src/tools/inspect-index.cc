@@ -108,7 +108,10 @@ int inspect_index(int argc, char **argv) {
     uint8_t *p = map + idx->files_off;
     for (int i = 0; i < idx->nfiles; i++) {
         p += 4;
+        // path, language and flags
         p += 4 + *reinterpret_cast<uint32_t*>(p);
+        p += 4 + *reinterpret_cast<uint32_t*>(p);
+        p += 4;
     }
     spans.push_back(index_span(idx->files_off,
                                (unsigned long)(p - map),
@@ -0,0 +1,77 @@
+/********************************************************************
+ * livegrep -- transcode.cc
+ * Copyright (c) 2011-2013 Nelson Elhage
+ *
+ * This program is free software. You may use, redistribute, and/or
+ * modify it under the terms listed in the COPYING file.
+ ********************************************************************/
+#include <iconv.h>
+#include <map>
+
+#include "utf8.h"
+
+#include "src/lib/metrics.h"
+
+#include "src/transcode.h"
+
+using namespace std;
+
+static metric idx_files_transcoded("index.files.transcoded");
+
+// WHATWG names and the iconv encodings that decode the same way. The
+// WHATWG shift_jis, for instance, is really Microsoft's, which leaves
+// backslashes alone where iconv's SHIFT_JIS turns them into yen signs.
+static const map<string, string> kIconvNames = {
+    {"shift_jis",    "CP932"},
+    {"euc-jp",       "EUC-JP"},
+    {"euc-kr",       "CP949"},
+    {"gbk",          "GB18030"},
+    {"gb18030",      "GB18030"},
+    {"big5",         "BIG5-HKSCS"},
+    {"windows-1251", "CP1251"},
+    {"windows-1252", "CP1252"},
+    {"iso-8859-1",   "CP1252"},
+    {"koi8-r",       "KOI8-R"},
+};
+
+bool known_encoding(const string &name) {
+    return kIconvNames.count(name) != 0;
+}
+
+static bool convert(re2::StringPiece in, const char *from, string *out) {
+    iconv_t cd = iconv_open("UTF-8", from);
+    if (cd == (iconv_t)-1)
+        return false;
+    // No supported encoding takes more than three bytes of UTF-8 per
+    // input byte.
+    out->resize(in.size() * 3);
+    char *inp = const_cast<char*>(in.data());
+    size_t inleft = in.size();
+    char *outp = &(*out)[0];
+    size_t outleft = out->size();
+    size_t r = iconv(cd, &inp, &inleft, &outp, &outleft);
+    iconv_close(cd);
+    if (r == (size_t)-1)
+        return false;
+    out->resize(out->size() - outleft);
+    return true;
+}
+
+bool transcode(re2::StringPiece contents, const vector<string> &encodings, string *out) {
+    if (encodings.empty() || utf8::is_valid(contents.data(), contents.data() + contents.size()))
+        return false;
+
+    bool ok = false;
+    if (contents.size() >= 2 && (uint8_t)contents[0] == 0xff && (uint8_t)contents[1] == 0xfe)
+        ok = convert(contents.substr(2), "UTF-16LE", out);
+    else if (contents.size() >= 2 && (uint8_t)contents[0] == 0xfe && (uint8_t)contents[1] == 0xff)
+        ok = convert(contents.substr(2), "UTF-16BE", out);
+    for (auto it = encodings.begin(); !ok && it != encodings.end(); ++it) {
+        auto name = kIconvNames.find(*it);
+        if (name != kIconvNames.end())
+            ok = convert(contents, name->second.c_str(), out);
+    }
+    if (ok)
+        idx_files_transcoded.inc();
+    return ok;
+}
@@ -0,0 +1,28 @@
+/********************************************************************
+ * livegrep -- transcode.h
+ * Copyright (c) 2011-2013 Nelson Elhage
+ *
+ * This program is free software. You may use, redistribute, and/or
+ * modify it under the terms listed in the COPYING file.
+ ********************************************************************/
+#ifndef CODESEARCH_TRANSCODE_H
+#define CODESEARCH_TRANSCODE_H
+
+#include <string>
+#include <vector>
+
+#include "re2/re2.h"
+
+// The encodings transcode accepts, by their WHATWG names (as used by
+// browsers and golang.org/x/text/encoding/htmlindex, so that the file
+// viewer decodes files the same way).
+bool known_encoding(const std::string &name);
+
+// If contents is not valid UTF-8, but is UTF-16 with a byte order mark
+// or decodes without error in one of encodings, tried in order, stores
+// it converted to UTF-8 in *out and returns true. Otherwise, including
+// when encodings is empty, returns false.
+bool transcode(re2::StringPiece contents, const std::vector<std::string> &encodings,
+               std::string *out);
+
+#endif
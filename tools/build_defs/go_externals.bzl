@@ -59,8 +59,28 @@ _externals = [
     _github("xanzy/go-gitlab", "e69c57e3177c974dc2396589ec7f9ff18a1ec68e"),
     _github("hashicorp/go-retryablehttp", "4165cf8897205a879a06b20d1ed0a2a76fbb6a17"),
     _github("hashicorp/go-cleanhttp", "6d9e2ac5d828e5f8594b97f88c4bde14a67bb6d2"),
+    _github("google/go-jsonnet", "7903819abfe600dab695e7992295688e15ee7895"),
+    struct(
+        name = "io_k8s_sigs_yaml",
+        importpath = "sigs.k8s.io/yaml",
+        sum = "h1:4A07+ZFc2wgJwo8YNlQpr1rVlgUDlxXHhPJciaPY5gs=",
+        version = "v1.1.0",
+    ),
+    struct(
+        name = "in_gopkg_yaml_v2",
+        importpath = "gopkg.in/yaml.v2",
+        sum = "h1:VUgggvou5XRW9mHwD/yXxIYSMtY0zoKQf/v226p2nyo=",
+        version = "v2.2.7",
+    ),
+    struct(
+        name = "io_etcd_go_bbolt",
+        importpath = "go.etcd.io/bbolt",
+        sum = "h1:j+zJOnnEjF/kyHlDDgGnVL/AIqIJPq8UoB2GSNfkUfQ=",
+        version = "v1.3.7",
+    ),
     _gopkg("alexcesaro/statsd.v2", "7fea3f0d2fab1ad973e641e51dba45443a311a90"),
     _gopkg("check.v1", "20d25e2804050c1cd24a7eea1e7a6447dd0e74ec"),
+    _gopkg("yaml.v3", "f6f7691f1bdeb1bd1cbd2fe1bee9e2dd30db9ba8"),
     struct(
         name = "org_golang_google_grpc",
         commit = "f74f0337644653eba7923908a4d7f79a4f3a267b",
@@ -70,7 +90,14 @@ _externals = [
 
 def go_externals():
     for ext in _externals:
-        if hasattr(ext, "vcs"):
+        if hasattr(ext, "sum"):
+            go_repository(
+                name = ext.name,
+                importpath = ext.importpath,
+                sum = ext.sum,
+                version = ext.version,
+            )
+        elif hasattr(ext, "vcs"):
             go_repository(
                 name = ext.name,
                 commit = ext.commit,
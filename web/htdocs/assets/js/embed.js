@@ -0,0 +1,49 @@
+// Embeds a livegrep search box in the page, in place of the script tag
+// that loads this file:
+//
+//   <script src="https://livegrep.example.com/assets/js/embed.js"
+//           data-scope="repo:^org/payments-" data-height="300"></script>
+//
+// data-scope, data-backend, data-q, data-max-matches and data-open are
+// passed on to /embed. Clicking a result fires a "livegrep:navigate"
+// event, whose detail has the result's url, tree, version, path and
+// line_number, on the widget's iframe; it bubbles, so the page can
+// listen on document.
+(function() {
+  var script = document.currentScript;
+  if (!script)
+    return;
+  var base = script.src.replace(/\/assets\/js\/embed\.js.*$/, '');
+  var origin = base.split('/').slice(0, 3).join('/');
+
+  var params = [];
+  ['scope', 'backend', 'q', 'max-matches', 'open'].forEach(function(name) {
+    var value = script.getAttribute('data-' + name);
+    if (value !== null)
+      params.push(name.replace('-', '_') + '=' + encodeURIComponent(value));
+  });
+
+  var frame = document.createElement('iframe');
+  frame.src = base + '/embed' + (params.length ? '?' + params.join('&') : '');
+  frame.title = 'Code search';
+  frame.style.border = '0';
+  frame.style.width = script.getAttribute('data-width') || '100%';
+  frame.style.height = (script.getAttribute('data-height') || '300') + 'px';
+  var maxHeight = parseInt(script.getAttribute('data-max-height') || '600', 10);
+  script.parentNode.insertBefore(frame, script.nextSibling);
+
+  window.addEventListener('message', function(e) {
+    if (e.origin !== origin || e.source !== frame.contentWindow)
+      return;
+    var msg = e.data || {};
+    if (msg.source !== 'livegrep')
+      return;
+    if (msg.type === 'resize') {
+      frame.style.height = Math.min(msg.height, maxHeight) + 'px';
+    } else if (msg.type === 'navigate') {
+      var event = document.createEvent('CustomEvent');
+      event.initCustomEvent('livegrep:navigate', true, true, msg);
+      frame.dispatchEvent(event);
+    }
+  });
+})();
@@ -35,7 +35,9 @@ var Codesearch = function() {
         q: opts.q,
         fold_case: opts.fold_case,
         regex: opts.regex,
-        repo: opts.repo
+        active: opts.active,
+        repo: opts.repo,
+        version: opts.version
       };
 
       var xhr = $.ajax({
@@ -53,11 +55,13 @@ var Codesearch = function() {
         data.file_results.forEach(function (r) {
           Codesearch.delegate.file_match(opts.id, r);
         });
-        Codesearch.delegate.search_done(opts.id, elapsed, data.search_type, data.info.why);
+        Codesearch.delegate.search_done(opts.id, elapsed, data.search_type, data.info.why, data.unavailable || [],
+                                        data.regex_mode == 'auto' ? data.query_mode : null,
+                                        data.languages || {});
       });
       xhr.fail(function(data) {
         window._err = data;
-        if (data.status >= 400 && data.status < 500) {
+        if ((data.status >= 400 && data.status < 500) || data.status == 504) {
           var err = JSON.parse(data.responseText);
           Codesearch.delegate.error(opts.id, err.error.message);
         } else {
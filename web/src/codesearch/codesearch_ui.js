@@ -3,6 +3,8 @@ var Backbone = require('backbone');
 var Cookies = require('js-cookie');
 
 var Codesearch = require('codesearch/codesearch.js').Codesearch;
+var QuickOpen = require('quickopen/quickopen.js');
+var SavedSearches = require('codesearch/saved_searches.js');
 var RepoSelector = require('codesearch/repo_selector.js');
 
 var KeyCodes = {
@@ -63,11 +65,11 @@ function shorten(ref) {
   return ref;
 }
 
-function url(tree, version, path, lno) {
+function url(tree, version, path, lno, backend, rev) {
   if (tree in CodesearchUI.internalViewRepos) {
     return internalUrl(tree, path, lno);
   } else {
-    return externalRepoUrl(tree, version, path, lno);
+    return externalRepoUrl(tree, version, path, lno, backend, rev);
   }
 }
 
@@ -80,8 +82,8 @@ function internalUrl(tree, path, lno) {
   return url;
 }
 
-function externalRepoUrl(tree, version, path, lno) {
-  var backend = Codesearch.in_flight.backend;
+function externalRepoUrl(tree, version, path, lno, backend, rev) {
+  backend = backend || Codesearch.in_flight.backend;
   var repo_map = CodesearchUI.repo_urls[backend];
   if (!repo_map) {
     return null;
@@ -89,13 +91,35 @@ function externalRepoUrl(tree, version, path, lno) {
   if (!repo_map[tree]) {
     return null;
   }
-  return externalUrl(repo_map[tree], tree, version, path, lno);
+  return externalUrl(repo_map[tree], tree, version, path, lno, rev, linkRevision(tree, backend));
 }
 
-function externalUrl(url, tree, version, path, lno) {
+// The commit and branch a result was indexed at, as far as the server
+// knows them, for the {sha} and {branch} of a url pattern.
+function revisionOf(model) {
+  return {commit: model.get('commit'), branch: model.get('branch')};
+}
+
+// What links to files of tree should be made at: the user's choice in
+// the search options, else the link_revision of the tree's repository:
+// "commit", "branch", or "" for the version searched.
+function linkRevision(tree, backend) {
+  if (CodesearchUI.link_revision)
+    return CodesearchUI.link_revision;
+  var revs = CodesearchUI.link_revisions[backend || Codesearch.in_flight.backend];
+  return (revs && revs[tree]) || '';
+}
+
+function externalUrl(url, tree, version, path, lno, rev, mode) {
   if (lno === undefined) {
       lno = 1;
   }
+  rev = rev || {};
+  var linked = version;
+  if (mode === 'commit' && rev.commit)
+    linked = rev.commit;
+  else if (mode === 'branch' && rev.branch)
+    linked = rev.branch;
 
   // If {path} already has a slash in front of it, trim extra leading
   // slashes from `path` to avoid a double-slash in the URL.
@@ -105,14 +129,40 @@ function externalUrl(url, tree, version, path, lno) {
 
   // the order of these replacements is used to minimize conflicts
   url = url.replace(/{lno}/g, lno);
-  url = url.replace(/{version}/g, shorten(version));
+  url = url.replace(/{version}/g, shorten(linked));
+  url = url.replace(/{sha}/g, rev.commit || version);
+  url = url.replace(/{branch}/g, shorten(rev.branch || version));
   url = url.replace(/{name}/g, tree);
   url = url.replace(/{basename}/g, tree.split("/")[1]); // E.g. "foo" in "username/foo"
   url = url.replace(/{path}/g, path);
   return url;
 }
 
-function renderLinkConfigs(linkConfigs, tree, version, path, lno) {
+function renderIndex(index) {
+  if (!index)
+    return [];
+  return [h.span({cls: 'result-label result-index', title: 'index:' + index}, [index])];
+}
+
+// Describes how fresh a result is, from the commit and indexed_at the
+// server gives it, for hovering over its path.
+function freshness(result) {
+  var parts = [];
+  if (result.get('commit'))
+    parts.push('Commit ' + result.get('commit'));
+  if (result.get('indexed_at'))
+    parts.push('indexed ' + new Date(result.get('indexed_at') * 1000).toLocaleString());
+  return parts.join(', ');
+}
+
+function renderLabels(labels) {
+  return _.keys(labels || {}).sort().map(function(key) {
+    var text = labels[key] ? key + '=' + labels[key] : key;
+    return h.span({cls: 'result-label', title: 'label:' + text}, [text]);
+  });
+}
+
+function renderLinkConfigs(linkConfigs, tree, version, path, lno, rev, backend) {
   linkConfigs = linkConfigs.filter(function(linkConfig) {
     return !linkConfig.whitelist_pattern ||
       linkConfig.whitelist_pattern.test(tree + ':' + version + ':' + path);
@@ -127,7 +177,9 @@ function renderLinkConfigs(linkConfigs, tree, version, path, lno) {
           tree,
           version,
           path,
-          lno
+          lno,
+          rev,
+          linkRevision(tree, backend)
         ),
       };
       if (linkConfig.target) {
@@ -207,7 +259,9 @@ var MatchView = Backbone.View.extend({
       this.model.get('tree'),
       this.model.get('version'),
       this.model.get('path'),
-      lno
+      lno,
+      revisionOf(this.model),
+      this.model.get('backend')
     );
 
     var matchElement = h.div({cls: classes.join(' ')}, [
@@ -237,7 +291,7 @@ var Match = Backbone.Model.extend({
     var version = this.get('version');
     var path = this.get('path');
     return {
-      id: tree + ':' + version + ':' + path,
+      id: (this.get('index') ? this.get('index') + ':' : '') + tree + ':' + version + ':' + path,
       tree: tree,
       version: version,
       path: path
@@ -248,7 +302,7 @@ var Match = Backbone.Model.extend({
     if (lno === undefined) {
       lno = this.get('lno');
     }
-    return url(this.get('tree'), this.get('version'), this.get('path'), lno);
+    return url(this.get('tree'), this.get('version'), this.get('path'), lno, this.get('backend'), revisionOf(this));
   },
 });
 
@@ -344,16 +398,17 @@ var FileMatch = Backbone.Model.extend({
     var version = this.get('version');
     var path = this.get('path');
     return {
-      id: tree + ':' + version + ':' + path,
+      id: (this.get('index') ? this.get('index') + ':' : '') + tree + ':' + version + ':' + path,
       tree: tree,
       version: version,
       path: path,
-      bounds: this.get('bounds')
+      bounds: this.get('bounds'),
+      spans: this.get('spans') || [this.get('bounds')]
     }
   },
 
   url: function() {
-    return url(this.get('tree'), this.get('version'), this.get('path'));
+    return url(this.get('tree'), this.get('version'), this.get('path'), undefined, this.get('backend'), revisionOf(this));
   },
 });
 
@@ -362,23 +417,22 @@ var FileMatchView = Backbone.View.extend({
 
   render: function() {
     var path_info = this.model.path_info();
-    var pieces = [
-      path_info.path.substring(0, path_info.bounds[0]),
-      path_info.path.substring(path_info.bounds[0], path_info.bounds[1]),
-      path_info.path.substring(path_info.bounds[1])
-    ];
-    var repoLabel = [
+    var repoLabel = renderIndex(this.model.get('index')).concat([
       h.span({cls: "repo"}, [path_info.tree, ':']),
-      h.span({cls: "version"}, [shorten(path_info.version), ':']),
-      pieces[0],
-      h.span({cls: "matchstr"}, [pieces[1]]),
-      pieces[2]
-    ];
+      h.span({cls: "version"}, [shorten(path_info.version), ':'])
+    ]);
+    var pos = 0;
+    path_info.spans.forEach(function (span) {
+      repoLabel.push(path_info.path.substring(pos, span[0]));
+      repoLabel.push(h.span({cls: "matchstr"}, [path_info.path.substring(span[0], span[1])]));
+      pos = span[1];
+    });
+    repoLabel.push(path_info.path.substring(pos));
 
     var el = this.$el;
     el.empty();
     el.addClass('filename-match');
-    el.append(h.a({cls: 'label header result-path', href: this.model.url()}, repoLabel));
+    el.append(h.a({cls: 'label header result-path', href: this.model.url(), title: freshness(this.model)}, repoLabel));
     return this;
   }
 });
@@ -391,7 +445,10 @@ var SearchState = Backbone.Model.extend({
       error: null,
       search_type: "",
       time: null,
-      why: null
+      why: null,
+      unavailable: [],
+      auto_mode: null,
+      languages: {}
     };
   },
 
@@ -407,7 +464,10 @@ var SearchState = Backbone.Model.extend({
     this.set({
         error: null,
         time: null,
-        why: null
+        why: null,
+        unavailable: [],
+        auto_mode: null,
+        languages: {}
     });
     this.search_results.reset();
     this.file_search_results.reset();
@@ -427,7 +487,9 @@ var SearchState = Backbone.Model.extend({
         cur.q === search.q &&
         cur.fold_case === search.fold_case &&
         cur.regex === search.regex &&
+        cur.active === search.active &&
         cur.backend === search.backend &&
+        cur.version === search.version &&
         _.isEqual(cur.repo, search.repo)) {
       return false;
     }
@@ -437,8 +499,10 @@ var SearchState = Backbone.Model.extend({
       q: search.q,
       fold_case: search.fold_case,
       regex: search.regex,
+      active: search.active,
       backend: search.backend,
-      repo: search.repo
+      repo: search.repo,
+      version: search.version
     };
     if (!search.q.length) {
       this.set('displaying', id);
@@ -458,8 +522,12 @@ var SearchState = Backbone.Model.extend({
       q.q = current.q;
       q.fold_case = current.fold_case;
       q.regex = current.regex;
+      if (current.active)
+        q.active = current.active;
       q.context = this.get('context');
       q.repo = current.repo;
+      if (current.version)
+        q.version = current.version;
     }
 
     if (current.backend) {
@@ -490,7 +558,9 @@ var SearchState = Backbone.Model.extend({
       return false;
     this.set('displaying', search);
     var m = _.clone(match);
-    m.backend = this.search_map[search].backend;
+    // Results of a search of several indexes say which they're from.
+    m.index = match.backend;
+    m.backend = match.backend || this.search_map[search].backend;
     this.search_results.add_match(new Match(m));
   },
   handle_file_match: function (search, file_match) {
@@ -498,14 +568,16 @@ var SearchState = Backbone.Model.extend({
       return false;
     this.set('displaying', search);
     var fm = _.clone(file_match);
-    fm.backend = this.search_map[search].backend;
+    fm.index = file_match.backend;
+    fm.backend = file_match.backend || this.search_map[search].backend;
     this.file_search_results.add(new FileMatch(fm));
   },
-  handle_done: function (search, time, search_type, why) {
+  handle_done: function (search, time, search_type, why, unavailable, auto_mode, languages) {
     if (search < this.get('displaying'))
       return false;
     this.set('displaying', search);
-    this.set({time: time, search_type: search_type, why: why});
+    this.set({time: time, search_type: search_type, why: why, unavailable: unavailable, auto_mode: auto_mode,
+              languages: languages || {}});
     this.search_results.trigger('search-complete');
   }
 });
@@ -532,7 +604,7 @@ var FileGroupView = Backbone.View.extend({
         {cls: 'header-path'},
         [
           h.a(
-            {cls: 'result-path', href: first_match.url()},
+            {cls: 'result-path', href: first_match.url(), title: freshness(first_match)},
             [
               h.span({cls: "repo"}, [tree, ':']),
               h.span({cls: "version"}, [shorten(version), ':']),
@@ -542,9 +614,12 @@ var FileGroupView = Backbone.View.extend({
           ),
         ]
       ),
+      h.span({cls: 'header-labels'}, renderIndex(first_match.get('index')).concat(
+        renderLabels(first_match.get('labels')))),
       h.div(
         {cls: 'header-links'},
-        renderLinkConfigs(CodesearchUI.linkConfigs, tree, version, path, first_match.get('lno'))
+        renderLinkConfigs(CodesearchUI.linkConfigs, tree, version, path, first_match.get('lno'),
+                          revisionOf(first_match), first_match.get('backend'))
       ),
     ];
     return h.div({cls: 'header'}, headerChildren);
@@ -569,6 +644,7 @@ var MatchesView = Backbone.View.extend({
   el: $('#results'),
   events: {
     'click .file-extension': '_limitExtension',
+    'click .revision': '_limitRevision',
     'keydown': '_handleKey',
   },
   initialize: function() {
@@ -590,6 +666,14 @@ var MatchesView = Backbone.View.extend({
       }
     }
 
+    // And which revisions (main, release branches) the results are
+    // from, when more than one is indexed.
+    var revision_map = {};
+    var countRevision = function(model) {
+      var rev = model.get('branch') || model.get('version');
+      revision_map[rev] = (revision_map[rev] || 0) + 1;
+    }
+
     var pathResults = h.div({'cls': 'path-results'});
     var count = 0;
     this.model.file_search_results.each(function(file) {
@@ -598,6 +682,7 @@ var MatchesView = Backbone.View.extend({
         pathResults.append(view.render().el);
       }
       countExtension(file.attributes.path);
+      countRevision(file);
       count += 1;
     }, this);
     this.$el.append(pathResults);
@@ -607,6 +692,7 @@ var MatchesView = Backbone.View.extend({
       var view = new FileGroupView({model: file_group});
       this.$el.append(view.render().el);
       countExtension(file_group.path_info.path);
+      countRevision(file_group.matches[0]);
     }, this);
 
     var i = this.model.search_id;
@@ -614,6 +700,8 @@ var MatchesView = Backbone.View.extend({
     var already_file_limited = /\bfile:/.test(query);
     if (!already_file_limited)
       this._render_extension_buttons(extension_map);
+    if (!/\brev:/.test(query))
+      this._render_revision_buttons(revision_map);
 
     return this;
   },
@@ -644,6 +732,26 @@ var MatchesView = Backbone.View.extend({
     }
     this.$el.prepend(fileExtensions);
   },
+  _render_revision_buttons: function(revision_map) {
+    // Display a button for each revision among the current search
+    // results, that narrows the search to that revision.
+    var revisions = _.keys(revision_map);
+    if (revisions.length < 2)
+      return;
+    revisions.sort();
+
+    var buttons = h.div({'cls': 'revisions'}, ['Revision:']);
+    for (var i=0; i < revisions.length; i++)
+      buttons.append(h.button({'cls': 'revision', 'data-revision': revisions[i]}, [shorten(revisions[i])]));
+    this.$el.prepend(buttons);
+  },
+  _limitRevision: function(e) {
+    var rev = $(e.target).attr('data-revision');
+    if (CodesearchUI.input_regex.is(':checked'))
+      rev = rev.replace(/[.*+?^${}()|[\]\\]/g, '\\$&');
+    CodesearchUI.input.val('rev:' + rev + ' ' + CodesearchUI.input.val());
+    CodesearchUI.newsearch();
+  },
   _limitExtension: function(e) {
     var ext = e.target.textContent;
     var q = CodesearchUI.input.val();
@@ -684,6 +792,9 @@ var ResultView = Backbone.View.extend({
     this.results      = this.$('#numresults');
     this.errorbox     = $('#regex-error');
     this.time         = this.$('#searchtime');
+    this.incomplete   = this.$('#incomplete');
+    this.automode     = this.$('#automode');
+    this.languages    = this.$('#languages');
     this.last_url     = null;
     this.last_title   = null;
 
@@ -765,7 +876,57 @@ var ResultView = Backbone.View.extend({
       results = results + '+';
     this.results.text(results);
 
+    var unavailable = this.model.get('unavailable');
+    if (unavailable && unavailable.length) {
+      this.incomplete.text('Results incomplete: ' + unavailable.map(function (u) {
+        return u.backend + ' unavailable (' + u.error + ')';
+      }).join(', '));
+      this.incomplete.show();
+    } else {
+      this.incomplete.hide();
+    }
+
+    // With regex:auto, say which way the query was read, since that
+    // explains what it matched.
+    var auto_mode = this.model.get('auto_mode');
+    if (auto_mode) {
+      this.automode.text(auto_mode == 'literal' ?
+        'Searched for the literal text (add regex:yes to search with a regex)' :
+        'Searched with a regex (add regex:no to search for the literal text)');
+      this.automode.show();
+    } else {
+      this.automode.hide();
+    }
+
+    this.render_languages();
+
     return this;
+  },
+
+  // The languages of the files the results are in, most files first,
+  // each narrowing the search to it when clicked.
+  render_languages: function() {
+    var languages = this.model.get('languages') || {};
+    var names = _.keys(languages).sort(function(a, b) {
+      return languages[b] - languages[a] || (a < b ? -1 : 1);
+    });
+    this.languages.empty();
+    if (names.length < 2) {
+      this.languages.hide();
+      return;
+    }
+    var self = this;
+    names.forEach(function(name) {
+      var chip = $('<a href="#" class="language-facet">')
+        .text(name + ' ' + languages[name])
+        .attr('title', 'Search only ' + name + ' files (lang:' + name + ')');
+      chip.click(function(e) {
+        e.preventDefault();
+        CodesearchUI.add_query_atom('lang:' + name);
+      });
+      self.languages.append(chip);
+    });
+    this.languages.show();
   }
 });
 
@@ -781,12 +942,15 @@ var CodesearchUI = function() {
 
       CodesearchUI.input      = $('#searchbox');
       CodesearchUI.input_repos = $('#repos');
+      CodesearchUI.input_version = $('#version');
       CodesearchUI.input_backend = $('#backend');
       if (CodesearchUI.input_backend.length == 0)
         CodesearchUI.input_backend = null;
       CodesearchUI.inputs_case = $('input[name=fold_case]');
       CodesearchUI.input_regex = $('input[name=regex]');
+      CodesearchUI.input_active = $('input[name=active]');
       CodesearchUI.input_context = $('input[name=context]');
+      CodesearchUI.input_link_revision = $('#link-revision');
 
       if (CodesearchUI.inputs_case.filter(':checked').length == 0) {
           CodesearchUI.inputs_case.filter('[value=auto]').attr('checked', true);
@@ -794,6 +958,7 @@ var CodesearchUI = function() {
 
       RepoSelector.init();
       CodesearchUI.update_repo_options();
+      CodesearchUI.update_version_options();
 
       CodesearchUI.init_query();
 
@@ -805,20 +970,29 @@ var CodesearchUI = function() {
 
       CodesearchUI.inputs_case.change(CodesearchUI.keypress);
       CodesearchUI.input_regex.change(CodesearchUI.keypress);
+      CodesearchUI.input_active.change(CodesearchUI.keypress);
       CodesearchUI.input_repos.change(CodesearchUI.keypress);
+      CodesearchUI.input_version.change(CodesearchUI.keypress);
       CodesearchUI.input_context.change(CodesearchUI.toggle_context);
 
       CodesearchUI.input_regex.change(function(){
         CodesearchUI.set_pref('regex', CodesearchUI.input_regex.prop('checked'));
       });
+      CodesearchUI.input_active.change(function(){
+        CodesearchUI.set_pref('active', CodesearchUI.input_active.prop('checked'));
+      });
       CodesearchUI.input_repos.change(function(){
         CodesearchUI.set_pref('repos', CodesearchUI.input_repos.val());
       });
       CodesearchUI.input_context.change(function(){
         CodesearchUI.set_pref('context', CodesearchUI.input_context.prop('checked'));
       });
+      CodesearchUI.init_link_revision();
+      CodesearchUI.input_link_revision.change(CodesearchUI.select_link_revision);
 
       CodesearchUI.toggle_context();
+      if (CodesearchUI.savedSearches)
+        SavedSearches.init(CodesearchUI.current_search);
 
       Codesearch.connect(CodesearchUI);
       $('.query-hint code').click(function(e) {
@@ -841,6 +1015,18 @@ var CodesearchUI = function() {
         CodesearchUI.newsearch();
       }
     },
+    // The link revision is a display preference, not part of the query,
+    // so it comes from the user's prefs even when the URL has a query.
+    init_link_revision: function() {
+      var prefs = Cookies.getJSON('prefs') || {};
+      CodesearchUI.link_revision = prefs['link_revision'] || '';
+      CodesearchUI.input_link_revision.val(CodesearchUI.link_revision);
+    },
+    select_link_revision: function() {
+      CodesearchUI.link_revision = CodesearchUI.input_link_revision.val() || '';
+      CodesearchUI.set_pref('link_revision', CodesearchUI.link_revision);
+      CodesearchUI.state.search_results.trigger('rerender');
+    },
     toggle_context: function(){
       CodesearchUI.state.set('context', CodesearchUI.input_context.prop('checked'));
     },
@@ -878,6 +1064,8 @@ var CodesearchUI = function() {
         CodesearchUI.input_regex.prop('checked', parms.regex[0] === "true");
       }
 
+      CodesearchUI.input_active.prop('checked', !!(parms.active && parms.active[0]));
+
       if (parms.context) {
         CodesearchUI.input_context.prop('checked', parms.context[0] === 'true');
       }
@@ -909,6 +1097,10 @@ var CodesearchUI = function() {
       if (parms['repo[]'])
         repos = repos.concat(parms['repo[]']);
       RepoSelector.updateSelected(repos);
+
+      CodesearchUI.input_version.val(parms.version ? parms.version[0] : '');
+      if (CodesearchUI.input_version.val() === null)
+        CodesearchUI.input_version.val('');
     },
     init_controls_from_prefs: function() {
       var prefs = Cookies.getJSON('prefs');
@@ -918,6 +1110,9 @@ var CodesearchUI = function() {
       if (prefs['regex'] !== undefined) {
         CodesearchUI.input_regex.prop('checked', prefs['regex']);
       }
+      if (prefs['active'] !== undefined) {
+        CodesearchUI.input_active.prop('checked', prefs['active']);
+      }
       if (prefs['repos'] !== undefined) {
         RepoSelector.updateSelected(prefs['repos']);
       } else if (CodesearchUI.defaultSearchRepos !== undefined) {
@@ -961,6 +1156,7 @@ var CodesearchUI = function() {
       if (!CodesearchUI.input_backend)
         return;
       CodesearchUI.update_repo_options();
+      CodesearchUI.update_version_options();
       CodesearchUI.keypress();
     },
     update_repo_options: function(repos) {
@@ -969,6 +1165,27 @@ var CodesearchUI = function() {
       var backend = CodesearchUI.input_backend.val();
       RepoSelector.updateOptions(_.keys(CodesearchUI.repo_urls[backend]));
     },
+    // Lists the tags indexed on the selected backend in the version
+    // selector, which is hidden if there are none.
+    update_version_options: function() {
+      if (!CodesearchUI.input_backend)
+        return;
+      var versions = CodesearchUI.versions[CodesearchUI.input_backend.val()] || [];
+      var selected = CodesearchUI.input_version.val();
+      CodesearchUI.input_version.find('option[value!=""]').remove();
+      _.each(versions, function(v) {
+        CodesearchUI.input_version.append($('<option>').attr('value', v).text(v));
+      });
+      CodesearchUI.input_version.val(_.contains(versions, selected) ? selected : '');
+      $('#version-option').toggle(versions.length > 0);
+    },
+    // Adds atom, such as lang:go, to the query and searches again.
+    add_query_atom: function(atom) {
+      var q = CodesearchUI.input.val();
+      if ((' ' + q + ' ').indexOf(' ' + atom + ' ') < 0)
+        CodesearchUI.input.val((q + ' ' + atom).trim());
+      CodesearchUI.newsearch();
+    },
     keypress: function() {
       CodesearchUI.clear_timer();
       CodesearchUI.timer = setTimeout(CodesearchUI.newsearch, 100);
@@ -979,13 +1196,27 @@ var CodesearchUI = function() {
         q: CodesearchUI.input.val(),
         fold_case: CodesearchUI.inputs_case.filter(':checked').val(),
         regex: CodesearchUI.input_regex.is(':checked'),
-        repo: CodesearchUI.input_repos.val()
+        active: CodesearchUI.input_active.is(':checked') ? CodesearchUI.activeWindow : '',
+        repo: CodesearchUI.input_repos.val(),
+        version: CodesearchUI.input_version.val()
       };
       if (CodesearchUI.input_backend)
         search.backend = CodesearchUI.input_backend.val();
       if (CodesearchUI.state.dispatch(search))
         Codesearch.new_search(search);
     },
+    // The search on the page, as /api/v2/saved saves it
+    current_search: function() {
+      var search = {
+        q: CodesearchUI.input.val(),
+        fold_case: CodesearchUI.inputs_case.filter(':checked').val(),
+        regex: CodesearchUI.input_regex.is(':checked'),
+        repos: CodesearchUI.input_repos.val() || []
+      };
+      if (CodesearchUI.input_backend)
+        search.backend = CodesearchUI.input_backend.val();
+      return search;
+    },
     clear_timer: function() {
       if (CodesearchUI.timer) {
         clearTimeout(CodesearchUI.timer);
@@ -1001,16 +1232,31 @@ var CodesearchUI = function() {
     file_match: function(search, file_match) {
       CodesearchUI.state.handle_file_match(search, file_match);
     },
-    search_done: function(search, time, search_type, why) {
-      CodesearchUI.state.handle_done(search, time, search_type, why);
+    search_done: function(search, time, search_type, why, unavailable, auto_mode, languages) {
+      CodesearchUI.state.handle_done(search, time, search_type, why, unavailable, auto_mode, languages);
     },
-    repo_urls: {}
+    repo_urls: {},
+    link_revisions: {},
+    // The user's choice of what to link files at, from the search
+    // options; "" to leave it to each repository.
+    link_revision: '',
+    versions: {},
+    features: [],
+    // Whether the feature flag name is on for this user.
+    feature: function(name) {
+      return _.contains(CodesearchUI.features, name);
+    }
   };
 }();
 
 CodesearchUI.repo_urls = initData.repo_urls;
+CodesearchUI.link_revisions = initData.link_revisions || {};
+CodesearchUI.versions = initData.versions || {};
+CodesearchUI.features = initData.features || [];
 CodesearchUI.internalViewRepos = initData.internal_view_repos;
 CodesearchUI.defaultSearchRepos = initData.default_search_repos;
+CodesearchUI.activeWindow = initData.active_window;
+CodesearchUI.savedSearches = initData.saved_searches;
 CodesearchUI.linkConfigs = (initData.link_configs || []).map(function(link_config) {
   if (link_config.whitelist_pattern) {
     link_config.whitelist_pattern = new RegExp(link_config.whitelist_pattern);
@@ -1018,6 +1264,9 @@ CodesearchUI.linkConfigs = (initData.link_configs || []).map(function(link_confi
   return link_config;
 });
 CodesearchUI.onload();
+// Quick-open lists files the file viewer can show
+if (!$.isEmptyObject(CodesearchUI.internalViewRepos || {}))
+  QuickOpen.init();
 }
 
 module.exports = {
@@ -0,0 +1,131 @@
+var $ = require('jquery');
+
+// The saved searches panel lists the searches the user has saved, with
+// the short link to share each by, and saves the search on the page
+// under a name, from /api/v2/saved.
+
+function errorMessage(xhr) {
+  var err = xhr.responseJSON && xhr.responseJSON.error;
+  return err ? err.message : 'Saved searches are unavailable';
+}
+
+function SavedSearches(currentSearch) {
+  this.currentSearch = currentSearch;
+
+  this.overlay = $('<section class="saved-searches u-modal-overlay hidden">');
+  var card = $('<div class="saved-searches-card u-modal-content">');
+  this.form = $('<form class="saved-searches-save">');
+  this.name = $('<input type="text" maxlength="100" required="required">')
+    .attr('placeholder', 'Name the search on this page');
+  this.form.append(this.name, $('<button type="submit">').text('save'));
+  this.status = $('<div class="saved-searches-status">');
+  this.list = $('<ul class="saved-searches-list">');
+  card.append(this.form, this.status, this.list);
+  this.overlay.append(card);
+  $('body').append(this.overlay);
+
+  var self = this;
+  this.overlay.on('click', function(event) {
+    if (event.target === self.overlay[0])
+      self.close();
+  });
+  this.overlay.on('keydown', function(event) {
+    if (event.which === 27) // escape
+      self.close();
+  });
+  this.form.on('submit', function(event) {
+    event.preventDefault();
+    self.save();
+  });
+  this.list.on('click', '.saved-search-delete', function() {
+    self.remove($(this).closest('li').data('id'));
+  });
+  this.list.on('focus click', '.saved-search-link', function() {
+    this.select();
+  });
+}
+
+SavedSearches.prototype.show = function() {
+  this.overlay.removeClass('hidden');
+  this.status.text('');
+  this.name.focus();
+  this.load();
+};
+
+SavedSearches.prototype.close = function() {
+  this.overlay.addClass('hidden');
+};
+
+SavedSearches.prototype.load = function() {
+  var self = this;
+  $.getJSON('/api/v2/saved')
+    .done(function(reply) { self.render(reply.searches); })
+    .fail(function(xhr) { self.status.text(errorMessage(xhr)); });
+};
+
+SavedSearches.prototype.render = function(searches) {
+  this.list.empty();
+  if (!searches.length) {
+    this.list.append($('<li class="saved-searches-empty">').text('No saved searches yet'));
+    return;
+  }
+  for (var i = 0; i < searches.length; i++) {
+    var s = searches[i];
+    var item = $('<li>').data('id', s.id);
+    item.append(
+      $('<a class="saved-search-name">').attr('href', s.url).text(s.name),
+      $('<code class="saved-search-query">').text(s.q),
+      $('<input type="text" class="saved-search-link" readonly="readonly">')
+        .val(window.location.origin + s.url),
+      $('<button type="button" class="saved-search-delete">').text('delete'));
+    this.list.append(item);
+  }
+};
+
+SavedSearches.prototype.save = function() {
+  var search = this.currentSearch();
+  search.name = this.name.val();
+  var self = this;
+  $.ajax({
+    method: 'POST',
+    url: '/api/v2/saved',
+    contentType: 'application/json',
+    data: JSON.stringify(search),
+    dataType: 'json'
+  }).done(function(saved) {
+    self.name.val('');
+    self.status.text('Saved "' + saved.name + '"');
+    self.load();
+  }).fail(function(xhr) {
+    self.status.text(errorMessage(xhr));
+  });
+};
+
+SavedSearches.prototype.remove = function(id) {
+  var self = this;
+  $.ajax({
+    method: 'DELETE',
+    url: '/api/v2/saved/' + encodeURIComponent(id)
+  }).done(function() {
+    self.load();
+  }).fail(function(xhr) {
+    self.status.text(errorMessage(xhr));
+  });
+};
+
+// init shows the saved searches button, which opens the panel.
+// currentSearch returns the search on the page, as /api/v2/saved takes
+// it.
+function init(currentSearch) {
+  var panel = null;
+  $('#saved-searches-option').show();
+  $('#saved-searches-button').on('click', function() {
+    if (!panel)
+      panel = new SavedSearches(currentSearch);
+    panel.show();
+  });
+}
+
+module.exports = {
+  init: init
+};
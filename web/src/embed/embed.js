@@ -0,0 +1,178 @@
+var $ = require('jquery');
+
+// The search widget served at /embed, which runs in a frame on another
+// site. It keeps to what fits in a small box: a search input, and one
+// line per match that links to the file.
+
+var DEBOUNCE_MS = 200;
+
+// The origin of the page the widget is framed in, if it may be sent
+// messages: livegrep itself or one of the configured origins.
+function parentOrigin(origins) {
+  if (window.parent === window || !document.referrer)
+    return null;
+  var origin = document.referrer.split('/').slice(0, 3).join('/');
+  if (origin === window.location.origin)
+    return origin;
+  for (var i = 0; i < origins.length; i++) {
+    if (origins[i] === '*' || origins[i].toLowerCase() === origin.toLowerCase())
+      return origin;
+  }
+  return null;
+}
+
+function shorten(ref) {
+  var match = /^refs\/(tags|branches)\/(.*)/.exec(ref);
+  if (match)
+    return match[2];
+  match = /^([0-9a-f]{8})[0-9a-f]+$/.exec(ref);
+  if (match)
+    return match[1];
+  return ref;
+}
+
+// The link to a match: the file viewer if the repository is browsable
+// here, else its page on the code host, as on the search page.
+function resultUrl(data, r) {
+  var path = r.path.replace(/^\/+/, '');
+  if (r.tree in data.internal_view_repos)
+    return '/view/' + r.tree + '/' + path + '#L' + r.lno;
+  var urls = data.repo_urls[data.backend] || {};
+  var url = urls[r.tree];
+  if (!url)
+    return null;
+  var revs = data.link_revisions[data.backend] || {};
+  var linked = r.version;
+  if (revs[r.tree] === 'commit' && r.commit)
+    linked = r.commit;
+  else if (revs[r.tree] === 'branch' && r.branch)
+    linked = r.branch;
+  url = url.replace(/{lno}/g, r.lno);
+  url = url.replace(/{version}/g, shorten(linked));
+  url = url.replace(/{sha}/g, r.commit || r.version);
+  url = url.replace(/{branch}/g, shorten(r.branch || r.version));
+  url = url.replace(/{name}/g, r.tree);
+  url = url.replace(/{basename}/g, r.tree.split('/')[1]);
+  url = url.replace(/{path}/g, path);
+  return url;
+}
+
+function renderLine(r) {
+  var code = $('<code>');
+  var line = r.line;
+  code.append(document.createTextNode(line.substring(0, r.bounds[0])));
+  code.append($('<span class="matchstr">').text(line.substring(r.bounds[0], r.bounds[1])));
+  code.append(document.createTextNode(line.substring(r.bounds[1])));
+  return code;
+}
+
+function init(data) {
+  var origin = parentOrigin(data.origins || []);
+  var $input = $('#embed-searchbox');
+  var $results = $('#embed-results');
+  var $status = $('#embed-status');
+  var $more = $('#embed-more');
+  var timer = null;
+  var seq = 0;
+
+  function post(msg) {
+    if (!origin)
+      return;
+    msg.source = 'livegrep';
+    window.parent.postMessage(msg, origin);
+  }
+
+  function resize() {
+    post({type: 'resize', height: document.body.scrollHeight});
+  }
+
+  function fullQuery(text) {
+    return data.scope ? data.scope + ' ' + text : text;
+  }
+
+  function render(text, reply) {
+    $results.empty();
+    reply.results.forEach(function(r) {
+      var url = resultUrl(data, r);
+      var $a = $('<a>').attr('href', url || '#');
+      if (data.open === 'tab')
+        $a.attr('target', '_blank').attr('rel', 'noopener');
+      else if (data.open === 'top')
+        $a.attr('target', '_top');
+      $a.append($('<span class="result-path">')
+                .append($('<span class="repo">').text(r.tree + ':'))
+                .append(document.createTextNode(r.path + ':' + r.lno)));
+      $a.append(renderLine(r));
+      $a.on('click', function(e) {
+        post({
+          type: 'navigate',
+          url: url ? this.href : null,
+          tree: r.tree,
+          version: r.version,
+          path: r.path,
+          line_number: r.lno
+        });
+        if (!url || data.open === 'none')
+          e.preventDefault();
+      });
+      $results.append($('<li>').append($a));
+    });
+    var n = reply.results.length;
+    $status.text(n === 0 ? 'No matches' :
+                 reply.info.why === 'MATCH_LIMIT' ? 'First ' + n + ' matches' :
+                 n + (n === 1 ? ' match' : ' matches'));
+    $more.attr('href', '/search/' + data.backend + '?q=' + encodeURIComponent(fullQuery(text))).show();
+    resize();
+  }
+
+  function search() {
+    var text = $input.val().trim();
+    var id = ++seq;
+    if (text === '') {
+      $results.empty();
+      $status.text('');
+      $more.hide();
+      resize();
+      return;
+    }
+    $.ajax({
+      method: 'POST',
+      url: '/api/v1/search/' + data.backend,
+      data: {q: fullQuery(text), max_matches: data.max_matches},
+      dataType: 'json'
+    }).done(function(reply) {
+      if (id === seq)
+        render(text, reply);
+    }).fail(function(xhr) {
+      if (id !== seq)
+        return;
+      var message = 'Cannot connect to server';
+      try {
+        message = JSON.parse(xhr.responseText).error.message;
+      } catch (e) {}
+      $results.empty();
+      $status.text(message);
+      $more.hide();
+      resize();
+    });
+  }
+
+  if (data.scope)
+    $('#embed-scope').text('Searching ' + data.scope);
+  $input.val(data.query);
+  $input.on('input', function() {
+    clearTimeout(timer);
+    timer = setTimeout(search, DEBOUNCE_MS);
+  });
+  $('#embed-form').on('submit', function(e) {
+    e.preventDefault();
+    clearTimeout(timer);
+    search();
+  });
+  search();
+  $input.focus();
+}
+
+module.exports = {
+  init: init
+};
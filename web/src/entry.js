@@ -2,7 +2,9 @@ $ = require('jquery');
 
 pages = {
   codesearch: require('codesearch/codesearch_ui.js'),
-  fileview: require('fileview/fileview.js')
+  embed: require('embed/embed.js'),
+  fileview: require('fileview/fileview.js'),
+  stats: require('stats/stats.js')
 };
 
 $(function(){
@@ -0,0 +1,114 @@
+var $ = require('jquery');
+
+// Blame shows, beside each line of the file, the commit that last changed
+// it, shaded by age so that the newest lines stand out; history lists
+// the commits that changed the file. Both come from the frontend's
+// /api/v2/blame and /api/v2/history, and link each commit to the
+// repository's forge where it is known.
+
+function formatDate(unix) {
+  return new Date(unix * 1000).toISOString().substring(0, 10);
+}
+
+function commitLink(commit, text) {
+  var el = commit.url ? $('<a>').attr('href', commit.url) : $('<span>');
+  return el.text(text).attr('title', commit.author + ', ' + formatDate(commit.author_time) + ': ' + commit.summary);
+}
+
+function errorMessage(xhr, what) {
+  var err = xhr.responseJSON && xhr.responseJSON.error;
+  return err ? err.message : what + ' failed';
+}
+
+function Blame(initData) {
+  this.params = {
+    repo: initData.repo_info.name,
+    path: initData.file_path,
+    commit: initData.commit_hash || initData.commit
+  };
+  this.root = $('.file-content');
+  this.gutter = null;
+  this.history = null;
+}
+
+Blame.prototype.toggle = function() {
+  if (this.gutter) {
+    this.root.toggleClass('with-blame');
+    return;
+  }
+  this.gutter = $('<div class="blame-gutter">').text('Blaming...');
+  this.root.addClass('with-blame').prepend(this.gutter);
+  var self = this;
+  $.getJSON('/api/v2/blame', this.params)
+    .done(function(reply) { self.render(reply); })
+    .fail(function(xhr) { self.gutter.text(errorMessage(xhr, 'Blaming the file')); });
+};
+
+Blame.prototype.render = function(reply) {
+  var min = Infinity, max = -Infinity;
+  $.each(reply.commits, function(hash, c) {
+    min = Math.min(min, c.author_time);
+    max = Math.max(max, c.author_time);
+  });
+
+  this.gutter.empty();
+  for (var i = 0; i < reply.hunks.length; i++) {
+    var hunk = reply.hunks[i];
+    var commit = reply.commits[hunk.commit];
+    // 0 for the oldest commit in the file, 1 for the newest
+    var age = max > min ? (commit.author_time - min) / (max - min) : 1;
+    var block = $('<div class="blame-hunk">')
+      .css('background-color', 'rgba(255, 140, 0, ' + (0.05 + 0.3 * age).toFixed(2) + ')');
+    for (var j = 0; j < hunk.lines; j++) {
+      // A space keeps the lines without a label as tall as the file's
+      var line = $('<div class="blame-line">').text('\u00a0');
+      if (j === 0) {
+        line.empty().append(
+          commitLink(commit, commit.hash.substring(0, 8)).addClass('blame-commit'),
+          $('<span class="blame-date">').text(formatDate(commit.author_time)),
+          $('<span class="blame-author">').text(commit.author));
+      }
+      block.append(line);
+    }
+    this.gutter.append(block);
+  }
+};
+
+Blame.prototype.toggleHistory = function() {
+  if (this.history) {
+    this.history.toggleClass('hidden');
+    return;
+  }
+  this.history = $('<section class="file-history u-modal-overlay">');
+  var card = $('<div class="file-history-card u-modal-content">').text('Loading the history...');
+  this.history.append(card);
+  $('body').append(this.history);
+  var self = this;
+  this.history.on('click', function(event) {
+    if (event.target === self.history[0])
+      self.history.addClass('hidden');
+  });
+  $.getJSON('/api/v2/history', this.params)
+    .done(function(reply) {
+      var list = $('<ul class="file-history-commits">');
+      reply.commits.forEach(function(c) {
+        list.append($('<li>').append(
+          commitLink(c, c.hash.substring(0, 8)).addClass('blame-commit'),
+          $('<span class="blame-date">').text(formatDate(c.author_time)),
+          $('<span class="blame-author">').text(c.author),
+          $('<span class="file-history-summary">').text(c.summary)));
+      });
+      card.empty().append(list);
+    })
+    .fail(function(xhr) { card.text(errorMessage(xhr, 'Loading the history')); });
+};
+
+Blame.prototype.hideHistory = function() {
+  if (this.history && !this.history.hasClass('hidden')) {
+    this.history.addClass('hidden');
+    return true;
+  }
+  return false;
+};
+
+module.exports = Blame;
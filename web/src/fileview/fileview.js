@@ -1,4 +1,7 @@
 $ = require('jquery');
+var Cookies = require('js-cookie');
+var QuickOpen = require('quickopen/quickopen.js');
+var Blame = require('fileview/blame.js');
 
 var KeyCodes = {
   ESCAPE: 27,
@@ -95,6 +98,8 @@ function init(initData) {
   var root = $('.file-content');
   var lineNumberContainer = root.find('.line-numbers');
   var helpScreen = $('.help-screen');
+  // Only files, not directories, have blame and history
+  var blame = initData.is_file ? new Blame(initData) : null;
 
   function doSearch(event, query, newTab) {
     var url;
@@ -110,6 +115,17 @@ function init(initData) {
     }
   }
 
+  // Jumps to where the selected symbol is defined, or to a list of its
+  // definitions if there are several.
+  function jumpToDefinition() {
+    var symbol = $.trim(getSelectedText() || '');
+    if (!symbol) {
+      return;
+    }
+    window.location.href = '/definition?repo=' + encodeURIComponent(initData.repo_info.name) +
+      '&symbol=' + encodeURIComponent(symbol);
+  }
+
   function showHelp() {
     helpScreen.removeClass('hidden').children().on('click', function(event) {
       // Prevent clicks inside the element to reach the document
@@ -182,9 +198,19 @@ function init(initData) {
       filePath = filePath.replace(/^\/+/, '');
     }
 
+    // {version} is the revision the file is being viewed at, unless the
+    // user or the repository asks for links at its commit.
+    var prefs = Cookies.getJSON('prefs') || {};
+    var linkRevision = prefs['link_revision'] || initData.repo_info.metadata['link_revision'];
+    var version = initData.commit;
+    if (linkRevision === 'commit' && initData.commit_hash)
+      version = initData.commit_hash;
+
     // XXX code copied
     url = url.replace('{lno}', lno);
-    url = url.replace('{version}', initData.commit);
+    url = url.replace('{version}', version);
+    url = url.replace('{sha}', initData.commit_hash || initData.commit);
+    url = url.replace('{branch}', initData.commit);
     url = url.replace('{name}', repoName);
     url = url.replace('{path}', filePath);
     return url;
@@ -222,6 +248,9 @@ function init(initData) {
         event.preventDefault();
         hideHelp();
       }
+      if(blame && blame.hideHistory()) {
+        event.preventDefault();
+      }
       $('#query').blur();
     } else if(String.fromCharCode(event.which) == 'V') {
       // Visually highlight the external link to indicate what happened
@@ -240,6 +269,12 @@ function init(initData) {
       if (selectedText) {
         window.find(selectedText, false /* case sensitive */, goBackwards);
       }
+    } else if (String.fromCharCode(event.which) == 'D') {
+      jumpToDefinition();
+    } else if (String.fromCharCode(event.which) == 'B' && blame) {
+      blame.toggle();
+    } else if (String.fromCharCode(event.which) == 'L' && blame) {
+      blame.toggleHistory();
     }
     return true;
   }
@@ -250,6 +285,8 @@ function init(initData) {
     var ACTION_MAP = {
       search: doSearch,
       help: showHelp,
+      blame: function() { blame.toggle(); },
+      history: function() { blame.toggleHistory(); },
     };
 
     for(var actionName in ACTION_MAP) {
@@ -320,6 +357,7 @@ function init(initData) {
     });
 
     initializeActionButtons($('.header .header-actions'));
+    QuickOpen.init(initData.repo_info.name);
   }
 
   // The native browser handling of hashes in the location is to scroll
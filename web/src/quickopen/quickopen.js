@@ -0,0 +1,174 @@
+$ = require('jquery');
+
+// Quick-open finds a file by a fuzzy match against its path, from
+// /api/v2/files, and opens it in the file viewer.
+
+var KeyCodes = {
+  ESCAPE: 27,
+  ENTER: 13,
+  UP: 38,
+  DOWN: 40,
+  P: 80
+};
+
+// How many files to list, and how long to wait for typing to pause
+// before asking for them.
+var MAX_FILES = 20;
+var DEBOUNCE_MS = 75;
+
+function QuickOpen(prefer) {
+  this.prefer = prefer || '';
+  this.files = [];
+  this.selected = 0;
+  this.query = null;
+  this.timer = null;
+
+  this.overlay = $('<section class="quick-open u-modal-overlay hidden">');
+  var card = $('<div class="quick-open-card u-modal-content">');
+  this.input = $('<input type="text" class="quick-open-input" autocomplete="off" spellcheck="false">')
+    .attr('placeholder', 'Find a file by its path');
+  this.list = $('<ul class="quick-open-files">');
+  this.status = $('<div class="quick-open-status">');
+  card.append(this.input, this.list, this.status);
+  this.overlay.append(card);
+  $('body').append(this.overlay);
+
+  var self = this;
+  this.overlay.on('click', function(event) {
+    if (event.target === self.overlay[0])
+      self.close();
+  });
+  this.input.on('input', function() {
+    clearTimeout(self.timer);
+    self.timer = setTimeout(function() { self.fetch(); }, DEBOUNCE_MS);
+  });
+  this.input.on('keydown', function(event) {
+    switch (event.which) {
+      case KeyCodes.ESCAPE:
+        self.close();
+        break;
+      case KeyCodes.UP:
+        self.select(self.selected - 1);
+        break;
+      case KeyCodes.DOWN:
+        self.select(self.selected + 1);
+        break;
+      case KeyCodes.ENTER:
+        self.open(self.files[self.selected], event.ctrlKey || event.metaKey);
+        break;
+      default:
+        return;
+    }
+    event.preventDefault();
+  });
+  this.list.on('mouseenter', 'li', function() {
+    self.select($(this).index());
+  });
+  this.list.on('click', 'li', function(event) {
+    self.open(self.files[$(this).index()], event.ctrlKey || event.metaKey);
+  });
+}
+
+QuickOpen.prototype.show = function() {
+  this.overlay.removeClass('hidden');
+  this.input.focus().select();
+};
+
+QuickOpen.prototype.close = function() {
+  this.overlay.addClass('hidden');
+};
+
+QuickOpen.prototype.isOpen = function() {
+  return !this.overlay.hasClass('hidden');
+};
+
+QuickOpen.prototype.fetch = function() {
+  var query = this.input.val();
+  if (query === this.query)
+    return;
+  this.query = query;
+  if ($.trim(query) === '') {
+    this.render([], '');
+    return;
+  }
+
+  var self = this;
+  $.getJSON('/api/v2/files', {q: query, repo: this.prefer, limit: MAX_FILES})
+    .done(function(reply) {
+      // Drop replies to queries typed over since
+      if (query !== self.query)
+        return;
+      self.render(reply.files, reply.files.length ? '' : 'No files match');
+    })
+    .fail(function(xhr) {
+      if (query !== self.query)
+        return;
+      var err = xhr.responseJSON && xhr.responseJSON.error;
+      self.render([], err ? err.message : 'Finding files failed');
+    });
+};
+
+QuickOpen.prototype.render = function(files, status) {
+  this.files = files;
+  this.list.empty();
+  for (var i = 0; i < files.length; i++) {
+    var file = files[i];
+    var path = $('<span class="quick-open-path">');
+    var pos = 0;
+    file.spans.forEach(function(span) {
+      path.append(document.createTextNode(file.path.substring(pos, span[0])));
+      path.append($('<span class="matchstr">').text(file.path.substring(span[0], span[1])));
+      pos = span[1];
+    });
+    path.append(document.createTextNode(file.path.substring(pos)));
+    this.list.append($('<li>').append(
+      $('<span class="quick-open-repo">').text(file.repo + ':'), path));
+  }
+  this.status.text(status);
+  this.select(0);
+};
+
+QuickOpen.prototype.select = function(i) {
+  if (!this.files.length)
+    return;
+  this.selected = Math.max(0, Math.min(i, this.files.length - 1));
+  var items = this.list.children();
+  items.removeClass('selected');
+  var item = items.eq(this.selected).addClass('selected')[0];
+  if (item.scrollIntoView)
+    item.scrollIntoView({block: 'nearest'});
+};
+
+QuickOpen.prototype.open = function(file, newTab) {
+  if (!file)
+    return;
+  var url = '/view/' + file.repo + '/' + file.path.split('/').map(encodeURIComponent).join('/');
+  if (newTab) {
+    window.open(url);
+  } else {
+    window.location.href = url;
+  }
+};
+
+// init binds ctrl+p, or cmd+p on a Mac, to open quick-open. Files in the
+// repository prefer, if given, are listed first.
+function init(prefer) {
+  var quickOpen = null;
+  $(document).on('keydown', function(event) {
+    if (event.which !== KeyCodes.P || !(event.ctrlKey || event.metaKey) || event.altKey || event.shiftKey)
+      return;
+    // Rather than the browser's print dialog
+    event.preventDefault();
+    if (!quickOpen)
+      quickOpen = new QuickOpen(prefer);
+    if (quickOpen.isOpen()) {
+      quickOpen.close();
+    } else {
+      quickOpen.show();
+    }
+  });
+}
+
+module.exports = {
+  init: init
+};
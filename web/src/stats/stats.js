@@ -0,0 +1,77 @@
+var $ = require('jquery');
+
+// The statistics page shows /api/v2/stats: what people search for, which
+// searches find nothing or stop short, and how long searches take. The
+// admin token it asks for is kept for the rest of the browser session.
+
+var TOKEN_KEY = 'livegrep-admin-token';
+
+var LISTS = [
+  ['top_queries', 'Top queries'],
+  ['zero_result_queries', 'Queries that found nothing'],
+  ['truncated_queries', 'Queries that stopped at a limit'],
+  ['top_repos', 'Most viewed repositories'],
+  ['top_files', 'Most viewed files']
+];
+
+function renderList(title, entries) {
+  var section = $('<section class="stats-list">').append($('<h3>').text(title));
+  if (!entries.length) {
+    return section.append($('<p class="stats-empty">').text('None yet'));
+  }
+  var table = $('<table>');
+  entries.forEach(function(e) {
+    table.append($('<tr>').append(
+      $('<td class="stats-count">').text(e.count),
+      $('<td>').append($('<code>').text(e.key))));
+  });
+  return section.append(table);
+}
+
+function render(report) {
+  var out = $('#stats-report').empty();
+  var latency = [];
+  ['p50', 'p90', 'p95', 'p99'].forEach(function(p) {
+    if (p in report.latency_ms)
+      latency.push(p + ' ' + report.latency_ms[p] + 'ms');
+  });
+  out.append($('<p class="stats-summary">').text(
+    report.searches + ' searches since ' + new Date(report.since).toLocaleString() +
+      (latency.length ? '; latency ' + latency.join(', ') : '')));
+  LISTS.forEach(function(l) {
+    out.append(renderList(l[1], report[l[0]] || []));
+  });
+}
+
+function load(token) {
+  $('#stats-status').text('Loading...');
+  $.ajax({
+    url: '/api/v2/stats',
+    headers: {Authorization: 'Bearer ' + token},
+    dataType: 'json'
+  }).done(function(report) {
+    sessionStorage.setItem(TOKEN_KEY, token);
+    $('#stats-token').hide();
+    $('#stats-status').text('');
+    render(report);
+  }).fail(function(xhr) {
+    sessionStorage.removeItem(TOKEN_KEY);
+    $('#stats-token').show();
+    var err = xhr.responseJSON && xhr.responseJSON.error;
+    $('#stats-status').text(err ? err.message : 'Loading the statistics failed');
+  });
+}
+
+function init() {
+  $('#stats-token').on('submit', function(event) {
+    event.preventDefault();
+    load($('#stats-token-input').val());
+  });
+  var token = sessionStorage.getItem(TOKEN_KEY);
+  if (token)
+    load(token);
+}
+
+module.exports = {
+  init: init
+};